@@ -0,0 +1,293 @@
+// Command cborgen generates CBOR encoders and decoders for the WebSocket
+// event values, so CBOR clients are served straight from the structs
+// instead of through interface{} trees.
+//
+// Every exported struct whose name ends in Value, and every struct such a
+// struct holds, gets an AppendCBOR and an UnmarshalCBOR method. Fields are
+// keyed by their json name and honour omitempty, so an event has the same
+// shape in either encoding. Supported field types are string, bool, the
+// integer types, map[string]string and slices of generated structs.
+//
+//	go run ./cmd/cborgen -out internal/realtime/events_cbor.go internal/realtime/events.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type field struct {
+	goName    string
+	key       string
+	omitempty bool
+	kind      string // string, bool, int, uint, stringmap or slice
+	goType    string // the Go type, or the element type of a slice
+}
+
+type codec struct {
+	name   string
+	fields []field
+}
+
+func main() {
+	out := flag.String("out", "", "output .go path (stdout if empty)")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Fatal("usage: cborgen -out file.go <go files...>")
+	}
+
+	src, err := generate(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate returns the codecs of the structs declared in paths, which
+// must belong to one package.
+func generate(paths []string) ([]byte, error) {
+	var pkg string
+	structs := map[string]*ast.StructType{}
+	fset := token.NewFileSet()
+	for _, path := range paths {
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		pkg = f.Name.Name
+		collect(f, structs)
+	}
+	codecs, err := codecs(structs)
+	if err != nil {
+		return nil, err
+	}
+	return render(pkg, codecs)
+}
+
+// collect adds the exported struct types declared in f to structs.
+func collect(f *ast.File, structs map[string]*ast.StructType) {
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			s := spec.(*ast.TypeSpec)
+			if st, ok := s.Type.(*ast.StructType); ok && s.Name.IsExported() {
+				structs[s.Name.Name] = st
+			}
+		}
+	}
+}
+
+// codecs returns a codec for every Value struct and the structs they
+// hold, sorted by name.
+func codecs(structs map[string]*ast.StructType) ([]codec, error) {
+	var queue []string
+	for name := range structs {
+		if strings.HasSuffix(name, "Value") {
+			queue = append(queue, name)
+		}
+	}
+	done := map[string]bool{}
+	var out []codec
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if done[name] {
+			continue
+		}
+		done[name] = true
+		st, ok := structs[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a struct declared in the input", name)
+		}
+		c, err := structCodec(name, st)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range c.fields {
+			if f.kind == "slice" {
+				queue = append(queue, f.goType)
+			}
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].name < out[b].name })
+	return out, nil
+}
+
+func structCodec(name string, st *ast.StructType) (codec, error) {
+	c := codec{name: name}
+	for _, f := range st.Fields.List {
+		if f.Tag == nil || len(f.Names) == 0 {
+			continue
+		}
+		tag, err := strconv.Unquote(f.Tag.Value)
+		if err != nil {
+			continue
+		}
+		jsonTag := reflect.StructTag(tag).Get("json")
+		if jsonTag == "" || jsonTag == "-" {
+			continue
+		}
+		key, opts, _ := strings.Cut(jsonTag, ",")
+		kind, goType, err := fieldKind(f.Type)
+		if err != nil {
+			return codec{}, fmt.Errorf("%s.%s: %w", name, f.Names[0].Name, err)
+		}
+		c.fields = append(c.fields, field{
+			goName:    f.Names[0].Name,
+			key:       key,
+			omitempty: strings.Contains(opts, "omitempty"),
+			kind:      kind,
+			goType:    goType,
+		})
+	}
+	return c, nil
+}
+
+func fieldKind(expr ast.Expr) (string, string, error) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string", "bool":
+			return t.Name, t.Name, nil
+		case "int", "int8", "int16", "int32", "int64":
+			return "int", t.Name, nil
+		case "uint", "uint8", "uint16", "uint32", "uint64":
+			return "uint", t.Name, nil
+		}
+	case *ast.ArrayType:
+		if elt, ok := t.Elt.(*ast.Ident); ok && t.Len == nil && ast.IsExported(elt.Name) {
+			return "slice", elt.Name, nil
+		}
+	case *ast.MapType:
+		k, kok := t.Key.(*ast.Ident)
+		v, vok := t.Value.(*ast.Ident)
+		if kok && vok && k.Name == "string" && v.Name == "string" {
+			return "stringmap", "map[string]string", nil
+		}
+	}
+	return "", "", fmt.Errorf("unsupported field type %T", expr)
+}
+
+// set is the condition under which omitempty keeps f, as encoding/json
+// applies it.
+func (f field) set() string {
+	switch f.kind {
+	case "string":
+		return "v." + f.goName + ` != ""`
+	case "bool":
+		return "v." + f.goName
+	case "int", "uint":
+		return "v." + f.goName + " != 0"
+	}
+	return "len(v." + f.goName + ") != 0"
+}
+
+func render(pkg string, codecs []codec) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by cmd/cborgen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	b.WriteString("import (\n\t\"fmt\"\n\n\t\"github.com/lixiansheng/fileflow/internal/cbor\"\n)\n")
+
+	for _, c := range codecs {
+		renderAppend(&b, c)
+		renderUnmarshal(&b, c)
+	}
+	return format.Source(b.Bytes())
+}
+
+func renderAppend(b *bytes.Buffer, c codec) {
+	fmt.Fprintf(b, "\n// AppendCBOR appends v to b as a CBOR map.\n")
+	fmt.Fprintf(b, "func (v *%s) AppendCBOR(b []byte) []byte {\n", c.name)
+	required := 0
+	var optional []field
+	for _, f := range c.fields {
+		if f.omitempty {
+			optional = append(optional, f)
+		} else {
+			required++
+		}
+	}
+	if len(optional) == 0 {
+		fmt.Fprintf(b, "b = cbor.AppendMapHeader(b, %d)\n", required)
+	} else {
+		fmt.Fprintf(b, "n := %d\n", required)
+		for _, f := range optional {
+			fmt.Fprintf(b, "if %s {\nn++\n}\n", f.set())
+		}
+		b.WriteString("b = cbor.AppendMapHeader(b, n)\n")
+	}
+	for _, f := range c.fields {
+		if f.omitempty {
+			fmt.Fprintf(b, "if %s {\n", f.set())
+		}
+		fmt.Fprintf(b, "b = cbor.AppendString(b, %q)\n", f.key)
+		switch f.kind {
+		case "string":
+			fmt.Fprintf(b, "b = cbor.AppendString(b, v.%s)\n", f.goName)
+		case "bool":
+			fmt.Fprintf(b, "b = cbor.AppendBool(b, v.%s)\n", f.goName)
+		case "int":
+			fmt.Fprintf(b, "b = cbor.AppendInt(b, int64(v.%s))\n", f.goName)
+		case "uint":
+			fmt.Fprintf(b, "b = cbor.AppendUint(b, uint64(v.%s))\n", f.goName)
+		case "stringmap":
+			fmt.Fprintf(b, "b = cbor.AppendStringMap(b, v.%s)\n", f.goName)
+		case "slice":
+			fmt.Fprintf(b, "if v.%[1]s == nil {\nb = cbor.AppendNull(b)\n} else {\n"+
+				"b = cbor.AppendArrayHeader(b, len(v.%[1]s))\nfor i := range v.%[1]s {\nb = v.%[1]s[i].AppendCBOR(b)\n}\n}\n", f.goName)
+		}
+		if f.omitempty {
+			b.WriteString("}\n")
+		}
+	}
+	b.WriteString("return b\n}\n")
+}
+
+func renderUnmarshal(b *bytes.Buffer, c codec) {
+	fmt.Fprintf(b, "\n// UnmarshalCBOR reads a CBOR map into v. Keys v has no field for are an\n// error wrapping cbor.ErrUnknownField.\n")
+	fmt.Fprintf(b, "func (v *%s) UnmarshalCBOR(d *cbor.Decoder) error {\n", c.name)
+	b.WriteString("n, err := d.MapLen()\nif err != nil {\nreturn err\n}\n")
+	b.WriteString("for i := 0; i < n; i++ {\nkey, err := d.String()\nif err != nil {\nreturn err\n}\nswitch key {\n")
+	for _, f := range c.fields {
+		fmt.Fprintf(b, "case %q:\n", f.key)
+		switch f.kind {
+		case "string":
+			fmt.Fprintf(b, "v.%s, err = d.String()\n", f.goName)
+		case "bool":
+			fmt.Fprintf(b, "v.%s, err = d.Bool()\n", f.goName)
+		case "int":
+			fmt.Fprintf(b, "var x int64\nx, err = d.Int()\nv.%s = %s(x)\n", f.goName, f.goType)
+		case "uint":
+			fmt.Fprintf(b, "var x uint64\nx, err = d.Uint()\nv.%s = %s(x)\n", f.goName, f.goType)
+		case "stringmap":
+			fmt.Fprintf(b, "v.%s, err = d.StringMap()\n", f.goName)
+		case "slice":
+			fmt.Fprintf(b, "var l int\nif l, err = d.ArrayLen(); err == nil && l >= 0 {\n"+
+				"v.%[1]s = make([]%[2]s, l)\nfor j := range v.%[1]s {\nif err = v.%[1]s[j].UnmarshalCBOR(d); err != nil {\nbreak\n}\n}\n}\n", f.goName, f.goType)
+		}
+	}
+	b.WriteString("default:\nreturn fmt.Errorf(\"%w %q\", cbor.ErrUnknownField, key)\n}\n")
+	b.WriteString("if err != nil {\nreturn err\n}\n}\nreturn nil\n}\n")
+}
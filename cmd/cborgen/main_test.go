@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestGeneratedCodecsUpToDate fails when internal/realtime/events_cbor.go
+// no longer matches the event structs; run `go generate ./internal/realtime`
+// to fix.
+func TestGeneratedCodecsUpToDate(t *testing.T) {
+	got, err := generate([]string{"../../internal/realtime/events.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("../../internal/realtime/events_cbor.go")
+	if err != nil {
+		t.Fatalf("read generated file: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Error("internal/realtime/events_cbor.go is stale; run go generate ./internal/realtime")
+	}
+}
@@ -0,0 +1,557 @@
+// Command loadgen simulates many enrolled devices against a FileFlow server
+// to measure the capacity of the hub and limiters before deployment.
+//
+// Each simulated device generates a P-256 key, enrolls via the admin API,
+// runs the challenge/attest/login flow, holds a WebSocket open and streams
+// messages to its peers. Latency and throughput are reported at the end.
+//
+// The server's per-IP limits apply to the load generator as a whole, so raise
+// RATE_LIMIT_RPS and MAX_WS_CONN_PER_IP on the target (or run loadgen from a
+// trusted proxy address) when testing beyond a handful of devices. Each
+// connection is also limited to 20 events per second; a message costs one
+// event per 4 KiB chunk plus four framing events, and receivers spend one
+// event per ack, so keep -msg-rate low or the hub will drop the connection.
+//
+//	go run ./cmd/loadgen -target http://localhost:8080 -devices 50 \
+//	    -admin-secret $FF_ADMIN_SECRET -secret $FF_SECRET -duration 1m
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/realtime"
+)
+
+type options struct {
+	target      string
+	origin      string
+	adminSecret string
+	adminToken  string
+	signingKey  []byte
+	secret      string
+	version     string
+	devices     int
+	duration    time.Duration
+	msgRate     float64
+	msgBytes    int
+	rampUp      time.Duration
+	httpTimeout time.Duration
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.target, "target", "http://localhost:8080", "base URL of the FileFlow server")
+	flag.StringVar(&opts.origin, "origin", "", "Origin header for WebSocket upgrades (defaults to target)")
+	flag.StringVar(&opts.adminSecret, "admin-secret", os.Getenv("FF_ADMIN_SECRET"), "admin secret used to enroll devices")
+	flag.StringVar(&opts.secret, "secret", os.Getenv("FF_SECRET"), "shared login secret")
+	flag.StringVar(&opts.version, "client-version", "1.0.0", "client version reported when connecting, checked against MIN_CLIENT_VERSION")
+	flag.IntVar(&opts.devices, "devices", 10, "number of simulated devices")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "how long to stream messages once connected")
+	flag.Float64Var(&opts.msgRate, "msg-rate", 1, "messages per second sent by each device")
+	flag.IntVar(&opts.msgBytes, "msg-bytes", 4096, "payload bytes per message")
+	flag.DurationVar(&opts.rampUp, "ramp-up", 5*time.Second, "time over which devices are started")
+	flag.DurationVar(&opts.httpTimeout, "http-timeout", 10*time.Second, "timeout for each HTTP request")
+	flag.Parse()
+
+	if opts.adminSecret == "" || opts.secret == "" {
+		log.Fatal("-admin-secret and -secret (or FF_ADMIN_SECRET / FF_SECRET) are required")
+	}
+	if opts.origin == "" {
+		opts.origin = strings.TrimRight(opts.target, "/")
+	}
+
+	// One admin session covers every enrollment; keep -ramp-up well under
+	// the server's ADMIN_SESSION_TTL.
+	token, key, err := adminLogin(opts)
+	if err != nil {
+		log.Fatalf("admin login: %v", err)
+	}
+	opts.adminToken = token
+	opts.signingKey = key
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	rep := newReport()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.devices; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if opts.devices > 1 {
+				delay := opts.rampUp * time.Duration(i) / time.Duration(opts.devices)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+			runDevice(ctx, opts, rep)
+		}(i)
+	}
+	wg.Wait()
+
+	rep.print(os.Stdout, time.Since(start))
+}
+
+// device is one simulated client with its own key and cookie jar.
+type device struct {
+	id     string
+	jwk    map[string]interface{}
+	priv   *ecdsa.PrivateKey
+	client *http.Client
+	jar    http.CookieJar
+}
+
+func newDevice(timeout time.Duration) (*device, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	jwk := &auth.ECPublicJWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(pad32(priv.PublicKey.X.Bytes())),
+		Y:   base64.RawURLEncoding.EncodeToString(pad32(priv.PublicKey.Y.Bytes())),
+	}
+	id, err := auth.DeviceIDFromJWK(jwk)
+	if err != nil {
+		return nil, err
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &device{
+		id:     id,
+		jwk:    map[string]interface{}{"kty": jwk.Kty, "crv": jwk.Crv, "x": jwk.X, "y": jwk.Y},
+		priv:   priv,
+		client: &http.Client{Jar: jar, Timeout: timeout},
+		jar:    jar,
+	}, nil
+}
+
+func runDevice(ctx context.Context, opts options, rep *report) {
+	d, err := newDevice(opts.httpTimeout)
+	if err != nil {
+		rep.fail("keygen", err)
+		return
+	}
+
+	steps := []struct {
+		name string
+		fn   func(*device, options) error
+	}{
+		{"enroll", enroll},
+		{"attest", attest},
+		{"login", login},
+	}
+	for _, step := range steps {
+		t0 := time.Now()
+		if err := step.fn(d, opts); err != nil {
+			rep.fail(step.name, err)
+			return
+		}
+		rep.observe(step.name, time.Since(t0))
+	}
+
+	t0 := time.Now()
+	conn, err := dial(d, opts)
+	if err != nil {
+		rep.fail("ws_connect", err)
+		return
+	}
+	rep.observe("ws_connect", time.Since(t0))
+	defer conn.Close()
+
+	stream(ctx, conn, opts, rep)
+}
+
+func postJSON(d *device, opts options, path string, body interface{}, header http.Header, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(opts.target, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", path, resp.StatusCode)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// adminLogin returns an admin token and, when the server wants admin
+// changes signed, the key to sign them with.
+func adminLogin(opts options) (string, []byte, error) {
+	d := &device{client: &http.Client{Timeout: opts.httpTimeout}}
+	var resp struct {
+		Token      string `json:"token"`
+		SigningKey string `json:"signing_key"`
+	}
+	if err := postJSON(d, opts, "/api/admin/login", map[string]string{
+		"secret": opts.adminSecret,
+	}, nil, &resp); err != nil {
+		return "", nil, err
+	}
+	if resp.SigningKey == "" {
+		return resp.Token, nil, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(resp.SigningKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("signing key: %w", err)
+	}
+	return resp.Token, key, nil
+}
+
+func enroll(d *device, opts options) error {
+	const path = "/api/admin/devices"
+	body := map[string]interface{}{
+		"device_id": d.id,
+		"pub_jwk":   d.jwk,
+		"label":     "loadgen-" + d.id[:8],
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+opts.adminToken)
+	if opts.signingKey != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := uuid.NewString()
+		sig, err := auth.SignRequest(opts.signingKey, http.MethodPost, path, ts, nonce, b)
+		if err != nil {
+			return err
+		}
+		header.Set("X-Admin-Timestamp", ts)
+		header.Set("X-Admin-Nonce", nonce)
+		header.Set("X-Admin-Signature", sig)
+	}
+	return postJSON(d, opts, path, body, header, nil)
+}
+
+func attest(d *device, opts options) error {
+	var ch struct {
+		ChallengeID string `json:"challenge_id"`
+		Nonce       string `json:"nonce"`
+	}
+	if err := postJSON(d, opts, "/api/device/challenge", map[string]interface{}{
+		"device_id": d.id,
+		"pub_jwk":   d.jwk,
+	}, nil, &ch); err != nil {
+		return err
+	}
+
+	nonce, err := base64.RawURLEncoding.DecodeString(ch.Nonce)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(nonce)
+	r, s, err := ecdsa.Sign(rand.Reader, d.priv, h[:])
+	if err != nil {
+		return err
+	}
+	sig := append(pad32(r.Bytes()), pad32(s.Bytes())...)
+
+	return postJSON(d, opts, "/api/device/attest", map[string]string{
+		"challenge_id": ch.ChallengeID,
+		"device_id":    d.id,
+		"signature":    base64.RawURLEncoding.EncodeToString(sig),
+	}, nil, nil)
+}
+
+func login(d *device, opts options) error {
+	var resp struct {
+		Authed bool `json:"authed"`
+	}
+	if err := postJSON(d, opts, "/api/login", map[string]string{
+		"secret":    opts.secret,
+		"device_id": d.id,
+	}, nil, &resp); err != nil {
+		return err
+	}
+	if !resp.Authed {
+		return errors.New("login rejected: wrong secret")
+	}
+	return nil
+}
+
+func dial(d *device, opts options) (*websocket.Conn, error) {
+	base, err := url.Parse(strings.TrimRight(opts.target, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	wsURL := *base
+	wsURL.Scheme = "ws"
+	if base.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	}
+	wsURL.Path = "/ws"
+	wsURL.RawQuery = url.Values{"client_version": {opts.version}}.Encode()
+
+	header := http.Header{}
+	header.Set("Origin", opts.origin)
+	dialer := websocket.Dialer{Jar: d.jar, HandshakeTimeout: opts.httpTimeout}
+	conn, _, err := dialer.Dial(wsURL.String(), header)
+	return conn, err
+}
+
+// inflight maps msgId to send time so any receiving device can compute
+// end-to-end delivery latency against the same clock.
+var inflight sync.Map
+
+func stream(ctx context.Context, conn *websocket.Conn, opts options, rep *report) {
+	ctx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+
+	var writeMu sync.Mutex
+	write := func(t string, v interface{}) error {
+		data, err := realtime.NewEvent(t, v).Marshal()
+		if err != nil {
+			return err
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	var closing atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readLoop(conn, rep, write, &closing)
+	}()
+
+	payload := strings.Repeat("x", opts.msgBytes)
+	interval := time.Duration(float64(time.Second) / opts.msgRate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := sendMessage(write, payload, rep); err != nil {
+				rep.fail("send", err)
+				break loop
+			}
+		}
+	}
+
+	closing.Store(true)
+	writeMu.Lock()
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	writeMu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+	}
+}
+
+func sendMessage(write func(string, interface{}) error, payload string, rep *report) error {
+	msgID := uuid.NewString()
+	inflight.Store(msgID, time.Now())
+
+	if err := write(realtime.EventMsgStart, realtime.MsgStartValue{MsgID: msgID}); err != nil {
+		return err
+	}
+	if err := write(realtime.EventParaStart, realtime.ParaStartValue{MsgID: msgID, Index: 0}); err != nil {
+		return err
+	}
+	for off := 0; off < len(payload); off += realtime.MaxChunkSize {
+		end := off + realtime.MaxChunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		if err := write(realtime.EventParaChunk, realtime.ParaChunkValue{MsgID: msgID, Index: 0, Text: payload[off:end]}); err != nil {
+			return err
+		}
+	}
+	if err := write(realtime.EventParaEnd, realtime.ParaEndValue{MsgID: msgID, Index: 0}); err != nil {
+		return err
+	}
+	if err := write(realtime.EventMsgEnd, realtime.MsgEndValue{MsgID: msgID}); err != nil {
+		return err
+	}
+
+	rep.sent(len(payload))
+	return nil
+}
+
+func readLoop(conn *websocket.Conn, rep *report, write func(string, interface{}) error, closing *atomic.Bool) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !closing.Load() {
+				rep.fail("ws_read", err)
+			}
+			return
+		}
+
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			e, err := realtime.ParseEvent(line)
+			if err != nil {
+				continue
+			}
+			switch e.Type {
+			case realtime.EventMsgEnd:
+				msgID := e.GetMsgID()
+				if v, ok := inflight.LoadAndDelete(msgID); ok {
+					rep.observe("delivery", time.Since(v.(time.Time)))
+					rep.delivered()
+				}
+				write(realtime.EventAck, realtime.AckValue{MsgID: msgID})
+			case realtime.EventSendFail:
+				v, _ := e.Value.(map[string]interface{})
+				reason, _ := v["reason"].(string)
+				inflight.Delete(e.GetMsgID())
+				rep.fail("send_fail", errors.New(reason))
+			}
+		}
+	}
+}
+
+func pad32(b []byte) []byte {
+	if len(b) >= 32 {
+		return b
+	}
+	out := make([]byte, 32)
+	copy(out[32-len(b):], b)
+	return out
+}
+
+// report aggregates latencies, failures and throughput across devices.
+type report struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	failures  map[string]map[string]int
+
+	msgsSent      atomic.Int64
+	bytesSent     atomic.Int64
+	msgsDelivered atomic.Int64
+}
+
+func newReport() *report {
+	return &report{
+		latencies: make(map[string][]time.Duration),
+		failures:  make(map[string]map[string]int),
+	}
+}
+
+func (r *report) observe(step string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies[step] = append(r.latencies[step], d)
+}
+
+func (r *report) fail(step string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures[step] == nil {
+		r.failures[step] = make(map[string]int)
+	}
+	r.failures[step][err.Error()]++
+}
+
+func (r *report) sent(n int) {
+	r.msgsSent.Add(1)
+	r.bytesSent.Add(int64(n))
+}
+
+func (r *report) delivered() {
+	r.msgsDelivered.Add(1)
+}
+
+func (r *report) print(w *os.File, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintf(w, "elapsed: %s\n\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "%-12s %8s %10s %10s %10s %10s\n", "step", "count", "p50", "p95", "p99", "max")
+
+	steps := make([]string, 0, len(r.latencies))
+	for step := range r.latencies {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	for _, step := range steps {
+		l := r.latencies[step]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Fprintf(w, "%-12s %8d %10s %10s %10s %10s\n", step, len(l),
+			percentile(l, 0.50), percentile(l, 0.95), percentile(l, 0.99), l[len(l)-1].Round(time.Microsecond))
+	}
+
+	secs := elapsed.Seconds()
+	fmt.Fprintf(w, "\nmessages sent:      %d (%.1f/s, %.1f KiB/s)\n",
+		r.msgsSent.Load(), float64(r.msgsSent.Load())/secs, float64(r.bytesSent.Load())/1024/secs)
+	fmt.Fprintf(w, "messages delivered: %d (%.1f/s)\n", r.msgsDelivered.Load(), float64(r.msgsDelivered.Load())/secs)
+
+	if len(r.failures) > 0 {
+		fmt.Fprintln(w, "\nfailures:")
+		for step, errs := range r.failures {
+			for msg, n := range errs {
+				fmt.Fprintf(w, "  %-12s %6d  %s\n", step, n, msg)
+			}
+		}
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p)
+	return sorted[idx].Round(time.Microsecond)
+}
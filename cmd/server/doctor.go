@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/certpin"
+	"github.com/lixiansheng/fileflow/internal/handler"
+)
+
+// Thresholds for doctor warnings.
+const (
+	doctorTimeout     = 5 * time.Second
+	doctorMaxSkew     = 30 * time.Second
+	doctorCertWarn    = 14 * 24 * time.Hour
+	doctorMaxWALBytes = 64 << 20
+)
+
+type severity int
+
+const (
+	sevOK severity = iota
+	sevWarn
+	sevFail
+)
+
+func (s severity) String() string {
+	switch s {
+	case sevWarn:
+		return "WARN"
+	case sevFail:
+		return "FAIL"
+	default:
+		return "OK"
+	}
+}
+
+type finding struct {
+	sev   severity
+	check string
+	msg   string
+}
+
+// doctor runs read-only setup checks against the server's configuration.
+// Network access goes through client and tlsConfig so tests can point it at
+// an httptest server.
+type doctor struct {
+	cfg       *config
+	client    *http.Client
+	tlsConfig *tls.Config
+	now       func() time.Time
+	findings  []finding
+}
+
+// runDoctor prints one line per check and returns the process exit code:
+// 1 when any check failed, 0 otherwise.
+func runDoctor(cfg *config, out io.Writer) int {
+	d := &doctor{
+		cfg:    cfg,
+		client: &http.Client{Timeout: doctorTimeout},
+		now:    time.Now,
+	}
+	d.run()
+	return d.report(out)
+}
+
+func (d *doctor) run() {
+	d.checkConfig()
+	d.checkSQLitePath()
+	d.checkWAL()
+	d.checkTrustedProxies()
+
+	serverDate := d.checkDomain()
+	d.checkClock(serverDate)
+	d.checkTLS()
+}
+
+func (d *doctor) add(sev severity, check, format string, args ...interface{}) {
+	d.findings = append(d.findings, finding{sev: sev, check: check, msg: fmt.Sprintf(format, args...)})
+}
+
+func (d *doctor) report(out io.Writer) int {
+	code := 0
+	for _, f := range d.findings {
+		fmt.Fprintf(out, "[%-4s] %-14s %s\n", f.sev, f.check, f.msg)
+		if f.sev == sevFail {
+			code = 1
+		}
+	}
+	return code
+}
+
+func (d *doctor) checkConfig() {
+	key, err := resolveSessionKey(d.cfg.SecureCookies)
+	switch {
+	case err != nil:
+		d.add(sevFail, "session key", "%v; set SESSION_KEY to a long random value", err)
+	case key == "dev-session-key":
+		d.add(sevWarn, "session key", "using the built-in dev key; set SESSION_KEY before exposing the server")
+	default:
+		d.add(sevOK, "session key", "configured")
+	}
+
+	if os.Getenv("APP_SECRET_HASH") == "" {
+		d.add(sevWarn, "secret hash", "APP_SECRET_HASH not set; the server will fall back to the hash stored in the database")
+	}
+	if d.cfg.BootstrapToken == "" {
+		d.add(sevWarn, "bootstrap", "BOOTSTRAP_TOKEN not set; the first device can only be enrolled after an admin login")
+	}
+	if os.Getenv("ADMIN_SECRET_HASH") == "" {
+		d.add(sevWarn, "admin", "ADMIN_SECRET_HASH not set; admin login only works if a hash is stored in the database")
+	}
+	switch {
+	case !d.cfg.EncryptTokens && !d.cfg.SignedTokens:
+		d.add(sevFail, "tokens", "ACCEPT_SIGNED_TOKENS=false requires ENCRYPT_TOKENS=true")
+	case !d.cfg.EncryptTokens:
+		d.add(sevWarn, "tokens", "ENCRYPT_TOKENS not set; session cookies are signed but their claims are readable")
+	}
+	if d.cfg.OIDCIssuer != "" && len(d.cfg.OIDCAllowed) == 0 {
+		d.add(sevFail, "oidc", "OIDC_ISSUER requires OIDC_ALLOWED; without it any account at %s could log in an enrolled device", d.cfg.OIDCIssuer)
+	}
+	if !d.cfg.SignAdminCalls {
+		d.add(sevWarn, "admin", "ADMIN_REQUEST_SIGNING=false; a leaked admin token alone can change devices and users")
+	}
+	if !d.cfg.SecureCookies && !isDevEnv() && !d.cfg.OnionMode {
+		d.add(sevWarn, "cookies", "SECURE_COOKIES=false outside dev; cookies will be sent over plain HTTP")
+	}
+}
+
+func (d *doctor) checkSQLitePath() {
+	path := d.cfg.SQLitePath
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		dir := filepath.Dir(path)
+		f, err := os.CreateTemp(dir, ".fileflow-doctor-*")
+		if err != nil {
+			d.add(sevFail, "sqlite path", "%s does not exist and %s is not writable: %v", path, dir, err)
+			return
+		}
+		f.Close()
+		os.Remove(f.Name())
+		d.add(sevOK, "sqlite path", "%s will be created on first start", path)
+		return
+	}
+	if err != nil {
+		d.add(sevFail, "sqlite path", "cannot stat %s: %v", path, err)
+		return
+	}
+	if info.IsDir() {
+		d.add(sevFail, "sqlite path", "%s is a directory; SQLITE_PATH must name a file", path)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		d.add(sevFail, "sqlite path", "%s is not writable by this user: %v", path, err)
+		return
+	}
+	f.Close()
+
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		d.add(sevWarn, "sqlite path", "%s has mode %04o; run chmod 600 so other users cannot read device keys", path, perm)
+		return
+	}
+	d.add(sevOK, "sqlite path", "%s is writable with mode %04o", path, info.Mode().Perm())
+}
+
+func (d *doctor) checkWAL() {
+	path := d.cfg.SQLitePath
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		d.add(sevFail, "sqlite wal", "open %s: %v", path, err)
+		return
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		d.add(sevFail, "sqlite wal", "read journal mode: %v", err)
+		return
+	}
+	var check string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&check); err != nil || check != "ok" {
+		d.add(sevFail, "sqlite wal", "quick_check failed (%s %v); restore from backup", check, err)
+		return
+	}
+
+	if !strings.EqualFold(mode, "wal") {
+		d.add(sevWarn, "sqlite wal", "journal_mode is %q, not wal; concurrent reads will block on writes", mode)
+		return
+	}
+	if info, err := os.Stat(path + "-wal"); err == nil && info.Size() > doctorMaxWALBytes {
+		d.add(sevWarn, "sqlite wal", "%s-wal is %d MB; checkpoints are not keeping up, check for long-lived readers", path, info.Size()>>20)
+		return
+	}
+	d.add(sevOK, "sqlite wal", "journal_mode=wal, integrity ok")
+}
+
+func (d *doctor) checkTrustedProxies() {
+	proxies := trustedProxiesEnv()
+	if proxies == "" {
+		d.add(sevOK, "proxies", "TRUSTED_PROXY_CIDRS not set; X-Forwarded-For is ignored and limits key on the peer address")
+		return
+	}
+
+	entries := strings.Split(proxies, ",")
+	if err := handler.SetTrustedProxies(entries); err != nil {
+		d.add(sevFail, "proxies", "%v", err)
+		return
+	}
+	for _, e := range entries {
+		if _, network, err := net.ParseCIDR(strings.TrimSpace(e)); err == nil {
+			if ones, _ := network.Mask.Size(); ones == 0 {
+				d.add(sevWarn, "proxies", "%s trusts every address; any client can spoof X-Forwarded-For", strings.TrimSpace(e))
+				return
+			}
+		}
+	}
+	d.add(sevOK, "proxies", "%d trusted proxy entries", len(entries))
+}
+
+// checkDomain fetches /healthz through APP_DOMAIN and returns the server's
+// Date header for the clock check.
+func (d *doctor) checkDomain() time.Time {
+	if d.cfg.AppDomain == "" {
+		d.add(sevWarn, "app domain", "APP_DOMAIN not set; origin checks are disabled")
+		return time.Time{}
+	}
+
+	url := "https://" + d.cfg.AppDomain + "/healthz"
+	resp, err := d.client.Get(url)
+	if err != nil {
+		d.add(sevWarn, "app domain", "GET %s failed: %v (is the server running and DNS pointing here?)", url, err)
+		return time.Time{}
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		d.add(sevWarn, "app domain", "GET %s returned %s", url, resp.Status)
+	} else {
+		d.add(sevOK, "app domain", "%s is reachable", url)
+	}
+
+	date, _ := http.ParseTime(resp.Header.Get("Date"))
+	return date
+}
+
+func (d *doctor) checkClock(serverDate time.Time) {
+	now := d.now()
+	if now.Year() < 2024 {
+		d.add(sevFail, "clock", "system time is %s; tokens and TOTP codes will not verify", now.Format(time.RFC3339))
+		return
+	}
+	if serverDate.IsZero() {
+		return
+	}
+
+	skew := now.Sub(serverDate)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > doctorMaxSkew {
+		d.add(sevWarn, "clock", "local clock differs from %s by %s; enable NTP", d.cfg.AppDomain, skew.Round(time.Second))
+		return
+	}
+	d.add(sevOK, "clock", "within %s of %s", doctorMaxSkew, d.cfg.AppDomain)
+}
+
+func (d *doctor) checkTLS() {
+	if d.cfg.AppDomain == "" {
+		return
+	}
+
+	addr := d.cfg.AppDomain
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+
+	dialer := &net.Dialer{Timeout: doctorTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, d.tlsConfig)
+	if err != nil {
+		d.add(sevWarn, "tls", "handshake with %s failed: %v", addr, err)
+		return
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		d.add(sevFail, "tls", "%s presented no certificate", addr)
+		return
+	}
+
+	left := certs[0].NotAfter.Sub(d.now())
+	switch {
+	case left <= 0:
+		d.add(sevFail, "tls", "certificate expired on %s", certs[0].NotAfter.Format(time.DateOnly))
+	case left < doctorCertWarn:
+		d.add(sevWarn, "tls", "certificate expires in %d days; check that renewal is running", int(left.Hours()/24))
+	default:
+		d.add(sevOK, "tls", "certificate valid until %s", certs[0].NotAfter.Format(time.DateOnly))
+	}
+
+	if d.cfg.CertPins != "" || d.cfg.CertFile != "" {
+		d.checkCertPin(addr, certs[0].Raw)
+	}
+}
+
+// checkCertPin checks that the certificate served at addr is one of the
+// pinned ones; otherwise every client would report a mismatch.
+func (d *doctor) checkCertPin(addr string, der []byte) {
+	pins, err := certpin.New(strings.Split(d.cfg.CertPins, ","), d.cfg.CertFile)
+	if err != nil {
+		d.add(sevFail, "cert pins", "%v", err)
+		return
+	}
+	fp := certpin.Fingerprint(der)
+	if ok, err := pins.Match(fp); err != nil {
+		d.add(sevFail, "cert pins", "%v", err)
+	} else if !ok {
+		d.add(sevFail, "cert pins", "%s serves %s, which is not in CERT_PINS or CERT_FILE; clients will report it as a mismatch", addr, fp)
+	} else {
+		d.add(sevOK, "cert pins", "%s serves a pinned certificate", addr)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/certpin"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+func findingFor(d *doctor, check string) *finding {
+	for i := range d.findings {
+		if d.findings[i].check == check {
+			return &d.findings[i]
+		}
+	}
+	return nil
+}
+
+func TestDoctorSQLitePath(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Missing", func(t *testing.T) {
+		d := &doctor{cfg: &config{SQLitePath: filepath.Join(dir, "new.db")}, now: time.Now}
+		d.checkSQLitePath()
+		if f := findingFor(d, "sqlite path"); f == nil || f.sev != sevOK {
+			t.Errorf("Expected OK for creatable path, got %+v", f)
+		}
+	})
+
+	t.Run("MissingDir", func(t *testing.T) {
+		d := &doctor{cfg: &config{SQLitePath: filepath.Join(dir, "nope", "x.db")}, now: time.Now}
+		d.checkSQLitePath()
+		if f := findingFor(d, "sqlite path"); f == nil || f.sev != sevFail {
+			t.Errorf("Expected FAIL for missing directory, got %+v", f)
+		}
+	})
+
+	t.Run("WorldReadable", func(t *testing.T) {
+		path := filepath.Join(dir, "open.db")
+		os.WriteFile(path, nil, 0o644)
+		os.Chmod(path, 0o644)
+		d := &doctor{cfg: &config{SQLitePath: path}, now: time.Now}
+		d.checkSQLitePath()
+		if f := findingFor(d, "sqlite path"); f == nil || f.sev != sevWarn {
+			t.Errorf("Expected WARN for mode 0644, got %+v", f)
+		}
+	})
+}
+
+func TestDoctorWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := store.New(path)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	s.Close()
+
+	d := &doctor{cfg: &config{SQLitePath: path}, now: time.Now}
+	d.checkWAL()
+	if f := findingFor(d, "sqlite wal"); f == nil || f.sev == sevFail {
+		t.Errorf("Expected a healthy database to pass quick_check, got %+v", f)
+	}
+
+	os.WriteFile(path, []byte("not a database"), 0o600)
+	d = &doctor{cfg: &config{SQLitePath: path}, now: time.Now}
+	d.checkWAL()
+	if f := findingFor(d, "sqlite wal"); f == nil || f.sev != sevFail {
+		t.Errorf("Expected FAIL for a corrupt file, got %+v", f)
+	}
+}
+
+func TestDoctorTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies string
+		want    severity
+	}{
+		{"Unset", "", sevOK},
+		{"Valid", "10.0.0.0/8, 192.168.1.1", sevOK},
+		{"Invalid", "10.0.0.0/99", sevFail},
+		{"TrustAll", "0.0.0.0/0", sevWarn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXY_CIDRS", tt.proxies)
+			t.Setenv("TRUSTED_PROXIES", "")
+			d := &doctor{cfg: &config{}, now: time.Now}
+			d.checkTrustedProxies()
+			if f := findingFor(d, "proxies"); f == nil || f.sev != tt.want {
+				t.Errorf("Expected %s, got %+v", tt.want, f)
+			}
+		})
+	}
+}
+
+func TestDoctorDomainClockTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	domain := strings.TrimPrefix(srv.URL, "https://")
+
+	newDoctor := func(now time.Time) *doctor {
+		return &doctor{
+			cfg:       &config{AppDomain: domain},
+			client:    srv.Client(),
+			tlsConfig: &tls.Config{RootCAs: pool, ServerName: "example.com"},
+			now:       func() time.Time { return now },
+		}
+	}
+
+	d := newDoctor(time.Now())
+	d.checkClock(d.checkDomain())
+	d.checkTLS()
+	for _, check := range []string{"app domain", "clock", "tls"} {
+		if f := findingFor(d, check); f == nil || f.sev != sevOK {
+			t.Errorf("Expected %s OK, got %+v", check, f)
+		}
+	}
+
+	d = newDoctor(time.Now().Add(5 * time.Minute))
+	d.checkClock(d.checkDomain())
+	if f := findingFor(d, "clock"); f == nil || f.sev != sevWarn {
+		t.Errorf("Expected clock skew WARN, got %+v", f)
+	}
+
+	d = newDoctor(srv.Certificate().NotAfter.Add(time.Hour))
+	d.checkTLS()
+	if f := findingFor(d, "tls"); f == nil || f.sev != sevFail {
+		t.Errorf("Expected expired certificate FAIL, got %+v", f)
+	}
+
+	for pin, want := range map[string]severity{
+		certpin.Fingerprint(srv.Certificate().Raw): sevOK,
+		strings.Repeat("0", 64):                    sevFail,
+	} {
+		d = newDoctor(time.Now())
+		d.cfg.CertPins = pin
+		d.checkTLS()
+		if f := findingFor(d, "cert pins"); f == nil || f.sev != want {
+			t.Errorf("CERT_PINS=%s: expected %s, got %+v", pin, want, f)
+		}
+	}
+}
+
+func TestDoctorReport(t *testing.T) {
+	d := &doctor{}
+	d.add(sevOK, "a", "fine")
+	d.add(sevWarn, "b", "hmm")
+	var buf bytes.Buffer
+	if code := d.report(&buf); code != 0 {
+		t.Errorf("Expected exit 0 with only warnings, got %d", code)
+	}
+
+	d.add(sevFail, "c", "broken")
+	buf.Reset()
+	if code := d.report(&buf); code != 1 {
+		t.Errorf("Expected exit 1 with a failure, got %d", code)
+	}
+	if !strings.Contains(buf.String(), "[FAIL] c") {
+		t.Errorf("Unexpected report:\n%s", buf.String())
+	}
+}
@@ -1,26 +1,61 @@
 package main
 
 import (
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/certpin"
+	"github.com/lixiansheng/fileflow/internal/feature"
 	"github.com/lixiansheng/fileflow/internal/handler"
+	"github.com/lixiansheng/fileflow/internal/lifecycle"
 	"github.com/lixiansheng/fileflow/internal/limit"
+	"github.com/lixiansheng/fileflow/internal/logging"
 	"github.com/lixiansheng/fileflow/internal/realtime"
 	"github.com/lixiansheng/fileflow/internal/store"
+	"github.com/lixiansheng/fileflow/internal/wake"
 	"golang.org/x/time/rate"
 	"strings"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		printVersion(os.Stdout)
+		return
+	}
+
+	// Set up first so configuration warnings come out in the same format.
+	// The standard log package writes through this logger too.
+	logFormat := getEnv("LOG_FORMAT", "text")
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatalf("Invalid LOG_FORMAT %q: want text or json", logFormat)
+	}
+	logLevels, err := logging.ParseLevels(getEnv("LOG_LEVEL", "info"), getEnv("LOG_LEVELS", ""))
+	if err != nil {
+		log.Fatalf("Invalid LOG_LEVEL or LOG_LEVELS: %v", err)
+	}
+	slog.SetDefault(logging.New(os.Stderr, logFormat, logLevels))
+
 	cfg := loadConfig()
+	cfg.LogLevels = logLevels
+
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(cfg, os.Stdout))
+	}
 
 	if cfg.AppDomain == "" && getEnv("ENV", "") == "prod" {
 		log.Fatal("APP_DOMAIN is required in prod")
@@ -39,28 +74,261 @@ type config struct {
 	MaxBodyBytes    int64
 	MaxWSMsgBytes   int
 	SecureCookies   bool
+	HostCookies     bool
+	LegacyCookies   bool
 	SessionTTL      time.Duration
+	SessionMaxLife  time.Duration
 	ChallengeTTL    time.Duration
+	ChallengeStore  string
+	PairingCodeTTL  time.Duration
+	DeviceTicketTTL time.Duration
+	DeviceTicketMax time.Duration
 	MaxWSConnPerIP  int
 	MaxWSConnGlobal int
+	IPv6PrefixLen   int
+	ConnAuditTTL    time.Duration
+	CertReportTTL   time.Duration
+	EnrollEventTTL  time.Duration
+	DeviceTrashTTL  time.Duration
+	ArgonTime       int
+	ArgonMemoryKiB  int
+	ArgonThreads    int
 	BootstrapToken  string
+	WebAuthnRPID    string
+	WebAuthnOrigin  string
+	AdminSessionTTL time.Duration
+	MinClientVer    string
+	RecClientVer    string
+	ClientUpdateURL string
+	EncryptTokens   bool
+	SignedTokens    bool
+	ArgonWorkers    int
+	ArgonQueue      int
+	ArgonQueueWait  time.Duration
+	ChallengeRate   float64
+	MaxChallenges   int
+	EnrollStrikes   int
+	TicketBinding   string
+	SignAdminCalls  bool
+	OIDCIssuer      string
+	OIDCClientID    string
+	OIDCSecret      string
+	OIDCRedirectURL string
+	OIDCAllowed     []string
+	LowMemory       bool
+	WSBufferSize    int
+	WSCompression   bool
+	WSCompressMin   int
+	WSCompressLevel int
+	WSDropLogSample int
+	WSSendQueue     int
+	SQLiteCacheKiB  int
+	ConnAudit       bool
+	TextPolicy      string
+	KeyRotateEvery  time.Duration
+	KeyRotateBytes  int
+	PushRate        float64
+	WakeGrace       time.Duration
+	CertPins        string
+	CertFile        string
+	CertAlertURL    string
+	AllowedOrigins  string
+	AllowedHosts    string
+	CSP             string
+	Permissions     string
+	HSTSMaxAge      time.Duration
+	HSTSSubdomains  bool
+	HSTSPreload     bool
+	RateExemptPaths []string
+	RateExemptNets  []string
+	RateRoutes      string
+	Compression     string
+	CompressLevel   int
+	CompressMinSize int
+	CompressTypes   []string
+	LogLevels       *logging.Levels // from LOG_LEVEL and LOG_LEVELS, set by main
+	OnionMode       bool
+	Receipts        bool
+	ReceiptTTL      time.Duration
+	Features        map[string]bool // FEATURES overrides
 }
 
 func loadConfig() *config {
-	return &config{
+	// LOW_MEMORY swaps in smaller defaults for the memory-related settings
+	// below; any of them set explicitly still wins.
+	low := getEnv("LOW_MEMORY", "false")
+	lowMemory := low == "1" || low == "true"
+	pick := func(normal, small int) int {
+		if lowMemory {
+			return small
+		}
+		return normal
+	}
+	// ONION_MODE serves a Tor onion service over plain HTTP, so cookies
+	// are not Secure unless asked for.
+	onion := getEnv("ONION_MODE", "false")
+	onionMode := onion == "1" || onion == "true"
+	secureCookies := "true"
+	if onionMode {
+		secureCookies = "false"
+	}
+
+	cfg := &config{
 		ListenAddr:      getEnv("LISTEN_ADDR", ":8080"),
 		SQLitePath:      getEnv("SQLITE_PATH", "/data/fileflow.db"),
 		AppDomain:       getEnv("APP_DOMAIN", ""),
 		RateLimitRPS:    getEnvFloat("RATE_LIMIT_RPS", 5.0),
 		MaxBodyBytes:    256 * 1024,
-		SecureCookies:   getEnv("SECURE_COOKIES", "true") == "true",
+		SecureCookies:   getEnv("SECURE_COOKIES", secureCookies) == "true",
+		HostCookies:     getEnv("HOST_COOKIES", "true") == "true",
+		LegacyCookies:   getEnv("ACCEPT_LEGACY_COOKIES", "true") == "true",
 		SessionTTL:      getEnvDurationHours("SESSION_TTL_HOURS", 12*time.Hour, "SESSION_TTL"),
+		SessionMaxLife:  getEnvDuration("SESSION_MAX_LIFETIME", 7*24*time.Hour),
 		ChallengeTTL:    60 * time.Second,
+		ChallengeStore:  getEnv("CHALLENGE_STORE", "memory"),
+		PairingCodeTTL:  getEnvDuration("PAIRING_CODE_TTL", 5*time.Minute),
+		DeviceTicketTTL: getEnvDuration("DEVICE_TICKET_TTL", 15*time.Minute),
+		DeviceTicketMax: getEnvDuration("DEVICE_TICKET_MAX_TTL", 4*time.Hour),
 		MaxWSMsgBytes:   getEnvInt("MAX_WS_MSG_BYTES", 256*1024),
 		MaxWSConnPerIP:  getEnvInt("MAX_WS_CONN_PER_IP", 5),
-		MaxWSConnGlobal: getEnvInt("MAX_WS_CONN_GLOBAL", 1000),
+		MaxWSConnGlobal: getEnvInt("MAX_WS_CONN_GLOBAL", pick(1000, 64)),
+		IPv6PrefixLen:   getEnvInt("RATE_LIMIT_IPV6_PREFIX", limit.DefaultIPv6PrefixLen),
+		ConnAuditTTL:    getEnvDuration("CONN_AUDIT_RETENTION", 30*24*time.Hour),
+		CertReportTTL:   getEnvDuration("CERT_REPORT_RETENTION", 30*24*time.Hour),
+		EnrollEventTTL:  getEnvDuration("ENROLL_EVENT_RETENTION", 30*24*time.Hour),
+		DeviceTrashTTL:  getEnvDuration("DEVICE_TRASH_RETENTION", 30*24*time.Hour),
+		ArgonTime:       getEnvInt("ARGON2_TIME", pick(int(auth.DefaultArgonParams.Time), 2)),
+		ArgonMemoryKiB:  getEnvInt("ARGON2_MEMORY_KIB", pick(int(auth.DefaultArgonParams.Memory), 19*1024)),
+		ArgonThreads:    getEnvInt("ARGON2_THREADS", pick(int(auth.DefaultArgonParams.Threads), 1)),
 		BootstrapToken:  getEnv("BOOTSTRAP_TOKEN", ""),
+		AdminSessionTTL: getEnvDuration("ADMIN_SESSION_TTL", 15*time.Minute),
+		MinClientVer:    getEnv("MIN_CLIENT_VERSION", ""),
+		RecClientVer:    getEnv("RECOMMENDED_CLIENT_VERSION", ""),
+		ClientUpdateURL: getEnv("CLIENT_UPDATE_URL", ""),
+		EncryptTokens:   getEnv("ENCRYPT_TOKENS", "false") == "true",
+		SignedTokens:    getEnv("ACCEPT_SIGNED_TOKENS", "true") == "true",
+		ArgonWorkers:    getEnvInt("ARGON2_WORKERS", pick(2, 1)),
+		ArgonQueue:      getEnvInt("ARGON2_QUEUE", pick(32, 8)),
+		ArgonQueueWait:  getEnvDuration("ARGON2_QUEUE_TIMEOUT", 5*time.Second),
+		ChallengeRate:   getEnvFloat("CHALLENGE_RATE_PER_MIN", 6),
+		MaxChallenges:   getEnvInt("MAX_OUTSTANDING_CHALLENGES", 5),
+		EnrollStrikes:   getEnvInt("ENROLL_MAX_INVALID", 5),
+		TicketBinding:   getEnv("TICKET_BINDING", "off"),
+		SignAdminCalls:  getEnv("ADMIN_REQUEST_SIGNING", "true") == "true",
+		LowMemory:       lowMemory,
+		WSBufferSize:    getEnvInt("WS_BUFFER_SIZE", pick(1024, 512)),
+		WSCompression:   getEnv("WS_COMPRESSION", "false") == "true",
+		WSCompressMin:   getEnvInt("WS_COMPRESS_MIN_BYTES", 1024),
+		WSCompressLevel: getEnvInt("WS_COMPRESS_LEVEL", flate.DefaultCompression),
+		WSDropLogSample: getEnvInt("WS_DROP_LOG_SAMPLE", realtime.DefaultDropLogSampling),
+		WSSendQueue:     getEnvInt("WS_SEND_QUEUE", pick(realtime.DefaultSendQueue, 32)),
+		SQLiteCacheKiB:  getEnvInt("SQLITE_CACHE_KIB", pick(0, 512)),
+		ConnAudit:       getEnv("CONN_AUDIT", strconv.FormatBool(!lowMemory)) == "true",
+		TextPolicy:      getEnv("TEXT_POLICY", realtime.TextPolicySanitize),
+		KeyRotateEvery:  getEnvDuration("KEY_ROTATE_INTERVAL", realtime.DefaultKeyRotation.Interval),
+		KeyRotateBytes:  getEnvInt("KEY_ROTATE_BYTES", int(realtime.DefaultKeyRotation.Bytes)),
+		PushRate:        getEnvFloat("PUSH_RATE_PER_MIN", 30),
+		WakeGrace:       getEnvDuration("WAKE_GRACE", wake.DefaultGrace),
+		CertPins:        getEnv("CERT_PINS", ""),
+		CertFile:        getEnv("CERT_FILE", ""),
+		CertAlertURL:    getEnv("CERT_ALERT_WEBHOOK", ""),
+		CSP:             getEnv("CSP", handler.DefaultCSP),
+		Permissions:     getEnv("PERMISSIONS_POLICY", handler.DefaultPermissionsPolicy),
+		HSTSMaxAge:      getEnvDuration("HSTS_MAX_AGE", 0),
+		HSTSSubdomains:  getEnv("HSTS_INCLUDE_SUBDOMAINS", "false") == "true",
+		HSTSPreload:     getEnv("HSTS_PRELOAD", "false") == "true",
+		RateRoutes:      getEnv("RATE_LIMIT_ROUTES", ""),
+		Compression:     getEnv("COMPRESSION", "gzip"),
+		CompressLevel:   getEnvInt("COMPRESS_LEVEL", gzip.DefaultCompression),
+		CompressMinSize: getEnvInt("COMPRESS_MIN_BYTES", handler.DefaultCompressMinSize),
+		OnionMode:       onionMode,
+		Receipts:        getEnv("TRANSFER_RECEIPTS", "false") == "true",
+		ReceiptTTL:      getEnvDuration("TRANSFER_RECEIPT_RETENTION", 30*24*time.Hour),
+	}
+	features, err := feature.ParseEnv(getEnv("FEATURES", ""))
+	if err != nil {
+		log.Fatalf("Invalid FEATURES: %v", err)
+	}
+	cfg.Features = features
+	cfg.AllowedOrigins = getEnv("ALLOWED_ORIGINS", cfg.AppDomain)
+	cfg.AllowedHosts = getEnv("ALLOWED_HOSTS", cfg.AppDomain)
+	cfg.WebAuthnRPID = getEnv("WEBAUTHN_RP_ID", cfg.AppDomain)
+	cfg.WebAuthnOrigin = getEnv("WEBAUTHN_ORIGIN", "")
+	if cfg.WebAuthnOrigin == "" && cfg.WebAuthnRPID != "" {
+		cfg.WebAuthnOrigin = "https://" + cfg.WebAuthnRPID
+	}
+	cfg.OIDCIssuer = getEnv("OIDC_ISSUER", "")
+	cfg.OIDCClientID = getEnv("OIDC_CLIENT_ID", "")
+	cfg.OIDCSecret = getEnv("OIDC_CLIENT_SECRET", "")
+	cfg.OIDCRedirectURL = getEnv("OIDC_REDIRECT_URL", "")
+	if cfg.OIDCRedirectURL == "" && cfg.AppDomain != "" {
+		cfg.OIDCRedirectURL = "https://" + cfg.AppDomain + "/auth/oidc/callback"
+	}
+	for _, v := range strings.Split(getEnv("OIDC_ALLOWED", ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			cfg.OIDCAllowed = append(cfg.OIDCAllowed, v)
+		}
+	}
+	// Probes hit /healthz and /readyz every few seconds, usually from the
+	// load balancer's address; they should not eat its clients' budget.
+	for _, v := range strings.Split(getEnv("RATE_LIMIT_EXEMPT_PATHS", "/healthz,/readyz"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			cfg.RateExemptPaths = append(cfg.RateExemptPaths, v)
+		}
+	}
+	for _, v := range strings.Split(getEnv("RATE_LIMIT_EXEMPT_CIDRS", ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			cfg.RateExemptNets = append(cfg.RateExemptNets, v)
+		}
+	}
+	for _, v := range strings.Split(getEnv("COMPRESS_TYPES", ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			cfg.CompressTypes = append(cfg.CompressTypes, v)
+		}
+	}
+	return cfg
+}
+
+// argonParams converts the ARGON2_* settings, rejecting values that do not
+// fit Argon2's parameter types.
+func (c *config) argonParams() (auth.ArgonParams, error) {
+	if c.ArgonTime < 1 || int64(c.ArgonTime) > math.MaxUint32 ||
+		c.ArgonMemoryKiB < 1 || int64(c.ArgonMemoryKiB) > math.MaxUint32 ||
+		c.ArgonThreads < 1 || c.ArgonThreads > math.MaxUint8 {
+		return auth.ArgonParams{}, fmt.Errorf("argon2 parameters out of range: time=%d memory=%d threads=%d",
+			c.ArgonTime, c.ArgonMemoryKiB, c.ArgonThreads)
+	}
+	p := auth.ArgonParams{
+		Time:    uint32(c.ArgonTime),
+		Memory:  uint32(c.ArgonMemoryKiB),
+		Threads: uint8(c.ArgonThreads),
 	}
+	return p, p.Validate()
+}
+
+// securityHeaders builds the response header policy. "off" drops CSP or
+// PERMISSIONS_POLICY.
+func (cfg *config) securityHeaders() (handler.SecurityHeaders, error) {
+	s := handler.SecurityHeaders{
+		CSP:                   cfg.CSP,
+		PermissionsPolicy:     cfg.Permissions,
+		HSTSMaxAge:            cfg.HSTSMaxAge,
+		HSTSIncludeSubdomains: cfg.HSTSSubdomains,
+		HSTSPreload:           cfg.HSTSPreload,
+	}
+	for name, v := range map[string]*string{"CSP": &s.CSP, "PERMISSIONS_POLICY": &s.PermissionsPolicy} {
+		if strings.ContainsAny(*v, "\r\n") {
+			return s, fmt.Errorf("invalid %s: must be a single line", name)
+		}
+		if *v == "off" {
+			*v = ""
+		}
+	}
+	// hstspreload.org rejects anything shorter or narrower.
+	if s.HSTSPreload && (s.HSTSMaxAge < 365*24*time.Hour || !s.HSTSIncludeSubdomains) {
+		return s, errors.New("HSTS_PRELOAD requires HSTS_MAX_AGE of at least 8760h and HSTS_INCLUDE_SUBDOMAINS=true")
+	}
+	return s, nil
 }
 
 func getEnv(key, defaultVal string) string {
@@ -138,6 +406,15 @@ func resolveSessionKey(secureCookies bool) (string, error) {
 	return sessionKey, nil
 }
 
+// trustedProxiesEnv returns the trusted proxy list, accepting the older
+// TRUSTED_PROXIES name.
+func trustedProxiesEnv() string {
+	if proxies := os.Getenv("TRUSTED_PROXY_CIDRS"); proxies != "" {
+		return proxies
+	}
+	return os.Getenv("TRUSTED_PROXIES")
+}
+
 func requireEnv(key string) string {
 	val := os.Getenv(key)
 	if val == "" {
@@ -147,23 +424,86 @@ func requireEnv(key string) string {
 }
 
 func run(cfg *config) error {
-	db, err := store.New(cfg.SQLitePath)
+	if cfg.LowMemory {
+		log.Printf("LOW_MEMORY profile on: argon2 %d KiB x%d workers, %d WebSocket connections, send queue %d",
+			cfg.ArgonMemoryKiB, cfg.ArgonWorkers, cfg.MaxWSConnGlobal, cfg.WSSendQueue)
+	}
+	db, err := store.Open(cfg.SQLitePath, store.Options{CacheKiB: cfg.SQLiteCacheKiB})
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+
+	// Subsystems stop in reverse registration order: HTTP first, the store
+	// last.
+	lc := lifecycle.New()
+	lc.Register(lifecycle.Hook{
+		Name: "store",
+		Stop: func(context.Context) error { return db.Close() },
+	})
+	flags, err := feature.New(db, cfg.Features)
+	if err != nil {
+		return fmt.Errorf("load feature flags: %w", err)
+	}
 
 	// Secret Hash Loading Strategy:
 	// 1. Env var APP_SECRET_HASH
 	// 2. DB Config (store.ConfigKeySecretHash)
 	// 3. Fatal error
+	argonParams, err := cfg.argonParams()
+	if err != nil {
+		log.Fatalf("Invalid ARGON2_* settings: %v", err)
+	}
+	for name, v := range map[string]string{
+		"MIN_CLIENT_VERSION":         cfg.MinClientVer,
+		"RECOMMENDED_CLIENT_VERSION": cfg.RecClientVer,
+	} {
+		if _, err := realtime.ParseVersion(v); v != "" && err != nil {
+			log.Fatalf("Invalid %s %q: want a dotted version like 1.4.0", name, v)
+		}
+	}
+	if l := cfg.WSCompressLevel; l != flate.DefaultCompression && (l < flate.BestSpeed || l > flate.BestCompression) {
+		log.Fatalf("Invalid WS_COMPRESS_LEVEL %d: want 1 (fastest) to 9 (smallest), or -1 for the default", l)
+	}
+	ticketBinding := cfg.TicketBinding
+	switch ticketBinding {
+	case "off":
+		ticketBinding = ""
+	case handler.TicketBindIP, handler.TicketBindSubnet:
+	default:
+		log.Fatalf("Invalid TICKET_BINDING %q: want off, ip or subnet", ticketBinding)
+	}
+	if cfg.OnionMode && ticketBinding != "" {
+		log.Printf("WARNING: TICKET_BINDING=%s is ignored in onion mode", ticketBinding)
+	}
+	textPolicy, err := realtime.ParseTextPolicy(cfg.TextPolicy)
+	if err != nil {
+		log.Fatalf("Invalid TEXT_POLICY: %v", err)
+	}
 	hash := os.Getenv("APP_SECRET_HASH")
-	if hash == "" {
-		var err error
+	hashInDB := hash == ""
+	if hashInDB {
 		hash, err = db.GetConfig(store.ConfigKeySecretHash)
 		if err != nil || hash == "" {
 			log.Fatal("APP_SECRET_HASH is required")
 		}
+	} else if auth.NeedsRehash(hash, argonParams) {
+		// The env var wins over the database on every start, so an
+		// upgraded hash could never take effect; ask for a new one instead.
+		log.Printf("APP_SECRET_HASH is weaker than the configured ARGON2_* parameters; regenerate it to upgrade")
+	}
+
+	// The admin secret is separate from the device secret and optional; with
+	// neither source set, /api/admin/login is disabled and only the first
+	// device can be enrolled, with the bootstrap token.
+	adminHash := os.Getenv("ADMIN_SECRET_HASH")
+	if adminHash == "" {
+		adminHash, err = db.GetConfig(store.ConfigKeyAdminSecretHash)
+		if err != nil && !errors.Is(err, store.ErrConfigNotFound) {
+			log.Fatalf("Failed to load admin secret hash: %v", err)
+		}
+	}
+	if adminHash == "" {
+		log.Printf("ADMIN_SECRET_HASH not set; admin login is disabled")
 	}
 
 	sessionKey, err := resolveSessionKey(cfg.SecureCookies)
@@ -171,50 +511,253 @@ func run(cfg *config) error {
 		log.Fatal(err)
 	}
 	tokenManager := auth.NewTokenManager([]byte(sessionKey))
-
-	proxies := os.Getenv("TRUSTED_PROXY_CIDRS")
-	if proxies == "" {
-		proxies = os.Getenv("TRUSTED_PROXIES")
+	tokenManager.SetRevoker(db)
+	if cfg.EncryptTokens {
+		tokenManager.SetEncrypted(cfg.SignedTokens)
+	} else if !cfg.SignedTokens {
+		log.Fatal("ACCEPT_SIGNED_TOKENS=false requires ENCRYPT_TOKENS=true")
+	}
+	totpCipher, err := auth.NewSeedCipher([]byte(sessionKey))
+	if err != nil {
+		log.Fatal(err)
 	}
-	if proxies != "" {
+
+	if proxies := trustedProxiesEnv(); proxies != "" {
 		if err := handler.SetTrustedProxies(strings.Split(proxies, ",")); err != nil {
 			log.Fatalf("Invalid trusted proxy list: %v", err)
 		}
 	}
 
+	securityHeaders, err := cfg.securityHeaders()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	origins, err := handler.ParseOrigins(cfg.AllowedOrigins)
+	if err != nil {
+		log.Fatalf("Invalid ALLOWED_ORIGINS: %v", err)
+	}
+	hosts, err := handler.ParseHosts(cfg.AllowedHosts, isDevEnv())
+	if err != nil {
+		log.Fatalf("Invalid ALLOWED_HOSTS: %v", err)
+	}
+
+	var certPins *certpin.Pins
+	var certAlerter *certpin.Alerter
+	if cfg.CertPins != "" || cfg.CertFile != "" {
+		certPins, err = certpin.New(strings.Split(cfg.CertPins, ","), cfg.CertFile)
+		if err != nil {
+			log.Fatalf("Invalid CERT_PINS or CERT_FILE: %v", err)
+		}
+		if cfg.CertAlertURL != "" {
+			if u, err := url.Parse(cfg.CertAlertURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				log.Fatalf("Invalid CERT_ALERT_WEBHOOK %q: want an http(s) URL", cfg.CertAlertURL)
+			}
+			certAlerter = certpin.NewAlerter(cfg.CertAlertURL, certpin.DefaultAlertQuiet)
+		}
+	}
+
+	var oidc *auth.OIDCProvider
+	if cfg.OIDCIssuer != "" {
+		if cfg.OIDCClientID == "" || cfg.OIDCRedirectURL == "" {
+			log.Fatal("OIDC_ISSUER requires OIDC_CLIENT_ID and OIDC_REDIRECT_URL (or APP_DOMAIN)")
+		}
+		if len(cfg.OIDCAllowed) == 0 {
+			log.Fatal("OIDC_ISSUER requires OIDC_ALLOWED; without it any account at the issuer could log in")
+		}
+		oidc = auth.NewOIDCProvider(auth.OIDCConfig{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+		})
+	}
+
 	connLimiter := limit.NewConnLimiter(cfg.MaxWSConnPerIP, cfg.MaxWSConnGlobal)
+	connLimiter.SetIPv6PrefixLen(cfg.IPv6PrefixLen)
 	loginLimiter := limit.NewIPLimiter(rate.Limit(cfg.RateLimitRPS), 10)
+	loginLimiter.SetIPv6PrefixLen(cfg.IPv6PrefixLen)
+	challengeLimiter := limit.NewDeviceLimiter(rate.Limit(cfg.ChallengeRate/60), 3)
+	pushLimiter := limit.NewDeviceLimiter(rate.Limit(cfg.PushRate/60), 5)
+
+	var challengeStore auth.Challenges
+	switch cfg.ChallengeStore {
+	case "memory":
+		memStore := auth.NewChallengeStore(cfg.ChallengeTTL)
+		lc.Register(lifecycle.Hook{
+			Name: "challenges",
+			Stop: func(context.Context) error {
+				memStore.Stop()
+				return nil
+			},
+		})
+		challengeStore = memStore
+	case "sqlite":
+		// Shared through the database so replicas can serve either half
+		// of the challenge/attest flow; the janitor prunes expired rows.
+		challengeStore = auth.NewDBChallengeStore(db, cfg.ChallengeTTL)
+	default:
+		log.Fatalf("Invalid CHALLENGE_STORE %q: want memory or sqlite", cfg.ChallengeStore)
+	}
+
+	pairingStore := auth.NewPairingStore(cfg.PairingCodeTTL)
+	lc.Register(lifecycle.Hook{
+		Name: "pairing",
+		Stop: func(context.Context) error {
+			pairingStore.Stop()
+			return nil
+		},
+	})
 
-	challengeStore := auth.NewChallengeStore(cfg.ChallengeTTL)
-	defer challengeStore.Stop()
+	// Each verification holds ARGON2_MEMORY_KIB, so the worker count is
+	// what bounds login memory under a burst.
+	verifier := auth.NewVerifierPool(cfg.ArgonWorkers, cfg.ArgonQueue, cfg.ArgonQueueWait)
+	lc.Register(lifecycle.Hook{
+		Name: "verifier",
+		Stop: func(context.Context) error {
+			verifier.Stop()
+			return nil
+		},
+	})
+
+	var adminNonces *auth.NonceCache
+	if cfg.SignAdminCalls {
+		adminNonces = auth.NewNonceCache()
+		lc.Register(lifecycle.Hook{
+			Name: "admin-nonces",
+			Stop: func(context.Context) error {
+				adminNonces.Stop()
+				return nil
+			},
+		})
+	}
 
 	hub := realtime.NewHub()
-	go hub.Run()
-	defer hub.Stop()
+	hub.SetCommandAuthorizer(db)
+	hub.SetPeerPolicy(db)
+	hub.SetSettingsStore(db)
+	waker := wake.New(db, cfg.WakeGrace)
+	hub.SetWaker(waker)
+	hub.SetSendQueue(cfg.WSSendQueue)
+	hub.SetDropLogSampling(cfg.WSDropLogSample)
+	hub.SetTextPolicy(textPolicy)
+	hub.SetKeyRotation(realtime.KeyRotation{Interval: cfg.KeyRotateEvery, Bytes: int64(cfg.KeyRotateBytes)})
+	lc.Register(lifecycle.Hook{
+		Name: "hub",
+		Start: func(context.Context) error {
+			go hub.Run()
+			return nil
+		},
+		// Waits for the drain close frames, whose reconnect grants and
+		// connection audit rows go to the store that stops after this.
+		Stop: hub.Shutdown,
+	})
+
+	pruneCtx, stopPrune := context.WithCancel(context.Background())
+	lc.Register(lifecycle.Hook{
+		Name: "janitor",
+		Start: func(context.Context) error {
+			go pruneStore(pruneCtx, db, cfg)
+			return nil
+		},
+		Stop: func(context.Context) error {
+			stopPrune()
+			return nil
+		},
+	})
 
 	h := handler.New(handler.Config{
-		Store:          db,
-		TokenManager:   tokenManager,
-		LoginLimiter:   loginLimiter,
-		ConnLimiter:    connLimiter,
-		SecretHash:     hash,
-		BootstrapToken: cfg.BootstrapToken,
-		Hub:            hub,
-		SecureCookies:  cfg.SecureCookies,
-		SessionTTL:     cfg.SessionTTL,
-		ChallengeStore: challengeStore,
-		MaxWSMsgBytes:  cfg.MaxWSMsgBytes,
-		AllowedOrigin:  cfg.AppDomain,
+		Store:              db,
+		TokenManager:       tokenManager,
+		LoginLimiter:       loginLimiter,
+		ConnLimiter:        connLimiter,
+		SecretHash:         hash,
+		BootstrapToken:     cfg.BootstrapToken,
+		Hub:                hub,
+		SecureCookies:      cfg.SecureCookies,
+		HostCookies:        cfg.HostCookies,
+		LegacyCookies:      cfg.LegacyCookies,
+		SessionTTL:         cfg.SessionTTL,
+		SessionMaxLifetime: cfg.SessionMaxLife,
+		DeviceTicketTTL:    cfg.DeviceTicketTTL,
+		DeviceTicketMaxTTL: cfg.DeviceTicketMax,
+		ChallengeStore:     challengeStore,
+		PairingStore:       pairingStore,
+		MaxWSMsgBytes:      cfg.MaxWSMsgBytes,
+		AllowedOrigins:     origins,
+		WebAuthnRPID:       cfg.WebAuthnRPID,
+		WebAuthnOrigin:     cfg.WebAuthnOrigin,
+		TOTPCipher:         totpCipher,
+		ArgonParams:        argonParams,
+		RehashSecret:       hashInDB,
+		AdminSecretHash:    adminHash,
+		AdminSessionTTL:    cfg.AdminSessionTTL,
+
+		// Client version policy for /ws.
+		MinClientVersion:         cfg.MinClientVer,
+		RecommendedClientVersion: cfg.RecClientVer,
+		ClientUpdateURL:          cfg.ClientUpdateURL,
+		SecretVerifier:           verifier,
+		ChallengeLimiter:         challengeLimiter,
+		PushLimiter:              pushLimiter,
+		Waker:                    waker,
+		CertPins:                 certPins,
+		CertAlerter:              certAlerter,
+		MaxChallenges:            cfg.MaxChallenges,
+		EnrollMaxInvalid:         cfg.EnrollStrikes,
+		TicketBinding:            ticketBinding,
+		AdminNonces:              adminNonces,
+		OIDC:                     oidc,
+		OIDCAllowed:              cfg.OIDCAllowed,
+		WSBufferSize:             cfg.WSBufferSize,
+		WSCompression:            cfg.WSCompression,
+		WSCompressMinBytes:       cfg.WSCompressMin,
+		WSCompressLevel:          cfg.WSCompressLevel,
+		NoConnAudit:              !cfg.ConnAudit,
+		Build:                    buildInfo(),
+		APIDocs:                  isDevEnv(),
+		OnionMode:                cfg.OnionMode,
+		TransferReceipts:         cfg.Receipts,
+		LogLevels:                cfg.LogLevels,
+		Features:                 flags,
 	})
 
 	rateLimiter := handler.NewRateLimiter(cfg.RateLimitRPS, 10)
+	rateLimiter.SetIPv6PrefixLen(cfg.IPv6PrefixLen)
+	if err := rateLimiter.SetExemptions(cfg.RateExemptPaths, cfg.RateExemptNets); err != nil {
+		log.Fatal(err)
+	}
+	routeLimits, err := handler.ParseRouteLimits(cfg.RateRoutes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := rateLimiter.SetRouteLimits(append(slices.Clone(handler.DefaultRouteLimits), routeLimits...)); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Receipts {
+		hub.SetReceiptRecorder(h)
+	}
+	hub.SetReconnector(h)
+	if cfg.OnionMode {
+		rateLimiter.SetKeyFunc(h.LimitKey)
+		log.Println("Onion mode: rate and connection limits are per device")
+	}
+
+	compression, err := handler.ParseCompression(cfg.Compression, cfg.CompressLevel, cfg.CompressMinSize, cfg.CompressTypes)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	routes := handler.Chain(
 		h.Routes(),
-		handler.SecurityHeadersMiddleware,
+		handler.ForwardedHeadersMiddleware,
+		handler.SecurityHeadersMiddleware(securityHeaders),
+		handler.RequestIDMiddleware,
 		handler.LoggingMiddleware,
+		handler.CompressMiddleware(compression),
+		handler.HostsMiddleware(hosts),
 		rateLimiter.Middleware,
-		handler.CORSMiddleware(cfg.AppDomain),
+		handler.CORSMiddleware(origins),
 		handler.MaxBytesMiddleware(cfg.MaxBodyBytes),
 	)
 
@@ -227,28 +770,96 @@ func run(cfg *config) error {
 	}
 
 	errCh := make(chan error, 1)
-	go func() {
-		log.Printf("Server starting on %s", cfg.ListenAddr)
-		errCh <- server.ListenAndServe()
-	}()
+	lc.Register(lifecycle.Hook{
+		Name: "http",
+		Start: func(context.Context) error {
+			go func() {
+				log.Printf("Server %s starting on %s", version, cfg.ListenAddr)
+				errCh <- server.ListenAndServe()
+			}()
+			return nil
+		},
+		Stop:    server.Shutdown,
+		Timeout: 30 * time.Second,
+	})
+
+	if err := lc.Start(context.Background()); err != nil {
+		return err
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
+	var serveErr error
 	select {
-	case err := <-errCh:
-		return err
+	case serveErr = <-errCh:
 	case sig := <-quit:
 		log.Printf("Received signal %v, shutting down...", sig)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := server.Shutdown(ctx); err != nil {
-		return err
+	if err := lc.Stop(context.Background()); err != nil {
+		return errors.Join(serveErr, err)
+	}
+	if serveErr != nil {
+		return serveErr
 	}
 
 	log.Println("Server stopped gracefully")
 	return nil
 }
+
+// pruneStore deletes expired audit, revocation and trash rows every hour
+// until ctx is cancelled.
+func pruneStore(ctx context.Context, db *store.Store, cfg *config) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			if n, err := db.PruneConnAttempts(now.Add(-cfg.ConnAuditTTL).UnixMilli()); err != nil {
+				log.Printf("Failed to prune connection attempts: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d connection attempts", n)
+			}
+			if n, err := db.PruneCertReports(now.Add(-cfg.CertReportTTL).UnixMilli()); err != nil {
+				log.Printf("Failed to prune certificate reports: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d certificate reports", n)
+			}
+			if n, err := db.PruneEnrollEvents(now.Add(-cfg.EnrollEventTTL).UnixMilli()); err != nil {
+				log.Printf("Failed to prune enrollment events: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d enrollment events", n)
+			}
+			if n, err := db.PruneRevokedSessions(now.UnixMilli()); err != nil {
+				log.Printf("Failed to prune revoked sessions: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d revoked sessions", n)
+			}
+			if n, err := db.PruneChallenges(now.UnixMilli()); err != nil {
+				log.Printf("Failed to prune challenges: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d expired challenges", n)
+			}
+			if n, err := db.PruneReconnectGrants(now.UnixMilli()); err != nil {
+				log.Printf("Failed to prune reconnect grants: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d expired reconnect grants", n)
+			}
+			if n, err := db.PurgeDeletedDevices(now.Add(-cfg.DeviceTrashTTL).UnixMilli()); err != nil {
+				log.Printf("Failed to purge deleted devices: %v", err)
+			} else if n > 0 {
+				log.Printf("Purged %d deleted devices", n)
+			}
+			if n, err := db.PruneTransferReceipts(now.Add(-cfg.ReceiptTTL).UnixMilli()); err != nil {
+				log.Printf("Failed to prune transfer receipts: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d transfer receipts", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
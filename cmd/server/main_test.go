@@ -51,3 +51,49 @@ func TestResolveSessionKey(t *testing.T) {
 		}
 	})
 }
+
+func TestLowMemoryProfile(t *testing.T) {
+	t.Setenv("LOW_MEMORY", "")
+	normal := loadConfig()
+	if normal.LowMemory || normal.ArgonMemoryKiB != 64*1024 || !normal.ConnAudit || normal.SQLiteCacheKiB != 0 {
+		t.Errorf("Unexpected defaults: %+v", normal)
+	}
+
+	t.Setenv("LOW_MEMORY", "1")
+	t.Setenv("ARGON2_WORKERS", "3")
+	low := loadConfig()
+	if !low.LowMemory || low.ArgonMemoryKiB != 19*1024 || low.ArgonThreads != 1 || low.WSSendQueue != 32 ||
+		low.MaxWSConnGlobal != 64 || low.SQLiteCacheKiB != 512 || low.ConnAudit {
+		t.Errorf("Profile not applied: %+v", low)
+	}
+	if low.ArgonWorkers != 3 {
+		t.Errorf("An explicit setting should win over the profile, got %d workers", low.ArgonWorkers)
+	}
+	if _, err := low.argonParams(); err != nil {
+		t.Errorf("Profile argon2 parameters rejected: %v", err)
+	}
+}
+
+func TestSecurityHeadersConfig(t *testing.T) {
+	s, err := loadConfig().securityHeaders()
+	if err != nil || s.CSP == "" || s.PermissionsPolicy == "" || s.HSTSMaxAge != 0 {
+		t.Errorf("Unexpected defaults: %+v, %v", s, err)
+	}
+
+	t.Setenv("CSP", "off")
+	t.Setenv("HSTS_MAX_AGE", "8760h")
+	t.Setenv("HSTS_PRELOAD", "true")
+	if _, err := loadConfig().securityHeaders(); err == nil {
+		t.Error("HSTS_PRELOAD without HSTS_INCLUDE_SUBDOMAINS should be rejected")
+	}
+	t.Setenv("HSTS_INCLUDE_SUBDOMAINS", "true")
+	s, err = loadConfig().securityHeaders()
+	if err != nil || s.CSP != "" || !s.HSTSPreload {
+		t.Errorf("Expected CSP off and HSTS preload, got %+v, %v", s, err)
+	}
+
+	t.Setenv("PERMISSIONS_POLICY", "camera=()\r\nX-Injected: 1")
+	if _, err := loadConfig().securityHeaders(); err == nil {
+		t.Error("A multi-line PERMISSIONS_POLICY should be rejected")
+	}
+}
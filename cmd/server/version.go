@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/lixiansheng/fileflow/internal/handler"
+)
+
+// Set at build time, for example:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) \
+//	  -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/server
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo returns the ldflags values, filling commit and build date from
+// the VCS stamp Go embeds in builds made inside a git checkout.
+func buildInfo() handler.BuildInfo {
+	info := handler.BuildInfo{Version: version, Commit: commit, BuildDate: buildDate}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// printVersion writes the one-line version shown by "fileflow version".
+func printVersion(w io.Writer) {
+	info := buildInfo()
+	fmt.Fprintf(w, "fileflow %s (commit %s, built %s, %s %s/%s)\n",
+		info.Version, orUnknown(info.Commit), orUnknown(info.BuildDate),
+		runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
@@ -0,0 +1,236 @@
+// Command tsgen generates TypeScript type definitions for the HTTP API
+// responses and WebSocket events from the Go source that defines them, so the
+// SPA and server cannot silently drift apart.
+//
+// Every exported struct with at least one json-tagged field becomes an
+// interface, and every exported string constant named Event* becomes a member
+// of the EventType union.
+//
+//	go run ./cmd/tsgen -out web/types/fileflow.d.ts internal/handler/types.go ...
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type field struct {
+	name     string
+	tsType   string
+	optional bool
+	doc      string
+}
+
+type iface struct {
+	name   string
+	doc    string
+	fields []field
+}
+
+type eventConst struct {
+	name  string
+	value string
+}
+
+func main() {
+	out := flag.String("out", "", "output .d.ts path (stdout if empty)")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Fatal("usage: tsgen -out file.d.ts <go files...>")
+	}
+
+	var ifaces []iface
+	var events []eventConst
+	fset := token.NewFileSet()
+	for _, path := range flag.Args() {
+		f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			log.Fatalf("parse %s: %v", path, err)
+		}
+		i, e := collect(f)
+		ifaces = append(ifaces, i...)
+		events = append(events, e...)
+	}
+
+	sortIfaces(ifaces)
+
+	src := render(ifaces, events)
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func sortIfaces(ifaces []iface) {
+	sort.Slice(ifaces, func(a, b int) bool { return ifaces[a].name < ifaces[b].name })
+}
+
+func collect(f *ast.File) ([]iface, []eventConst) {
+	var ifaces []iface
+	var events []eventConst
+
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				st, ok := s.Type.(*ast.StructType)
+				if !ok || !s.Name.IsExported() {
+					continue
+				}
+				doc := s.Doc
+				if doc == nil {
+					doc = gen.Doc
+				}
+				if i, ok := structIface(s.Name.Name, doc, st); ok {
+					ifaces = append(ifaces, i)
+				}
+			case *ast.ValueSpec:
+				if gen.Tok != token.CONST {
+					continue
+				}
+				for idx, name := range s.Names {
+					if !strings.HasPrefix(name.Name, "Event") || idx >= len(s.Values) {
+						continue
+					}
+					lit, ok := s.Values[idx].(*ast.BasicLit)
+					if !ok || lit.Kind != token.STRING {
+						continue
+					}
+					v, err := strconv.Unquote(lit.Value)
+					if err != nil {
+						continue
+					}
+					events = append(events, eventConst{name: name.Name, value: v})
+				}
+			}
+		}
+	}
+	return ifaces, events
+}
+
+func structIface(name string, doc *ast.CommentGroup, st *ast.StructType) (iface, bool) {
+	out := iface{name: name, doc: doc.Text()}
+	for _, f := range st.Fields.List {
+		if f.Tag == nil || len(f.Names) == 0 {
+			continue
+		}
+		tag, err := strconv.Unquote(f.Tag.Value)
+		if err != nil {
+			continue
+		}
+		jsonTag := reflect.StructTag(tag).Get("json")
+		if jsonTag == "" || jsonTag == "-" {
+			continue
+		}
+		jsonName, opts, _ := strings.Cut(jsonTag, ",")
+		_, isPtr := f.Type.(*ast.StarExpr)
+		out.fields = append(out.fields, field{
+			name:     jsonName,
+			tsType:   tsType(f.Type),
+			optional: strings.Contains(opts, "omitempty") || isPtr,
+			doc:      strings.TrimSpace(f.Doc.Text()),
+		})
+	}
+	return out, len(out.fields) > 0
+}
+
+func tsType(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return "string"
+		case "bool":
+			return "boolean"
+		case "int", "int8", "int16", "int32", "int64",
+			"uint", "uint8", "uint16", "uint32", "uint64",
+			"float32", "float64":
+			return "number"
+		case "any":
+			return "unknown"
+		}
+		return t.Name
+	case *ast.StarExpr:
+		return tsType(t.X)
+	case *ast.ArrayType:
+		if id, ok := t.Elt.(*ast.Ident); ok && id.Name == "byte" {
+			return "string"
+		}
+		return tsType(t.Elt) + "[]"
+	case *ast.MapType:
+		return "Record<string, " + tsType(t.Value) + ">"
+	case *ast.InterfaceType:
+		return "unknown"
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	}
+	return "unknown"
+}
+
+func render(ifaces []iface, events []eventConst) []byte {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by cmd/tsgen. DO NOT EDIT.\n\n")
+
+	if len(events) > 0 {
+		b.WriteString("export type EventType =\n")
+		for i, e := range events {
+			sep := ""
+			if i == len(events)-1 {
+				sep = ";"
+			}
+			fmt.Fprintf(&b, "  | %q%s\n", e.value, sep)
+		}
+		b.WriteString("\n")
+	}
+
+	for _, i := range ifaces {
+		if i.doc != "" {
+			writeDoc(&b, "", i.doc)
+		}
+		fmt.Fprintf(&b, "export interface %s {\n", i.name)
+		for _, f := range i.fields {
+			if f.doc != "" {
+				writeDoc(&b, "  ", f.doc)
+			}
+			opt := ""
+			if f.optional {
+				opt = "?"
+			}
+			fmt.Fprintf(&b, "  %s%s: %s;\n", f.name, opt, f.tsType)
+		}
+		b.WriteString("}\n\n")
+	}
+
+	return append(bytes.TrimRight(b.Bytes(), "\n"), '\n')
+}
+
+func writeDoc(b *bytes.Buffer, indent, doc string) {
+	lines := strings.Split(strings.TrimSpace(doc), "\n")
+	if len(lines) == 1 {
+		fmt.Fprintf(b, "%s/** %s */\n", indent, lines[0])
+		return
+	}
+	fmt.Fprintf(b, "%s/**\n", indent)
+	for _, l := range lines {
+		fmt.Fprintf(b, "%s * %s\n", indent, l)
+	}
+	fmt.Fprintf(b, "%s */\n", indent)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"os"
+	"testing"
+)
+
+// TestGeneratedTypesUpToDate fails when web/types/fileflow.d.ts no longer
+// matches the Go definitions; run `go generate ./internal/handler` to fix.
+func TestGeneratedTypesUpToDate(t *testing.T) {
+	sources := []string{
+		"../../internal/handler/api.go",
+		"../../internal/handler/types.go",
+		"../../internal/realtime/events.go",
+		"../../internal/realtime/hub.go",
+		"../../internal/store/audit.go",
+		"../../internal/store/enrollevents.go",
+		"../../internal/store/receipts.go",
+	}
+
+	var ifaces []iface
+	var events []eventConst
+	fset := token.NewFileSet()
+	for _, path := range sources {
+		f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			t.Fatalf("parse %s: %v", path, err)
+		}
+		i, e := collect(f)
+		ifaces = append(ifaces, i...)
+		events = append(events, e...)
+	}
+	sortIfaces(ifaces)
+
+	want, err := os.ReadFile("../../web/types/fileflow.d.ts")
+	if err != nil {
+		t.Fatalf("read generated file: %v", err)
+	}
+	if got := render(ifaces, events); string(got) != string(want) {
+		t.Error("web/types/fileflow.d.ts is stale; run go generate ./internal/handler")
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/gorilla/websocket v1.5.3
 	golang.org/x/crypto v0.47.0
 	golang.org/x/time v0.14.0
+	modernc.org/sqlite v1.44.0
 )
 
 require (
@@ -19,5 +20,4 @@ require (
 	modernc.org/libc v1.67.4 // indirect
 	modernc.org/mathutil v1.7.1 // indirect
 	modernc.org/memory v1.11.0 // indirect
-	modernc.org/sqlite v1.44.0 // indirect
 )
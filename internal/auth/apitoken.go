@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// APITokenPrefix marks long-lived API tokens so they are told apart from
+// admin tokens in an Authorization header and are easy to spot in leaks.
+const APITokenPrefix = "ffat_"
+
+// GenerateAPIToken returns a new API token and the hash to store for it.
+// The token itself is shown once and never stored.
+func GenerateAPIToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = APITokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashAPIToken(token), nil
+}
+
+// HashAPIToken returns the hex SHA-256 an API token is stored and looked up
+// by. The token has 256 random bits, so a fast hash is enough.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAPIToken reports whether token looks like one from GenerateAPIToken.
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, APITokenPrefix)
+}
+
+// AppTokenPrefix marks app tokens: send-only tokens an admin creates for
+// scripts and home-automation systems that push to devices without being
+// enrolled themselves.
+const AppTokenPrefix = "ffapp_"
+
+// GenerateAppToken returns a new app token and the hash to store for it,
+// which HashAPIToken also computes.
+func GenerateAppToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = AppTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashAPIToken(token), nil
+}
+
+// IsAppToken reports whether token looks like one from GenerateAppToken.
+func IsAppToken(token string) bool {
+	return strings.HasPrefix(token, AppTokenPrefix)
+}
+
+// ReconnectTokenPrefix marks fast-reconnect tokens, which the server puts
+// in the close frame of a connection it ends so the device can connect
+// again without a new challenge.
+const ReconnectTokenPrefix = "ffrc_"
+
+// GenerateReconnectToken returns a new reconnect token and the hash to
+// store for it. The token is short enough for a close frame's reason.
+func GenerateReconnectToken() (token, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = ReconnectTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashAPIToken(token), nil
+}
@@ -21,6 +21,17 @@ type Challenge struct {
 	ExpiresAt time.Time
 }
 
+// Challenges issues and redeems single-use attestation challenges. The
+// in-memory ChallengeStore suits a single instance; DBChallengeStore shares
+// challenges between replicas.
+type Challenges interface {
+	Create(deviceID string) (*Challenge, error)
+	Consume(id string) (*Challenge, error)
+	// CountForDevice returns the number of unexpired challenges issued to
+	// deviceID.
+	CountForDevice(deviceID string) int
+}
+
 type ChallengeStore struct {
 	mu         sync.RWMutex
 	challenges map[string]*Challenge
@@ -67,17 +78,24 @@ func (cs *ChallengeStore) cleanup() {
 	}
 }
 
-func (cs *ChallengeStore) Create(deviceID string) (*Challenge, error) {
+func newChallenge(deviceID string, ttl time.Duration) (*Challenge, error) {
 	nonce := make([]byte, 32)
 	if _, err := rand.Read(nonce); err != nil {
 		return nil, err
 	}
 
-	challenge := &Challenge{
+	return &Challenge{
 		ID:        uuid.NewString(),
 		DeviceID:  deviceID,
 		Nonce:     nonce,
-		ExpiresAt: time.Now().Add(cs.ttl),
+		ExpiresAt: time.Now().Add(ttl),
+	}, nil
+}
+
+func (cs *ChallengeStore) Create(deviceID string) (*Challenge, error) {
+	challenge, err := newChallenge(deviceID, cs.ttl)
+	if err != nil {
+		return nil, err
 	}
 
 	cs.mu.Lock()
@@ -87,6 +105,21 @@ func (cs *ChallengeStore) Create(deviceID string) (*Challenge, error) {
 	return challenge, nil
 }
 
+// CountForDevice returns the number of unexpired challenges issued to deviceID.
+func (cs *ChallengeStore) CountForDevice(deviceID string) int {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	n := 0
+	for _, c := range cs.challenges {
+		if c.DeviceID == deviceID && now.Before(c.ExpiresAt) {
+			n++
+		}
+	}
+	return n
+}
+
 func (cs *ChallengeStore) Consume(id string) (*Challenge, error) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
@@ -0,0 +1,57 @@
+package auth
+
+import "time"
+
+// ChallengeDB persists challenges for DBChallengeStore. store.Store
+// implements it.
+type ChallengeDB interface {
+	InsertChallenge(c *Challenge) error
+	// TakeChallenge deletes and returns the challenge with id in one step,
+	// or ErrChallengeNotFound, so only one replica can redeem it.
+	TakeChallenge(id string) (*Challenge, error)
+	CountChallenges(deviceID string, now time.Time) (int, error)
+}
+
+// DBChallengeStore keeps challenges in the database so the challenge and
+// attest requests may land on different instances. Expired rows are
+// rejected on Consume and removed by the server's janitor.
+type DBChallengeStore struct {
+	db  ChallengeDB
+	ttl time.Duration
+}
+
+func NewDBChallengeStore(db ChallengeDB, ttl time.Duration) *DBChallengeStore {
+	return &DBChallengeStore{db: db, ttl: ttl}
+}
+
+func (ds *DBChallengeStore) Create(deviceID string) (*Challenge, error) {
+	challenge, err := newChallenge(deviceID, ds.ttl)
+	if err != nil {
+		return nil, err
+	}
+	if err := ds.db.InsertChallenge(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func (ds *DBChallengeStore) Consume(id string) (*Challenge, error) {
+	challenge, err := ds.db.TakeChallenge(id)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(challenge.ExpiresAt) {
+		return nil, ErrChallengeExpired
+	}
+	return challenge, nil
+}
+
+// CountForDevice reports 0 if the lookup fails; it only feeds the admin
+// impact preview.
+func (ds *DBChallengeStore) CountForDevice(deviceID string) int {
+	n, err := ds.db.CountChallenges(deviceID, time.Now())
+	if err != nil {
+		return 0
+	}
+	return n
+}
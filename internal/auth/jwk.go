@@ -1,7 +1,9 @@
 package auth
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/base64"
@@ -11,12 +13,13 @@ import (
 	"math/big"
 )
 
-// ECPublicJWK represents the public portion of an EC JWK (P-256).
+// ECPublicJWK represents the public portion of a device JWK: EC P-256, or
+// OKP Ed25519 (which has no Y coordinate).
 type ECPublicJWK struct {
 	Kty string `json:"kty"`
 	Crv string `json:"crv"`
 	X   string `json:"x"`
-	Y   string `json:"y"`
+	Y   string `json:"y,omitempty"`
 }
 
 var ErrInvalidJWK = errors.New("invalid public key")
@@ -64,6 +67,43 @@ func ParseECPublicJWKBytes(b []byte) (*ecdsa.PublicKey, *ECPublicJWK, error) {
 	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, &jwk, nil
 }
 
+// ParsePublicJWKMap is ParsePublicJWKBytes for a decoded JSON object.
+func ParsePublicJWKMap(m map[string]interface{}) (crypto.PublicKey, *ECPublicJWK, error) {
+	if m == nil {
+		return nil, nil, ErrInvalidJWK
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, ErrInvalidJWK
+	}
+	return ParsePublicJWKBytes(b)
+}
+
+// ParsePublicJWKBytes accepts any supported device key type and returns an
+// *ecdsa.PublicKey for EC P-256 or an ed25519.PublicKey for OKP Ed25519.
+func ParsePublicJWKBytes(b []byte) (crypto.PublicKey, *ECPublicJWK, error) {
+	var jwk ECPublicJWK
+	if err := json.Unmarshal(b, &jwk); err != nil {
+		return nil, nil, ErrInvalidJWK
+	}
+
+	switch {
+	case jwk.Kty == "EC":
+		return ParseECPublicJWKBytes(b)
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		if jwk.Y != "" {
+			return nil, nil, ErrInvalidJWK
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, nil, ErrInvalidJWK
+		}
+		return ed25519.PublicKey(x), &jwk, nil
+	}
+	return nil, nil, ErrInvalidJWK
+}
+
 func EqualECPublicJWK(a, b *ECPublicJWK) bool {
 	if a == nil || b == nil {
 		return false
@@ -75,11 +115,13 @@ func DeviceIDFromJWK(jwk *ECPublicJWK) (string, error) {
 	if jwk == nil {
 		return "", ErrInvalidJWK
 	}
+	// Y is omitted for OKP keys; EC keys always have one, so their IDs are
+	// unchanged.
 	canonical := struct {
 		Kty string `json:"kty"`
 		Crv string `json:"crv"`
 		X   string `json:"x"`
-		Y   string `json:"y"`
+		Y   string `json:"y,omitempty"`
 	}{
 		Kty: jwk.Kty,
 		Crv: jwk.Crv,
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestParsePublicJWKBytes(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	x := base64.RawURLEncoding.EncodeToString(pub)
+
+	tests := []struct {
+		name    string
+		jwk     string
+		wantErr bool
+	}{
+		{"Ed25519", `{"kty":"OKP","crv":"Ed25519","x":"` + x + `"}`, false},
+		{"X25519", `{"kty":"OKP","crv":"X25519","x":"` + x + `"}`, true},
+		{"ShortKey", `{"kty":"OKP","crv":"Ed25519","x":"AAAA"}`, true},
+		{"OKPWithY", `{"kty":"OKP","crv":"Ed25519","x":"` + x + `","y":"` + x + `"}`, true},
+		{"RSA", `{"kty":"RSA","n":"AQAB","e":"AQAB"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParsePublicJWKBytes([]byte(tt.jwk))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	key, jwk, err := ParsePublicJWKBytes([]byte(tests[0].jwk))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	msg := []byte("nonce")
+	if !VerifySignature(key, msg, ed25519.Sign(priv, msg)) {
+		t.Error("Expected valid Ed25519 signature to verify")
+	}
+	if VerifySignature(key, []byte("other"), ed25519.Sign(priv, msg)) {
+		t.Error("Expected signature over a different message to fail")
+	}
+
+	id, err := DeviceIDFromJWK(jwk)
+	if err != nil || !ValidateDeviceIDFormat(id) {
+		t.Errorf("Unexpected device ID %q: %v", id, err)
+	}
+}
@@ -0,0 +1,428 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrOIDCDiscovery = errors.New("oidc: provider discovery failed")
+	ErrOIDCExchange  = errors.New("oidc: code exchange failed")
+	ErrOIDCIDToken   = errors.New("oidc: invalid id token")
+)
+
+// oidcLeeway absorbs clock skew between this server and the provider when
+// checking ID token times.
+const oidcLeeway = time.Minute
+
+// oidcKeyRefresh is the least time between two JWKS fetches, so tokens
+// naming unknown keys cannot make every login hit the provider.
+const oidcKeyRefresh = time.Minute
+
+// OIDCConfig names an OpenID Connect provider and this server's client
+// registration with it.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the registered callback, ending in /auth/oidc/callback.
+	RedirectURL string
+	// Scopes defaults to openid, email and profile.
+	Scopes []string
+	// HTTPClient defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+}
+
+// OIDCIdentity is what a verified ID token says about the user.
+type OIDCIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// OIDCProvider runs the authorization code flow (with PKCE) against one
+// provider. The discovery document and signing keys are fetched on first
+// use, so the server starts while the provider is unreachable.
+type OIDCProvider struct {
+	cfg OIDCConfig
+
+	mu     sync.Mutex
+	meta   *oidcMetadata
+	keys   map[string]crypto.PublicKey
+	keysAt time.Time
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewOIDCProvider(cfg OIDCConfig) *OIDCProvider {
+	cfg.Issuer = strings.TrimRight(cfg.Issuer, "/")
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OIDCProvider{cfg: cfg}
+}
+
+// Issuer returns the configured issuer URL.
+func (p *OIDCProvider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+// OIDCVerifier derives the PKCE code verifier for a login's state. It is
+// keyed with the token secret so it cannot be worked out from the state in
+// the authorization URL, and needs no storage between login and callback.
+func (tm *TokenManager) OIDCVerifier(state string) string {
+	mac := hmac.New(sha256.New, tm.secret)
+	mac.Write([]byte("fileflow oidc verifier v1\x00" + state))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// OIDCNonce derives the ID token nonce for a login's state.
+func (tm *TokenManager) OIDCNonce(state string) string {
+	mac := hmac.New(sha256.New, tm.secret)
+	mac.Write([]byte("fileflow oidc nonce v1\x00" + state))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// AuthCodeURL returns the provider URL to send the browser to.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades an authorization code for an ID token and returns the
+// identity in it once its signature, issuer, audience, expiry and nonce
+// check out.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (*OIDCIdentity, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCExchange, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCExchange, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrOIDCExchange, resp.StatusCode)
+	}
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil || tok.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in response", ErrOIDCExchange)
+	}
+	return p.verifyIDToken(ctx, tok.IDToken, nonce, time.Now())
+}
+
+type idTokenClaims struct {
+	Iss           string          `json:"iss"`
+	Sub           string          `json:"sub"`
+	Aud           json.RawMessage `json:"aud"`
+	Azp           string          `json:"azp"`
+	Exp           int64           `json:"exp"`
+	Iat           int64           `json:"iat"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified json.RawMessage `json:"email_verified"`
+	Name          string          `json:"name"`
+}
+
+// audiences reads aud, which may be a single string or a list.
+func (c *idTokenClaims) audiences() []string {
+	var one string
+	if json.Unmarshal(c.Aud, &one) == nil {
+		return []string{one}
+	}
+	var many []string
+	json.Unmarshal(c.Aud, &many)
+	return many
+}
+
+// emailVerified reads email_verified, which some providers send as a
+// string.
+func (c *idTokenClaims) emailVerified() bool {
+	var b bool
+	if json.Unmarshal(c.EmailVerified, &b) == nil {
+		return b
+	}
+	var s string
+	return json.Unmarshal(c.EmailVerified, &s) == nil && s == "true"
+}
+
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, raw, nonce string, now time.Time) (*OIDCIdentity, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrOIDCIDToken
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrOIDCIDToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, ErrOIDCIDToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrOIDCIDToken
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrOIDCIDToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrOIDCIDToken
+	}
+	var c idTokenClaims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, ErrOIDCIDToken
+	}
+
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	aud := c.audiences()
+	switch {
+	case c.Iss != meta.Issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrOIDCIDToken, c.Iss)
+	case !containsString(aud, p.cfg.ClientID):
+		return nil, fmt.Errorf("%w: not issued to this client", ErrOIDCIDToken)
+	case len(aud) > 1 && c.Azp != p.cfg.ClientID:
+		return nil, fmt.Errorf("%w: azp %q", ErrOIDCIDToken, c.Azp)
+	case c.Sub == "":
+		return nil, fmt.Errorf("%w: no subject", ErrOIDCIDToken)
+	case now.After(time.Unix(c.Exp, 0).Add(oidcLeeway)):
+		return nil, fmt.Errorf("%w: expired", ErrOIDCIDToken)
+	case c.Iat != 0 && time.Unix(c.Iat, 0).After(now.Add(oidcLeeway)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrOIDCIDToken)
+	case subtle.ConstantTimeCompare([]byte(c.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrOIDCIDToken)
+	}
+
+	return &OIDCIdentity{
+		Subject:       c.Sub,
+		Email:         c.Email,
+		EmailVerified: c.emailVerified(),
+		Name:          c.Name,
+	}, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWS checks a JWS signature for the algorithms providers commonly
+// sign ID tokens with. "none" and HMAC algorithms are never accepted.
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		h := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		return ok && len(sig) == 64 && VerifyECDSASignature(k, signed, sig)
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		return ok && VerifySignature(k, signed, sig)
+	}
+	return false
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	var meta oidcMetadata
+	if err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCDiscovery, err)
+	}
+	// The document must describe the issuer it was fetched for (OIDC
+	// Discovery §4.3), or ID tokens would be checked against another one.
+	if strings.TrimRight(meta.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("%w: document is for issuer %q", ErrOIDCDiscovery, meta.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: missing endpoints", ErrOIDCDiscovery)
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// key returns the signing key kid, refetching the JWKS when it is unknown
+// (the provider may have rotated keys) at most once per oidcKeyRefresh.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysAt) < oidcKeyRefresh {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrOIDCIDToken, kid)
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	p.keysAt = time.Now()
+	if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("%w: fetching keys: %v", ErrOIDCDiscovery, err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		var hdr struct {
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+		}
+		if json.Unmarshal(raw, &hdr) != nil || (hdr.Use != "" && hdr.Use != "sig") {
+			continue
+		}
+		if k, err := parseSigningJWK(raw); err == nil {
+			keys[hdr.Kid] = k
+		}
+	}
+	p.keys = keys
+
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrOIDCIDToken, kid)
+}
+
+// parseSigningJWK reads an RSA key, or any key ParsePublicJWKBytes takes.
+func parseSigningJWK(raw []byte) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return nil, ErrInvalidJWK
+	}
+	if jwk.Kty != "RSA" {
+		k, _, err := ParsePublicJWKBytes(raw)
+		return k, err
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil || len(n) < 256 {
+		return nil, ErrInvalidJWK
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, ErrInvalidJWK
+	}
+	exp := int(new(big.Int).SetBytes(e).Int64())
+	if exp < 3 {
+		return nil, ErrInvalidJWK
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeOIDC is a provider whose token endpoint returns claims for every
+// code, signed with an RSA key it publishes as "k1".
+type fakeOIDC struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	claims   map[string]interface{}
+	verifier string
+}
+
+func newFakeOIDC(t *testing.T) *fakeOIDC {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	f := &fakeOIDC{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "shh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.verifier = r.PostFormValue("code_verifier")
+		json.NewEncoder(w).Encode(map[string]string{"id_token": f.sign(t, "RS256", f.claims)})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeOIDC) sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15 failed: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (f *fakeOIDC) validClaims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            f.URL,
+		"sub":            "user-1",
+		"aud":            "client",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+func TestOIDCProvider(t *testing.T) {
+	f := newFakeOIDC(t)
+	defer f.Close()
+
+	p := NewOIDCProvider(OIDCConfig{
+		Issuer:       f.URL + "/",
+		ClientID:     "client",
+		ClientSecret: "shh",
+		RedirectURL:  "https://app.example/auth/oidc/callback",
+	})
+	ctx := context.Background()
+
+	authURL, err := p.AuthCodeURL(ctx, "state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatalf("AuthCodeURL failed: %v", err)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	sum := sha256.Sum256([]byte("verifier-1"))
+	if !strings.HasPrefix(authURL, f.URL+"/authorize?") || q.Get("state") != "state-1" || q.Get("nonce") != "nonce-1" ||
+		q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("Unexpected auth URL: %s", authURL)
+	}
+
+	f.claims = f.validClaims("nonce-1")
+	id, err := p.Exchange(ctx, "code", "verifier-1", "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if id.Subject != "user-1" || id.Email != "alice@example.com" || !id.EmailVerified {
+		t.Errorf("Unexpected identity: %+v", id)
+	}
+	if f.verifier != "verifier-1" {
+		t.Errorf("Token request carried verifier %q", f.verifier)
+	}
+
+	for name, mutate := range map[string]func(map[string]interface{}){
+		"nonce":    func(c map[string]interface{}) { c["nonce"] = "other" },
+		"audience": func(c map[string]interface{}) { c["aud"] = "someone-else" },
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example" },
+		"expired":  func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"azp":      func(c map[string]interface{}) { c["aud"] = []string{"client", "other"} },
+	} {
+		f.claims = f.validClaims("nonce-1")
+		mutate(f.claims)
+		if _, err := p.Exchange(ctx, "code", "verifier-1", "nonce-1"); !errors.Is(err, ErrOIDCIDToken) {
+			t.Errorf("%s: expected ErrOIDCIDToken, got %v", name, err)
+		}
+	}
+
+	claims := f.validClaims("nonce-1")
+	good := f.sign(t, "RS256", claims)
+	parts := strings.Split(good, ".")
+	none, _ := json.Marshal(map[string]string{"alg": "none", "kid": "k1"})
+	for name, raw := range map[string]string{
+		"alg none":     base64.RawURLEncoding.EncodeToString(none) + "." + parts[1] + ".",
+		"tampered":     parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2],
+		"wrong alg":    f.sign(t, "ES256", claims),
+		"not a jwt":    "abc",
+		"missing part": parts[0] + "." + parts[1],
+	} {
+		if _, err := p.verifyIDToken(ctx, raw, "nonce-1", time.Now()); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestOIDCDerivedValues(t *testing.T) {
+	tm := NewTokenManager([]byte("test-secret-key-that-is-long-enough"))
+	other := NewTokenManager([]byte("another-secret-key-that-is-long-enough"))
+
+	v := tm.OIDCVerifier("state")
+	if len(v) < 43 || v == tm.OIDCVerifier("state2") || v == other.OIDCVerifier("state") || v == tm.OIDCNonce("state") {
+		t.Errorf("Verifier should be long and depend on the state and secret: %q", v)
+	}
+
+	token, err := tm.SignOIDCState("state", "device-1", time.Minute)
+	if err != nil {
+		t.Fatalf("SignOIDCState failed: %v", err)
+	}
+	if _, err := tm.VerifyWithVersion(token, TokenVersionSession); err == nil {
+		t.Error("An OIDC state token must not pass as a session")
+	}
+	claims, err := tm.VerifyWithVersion(token, TokenVersionOIDCState)
+	if err != nil || claims.SID != "state" || claims.DeviceID != "device-1" {
+		t.Errorf("VerifyWithVersion = %+v, %v", claims, err)
+	}
+}
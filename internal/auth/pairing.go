@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrPairingCodeInvalid = errors.New("invalid or expired pairing code")
+
+// PairingCodeLength and PairingAlphabet define the codes shown to users.
+// The alphabet drops 0/O, 1/I/L so codes survive being read aloud or typed
+// from another screen.
+const (
+	PairingCodeLength = 8
+	PairingAlphabet   = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+)
+
+// PairingCode is a single-use code an enrolled device issues so a new
+// device can enroll itself without the admin bootstrap token.
+type PairingCode struct {
+	Code      string
+	IssuedBy  string
+	ExpiresAt time.Time
+	// Strikes counts enrollment attempts with this code whose device
+	// payload was invalid.
+	Strikes int
+}
+
+// PairingStore holds outstanding pairing codes in memory. Each issuing
+// device has at most one live code; issuing another replaces it.
+type PairingStore struct {
+	mu     sync.Mutex
+	codes  map[string]*PairingCode
+	ttl    time.Duration
+	stopCh chan struct{}
+}
+
+func NewPairingStore(ttl time.Duration) *PairingStore {
+	ps := &PairingStore{
+		codes:  make(map[string]*PairingCode),
+		ttl:    ttl,
+		stopCh: make(chan struct{}),
+	}
+	go ps.cleanupLoop()
+	return ps
+}
+
+func (ps *PairingStore) Stop() {
+	close(ps.stopCh)
+}
+
+func (ps *PairingStore) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ps.cleanup()
+		case <-ps.stopCh:
+			return
+		}
+	}
+}
+
+func (ps *PairingStore) cleanup() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := time.Now()
+	for code, p := range ps.codes {
+		if now.After(p.ExpiresAt) {
+			delete(ps.codes, code)
+		}
+	}
+}
+
+// Create issues a new code on behalf of issuerID, revoking any code that
+// device issued earlier.
+func (ps *PairingStore) Create(issuerID string) (*PairingCode, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for code, p := range ps.codes {
+		if p.IssuedBy == issuerID {
+			delete(ps.codes, code)
+		}
+	}
+
+	for {
+		code, err := randomPairingCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, taken := ps.codes[code]; taken {
+			continue
+		}
+		p := &PairingCode{Code: code, IssuedBy: issuerID, ExpiresAt: time.Now().Add(ps.ttl)}
+		ps.codes[code] = p
+		return p, nil
+	}
+}
+
+// Consume redeems code exactly once. Input is case-insensitive and may
+// contain spaces or dashes.
+func (ps *PairingStore) Consume(code string) (*PairingCode, error) {
+	code = NormalizePairingCode(code)
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.codes[code]
+	if !ok {
+		return nil, ErrPairingCodeInvalid
+	}
+	delete(ps.codes, code)
+
+	if time.Now().After(p.ExpiresAt) {
+		return nil, ErrPairingCodeInvalid
+	}
+	return p, nil
+}
+
+// Strike counts an invalid enrollment payload against code and revokes the
+// code once it has max strikes, so a leaked code cannot be used to probe
+// the endpoint indefinitely. It returns a copy of the code, or nil if code
+// is not live, and whether this strike revoked it.
+func (ps *PairingStore) Strike(code string, max int) (*PairingCode, bool) {
+	code = NormalizePairingCode(code)
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.codes[code]
+	if !ok || time.Now().After(p.ExpiresAt) {
+		return nil, false
+	}
+	p.Strikes++
+	locked := p.Strikes >= max
+	if locked {
+		delete(ps.codes, code)
+	}
+	cp := *p
+	return &cp, locked
+}
+
+// NormalizePairingCode upper-cases code and strips the separators users
+// tend to type.
+func NormalizePairingCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-':
+			return -1
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, code)
+}
+
+func randomPairingCode() (string, error) {
+	max := big.NewInt(int64(len(PairingAlphabet)))
+	b := make([]byte, PairingCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = PairingAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPairingStore(t *testing.T) {
+	ps := NewPairingStore(time.Minute)
+	defer ps.Stop()
+
+	p, err := ps.Create("issuer-a")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if len(p.Code) != PairingCodeLength {
+		t.Errorf("Expected %d-character code, got %q", PairingCodeLength, p.Code)
+	}
+	for _, r := range p.Code {
+		if !strings.ContainsRune(PairingAlphabet, r) {
+			t.Errorf("Code %q contains %q outside the alphabet", p.Code, r)
+		}
+	}
+
+	// Users may type the code in lower case with a separator.
+	typed := strings.ToLower(p.Code[:4] + "-" + p.Code[4:])
+	got, err := ps.Consume(typed)
+	if err != nil || got.IssuedBy != "issuer-a" {
+		t.Fatalf("Consume(%q) = %+v, %v", typed, got, err)
+	}
+	if _, err := ps.Consume(p.Code); err != ErrPairingCodeInvalid {
+		t.Errorf("Expected a code to be single-use, got %v", err)
+	}
+}
+
+func TestPairingStoreReplacesIssuerCode(t *testing.T) {
+	ps := NewPairingStore(time.Minute)
+	defer ps.Stop()
+
+	first, _ := ps.Create("issuer-a")
+	other, _ := ps.Create("issuer-b")
+	second, _ := ps.Create("issuer-a")
+
+	if _, err := ps.Consume(first.Code); err != ErrPairingCodeInvalid {
+		t.Errorf("Expected the earlier code revoked, got %v", err)
+	}
+	if _, err := ps.Consume(second.Code); err != nil {
+		t.Errorf("Expected the new code valid, got %v", err)
+	}
+	if _, err := ps.Consume(other.Code); err != nil {
+		t.Errorf("Expected another issuer's code untouched, got %v", err)
+	}
+}
+
+func TestPairingStoreExpiry(t *testing.T) {
+	ps := NewPairingStore(-time.Second)
+	defer ps.Stop()
+
+	p, _ := ps.Create("issuer-a")
+	if _, err := ps.Consume(p.Code); err != ErrPairingCodeInvalid {
+		t.Errorf("Expected expired code rejected, got %v", err)
+	}
+}
+
+func TestPairingStoreStrike(t *testing.T) {
+	ps := NewPairingStore(time.Minute)
+	defer ps.Stop()
+
+	if p, _ := ps.Strike("NOTACODE", 3); p != nil {
+		t.Errorf("Strike on an unknown code = %+v", p)
+	}
+
+	p, _ := ps.Create("issuer-a")
+	for i := 1; i <= 3; i++ {
+		got, locked := ps.Strike(strings.ToLower(p.Code), 3)
+		if got == nil || got.Strikes != i || got.IssuedBy != "issuer-a" || locked != (i == 3) {
+			t.Fatalf("strike %d = %+v, %v", i, got, locked)
+		}
+	}
+	if _, err := ps.Consume(p.Code); err != ErrPairingCodeInvalid {
+		t.Errorf("Expected a locked code to be revoked, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+import "time"
+
+// Reputation tiers used to scale device ticket lifetimes.
+const (
+	trustedSuccesses     = 50
+	establishedSuccesses = 10
+	knownSuccesses       = 3
+	failureCooldown      = 24 * time.Hour
+)
+
+// ReputationPolicy derives a device ticket TTL from a device's auth history.
+// Devices with a long clean history re-attest less often; new devices and
+// devices with a recent failure get short-lived tickets.
+type ReputationPolicy struct {
+	BaseTTL time.Duration
+	MinTTL  time.Duration
+	MaxTTL  time.Duration
+}
+
+// NewReputationPolicy returns a policy around base, clamped to [base/3, max].
+func NewReputationPolicy(base, max time.Duration) ReputationPolicy {
+	if max < base {
+		max = base
+	}
+	return ReputationPolicy{
+		BaseTTL: base,
+		MinTTL:  base / 3,
+		MaxTTL:  max,
+	}
+}
+
+// TicketTTL returns the ticket lifetime for a device with the given history.
+func (p ReputationPolicy) TicketTTL(successes int, lastFailure, now time.Time) time.Duration {
+	if !lastFailure.IsZero() && now.Sub(lastFailure) < failureCooldown {
+		return p.MinTTL
+	}
+
+	var ttl time.Duration
+	switch {
+	case successes >= trustedSuccesses:
+		ttl = p.MaxTTL
+	case successes >= establishedSuccesses:
+		ttl = p.BaseTTL * 4
+	case successes >= knownSuccesses:
+		ttl = p.BaseTTL
+	default:
+		ttl = p.MinTTL
+	}
+
+	if ttl > p.MaxTTL {
+		ttl = p.MaxTTL
+	}
+	if ttl < p.MinTTL {
+		ttl = p.MinTTL
+	}
+	return ttl
+}
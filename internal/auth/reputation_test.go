@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReputationPolicy_TicketTTL(t *testing.T) {
+	p := NewReputationPolicy(15*time.Minute, 4*time.Hour)
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		successes   int
+		lastFailure time.Time
+		want        time.Duration
+	}{
+		{"NewDevice", 0, time.Time{}, 5 * time.Minute},
+		{"KnownDevice", 3, time.Time{}, 15 * time.Minute},
+		{"EstablishedDevice", 10, time.Time{}, time.Hour},
+		{"TrustedDevice", 80, time.Time{}, 4 * time.Hour},
+		{"RecentFailure", 80, now.Add(-time.Hour), 5 * time.Minute},
+		{"OldFailure", 80, now.Add(-48 * time.Hour), 4 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.TicketTTL(tt.successes, tt.lastFailure, now); got != tt.want {
+				t.Errorf("TicketTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReputationPolicy_MaxBelowBase(t *testing.T) {
+	p := NewReputationPolicy(15*time.Minute, time.Minute)
+	if got := p.TicketTTL(100, time.Time{}, time.Now()); got != 15*time.Minute {
+		t.Errorf("TicketTTL() = %v, want base TTL when max < base", got)
+	}
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRequestUnsigned  = errors.New("request is not signed")
+	ErrRequestSignature = errors.New("invalid request signature")
+	ErrRequestStale     = errors.New("request timestamp outside the allowed window")
+	ErrRequestReplayed  = errors.New("request nonce already used")
+)
+
+// MaxRequestSkew is how far a signed request's timestamp may be from the
+// server clock. Nonces are remembered for as long as a timestamp can pass.
+const MaxRequestSkew = 5 * time.Minute
+
+// RequestKey derives the key an admin token's holder signs requests with.
+// It is handed out once at login and never travels with the token, so a
+// token copied from a log or proxy cannot be used to change anything.
+func (tm *TokenManager) RequestKey(sid string) []byte {
+	mac := hmac.New(sha256.New, tm.secret)
+	mac.Write([]byte("fileflow admin request v1\x00" + sid))
+	return mac.Sum(nil)
+}
+
+// CanonicalJSON re-encodes a JSON body with object keys sorted, no
+// insignificant whitespace and no HTML escaping, which is what
+// JSON.stringify over sorted keys or `jq -cS .` produce. Numbers keep their
+// original text. An empty body stays empty.
+func CanonicalJSON(body []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// SignRequest returns the signature over a request: HMAC-SHA256 with key of
+// method, URI, timestamp (Unix seconds), nonce and canonical body, each on
+// its own line, base64url encoded.
+func SignRequest(key []byte, method, uri, timestamp, nonce string, body []byte) (string, error) {
+	canon, err := CanonicalJSON(body)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	for _, part := range []string{method, uri, timestamp, nonce} {
+		mac.Write([]byte(part))
+		mac.Write([]byte("\n"))
+	}
+	mac.Write(canon)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyRequest checks a request signature, its timestamp against now and
+// that nonces has not seen its nonce before.
+func VerifyRequest(key []byte, method, uri, timestamp, nonce, signature string, body []byte, nonces *NonceCache, now time.Time) error {
+	if timestamp == "" || nonce == "" || signature == "" {
+		return ErrRequestUnsigned
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrRequestStale
+	}
+	at := time.Unix(ts, 0)
+	if at.Before(now.Add(-MaxRequestSkew)) || at.After(now.Add(MaxRequestSkew)) {
+		return ErrRequestStale
+	}
+
+	want, err := SignRequest(key, method, uri, timestamp, nonce, body)
+	if err != nil || subtle.ConstantTimeCompare([]byte(want), []byte(signature)) != 1 {
+		return ErrRequestSignature
+	}
+
+	// Checked last so a forged request cannot burn someone else's nonce.
+	if !nonces.Use(nonce, at.Add(MaxRequestSkew)) {
+		return ErrRequestReplayed
+	}
+	return nil
+}
+
+// NonceCache remembers request nonces until the request they came with
+// could no longer pass the timestamp check.
+type NonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	stopCh chan struct{}
+}
+
+func NewNonceCache() *NonceCache {
+	nc := &NonceCache{
+		nonces: make(map[string]time.Time),
+		stopCh: make(chan struct{}),
+	}
+	go nc.cleanupLoop()
+	return nc
+}
+
+func (nc *NonceCache) Stop() {
+	close(nc.stopCh)
+}
+
+// Use records nonce until expires and reports whether it was unused.
+func (nc *NonceCache) Use(nonce string, expires time.Time) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if exp, ok := nc.nonces[nonce]; ok && time.Now().Before(exp) {
+		return false
+	}
+	nc.nonces[nonce] = expires
+	return true
+}
+
+func (nc *NonceCache) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			nc.cleanup()
+		case <-nc.stopCh:
+			return
+		}
+	}
+}
+
+func (nc *NonceCache) cleanup() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	for nonce, exp := range nc.nonces {
+		if now.After(exp) {
+			delete(nc.nonces, nonce)
+		}
+	}
+}
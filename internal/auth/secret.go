@@ -9,34 +9,127 @@ import (
 	"strings"
 
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var ErrInvalidSecret = errors.New("invalid secret")
 
 const (
-	argonTime    = 1
-	argonMemory  = 64 * 1024
-	argonThreads = 4
-	argonKeyLen  = 32
-	saltLen      = 16
+	argonKeyLen = 32
+	saltLen     = 16
 )
 
+// ArgonParams are the Argon2id cost parameters used for new hashes.
+// Memory is in KiB.
+type ArgonParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultArgonParams is used when no parameters are configured.
+var DefaultArgonParams = ArgonParams{Time: 1, Memory: 64 * 1024, Threads: 4}
+
+// Validate rejects parameters argon2 cannot run with.
+func (p ArgonParams) Validate() error {
+	if p.Time < 1 {
+		return errors.New("argon2 time must be at least 1")
+	}
+	if p.Threads < 1 {
+		return errors.New("argon2 threads must be at least 1")
+	}
+	if p.Memory < 8*uint32(p.Threads) {
+		return fmt.Errorf("argon2 memory must be at least %d KiB for %d threads", 8*uint32(p.Threads), p.Threads)
+	}
+	return nil
+}
+
 func HashSecret(secret string) (string, error) {
+	return HashSecretParams(secret, DefaultArgonParams)
+}
+
+// HashSecretParams hashes secret with the given cost parameters.
+func HashSecretParams(secret string, p ArgonParams) (string, error) {
+	if err := p.Validate(); err != nil {
+		return "", err
+	}
+
 	salt := make([]byte, saltLen)
 	if _, err := rand.Read(salt); err != nil {
 		return "", fmt.Errorf("generate salt: %w", err)
 	}
 
-	hash := argon2.IDKey([]byte(secret), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	hash := argon2.IDKey([]byte(secret), salt, p.Time, p.Memory, p.Threads, argonKeyLen)
 
 	saltB64 := base64.RawStdEncoding.EncodeToString(salt)
 	hashB64 := base64.RawStdEncoding.EncodeToString(hash)
 
 	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s",
-		argonMemory, argonTime, argonThreads, saltB64, hashB64), nil
+		p.Memory, p.Time, p.Threads, saltB64, hashB64), nil
+}
+
+// NeedsRehash reports whether encoded was produced with a lower time or
+// memory cost, or a shorter key, than p. Thread count only changes how the
+// work is split, so a difference there alone does not trigger a re-hash.
+// bcrypt hashes always need one. Hashes that cannot be parsed report false;
+// VerifySecret rejects them.
+func NeedsRehash(encoded string, p ArgonParams) bool {
+	if isBcrypt(encoded) {
+		return true
+	}
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+	got, err := parseArgonParams(parts[3])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+	return got.Time < p.Time || got.Memory < p.Memory || len(hash) < argonKeyLen
 }
 
+func parseArgonParams(s string) (ArgonParams, error) {
+	var p ArgonParams
+	if _, err := fmt.Sscanf(s, "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return ArgonParams{}, err
+	}
+	return p, nil
+}
+
+// isBcrypt reports whether encoded is a bcrypt hash. Secrets migrated from
+// other tools may use one until the first login re-hashes them.
+func isBcrypt(encoded string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(encoded, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyBcrypt(secret, encoded string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(secret))
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		return ErrInvalidSecret
+	default:
+		return fmt.Errorf("%w: invalid bcrypt hash", ErrInvalidSecret)
+	}
+}
+
+// VerifySecret checks secret against an argon2id hash, or a bcrypt hash
+// left over from a migration.
 func VerifySecret(secret, encoded string) error {
+	if isBcrypt(encoded) {
+		return verifyBcrypt(secret, encoded)
+	}
+
 	parts := strings.Split(encoded, "$")
 	if len(parts) != 6 {
 		return fmt.Errorf("%w: invalid hash format", ErrInvalidSecret)
@@ -46,9 +139,7 @@ func VerifySecret(secret, encoded string) error {
 		return fmt.Errorf("%w: unsupported algorithm", ErrInvalidSecret)
 	}
 
-	var memory, time uint32
-	var threads uint8
-	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	params, err := parseArgonParams(parts[3])
 	if err != nil {
 		return fmt.Errorf("%w: invalid parameters", ErrInvalidSecret)
 	}
@@ -63,7 +154,7 @@ func VerifySecret(secret, encoded string) error {
 		return fmt.Errorf("%w: invalid hash", ErrInvalidSecret)
 	}
 
-	computedHash := argon2.IDKey([]byte(secret), salt, time, memory, threads, uint32(len(expectedHash)))
+	computedHash := argon2.IDKey([]byte(secret), salt, params.Time, params.Memory, params.Threads, uint32(len(expectedHash)))
 
 	if subtle.ConstantTimeCompare(computedHash, expectedHash) != 1 {
 		return ErrInvalidSecret
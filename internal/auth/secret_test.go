@@ -1,7 +1,11 @@
 package auth
 
 import (
+	"errors"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestHashAndVerifySecret(t *testing.T) {
@@ -64,3 +68,61 @@ func TestVerifyInvalidHashFormat(t *testing.T) {
 		})
 	}
 }
+
+func TestHashSecretParams(t *testing.T) {
+	weak := ArgonParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+	strong := ArgonParams{Time: 2, Memory: 16 * 1024, Threads: 1}
+
+	hash, err := HashSecretParams("secret", weak)
+	if err != nil {
+		t.Fatalf("HashSecretParams failed: %v", err)
+	}
+	if err := VerifySecret("secret", hash); err != nil {
+		t.Errorf("VerifySecret failed: %v", err)
+	}
+
+	if NeedsRehash(hash, weak) {
+		t.Error("Hash should not need re-hash under its own params")
+	}
+	if !NeedsRehash(hash, strong) {
+		t.Error("Hash should need re-hash under stronger params")
+	}
+	if NeedsRehash(hash, ArgonParams{Time: 1, Memory: 8 * 1024, Threads: 4}) {
+		t.Error("Thread count alone should not trigger a re-hash")
+	}
+	if NeedsRehash("$argon2id$v=19$invalid$c2FsdA$aGFzaA", strong) {
+		t.Error("Unparseable hash should not report re-hash")
+	}
+
+	if _, err := HashSecretParams("secret", ArgonParams{Time: 0, Memory: 1024, Threads: 1}); err == nil {
+		t.Error("Expected error for zero time")
+	}
+	if _, err := HashSecretParams("secret", ArgonParams{Time: 1, Memory: 16, Threads: 4}); err == nil {
+		t.Error("Expected error for memory below 8 KiB per thread")
+	}
+}
+
+func TestVerifyBcryptSecret(t *testing.T) {
+	raw, err := bcrypt.GenerateFromPassword([]byte("legacy-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword failed: %v", err)
+	}
+	hash := string(raw)
+
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		encoded := prefix + strings.TrimPrefix(hash, hash[:4])
+		if err := VerifySecret("legacy-secret", encoded); err != nil {
+			t.Errorf("%s: VerifySecret failed: %v", prefix, err)
+		}
+		if err := VerifySecret("wrong-secret", encoded); err != ErrInvalidSecret {
+			t.Errorf("%s: expected ErrInvalidSecret, got %v", prefix, err)
+		}
+		if !NeedsRehash(encoded, DefaultArgonParams) {
+			t.Errorf("%s: bcrypt hash should need re-hash", prefix)
+		}
+	}
+
+	if err := VerifySecret("legacy-secret", "$2b$10$short"); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("Expected ErrInvalidSecret for malformed bcrypt hash, got %v", err)
+	}
+}
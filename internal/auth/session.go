@@ -130,6 +130,19 @@ func SetDeviceTicketCookie(w http.ResponseWriter, ticket string, ttl time.Durati
 	})
 }
 
+// ClearCookie expires the named cookie on the client.
+func ClearCookie(w http.ResponseWriter, name string, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
 func GetSessionFromRequest(r *http.Request) string {
 	cookie, err := r.Cookie("session")
 	if err != nil {
@@ -1,11 +1,26 @@
 package auth
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"math/big"
 )
 
+// VerifySignature checks signature over message with a key returned by
+// ParsePublicJWKBytes. ECDSA signatures are over SHA-256(message); Ed25519
+// signs message directly.
+func VerifySignature(pub crypto.PublicKey, message, signature []byte) bool {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return VerifyECDSASignature(k, message, signature)
+	case ed25519.PublicKey:
+		return len(signature) == ed25519.SignatureSize && ed25519.Verify(k, message, signature)
+	}
+	return false
+}
+
 func VerifyECDSASignature(pub *ecdsa.PublicKey, message, signature []byte) bool {
 	if pub == nil || len(signature) == 0 {
 		return false
@@ -1,7 +1,9 @@
 package auth
 
 import (
+	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
@@ -10,49 +12,268 @@ import (
 	"fmt"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 var (
-	ErrTokenExpired     = errors.New("token expired")
-	ErrInvalidSignature = errors.New("invalid signature")
-	ErrInvalidFormat    = errors.New("invalid token format")
-	ErrInvalidVersion   = errors.New("invalid token version")
+	ErrTokenExpired      = errors.New("token expired")
+	ErrInvalidSignature  = errors.New("invalid signature")
+	ErrInvalidFormat     = errors.New("invalid token format")
+	ErrInvalidVersion    = errors.New("invalid token version")
+	ErrTokenRevoked      = errors.New("token revoked")
+	ErrMaxLifetime       = errors.New("token reached its maximum lifetime")
+	ErrInsufficientScope = errors.New("token scope does not allow this")
+	ErrSignedToken       = errors.New("signed-only tokens are no longer accepted")
 )
 
+// Token formats. A signed token is "<payload>.<hmac>" with the claims
+// readable by whoever holds it; an encrypted one is "v2.<sealed>", where
+// sealed is an XChaCha20-Poly1305 nonce and ciphertext, so the cookie is
+// opaque. The prefix cannot collide with a signed payload, which always
+// starts with the base64 of "{".
+const encryptedPrefix = "v2"
+
+// Revoker reports whether a token's SID has been revoked server-side.
+type Revoker interface {
+	IsSessionRevoked(sid string) (bool, error)
+}
+
 const (
 	TokenVersionSession      = 1
 	TokenVersionDeviceTicket = 2
+	TokenVersionAdmin        = 3
+	// TokenVersionOIDCState carries an OIDC login's state and device
+	// across the redirect to the provider. It authorises nothing.
+	TokenVersionOIDCState = 4
+)
+
+// Token scopes limit what a session or admin token may do. The version
+// says what kind of token it is; the scope says how much it may do.
+const (
+	// ScopeUser is a full device session: send, receive and manage the
+	// device.
+	ScopeUser = "user"
+	// ScopeAdmin is a full admin token.
+	ScopeAdmin = "admin"
+	// ScopeReadOnly only observes: a session that receives but never sends,
+	// or an admin token limited to GET requests.
+	ScopeReadOnly = "readonly"
 )
 
+// DefaultScope is the scope of a token of the given version that carries
+// none, such as one signed before scopes existed.
+func DefaultScope(version int) string {
+	switch version {
+	case TokenVersionSession:
+		return ScopeUser
+	case TokenVersionAdmin:
+		return ScopeAdmin
+	}
+	return ""
+}
+
 type Claims struct {
 	Ver int    `json:"v"`
 	SID string `json:"sid"`
 	Iat int64  `json:"iat"`
 	Exp int64  `json:"exp"`
+	// Auth is when the SID was first authenticated; renewals carry it over.
+	Auth int64 `json:"auth,omitempty"`
+	// DeviceID binds a session token to the device that logged in.
+	DeviceID string `json:"device_id,omitempty"`
+	// Scope is one of the Scope* constants; empty means DefaultScope(Ver).
+	Scope string `json:"scope,omitempty"`
+	// Bind is BindingHash of what a device ticket is tied to, such as the
+	// client's address. Empty for unbound tokens.
+	Bind string `json:"bind,omitempty"`
+}
+
+// EffectiveScope returns the token's scope, falling back to the default
+// for its version.
+func (c *Claims) EffectiveScope() string {
+	if c.Scope != "" {
+		return c.Scope
+	}
+	return DefaultScope(c.Ver)
+}
+
+// HasScope reports whether the token's scope is one of scopes.
+func (c *Claims) HasScope(scopes ...string) bool {
+	have := c.EffectiveScope()
+	for _, s := range scopes {
+		if s == have {
+			return true
+		}
+	}
+	return false
 }
 
 type TokenManager struct {
-	secret []byte
+	secret  []byte
+	revoker Revoker
+	// aead opens encrypted tokens and, when encrypt is set, seals new
+	// ones. rejectSigned stops Verify from accepting the signed-only format
+	// once every such token has expired.
+	aead         cipher.AEAD
+	encrypt      bool
+	rejectSigned bool
 }
 
 func NewTokenManager(secret []byte) *TokenManager {
-	return &TokenManager{secret: secret}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("fileflow token v2"))
+	// A SHA-256 sum is always chacha20poly1305.KeySize bytes, so this
+	// cannot fail.
+	aead, _ := chacha20poly1305.NewX(mac.Sum(nil))
+	return &TokenManager{secret: secret, aead: aead}
+}
+
+// SetRevoker makes Verify reject tokens whose SID r reports as revoked.
+// Lookup errors fail closed.
+func (tm *TokenManager) SetRevoker(r Revoker) {
+	tm.revoker = r
+}
+
+// SetEncrypted makes Sign issue encrypted tokens under a key derived from
+// the manager's secret. Encrypted tokens verify either way, so turning this
+// off again does not log anyone out; signed-only tokens are still accepted
+// unless acceptSigned is false, so turning it on does not either.
+func (tm *TokenManager) SetEncrypted(acceptSigned bool) {
+	tm.encrypt = true
+	tm.rejectSigned = !acceptSigned
+}
+
+// Sign issues a token of the given version. scope may be empty for token
+// kinds that have none, such as device tickets.
+func (tm *TokenManager) Sign(sid string, version int, scope string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return tm.sign(Claims{
+		Ver:   version,
+		SID:   sid,
+		Iat:   now.Unix(),
+		Exp:   now.Add(ttl).Unix(),
+		Auth:  now.Unix(),
+		Scope: scope,
+	})
 }
 
-func (tm *TokenManager) Sign(sid string, version int, ttl time.Duration) (string, error) {
+// SignTicket issues a device ticket for deviceID. bind is a BindingHash, or
+// empty for a ticket usable from anywhere.
+func (tm *TokenManager) SignTicket(deviceID, bind string, ttl time.Duration) (string, error) {
 	now := time.Now()
-	claims := Claims{
-		Ver: version,
-		SID: sid,
-		Iat: now.Unix(),
-		Exp: now.Add(ttl).Unix(),
+	return tm.sign(Claims{
+		Ver:  TokenVersionDeviceTicket,
+		SID:  deviceID,
+		Iat:  now.Unix(),
+		Exp:  now.Add(ttl).Unix(),
+		Auth: now.Unix(),
+		Bind: bind,
+	})
+}
+
+// BindingHash returns a keyed hash of v for Claims.Bind. It is keyed so a
+// readable token does not reveal, say, the address it was issued to.
+func (tm *TokenManager) BindingHash(v string) string {
+	mac := hmac.New(sha256.New, tm.secret)
+	mac.Write([]byte("fileflow bind v1\x00" + v))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// CheckBinding reports whether claims were bound to v.
+func (tm *TokenManager) CheckBinding(claims *Claims, v string) bool {
+	return hmac.Equal([]byte(claims.Bind), []byte(tm.BindingHash(v)))
+}
+
+// ReceiptSignature signs a transfer receipt's payload. Only this server
+// can produce or check it, which is enough to tell a receipt it issued
+// from an edited one.
+func (tm *TokenManager) ReceiptSignature(payload []byte) string {
+	mac := hmac.New(sha256.New, tm.secret)
+	mac.Write([]byte("fileflow receipt v1\x00"))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignSession issues a session token bound to deviceID.
+func (tm *TokenManager) SignSession(sid, deviceID, scope string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return tm.sign(Claims{
+		Ver:      TokenVersionSession,
+		SID:      sid,
+		Iat:      now.Unix(),
+		Exp:      now.Add(ttl).Unix(),
+		Auth:     now.Unix(),
+		DeviceID: deviceID,
+		Scope:    scope,
+	})
+}
+
+// SignOIDCState issues the short-lived cookie token that ties an OIDC
+// callback's state to the device that started the login.
+func (tm *TokenManager) SignOIDCState(state, deviceID string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return tm.sign(Claims{
+		Ver:      TokenVersionOIDCState,
+		SID:      state,
+		Iat:      now.Unix(),
+		Exp:      now.Add(ttl).Unix(),
+		DeviceID: deviceID,
+	})
+}
+
+// Renew issues a replacement for a verified token with the same SID, device
+// and authentication time, valid for ttl but never beyond maxLifetime after the
+// original authentication. Because the SID is kept, revoking it also
+// revokes every renewal.
+func (tm *TokenManager) Renew(claims *Claims, ttl, maxLifetime time.Duration) (string, *Claims, error) {
+	now := time.Now()
+	auth := claims.Auth
+	if auth == 0 {
+		auth = claims.Iat
+	}
+
+	limit := time.Unix(auth, 0).Add(maxLifetime)
+	if !now.Before(limit) {
+		return "", nil, ErrMaxLifetime
+	}
+	exp := now.Add(ttl)
+	if exp.After(limit) {
+		exp = limit
+	}
+
+	renewed := Claims{
+		Ver:      claims.Ver,
+		SID:      claims.SID,
+		Iat:      now.Unix(),
+		Exp:      exp.Unix(),
+		Auth:     auth,
+		DeviceID: claims.DeviceID,
+		Scope:    claims.Scope,
+		Bind:     claims.Bind,
 	}
+	token, err := tm.sign(renewed)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &renewed, nil
+}
 
+func (tm *TokenManager) sign(claims Claims) (string, error) {
 	payload, err := json.Marshal(claims)
 	if err != nil {
 		return "", fmt.Errorf("marshal claims: %w", err)
 	}
 
+	if tm.encrypt {
+		nonce := make([]byte, tm.aead.NonceSize(), tm.aead.NonceSize()+len(payload)+tm.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", fmt.Errorf("generate nonce: %w", err)
+		}
+		sealed := tm.aead.Seal(nonce, nonce, payload, []byte(encryptedPrefix))
+		return encryptedPrefix + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+	}
+
 	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
 	signature := tm.computeHMAC(encodedPayload)
 	encodedSignature := base64.RawURLEncoding.EncodeToString(signature)
@@ -66,26 +287,19 @@ func (tm *TokenManager) Verify(token string) (*Claims, error) {
 		return nil, ErrInvalidFormat
 	}
 
-	encodedPayload := parts[0]
-	encodedSignature := parts[1]
-
-	// 1. Verify Signature
-	expectedSignature := tm.computeHMAC(encodedPayload)
-	actualSignature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
-	if err != nil {
-		return nil, ErrInvalidSignature
-	}
-
-	if subtle.ConstantTimeCompare(expectedSignature, actualSignature) != 1 {
-		return nil, ErrInvalidSignature
+	// 1. Authenticate and recover the payload
+	var payload []byte
+	var err error
+	if parts[0] == encryptedPrefix {
+		payload, err = tm.open(parts[1])
+	} else {
+		payload, err = tm.verifySigned(parts[0], parts[1])
 	}
-
-	// 2. Decode Payload
-	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
 	if err != nil {
-		return nil, fmt.Errorf("decode payload: %w", err)
+		return nil, err
 	}
 
+	// 2. Decode Payload
 	var claims Claims
 	if err := json.Unmarshal(payload, &claims); err != nil {
 		return nil, fmt.Errorf("unmarshal claims: %w", err)
@@ -96,6 +310,17 @@ func (tm *TokenManager) Verify(token string) (*Claims, error) {
 		return nil, ErrTokenExpired
 	}
 
+	// 4. Check Revocation
+	if tm.revoker != nil {
+		revoked, err := tm.revoker.IsSessionRevoked(claims.SID)
+		if err != nil {
+			return nil, fmt.Errorf("check revocation: %w", err)
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+
 	return &claims, nil
 }
 
@@ -110,6 +335,57 @@ func (tm *TokenManager) VerifyWithVersion(token string, version int) (*Claims, e
 	return claims, nil
 }
 
+// VerifyScope is VerifyWithVersion that also requires the token's scope to
+// be one of scopes.
+func (tm *TokenManager) VerifyScope(token string, version int, scopes ...string) (*Claims, error) {
+	claims, err := tm.VerifyWithVersion(token, version)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.HasScope(scopes...) {
+		return nil, ErrInsufficientScope
+	}
+	return claims, nil
+}
+
+// verifySigned checks a "<payload>.<hmac>" token and returns its payload.
+func (tm *TokenManager) verifySigned(encodedPayload, encodedSignature string) ([]byte, error) {
+	if tm.rejectSigned {
+		return nil, ErrSignedToken
+	}
+
+	expectedSignature := tm.computeHMAC(encodedPayload)
+	actualSignature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	if subtle.ConstantTimeCompare(expectedSignature, actualSignature) != 1 {
+		return nil, ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("decode payload: %w", err)
+	}
+	return payload, nil
+}
+
+// open decrypts the body of a "v2.<sealed>" token. A tampered token or one
+// sealed under another key fails as ErrInvalidSignature, like a bad HMAC.
+func (tm *TokenManager) open(encoded string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	n := tm.aead.NonceSize()
+	if err != nil || len(sealed) < n {
+		return nil, ErrInvalidFormat
+	}
+	payload, err := tm.aead.Open(nil, sealed[:n], sealed[n:], []byte(encryptedPrefix))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	return payload, nil
+}
+
 func (tm *TokenManager) computeHMAC(data string) []byte {
 	h := hmac.New(sha256.New, tm.secret)
 	h.Write([]byte(data))
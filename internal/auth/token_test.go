@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"encoding/base64"
 	"errors"
 	"strings"
 	"testing"
@@ -16,7 +17,7 @@ func TestTokenManager_SignAndVerify(t *testing.T) {
 	ttl := 1 * time.Hour
 
 	// 1. Sign
-	token, err := tm.Sign(sid, ver, ttl)
+	token, err := tm.Sign(sid, ver, "", ttl)
 	if err != nil {
 		t.Fatalf("Sign failed: %v", err)
 	}
@@ -49,7 +50,7 @@ func TestTokenManager_Expired(t *testing.T) {
 	tm := NewTokenManager(secret)
 
 	// Negative TTL
-	token, err := tm.Sign("sid", TokenVersionSession, -time.Minute)
+	token, err := tm.Sign("sid", TokenVersionSession, "", -time.Minute)
 	if err != nil {
 		t.Fatalf("Sign failed: %v", err)
 	}
@@ -63,11 +64,220 @@ func TestTokenManager_Expired(t *testing.T) {
 	}
 }
 
+func TestTokenManager_Renew(t *testing.T) {
+	tm := NewTokenManager([]byte("test-secret"))
+	now := time.Now().Unix()
+
+	claims := &Claims{Ver: TokenVersionSession, SID: "sid", Iat: now - 60, Exp: now + 60, Auth: now - 3600, DeviceID: "dev"}
+
+	token, renewed, err := tm.Renew(claims, time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	if renewed.SID != "sid" || renewed.Auth != claims.Auth || renewed.DeviceID != "dev" {
+		t.Errorf("Renew changed identity: %+v", renewed)
+	}
+	if got, err := tm.VerifyWithVersion(token, TokenVersionSession); err != nil || got.Exp != renewed.Exp {
+		t.Fatalf("Renewed token did not verify: %+v, %v", got, err)
+	}
+
+	// Capped at Auth + maxLifetime.
+	_, renewed, err = tm.Renew(claims, time.Hour, 90*time.Minute)
+	if err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	if want := claims.Auth + 90*60; renewed.Exp != want {
+		t.Errorf("Expected exp capped at %d, got %d", want, renewed.Exp)
+	}
+
+	if _, _, err := tm.Renew(claims, time.Hour, 30*time.Minute); !errors.Is(err, ErrMaxLifetime) {
+		t.Errorf("Expected ErrMaxLifetime, got %v", err)
+	}
+
+	// Tokens issued before Auth existed fall back to Iat.
+	legacy := &Claims{Ver: TokenVersionSession, SID: "old", Iat: now - 60, Exp: now + 60}
+	if _, renewed, err := tm.Renew(legacy, time.Hour, 2*time.Hour); err != nil || renewed.Auth != legacy.Iat {
+		t.Errorf("Expected legacy auth time %d, got %+v, %v", legacy.Iat, renewed, err)
+	}
+}
+
+type revokerFunc func(sid string) (bool, error)
+
+func (f revokerFunc) IsSessionRevoked(sid string) (bool, error) { return f(sid) }
+
+func TestTokenManager_Revoked(t *testing.T) {
+	tm := NewTokenManager([]byte("test-secret"))
+	tm.SetRevoker(revokerFunc(func(sid string) (bool, error) {
+		switch sid {
+		case "revoked":
+			return true, nil
+		case "broken":
+			return false, errors.New("db down")
+		}
+		return false, nil
+	}))
+
+	tests := []struct {
+		sid     string
+		wantErr error
+	}{
+		{"live", nil},
+		{"revoked", ErrTokenRevoked},
+	}
+	for _, tt := range tests {
+		token, _ := tm.Sign(tt.sid, TokenVersionSession, "", time.Hour)
+		_, err := tm.Verify(token)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("sid %q: expected %v, got %v", tt.sid, tt.wantErr, err)
+		}
+	}
+
+	token, _ := tm.Sign("broken", TokenVersionSession, "", time.Hour)
+	if _, err := tm.Verify(token); err == nil {
+		t.Error("expected revocation lookup failure to reject the token")
+	}
+}
+
+func TestTokenManager_Scope(t *testing.T) {
+	tm := NewTokenManager([]byte("test-secret"))
+
+	tests := []struct {
+		name    string
+		version int
+		scope   string
+		want    []string
+		wantErr error
+	}{
+		{"AdminOK", TokenVersionAdmin, ScopeAdmin, []string{ScopeAdmin}, nil},
+		{"ReadOnlyAdmin", TokenVersionAdmin, ScopeReadOnly, []string{ScopeAdmin}, ErrInsufficientScope},
+		{"ReadOnlyAllowed", TokenVersionAdmin, ScopeReadOnly, []string{ScopeAdmin, ScopeReadOnly}, nil},
+		{"LegacyAdmin", TokenVersionAdmin, "", []string{ScopeAdmin}, nil},
+		{"LegacySession", TokenVersionSession, "", []string{ScopeUser}, nil},
+		{"ReadOnlySession", TokenVersionSession, ScopeReadOnly, []string{ScopeUser}, ErrInsufficientScope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _ := tm.Sign("sid", tt.version, tt.scope, time.Hour)
+			_, err := tm.VerifyScope(token, tt.version, tt.want...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	token, _ := tm.SignSession("sid", "device-1", ScopeReadOnly, time.Minute)
+	claims, _ := tm.Verify(token)
+	renewed, _, err := tm.Renew(claims, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	claims, _ = tm.Verify(renewed)
+	if claims.EffectiveScope() != ScopeReadOnly {
+		t.Errorf("Renew dropped the scope: got %q", claims.EffectiveScope())
+	}
+}
+
+func TestTokenManager_Encrypted(t *testing.T) {
+	signer := NewTokenManager([]byte("test-secret"))
+	sealer := NewTokenManager([]byte("test-secret"))
+	sealer.SetEncrypted(true)
+
+	signed, _ := signer.SignSession("sid-signed", "device-1", ScopeUser, time.Hour)
+	sealed, err := sealer.SignSession("sid-sealed", "device-1", ScopeUser, time.Hour)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if !strings.HasPrefix(sealed, "v2.") {
+		t.Fatalf("expected a v2 token, got %q", sealed)
+	}
+	body, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(sealed, "v2."))
+	if strings.Contains(string(body), "sid-sealed") || strings.Contains(sealed, "sid-sealed") {
+		t.Error("encrypted token exposes its claims")
+	}
+
+	// Both formats verify during a rollout, and a manager with encryption
+	// off still reads encrypted tokens so it can be rolled back.
+	for name, tc := range map[string]struct {
+		tm    *TokenManager
+		token string
+		sid   string
+	}{
+		"SealedBySealer": {sealer, sealed, "sid-sealed"},
+		"SignedBySealer": {sealer, signed, "sid-signed"},
+		"SealedBySigner": {signer, sealed, "sid-sealed"},
+	} {
+		claims, err := tc.tm.Verify(tc.token)
+		if err != nil || claims.SID != tc.sid || claims.DeviceID != "device-1" {
+			t.Errorf("%s: got %+v, %v", name, claims, err)
+		}
+	}
+
+	strict := NewTokenManager([]byte("test-secret"))
+	strict.SetEncrypted(false)
+	if _, err := strict.Verify(signed); !errors.Is(err, ErrSignedToken) {
+		t.Errorf("expected ErrSignedToken, got %v", err)
+	}
+	if _, err := strict.Verify(sealed); err != nil {
+		t.Errorf("strict manager rejected an encrypted token: %v", err)
+	}
+
+	other := NewTokenManager([]byte("other-secret"))
+	if _, err := other.Verify(sealed); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("wrong key: expected ErrInvalidSignature, got %v", err)
+	}
+	tampered := []byte(sealed)
+	if tampered[10] == 'A' {
+		tampered[10] = 'B'
+	} else {
+		tampered[10] = 'A'
+	}
+	if _, err := sealer.Verify(string(tampered)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("tampered: expected ErrInvalidSignature, got %v", err)
+	}
+}
+
+func TestTokenManager_Binding(t *testing.T) {
+	tm := NewTokenManager([]byte("test-secret"))
+
+	token, _ := tm.SignTicket("device-1", tm.BindingHash("192.0.2.1"), time.Hour)
+	claims, err := tm.VerifyWithVersion(token, TokenVersionDeviceTicket)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if strings.Contains(claims.Bind, "192.0.2") {
+		t.Errorf("binding exposes the address: %q", claims.Bind)
+	}
+	if !tm.CheckBinding(claims, "192.0.2.1") {
+		t.Error("expected binding to match the issuing address")
+	}
+	if tm.CheckBinding(claims, "192.0.2.2") {
+		t.Error("expected binding to reject another address")
+	}
+	if NewTokenManager([]byte("other")).BindingHash("192.0.2.1") == claims.Bind {
+		t.Error("binding hash should depend on the key")
+	}
+}
+
+func TestTokenManager_ReceiptSignature(t *testing.T) {
+	tm := NewTokenManager([]byte("test-secret"))
+
+	sig := tm.ReceiptSignature([]byte(`{"id":"r1"}`))
+	if sig != tm.ReceiptSignature([]byte(`{"id":"r1"}`)) {
+		t.Error("expected the same payload to get the same signature")
+	}
+	if sig == tm.ReceiptSignature([]byte(`{"id":"r2"}`)) {
+		t.Error("signature should depend on the payload")
+	}
+	if sig == NewTokenManager([]byte("other")).ReceiptSignature([]byte(`{"id":"r1"}`)) {
+		t.Error("signature should depend on the key")
+	}
+}
+
 func TestTokenManager_Tampered(t *testing.T) {
 	secret := []byte("test-secret")
 	tm := NewTokenManager(secret)
 
-	token, err := tm.Sign("sid", TokenVersionSession, time.Hour)
+	token, err := tm.Sign("sid", TokenVersionSession, "", time.Hour)
 	if err != nil {
 		t.Fatalf("Sign failed: %v", err)
 	}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode_RFC6238(t *testing.T) {
+	seed := []byte("12345678901234567890")
+
+	// RFC 6238 Appendix B SHA-1 vectors, truncated to six digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := TOTPCode(seed, TOTPStep(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("TOTPCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	seed := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	cur := TOTPStep(now)
+
+	if step, ok := VerifyTOTP(seed, TOTPCode(seed, cur-1), now, 0); !ok || step != cur-1 {
+		t.Errorf("Expected previous step accepted, got %d, %v", step, ok)
+	}
+	if _, ok := VerifyTOTP(seed, TOTPCode(seed, cur-2), now, 0); ok {
+		t.Error("Expected code outside skew rejected")
+	}
+	if _, ok := VerifyTOTP(seed, TOTPCode(seed, cur), now, cur); ok {
+		t.Error("Expected already used step rejected")
+	}
+	if _, ok := VerifyTOTP(seed, "12345", now, 0); ok {
+		t.Error("Expected short code rejected")
+	}
+}
+
+func TestSeedCipher(t *testing.T) {
+	c, err := NewSeedCipher([]byte("server-secret"))
+	if err != nil {
+		t.Fatalf("NewSeedCipher failed: %v", err)
+	}
+	seed := []byte("12345678901234567890")
+
+	sealed, err := c.Seal("device-a", seed)
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if bytes.Contains(sealed, seed) {
+		t.Fatal("Sealed seed contains plaintext")
+	}
+
+	got, err := c.Open("device-a", sealed)
+	if err != nil || !bytes.Equal(got, seed) {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+	if _, err := c.Open("device-b", sealed); err == nil {
+		t.Error("Expected seed bound to device-a to fail for device-b")
+	}
+
+	other, _ := NewSeedCipher([]byte("other-secret"))
+	if _, err := other.Open("device-a", sealed); err == nil {
+		t.Error("Expected open with a different key to fail")
+	}
+}
@@ -24,7 +24,7 @@ func ValidateDeviceID(deviceID string, pubJWK map[string]interface{}) error {
 		return fmt.Errorf("public_key is required")
 	}
 
-	if _, _, err := ParseECPublicJWKMap(pubJWK); err != nil {
+	if _, _, err := ParsePublicJWKMap(pubJWK); err != nil {
 		return fmt.Errorf("invalid public key")
 	}
 
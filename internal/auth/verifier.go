@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrVerifierBusy    = errors.New("secret verification queue is full")
+	ErrVerifierTimeout = errors.New("timed out waiting for secret verification")
+)
+
+// VerifierPool runs VerifySecret on a fixed number of workers, so a burst of
+// logins queues instead of running one 64 MiB Argon2 computation per request
+// at once. Memory stays at workers × the hash's memory cost however many
+// requests arrive.
+type VerifierPool struct {
+	jobs    chan *verifyJob
+	workers int
+	timeout time.Duration
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	verify  func(secret, encoded string) error
+
+	running   atomic.Int64
+	completed atomic.Uint64
+	rejected  atomic.Uint64
+	timedOut  atomic.Uint64
+	abandoned atomic.Uint64
+}
+
+type verifyJob struct {
+	ctx     context.Context
+	secret  string
+	encoded string
+	done    chan error
+}
+
+// VerifierStats is a snapshot of a VerifierPool's counters.
+type VerifierStats struct {
+	Workers  int
+	QueueCap int
+	Queued   int
+	Running  int
+	// Completed counts verifications that ran, whatever their result.
+	Completed uint64
+	// Rejected counts calls turned away because the queue was full.
+	Rejected uint64
+	// TimedOut counts calls that gave up waiting.
+	TimedOut uint64
+	// Abandoned counts queued jobs skipped because their caller had
+	// already given up.
+	Abandoned uint64
+}
+
+// NewVerifierPool starts workers goroutines that verify secrets, with room
+// for queue more waiting requests. Each call waits at most timeout for its
+// result; zero waits for as long as the caller's context allows.
+func NewVerifierPool(workers, queue int, timeout time.Duration) *VerifierPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queue < 0 {
+		queue = 0
+	}
+	p := &VerifierPool{
+		jobs:    make(chan *verifyJob, queue),
+		workers: workers,
+		timeout: timeout,
+		stop:    make(chan struct{}),
+		verify:  VerifySecret,
+	}
+	p.wg.Add(workers)
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+// Verify is VerifySecret run on the pool. It fails with ErrVerifierBusy at
+// once when the queue is full and with ErrVerifierTimeout when no result
+// arrives in time; neither says anything about the secret.
+func (p *VerifierPool) Verify(ctx context.Context, secret, encoded string) error {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	job := &verifyJob{ctx: ctx, secret: secret, encoded: encoded, done: make(chan error, 1)}
+	select {
+	case p.jobs <- job:
+	default:
+		p.rejected.Add(1)
+		return ErrVerifierBusy
+	}
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		p.timedOut.Add(1)
+		return ErrVerifierTimeout
+	}
+}
+
+// Stats returns the pool's current counters.
+func (p *VerifierPool) Stats() VerifierStats {
+	return VerifierStats{
+		Workers:   p.workers,
+		QueueCap:  cap(p.jobs),
+		Queued:    len(p.jobs),
+		Running:   int(p.running.Load()),
+		Completed: p.completed.Load(),
+		Rejected:  p.rejected.Load(),
+		TimedOut:  p.timedOut.Load(),
+		Abandoned: p.abandoned.Load(),
+	}
+}
+
+// Stop stops the workers once they finish their current job. Jobs still
+// queued are left for their callers to time out.
+func (p *VerifierPool) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *VerifierPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case job := <-p.jobs:
+			// The caller may have timed out or gone away while this sat in
+			// the queue; nobody would read the result.
+			if job.ctx.Err() != nil {
+				p.abandoned.Add(1)
+				continue
+			}
+			p.running.Add(1)
+			err := p.verify(job.secret, job.encoded)
+			p.running.Add(-1)
+			p.completed.Add(1)
+			job.done <- err
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifierPool(t *testing.T) {
+	hash, err := HashSecretParams("pool-secret", ArgonParams{Time: 1, Memory: 64, Threads: 1})
+	if err != nil {
+		t.Fatalf("HashSecretParams failed: %v", err)
+	}
+
+	p := NewVerifierPool(2, 4, time.Second)
+	defer p.Stop()
+
+	if err := p.Verify(context.Background(), "pool-secret", hash); err != nil {
+		t.Errorf("correct secret: %v", err)
+	}
+	if err := p.Verify(context.Background(), "wrong", hash); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("wrong secret: expected ErrInvalidSecret, got %v", err)
+	}
+	if st := p.Stats(); st.Completed != 2 || st.Workers != 2 || st.QueueCap != 4 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestVerifierPoolSaturated(t *testing.T) {
+	p := NewVerifierPool(1, 1, 100*time.Millisecond)
+	defer p.Stop()
+
+	gate := make(chan struct{})
+	p.verify = func(secret, encoded string) error {
+		<-gate
+		return nil
+	}
+
+	waitFor := func(cond func(VerifierStats) bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !cond(p.Stats()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out; stats %+v", p.Stats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- p.Verify(context.Background(), "a", "") }()
+	waitFor(func(st VerifierStats) bool { return st.Running == 1 })
+	go func() { errs <- p.Verify(context.Background(), "b", "") }()
+	waitFor(func(st VerifierStats) bool { return st.Queued == 1 })
+
+	if err := p.Verify(context.Background(), "c", ""); !errors.Is(err, ErrVerifierBusy) {
+		t.Errorf("full queue: expected ErrVerifierBusy, got %v", err)
+	}
+	for range 2 {
+		if err := <-errs; !errors.Is(err, ErrVerifierTimeout) {
+			t.Errorf("expected ErrVerifierTimeout, got %v", err)
+		}
+	}
+
+	// The running job finishes; the queued one's caller is gone, so it is
+	// dropped without running.
+	close(gate)
+	waitFor(func(st VerifierStats) bool { return st.Completed == 1 && st.Abandoned == 1 })
+	if st := p.Stats(); st.Rejected != 1 || st.TimedOut != 2 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/lixiansheng/fileflow/internal/cbor"
+)
+
+// Authenticator data flags (WebAuthn §6.1).
+const (
+	webauthnFlagUP = 0x01
+	webauthnFlagUV = 0x04
+	webauthnFlagAT = 0x40
+)
+
+// COSE key parameters (RFC 9053) for the algorithms FileFlow accepts.
+const (
+	coseKty      = 1
+	coseAlg      = 3
+	coseCrv      = -1
+	coseX        = -2
+	coseY        = -3
+	coseKtyOKP   = 1
+	coseKtyEC2   = 2
+	coseCrvP256  = 1
+	coseCrvEd    = 6
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+)
+
+// WebAuthnAlgorithms lists the COSE algorithms offered in creation options.
+var WebAuthnAlgorithms = []int{coseAlgES256, coseAlgEdDSA}
+
+var (
+	ErrWebAuthnClientData     = errors.New("webauthn: invalid client data")
+	ErrWebAuthnAuthData       = errors.New("webauthn: invalid authenticator data")
+	ErrWebAuthnAttestation    = errors.New("webauthn: invalid attestation object")
+	ErrWebAuthnUnsupportedKey = errors.New("webauthn: unsupported credential key")
+	ErrWebAuthnSignature      = errors.New("webauthn: signature verification failed")
+	ErrWebAuthnCounter        = errors.New("webauthn: signature counter did not increase")
+)
+
+// RelyingParty holds the identity WebAuthn ceremonies are bound to.
+type RelyingParty struct {
+	// ID is the RP ID, normally the bare app domain.
+	ID string
+	// Origin is the exact origin the browser reports, e.g. https://example.com.
+	Origin string
+}
+
+// WebAuthnCredential is a verified newly registered credential.
+type WebAuthnCredential struct {
+	ID        []byte
+	JWK       *ECPublicJWK
+	SignCount uint32
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	credentialPK []byte
+}
+
+// VerifyRegistration checks a navigator.credentials.create() response
+// against challenge and returns the credential it created. Attestation
+// statements are not verified; FileFlow trusts the admin who enrolls the
+// device, not the authenticator vendor.
+func (rp RelyingParty) VerifyRegistration(clientDataJSON, attestationObject, challenge []byte) (*WebAuthnCredential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	v, err := cbor.Unmarshal(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWebAuthnAttestation, err)
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrWebAuthnAttestation
+	}
+	raw, ok := obj["authData"].([]byte)
+	if !ok {
+		return nil, ErrWebAuthnAttestation
+	}
+
+	ad, err := rp.parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ad.flags&webauthnFlagAT == 0 || len(ad.credentialID) == 0 {
+		return nil, fmt.Errorf("%w: no attested credential", ErrWebAuthnAuthData)
+	}
+
+	jwk, err := coseToJWK(ad.credentialPK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnCredential{ID: ad.credentialID, JWK: jwk, SignCount: ad.signCount}, nil
+}
+
+// VerifyAssertion checks a navigator.credentials.get() response signed by
+// pub and returns the new signature counter. storedCount is the counter from
+// the previous assertion; a non-increasing counter indicates a cloned
+// authenticator and is rejected.
+func (rp RelyingParty) VerifyAssertion(pub crypto.PublicKey, storedCount uint32, clientDataJSON, authData, signature, challenge []byte) (uint32, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	ad, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+
+	clientHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientHash[:]...)
+	if !VerifySignature(pub, signed, signature) {
+		return 0, ErrWebAuthnSignature
+	}
+
+	if (ad.signCount != 0 || storedCount != 0) && ad.signCount <= storedCount {
+		return 0, ErrWebAuthnCounter
+	}
+	return ad.signCount, nil
+}
+
+func (rp RelyingParty) verifyClientData(raw []byte, typ string, challenge []byte) error {
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return ErrWebAuthnClientData
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("%w: type %q", ErrWebAuthnClientData, cd.Type)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrWebAuthnClientData)
+	}
+	if cd.Origin != rp.Origin {
+		return fmt.Errorf("%w: origin %q", ErrWebAuthnClientData, cd.Origin)
+	}
+	return nil
+}
+
+func (rp RelyingParty) parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, ErrWebAuthnAuthData
+	}
+	ad := &authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+
+	want := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, want[:]) {
+		return nil, fmt.Errorf("%w: rp id mismatch", ErrWebAuthnAuthData)
+	}
+	if ad.flags&webauthnFlagUP == 0 || ad.flags&webauthnFlagUV == 0 {
+		return nil, fmt.Errorf("%w: user not verified", ErrWebAuthnAuthData)
+	}
+
+	if ad.flags&webauthnFlagAT != 0 {
+		rest := b[37:]
+		// aaguid(16) | credIdLen(2) | credId | COSE key
+		if len(rest) < 18 {
+			return nil, ErrWebAuthnAuthData
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return nil, ErrWebAuthnAuthData
+		}
+		ad.credentialID = rest[:n]
+		rest = rest[n:]
+
+		_, used, err := cbor.UnmarshalPrefix(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrWebAuthnAuthData, err)
+		}
+		ad.credentialPK = rest[:used]
+	}
+	return ad, nil
+}
+
+// coseToJWK converts an ES256 or EdDSA COSE_Key into the JWK form devices
+// are enrolled with, so the device ID and attestation path are shared.
+func coseToJWK(raw []byte) (*ECPublicJWK, error) {
+	v, err := cbor.Unmarshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWebAuthnUnsupportedKey, err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnUnsupportedKey
+	}
+	param := func(k int64) interface{} { return m[k] }
+	b64 := func(k int64) string {
+		b, _ := param(k).([]byte)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	var jwk ECPublicJWK
+	switch {
+	case param(coseKty) == int64(coseKtyEC2) && param(coseAlg) == int64(coseAlgES256) && param(coseCrv) == int64(coseCrvP256):
+		jwk = ECPublicJWK{Kty: "EC", Crv: "P-256", X: b64(coseX), Y: b64(coseY)}
+	case param(coseKty) == int64(coseKtyOKP) && param(coseAlg) == int64(coseAlgEdDSA) && param(coseCrv) == int64(coseCrvEd):
+		jwk = ECPublicJWK{Kty: "OKP", Crv: "Ed25519", X: b64(coseX)}
+	default:
+		return nil, ErrWebAuthnUnsupportedKey
+	}
+
+	b, err := json.Marshal(jwk)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := ParsePublicJWKBytes(b); err != nil {
+		return nil, ErrWebAuthnUnsupportedKey
+	}
+	return &jwk, nil
+}
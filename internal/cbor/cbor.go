@@ -0,0 +1,390 @@
+// Package cbor implements the subset of CBOR (RFC 8949) used by FileFlow:
+// definite-length integers, byte/text strings, arrays, maps, floats, booleans
+// and null. Tags are accepted on decode and discarded.
+package cbor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+const (
+	majorUint   = 0
+	majorNegInt = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+
+	maxDepth = 32
+)
+
+var (
+	ErrUnexpectedEOF   = errors.New("cbor: unexpected end of data")
+	ErrTrailingData    = errors.New("cbor: trailing data")
+	ErrIndefinite      = errors.New("cbor: indefinite-length items are not supported")
+	ErrTooDeep         = errors.New("cbor: nesting too deep")
+	ErrUnsupportedType = errors.New("cbor: unsupported type")
+	// ErrInvalidUTF8 is returned for a text string that is not valid
+	// UTF-8, which RFC 8949 does not allow.
+	ErrInvalidUTF8 = errors.New("cbor: text string is not valid UTF-8")
+)
+
+// Marshal encodes v. Supported types are nil, bool, string, []byte, all Go
+// integer and float types, []interface{}, map[string]interface{} and
+// map[interface{}]interface{}. Map keys are emitted in sorted order so the
+// output is deterministic.
+func Marshal(v interface{}) ([]byte, error) {
+	return appendValue(nil, v, 0)
+}
+
+func appendHead(b []byte, major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return append(b, m|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, m|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, m|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, m|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, m|27), n)
+	}
+}
+
+func appendInt(b []byte, n int64) []byte {
+	if n >= 0 {
+		return appendHead(b, majorUint, uint64(n))
+	}
+	return appendHead(b, majorNegInt, uint64(-1-n))
+}
+
+func appendFloat(b []byte, f float64) []byte {
+	// Integral values round-trip exactly as integers and are much smaller.
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return appendInt(b, int64(f))
+	}
+	return binary.BigEndian.AppendUint64(append(b, majorSimple<<5|27), math.Float64bits(f))
+}
+
+func appendValue(b []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xf6), nil
+	case bool:
+		if x {
+			return append(b, 0xf5), nil
+		}
+		return append(b, 0xf4), nil
+	case string:
+		return append(appendHead(b, majorText, uint64(len(x))), x...), nil
+	case []byte:
+		return append(appendHead(b, majorBytes, uint64(len(x))), x...), nil
+	case int:
+		return appendInt(b, int64(x)), nil
+	case int8:
+		return appendInt(b, int64(x)), nil
+	case int16:
+		return appendInt(b, int64(x)), nil
+	case int32:
+		return appendInt(b, int64(x)), nil
+	case int64:
+		return appendInt(b, x), nil
+	case uint:
+		return appendHead(b, majorUint, uint64(x)), nil
+	case uint8:
+		return appendHead(b, majorUint, uint64(x)), nil
+	case uint16:
+		return appendHead(b, majorUint, uint64(x)), nil
+	case uint32:
+		return appendHead(b, majorUint, uint64(x)), nil
+	case uint64:
+		return appendHead(b, majorUint, x), nil
+	case float32:
+		return appendFloat(b, float64(x)), nil
+	case float64:
+		return appendFloat(b, x), nil
+	case []interface{}:
+		b = appendHead(b, majorArray, uint64(len(x)))
+		for _, item := range x {
+			var err error
+			if b, err = appendValue(b, item, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendHead(b, majorMap, uint64(len(x)))
+		for _, k := range keys {
+			b = append(appendHead(b, majorText, uint64(len(k))), k...)
+			var err error
+			if b, err = appendValue(b, x[k], depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[interface{}]interface{}:
+		type entry struct {
+			key []byte
+			val interface{}
+		}
+		entries := make([]entry, 0, len(x))
+		for k, val := range x {
+			kb, err := appendValue(nil, k, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{kb, val})
+		}
+		sort.Slice(entries, func(i, j int) bool { return string(entries[i].key) < string(entries[j].key) })
+		b = appendHead(b, majorMap, uint64(len(x)))
+		for _, e := range entries {
+			b = append(b, e.key...)
+			var err error
+			if b, err = appendValue(b, e.val, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+	}
+}
+
+// Unmarshal decodes a single CBOR item. Unsigned integers decode as uint64
+// (or int64 when they fit), negative integers as int64, floats as float64,
+// arrays as []interface{}, and maps as map[string]interface{} when every key
+// is a text string or map[interface{}]interface{} otherwise.
+func Unmarshal(data []byte) (interface{}, error) {
+	d := decoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, ErrTrailingData
+	}
+	return v, nil
+}
+
+// UnmarshalPrefix decodes the first CBOR item in data and returns the
+// number of bytes it occupied, allowing callers to walk concatenated items.
+func UnmarshalPrefix(data []byte) (interface{}, int, error) {
+	d := decoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, d.pos, nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, ErrUnexpectedEOF
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) head() (byte, byte, uint64, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		b, err := d.next(1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return major, info, uint64(b[0]), nil
+	case info == 25:
+		b, err := d.next(2)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return major, info, uint64(binary.BigEndian.Uint16(b)), nil
+	case info == 26:
+		b, err := d.next(4)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return major, info, uint64(binary.BigEndian.Uint32(b)), nil
+	case info == 27:
+		b, err := d.next(8)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return major, info, binary.BigEndian.Uint64(b), nil
+	case info == 31:
+		return 0, 0, 0, ErrIndefinite
+	default:
+		return 0, 0, 0, fmt.Errorf("cbor: invalid additional info %d", info)
+	}
+}
+
+func (d *decoder) length(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+
+func (d *decoder) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case majorUint:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	case majorNegInt:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("cbor: negative integer overflow")
+		}
+		return -1 - int64(n), nil
+	case majorBytes, majorText:
+		l, err := d.length(n)
+		if err != nil {
+			return nil, err
+		}
+		b, _ := d.next(l)
+		if major == majorText {
+			if !utf8.Valid(b) {
+				return nil, ErrInvalidUTF8
+			}
+			return string(b), nil
+		}
+		out := make([]byte, l)
+		copy(out, b)
+		return out, nil
+	case majorArray:
+		// Every element occupies at least one byte.
+		l, err := d.length(n)
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]interface{}, 0, l)
+		for i := 0; i < l; i++ {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case majorMap:
+		l, err := d.length(n)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]interface{}, 0, l)
+		vals := make([]interface{}, 0, l)
+		allText := true
+		for i := 0; i < l; i++ {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := k.(string); !ok {
+				allText = false
+			}
+			keys = append(keys, k)
+			vals = append(vals, v)
+		}
+		if allText {
+			m := make(map[string]interface{}, l)
+			for i, k := range keys {
+				m[k.(string)] = vals[i]
+			}
+			return m, nil
+		}
+		m := make(map[interface{}]interface{}, l)
+		for i, k := range keys {
+			switch k.(type) {
+			case []byte, []interface{}, map[string]interface{}, map[interface{}]interface{}:
+				return nil, fmt.Errorf("cbor: unsupported map key type %T", k)
+			}
+			m[k] = vals[i]
+		}
+		return m, nil
+	case majorTag:
+		return d.value(depth + 1)
+	default:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			return float16ToFloat64(uint16(n)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case 27:
+			return math.Float64frombits(n), nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+}
+
+func float16ToFloat64(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(frac+1024, exp-25)
+}
@@ -0,0 +1,138 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalVectors(t *testing.T) {
+	// Vectors from RFC 8949 Appendix A.
+	tests := []struct {
+		name string
+		in   interface{}
+		want string
+	}{
+		{"Zero", 0, "00"},
+		{"TwentyFour", 24, "1818"},
+		{"Thousand", 1000, "1903e8"},
+		{"NegOne", -1, "20"},
+		{"NegThousand", -1000, "3903e7"},
+		{"Float", 1.1, "fb3ff199999999999a"},
+		{"IntegralFloat", float64(100), "1864"},
+		{"False", false, "f4"},
+		{"True", true, "f5"},
+		{"Null", nil, "f6"},
+		{"Bytes", []byte{1, 2, 3, 4}, "4401020304"},
+		{"Text", "IETF", "6449455446"},
+		{"Array", []interface{}{1, 2, 3}, "83010203"},
+		{"Map", map[string]interface{}{"a": 1, "b": []interface{}{2, 3}}, "a26161016162820203"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.in)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("Marshal() = %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := map[string]interface{}{
+		"t":  "para_chunk",
+		"ts": int64(1700000000000),
+		"v": map[string]interface{}{
+			"msgId": "abc",
+			"i":     int64(3),
+			"s":     "hello, 世界",
+			"ratio": 0.5,
+			"raw":   []byte{0xde, 0xad},
+			"neg":   int64(-42),
+			"ok":    true,
+			"none":  nil,
+		},
+	}
+
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	out, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n in=%#v\nout=%#v", in, out)
+	}
+}
+
+func TestUnmarshalIntegerKeys(t *testing.T) {
+	// {1: 2, -1: 1, -2: h'01'} as used by COSE keys.
+	data, _ := hex.DecodeString("a3010220012141" + "01")
+	v, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("expected map[interface{}]interface{}, got %T", v)
+	}
+	if m[int64(1)] != int64(2) || m[int64(-1)] != int64(1) {
+		t.Errorf("unexpected map contents: %#v", m)
+	}
+	if !bytes.Equal(m[int64(-2)].([]byte), []byte{1}) {
+		t.Errorf("unexpected byte string: %#v", m[int64(-2)])
+	}
+}
+
+func TestUnmarshalFloats(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want float64
+	}{
+		{"f93c00", 1.0},
+		{"f93e00", 1.5},
+		{"f9c400", -4.0},
+		{"fa47c35000", 100000.0},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.hex)
+		v, err := Unmarshal(data)
+		if err != nil {
+			t.Fatalf("Unmarshal(%s) failed: %v", tt.hex, err)
+		}
+		if v != tt.want {
+			t.Errorf("Unmarshal(%s) = %v, want %v", tt.hex, v, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+		want error
+	}{
+		{"Empty", "", ErrUnexpectedEOF},
+		{"TruncatedText", "6449", ErrUnexpectedEOF},
+		{"HugeLength", "7bffffffffffffffff", ErrUnexpectedEOF},
+		{"Indefinite", "9fff", ErrIndefinite},
+		{"Trailing", "0000", ErrTrailingData},
+		{"InvalidUTF8", "62c328", ErrInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.hex)
+			if _, err := Unmarshal(data); !errors.Is(err, tt.want) {
+				t.Errorf("Unmarshal() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package cbor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// The Append functions and Decoder let generated code encode and decode
+// structs directly, without the interface{} trees Marshal and Unmarshal
+// build. See cmd/cborgen.
+
+// ErrUnknownField is returned by generated decoders for a map key the
+// struct has no field for.
+var ErrUnknownField = errors.New("cbor: unknown field")
+
+// AppendMapHeader appends the head of a map with n entries.
+func AppendMapHeader(b []byte, n int) []byte {
+	return appendHead(b, majorMap, uint64(n))
+}
+
+// AppendArrayHeader appends the head of an array with n items.
+func AppendArrayHeader(b []byte, n int) []byte {
+	return appendHead(b, majorArray, uint64(n))
+}
+
+// AppendString appends s as a text string.
+func AppendString(b []byte, s string) []byte {
+	return append(appendHead(b, majorText, uint64(len(s))), s...)
+}
+
+// AppendInt appends n as an integer.
+func AppendInt(b []byte, n int64) []byte {
+	return appendInt(b, n)
+}
+
+// AppendUint appends n as an unsigned integer.
+func AppendUint(b []byte, n uint64) []byte {
+	return appendHead(b, majorUint, n)
+}
+
+// AppendBool appends true or false.
+func AppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xf5)
+	}
+	return append(b, 0xf4)
+}
+
+// AppendNull appends null.
+func AppendNull(b []byte) []byte {
+	return append(b, 0xf6)
+}
+
+// AppendStringMap appends m as a map of text strings, keys sorted, or
+// null when m is nil.
+func AppendStringMap(b []byte, m map[string]string) []byte {
+	if m == nil {
+		return AppendNull(b)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = AppendMapHeader(b, len(m))
+	for _, k := range keys {
+		b = AppendString(AppendString(b, k), m[k])
+	}
+	return b
+}
+
+// A Decoder reads CBOR items of known types one after another. Like
+// encoding/json, the typed reads accept null as the zero value. Tags are
+// skipped.
+type Decoder struct {
+	d decoder
+}
+
+// NewDecoder returns a Decoder reading data.
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{d: decoder{data: data}}
+}
+
+// Done reports whether every byte of the data has been read.
+func (d *Decoder) Done() bool {
+	return d.d.pos == len(d.d.data)
+}
+
+// null consumes a null or undefined item and reports whether there was
+// one.
+func (d *Decoder) null() bool {
+	if d.d.pos < len(d.d.data) {
+		if b := d.d.data[d.d.pos]; b == 0xf6 || b == 0xf7 {
+			d.d.pos++
+			return true
+		}
+	}
+	return false
+}
+
+// head reads the next head, skipping tags.
+func (d *Decoder) head() (byte, byte, uint64, error) {
+	for depth := 0; ; depth++ {
+		if depth > maxDepth {
+			return 0, 0, 0, ErrTooDeep
+		}
+		major, info, n, err := d.d.head()
+		if err != nil || major != majorTag {
+			return major, info, n, err
+		}
+	}
+}
+
+func (d *Decoder) expect(want byte) (uint64, error) {
+	major, _, n, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if major != want {
+		return 0, fmt.Errorf("cbor: got major type %d, want %d", major, want)
+	}
+	return n, nil
+}
+
+// MapLen reads the head of a map and returns its number of entries; 0 for
+// null.
+func (d *Decoder) MapLen() (int, error) {
+	if d.null() {
+		return 0, nil
+	}
+	n, err := d.expect(majorMap)
+	if err != nil {
+		return 0, err
+	}
+	// Every entry occupies at least two bytes.
+	return d.d.length(n)
+}
+
+// ArrayLen reads the head of an array and returns its number of items, or
+// -1 for null so that callers can tell it from an empty array.
+func (d *Decoder) ArrayLen() (int, error) {
+	if d.null() {
+		return -1, nil
+	}
+	n, err := d.expect(majorArray)
+	if err != nil {
+		return 0, err
+	}
+	return d.d.length(n)
+}
+
+// String reads a text string.
+func (d *Decoder) String() (string, error) {
+	if d.null() {
+		return "", nil
+	}
+	n, err := d.expect(majorText)
+	if err != nil {
+		return "", err
+	}
+	l, err := d.d.length(n)
+	if err != nil {
+		return "", err
+	}
+	b, _ := d.d.next(l)
+	if !utf8.Valid(b) {
+		return "", ErrInvalidUTF8
+	}
+	return string(b), nil
+}
+
+// Int reads an integer. A float is accepted when it holds an integer,
+// since some encoders write large JavaScript numbers as floats.
+func (d *Decoder) Int() (int64, error) {
+	if d.null() {
+		return 0, nil
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	switch major {
+	case majorUint:
+		if n > math.MaxInt64 {
+			return 0, errors.New("cbor: integer overflow")
+		}
+		return int64(n), nil
+	case majorNegInt:
+		if n > math.MaxInt64 {
+			return 0, errors.New("cbor: negative integer overflow")
+		}
+		return -1 - int64(n), nil
+	case majorSimple:
+		f, ok := simpleFloat(info, n)
+		if ok && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return int64(f), nil
+		}
+	}
+	return 0, fmt.Errorf("cbor: got major type %d, want an integer", major)
+}
+
+// Uint reads a non-negative integer.
+func (d *Decoder) Uint() (uint64, error) {
+	n, err := d.Int()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("cbor: negative value for an unsigned integer")
+	}
+	return uint64(n), nil
+}
+
+// Bool reads true or false.
+func (d *Decoder) Bool() (bool, error) {
+	if d.null() {
+		return false, nil
+	}
+	major, info, _, err := d.head()
+	if err != nil {
+		return false, err
+	}
+	if major == majorSimple && (info == 20 || info == 21) {
+		return info == 21, nil
+	}
+	return false, fmt.Errorf("cbor: got major type %d, want a boolean", major)
+}
+
+// StringMap reads a map of text strings; nil for null.
+func (d *Decoder) StringMap() (map[string]string, error) {
+	if d.null() {
+		return nil, nil
+	}
+	n, err := d.MapLen()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		k, err := d.String()
+		if err != nil {
+			return nil, err
+		}
+		if m[k], err = d.String(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Raw returns the bytes of the next item, whatever its type, and skips
+// over it.
+func (d *Decoder) Raw() ([]byte, error) {
+	start := d.d.pos
+	if err := d.d.skip(0); err != nil {
+		return nil, err
+	}
+	return d.d.data[start:d.d.pos], nil
+}
+
+func simpleFloat(info byte, n uint64) (float64, bool) {
+	switch info {
+	case 25:
+		return float16ToFloat64(uint16(n)), true
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), true
+	case 27:
+		return math.Float64frombits(n), true
+	}
+	return 0, false
+}
+
+// skip moves past one item without decoding it.
+func (d *decoder) skip(depth int) error {
+	if depth > maxDepth {
+		return ErrTooDeep
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case majorBytes, majorText:
+		l, err := d.length(n)
+		if err != nil {
+			return err
+		}
+		d.pos += l
+	case majorArray, majorMap:
+		l, err := d.length(n)
+		if err != nil {
+			return err
+		}
+		if major == majorMap {
+			l *= 2
+		}
+		for i := 0; i < l; i++ {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+	case majorTag:
+		return d.skip(depth + 1)
+	case majorSimple:
+		if info > 27 {
+			return fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+// Package certpin checks TLS certificate fingerprints reported by clients
+// against the certificate the server is meant to be reached through. A
+// mismatch means something between the client and the server (a corporate
+// proxy, a captive portal or an attacker) terminated TLS with its own
+// certificate.
+//
+// The server itself usually sits behind a reverse proxy that owns the
+// certificate, so the expected fingerprints are configured: static pins,
+// a certificate file shared with the proxy, or both.
+package certpin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidFingerprint is returned for a fingerprint that is not a
+// SHA-256 digest in hex.
+var ErrInvalidFingerprint = errors.New("certpin: fingerprint must be a hex SHA-256 digest")
+
+// Fingerprint returns the SHA-256 fingerprint of a DER certificate in the
+// form Normalize produces.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Normalize accepts a SHA-256 fingerprint as lowercase or uppercase hex,
+// optionally colon-separated like openssl and browsers print it, and
+// returns it as 64 lowercase hex digits.
+func Normalize(fp string) (string, error) {
+	s := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+	if len(s) != sha256.Size*2 {
+		return "", ErrInvalidFingerprint
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", ErrInvalidFingerprint
+	}
+	return s, nil
+}
+
+// Pins is the set of fingerprints clients may legitimately observe.
+type Pins struct {
+	static   []string
+	certFile string
+
+	mu      sync.Mutex
+	modTime time.Time
+	fromPEM []string
+}
+
+// New returns the pins made of fingerprints and the leaf certificate in
+// certFile (PEM), either of which may be empty. The file is re-read when
+// it changes, so a certificate renewed by the proxy is picked up without
+// a restart.
+func New(fingerprints []string, certFile string) (*Pins, error) {
+	p := &Pins{certFile: certFile}
+	for _, fp := range fingerprints {
+		if strings.TrimSpace(fp) == "" {
+			continue
+		}
+		n, err := Normalize(fp)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", err, fp)
+		}
+		p.static = append(p.static, n)
+	}
+	if len(p.static) == 0 && certFile == "" {
+		return nil, errors.New("certpin: no fingerprints or certificate file")
+	}
+	if _, err := p.Expected(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Expected returns the current fingerprints.
+func (p *Pins) Expected() ([]string, error) {
+	expected := append([]string(nil), p.static...)
+	if p.certFile == "" {
+		return expected, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, err := os.Stat(p.certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !info.ModTime().Equal(p.modTime) {
+		fps, err := readLeaf(p.certFile)
+		if err != nil {
+			return nil, err
+		}
+		p.fromPEM, p.modTime = fps, info.ModTime()
+	}
+	return append(expected, p.fromPEM...), nil
+}
+
+// Match reports whether the normalized fingerprint fp is expected.
+func (p *Pins) Match(fp string) (bool, error) {
+	expected, err := p.Expected()
+	if err != nil {
+		return false, err
+	}
+	for _, e := range expected {
+		if e == fp {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readLeaf returns the fingerprint of the first certificate in a PEM file,
+// which for a certificate chain is the leaf.
+func readLeaf(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("certpin: no certificate in %s", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			return []string{Fingerprint(block.Bytes)}, nil
+		}
+	}
+}
+
+// Mismatch is what an alert reports.
+type Mismatch struct {
+	DeviceID    string   `json:"device_id"`
+	Fingerprint string   `json:"fingerprint"`
+	Expected    []string `json:"expected"`
+	IP          string   `json:"ip"`
+	ReportedAt  int64    `json:"reported_at"`
+}
+
+// DefaultAlertQuiet is how long a device and fingerprint pair stays quiet
+// after alerting.
+const DefaultAlertQuiet = time.Hour
+
+// alertTimeout bounds an alert webhook call.
+const alertTimeout = 5 * time.Second
+
+// Alerter posts mismatches to a webhook. A device behind the same proxy
+// reports the same fingerprint on every connection, so each device and
+// fingerprint pair alerts at most once per quiet period.
+type Alerter struct {
+	url    string
+	quiet  time.Duration
+	client *http.Client
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+
+	// post delivers an alert; tests replace it.
+	post func(Mismatch) error
+}
+
+// NewAlerter returns an Alerter posting to url.
+func NewAlerter(url string, quiet time.Duration) *Alerter {
+	a := &Alerter{
+		url:    url,
+		quiet:  quiet,
+		client: &http.Client{Timeout: alertTimeout},
+		sent:   make(map[string]time.Time),
+	}
+	a.post = a.deliver
+	return a
+}
+
+// Alert sends m in the background unless the same device reported the
+// same fingerprint within the quiet period.
+func (a *Alerter) Alert(m Mismatch) {
+	key := m.DeviceID + "|" + m.Fingerprint
+	now := time.Now()
+	a.mu.Lock()
+	if last, ok := a.sent[key]; ok && now.Sub(last) < a.quiet {
+		a.mu.Unlock()
+		return
+	}
+	a.sent[key] = now
+	for k, last := range a.sent {
+		if now.Sub(last) >= a.quiet {
+			delete(a.sent, k)
+		}
+	}
+	a.mu.Unlock()
+
+	go func() {
+		if err := a.post(m); err != nil {
+			slog.Error("Failed to send certificate mismatch alert", "device_id", m.DeviceID, "err", err)
+		}
+	}()
+}
+
+func (a *Alerter) deliver(m Mismatch) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
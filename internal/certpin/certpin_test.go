@@ -0,0 +1,128 @@
+package certpin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func selfSigned(t *testing.T, name string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestNormalize(t *testing.T) {
+	want := strings.Repeat("ab", 32)
+	for _, in := range []string{want, strings.ToUpper(want), strings.TrimSuffix(strings.Repeat("AB:", 32), ":"), " " + want + "\n"} {
+		if got, err := Normalize(in); err != nil || got != want {
+			t.Errorf("Normalize(%q) = %q, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", strings.Repeat("ab", 20), strings.Repeat("zz", 32)} {
+		if _, err := Normalize(in); err == nil {
+			t.Errorf("Normalize(%q) should fail", in)
+		}
+	}
+}
+
+func TestPinsFromFile(t *testing.T) {
+	if _, err := New(nil, ""); err == nil {
+		t.Error("New without pins should fail")
+	}
+	if _, err := New([]string{"not-a-fingerprint"}, ""); err == nil {
+		t.Error("New with a bad pin should fail")
+	}
+
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	write := func(der []byte, mod time.Time) {
+		// A chain: leaf first, then an intermediate that must be ignored.
+		chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: selfSigned(t, "intermediate")})...)
+		if err := os.WriteFile(path, chain, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mod, mod)
+	}
+
+	old, renewed := selfSigned(t, "old"), selfSigned(t, "renewed")
+	write(old, time.Now().Add(-time.Hour))
+	static := strings.Repeat("0", 64)
+	p, err := New([]string{static}, path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for fp, want := range map[string]bool{static: true, Fingerprint(old): true, Fingerprint(renewed): false} {
+		if ok, err := p.Match(fp); err != nil || ok != want {
+			t.Errorf("Match(%s) = %v, %v; want %v", fp, ok, err, want)
+		}
+	}
+
+	// The proxy renews the certificate in place.
+	write(renewed, time.Now())
+	if ok, _ := p.Match(Fingerprint(renewed)); !ok {
+		t.Error("renewed certificate not picked up")
+	}
+	if ok, _ := p.Match(Fingerprint(old)); ok {
+		t.Error("replaced certificate still matches")
+	}
+
+	os.Remove(path)
+	if _, err := p.Match(static); err == nil {
+		t.Error("Match should fail when the certificate file is gone")
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	a := NewAlerter("http://unused", time.Hour)
+	sent := make(chan Mismatch, 4)
+	a.post = func(m Mismatch) error {
+		sent <- m
+		return nil
+	}
+
+	a.Alert(Mismatch{DeviceID: "laptop", Fingerprint: "aa"})
+	a.Alert(Mismatch{DeviceID: "laptop", Fingerprint: "aa"})
+	a.Alert(Mismatch{DeviceID: "laptop", Fingerprint: "bb"})
+	a.Alert(Mismatch{DeviceID: "phone", Fingerprint: "aa"})
+
+	got := map[string]int{}
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-sent:
+			got[m.DeviceID+"|"+m.Fingerprint]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d alerts sent: %v", i, got)
+		}
+	}
+	select {
+	case m := <-sent:
+		t.Errorf("duplicate alert %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got["laptop|aa"] != 1 || got["laptop|bb"] != 1 || got["phone|aa"] != 1 {
+		t.Errorf("alerts = %v", got)
+	}
+}
@@ -0,0 +1,227 @@
+// Package feature holds the feature flags that switch whole subsystems on
+// or off per install, so a subsystem can ship disabled and be turned on
+// where it is wanted.
+//
+// A flag's value comes from, in order: the FEATURES environment override,
+// the config table (key "feature.<name>"), the flag's default. Flags set
+// from the environment cannot be changed at runtime.
+package feature
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// Names of the known flags.
+const (
+	Rooms = "rooms"
+)
+
+// Flag describes a known flag.
+type Flag struct {
+	Name        string
+	Description string
+	Default     bool
+}
+
+// Known lists every flag, sorted by name. A flag is added with the code it
+// gates, never ahead of it.
+var Known = []Flag{
+	{Rooms, "Joining rooms other than a user's default room", true},
+}
+
+// Sources of a flag's value.
+const (
+	SourceDefault = "default"
+	SourceConfig  = "config"
+	SourceEnv     = "env"
+)
+
+var (
+	// ErrUnknownFlag is returned for a name not in Known.
+	ErrUnknownFlag = errors.New("unknown feature flag")
+	// ErrFlagLocked is returned when changing a flag set by FEATURES.
+	ErrFlagLocked = errors.New("feature flag is set by the environment")
+)
+
+// Store persists flags. *store.Store implements it.
+type Store interface {
+	GetConfig(key string) (string, error)
+	SetConfigs(set map[string]string, del []string) error
+}
+
+// State is a flag's current value and where it came from.
+type State struct {
+	Flag
+	Enabled bool
+	Source  string
+}
+
+// Flags holds the value of every known flag. A nil *Flags reports every
+// flag at its default.
+type Flags struct {
+	store Store
+	env   map[string]bool
+
+	mu     sync.RWMutex
+	config map[string]bool
+}
+
+// ParseEnv parses overrides written as "rooms=off", as
+// FEATURES holds them. Values are anything strconv.ParseBool accepts, or
+// on and off.
+func ParseEnv(s string) (map[string]bool, error) {
+	overrides := map[string]bool{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid feature override %q: want flag=on or flag=off", kv)
+		}
+		name = strings.TrimSpace(name)
+		if lookup(name) == nil {
+			return nil, fmt.Errorf("%w %q", ErrUnknownFlag, name)
+		}
+		enabled, err := parseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid feature override %q: want flag=on or flag=off", kv)
+		}
+		overrides[name] = enabled
+	}
+	return overrides, nil
+}
+
+// New loads the flags stored in s and applies the env overrides. Stored
+// values of unknown flags are ignored, so a flag can be retired without
+// cleaning up after it.
+func New(s Store, env map[string]bool) (*Flags, error) {
+	f := &Flags{store: s, env: env, config: map[string]bool{}}
+	for _, flag := range Known {
+		value, err := s.GetConfig(key(flag.Name))
+		if errors.Is(err, store.ErrConfigNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		enabled, err := parseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %q is not a boolean", key(flag.Name), value)
+		}
+		f.config[flag.Name] = enabled
+	}
+	return f, nil
+}
+
+// Enabled reports whether the named flag is on. Unknown flags are off.
+func (f *Flags) Enabled(name string) bool {
+	flag := lookup(name)
+	if flag == nil {
+		return false
+	}
+	return f.state(*flag).Enabled
+}
+
+// Snapshot returns the value of every known flag.
+func (f *Flags) Snapshot() map[string]bool {
+	snap := make(map[string]bool, len(Known))
+	for _, flag := range Known {
+		snap[flag.Name] = f.state(flag).Enabled
+	}
+	return snap
+}
+
+// States returns every known flag with its value and source, in the
+// order of Known.
+func (f *Flags) States() []State {
+	states := make([]State, len(Known))
+	for i, flag := range Known {
+		states[i] = f.state(flag)
+	}
+	return states
+}
+
+// Set stores the values of the named flags. A nil value removes the
+// stored one, returning the flag to its default. Nothing is changed
+// unless every name is known and none is set by the environment, and the
+// flags are written in one store transaction.
+func (f *Flags) Set(values map[string]*bool) error {
+	for name := range values {
+		if lookup(name) == nil {
+			return fmt.Errorf("%w %q", ErrUnknownFlag, name)
+		}
+		if _, ok := f.env[name]; ok {
+			return fmt.Errorf("%w: %s", ErrFlagLocked, name)
+		}
+	}
+	set := map[string]string{}
+	var del []string
+	for name, v := range values {
+		if v == nil {
+			del = append(del, key(name))
+		} else {
+			set[key(name)] = strconv.FormatBool(*v)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.store.SetConfigs(set, del); err != nil {
+		return err
+	}
+	for name, v := range values {
+		if v == nil {
+			delete(f.config, name)
+		} else {
+			f.config[name] = *v
+		}
+	}
+	return nil
+}
+
+func (f *Flags) state(flag Flag) State {
+	if f == nil {
+		return State{Flag: flag, Enabled: flag.Default, Source: SourceDefault}
+	}
+	if v, ok := f.env[flag.Name]; ok {
+		return State{Flag: flag, Enabled: v, Source: SourceEnv}
+	}
+	f.mu.RLock()
+	v, ok := f.config[flag.Name]
+	f.mu.RUnlock()
+	if ok {
+		return State{Flag: flag, Enabled: v, Source: SourceConfig}
+	}
+	return State{Flag: flag, Enabled: flag.Default, Source: SourceDefault}
+}
+
+func lookup(name string) *Flag {
+	i := slices.IndexFunc(Known, func(f Flag) bool { return f.Name == name })
+	if i < 0 {
+		return nil
+	}
+	return &Known[i]
+}
+
+func key(name string) string {
+	return store.ConfigKeyFeaturePrefix + name
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
@@ -0,0 +1,117 @@
+package feature
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+func TestParseEnv(t *testing.T) {
+	got, err := ParseEnv(" rooms=off, ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[Rooms] {
+		t.Errorf("ParseEnv = %v", got)
+	}
+	if got, err := ParseEnv("rooms=1"); err != nil || !got[Rooms] {
+		t.Errorf("ParseEnv(\"rooms=1\") = %v, %v", got, err)
+	}
+	if got, err := ParseEnv(""); err != nil || len(got) != 0 {
+		t.Errorf("ParseEnv(\"\") = %v, %v", got, err)
+	}
+	if _, err := ParseEnv("teleport=on"); !errors.Is(err, ErrUnknownFlag) {
+		t.Errorf("unknown flag: err = %v", err)
+	}
+	for _, bad := range []string{"rooms", "rooms=maybe"} {
+		if _, err := ParseEnv(bad); err == nil {
+			t.Errorf("ParseEnv(%q) succeeded", bad)
+		}
+	}
+}
+
+// failingStore refuses every write.
+type failingStore struct{ Store }
+
+func (failingStore) SetConfigs(map[string]string, []string) error {
+	return errors.New("disk full")
+}
+
+func TestFlags(t *testing.T) {
+	s, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var none *Flags
+	if !none.Enabled(Rooms) || none.Enabled("teleport") {
+		t.Errorf("nil flags = %v", none.Snapshot())
+	}
+
+	locked, err := New(s, map[string]bool{Rooms: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := locked.States()[0]; st.Enabled || st.Source != SourceEnv {
+		t.Errorf("env rooms = %+v", st)
+	}
+	on, off := true, false
+	if err := locked.Set(map[string]*bool{Rooms: &on}); !errors.Is(err, ErrFlagLocked) {
+		t.Errorf("set env flag: err = %v", err)
+	}
+
+	f, err := New(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set(map[string]*bool{Rooms: &off, "teleport": &on}); !errors.Is(err, ErrUnknownFlag) {
+		t.Errorf("set unknown flag: err = %v", err)
+	}
+	if !f.Enabled(Rooms) {
+		t.Error("rejected Set changed rooms")
+	}
+	if err := f.Set(map[string]*bool{Rooms: &off}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Enabled(Rooms) {
+		t.Errorf("after Set: %v", f.Snapshot())
+	}
+
+	// A failed write leaves the flags as they were.
+	broken := &Flags{store: failingStore{s}, config: map[string]bool{}}
+	if err := broken.Set(map[string]*bool{Rooms: &off}); err == nil {
+		t.Error("Set succeeded on a failing store")
+	}
+	if st := broken.States()[0]; !st.Enabled || st.Source != SourceDefault {
+		t.Errorf("after failed Set: %+v", st)
+	}
+
+	// Stored values survive a restart; the env override does not.
+	f, err = New(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := f.States()[0]; st.Enabled || st.Source != SourceConfig {
+		t.Errorf("after reload: %+v", st)
+	}
+
+	if err := f.Set(map[string]*bool{Rooms: nil}); err != nil {
+		t.Fatal(err)
+	}
+	if st := f.States()[0]; !st.Enabled || st.Source != SourceDefault {
+		t.Errorf("reset rooms: %+v", st)
+	}
+	if _, err := s.GetConfig(key(Rooms)); !errors.Is(err, store.ErrConfigNotFound) {
+		t.Errorf("reset rooms left a stored value: err = %v", err)
+	}
+
+	if err := s.SetConfig(store.ConfigKeyFeaturePrefix+Rooms, "sideways"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(s, nil); err == nil {
+		t.Error("New accepted a malformed stored flag")
+	}
+}
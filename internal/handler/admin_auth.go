@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+)
+
+// adminClaims returns the claims of the admin bearer token on r, or nil if
+// there is no valid one. err is auth.ErrInsufficientScope when the token is
+// valid but its scope is not one of scopes.
+func (h *Handler) adminClaims(r *http.Request, scopes ...string) (*auth.Claims, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, auth.ErrInvalidFormat
+	}
+	if len(scopes) == 0 {
+		return h.tokenManager.VerifyWithVersion(token, auth.TokenVersionAdmin)
+	}
+	return h.tokenManager.VerifyScope(token, auth.TokenVersionAdmin, scopes...)
+}
+
+// requireAdminScope checks for an admin token from POST /api/admin/login
+// whose scope is one of scopes. It writes a 401 when there is no valid
+// token and a 403 when the token may not do this.
+func (h *Handler) requireAdminScope(w http.ResponseWriter, r *http.Request, scopes ...string) bool {
+	_, ok := h.adminScopeClaims(w, r, scopes...)
+	return ok
+}
+
+func (h *Handler) adminScopeClaims(w http.ResponseWriter, r *http.Request, scopes ...string) (*auth.Claims, bool) {
+	claims, err := h.adminClaims(r, scopes...)
+	if err != nil {
+		if errors.Is(err, auth.ErrInsufficientScope) {
+			writeError(w, http.StatusForbidden, "INSUFFICIENT_SCOPE", "This admin token is read-only")
+			return nil, false
+		}
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Admin token required")
+		return nil, false
+	}
+	return claims, true
+}
+
+// requireAdmin guards admin calls that change state. When signed calls are
+// required the request must also carry a valid signature.
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	claims, ok := h.adminScopeClaims(w, r, auth.ScopeAdmin)
+	if !ok {
+		return false
+	}
+	return h.requireAdminSignature(w, r, claims)
+}
+
+// requireAdminSignature checks the X-Admin-Timestamp, X-Admin-Nonce and
+// X-Admin-Signature headers against the signing key of claims' session.
+// The body is read to be signed and put back for the handler.
+func (h *Handler) requireAdminSignature(w http.ResponseWriter, r *http.Request, claims *auth.Claims) bool {
+	if h.adminNonces == nil {
+		return true
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Failed to read body")
+			return false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	err := auth.VerifyRequest(h.tokenManager.RequestKey(claims.SID), r.Method, clientRequestURI(r),
+		r.Header.Get("X-Admin-Timestamp"), r.Header.Get("X-Admin-Nonce"), r.Header.Get("X-Admin-Signature"),
+		body, h.adminNonces, time.Now())
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, auth.ErrRequestUnsigned):
+		writeError(w, http.StatusUnauthorized, "SIGNATURE_REQUIRED", "Admin changes must be signed")
+	case errors.Is(err, auth.ErrRequestStale):
+		writeError(w, http.StatusUnauthorized, "STALE_REQUEST", "Request timestamp is too far from server time")
+	case errors.Is(err, auth.ErrRequestReplayed):
+		writeError(w, http.StatusUnauthorized, "REPLAYED_REQUEST", "Request nonce already used")
+	default:
+		slog.WarnContext(r.Context(), "Bad admin request signature", "ip", getClientIP(r))
+		writeError(w, http.StatusUnauthorized, "INVALID_SIGNATURE", "Invalid request signature")
+	}
+	return false
+}
+
+// requireAdminRead guards admin calls that only read, which read-only admin
+// tokens may make too.
+func (h *Handler) requireAdminRead(w http.ResponseWriter, r *http.Request) bool {
+	return h.requireAdminScope(w, r, auth.ScopeAdmin, auth.ScopeReadOnly)
+}
+
+// requireAdminMethod is requireAdminRead for GET and requireAdmin for
+// anything else, for endpoints that both read and write.
+func (h *Handler) requireAdminMethod(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet {
+		return h.requireAdminRead(w, r)
+	}
+	return h.requireAdmin(w, r)
+}
+
+// requireEnrollAdmin is requireAdmin for the device enrollment endpoints,
+// which also take the bootstrap header while no device is enrolled so the
+// first device can be set up before anyone can log in as admin.
+func (h *Handler) requireEnrollAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if claims, err := h.adminClaims(r, auth.ScopeAdmin); err == nil {
+		return h.requireAdminSignature(w, r, claims)
+	}
+
+	token := r.Header.Get("X-Admin-Bootstrap")
+	if token == "" {
+		return h.requireAdmin(w, r)
+	}
+	if token != h.bootstrapToken {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Admin token required")
+		return false
+	}
+	if h.bootstrapLocked() {
+		writeError(w, http.StatusForbidden, "BOOTSTRAP_LOCKED",
+			"The bootstrap token was locked after repeated invalid enrollments; restart the server with a new BOOTSTRAP_TOKEN")
+		return false
+	}
+	n, err := h.store.CountDevices()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to count devices", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return false
+	}
+	if n > 0 {
+		writeError(w, http.StatusForbidden, "BOOTSTRAP_CLOSED",
+			"The bootstrap token only enrolls the first device; log in as admin or use a pairing code")
+		return false
+	}
+	return true
+}
+
+// handleAdminLogin exchanges the admin secret for a short-lived admin token,
+// sent back as "Authorization: Bearer <token>" on /api/admin/* calls. An
+// optional "scope" of "readonly" asks for a token that may only read, for
+// dashboards and monitoring.
+func (h *Handler) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
+	if ok, st := h.loginLimiter.Check(h.LimitKey(r)); !ok {
+		writeRateLimited(w, st, "Too many requests")
+		return
+	}
+
+	if h.adminSecretHash == "" {
+		writeError(w, http.StatusNotFound, "ADMIN_LOGIN_DISABLED", "Admin login is not configured")
+		return
+	}
+
+	var req AdminLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+
+	scope := req.Scope
+	switch scope {
+	case "":
+		scope = auth.ScopeAdmin
+	case auth.ScopeAdmin, auth.ScopeReadOnly:
+	default:
+		writeError(w, http.StatusBadRequest, "INVALID_SCOPE", "scope must be admin or readonly")
+		return
+	}
+
+	if err := h.verifySecret(r, req.Secret, h.adminSecretHash); err != nil {
+		if verifierBusy(w, err) {
+			return
+		}
+		slog.WarnContext(r.Context(), "Failed admin login", "ip", getClientIP(r))
+		writeError(w, http.StatusUnauthorized, "INVALID_SECRET", "Invalid admin secret")
+		return
+	}
+
+	expires := time.Now().Add(h.adminTTL)
+	sid := uuid.NewString()
+	token, err := h.tokenManager.Sign(sid, auth.TokenVersionAdmin, scope, h.adminTTL)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate admin token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate token")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Admin login", "scope", scope, "ip", getClientIP(r))
+	resp := AdminTokenResponse{Token: token, ExpiresAt: expires.UnixMilli(), Scope: scope}
+	if h.adminNonces != nil && scope == auth.ScopeAdmin {
+		resp.SigningKey = base64.RawURLEncoding.EncodeToString(h.tokenManager.RequestKey(sid))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleAdminLogout revokes the admin token it is called with.
+func (h *Handler) handleAdminLogout(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.adminClaims(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Admin token required")
+		return
+	}
+
+	if err := h.store.RevokeSession(claims.SID, time.Now().UnixMilli(), h.revokedUntil(claims)); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to revoke admin token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to log out")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, LoggedOutResponse{LoggedOut: true})
+}
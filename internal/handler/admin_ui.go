@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"io/fs"
+	"net/http"
+
+	"github.com/lixiansheng/fileflow/web"
+)
+
+// adminUI serves the embedded admin page under /admin/. The page itself is
+// public and holds no data; every call it makes goes through requireAdmin
+// with a token from POST /api/admin/login.
+func adminUI() http.Handler {
+	assets, err := fs.Sub(web.Admin, "admin")
+	if err != nil {
+		// The embed path is fixed at compile time.
+		panic(err)
+	}
+	files := http.StripPrefix("/admin/", http.FileServerFS(assets))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy",
+			"default-src 'self'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'")
+		files.ServeHTTP(w, r)
+	})
+}
@@ -1,92 +1,345 @@
 package handler
 
 import (
+	"compress/flate"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
 	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/certpin"
+	"github.com/lixiansheng/fileflow/internal/feature"
 	"github.com/lixiansheng/fileflow/internal/limit"
+	"github.com/lixiansheng/fileflow/internal/logging"
 	"github.com/lixiansheng/fileflow/internal/realtime"
 	"github.com/lixiansheng/fileflow/internal/store"
+	"github.com/lixiansheng/fileflow/internal/wake"
 )
 
 type Handler struct {
 	store           *store.Store
-	tokenManager    *auth.TokenManager
+	tokenManager    TokenManager
 	loginLimiter    *limit.IPLimiter
 	connLimiter     *limit.ConnLimiter
+	secretMu        sync.RWMutex
 	secretHash      string
+	argonParams     auth.ArgonParams
+	rehashSecret    bool
+	adminSecretHash string
+	adminTTL        time.Duration
+	minClient       string
+	recommendClient string
+	updateURL       string
 	bootstrapToken  string
-	hub             *realtime.Hub
+	hub             Hub
 	secureCookies   bool
+	hostCookies     bool
+	legacyCookies   bool
 	sessionTTL      time.Duration
+	sessionMaxLife  time.Duration
 	deviceTicketTTL time.Duration
-	challengeStore  *auth.ChallengeStore
+	reputation      auth.ReputationPolicy
+	challengeStore  auth.Challenges
+	pairingStore    *auth.PairingStore
 	maxWSMsgBytes   int
+	wsCompressMin   int
+	wsCompressLevel int
+	relyingParty    auth.RelyingParty
+	totpCipher      *auth.SeedCipher
 	upgrader        websocket.Upgrader
+	verifier        *auth.VerifierPool
+	deviceLimiter   *limit.DeviceLimiter
+	maxChallenges   int
+	// enrollMaxInvalid is how many invalid device payloads a pairing code
+	// or the bootstrap token survives; bootstrapStrikes counts the
+	// latter's.
+	enrollMaxInvalid int
+	bootstrapMu      sync.Mutex
+	bootstrapStrikes int
+	ticketBinding    string
+	adminNonces      *auth.NonceCache
+	oidc             *auth.OIDCProvider
+	oidcAllowed      []string
+	noConnAudit      bool
+	pushLimiter      *limit.DeviceLimiter
+	build            BuildInfo
+	apiDocs          bool
+	waker            *wake.Waker
+	certPins         *certpin.Pins
+	certAlerter      *certpin.Alerter
+	onion            bool
+	receipts         bool
+	logLevels        *logging.Levels
+	flags            *feature.Flags
 }
 
 type Config struct {
-	Store           *store.Store
-	TokenManager    *auth.TokenManager
-	LoginLimiter    *limit.IPLimiter
-	ConnLimiter     *limit.ConnLimiter
-	SecretHash      string
-	BootstrapToken  string
-	Hub             *realtime.Hub
-	SecureCookies   bool
-	SessionTTL      time.Duration
-	DeviceTicketTTL time.Duration
-	ChallengeStore  *auth.ChallengeStore
-	MaxWSMsgBytes   int
-	AllowedOrigin   string
+	Store          *store.Store
+	TokenManager   TokenManager
+	LoginLimiter   *limit.IPLimiter
+	ConnLimiter    *limit.ConnLimiter
+	SecretHash     string
+	BootstrapToken string
+	Hub            Hub
+	SecureCookies  bool
+	// HostCookies names the auth cookies with the __Host- prefix. It only
+	// takes effect together with SecureCookies.
+	HostCookies bool
+	// LegacyCookies keeps accepting unprefixed cookie names while browsers
+	// migrate to the prefixed ones.
+	LegacyCookies bool
+	SessionTTL    time.Duration
+	// SessionMaxLifetime bounds how long /api/session/refresh can keep a
+	// login alive. Defaults to 7 days.
+	SessionMaxLifetime time.Duration
+	DeviceTicketTTL    time.Duration
+	// DeviceTicketMaxTTL caps the ticket lifetime granted to devices with a
+	// long clean auth history. Defaults to DeviceTicketTTL * 16.
+	DeviceTicketMaxTTL time.Duration
+	// ChallengeStore defaults to an in-memory store with a 60s TTL.
+	ChallengeStore auth.Challenges
+	// PairingStore holds codes for /api/device/enroll. Defaults to a
+	// store with a 5 minute TTL.
+	PairingStore  *auth.PairingStore
+	MaxWSMsgBytes int
+	// AllowedOrigins may open WebSockets; nil allows any origin.
+	AllowedOrigins *Origins
+	// WebAuthnRPID enables the /api/webauthn endpoints when set.
+	WebAuthnRPID   string
+	WebAuthnOrigin string
+	// TOTPCipher encrypts TOTP seeds at rest; nil disables TOTP setup.
+	TOTPCipher *auth.SeedCipher
+	// ArgonParams are the cost parameters the secret hash should use.
+	// Defaults to auth.DefaultArgonParams.
+	ArgonParams auth.ArgonParams
+	// RehashSecret upgrades a weaker secret hash on the next successful
+	// login and saves it under store.ConfigKeySecretHash. Leave it off when
+	// the hash comes from somewhere the server cannot rewrite.
+	RehashSecret bool
+	// AdminSecretHash is the Argon2id (or bcrypt) hash POST /api/admin/login
+	// checks. Admin login is disabled when it is empty.
+	AdminSecretHash string
+	// AdminSessionTTL is how long an admin token lasts. Defaults to 15
+	// minutes.
+	AdminSessionTTL time.Duration
+	// MinClientVersion refuses WebSocket clients that report an older
+	// version (or none) with update_required. Empty accepts every client.
+	MinClientVersion string
+	// RecommendedClientVersion sends update_recommended to clients below
+	// it but lets them connect.
+	RecommendedClientVersion string
+	// ClientUpdateURL is where the update events point clients.
+	ClientUpdateURL string
+	// SecretVerifier bounds how many login secrets are checked at once.
+	// Nil checks them on the request goroutine.
+	SecretVerifier *auth.VerifierPool
+	// ChallengeLimiter rate limits attestation challenges per device ID on
+	// top of the per-IP limit. Nil leaves only the per-IP limit.
+	ChallengeLimiter *limit.DeviceLimiter
+	// MaxChallenges caps the unexpired challenges one device may hold.
+	// Defaults to 5.
+	MaxChallenges int
+	// EnrollMaxInvalid is how many enrollment requests with an invalid
+	// device payload a pairing code or the bootstrap token accepts before
+	// it stops working. Defaults to 5.
+	EnrollMaxInvalid int
+	// TicketBinding ties device tickets to the address they were issued
+	// to: TicketBindIP, TicketBindSubnet, or empty for no binding.
+	TicketBinding string
+	// AdminNonces, when set, requires admin calls that change state to be
+	// signed with the key from admin login and remembers their nonces to
+	// refuse replays. Nil accepts the bearer token alone.
+	AdminNonces *auth.NonceCache
+	// OIDC enables /auth/oidc/login and /auth/oidc/callback, which start a
+	// session for the attested device after a login at the provider
+	// instead of the shared secret. Nil disables them.
+	OIDC *auth.OIDCProvider
+	// OIDCAllowed limits OIDC logins to these verified emails, "@domain"
+	// suffixes or "sub:" subjects, each optionally mapped to a user with
+	// "=user_id". Empty admits no one.
+	OIDCAllowed []string
+	// WSBufferSize is the WebSocket read and write buffer size in bytes.
+	// Defaults to 1024.
+	WSBufferSize int
+	// WSCompression accepts permessage-deflate from clients that offer it.
+	// Event frames smaller than WSCompressMinBytes and file chunks are
+	// still sent uncompressed; WSCompressLevel is the flate level, with 0
+	// meaning the library default.
+	WSCompression      bool
+	WSCompressMinBytes int
+	WSCompressLevel    int
+	// NoConnAudit stops recording WebSocket connection attempts, so
+	// /api/admin/devices/{id}/connections stays empty.
+	NoConnAudit bool
+	// PushLimiter rate limits /api/push per app token on top of the per-IP
+	// limit. Nil leaves only the per-IP limit.
+	PushLimiter *limit.DeviceLimiter
+	// Build describes the running binary for GET /api/version.
+	Build BuildInfo
+	// APIDocs serves Swagger UI for /api/openapi.json at /api/docs. Meant
+	// for development; the page loads its assets from a CDN.
+	APIDocs bool
+	// Waker wakes an offline device with a wake target when /api/push
+	// finds it disconnected. Nil answers DEVICE_OFFLINE as before.
+	Waker *wake.Waker
+	// CertPins are the certificate fingerprints clients may report to
+	// /api/cert-report. Nil disables the endpoint.
+	CertPins *certpin.Pins
+	// CertAlerter is told about reported mismatches. Nil only audits them.
+	CertAlerter *certpin.Alerter
+	// OnionMode keys per-client limits on device tickets rather than
+	// addresses and turns off ticket binding, for a Tor onion service
+	// where every request comes from the local Tor daemon. See onion.go.
+	OnionMode bool
+	// TransferReceipts serves GET /api/transfers/{id}/receipt. The hub
+	// must also be given the Handler as its receipt recorder, see
+	// receipts.go.
+	TransferReceipts bool
+	// LogLevels are the levels the default logger uses, read and changed
+	// by /api/admin/loglevel. Nil disables the endpoint.
+	LogLevels *logging.Levels
+	// Features are the feature flags, read and changed by
+	// /api/admin/features. Nil leaves every flag at its default and
+	// disables the endpoint.
+	Features *feature.Flags
 }
 
+// Device ticket binding modes. Subnet binding (IPv4 /24, IPv6 /64)
+// tolerates carrier NAT and address churn that exact binding does not.
+const (
+	TicketBindIP     = "ip"
+	TicketBindSubnet = "subnet"
+)
+
 func New(cfg Config) *Handler {
 	ttl := cfg.DeviceTicketTTL
 	if ttl == 0 {
 		ttl = 15 * time.Minute
 	}
+	maxTTL := cfg.DeviceTicketMaxTTL
+	if maxTTL == 0 {
+		maxTTL = ttl * 16
+	}
 	maxWSMsgBytes := cfg.MaxWSMsgBytes
 	if maxWSMsgBytes == 0 {
 		maxWSMsgBytes = realtime.MaxMessageSize
 	}
+	maxLife := cfg.SessionMaxLifetime
+	if maxLife == 0 {
+		maxLife = 7 * 24 * time.Hour
+	}
 	challengeStore := cfg.ChallengeStore
 	if challengeStore == nil {
 		challengeStore = auth.NewChallengeStore(60 * time.Second)
 	}
+	pairingStore := cfg.PairingStore
+	if pairingStore == nil {
+		pairingStore = auth.NewPairingStore(5 * time.Minute)
+	}
+	adminTTL := cfg.AdminSessionTTL
+	if adminTTL == 0 {
+		adminTTL = 15 * time.Minute
+	}
+	maxChallenges := cfg.MaxChallenges
+	if maxChallenges == 0 {
+		maxChallenges = 5
+	}
+	enrollMaxInvalid := cfg.EnrollMaxInvalid
+	if enrollMaxInvalid <= 0 {
+		enrollMaxInvalid = 5
+	}
+	argonParams := cfg.ArgonParams
+	if argonParams == (auth.ArgonParams{}) {
+		argonParams = auth.DefaultArgonParams
+	}
+
+	// Binding a ticket to 127.0.0.1 would tie it to the Tor daemon, not
+	// the device.
+	ticketBinding := cfg.TicketBinding
+	if cfg.OnionMode {
+		ticketBinding = ""
+	}
 
 	h := &Handler{
-		store:           cfg.Store,
-		tokenManager:    cfg.TokenManager,
-		loginLimiter:    cfg.LoginLimiter,
-		connLimiter:     cfg.ConnLimiter,
-		secretHash:      cfg.SecretHash,
-		bootstrapToken:  cfg.BootstrapToken,
-		hub:             cfg.Hub,
-		secureCookies:   cfg.SecureCookies,
-		sessionTTL:      cfg.SessionTTL,
-		deviceTicketTTL: ttl,
-		challengeStore:  challengeStore,
-		maxWSMsgBytes:   maxWSMsgBytes,
+		store:            cfg.Store,
+		tokenManager:     cfg.TokenManager,
+		loginLimiter:     cfg.LoginLimiter,
+		connLimiter:      cfg.ConnLimiter,
+		secretHash:       cfg.SecretHash,
+		argonParams:      argonParams,
+		rehashSecret:     cfg.RehashSecret,
+		adminSecretHash:  cfg.AdminSecretHash,
+		adminTTL:         adminTTL,
+		minClient:        cfg.MinClientVersion,
+		recommendClient:  cfg.RecommendedClientVersion,
+		updateURL:        cfg.ClientUpdateURL,
+		bootstrapToken:   cfg.BootstrapToken,
+		hub:              cfg.Hub,
+		secureCookies:    cfg.SecureCookies,
+		hostCookies:      cfg.HostCookies && cfg.SecureCookies,
+		legacyCookies:    cfg.LegacyCookies,
+		sessionTTL:       cfg.SessionTTL,
+		sessionMaxLife:   maxLife,
+		deviceTicketTTL:  ttl,
+		reputation:       auth.NewReputationPolicy(ttl, maxTTL),
+		challengeStore:   challengeStore,
+		pairingStore:     pairingStore,
+		maxWSMsgBytes:    maxWSMsgBytes,
+		relyingParty:     auth.RelyingParty{ID: cfg.WebAuthnRPID, Origin: cfg.WebAuthnOrigin},
+		totpCipher:       cfg.TOTPCipher,
+		verifier:         cfg.SecretVerifier,
+		deviceLimiter:    cfg.ChallengeLimiter,
+		maxChallenges:    maxChallenges,
+		enrollMaxInvalid: enrollMaxInvalid,
+		ticketBinding:    ticketBinding,
+		adminNonces:      cfg.AdminNonces,
+		oidc:             cfg.OIDC,
+		oidcAllowed:      cfg.OIDCAllowed,
+		noConnAudit:      cfg.NoConnAudit,
+		pushLimiter:      cfg.PushLimiter,
+		build:            cfg.Build,
+		apiDocs:          cfg.APIDocs,
+		waker:            cfg.Waker,
+		certPins:         cfg.CertPins,
+		certAlerter:      cfg.CertAlerter,
+		onion:            cfg.OnionMode,
+		receipts:         cfg.TransferReceipts,
+		logLevels:        cfg.LogLevels,
+		flags:            cfg.Features,
 	}
 
+	wsBuffer := cfg.WSBufferSize
+	if wsBuffer <= 0 {
+		wsBuffer = 1024
+	}
+	h.wsCompressMin = cfg.WSCompressMinBytes
+	h.wsCompressLevel = cfg.WSCompressLevel
+	if h.wsCompressLevel == 0 {
+		h.wsCompressLevel = flate.DefaultCompression
+	}
 	h.upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:    wsBuffer,
+		WriteBufferSize:   wsBuffer,
+		EnableCompression: cfg.WSCompression,
+		Subprotocols:      []string{realtime.SubprotocolCBOR, realtime.SubprotocolJSON},
 		CheckOrigin: func(r *http.Request) bool {
-			if cfg.AllowedOrigin == "" {
+			if cfg.AllowedOrigins == nil {
 				return true
 			}
-			origin := r.Header.Get("Origin")
-			return origin == cfg.AllowedOrigin || origin == "https://"+cfg.AllowedOrigin
+			return cfg.AllowedOrigins.Allow(r.Header.Get("Origin"))
 		},
 	}
 
@@ -96,52 +349,200 @@ func New(cfg Config) *Handler {
 func (h *Handler) Routes() http.Handler {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/healthz", h.handleHealthz)
-	mux.HandleFunc("/api/device/challenge", h.handleDeviceChallenge)
-	mux.HandleFunc("/api/device/attest", h.handleDeviceAttest)
-	mux.HandleFunc("/api/login", h.handleLogin)
-	mux.HandleFunc("/api/session", h.handleSession)
-	mux.HandleFunc("/api/presence", h.handlePresence)
-	mux.HandleFunc("/api/admin/devices", h.handleAdminDevices)
-	mux.HandleFunc("/ws", h.handleWebSocket)
-	mux.Handle("/", http.FileServer(http.Dir("web/static")))
+	mux.HandleFunc("GET /healthz", h.handleHealthz)
+	mux.HandleFunc("GET /readyz", h.handleReadyz)
+	mux.HandleFunc("GET /.well-known/fileflow.json", h.handleWellKnown)
+	// The current API answers both unversioned and under its version
+	// prefix; see versions.go.
+	v1 := h.routesV1()
+	mux.Handle("/api/", withAPIVersion(APIVersion, v1))
+	mux.Handle("/api/v1/", mountAPIVersion("/api/v1", 1, v1))
+	mux.HandleFunc("GET /auth/oidc/login", h.handleOIDCLogin)
+	mux.HandleFunc("GET /auth/oidc/callback", h.handleOIDCCallback)
+	mux.HandleFunc("GET /ws", h.handleWebSocket)
+	mux.Handle("/admin/", adminUI())
+	mux.Handle("/", methodFallback(mux, "/", http.FileServer(http.Dir("web/static"))))
+
+	return mux
+}
+
+// routesV1 routes version 1 of the API at its unversioned /api paths.
+// Routes mounts it at both /api and /api/v1.
+func (h *Handler) routesV1() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/version", h.handleVersion)
+	mux.HandleFunc("GET /api/server-info", h.handleServerInfo)
+	mux.HandleFunc("GET /api/openapi.json", h.handleOpenAPI)
+	if h.apiDocs {
+		mux.HandleFunc("GET /api/docs", handleAPIDocs)
+	}
+	mux.HandleFunc("POST /api/device/challenge", h.handleDeviceChallenge)
+	mux.HandleFunc("POST /api/device/attest", h.handleDeviceAttest)
+	mux.HandleFunc("POST /api/device/pairing-code", h.handlePairingCode)
+	mux.HandleFunc("POST /api/device/enroll", h.handleDeviceEnroll)
+	mux.HandleFunc("POST /api/login", h.handleLogin)
+	mux.HandleFunc("GET /api/session", h.handleSession)
+	mux.HandleFunc("POST /api/session/refresh", h.handleSessionRefresh)
+	mux.HandleFunc("POST /api/logout", h.handleLogout)
+	mux.HandleFunc("POST /api/totp/setup", h.handleTOTPSetup)
+	mux.HandleFunc("POST /api/totp/confirm", h.handleTOTPConfirm)
+	mux.HandleFunc("GET /api/presence", h.handlePresence)
+	mux.HandleFunc("GET /api/tokens", h.handleAPITokenList)
+	mux.HandleFunc("POST /api/tokens", h.handleAPITokenCreate)
+	mux.HandleFunc("DELETE /api/tokens/{id}", h.handleAPIToken)
+	mux.HandleFunc("POST /api/push", h.handlePush)
+	mux.HandleFunc("POST /api/cert-report", h.handleCertReport)
+	mux.HandleFunc("GET /api/transfers/{id}/receipt", h.handleTransferReceipt)
+	mux.HandleFunc("POST /api/webauthn/register/options", h.handleWebAuthnRegisterOptions)
+	mux.HandleFunc("POST /api/webauthn/register", h.handleWebAuthnRegister)
+	mux.HandleFunc("POST /api/webauthn/assert/options", h.handleWebAuthnAssertOptions)
+	mux.HandleFunc("POST /api/webauthn/assert", h.handleWebAuthnAssert)
+	mux.HandleFunc("POST /api/admin/login", h.handleAdminLogin)
+	mux.HandleFunc("POST /api/admin/logout", h.handleAdminLogout)
+	mux.HandleFunc("GET /api/admin/devices", h.handleAdminDeviceList)
+	mux.HandleFunc("POST /api/admin/devices", h.handleAdminDeviceAdd)
+	mux.HandleFunc("PATCH /api/admin/devices/{id}", h.handleAdminDeviceUpdate)
+	mux.HandleFunc("DELETE /api/admin/devices/{id}", h.handleAdminDeviceDelete)
+	mux.HandleFunc("POST /api/admin/devices/{id}/restore", h.handleAdminDeviceRestore)
+	mux.HandleFunc("GET /api/admin/devices/{id}/impact", h.handleAdminDeviceImpact)
+	mux.HandleFunc("GET /api/admin/devices/{id}/connections", h.handleAdminDeviceConnections)
+	mux.HandleFunc("GET /api/admin/devices/{id}/timeline", h.handleAdminDeviceTimeline)
+	mux.HandleFunc("PUT /api/admin/devices/{id}/state", h.handleAdminDeviceState)
+	mux.HandleFunc("DELETE /api/admin/devices/{id}/totp", h.handleAdminDeviceTOTP)
+	mux.HandleFunc("GET /api/admin/devices/{id}/commands", h.handleAdminDeviceCommands)
+	mux.HandleFunc("PUT /api/admin/devices/{id}/commands", h.handleAdminDeviceCommands)
+	mux.HandleFunc("GET /api/admin/devices/{id}/peers", h.handleAdminDevicePeers)
+	mux.HandleFunc("PUT /api/admin/devices/{id}/peers", h.handleAdminDevicePeers)
+	mux.HandleFunc("GET /api/admin/devices/{id}/wake", h.handleAdminDeviceWake)
+	mux.HandleFunc("PUT /api/admin/devices/{id}/wake", h.handleAdminDeviceWake)
+	mux.HandleFunc("DELETE /api/admin/devices/{id}/wake", h.handleAdminDeviceWake)
+	mux.HandleFunc("GET /api/admin/trash", h.handleAdminTrash)
+	mux.HandleFunc("GET /api/admin/users", h.handleAdminUserList)
+	mux.HandleFunc("POST /api/admin/users", h.handleAdminUserCreate)
+	mux.HandleFunc("GET /api/admin/secrets", h.handleAdminLoginSecretList)
+	mux.HandleFunc("POST /api/admin/secrets", h.handleAdminLoginSecretCreate)
+	mux.HandleFunc("DELETE /api/admin/secrets/{name}", h.handleAdminLoginSecretDelete)
+	mux.HandleFunc("GET /api/admin/stats", h.handleAdminStats)
+	mux.HandleFunc("GET /api/admin/loglevel", h.handleAdminLogLevel)
+	mux.HandleFunc("PUT /api/admin/loglevel", h.handleAdminLogLevel)
+	mux.HandleFunc("GET /api/admin/features", h.handleAdminFeatures)
+	mux.HandleFunc("PUT /api/admin/features", h.handleAdminFeatures)
+	mux.HandleFunc("GET /api/admin/cert-reports", h.handleAdminCertReports)
+	mux.HandleFunc("GET /api/admin/enroll-events", h.handleAdminEnrollEvents)
+	mux.HandleFunc("GET /api/admin/app-tokens", h.handleAdminAppTokenList)
+	mux.HandleFunc("POST /api/admin/app-tokens", h.handleAdminAppTokenCreate)
+	mux.HandleFunc("DELETE /api/admin/app-tokens/{id}", h.handleAdminAppToken)
+	mux.Handle("/api/", methodFallback(mux, "/api/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Not found")
+	})))
 
 	return mux
 }
 
-// ... existing code ...
+// routeMethods are the methods methodFallback looks for other routes under.
+var routeMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// methodFallback is the catch-all registered at pattern in mux. A request
+// that reaches it matched no route; when its path is routed for other
+// methods it gets a 405 with an Allow header in the API's error format
+// (ServeMux's own 405 is plain text and never fires past a catch-all),
+// and otherwise it is handed to next.
+func methodFallback(mux *http.ServeMux, pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allow []string
+		for _, m := range routeMethods {
+			probe := &http.Request{Method: m, URL: r.URL, Host: r.Host, Header: http.Header{}}
+			if _, p := mux.Handler(probe); p != "" && p != pattern {
+				allow = append(allow, m)
+			}
+		}
+		if len(allow) > 0 {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-func (h *Handler) handleAdminDevices(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+// handleAdminDeviceList lists enrolled devices with their live connection
+// counts, a page at a time. ?label= keeps devices whose label contains it;
+// ?limit= (default 100, at most 500) and ?offset= select the page.
+func (h *Handler) handleAdminDeviceList(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminRead(w, r) {
 		return
 	}
 
-	token := r.Header.Get("X-Admin-Bootstrap")
-	if token == "" || token != h.bootstrapToken {
-		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Invalid bootstrap token")
+	q := r.URL.Query()
+	query := store.DeviceQuery{Label: q.Get("label"), Limit: 100}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "limit must be between 1 and 500")
+			return
+		}
+		query.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "offset must be a non-negative integer")
+			return
+		}
+		query.Offset = n
+	}
+
+	devices, total, err := h.store.QueryDevices(query)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list devices", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list devices")
 		return
 	}
 
-	var req struct {
-		DeviceID string                 `json:"device_id"`
-		PubJWK   map[string]interface{} `json:"pub_jwk"`
-		Label    string                 `json:"label"`
+	resp := DeviceListResponse{Devices: make([]EnrolledDevice, 0, len(devices)), Total: total}
+	for _, d := range devices {
+		resp.Devices = append(resp.Devices, EnrolledDevice{
+			DeviceID:        d.DeviceID,
+			Label:           d.Label,
+			UserID:          d.UserID,
+			CreatedAt:       d.CreatedAt,
+			LiveConnections: h.hub.DeviceStats(d.DeviceID).Connections,
+			LastSeen:        d.LastSeen,
+			Disabled:        d.Disabled,
+		})
+	}
+	if next := query.Offset + len(devices); next < total {
+		resp.NextOffset = next
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleAdminDeviceAdd enrolls a device from its ID and public key.
+func (h *Handler) handleAdminDeviceAdd(w http.ResponseWriter, r *http.Request) {
+	if !h.requireEnrollAdmin(w, r) {
+		return
 	}
 
+	var req DeviceAddRequest
+
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		h.rejectEnrollment(w, r, "", "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+
+	if !h.requireUser(w, req.UserID) {
 		return
 	}
 
 	if err := auth.ValidateDeviceID(req.DeviceID, req.PubJWK); err != nil {
-		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", err.Error())
+		h.rejectEnrollment(w, r, "", "INVALID_DEVICE_ID", err.Error())
 		return
 	}
 
 	jwkJSON, err := json.Marshal(req.PubJWK)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "INVALID_PUBLIC_KEY", "Failed to serialize public key")
+		h.rejectEnrollment(w, r, "", "INVALID_PUBLIC_KEY", "Failed to serialize public key")
 		return
 	}
 
@@ -150,6 +551,7 @@ func (h *Handler) handleAdminDevices(w http.ResponseWriter, r *http.Request) {
 		PubJWKJSON: string(jwkJSON),
 		Label:      req.Label,
 		CreatedAt:  time.Now().UnixMilli(),
+		UserID:     req.UserID,
 	}
 
 	if err := h.store.AddDevice(device); err != nil {
@@ -157,25 +559,140 @@ func (h *Handler) handleAdminDevices(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusConflict, "DEVICE_EXISTS", "Device already enrolled")
 			return
 		}
-		log.Printf("Failed to add device: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to add device", "err", err)
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to add device")
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]bool{"added": true})
+	writeJSON(w, http.StatusOK, AddedResponse{Added: true})
 }
 
-func (h *Handler) handleDeviceChallenge(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+// handleAdminDeviceImpact previews what revoking a device would disrupt
+// without changing any state.
+func (h *Handler) handleAdminDeviceImpact(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	device, err := h.store.GetDevice(deviceID)
+	if err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			writeError(w, http.StatusNotFound, "DEVICE_NOT_FOUND", "Device not found")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to load device", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load device")
+		return
+	}
+
+	stats := h.hub.DeviceStats(deviceID)
+	writeJSON(w, http.StatusOK, DeviceImpactResponse{
+		DeviceID:              device.DeviceID,
+		Label:                 device.Label,
+		LiveConnections:       stats.Connections,
+		ActiveSessions:        stats.Sessions,
+		InFlightMessages:      stats.InFlight,
+		OutstandingChallenges: h.challengeStore.CountForDevice(deviceID),
+	})
+}
+
+// handleAdminDeviceConnections lists recent WebSocket connection attempts
+// for a device, newest first.
+func (h *Handler) handleAdminDeviceConnections(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+
+	attempts, err := h.store.ListConnAttempts(deviceID, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list connection attempts", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list connection attempts")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ConnectionsResponse{Attempts: attempts})
+}
+
+// handleAdminDeviceTimeline lists the spans a device was connected, newest
+// first, from the accepted entries of the connection audit. ?before= takes
+// the next_before of the previous page.
+func (h *Handler) handleAdminDeviceTimeline(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
 		return
 	}
 
-	var req struct {
-		DeviceID string                 `json:"device_id"`
-		PubJWK   map[string]interface{} `json:"pub_jwk"`
+	q := r.URL.Query()
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+	var before int64
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "before must be a positive integer")
+			return
+		}
+		before = n
 	}
 
+	conns, err := h.store.ListConnIntervals(deviceID, before, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list connection intervals", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list connection intervals")
+		return
+	}
+
+	resp := TimelineResponse{DeviceID: deviceID, Intervals: make([]TimelineEntry, 0, len(conns))}
+	for _, c := range conns {
+		e := TimelineEntry{ID: c.ID, StartedAt: c.CreatedAt, EndedAt: c.ClosedAt, IP: c.IP, CloseCode: c.CloseCode}
+		if c.ClosedAt > 0 {
+			e.DurationMS = c.ClosedAt - c.CreatedAt
+		}
+		resp.Intervals = append(resp.Intervals, e)
+	}
+	if len(conns) == limit {
+		resp.NextBefore = conns[len(conns)-1].ID
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) handleDeviceChallenge(w http.ResponseWriter, r *http.Request) {
+	var req ChallengeRequest
+
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
 		return
@@ -186,7 +703,7 @@ func (h *Handler) handleDeviceChallenge(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	_, reqJWK, err := auth.ParseECPublicJWKMap(req.PubJWK)
+	_, reqJWK, err := auth.ParsePublicJWKMap(req.PubJWK)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, "INVALID_PUBLIC_KEY", "Invalid public key")
 		return
@@ -198,41 +715,58 @@ func (h *Handler) handleDeviceChallenge(w http.ResponseWriter, r *http.Request)
 			writeError(w, http.StatusForbidden, "DEVICE_NOT_ENROLLED", "Device not enrolled")
 			return
 		}
-		log.Printf("Failed to load device: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to load device", "err", err)
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load device")
 		return
 	}
+	if device.Disabled {
+		writeError(w, http.StatusForbidden, "DEVICE_DISABLED", "Device is disabled")
+		return
+	}
 
-	_, storedJWK, err := auth.ParseECPublicJWKBytes([]byte(device.PubJWKJSON))
+	_, storedJWK, err := auth.ParsePublicJWKBytes([]byte(device.PubJWKJSON))
 	if err != nil || !auth.EqualECPublicJWK(reqJWK, storedJWK) {
 		writeError(w, http.StatusBadRequest, "INVALID_PUBLIC_KEY", "Public key does not match enrollment")
 		return
 	}
 
+	if !h.allowChallenge(w, req.DeviceID) {
+		return
+	}
+
 	challenge, err := h.challengeStore.Create(req.DeviceID)
 	if err != nil {
-		log.Printf("Failed to create challenge: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to create challenge", "err", err)
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create challenge")
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]string{
-		"challenge_id": challenge.ID,
-		"nonce":        base64.RawURLEncoding.EncodeToString(challenge.Nonce),
+	writeJSON(w, http.StatusOK, ChallengeResponse{
+		ChallengeID: challenge.ID,
+		Nonce:       base64.RawURLEncoding.EncodeToString(challenge.Nonce),
 	})
 }
 
-func (h *Handler) handleDeviceAttest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
-		return
+// allowChallenge checks the per-device challenge rate and the cap on
+// outstanding challenges for an enrolled device, writing a 429 when either
+// is exceeded. Without it anyone who knows a device's ID and public key
+// could fill the challenge store from many addresses.
+func (h *Handler) allowChallenge(w http.ResponseWriter, deviceID string) bool {
+	if h.deviceLimiter != nil {
+		if ok, st := h.deviceLimiter.Check(deviceID); !ok {
+			writeRateLimited(w, st, "Too many challenges for this device")
+			return false
+		}
 	}
-
-	var req struct {
-		ChallengeID string `json:"challenge_id"`
-		DeviceID    string `json:"device_id"`
-		Signature   string `json:"signature"`
+	if h.challengeStore.CountForDevice(deviceID) >= h.maxChallenges {
+		writeError(w, http.StatusTooManyRequests, "RATE_LIMITED", "Too many outstanding challenges for this device")
+		return false
 	}
+	return true
+}
+
+func (h *Handler) handleDeviceAttest(w http.ResponseWriter, r *http.Request) {
+	var req AttestRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
@@ -265,12 +799,16 @@ func (h *Handler) handleDeviceAttest(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusForbidden, "DEVICE_NOT_ENROLLED", "Device not enrolled")
 			return
 		}
-		log.Printf("Failed to load device: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to load device", "err", err)
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load device")
 		return
 	}
+	if device.Disabled {
+		writeError(w, http.StatusForbidden, "DEVICE_DISABLED", "Device is disabled")
+		return
+	}
 
-	pubKey, _, err := auth.ParseECPublicJWKBytes([]byte(device.PubJWKJSON))
+	pubKey, _, err := auth.ParsePublicJWKBytes([]byte(device.PubJWKJSON))
 	if err != nil {
 		writeError(w, http.StatusBadRequest, "INVALID_PUBLIC_KEY", "Invalid enrolled public key")
 		return
@@ -282,20 +820,86 @@ func (h *Handler) handleDeviceAttest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !auth.VerifyECDSASignature(pubKey, challenge.Nonce, sigBytes) {
+	// Anyone who knows a device's ID and public key can get a challenge
+	// for it, so a bad signature says nothing about the device. It is
+	// charged to the caller's login bucket instead of the device's
+	// reputation, which would shorten the real device's tickets.
+	if !auth.VerifySignature(pubKey, challenge.Nonce, sigBytes) {
+		h.loginLimiter.Allow(h.LimitKey(r))
+		slog.WarnContext(r.Context(), "Device attestation failed", "device_id", req.DeviceID, "ip", getClientIP(r))
 		writeError(w, http.StatusUnauthorized, "INVALID_SIGNATURE", "Signature verification failed")
 		return
 	}
 
-	ticket, err := h.tokenManager.Sign(req.DeviceID, auth.TokenVersionDeviceTicket, h.deviceTicketTTL)
+	h.recordAuthSuccess(req.DeviceID)
+	h.issueDeviceTicket(w, r, req.DeviceID)
+}
+
+// issueDeviceTicket sets a device_ticket cookie for a freshly authenticated
+// device and writes the DeviceOKResponse.
+func (h *Handler) issueDeviceTicket(w http.ResponseWriter, r *http.Request, deviceID string) {
+	ttl := h.ticketTTL(deviceID)
+
+	var bind string
+	if key := h.ticketBindKey(r); key != "" {
+		bind = h.tokenManager.BindingHash(key)
+	}
+	ticket, err := h.tokenManager.SignTicket(deviceID, bind, ttl)
 	if err != nil {
-		log.Printf("Failed to sign device ticket: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to sign device ticket", "err", err)
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to sign ticket")
 		return
 	}
 
-	auth.SetDeviceTicketCookie(w, ticket, h.deviceTicketTTL, h.secureCookies)
-	writeJSON(w, http.StatusOK, map[string]bool{"device_ok": true})
+	h.setCookie(w, cookieDeviceTicket, ticket, time.Now().Add(ttl))
+	writeJSON(w, http.StatusOK, DeviceOKResponse{DeviceOK: true})
+}
+
+// ticketBindKey returns what a device ticket used on r is bound to under
+// the configured binding mode, or "" when binding is off.
+func (h *Handler) ticketBindKey(r *http.Request) string {
+	if h.ticketBinding == "" {
+		return ""
+	}
+	addr := getClientIP(r)
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if h.ticketBinding == TicketBindIP {
+		return ip.String()
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// ticketTTL returns the device ticket lifetime for a device based on its
+// authentication history, falling back to the base TTL on store errors.
+func (h *Handler) ticketTTL(deviceID string) time.Duration {
+	stats, err := h.store.GetAuthStats(deviceID)
+	if err != nil {
+		slog.Error("Failed to load auth stats", "err", err)
+		return h.deviceTicketTTL
+	}
+	var lastFailure time.Time
+	if stats.LastFailureAt > 0 {
+		lastFailure = time.UnixMilli(stats.LastFailureAt)
+	}
+	return h.reputation.TicketTTL(stats.Successes, lastFailure, time.Now())
+}
+
+func (h *Handler) recordAuthSuccess(deviceID string) {
+	if err := h.store.RecordAuthSuccess(deviceID, time.Now().UnixMilli()); err != nil {
+		slog.Error("Failed to record auth success", "err", err)
+	}
+}
+
+func (h *Handler) recordAuthFailure(deviceID string) {
+	if err := h.store.RecordAuthFailure(deviceID, time.Now().UnixMilli()); err != nil {
+		slog.Error("Failed to record auth failure", "err", err)
+	}
 }
 
 type APIResponse struct {
@@ -309,7 +913,14 @@ type APIError struct {
 	Message string `json:"message"`
 }
 
-var errMissingDeviceTicket = errors.New("missing device ticket")
+var (
+	errMissingDeviceTicket   = errors.New("missing device ticket")
+	errMissingSession        = errors.New("missing session")
+	errSessionDeviceMismatch = errors.New("session belongs to another device")
+	errDeviceRevoked         = errors.New("device is not enrolled")
+	errDeviceDisabled        = errors.New("device is disabled")
+	errTicketBinding         = errors.New("device ticket used from another network")
+)
 
 func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -329,7 +940,7 @@ func writeError(w http.ResponseWriter, status int, code, message string) {
 }
 
 func (h *Handler) verifyDeviceTicket(r *http.Request) (string, error) {
-	cookie, err := r.Cookie("device_ticket")
+	cookie, err := h.readCookie(r, cookieDeviceTicket)
 	if err != nil {
 		return "", errMissingDeviceTicket
 	}
@@ -343,42 +954,161 @@ func (h *Handler) verifyDeviceTicket(r *http.Request) (string, error) {
 		return "", errors.New("invalid device id")
 	}
 
+	// Tickets issued before binding was turned on carry no binding and
+	// stay valid until they expire.
+	if key := h.ticketBindKey(r); key != "" && claims.Bind != "" && !h.tokenManager.CheckBinding(claims, key) {
+		return claims.SID, errTicketBinding
+	}
+
+	// Tickets outlive the device row: deleting or disabling a device must
+	// invalidate every ticket already issued to it. The ID is still
+	// returned with errDeviceRevoked or errDeviceDisabled so callers can
+	// audit it.
+	device, err := h.store.GetDevice(claims.SID)
+	if err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			return claims.SID, errDeviceRevoked
+		}
+		return "", err
+	}
+	if device.Disabled {
+		return claims.SID, errDeviceDisabled
+	}
+
+	logging.SetDeviceID(r.Context(), claims.SID)
 	return claims.SID, nil
 }
 
+// verifySession checks the ff_session cookie and that it was issued to
+// deviceID, so a session cookie copied to another machine is useless without
+// that device's ticket as well.
+func (h *Handler) verifySession(r *http.Request, deviceID string) (*auth.Claims, error) {
+	cookie, err := h.readCookie(r, cookieSession)
+	if err != nil {
+		return nil, errMissingSession
+	}
+
+	claims, err := h.tokenManager.VerifyWithVersion(cookie.Value, auth.TokenVersionSession)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.DeviceID == "" || claims.DeviceID != deviceID {
+		return nil, errSessionDeviceMismatch
+	}
+	return claims, nil
+}
+
 func (h *Handler) handleHealthz(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	writeJSON(w, http.StatusOK, HealthResponse{OK: true})
 }
 
-func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
-		return
+// BuildInfo identifies the server binary. cmd/server fills it from
+// ldflags.
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+}
+
+// handleVersion reports the server and protocol versions so clients can
+// check compatibility. Commit, build date and Go runtime are only shown to
+// admin tokens, since they help an attacker match known bugs.
+func (h *Handler) handleVersion(w http.ResponseWriter, r *http.Request) {
+	resp := VersionResponse{
+		Version:           h.build.Version,
+		Protocol:          realtime.ProtocolVersion,
+		Subprotocols:      []string{realtime.SubprotocolJSON, realtime.SubprotocolCBOR},
+		MinClient:         h.minClient,
+		RecommendedClient: h.recommendClient,
+	}
+	if resp.Version == "" {
+		resp.Version = "dev"
 	}
+	if _, err := h.adminClaims(r, auth.ScopeAdmin, auth.ScopeReadOnly); err == nil {
+		resp.Build = &BuildDetails{
+			Commit:    h.build.Commit,
+			BuildDate: h.build.BuildDate,
+			GoVersion: runtime.Version(),
+			Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
 
-	ip := getClientIP(r)
-	if !h.loginLimiter.Allow(ip) {
-		writeError(w, http.StatusTooManyRequests, "RATE_LIMITED", "Too many requests")
-		return
+// readyTimeout bounds the store probe in /readyz.
+const readyTimeout = 2 * time.Second
+
+// handleReadyz reports whether the server can do useful work: the store
+// takes a write lock and the hub loop has beaten within three intervals.
+// Unlike /healthz it answers 503 when either is degraded.
+func (h *Handler) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := ReadyResponse{}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	start := time.Now()
+	err := h.store.Ping(ctx)
+	resp.Store = ComponentStatus{OK: err == nil, LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Readiness: store probe failed", "err", err)
+		resp.Store.Detail = "database unavailable or locked"
 	}
 
-	var req struct {
-		Secret   string `json:"secret"`
-		DeviceID string `json:"device_id"`
+	switch last := h.hub.LastHeartbeat(); {
+	case last.IsZero():
+		resp.Hub = ComponentStatus{Detail: "hub not running"}
+	case time.Since(last) > 3*realtime.HeartbeatInterval:
+		resp.Hub = ComponentStatus{Detail: "hub loop stalled", LastHeartbeat: last.UnixMilli()}
+	default:
+		resp.Hub = ComponentStatus{OK: true, LastHeartbeat: last.UnixMilli()}
 	}
 
+	resp.OK = resp.Store.OK && resp.Hub.OK
+	status := http.StatusOK
+	if !resp.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if ok, st := h.loginLimiter.Check(h.LimitKey(r)); !ok {
+		writeRateLimited(w, st, "Too many requests")
+		return
+	}
+
+	var req LoginRequest
+
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
 		return
 	}
 
+	// A read-only session receives but never sends, for wall displays and
+	// other devices that should only show what arrives.
+	scope := req.Scope
+	switch scope {
+	case "":
+		scope = auth.ScopeUser
+	case auth.ScopeUser, auth.ScopeReadOnly:
+	default:
+		writeError(w, http.StatusBadRequest, "INVALID_SCOPE", "scope must be user or readonly")
+		return
+	}
+
 	deviceID, err := h.verifyDeviceTicket(r)
 	if err != nil {
-		if errors.Is(err, errMissingDeviceTicket) {
+		switch {
+		case errors.Is(err, errMissingDeviceTicket):
 			writeError(w, http.StatusUnauthorized, "MISSING_DEVICE_TICKET", "Device ticket required")
-			return
+		case errors.Is(err, errDeviceRevoked):
+			writeError(w, http.StatusForbidden, "DEVICE_NOT_ENROLLED", "Device not enrolled")
+		case errors.Is(err, errDeviceDisabled):
+			writeError(w, http.StatusForbidden, "DEVICE_DISABLED", "Device is disabled")
+		default:
+			writeError(w, http.StatusUnauthorized, "INVALID_DEVICE_TICKET", "Invalid device ticket")
 		}
-		writeError(w, http.StatusUnauthorized, "INVALID_DEVICE_TICKET", "Invalid device ticket")
 		return
 	}
 
@@ -395,128 +1125,515 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := h.store.GetDevice(deviceID); err != nil {
-		if err == store.ErrDeviceNotFound {
-			writeError(w, http.StatusForbidden, "DEVICE_NOT_ENROLLED", "Device not enrolled")
+	// Verify the shared secret of the device's user
+	userID, err := h.deviceUser(deviceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Store error during login", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return
+	}
+	secretHash, err := h.secretHashFor(userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Store error during login", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return
+	}
+	secretScope, err := h.matchLoginSecret(r, userID, req.Secret, secretHash)
+	if err != nil {
+		if verifierBusy(w, err) {
 			return
 		}
-		log.Printf("Store error during login: %v", err)
+		if !errors.Is(err, errWrongSecret) {
+			slog.ErrorContext(r.Context(), "Store error during login", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+			return
+		}
+		h.recordAuthFailure(deviceID)
+		// Return generic error to avoid enumeration
+		writeJSON(w, http.StatusOK, AuthedResponse{Authed: false})
+		return
+	}
+	// A named secret caps the scope whatever the client asked for.
+	scope = narrowScope(scope, secretScope)
+
+	// Second factor, checked only after the secret so a missing or wrong
+	// code does not reveal whether the secret was right to a guesser.
+	needOTP, err := h.totpRequired(deviceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Store error during login", "err", err)
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
 		return
 	}
+	if needOTP {
+		if req.OTP == "" {
+			writeJSON(w, http.StatusOK, AuthedResponse{Authed: false, OTPRequired: true})
+			return
+		}
+		ok, err := h.verifyOTP(deviceID, req.OTP)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to verify TOTP", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+			return
+		}
+		if !ok {
+			h.recordAuthFailure(deviceID)
+			writeJSON(w, http.StatusOK, AuthedResponse{Authed: false, OTPRequired: true})
+			return
+		}
+	}
 
-	// Verify Shared Secret
-	if err := auth.VerifySecret(req.Secret, h.secretHash); err != nil {
-		// Return generic error to avoid enumeration
-		writeJSON(w, http.StatusOK, map[string]bool{"authed": false})
+	h.recordAuthSuccess(deviceID)
+
+	if err := h.startSession(w, deviceID, scope); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate token")
 		return
 	}
+	writeJSON(w, http.StatusOK, AuthedResponse{Authed: true, Scope: scope})
+}
 
-	sid := uuid.NewString()
+// startSession issues a new ff_session for deviceID and sets its cookie.
+func (h *Handler) startSession(w http.ResponseWriter, deviceID, scope string) error {
 	ttl := h.sessionTTL
-	token, err := h.tokenManager.Sign(sid, auth.TokenVersionSession, ttl)
+	token, err := h.tokenManager.SignSession(uuid.NewString(), deviceID, scope, ttl)
 	if err != nil {
-		log.Printf("Failed to generate token: %v", err)
-		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate token")
+		return err
+	}
+	h.setSessionCookie(w, token, time.Now().Add(ttl))
+	return nil
+}
+
+// verifySecret checks secret against hash on the verifier pool, if there
+// is one.
+func (h *Handler) verifySecret(r *http.Request, secret, hash string) error {
+	if h.verifier == nil {
+		return auth.VerifySecret(secret, hash)
+	}
+	return h.verifier.Verify(r.Context(), secret, hash)
+}
+
+// verifierBusy writes a 503 and returns true when err means the verifier
+// pool could not take the request, which says nothing about the secret.
+func verifierBusy(w http.ResponseWriter, err error) bool {
+	if !verifierError(err) {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	writeError(w, http.StatusServiceUnavailable, "SERVER_BUSY", "Too many logins in progress; try again shortly")
+	return true
+}
+
+func (h *Handler) currentSecretHash() string {
+	h.secretMu.RLock()
+	defer h.secretMu.RUnlock()
+	return h.secretHash
+}
+
+// maybeRehashSecret replaces a verified hash that was made with weaker
+// Argon2 parameters than the configured ones. Failures are logged and the
+// old hash stays in use; the next login tries again.
+func (h *Handler) maybeRehashSecret(secret, oldHash string) {
+	if !h.rehashSecret || !auth.NeedsRehash(oldHash, h.argonParams) {
+		return
+	}
+	newHash, err := auth.HashSecretParams(secret, h.argonParams)
+	if err != nil {
+		slog.Error("Failed to re-hash secret", "err", err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "ff_session",
-		Value:    token,
-		Path:     "/",
-		Expires:  time.Now().Add(ttl),
-		HttpOnly: true,
-		Secure:   h.secureCookies,
-		SameSite: http.SameSiteStrictMode,
-	})
+	h.secretMu.Lock()
+	defer h.secretMu.Unlock()
+	if h.secretHash != oldHash {
+		// A concurrent login already upgraded it.
+		return
+	}
+	if err := h.store.SetConfig(store.ConfigKeySecretHash, newHash); err != nil {
+		slog.Error("Failed to store re-hashed secret", "err", err)
+		return
+	}
+	h.secretHash = newHash
+	slog.Info("Secret hash upgraded",
+		"memory", h.argonParams.Memory, "time", h.argonParams.Time, "threads", h.argonParams.Threads)
+}
 
-	writeJSON(w, http.StatusOK, map[string]bool{"authed": true})
+func (h *Handler) setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	h.setCookie(w, cookieSession, token, expires)
 }
 
 func (h *Handler) handleSession(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("ff_session")
+	deviceID, err := h.verifyDeviceTicket(r)
 	if err != nil {
-		writeJSON(w, http.StatusOK, map[string]bool{"authed": false})
+		writeJSON(w, http.StatusOK, AuthedResponse{Authed: false, OIDC: h.oidc != nil})
 		return
 	}
 
-	if _, err := h.tokenManager.VerifyWithVersion(cookie.Value, auth.TokenVersionSession); err != nil {
-		writeJSON(w, http.StatusOK, map[string]bool{"authed": false})
+	claims, err := h.verifySession(r, deviceID)
+	if err != nil {
+		writeJSON(w, http.StatusOK, AuthedResponse{Authed: false, OIDC: h.oidc != nil})
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]bool{"authed": true})
+	writeJSON(w, http.StatusOK, AuthedResponse{Authed: true, Scope: claims.EffectiveScope()})
 }
 
-func (h *Handler) handlePresence(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("ff_session")
+// handleSessionRefresh swaps a valid ff_session for one with a fresh TTL,
+// bounded by the session's maximum lifetime from the original login.
+func (h *Handler) handleSessionRefresh(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := h.verifyDeviceTicket(r)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Session required")
+		writeError(w, http.StatusUnauthorized, "INVALID_DEVICE_TICKET", "Invalid device ticket")
+		return
+	}
+	claims, err := h.verifySession(r, deviceID)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Session expired")
 		return
 	}
 
-	if _, err := h.tokenManager.VerifyWithVersion(cookie.Value, auth.TokenVersionSession); err != nil {
-		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid session")
+	token, renewed, err := h.tokenManager.Renew(claims, h.sessionTTL, h.sessionMaxLife)
+	if err != nil {
+		if errors.Is(err, auth.ErrMaxLifetime) {
+			writeError(w, http.StatusUnauthorized, "SESSION_MAX_LIFETIME", "Session reached its maximum lifetime")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to renew session", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to renew session")
 		return
 	}
 
-	writeSuccess(w, map[string]int{
-		"online":   h.hub.OnlineCount(),
-		"required": 2,
-	})
+	expires := time.Unix(renewed.Exp, 0)
+	h.setSessionCookie(w, token, expires)
+	writeJSON(w, http.StatusOK, SessionRefreshResponse{Authed: true, ExpiresAt: expires.UnixMilli()})
 }
 
-func (h *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+// handleLogout revokes the caller's ff_session server-side, drops its live
+// WebSocket connections and clears the auth cookies. It always succeeds so a
+// client holding an already-invalid cookie can still reset its state.
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := h.readCookie(r, cookieSession); err == nil {
+		claims, err := h.tokenManager.VerifyWithVersion(cookie.Value, auth.TokenVersionSession)
+		if err == nil {
+			now := time.Now()
+			if err := h.store.RevokeSession(claims.SID, now.UnixMilli(), h.revokedUntil(claims)); err != nil {
+				slog.ErrorContext(r.Context(), "Failed to revoke session", "err", err)
+				writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to revoke session")
+				return
+			}
+			h.hub.CloseSession(claims.SID)
+		}
+	}
+
+	h.clearCookie(w, cookieSession)
+	h.clearCookie(w, cookieDeviceTicket)
+	writeJSON(w, http.StatusOK, LoggedOutResponse{LoggedOut: true})
+}
+
+// revokedUntil returns how long a revocation of claims' SID must be kept
+// (Unix ms): the latest moment any token with that SID can be valid. That
+// is the session's maximum lifetime, not claims.Exp, because another copy
+// of the token may have been renewed past it.
+func (h *Handler) revokedUntil(claims *auth.Claims) int64 {
+	authAt := claims.Auth
+	if authAt == 0 {
+		authAt = claims.Iat
+	}
+	until := time.Unix(authAt, 0).Add(h.sessionMaxLife)
+	if exp := time.Unix(claims.Exp, 0); exp.After(until) {
+		until = exp
+	}
+	return until.UnixMilli()
+}
+
+// requireDeviceOrToken authenticates the caller by API token or, without
+// one, by device ticket and session, writing a 401 on failure. Read-only
+// credentials are accepted.
+func (h *Handler) requireDeviceOrToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if t, err := h.verifyAPIToken(r); !errors.Is(err, errMissingAPIToken) {
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Invalid API token")
+			return "", false
+		}
+		return t.DeviceID, true
+	}
+
 	deviceID, err := h.verifyDeviceTicket(r)
 	if err != nil {
-		if errors.Is(err, errMissingDeviceTicket) {
-			writeError(w, http.StatusUnauthorized, "MISSING_DEVICE_TICKET", "Device ticket required")
-			return
+		writeError(w, http.StatusUnauthorized, "INVALID_DEVICE_TICKET", "Invalid device ticket")
+		return "", false
+	}
+	if _, err := h.verifySession(r, deviceID); err != nil {
+		if errors.Is(err, errMissingSession) {
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Session required")
+			return "", false
 		}
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid session")
+		return "", false
+	}
+	return deviceID, true
+}
+
+// handlePresence reports how many of the caller's devices are online. It
+// takes a device ticket and session or an API token.
+func (h *Handler) handlePresence(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := h.requireDeviceOrToken(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := h.deviceUser(deviceID)
+	if err != nil {
 		writeError(w, http.StatusUnauthorized, "INVALID_DEVICE_TICKET", "Invalid device ticket")
 		return
 	}
 
-	if _, err := h.store.GetDevice(deviceID); err != nil {
-		if errors.Is(err, store.ErrDeviceNotFound) {
+	writeSuccess(w, PresenceResponse{
+		Online:   h.hub.OnlineCountFor(userID),
+		Required: 2,
+	})
+}
+
+// wsAuth is who a WebSocket upgrade was authorised as.
+type wsAuth struct {
+	deviceID  string
+	sessionID string
+	readOnly  bool
+}
+
+// authWebSocket checks an upgrade's reconnect token or API token, or its
+// device ticket and session when it has neither, auditing and answering
+// failures itself.
+func (h *Handler) authWebSocket(w http.ResponseWriter, r *http.Request) (wsAuth, bool) {
+	if token := r.URL.Query().Get("reconnect"); token != "" {
+		a, err := h.verifyReconnect(r, token)
+		switch {
+		case err == nil:
+			return a, true
+		case errors.Is(err, errDeviceRevoked):
+			h.auditConn(r, nil, a.deviceID, store.ConnOutcomeAuthFailed, "not_enrolled")
 			writeError(w, http.StatusForbidden, "DEVICE_NOT_ENROLLED", "Device not enrolled")
-			return
+		case errors.Is(err, errDeviceDisabled):
+			h.auditConn(r, nil, a.deviceID, store.ConnOutcomeAuthFailed, "disabled")
+			writeError(w, http.StatusForbidden, "DEVICE_DISABLED", "Device is disabled")
+		case errors.Is(err, errInvalidReconnect):
+			h.auditConn(r, nil, a.deviceID, store.ConnOutcomeAuthFailed, "reconnect_token")
+			writeError(w, http.StatusUnauthorized, "INVALID_RECONNECT_TOKEN", "Reconnect token is invalid, used or expired")
+		default:
+			slog.ErrorContext(r.Context(), "Store error during WebSocket auth", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
 		}
-		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
-		return
+		return wsAuth{}, false
+	}
+
+	if t, err := h.verifyAPIToken(r); !errors.Is(err, errMissingAPIToken) {
+		switch {
+		case err == nil:
+			return wsAuth{deviceID: t.DeviceID, sessionID: apiTokenSession(t.ID), readOnly: t.Scope != auth.ScopeUser}, true
+		case errors.Is(err, errDeviceRevoked):
+			h.auditConn(r, nil, t.DeviceID, store.ConnOutcomeAuthFailed, "not_enrolled")
+			writeError(w, http.StatusForbidden, "DEVICE_NOT_ENROLLED", "Device not enrolled")
+		case errors.Is(err, errDeviceDisabled):
+			h.auditConn(r, nil, t.DeviceID, store.ConnOutcomeAuthFailed, "disabled")
+			writeError(w, http.StatusForbidden, "DEVICE_DISABLED", "Device is disabled")
+		default:
+			h.auditConn(r, nil, "", store.ConnOutcomeAuthFailed, "api_token")
+			writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Invalid API token")
+		}
+		return wsAuth{}, false
 	}
 
-	cookie, err := r.Cookie("ff_session")
+	deviceID, err := h.verifyDeviceTicket(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errMissingDeviceTicket):
+			h.auditConn(r, nil, "", store.ConnOutcomeAuthFailed, "device_ticket")
+			writeError(w, http.StatusUnauthorized, "MISSING_DEVICE_TICKET", "Device ticket required")
+		case errors.Is(err, errDeviceRevoked):
+			h.auditConn(r, nil, deviceID, store.ConnOutcomeAuthFailed, "not_enrolled")
+			writeError(w, http.StatusForbidden, "DEVICE_NOT_ENROLLED", "Device not enrolled")
+		case errors.Is(err, errDeviceDisabled):
+			h.auditConn(r, nil, deviceID, store.ConnOutcomeAuthFailed, "disabled")
+			writeError(w, http.StatusForbidden, "DEVICE_DISABLED", "Device is disabled")
+		case errors.Is(err, errTicketBinding):
+			h.auditConn(r, nil, deviceID, store.ConnOutcomeAuthFailed, "ticket_binding")
+			writeError(w, http.StatusUnauthorized, "INVALID_DEVICE_TICKET", "Invalid device ticket")
+		default:
+			h.auditConn(r, nil, "", store.ConnOutcomeAuthFailed, "device_ticket")
+			writeError(w, http.StatusUnauthorized, "INVALID_DEVICE_TICKET", "Invalid device ticket")
+		}
+		return wsAuth{}, false
+	}
+
+	claims, err := h.verifySession(r, deviceID)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Session required")
+		switch {
+		case errors.Is(err, errMissingSession):
+			h.auditConn(r, nil, deviceID, store.ConnOutcomeAuthFailed, "missing_session")
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Session required")
+		case errors.Is(err, errSessionDeviceMismatch):
+			h.auditConn(r, nil, deviceID, store.ConnOutcomeAuthFailed, "session_device_mismatch")
+			writeError(w, http.StatusUnauthorized, "SESSION_DEVICE_MISMATCH", "Session was issued to another device")
+		default:
+			h.auditConn(r, nil, deviceID, store.ConnOutcomeAuthFailed, "invalid_session")
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid session")
+		}
+		return wsAuth{}, false
+	}
+	return wsAuth{deviceID: deviceID, sessionID: claims.SID, readOnly: !claims.HasScope(auth.ScopeUser)}, true
+}
+
+func (h *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	a, ok := h.authWebSocket(w, r)
+	if !ok {
 		return
 	}
+	deviceID := a.deviceID
 
-	claims, err := h.tokenManager.VerifyWithVersion(cookie.Value, auth.TokenVersionSession)
+	userID, err := h.deviceUser(deviceID)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid session")
+		slog.ErrorContext(r.Context(), "Store error during WebSocket auth", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
 		return
 	}
+	room := r.URL.Query().Get("room")
+	if !realtime.ValidRoomID(room) {
+		writeError(w, http.StatusBadRequest, "INVALID_ROOM", "Room must be 1-64 letters, digits, '-' or '_'")
+		return
+	}
+	if room != "" && !h.flags.Enabled(feature.Rooms) {
+		writeError(w, http.StatusForbidden, "FEATURE_DISABLED", "Rooms are disabled on this server")
+		return
+	}
+	resumeToken := r.URL.Query().Get("resume")
+	var resumeSeq uint64
+	if resumeToken != "" {
+		resumeSeq, err = strconv.ParseUint(r.URL.Query().Get("last_seq"), 10, 64)
+		if err != nil || len(resumeToken) > realtime.MaxResumeTokenLen {
+			writeError(w, http.StatusBadRequest, "INVALID_RESUME", "resume needs a token of up to 64 characters and last_seq")
+			return
+		}
+	}
 
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		h.auditConn(r, nil, deviceID, store.ConnOutcomeUpgradeFailed, "")
+		slog.ErrorContext(r.Context(), "WebSocket upgrade failed", "err", err)
 		return
 	}
 
 	ip := getClientIP(r)
-	if h.connLimiter != nil && !h.connLimiter.Increment(ip) {
+	if h.upgrader.EnableCompression {
+		// Only takes effect if the client offered permessage-deflate. main
+		// validates the level, so an error here leaves the library default.
+		if err := conn.SetCompressionLevel(h.wsCompressLevel); err != nil {
+			slog.WarnContext(r.Context(), "Failed to set WebSocket compression level", "level", h.wsCompressLevel, "err", err)
+		}
+	}
+
+	// Outdated clients are refused after the upgrade so they can be told
+	// why; a browser cannot read the body of a failed handshake.
+	version := r.URL.Query().Get("client_version")
+	if h.minClient != "" && realtime.VersionBelow(version, h.minClient) {
+		h.auditConn(r, conn, deviceID, store.ConnOutcomeClientOutdated, version)
+		client := h.hub.NewClient(conn, deviceID, ip, nil, 20, h.maxWSMsgBytes)
+		client.Reject(h.updateEvent(realtime.EventUpdateRequired, version, h.minClient),
+			realtime.CloseClientOutdated, "client outdated")
+		return
+	}
+
+	// In onion mode the connection limit is per device, not per address.
+	connKey := h.LimitKey(r)
+	if h.connLimiter != nil && !h.connLimiter.Increment(connKey) {
+		h.auditConn(r, conn, deviceID, store.ConnOutcomeLimitRejected, "")
 		conn.Close()
-		log.Printf("Connection limit exceeded for %s", ip)
+		slog.WarnContext(r.Context(), "Connection limit exceeded", "ip", ip)
 		return
 	}
 
-	// Use Claims SID as DeviceID (now ClientID)
+	attemptID := h.auditConn(r, conn, deviceID, store.ConnOutcomeAccepted, "")
+
 	// Rate limit: 20 messages/second per client
-	client := realtime.NewClient(h.hub, conn, claims.SID, ip, h.connLimiter, 20, h.maxWSMsgBytes)
-	h.hub.Register(client)
+	client := h.hub.NewClient(conn, deviceID, connKey, h.connLimiter, 20, h.maxWSMsgBytes)
+	client.SessionID = a.sessionID
+	client.UserID = userID
+	client.Room = room
+	client.ResumeToken = resumeToken
+	client.ResumeSeq = resumeSeq
+	client.ReadOnly = a.readOnly
+	client.CompressMin = h.wsCompressMin
+	if n, err := strconv.Atoi(r.URL.Query().Get("max_chunk")); err == nil {
+		client.MaxChunk = realtime.ClampChunkSize(n)
+	}
+	client.Locale = wsLocale(r)
+	client.TimeZone = realtime.NormalizeTimeZone(r.URL.Query().Get("tz"))
+	client.Log = logging.Logger(r.Context())
+	if attemptID != 0 {
+		client.OnClose = func(code int) {
+			if err := h.store.CloseConnAttempt(attemptID, code, time.Now().UnixMilli()); err != nil {
+				slog.ErrorContext(r.Context(), "Failed to record connection close", "err", err)
+			}
+		}
+	}
+	if h.recommendClient != "" && realtime.VersionBelow(version, h.recommendClient) {
+		ev := h.updateEvent(realtime.EventUpdateRecommended, version, h.recommendClient)
+		if data, err := ev.Marshal(); err == nil {
+			client.Send(data)
+		}
+	}
+
+	h.hub.Attach(client)
+}
+
+// updateEvent builds an update_required or update_recommended event for a
+// client reporting version current.
+func (h *Handler) updateEvent(eventType, current, want string) *realtime.Event {
+	return realtime.NewEvent(eventType, realtime.UpdateValue{
+		Current: current,
+		Version: want,
+		URL:     h.updateURL,
+	})
+}
+
+// wsLocale is the locale a WebSocket client declared with ?locale=, or
+// else the first tag of its Accept-Language header.
+func wsLocale(r *http.Request) string {
+	if v := r.URL.Query().Get("locale"); v != "" {
+		return realtime.NormalizeLocale(v)
+	}
+	return realtime.NormalizeLocale(r.Header.Get("Accept-Language"))
+}
+
+// auditConn records a WebSocket upgrade attempt and returns its ID, or 0 if
+// it was not stored (or auditing is off). conn is nil when the upgrade
+// never happened.
+func (h *Handler) auditConn(r *http.Request, conn *websocket.Conn, deviceID, outcome, reason string) int64 {
+	if h.noConnAudit {
+		return 0
+	}
+	attempt := &store.ConnAttempt{
+		DeviceID:   deviceID,
+		Outcome:    outcome,
+		Reason:     reason,
+		IP:         getClientIP(r),
+		UserAgent:  r.UserAgent(),
+		Origin:     r.Header.Get("Origin"),
+		Extensions: r.Header.Get("Sec-WebSocket-Extensions"),
+		Locale:     wsLocale(r),
+		TimeZone:   realtime.NormalizeTimeZone(r.URL.Query().Get("tz")),
+		CreatedAt:  time.Now().UnixMilli(),
+	}
+	if conn != nil {
+		attempt.Subprotocol = conn.Subprotocol()
+	}
+	if r.TLS != nil {
+		attempt.TLSVersion = tls.VersionName(r.TLS.Version)
+		attempt.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
 
-	go client.WritePump()
-	go client.ReadPump()
+	id, err := h.store.RecordConnAttempt(attempt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record connection attempt", "err", err)
+		return 0
+	}
+	return id
 }
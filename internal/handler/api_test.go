@@ -2,25 +2,42 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/cbor"
+	"github.com/lixiansheng/fileflow/internal/certpin"
+	"github.com/lixiansheng/fileflow/internal/feature"
+	"github.com/lixiansheng/fileflow/internal/lifecycle"
 	"github.com/lixiansheng/fileflow/internal/limit"
+	"github.com/lixiansheng/fileflow/internal/logging"
 	"github.com/lixiansheng/fileflow/internal/realtime"
 	"github.com/lixiansheng/fileflow/internal/store"
+	"github.com/lixiansheng/fileflow/internal/wake"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/time/rate"
 )
 
@@ -36,25 +53,32 @@ func setupTestHandler(t *testing.T) (*Handler, func()) {
 	}
 
 	secretHash, _ := auth.HashSecret("test-secret")
+	adminHash, _ := auth.HashSecret("test-admin-secret")
 	tokenManager := auth.NewTokenManager([]byte("test-key"))
+	tokenManager.SetRevoker(s)
 	loginLimiter := limit.NewIPLimiter(rate.Inf, 1000)
 	connLimiter := limit.NewConnLimiter(5, 100)
 	challengeStore := auth.NewChallengeStore(500 * time.Millisecond)
 	hub := realtime.NewHub()
+	hub.SetPeerPolicy(s)
 	go hub.Run()
+	totpCipher, _ := auth.NewSeedCipher([]byte("test-key"))
 
 	h := New(Config{
-		Store:          s,
-		TokenManager:   tokenManager,
-		LoginLimiter:   loginLimiter,
-		ConnLimiter:    connLimiter,
-		SecretHash:     secretHash,
-		ChallengeStore: challengeStore,
-		Hub:            hub,
-		SecureCookies:  false,
-		SessionTTL:     time.Hour,
-		AllowedOrigin:  "",
-		BootstrapToken: "test-bootstrap-token",
+		Store:           s,
+		TokenManager:    tokenManager,
+		LoginLimiter:    loginLimiter,
+		ConnLimiter:     connLimiter,
+		SecretHash:      secretHash,
+		ChallengeStore:  challengeStore,
+		Hub:             hub,
+		SecureCookies:   false,
+		SessionTTL:      time.Hour,
+		BootstrapToken:  "test-bootstrap-token",
+		AdminSecretHash: adminHash,
+		WebAuthnRPID:    "fileflow.test",
+		WebAuthnOrigin:  "https://fileflow.test",
+		TOTPCipher:      totpCipher,
 	})
 
 	cleanup := func() {
@@ -67,9 +91,45 @@ func setupTestHandler(t *testing.T) (*Handler, func()) {
 }
 
 type testDevice struct {
-	id   string
-	jwk  map[string]interface{}
-	priv *ecdsa.PrivateKey
+	id     string
+	jwk    map[string]interface{}
+	priv   *ecdsa.PrivateKey
+	edPriv ed25519.PrivateKey
+}
+
+func newTestEd25519Device(t *testing.T) testDevice {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	jwk := &auth.ECPublicJWK{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(pub),
+	}
+	deviceID, err := auth.DeviceIDFromJWK(jwk)
+	if err != nil {
+		t.Fatalf("Failed to compute device ID: %v", err)
+	}
+
+	jwkMap := map[string]interface{}{
+		"kty": jwk.Kty,
+		"crv": jwk.Crv,
+		"x":   jwk.X,
+	}
+	return testDevice{id: deviceID, jwk: jwkMap, edPriv: priv}
+}
+
+// sign signs a challenge nonce with whichever key type the device holds.
+func (d testDevice) sign(t *testing.T, nonce []byte) string {
+	t.Helper()
+	if d.edPriv != nil {
+		return base64.RawURLEncoding.EncodeToString(ed25519.Sign(d.edPriv, nonce))
+	}
+	return signNonce(t, d.priv, nonce)
 }
 
 func newTestDevice(t *testing.T) testDevice {
@@ -176,7 +236,7 @@ func issueDeviceTicket(t *testing.T, h *Handler, device testDevice) string {
 		t.Fatalf("Failed to decode challenge response: %v", err)
 	}
 
-	sig := signNonce(t, device.priv, decodeB64URL(t, chResp.Nonce))
+	sig := device.sign(t, decodeB64URL(t, chResp.Nonce))
 
 	attestBody, _ := json.Marshal(map[string]string{
 		"challenge_id": chResp.ChallengeID,
@@ -222,6 +282,338 @@ func TestHealthz(t *testing.T) {
 	}
 }
 
+func TestVersion(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+	h.build = BuildInfo{Version: "1.2.3", Commit: "abc123"}
+
+	get := func(admin bool) VersionResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/version", nil)
+		if admin {
+			setAdmin(h, req)
+		}
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		var resp VersionResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return resp
+	}
+
+	pub := get(false)
+	if pub.Version != "1.2.3" || pub.Protocol != realtime.ProtocolVersion {
+		t.Fatalf("unexpected public response: %+v", pub)
+	}
+	if pub.Build != nil {
+		t.Fatalf("build details leaked without admin: %+v", pub.Build)
+	}
+
+	adm := get(true)
+	if adm.Build == nil || adm.Build.Commit != "abc123" || adm.Build.GoVersion == "" {
+		t.Fatalf("expected build details for admin, got %+v", adm.Build)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/version", nil)
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want 405", rec.Code)
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(&buf, "json", logging.NewLevels(slog.LevelInfo)))
+	routes := Chain(h.Routes(), RequestIDMiddleware, LoggingMiddleware)
+
+	do := func(requestID string) (*httptest.ResponseRecorder, map[string]any) {
+		t.Helper()
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/api/tokens", nil)
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		var access map[string]any
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			var m map[string]any
+			if json.Unmarshal(line, &m) == nil && m["msg"] == "request" {
+				access = m
+			}
+		}
+		if access == nil {
+			t.Fatalf("no access log record in %q", buf.String())
+		}
+		return rec, access
+	}
+
+	rec, access := do("edge-7f3a")
+	if got := rec.Header().Get("X-Request-ID"); got != "edge-7f3a" {
+		t.Errorf("X-Request-ID = %q, want the client's", got)
+	}
+	// The ticket names the device even though the missing session fails
+	// the request.
+	if access["request_id"] != "edge-7f3a" || access["device_id"] != device.id ||
+		access["route"] != "/api/tokens" || access["status"] != float64(http.StatusUnauthorized) || access["duration"] == nil {
+		t.Errorf("access record = %v", access)
+	}
+
+	for _, bad := range []string{"", "has space", strings.Repeat("a", 129), "line\nbreak"} {
+		rec, access := do(bad)
+		id := rec.Header().Get("X-Request-ID")
+		if _, err := uuid.Parse(id); err != nil || access["request_id"] != id {
+			t.Errorf("X-Request-ID %q: got %q, logged %v; want a generated UUID", bad, id, access["request_id"])
+		}
+	}
+}
+
+func TestWellKnown(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/fileflow.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var resp WellKnownResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.APIBase != "/api/v1" || resp.WebSocket != "/ws" || resp.Protocol != realtime.ProtocolVersion {
+		t.Errorf("resp = %+v", resp)
+	}
+	if resp.Limits.ChunkBytes != realtime.MaxChunkSize || resp.Limits.MaxMessageBytes != h.maxWSMsgBytes {
+		t.Errorf("limits = %+v", resp.Limits)
+	}
+	if slices.Contains(resp.Features, "oidc") || !slices.Contains(resp.Features, "settings_sync") {
+		t.Errorf("features = %v", resp.Features)
+	}
+
+	// The advertised paths answer.
+	for _, path := range []string{resp.APIBase + "/version", resp.OpenAPI} {
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s = %d", path, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/.well-known/fileflow.json", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d", rec.Code)
+	}
+}
+
+func TestAPIVersions(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	unversioned, v1 := get("/api/version"), get("/api/v1/version")
+	if v1.Code != http.StatusOK || v1.Body.String() != unversioned.Body.String() {
+		t.Errorf("/api/v1/version = %d %s, want %s", v1.Code, v1.Body.String(), unversioned.Body.String())
+	}
+	for _, rec := range []*httptest.ResponseRecorder{unversioned, v1} {
+		if got := rec.Header().Get(apiVersionHeader); got != "1" {
+			t.Errorf("%s = %q, want 1", apiVersionHeader, got)
+		}
+	}
+
+	// Unknown API paths answer in the API's error format, not with the
+	// static file server's.
+	for _, path := range []string{"/api/nope", "/api/v1/nope", "/api/v2/version"} {
+		rec := get(path)
+		var resp APIResponse
+		if rec.Code != http.StatusNotFound || json.Unmarshal(rec.Body.Bytes(), &resp) != nil || resp.Error == nil || resp.Error.Code != "NOT_FOUND" {
+			t.Errorf("%s = %d %s, want a JSON 404", path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	for _, tc := range []struct{ method, path, allow string }{
+		{http.MethodPost, "/api/version", "GET"},
+		{http.MethodPut, "/api/admin/devices", "GET, POST"},
+		{http.MethodPost, "/api/v1/admin/devices/x/wake", "GET, PUT, DELETE"},
+		{http.MethodPost, "/healthz", "GET"},
+	} {
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s = %d, want 405", tc.method, tc.path, rec.Code)
+			continue
+		}
+		if got := rec.Header().Get("Allow"); got != tc.allow {
+			t.Errorf("%s %s Allow = %q, want %q", tc.method, tc.path, got, tc.allow)
+		}
+		var resp APIResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error == nil || resp.Error.Code != "METHOD_NOT_ALLOWED" {
+			t.Errorf("%s %s body = %s", tc.method, tc.path, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /api/nope = %d, want 404", rec.Code)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var spec struct {
+		OpenAPI    string                    `json:"openapi"`
+		Paths      map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if spec.OpenAPI != "3.0.3" {
+		t.Errorf("openapi = %q", spec.OpenAPI)
+	}
+	for _, name := range []string{"LoginRequest", "DeviceListResponse", "EnrolledDevice", "ConnAttempt", "APIResponse"} {
+		if spec.Components.Schemas[name] == nil {
+			t.Errorf("schema %s missing", name)
+		}
+	}
+
+	// Every route registered in Routes is documented.
+	src, err := os.ReadFile("api.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range regexp.MustCompile(`mux\.HandleFunc\("(?:([A-Z]+) )?([^"]+)"`).FindAllStringSubmatch(string(src), -1) {
+		method, route := strings.ToLower(m[1]), m[2]
+		if route == "/api/docs" {
+			continue
+		}
+		item, ok := spec.Paths[route]
+		if !ok {
+			t.Errorf("route %s is not in the OpenAPI document", route)
+			continue
+		}
+		if _, ok := item[method]; method != "" && !ok {
+			t.Errorf("route %s %s is not in the OpenAPI document", m[1], route)
+		}
+	}
+
+	// Every documented operation is routed with that method.
+	for path, item := range spec.Paths {
+		for method := range item {
+			target := strings.ReplaceAll(strings.ReplaceAll(path, "{id}", "x"), "{", "")
+			req := httptest.NewRequest(strings.ToUpper(method), target, strings.NewReader("{}"))
+			rec := httptest.NewRecorder()
+			h.Routes().ServeHTTP(rec, req)
+			if rec.Code == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: method not allowed", method, path)
+			}
+			if rec.Code == http.StatusNotFound {
+				var resp APIResponse
+				if json.Unmarshal(rec.Body.Bytes(), &resp) != nil || resp.Error == nil || resp.Error.Code == "NOT_FOUND" {
+					t.Errorf("%s %s: not routed", method, path)
+				}
+			}
+		}
+	}
+
+	// Swagger UI is opt-in.
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/docs", nil))
+	if rec.Code == http.StatusOK {
+		t.Error("/api/docs served without APIDocs")
+	}
+	h.apiDocs = true
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/docs", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "/api/openapi.json") {
+		t.Errorf("/api/docs: %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Security-Policy") == "" {
+		t.Error("/api/docs: expected a Content-Security-Policy header")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	ready := func() (int, ReadyResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		var resp ReadyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	deadline := time.Now().Add(time.Second)
+	code, resp := ready()
+	for code != http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		code, resp = ready()
+	}
+	if code != http.StatusOK || !resp.OK || !resp.Store.OK || !resp.Hub.OK || resp.Hub.LastHeartbeat == 0 {
+		t.Fatalf("Expected a ready server, got %d %+v", code, resp)
+	}
+
+	// Another connection holding the write lock makes the store not ready.
+	conn, err := h.store.DB().Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open connection: %v", err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("Failed to lock database: %v", err)
+	}
+	code, resp = ready()
+	conn.ExecContext(context.Background(), "ROLLBACK")
+	conn.Close()
+	if code != http.StatusServiceUnavailable || resp.Store.OK || !resp.Hub.OK {
+		t.Errorf("Expected 503 with a locked store, got %d %+v", code, resp)
+	}
+
+	running := h.hub
+	h.hub = realtime.NewHub()
+	defer func() { h.hub = running }()
+	if code, resp := ready(); code != http.StatusServiceUnavailable || resp.Hub.OK || !resp.Store.OK {
+		t.Errorf("Expected 503 with a stopped hub, got %d %+v", code, resp)
+	}
+}
+
 func TestLoginEndpoint(t *testing.T) {
 	h, cleanup := setupTestHandler(t)
 	defer cleanup()
@@ -289,7 +681,7 @@ func TestLoginEndpoint(t *testing.T) {
 	})
 
 	t.Run("UnenrolledDevice", func(t *testing.T) {
-		ticket, _ := h.tokenManager.Sign("unenrolled-123", auth.TokenVersionDeviceTicket, time.Minute)
+		ticket, _ := h.tokenManager.Sign("unenrolled-123", auth.TokenVersionDeviceTicket, "", time.Minute)
 		body := `{"secret":"test-secret", "device_id":"unenrolled-123"}`
 		req := httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewBufferString(body))
 		req.Header.Set("Content-Type", "application/json")
@@ -375,7 +767,7 @@ func TestLoginEndpoint(t *testing.T) {
 	t.Run("ExpiredDeviceTicket", func(t *testing.T) {
 		device := newTestDevice(t)
 		enrollTestDevice(t, h, device)
-		expired, _ := h.tokenManager.Sign(device.id, auth.TokenVersionDeviceTicket, -time.Minute)
+		expired, _ := h.tokenManager.Sign(device.id, auth.TokenVersionDeviceTicket, "", -time.Minute)
 
 		body := `{"secret":"test-secret", "device_id":"` + device.id + `"}`
 		req := httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewBufferString(body))
@@ -402,6 +794,181 @@ func TestLoginEndpoint(t *testing.T) {
 	})
 }
 
+func TestLoginSecrets(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	login := func(secret, scope string) (AuthedResponse, string) {
+		device := newTestDevice(t)
+		enrollTestDevice(t, h, device)
+		ticket := issueDeviceTicket(t, h, device)
+
+		body := `{"secret":"` + secret + `", "device_id":"` + device.id + `", "scope":"` + scope + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewBufferString(body))
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+
+		var resp AuthedResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "ff_session" {
+				claims, err := h.tokenManager.Verify(c.Value)
+				if err != nil {
+					t.Fatalf("Verify session: %v", err)
+				}
+				return resp, claims.Scope
+			}
+		}
+		return resp, ""
+	}
+
+	rec := postJSON(h, "/api/admin/secrets", LoginSecretCreateRequest{Name: "drop-only", Secret: "kiosk-secret", Scope: auth.ScopeReadOnly}, true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for name, req := range map[string]LoginSecretCreateRequest{
+		"INVALID_SECRET_NAME": {Name: "Drop Only", Secret: "kiosk-secret", Scope: auth.ScopeReadOnly},
+		"INVALID_SCOPE":       {Name: "admin", Secret: "kiosk-secret", Scope: auth.ScopeAdmin},
+		"WEAK_SECRET":         {Name: "short", Secret: "short", Scope: auth.ScopeUser},
+		"UNKNOWN_USER":        {UserID: "u-nobody", Name: "kiosk", Secret: "kiosk-secret", Scope: auth.ScopeUser},
+		"SECRET_EXISTS":       {Name: "drop-only", Secret: "other-secret", Scope: auth.ScopeUser},
+	} {
+		if rec := postJSON(h, "/api/admin/secrets", req, true); !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("%+v: got %d %s, want %s", req, rec.Code, rec.Body.String(), name)
+		}
+	}
+
+	// The named secret starts a readonly session whatever was asked for;
+	// the main secret still grants what the client asks.
+	for _, tc := range []struct{ secret, scope, want string }{
+		{"kiosk-secret", "", auth.ScopeReadOnly},
+		{"kiosk-secret", auth.ScopeUser, auth.ScopeReadOnly},
+		{"test-secret", "", auth.ScopeUser},
+		{"test-secret", auth.ScopeReadOnly, auth.ScopeReadOnly},
+	} {
+		resp, scope := login(tc.secret, tc.scope)
+		if !resp.Authed || resp.Scope != tc.want || scope != tc.want {
+			t.Errorf("login %s asking %q: %+v, session scope %q; want %s", tc.secret, tc.scope, resp, scope, tc.want)
+		}
+	}
+	if resp, _ := login("wrong-secret", ""); resp.Authed {
+		t.Error("Expected a wrong secret to fail")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/secrets", nil)
+	setAdmin(h, req)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	var list LoginSecretListResponse
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list.Secrets) != 1 || list.Secrets[0].Name != "drop-only" || list.Secrets[0].Scope != auth.ScopeReadOnly ||
+		strings.Contains(rec.Body.String(), "argon2") {
+		t.Errorf("list = %s", rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/admin/secrets/drop-only", nil)
+	setAdmin(h, req)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp, _ := login("kiosk-secret", ""); resp.Authed {
+		t.Error("Expected a deleted secret to fail")
+	}
+}
+
+func TestLoginRehashesWeakSecret(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	weak, err := auth.HashSecretParams("test-secret", auth.ArgonParams{Time: 1, Memory: 8 * 1024, Threads: 1})
+	if err != nil {
+		t.Fatalf("HashSecretParams failed: %v", err)
+	}
+	h.secretHash = weak
+	h.argonParams = auth.ArgonParams{Time: 2, Memory: 8 * 1024, Threads: 1}
+	h.rehashSecret = true
+
+	login := func(secret string) bool {
+		device := newTestDevice(t)
+		enrollTestDevice(t, h, device)
+		ticket := issueDeviceTicket(t, h, device)
+
+		body := `{"secret":"` + secret + `", "device_id":"` + device.id + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+
+		var resp AuthedResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp.Authed
+	}
+
+	if login("wrong-secret") {
+		t.Fatal("Expected wrong secret to fail")
+	}
+	if h.currentSecretHash() != weak {
+		t.Fatal("Failed login should not re-hash")
+	}
+
+	if !login("test-secret") {
+		t.Fatal("Expected login to succeed")
+	}
+	upgraded := h.currentSecretHash()
+	if upgraded == weak || auth.NeedsRehash(upgraded, h.argonParams) {
+		t.Errorf("Expected hash upgraded to current params, got %q", upgraded)
+	}
+	stored, err := h.store.GetConfig(store.ConfigKeySecretHash)
+	if err != nil || stored != upgraded {
+		t.Errorf("Expected upgraded hash in store, got %q (%v)", stored, err)
+	}
+
+	if !login("test-secret") {
+		t.Error("Expected login to succeed with upgraded hash")
+	}
+}
+
+func TestLoginMigratesBcryptSecret(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("test-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword failed: %v", err)
+	}
+	h.secretHash = string(legacy)
+	h.rehashSecret = true
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	body := `{"secret":"test-secret", "device_id":"` + device.id + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+
+	var resp AuthedResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if !resp.Authed {
+		t.Fatalf("Expected bcrypt login to succeed: %s", rec.Body.String())
+	}
+
+	stored, err := h.store.GetConfig(store.ConfigKeySecretHash)
+	if err != nil || !strings.HasPrefix(stored, "$argon2id$") {
+		t.Errorf("Expected argon2id hash in store, got %q (%v)", stored, err)
+	}
+	if err := auth.VerifySecret("test-secret", stored); err != nil {
+		t.Errorf("Upgraded hash should verify: %v", err)
+	}
+}
+
 func TestAdminDevices(t *testing.T) {
 	h, cleanup := setupTestHandler(t)
 	defer cleanup()
@@ -434,7 +1001,7 @@ func TestAdminDevices(t *testing.T) {
 		})
 		req := httptest.NewRequest(http.MethodPost, "/api/admin/devices", bytes.NewBuffer(bodyBytes))
 		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("X-Admin-Bootstrap", "test-bootstrap-token")
+		setAdmin(h, req)
 		rec := httptest.NewRecorder()
 
 		h.Routes().ServeHTTP(rec, req)
@@ -442,7 +1009,7 @@ func TestAdminDevices(t *testing.T) {
 		// Try to register the same device again
 		req = httptest.NewRequest(http.MethodPost, "/api/admin/devices", bytes.NewBuffer(bodyBytes))
 		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("X-Admin-Bootstrap", "test-bootstrap-token")
+		setAdmin(h, req)
 		rec = httptest.NewRecorder()
 
 		h.Routes().ServeHTTP(rec, req)
@@ -470,26 +1037,341 @@ func TestAdminDevices(t *testing.T) {
 			t.Errorf("Expected status 401, got %d", rec.Code)
 		}
 	})
-}
-
-func TestDeviceChallengeAttest(t *testing.T) {
-	h, cleanup := setupTestHandler(t)
-	defer cleanup()
 
-	t.Run("UnenrolledDeviceChallenge", func(t *testing.T) {
+	t.Run("BootstrapClosed", func(t *testing.T) {
+		// A device is enrolled, so the bootstrap token no longer works.
 		device := newTestDevice(t)
 		bodyBytes, _ := json.Marshal(map[string]interface{}{
 			"device_id": device.id,
 			"pub_jwk":   device.jwk,
 		})
-		req := httptest.NewRequest(http.MethodPost, "/api/device/challenge", bytes.NewBuffer(bodyBytes))
-		req.Header.Set("Content-Type", "application/json")
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/devices", bytes.NewBuffer(bodyBytes))
+		req.Header.Set("X-Admin-Bootstrap", "test-bootstrap-token")
 		rec := httptest.NewRecorder()
 
 		h.Routes().ServeHTTP(rec, req)
 
 		if rec.Code != http.StatusForbidden {
-			t.Errorf("Expected status 403, got %d", rec.Code)
+			t.Errorf("Expected status 403, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestAdminLogin(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	listDevices := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/devices", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	rec := postJSON(h, "/api/admin/login", map[string]string{"secret": "test-secret"}, false)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Device secret should not log in as admin, got %d", rec.Code)
+	}
+
+	rec = postJSON(h, "/api/admin/login", map[string]string{"secret": "test-admin-secret"}, false)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Admin login failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var resp AdminTokenResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.ExpiresAt <= time.Now().UnixMilli() {
+		t.Errorf("expires_at should be in the future, got %d", resp.ExpiresAt)
+	}
+	if code := listDevices(resp.Token); code != http.StatusOK {
+		t.Fatalf("Admin token rejected: %d", code)
+	}
+
+	// The bootstrap header only covers enrollment, never the rest of the API.
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/devices", nil)
+	req.Header.Set("X-Admin-Bootstrap", "test-bootstrap-token")
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Bootstrap header should not list devices, got %d", rec.Code)
+	}
+
+	// A device session token is not an admin token.
+	deviceToken, _ := h.tokenManager.Sign(uuid.NewString(), auth.TokenVersionSession, auth.ScopeUser, time.Hour)
+	if code := listDevices(deviceToken); code != http.StatusUnauthorized {
+		t.Errorf("Device session token should be rejected, got %d", code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/admin/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.Token)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Admin logout failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if code := listDevices(resp.Token); code != http.StatusUnauthorized {
+		t.Errorf("Revoked admin token should be rejected, got %d", code)
+	}
+}
+
+func TestSignedAdminRequests(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+	h.adminNonces = auth.NewNonceCache()
+	defer h.adminNonces.Stop()
+
+	rec := postJSON(h, "/api/admin/login", map[string]string{"secret": "test-admin-secret"}, false)
+	var login AdminTokenResponse
+	json.Unmarshal(rec.Body.Bytes(), &login)
+	key, err := base64.RawURLEncoding.DecodeString(login.SigningKey)
+	if err != nil || len(key) == 0 {
+		t.Fatalf("Admin login should return a signing key, got %q", login.SigningKey)
+	}
+
+	type signed struct{ ts, nonce, sig string }
+	sign := func(method, path, body string, at time.Time) signed {
+		s := signed{ts: strconv.FormatInt(at.Unix(), 10), nonce: uuid.NewString()}
+		s.sig, _ = auth.SignRequest(key, method, path, s.ts, s.nonce, []byte(body))
+		return s
+	}
+	do := func(method, path, body string, s signed) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+login.Token)
+		if s.sig != "" {
+			req.Header.Set("X-Admin-Timestamp", s.ts)
+			req.Header.Set("X-Admin-Nonce", s.nonce)
+			req.Header.Set("X-Admin-Signature", s.sig)
+		}
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	expectCode := func(rec *httptest.ResponseRecorder, code string) {
+		t.Helper()
+		var resp APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusUnauthorized || resp.Error == nil || resp.Error.Code != code {
+			t.Errorf("Expected 401 %s, got %d %s", code, rec.Code, rec.Body.String())
+		}
+	}
+
+	if rec := do(http.MethodGet, "/api/admin/users", "", signed{}); rec.Code != http.StatusOK {
+		t.Errorf("Reads should not need a signature, got %d", rec.Code)
+	}
+
+	const path = "/api/admin/users"
+	expectCode(do(http.MethodPost, path, `{"name":"bob","secret":"bob-secret"}`, signed{}), "SIGNATURE_REQUIRED")
+
+	// The signature covers the canonical body, so key order and whitespace
+	// on the wire do not matter.
+	s := sign(http.MethodPost, path, `{"name":"bob","secret":"bob-secret"}`, time.Now())
+	body := `{ "secret": "bob-secret", "name": "bob" }`
+	if rec := do(http.MethodPost, path, body, s); rec.Code != http.StatusOK {
+		t.Fatalf("Signed request failed: %d %s", rec.Code, rec.Body.String())
+	}
+	expectCode(do(http.MethodPost, path, body, s), "REPLAYED_REQUEST")
+
+	s = sign(http.MethodPost, path, `{"name":"carol","secret":"carol-secret"}`, time.Now())
+	expectCode(do(http.MethodPost, path, `{"name":"mallory","secret":"carol-secret"}`, s), "INVALID_SIGNATURE")
+	// A forged request must not use up the nonce it copied.
+	if rec := do(http.MethodPost, path, `{"name":"carol","secret":"carol-secret"}`, s); rec.Code != http.StatusOK {
+		t.Errorf("Nonce should survive a failed signature, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Under a versioned mount the signature covers the path the client
+	// sent, not the one the handler is routed at.
+	const v1Path = "/api/v1/admin/users"
+	s = sign(http.MethodPost, v1Path, `{"name":"frank","secret":"frank-secret"}`, time.Now())
+	if rec := do(http.MethodPost, v1Path, `{"name":"frank","secret":"frank-secret"}`, s); rec.Code != http.StatusOK {
+		t.Errorf("Signed v1 request failed: %d %s", rec.Code, rec.Body.String())
+	}
+	s = sign(http.MethodPost, path, `{"name":"grace","secret":"grace-secret"}`, time.Now())
+	expectCode(do(http.MethodPost, v1Path, `{"name":"grace","secret":"grace-secret"}`, s), "INVALID_SIGNATURE")
+
+	s = sign(http.MethodPost, path, `{"name":"dave","secret":"dave-secret"}`, time.Now().Add(-10*time.Minute))
+	expectCode(do(http.MethodPost, path, `{"name":"dave","secret":"dave-secret"}`, s), "STALE_REQUEST")
+
+	// A key from one admin session does not sign for another.
+	other, _ := h.tokenManager.Sign(uuid.NewString(), auth.TokenVersionAdmin, auth.ScopeAdmin, time.Hour)
+	s = sign(http.MethodPost, path, `{"name":"erin","secret":"erin-secret"}`, time.Now())
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(`{"name":"erin","secret":"erin-secret"}`))
+	req.Header.Set("Authorization", "Bearer "+other)
+	req.Header.Set("X-Admin-Timestamp", s.ts)
+	req.Header.Set("X-Admin-Nonce", s.nonce)
+	req.Header.Set("X-Admin-Signature", s.sig)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	expectCode(rec, "INVALID_SIGNATURE")
+}
+
+func TestScopedTokens(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	// A version-1 session signed before scopes existed reports the
+	// version's default, as every authorization check treats it.
+	t.Run("UnscopedSession", func(t *testing.T) {
+		token, _ := h.tokenManager.SignSession("unscoped-sid", device.id, "", time.Hour)
+		claims, err := h.tokenManager.VerifyWithVersion(token, auth.TokenVersionSession)
+		if err != nil || claims.Scope != "" {
+			t.Fatalf("Expected a session without a scope claim, got %+v, %v", claims, err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: token})
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+
+		var resp AuthedResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if !resp.Authed || resp.Scope != auth.ScopeUser {
+			t.Errorf("Expected authed with user scope, got %+v", resp)
+		}
+	})
+
+	t.Run("ReadOnlyAdmin", func(t *testing.T) {
+		rec := postJSON(h, "/api/admin/login", map[string]string{"secret": "test-admin-secret", "scope": "root"}, false)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Unknown scope should be rejected, got %d", rec.Code)
+		}
+
+		rec = postJSON(h, "/api/admin/login", map[string]string{"secret": "test-admin-secret", "scope": "readonly"}, false)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Admin login failed: %d %s", rec.Code, rec.Body.String())
+		}
+		var resp AdminTokenResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if resp.Scope != auth.ScopeReadOnly {
+			t.Errorf("Expected readonly scope, got %q", resp.Scope)
+		}
+
+		do := func(method, path, body string) int {
+			req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Bearer "+resp.Token)
+			rec := httptest.NewRecorder()
+			h.Routes().ServeHTTP(rec, req)
+			return rec.Code
+		}
+		for _, path := range []string{
+			"/api/admin/devices",
+			"/api/admin/users",
+			"/api/admin/trash",
+			"/api/admin/devices/" + device.id + "/commands",
+			"/api/admin/devices/" + device.id + "/peers",
+			"/api/admin/devices/" + device.id + "/wake",
+			"/api/admin/cert-reports",
+		} {
+			if code := do(http.MethodGet, path, ""); code != http.StatusOK {
+				t.Errorf("GET %s: expected 200, got %d", path, code)
+			}
+		}
+		for _, c := range []struct{ method, path, body string }{
+			{http.MethodPut, "/api/admin/devices/" + device.id + "/commands", `{"commands":["ring"]}`},
+			{http.MethodPut, "/api/admin/devices/" + device.id + "/state", `{"disabled":true}`},
+			{http.MethodPatch, "/api/admin/devices/" + device.id, `{"label":"renamed"}`},
+			{http.MethodPut, "/api/admin/devices/" + device.id + "/wake", `{"mac":"00:11:22:33:44:55"}`},
+			{http.MethodPost, "/api/admin/app-tokens", `{"name":"x","device_ids":["` + device.id + `"]}`},
+			{http.MethodDelete, "/api/admin/devices/" + device.id, ""},
+			{http.MethodPost, "/api/admin/users", `{"name":"eve","secret":"long-enough"}`},
+			{http.MethodPost, "/api/admin/devices", `{}`},
+		} {
+			if code := do(c.method, c.path, c.body); code != http.StatusForbidden {
+				t.Errorf("%s %s: expected 403, got %d", c.method, c.path, code)
+			}
+		}
+	})
+
+	t.Run("ReadOnlySession", func(t *testing.T) {
+		body := `{"secret":"test-secret", "device_id":"` + device.id + `", "scope":"readonly"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewBufferString(body))
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		var session *http.Cookie
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "ff_session" {
+				session = c
+			}
+		}
+		if session == nil {
+			t.Fatalf("Read-only login failed: %d %s", rec.Code, rec.Body.String())
+		}
+		claims, err := h.tokenManager.Verify(session.Value)
+		if err != nil || claims.EffectiveScope() != auth.ScopeReadOnly {
+			t.Fatalf("Expected a readonly session, got %+v (%v)", claims, err)
+		}
+
+		req = httptest.NewRequest(http.MethodPost, "/api/device/pairing-code", nil)
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		req.AddCookie(session)
+		rec = httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Read-only session should not issue pairing codes, got %d", rec.Code)
+		}
+	})
+}
+
+func TestAdminStats(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+	h.verifier = auth.NewVerifierPool(1, 2, time.Second)
+	defer h.verifier.Stop()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	body := `{"secret":"wrong-secret", "device_id":"` + device.id + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewBufferString(body))
+	req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/admin/stats", nil)
+	setAdmin(h, req)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stats AdminStatsResponse
+	json.NewDecoder(rec.Body).Decode(&stats)
+	v := stats.SecretVerifier
+	if v.Workers != 1 || v.QueueCap != 2 || v.Completed != 1 || v.Rejected != 0 {
+		t.Errorf("Unexpected verifier stats: %+v", v)
+	}
+	if stats.Realtime.OversizedFrames != 0 || stats.Realtime.Dropped != (DroppedStats{}) {
+		t.Errorf("Unexpected realtime stats: %+v", stats.Realtime)
+	}
+}
+
+func TestDeviceChallengeAttest(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	t.Run("UnenrolledDeviceChallenge", func(t *testing.T) {
+		device := newTestDevice(t)
+		bodyBytes, _ := json.Marshal(map[string]interface{}{
+			"device_id": device.id,
+			"pub_jwk":   device.jwk,
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/device/challenge", bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", rec.Code)
 		}
 	})
 
@@ -590,167 +1472,2893 @@ func TestDeviceChallengeAttest(t *testing.T) {
 		if atRec.Code != http.StatusUnauthorized {
 			t.Errorf("Expected status 401, got %d", atRec.Code)
 		}
+
+		// An unauthenticated caller must not be able to shorten the real
+		// device's tickets.
+		stats, err := h.store.GetAuthStats(device.id)
+		if err != nil {
+			t.Fatalf("GetAuthStats failed: %v", err)
+		}
+		if stats.Failures != 0 || stats.LastFailureAt != 0 {
+			t.Errorf("Expected no failure recorded against the device, got %+v", stats)
+		}
+		if ttl := h.ticketTTL(device.id); ttl != h.reputation.TicketTTL(0, time.Time{}, time.Now()) {
+			t.Errorf("Expected ticket TTL unaffected, got %v", ttl)
+		}
 	})
 }
 
-func TestSessionEndpoint(t *testing.T) {
+func TestTicketBinding(t *testing.T) {
 	h, cleanup := setupTestHandler(t)
 	defer cleanup()
 
-	sid := "test-sid"
-	validToken, _ := h.tokenManager.Sign(sid, auth.TokenVersionSession, time.Hour)
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	unbound := issueDeviceTicket(t, h, device)
 
-	t.Run("ValidSession", func(t *testing.T) {
+	// httptest requests come from 192.0.2.1.
+	h.ticketBinding = TicketBindSubnet
+	bound := issueDeviceTicket(t, h, device)
+
+	verifyFrom := func(ticket, addr string) error {
 		req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
-		req.AddCookie(&http.Cookie{Name: "ff_session", Value: validToken})
-		rec := httptest.NewRecorder()
+		req.RemoteAddr = addr
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		_, err := h.verifyDeviceTicket(req)
+		return err
+	}
 
-		h.Routes().ServeHTTP(rec, req)
+	tests := []struct {
+		name    string
+		mode    string
+		ticket  string
+		addr    string
+		wantErr error
+	}{
+		{"SameAddress", TicketBindSubnet, bound, "192.0.2.1:1234", nil},
+		{"SameSubnet", TicketBindSubnet, bound, "192.0.2.77:1234", nil},
+		{"OtherSubnet", TicketBindSubnet, bound, "198.51.100.1:1234", errTicketBinding},
+		{"ExactRejectsNeighbour", TicketBindIP, bound, "192.0.2.77:1234", errTicketBinding},
+		{"UnboundStillValid", TicketBindSubnet, unbound, "198.51.100.1:1234", nil},
+		{"BindingOff", "", bound, "198.51.100.1:1234", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.ticketBinding = tt.mode
+			if err := verifyFrom(tt.ticket, tt.addr); !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
 
-		if rec.Code != http.StatusOK {
-			t.Errorf("Expected status 200, got %d", rec.Code)
-		}
+func TestOnionMode(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
 
-		var resp map[string]bool
-		json.NewDecoder(rec.Body).Decode(&resp)
+	a, b := newTestDevice(t), newTestDevice(t)
+	enrollTestDevice(t, h, a)
+	enrollTestDevice(t, h, b)
+	ticketA, ticketB := issueDeviceTicket(t, h, a), issueDeviceTicket(t, h, b)
 
-		if !resp["authed"] {
-			t.Error("Expected authed: true")
+	serverInfo := func() ServerInfoResponse {
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/server-info", nil))
+		var info ServerInfoResponse
+		if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+			t.Fatal(err)
 		}
-	})
-
-	t.Run("InvalidSession", func(t *testing.T) {
+		return info
+	}
+	// Every request reaches an onion service from the local Tor daemon.
+	fromTor := func(ticket string) *http.Request {
 		req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
-		req.AddCookie(&http.Cookie{Name: "ff_session", Value: "invalid-token"})
-		rec := httptest.NewRecorder()
-
-		h.Routes().ServeHTTP(rec, req)
+		req.RemoteAddr = "127.0.0.1:40000"
+		if ticket != "" {
+			req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		}
+		return req
+	}
 
-		var resp map[string]bool
-		json.NewDecoder(rec.Body).Decode(&resp)
+	if info := serverInfo(); info.Mode != ServerModeStandard || info.LimitKey != LimitKeyIP || info.TicketBinding != "off" {
+		t.Errorf("standard server-info = %+v", info)
+	}
+	if got := h.LimitKey(fromTor(ticketA)); got != "127.0.0.1" {
+		t.Errorf("standard LimitKey = %q", got)
+	}
 
-		if resp["authed"] {
-			t.Error("Expected authed: false")
+	h.onion = true
+	if info := serverInfo(); info.Mode != ServerModeOnion || info.LimitKey != LimitKeyDevice {
+		t.Errorf("onion server-info = %+v", info)
+	}
+	for name, tc := range map[string]struct{ ticket, want string }{
+		"ticket":    {ticketA, "device:" + a.id},
+		"no ticket": {"", onionAnonymousKey},
+		"forged":    {"not-a-ticket", onionAnonymousKey},
+	} {
+		if got := h.LimitKey(fromTor(tc.ticket)); got != tc.want {
+			t.Errorf("%s: LimitKey = %q, want %q", name, got, tc.want)
 		}
-	})
+	}
 
-	t.Run("NoSession", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+	// Devices behind the same Tor daemon get a bucket each.
+	rl := NewRateLimiter(0.001, 1)
+	rl.SetKeyFunc(h.LimitKey)
+	limited := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, tc := range []struct {
+		ticket string
+		want   int
+	}{
+		{ticketA, http.StatusOK},
+		{ticketB, http.StatusOK},
+		{ticketA, http.StatusTooManyRequests},
+	} {
 		rec := httptest.NewRecorder()
-
-		h.Routes().ServeHTTP(rec, req)
-
-		var resp map[string]bool
-		json.NewDecoder(rec.Body).Decode(&resp)
-
-		if resp["authed"] {
-			t.Error("Expected authed: false")
+		limited.ServeHTTP(rec, fromTor(tc.ticket))
+		if rec.Code != tc.want {
+			t.Errorf("request %d: status %d, want %d", i, rec.Code, tc.want)
 		}
-	})
+	}
 }
 
-func TestPresenceEndpoint(t *testing.T) {
+func TestTransferReceipt(t *testing.T) {
 	h, cleanup := setupTestHandler(t)
 	defer cleanup()
 
-	t.Run("WithoutSession", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/api/presence", nil)
-		rec := httptest.NewRecorder()
+	a, b := newTestDevice(t), newTestDevice(t)
+	enrollTestDevice(t, h, a)
+	enrollTestDevice(t, h, b)
+	ticket := issueDeviceTicket(t, h, b)
+	session, _ := h.tokenManager.SignSession("test-sid", b.id, auth.ScopeUser, time.Hour)
 
+	get := func(id string) (*httptest.ResponseRecorder, TransferReceiptResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/transfers/"+id+"/receipt", nil)
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: session})
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
 		h.Routes().ServeHTTP(rec, req)
+		var resp TransferReceiptResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
 
-		if rec.Code != http.StatusUnauthorized {
-			t.Errorf("Expected status 401, got %d", rec.Code)
-		}
+	started := time.UnixMilli(1_000_000)
+	id, err := h.RecordReceipt(realtime.Receipt{
+		MsgID: "m1", From: a.id, To: b.id, File: true, Chunks: 4, Bytes: 1000,
+		SHA256: "ab", StartedAt: started, CommittedAt: started.Add(time.Second),
 	})
+	if err != nil {
+		t.Fatalf("RecordReceipt: %v", err)
+	}
 
-	t.Run("WithSession", func(t *testing.T) {
-		sid := "test-sid"
-		validToken, _ := h.tokenManager.Sign(sid, auth.TokenVersionSession, time.Hour)
+	if rec, _ := get(id); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "RECEIPTS_DISABLED") {
+		t.Errorf("disabled: status %d: %s", rec.Code, rec.Body.String())
+	}
 
-		req := httptest.NewRequest(http.MethodGet, "/api/presence", nil)
-		req.AddCookie(&http.Cookie{Name: "ff_session", Value: validToken})
-		rec := httptest.NewRecorder()
+	h.receipts = true
+	rec, resp := get(id)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	want := store.TransferReceipt{ID: id, MsgID: "m1", Sender: a.id, Receiver: b.id, File: true, Chunks: 4, Bytes: 1000,
+		SHA256: "ab", StartedAt: 1_000_000, CommittedAt: 1_001_000, Signature: resp.Receipt.Signature}
+	if !resp.Valid || resp.Receipt != want || resp.Receipt.Signature == "" {
+		t.Errorf("receipt = %+v, valid %v", resp.Receipt, resp.Valid)
+	}
 
-		h.Routes().ServeHTTP(rec, req)
+	// An edited receipt no longer matches its signature.
+	edited := resp.Receipt
+	edited.ID, edited.SHA256 = "edited", "cd"
+	h.store.PutTransferReceipt(&edited)
+	if rec, resp := get("edited"); rec.Code != http.StatusOK || resp.Valid {
+		t.Errorf("edited: status %d, valid %v", rec.Code, resp.Valid)
+	}
 
-		if rec.Code != http.StatusOK {
-			t.Errorf("Expected status 200, got %d", rec.Code)
+	// Another user's receipts look the same as missing ones.
+	other := resp.Receipt
+	other.ID, other.UserID = "other", "u-dave"
+	h.store.PutTransferReceipt(&other)
+	for _, id := range []string{"other", "missing"} {
+		if rec, _ := get(id); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "RECEIPT_NOT_FOUND") {
+			t.Errorf("%s: status %d: %s", id, rec.Code, rec.Body.String())
 		}
-	})
+	}
 }
 
-func TestWebSocketAuth(t *testing.T) {
+func TestChallengeLimits(t *testing.T) {
 	h, cleanup := setupTestHandler(t)
 	defer cleanup()
 
-	t.Run("MissingDeviceTicket", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
-		rec := httptest.NewRecorder()
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
 
-		h.Routes().ServeHTTP(rec, req)
+	var last *httptest.ResponseRecorder
+	challenge := func() int {
+		body, _ := json.Marshal(map[string]interface{}{
+			"device_id": device.id,
+			"pub_jwk":   device.jwk,
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/device/challenge", bytes.NewBuffer(body))
+		last = httptest.NewRecorder()
+		h.Routes().ServeHTTP(last, req)
+		return last.Code
+	}
 
-		if rec.Code != http.StatusUnauthorized {
-			t.Errorf("Expected status 401, got %d", rec.Code)
+	t.Run("OutstandingCap", func(t *testing.T) {
+		for i := 0; i < h.maxChallenges; i++ {
+			if code := challenge(); code != http.StatusOK {
+				t.Fatalf("Challenge %d: expected 200, got %d", i+1, code)
+			}
 		}
-
-		var resp APIResponse
-		json.NewDecoder(rec.Body).Decode(&resp)
-		if resp.Error == nil || resp.Error.Code != "MISSING_DEVICE_TICKET" {
-			t.Errorf("Expected MISSING_DEVICE_TICKET, got %#v", resp.Error)
+		if code := challenge(); code != http.StatusTooManyRequests {
+			t.Errorf("Expected 429 past the outstanding cap, got %d", code)
 		}
 	})
 
-	t.Run("ExpiredDeviceTicket", func(t *testing.T) {
-		device := newTestDevice(t)
-		enrollTestDevice(t, h, device)
-		expired, _ := h.tokenManager.Sign(device.id, auth.TokenVersionDeviceTicket, -time.Minute)
-
-		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
-		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: expired})
-		rec := httptest.NewRecorder()
-
-		h.Routes().ServeHTTP(rec, req)
+	t.Run("PerDeviceRate", func(t *testing.T) {
+		h.maxChallenges = 100
+		h.deviceLimiter = limit.NewDeviceLimiter(rate.Limit(0.001), 2)
+		for i := 0; i < 2; i++ {
+			if code := challenge(); code != http.StatusOK {
+				t.Fatalf("Challenge %d: expected 200, got %d", i+1, code)
+			}
+		}
+		if code := challenge(); code != http.StatusTooManyRequests {
+			t.Errorf("Expected 429 past the per-device rate, got %d", code)
+		}
+		// One token per 1000s, none left.
+		if got := last.Header().Get("Retry-After"); got != "1000" {
+			t.Errorf("Retry-After = %q, want 1000", got)
+		}
+		if got := last.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("X-RateLimit-Limit = %q, want 2", got)
+		}
 
-		if rec.Code != http.StatusUnauthorized {
-			t.Errorf("Expected status 401, got %d", rec.Code)
+		other := newTestDevice(t)
+		enrollTestDevice(t, h, other)
+		if ticket := issueDeviceTicket(t, h, other); ticket == "" {
+			t.Error("Another device should not be limited")
 		}
 	})
+}
 
-	t.Run("TamperedDeviceTicket", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
-		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: "bad-token"})
+func TestEd25519Device(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestEd25519Device(t)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"device_id": device.id,
+		"pub_jwk":   device.jwk,
+		"label":     "Ed25519 Device",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/devices", bytes.NewBuffer(body))
+	setAdmin(h, req)
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Enrollment failed: status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	if ticket := issueDeviceTicket(t, h, device); ticket == "" {
+		t.Fatal("Expected a device ticket")
+	}
+
+	t.Run("WrongKeySignature", func(t *testing.T) {
+		other := newTestEd25519Device(t)
+		other.id, other.jwk = device.id, device.jwk
+
+		challengeBody, _ := json.Marshal(map[string]interface{}{
+			"device_id": device.id,
+			"pub_jwk":   device.jwk,
+		})
+		chReq := httptest.NewRequest(http.MethodPost, "/api/device/challenge", bytes.NewBuffer(challengeBody))
+		chRec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(chRec, chReq)
+
+		var chResp ChallengeResponse
+		json.NewDecoder(chRec.Body).Decode(&chResp)
+
+		attestBody, _ := json.Marshal(map[string]string{
+			"challenge_id": chResp.ChallengeID,
+			"device_id":    device.id,
+			"signature":    other.sign(t, decodeB64URL(t, chResp.Nonce)),
+		})
+		atReq := httptest.NewRequest(http.MethodPost, "/api/device/attest", bytes.NewBuffer(attestBody))
+		atRec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(atRec, atReq)
+
+		if atRec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", atRec.Code)
+		}
+	})
+}
+
+// testAuthenticator is a software WebAuthn authenticator producing the
+// same structures a browser hands back from navigator.credentials.
+type testAuthenticator struct {
+	priv   *ecdsa.PrivateKey
+	credID []byte
+	count  uint32
+}
+
+func (a *testAuthenticator) authData(t *testing.T, attested bool) []byte {
+	t.Helper()
+
+	rpHash := sha256.Sum256([]byte("fileflow.test"))
+	b := append([]byte{}, rpHash[:]...)
+	flags := byte(0x01 | 0x04)
+	if attested {
+		flags |= 0x40
+	}
+	b = append(b, flags, byte(a.count>>24), byte(a.count>>16), byte(a.count>>8), byte(a.count))
+	if !attested {
+		return b
+	}
+
+	coseKey, err := cbor.Marshal(map[interface{}]interface{}{
+		int64(1):  int64(2),
+		int64(3):  int64(-7),
+		int64(-1): int64(1),
+		int64(-2): pad32(a.priv.PublicKey.X.Bytes()),
+		int64(-3): pad32(a.priv.PublicKey.Y.Bytes()),
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode COSE key: %v", err)
+	}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, byte(len(a.credID)>>8), byte(len(a.credID)))
+	b = append(b, a.credID...)
+	return append(b, coseKey...)
+}
+
+func webauthnClientData(typ, challenge, origin string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": origin})
+	return b
+}
+
+// setAdmin authorizes req with a fresh admin token, as if from
+// POST /api/admin/login.
+func setAdmin(h *Handler, req *http.Request) {
+	token, _ := h.tokenManager.Sign(uuid.NewString(), auth.TokenVersionAdmin, auth.ScopeAdmin, time.Hour)
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+func postJSON(h *Handler, path string, body interface{}, admin bool) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(b))
+	if admin {
+		setAdmin(h, req)
+	}
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWebAuthn(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	authn := &testAuthenticator{priv: priv, credID: []byte("test-credential")}
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	if rec := postJSON(h, "/api/webauthn/register/options", nil, false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without admin token, got %d", rec.Code)
+	}
+
+	rec := postJSON(h, "/api/webauthn/register/options", nil, true)
+	var regOpts WebAuthnRegisterOptionsResponse
+	json.NewDecoder(rec.Body).Decode(&regOpts)
+	if rec.Code != http.StatusOK || regOpts.RPID != "fileflow.test" {
+		t.Fatalf("Register options failed: status=%d rp_id=%q", rec.Code, regOpts.RPID)
+	}
+
+	attObj, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authn.authData(t, true),
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode attestation object: %v", err)
+	}
+	rec = postJSON(h, "/api/webauthn/register", map[string]string{
+		"challenge_id":       regOpts.ChallengeID,
+		"client_data_json":   b64(webauthnClientData("webauthn.create", regOpts.Challenge, "https://fileflow.test")),
+		"attestation_object": b64(attObj),
+		"label":              "Passkey",
+	}, true)
+	var registered WebAuthnRegisteredResponse
+	json.NewDecoder(rec.Body).Decode(&registered)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Register failed: status=%d", rec.Code)
+	}
+	if registered.CredentialID != b64(authn.credID) {
+		t.Errorf("Expected credential %q, got %q", b64(authn.credID), registered.CredentialID)
+	}
+
+	assert := func(t *testing.T, origin string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		rec := postJSON(h, "/api/webauthn/assert/options", map[string]string{"device_id": registered.DeviceID}, false)
+		var opts WebAuthnAssertOptionsResponse
+		json.NewDecoder(rec.Body).Decode(&opts)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Assert options failed: status=%d", rec.Code)
+		}
+
+		authData := authn.authData(t, false)
+		clientData := webauthnClientData("webauthn.get", opts.Challenge, origin)
+		clientHash := sha256.Sum256(clientData)
+		digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+		sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+
+		return postJSON(h, "/api/webauthn/assert", map[string]string{
+			"challenge_id":       opts.ChallengeID,
+			"device_id":          registered.DeviceID,
+			"credential_id":      opts.CredentialID,
+			"client_data_json":   b64(clientData),
+			"authenticator_data": b64(authData),
+			"signature":          b64(sig),
+		}, false)
+	}
+
+	t.Run("Assert", func(t *testing.T) {
+		authn.count = 5
+		rec := assert(t, "https://fileflow.test")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		found := false
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "device_ticket" && c.Value != "" {
+				found = true
+			}
+		}
+		if !found {
+			t.Error("Expected device_ticket cookie")
+		}
+	})
+
+	t.Run("CounterReplay", func(t *testing.T) {
+		rec := assert(t, "https://fileflow.test")
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+	})
+
+	t.Run("WrongOrigin", func(t *testing.T) {
+		authn.count = 6
+		rec := assert(t, "https://evil.test")
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+	})
+
+	t.Run("KeyOnlyDevice", func(t *testing.T) {
+		device := newTestDevice(t)
+		enrollTestDevice(t, h, device)
+		rec := postJSON(h, "/api/webauthn/assert/options", map[string]string{"device_id": device.id}, false)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", rec.Code)
+		}
+	})
+}
+
+func TestTOTPLogin(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+	session, _ := h.tokenManager.SignSession("totp-sid", device.id, auth.ScopeUser, time.Hour)
+
+	do := func(method, path string, body interface{}, withSession bool) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(b))
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		if withSession {
+			req.AddCookie(&http.Cookie{Name: "ff_session", Value: session})
+		}
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	login := func(otp string) AuthedResponse {
+		rec := do(http.MethodPost, "/api/login", map[string]string{
+			"secret":    "test-secret",
+			"device_id": device.id,
+			"otp":       otp,
+		}, false)
+		var resp AuthedResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp
+	}
+
+	if rec := do(http.MethodPost, "/api/totp/setup", nil, false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without session, got %d", rec.Code)
+	}
+
+	rec := do(http.MethodPost, "/api/totp/setup", nil, true)
+	var setup TOTPSetupResponse
+	json.NewDecoder(rec.Body).Decode(&setup)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(setup.URI, "otpauth://totp/") {
+		t.Fatalf("Setup failed: status=%d uri=%q", rec.Code, setup.URI)
+	}
+	seed, err := auth.TOTPEncoding.DecodeString(setup.Secret)
+	if err != nil {
+		t.Fatalf("Failed to decode secret: %v", err)
+	}
+
+	// An unconfirmed seed is not enforced.
+	if resp := login(""); !resp.Authed {
+		t.Fatal("Expected login without otp before confirmation")
+	}
+
+	step := auth.TOTPStep(time.Now())
+	if rec := do(http.MethodPost, "/api/totp/confirm", map[string]string{"otp": auth.TOTPCode(seed, step+5)}, true); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong code, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/totp/confirm", map[string]string{"otp": auth.TOTPCode(seed, step-1)}, true); rec.Code != http.StatusOK {
+		t.Fatalf("Confirm failed: status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	if rec := do(http.MethodPost, "/api/totp/setup", nil, true); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 once enabled, got %d", rec.Code)
+	}
+
+	t.Run("MissingOTP", func(t *testing.T) {
+		if resp := login(""); resp.Authed || !resp.OTPRequired {
+			t.Errorf("Expected otp_required, got %+v", resp)
+		}
+	})
+
+	t.Run("ReplayedOTP", func(t *testing.T) {
+		if resp := login(auth.TOTPCode(seed, step-1)); resp.Authed {
+			t.Error("Expected replayed code rejected")
+		}
+	})
+
+	t.Run("ValidOTP", func(t *testing.T) {
+		if resp := login(auth.TOTPCode(seed, step)); !resp.Authed {
+			t.Error("Expected login with current code")
+		}
+	})
+
+	t.Run("AdminReset", func(t *testing.T) {
+		if rec := do(http.MethodDelete, "/api/admin/devices/"+device.id+"/totp", nil, false); rec.Code != http.StatusOK {
+			t.Fatalf("Reset failed: status=%d", rec.Code)
+		}
+		if resp := login(""); !resp.Authed {
+			t.Error("Expected login without otp after reset")
+		}
+	})
+}
+
+func TestSessionEndpoint(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	sid := "test-sid"
+	validToken, _ := h.tokenManager.SignSession(sid, device.id, auth.ScopeUser, time.Hour)
+
+	t.Run("ValidSession", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: validToken})
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", rec.Code)
+		}
+
+		var resp map[string]bool
+		json.NewDecoder(rec.Body).Decode(&resp)
+
+		if !resp["authed"] {
+			t.Error("Expected authed: true")
+		}
+	})
+
+	t.Run("InvalidSession", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: "invalid-token"})
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		var resp map[string]bool
+		json.NewDecoder(rec.Body).Decode(&resp)
+
+		if resp["authed"] {
+			t.Error("Expected authed: false")
+		}
+	})
+
+	t.Run("OtherDevicesSession", func(t *testing.T) {
+		other := newTestDevice(t)
+		enrollTestDevice(t, h, other)
+
+		for name, token := range map[string]string{
+			"Bound":   validToken,
+			"Unbound": func() string { tok, _ := h.tokenManager.Sign(sid, auth.TokenVersionSession, "", time.Hour); return tok }(),
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+			req.AddCookie(&http.Cookie{Name: "ff_session", Value: token})
+			req.AddCookie(&http.Cookie{Name: "device_ticket", Value: issueDeviceTicket(t, h, other)})
+			rec := httptest.NewRecorder()
+
+			h.Routes().ServeHTTP(rec, req)
+
+			var resp AuthedResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if resp.Authed {
+				t.Errorf("%s: expected authed: false with another device's ticket", name)
+			}
+		}
+	})
+
+	t.Run("NoSession", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		var resp map[string]bool
+		json.NewDecoder(rec.Body).Decode(&resp)
+
+		if resp["authed"] {
+			t.Error("Expected authed: false")
+		}
+	})
+}
+
+func TestSessionRefresh(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/session/refresh", nil)
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		if token != "" {
+			req.AddCookie(&http.Cookie{Name: "ff_session", Value: token})
+		}
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	token, _ := h.tokenManager.SignSession("refresh-sid", device.id, auth.ScopeUser, time.Minute)
+
+	t.Run("Renews", func(t *testing.T) {
+		rec := refresh(token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+		var resp SessionRefreshResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.ExpiresAt < time.Now().Add(59*time.Minute).UnixMilli() {
+			t.Errorf("Expected expiry about an hour out, got %d", resp.ExpiresAt)
+		}
+
+		var renewed string
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "ff_session" {
+				renewed = c.Value
+			}
+		}
+		claims, err := h.tokenManager.VerifyWithVersion(renewed, auth.TokenVersionSession)
+		if err != nil || claims.SID != "refresh-sid" || claims.DeviceID != device.id {
+			t.Fatalf("Expected renewed cookie for the same SID and device, got %+v, %v", claims, err)
+		}
+	})
+
+	t.Run("NoSession", func(t *testing.T) {
+		if rec := refresh(""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+	})
+
+	t.Run("MaxLifetime", func(t *testing.T) {
+		maxLife := h.sessionMaxLife
+		h.sessionMaxLife = 0
+		defer func() { h.sessionMaxLife = maxLife }()
+
+		rec := refresh(token)
+		if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), "SESSION_MAX_LIFETIME") {
+			t.Errorf("Expected SESSION_MAX_LIFETIME, got %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		h.store.RevokeSession("refresh-sid", time.Now().UnixMilli(), time.Now().Add(time.Hour).UnixMilli())
+		if rec := refresh(token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+	})
+}
+
+func TestLogout(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+	token, _ := h.tokenManager.SignSession("logout-sid", device.id, auth.ScopeUser, time.Hour)
+
+	session := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: token})
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+
+		var resp AuthedResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp.Authed
+	}
+
+	if !session() {
+		t.Fatal("Expected session to be valid before logout")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+	req.AddCookie(&http.Cookie{Name: "ff_session", Value: token})
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	cleared := make(map[string]bool)
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			cleared[c.Name] = true
+		}
+	}
+	if !cleared["ff_session"] || !cleared["device_ticket"] {
+		t.Errorf("Expected both auth cookies cleared, got %v", rec.Header()["Set-Cookie"])
+	}
+
+	if session() {
+		t.Error("Expected revoked session to be rejected")
+	}
+
+	// A copy renewed past the logged-out cookie's expiry stays revoked
+	// after the prune that follows that expiry.
+	t.Run("RenewedCopy", func(t *testing.T) {
+		older, _ := h.tokenManager.SignSession("renewed-sid", device.id, auth.ScopeUser, time.Hour)
+		claims, err := h.tokenManager.VerifyWithVersion(older, auth.TokenVersionSession)
+		if err != nil {
+			t.Fatal(err)
+		}
+		renewed, _, err := h.tokenManager.Renew(claims, 24*time.Hour, h.sessionMaxLife)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: older})
+		h.Routes().ServeHTTP(httptest.NewRecorder(), req)
+
+		if _, err := h.store.PruneRevokedSessions(time.Now().Add(2 * time.Hour).UnixMilli()); err != nil {
+			t.Fatalf("PruneRevokedSessions failed: %v", err)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/api/session", nil)
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: renewed})
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+
+		var resp AuthedResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.Authed {
+			t.Error("Expected renewed copy of a logged-out session to stay revoked after pruning")
+		}
+	})
+
+	t.Run("WithoutSession", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", rec.Code)
+		}
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/logout", nil)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status 405, got %d", rec.Code)
+		}
+	})
+}
+
+func TestPresenceEndpoint(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	t.Run("WithoutSession", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/presence", nil)
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+	})
+
+	t.Run("WithSession", func(t *testing.T) {
+		device := newTestDevice(t)
+		enrollTestDevice(t, h, device)
+		ticket := issueDeviceTicket(t, h, device)
+		validToken, _ := h.tokenManager.SignSession("test-sid", device.id, auth.ScopeUser, time.Hour)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/presence", nil)
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: validToken})
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", rec.Code)
+		}
+	})
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	t.Run("MissingDeviceTicket", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+
+		var resp APIResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.Error == nil || resp.Error.Code != "MISSING_DEVICE_TICKET" {
+			t.Errorf("Expected MISSING_DEVICE_TICKET, got %#v", resp.Error)
+		}
+	})
+
+	t.Run("ExpiredDeviceTicket", func(t *testing.T) {
+		device := newTestDevice(t)
+		enrollTestDevice(t, h, device)
+		expired, _ := h.tokenManager.Sign(device.id, auth.TokenVersionDeviceTicket, "", -time.Minute)
+
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: expired})
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+	})
+
+	t.Run("TamperedDeviceTicket", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: "bad-token"})
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+	})
+
+	t.Run("InvalidRoom", func(t *testing.T) {
+		device := newTestDevice(t)
+		enrollTestDevice(t, h, device)
+		ticket := issueDeviceTicket(t, h, device)
+		sessionToken, _ := h.tokenManager.SignSession("test-sid", device.id, auth.ScopeUser, time.Minute)
+
+		req := httptest.NewRequest(http.MethodGet, "/ws?room=../other", nil)
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: sessionToken})
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		var resp APIResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if rec.Code != http.StatusBadRequest || resp.Error == nil || resp.Error.Code != "INVALID_ROOM" {
+			t.Errorf("Expected 400 INVALID_ROOM, got %d %#v", rec.Code, resp.Error)
+		}
+	})
+
+	t.Run("AuthorizedWebSocket", func(t *testing.T) {
+		device := newTestDevice(t)
+		enrollTestDevice(t, h, device)
+		ticket := issueDeviceTicket(t, h, device)
+
+		sessionToken, _ := h.tokenManager.SignSession("test-sid", device.id, auth.ScopeUser, time.Minute)
+
+		server := httptest.NewServer(h.Routes())
+		defer server.Close()
+
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+		header := http.Header{}
+		header.Set("Cookie", fmt.Sprintf("ff_session=%s; device_ticket=%s", sessionToken, ticket))
+
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			status := 0
+			if resp != nil {
+				status = resp.StatusCode
+			}
+			t.Fatalf("WebSocket dial failed: %v (status=%d)", err, status)
+		}
+		conn.Close()
+	})
+
+	t.Run("SessionFromOtherDevice", func(t *testing.T) {
+		owner := newTestDevice(t)
+		enrollTestDevice(t, h, owner)
+		thief := newTestDevice(t)
+		enrollTestDevice(t, h, thief)
+		ticket := issueDeviceTicket(t, h, thief)
+
+		sessionToken, _ := h.tokenManager.SignSession("stolen-sid", owner.id, auth.ScopeUser, time.Minute)
+
+		server := httptest.NewServer(h.Routes())
+		defer server.Close()
+
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+		header := http.Header{}
+		header.Set("Cookie", fmt.Sprintf("ff_session=%s; device_ticket=%s", sessionToken, ticket))
+
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err == nil {
+			t.Fatal("Expected dial with another device's session to fail")
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %v", resp)
+		}
+	})
+}
+
+func TestAdminDeviceImpact(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	challengeBody, _ := json.Marshal(map[string]interface{}{
+		"device_id": device.id,
+		"pub_jwk":   device.jwk,
+	})
+	chReq := httptest.NewRequest(http.MethodPost, "/api/device/challenge", bytes.NewBuffer(challengeBody))
+	chRec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(chRec, chReq)
+	if chRec.Code != http.StatusOK {
+		t.Fatalf("Challenge failed: status=%d body=%s", chRec.Code, chRec.Body.String())
+	}
+
+	server := httptest.NewServer(h.Routes())
+	defer server.Close()
+
+	sessionToken, _ := h.tokenManager.SignSession("impact-sid", device.id, auth.ScopeUser, time.Minute)
+	header := http.Header{}
+	header.Set("Cookie", fmt.Sprintf("ff_session=%s; device_ticket=%s", sessionToken, ticket))
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("WebSocket dial failed: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	t.Run("Preview", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/devices/"+device.id+"/impact", nil)
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var resp map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp["live_connections"] != float64(1) {
+			t.Errorf("Expected 1 live connection, got %v", resp["live_connections"])
+		}
+		if resp["active_sessions"] != float64(1) {
+			t.Errorf("Expected 1 active session, got %v", resp["active_sessions"])
+		}
+		if resp["outstanding_challenges"] != float64(1) {
+			t.Errorf("Expected 1 outstanding challenge, got %v", resp["outstanding_challenges"])
+		}
+	})
+
+	t.Run("UnknownDevice", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/devices/unknown-device-id/impact", nil)
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", rec.Code)
+		}
+	})
+
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/devices/"+device.id+"/impact", nil)
+		rec := httptest.NewRecorder()
+
+		h.Routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+	})
+}
+
+func TestWebSocketConnectionAudit(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	server := httptest.NewServer(h.Routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	// Missing session: auth failure attributed to the ticket's device.
+	header := http.Header{}
+	header.Set("Cookie", "device_ticket="+ticket)
+	header.Set("User-Agent", "audit-test/1.0")
+	header.Set("Accept-Language", "pt-BR,pt;q=0.9")
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL, header); err == nil {
+		t.Fatal("Expected dial without session to fail")
+	}
+
+	sessionToken, _ := h.tokenManager.SignSession("audit-sid", device.id, auth.ScopeUser, time.Minute)
+	header.Set("Cookie", fmt.Sprintf("ff_session=%s; device_ticket=%s", sessionToken, ticket))
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?locale=pt-PT&tz=Europe/Lisbon", header)
+	if err != nil {
+		t.Fatalf("WebSocket dial failed: %v", err)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/devices/"+device.id+"/connections", nil)
+	setAdmin(h, req)
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp ConnectionsResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(resp.Attempts))
+	}
+
+	accepted, failed := resp.Attempts[0], resp.Attempts[1]
+	if accepted.Outcome != store.ConnOutcomeAccepted || accepted.CloseCode != websocket.CloseGoingAway {
+		t.Errorf("Unexpected accepted attempt: %+v", accepted)
+	}
+	if failed.Outcome != store.ConnOutcomeAuthFailed || failed.Reason != "missing_session" {
+		t.Errorf("Unexpected failed attempt: %+v", failed)
+	}
+	if failed.UserAgent != "audit-test/1.0" {
+		t.Errorf("Expected user agent to be recorded, got %q", failed.UserAgent)
+	}
+	if failed.Locale != "pt-BR" || accepted.Locale != "pt-PT" || accepted.TimeZone != "Europe/Lisbon" {
+		t.Errorf("Expected locale and time zone recorded, got %q and %q/%q", failed.Locale, accepted.Locale, accepted.TimeZone)
+	}
+}
+
+func TestAdminDeviceTimeline(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	for i := int64(0); i < 3; i++ {
+		id, _ := h.store.RecordConnAttempt(&store.ConnAttempt{DeviceID: device.id, Outcome: store.ConnOutcomeAccepted, IP: "192.0.2.1", CreatedAt: 1000 * (i + 1)})
+		if i < 2 {
+			h.store.CloseConnAttempt(id, websocket.CloseGoingAway, 1000*(i+1)+300)
+		}
+	}
+	h.store.RecordConnAttempt(&store.ConnAttempt{DeviceID: device.id, Outcome: store.ConnOutcomeAuthFailed, CreatedAt: 5000})
+
+	get := func(query string) (int, TimelineResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/devices/"+device.id+"/timeline"+query, nil)
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		var resp TimelineResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	code, resp := get("?limit=2")
+	if code != http.StatusOK || len(resp.Intervals) != 2 || resp.NextBefore == 0 {
+		t.Fatalf("First page: %d %+v", code, resp)
+	}
+	open, closed := resp.Intervals[0], resp.Intervals[1]
+	if open.StartedAt != 3000 || open.EndedAt != 0 || open.DurationMS != 0 {
+		t.Errorf("Unexpected open interval: %+v", open)
+	}
+	if closed.StartedAt != 2000 || closed.DurationMS != 300 || closed.IP != "192.0.2.1" || closed.CloseCode != websocket.CloseGoingAway {
+		t.Errorf("Unexpected closed interval: %+v", closed)
+	}
+
+	code, resp = get(fmt.Sprintf("?limit=2&before=%d", resp.NextBefore))
+	if code != http.StatusOK || len(resp.Intervals) != 1 || resp.Intervals[0].StartedAt != 1000 || resp.NextBefore != 0 {
+		t.Errorf("Last page: %d %+v", code, resp)
+	}
+
+	if code, _ := get("?before=x"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad cursor, got %d", code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/devices/"+device.id+"/timeline", nil)
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without admin token, got %d", rec.Code)
+	}
+}
+
+func TestAdminDeviceState(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+	path := "/api/admin/devices/" + device.id + "/state"
+
+	setState := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	errorCode := func(rec *httptest.ResponseRecorder) string {
+		var resp APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if resp.Error == nil {
+			return ""
+		}
+		return resp.Error.Code
+	}
+	login := func() *httptest.ResponseRecorder {
+		body := `{"secret":"test-secret", "device_id":"` + device.id + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := setState(`{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without disabled, got %d", rec.Code)
+	}
+	rec := setState(`{"disabled":true}`)
+	var resp DeviceStateResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || !resp.Disabled {
+		t.Fatalf("Disable failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := login(); rec.Code != http.StatusForbidden || errorCode(rec) != "DEVICE_DISABLED" {
+		t.Errorf("Login with a disabled device: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = postJSON(h, "/api/device/challenge", map[string]interface{}{"device_id": device.id, "pub_jwk": device.jwk}, false)
+	if rec.Code != http.StatusForbidden || errorCode(rec) != "DEVICE_DISABLED" {
+		t.Errorf("Challenge for a disabled device: %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := setState(`{"disabled":false}`); rec.Code != http.StatusOK {
+		t.Fatalf("Enable failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := login(); rec.Code != http.StatusOK {
+		t.Errorf("Login after enabling: %d %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/admin/devices/unknown-device-id/state", strings.NewReader(`{"disabled":true}`))
+	setAdmin(h, req)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown device, got %d", rec.Code)
+	}
+}
+
+func TestAdminDeviceUpdate(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	other := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	enrollTestDevice(t, h, other)
+
+	patch := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/admin/devices/"+id, strings.NewReader(body))
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := patch(device.id, `{"label":"  Kitchen tablet "}`)
+	var resp DeviceUpdatedResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Label != "Kitchen tablet" {
+		t.Fatalf("Rename failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if d, _ := h.store.GetDevice(device.id); d.Label != "Kitchen tablet" {
+		t.Errorf("Expected the stored label to change, got %q", d.Label)
+	}
+
+	if rec := patch(other.id, `{"label":"Kitchen tablet"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a taken label, got %d", rec.Code)
+	}
+	for _, body := range []string{`{}`, `{"label":"   "}`, `{"label":"a\u0000b"}`, `{"label":"` + strings.Repeat("x", 65) + `"}`} {
+		if rec := patch(device.id, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if rec := patch("unknown-device-id", `{"label":"x"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown device, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/admin/devices/"+device.id, strings.NewReader(`{"label":"x"}`))
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without admin auth, got %d", rec.Code)
+	}
+}
+
+func TestAdminDeviceCommands(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	path := "/api/admin/devices/" + device.id + "/commands"
+
+	do := func(method, body string, admin bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if admin {
+			setAdmin(h, req)
+		}
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	commands := func(rec *httptest.ResponseRecorder) []string {
+		var resp AllowedCommandsResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp.Commands
+	}
+
+	rec := do(http.MethodGet, "", true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := commands(rec); len(got) != 0 {
+		t.Errorf("Expected empty allowlist, got %v", got)
+	}
+
+	rec = do(http.MethodPut, `{"commands":["ring","open_url"]}`, true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := commands(rec); len(got) != 2 || got[0] != "open_url" || got[1] != "ring" {
+		t.Errorf("Expected [open_url ring], got %v", got)
+	}
+
+	if rec := do(http.MethodPut, `{"commands":["shell"]}`, true); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unknown command, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, `{"commands":[]}`, false); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without admin token, got %d", rec.Code)
+	}
+	if ok, _ := h.store.CommandAllowed(device.id, "ring"); !ok {
+		t.Error("Expected rejected updates to leave the allowlist intact")
+	}
+}
+
+func TestAdminDevicePeers(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	parent, kid, stranger := newTestDevice(t), newTestDevice(t), newTestDevice(t)
+	enrollTestDevice(t, h, parent)
+	enrollTestDevice(t, h, kid)
+	if err := h.store.CreateUser(&store.User{UserID: "u-dave", Name: "dave", SecretHash: "x", CreatedAt: 1}); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	strangerJWK, _ := json.Marshal(stranger.jwk)
+	h.store.AddDevice(&store.Device{DeviceID: stranger.id, PubJWKJSON: string(strangerJWK), CreatedAt: 1, UserID: "u-dave"})
+
+	do := func(method, deviceID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/admin/devices/"+deviceID+"/peers", strings.NewReader(body))
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPut, parent.id, `{"peers":["`+kid.id+`"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = do(http.MethodGet, kid.id, "")
+	var resp DevicePeersResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Peers) != 1 || resp.Peers[0] != parent.id {
+		t.Errorf("Expected kid linked to parent, got %+v", resp)
+	}
+
+	for name, body := range map[string]string{
+		"self":       `{"peers":["` + parent.id + `"]}`,
+		"unknown":    `{"peers":["` + newTestDevice(t).id + `"]}`,
+		"other user": `{"peers":["` + stranger.id + `"]}`,
+	} {
+		if rec := do(http.MethodPut, parent.id, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", name, rec.Code)
+		}
+	}
+	if rec := do(http.MethodPut, newTestDevice(t).id, `{"peers":[]}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown device, got %d", rec.Code)
+	}
+	if ok, _ := h.store.PeerAllowed(parent.id, kid.id); !ok {
+		t.Error("Expected rejected updates to leave the links intact")
+	}
+}
+
+func TestAdminDeviceTrash(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	server := httptest.NewServer(h.Routes())
+	defer server.Close()
+
+	sessionToken, _ := h.tokenManager.SignSession("trash-sid", device.id, auth.ScopeUser, time.Minute)
+	header := http.Header{}
+	header.Set("Cookie", fmt.Sprintf("ff_session=%s; device_ticket=%s", sessionToken, ticket))
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("WebSocket dial failed: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodDelete, "/api/admin/devices/"+device.id)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var deleted DeviceDeletedResponse
+	json.NewDecoder(rec.Body).Decode(&deleted)
+	if deleted.ConnectionsClosed != 1 || deleted.DeletedAt == 0 {
+		t.Errorf("Unexpected delete response: %+v", deleted)
+	}
+
+	// The live socket gets a close frame telling the client not to retry.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, realtime.CloseDeviceRevoked) {
+				t.Errorf("Expected close code %d, got %v", realtime.CloseDeviceRevoked, err)
+			}
+			break
+		}
+	}
+
+	// Tickets issued before the delete stop working everywhere.
+	refresh := httptest.NewRequest(http.MethodPost, "/api/session/refresh", nil)
+	refresh.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+	refresh.AddCookie(&http.Cookie{Name: "ff_session", Value: sessionToken})
+	refreshRec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(refreshRec, refresh)
+	if refreshRec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 refreshing a revoked device's session, got %d", refreshRec.Code)
+	}
+
+	if rec := do(http.MethodDelete, "/api/admin/devices/"+device.id); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 deleting twice, got %d", rec.Code)
+	}
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL, header); err == nil {
+		t.Error("Expected trashed device to be refused a WebSocket")
+	}
+
+	rec = do(http.MethodGet, "/api/admin/trash")
+	var trash TrashResponse
+	json.NewDecoder(rec.Body).Decode(&trash)
+	if len(trash.Devices) != 1 || trash.Devices[0].DeviceID != device.id {
+		t.Fatalf("Expected device in trash, got %+v", trash)
+	}
+
+	if rec := do(http.MethodPost, "/api/admin/devices/"+device.id+"/restore"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 restoring, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/admin/devices/"+device.id+"/restore"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 restoring a live device, got %d", rec.Code)
+	}
+
+	// The restored device reconnects with its existing key and session.
+	conn2, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("Expected restored device to connect: %v", err)
+	}
+	conn2.Close()
+}
+
+func TestWebSocketReconnect(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+
+	server := httptest.NewServer(h.Routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?reconnect="
+	dial := func(token string) int {
+		t.Helper()
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL+token, nil)
+		if err == nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if token := h.ReconnectToken(device.id, apiTokenSession("t1"), false); token != "" {
+		t.Errorf("API token connections should get no reconnect token, got %q", token)
+	}
+
+	token := h.ReconnectToken(device.id, "rc-sid", false)
+	if !strings.HasPrefix(token, auth.ReconnectTokenPrefix) || len(token) > 123 {
+		t.Fatalf("ReconnectToken = %q", token)
+	}
+	// Neither a device ticket nor a session cookie is needed, but the
+	// token works once.
+	if code := dial(token); code != http.StatusSwitchingProtocols {
+		t.Fatalf("reconnect: expected 101, got %d", code)
+	}
+	if code := dial(token); code != http.StatusUnauthorized {
+		t.Errorf("reused token: expected 401, got %d", code)
+	}
+	if code := dial("ffrc_made-up"); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: expected 401, got %d", code)
+	}
+
+	token = h.ReconnectToken(device.id, "rc-sid", false)
+	h.store.RevokeSession("rc-sid", time.Now().UnixMilli(), time.Now().Add(time.Hour).UnixMilli())
+	if code := dial(token); code != http.StatusUnauthorized {
+		t.Errorf("revoked session: expected 401, got %d", code)
+	}
+
+	token = h.ReconnectToken(device.id, "rc-sid-2", false)
+	h.store.SetDeviceDisabled(device.id, true)
+	if code := dial(token); code != http.StatusForbidden {
+		t.Errorf("disabled device: expected 403, got %d", code)
+	}
+}
+
+// TestShutdownDrainToken stops the hub and the store through the real
+// lifecycle, in the order main registers them, and checks that the drain
+// close frame's reconnect token and the connection's audit close were
+// stored before the store closed.
+func TestShutdownDrainToken(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	var seq int
+	var name, dbPath string
+	if err := h.store.DB().QueryRow("PRAGMA database_list").Scan(&seq, &name, &dbPath); err != nil {
+		t.Fatalf("database_list: %v", err)
+	}
+
+	hub := h.hub.(*realtime.Hub)
+	hub.SetReconnector(h)
+	lc := lifecycle.New()
+	lc.Register(lifecycle.Hook{
+		Name: "store",
+		Stop: func(context.Context) error { return h.store.Close() },
+	})
+	lc.Register(lifecycle.Hook{Name: "hub", Stop: hub.Shutdown})
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+	sessionToken, _ := h.tokenManager.SignSession("drain-sid", device.id, auth.ScopeUser, time.Minute)
+	header := http.Header{}
+	header.Set("Cookie", fmt.Sprintf("ff_session=%s; device_ticket=%s", sessionToken, ticket))
+
+	server := httptest.NewServer(h.Routes())
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+	if err != nil {
+		t.Fatalf("WebSocket dial failed: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := lc.Stop(context.Background()); err != nil {
+		t.Fatalf("lifecycle Stop: %v", err)
+	}
+
+	var token string
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway {
+				t.Fatalf("Expected a going-away close frame, got %v", err)
+			}
+			token = ce.Text
+			break
+		}
+	}
+	if !strings.HasPrefix(token, auth.ReconnectTokenPrefix) {
+		t.Fatalf("Drain close frame should carry a reconnect token, got %q", token)
+	}
+
+	db, err := store.New(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.TakeReconnectGrant(auth.HashAPIToken(token), time.Now().UnixMilli()); err != nil {
+		t.Errorf("Drain token's grant was not stored before the store closed: %v", err)
+	}
+	attempts, err := db.ListConnAttempts(device.id, 10)
+	if err != nil || len(attempts) == 0 || attempts[0].ClosedAt == 0 {
+		t.Errorf("Connection close was not audited before the store closed: %+v, %v", attempts, err)
+	}
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+	sessionToken, _ := h.tokenManager.SignSession("deflate-sid", device.id, auth.ScopeUser, time.Minute)
+	header := http.Header{}
+	header.Set("Cookie", fmt.Sprintf("ff_session=%s; device_ticket=%s", sessionToken, ticket))
+
+	server := httptest.NewServer(h.Routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	negotiated := func() bool {
+		t.Helper()
+		dialer := websocket.Dialer{EnableCompression: true}
+		conn, resp, err := dialer.Dial(wsURL, header)
+		if err != nil {
+			t.Fatalf("WebSocket dial failed: %v", err)
+		}
+		conn.Close()
+		return strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	}
+
+	if negotiated() {
+		t.Error("permessage-deflate negotiated with WSCompression off")
+	}
+	h.upgrader.EnableCompression = true
+	if !negotiated() {
+		t.Error("permessage-deflate not negotiated with WSCompression on")
+	}
+}
+
+func TestClientVersionPolicy(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+	h.minClient = "1.2"
+	h.recommendClient = "1.5.0"
+	h.updateURL = "https://fileflow.test/update"
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	server := httptest.NewServer(h.Routes())
+	defer server.Close()
+
+	sessionToken, _ := h.tokenManager.SignSession("version-sid", device.id, auth.ScopeUser, time.Minute)
+	header := http.Header{}
+	header.Set("Cookie", fmt.Sprintf("ff_session=%s; device_ticket=%s", sessionToken, ticket))
+	dial := func(version string) *websocket.Conn {
+		t.Helper()
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+		if version != "" {
+			wsURL += "?client_version=" + version
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			t.Fatalf("WebSocket dial failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+	// readUpdate returns the first update event on conn, skipping presence
+	// and connected.
+	readUpdate := func(conn *websocket.Conn) (*realtime.Event, realtime.UpdateValue) {
+		t.Helper()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("Expected an update event, got %v", err)
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				ev, err := realtime.ParseEvent([]byte(line))
+				if err != nil || ev.Type == realtime.EventPresence || ev.Type == realtime.EventConnected {
+					continue
+				}
+				var v realtime.UpdateValue
+				b, _ := json.Marshal(ev.Value)
+				json.Unmarshal(b, &v)
+				return ev, v
+			}
+		}
+	}
+
+	for _, version := range []string{"", "1.1.9", "garbage"} {
+		conn := dial(version)
+		ev, v := readUpdate(conn)
+		if ev.Type != realtime.EventUpdateRequired || v.Version != "1.2" || v.Current != version || v.URL != h.updateURL {
+			t.Errorf("version %q: unexpected event %s %+v", version, ev.Type, v)
+		}
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, realtime.CloseClientOutdated) {
+			t.Errorf("version %q: expected close code %d, got %v", version, realtime.CloseClientOutdated, err)
+		}
+		conn.Close()
+	}
+	attempts, _ := h.store.ListConnAttempts(device.id, 1)
+	if len(attempts) != 1 || attempts[0].Outcome != store.ConnOutcomeClientOutdated || attempts[0].Reason != "garbage" {
+		t.Errorf("Expected a client_outdated audit record, got %+v", attempts)
+	}
+
+	conn := dial("1.4")
+	if ev, v := readUpdate(conn); ev.Type != realtime.EventUpdateRecommended || v.Version != "1.5.0" {
+		t.Errorf("Expected update_recommended, got %s %+v", ev.Type, v)
+	}
+	conn.Close()
+
+	// Current clients get neither event and stay connected.
+	conn = dial("1.5")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, realtime.CloseClientOutdated) {
+				t.Error("Current client was refused")
+			}
+			break
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if ev, err := realtime.ParseEvent([]byte(line)); err == nil && ev.Type != realtime.EventPresence && ev.Type != realtime.EventConnected {
+				t.Errorf("Unexpected %s event for a current client", ev.Type)
+			}
+		}
+	}
+}
+
+func TestPairingEnrollment(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	// The issuer belongs to a named user, which the new device inherits.
+	if err := h.store.CreateUser(&store.User{UserID: "u-carol", Name: "carol", SecretHash: "x", CreatedAt: 1}); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	issuer := newTestDevice(t)
+	issuerJWK, _ := json.Marshal(issuer.jwk)
+	if err := h.store.AddDevice(&store.Device{
+		DeviceID:   issuer.id,
+		PubJWKJSON: string(issuerJWK),
+		CreatedAt:  time.Now().UnixMilli(),
+		UserID:     "u-carol",
+	}); err != nil {
+		t.Fatalf("Failed to add device: %v", err)
+	}
+	ticket := issueDeviceTicket(t, h, issuer)
+	session, _ := h.tokenManager.SignSession("pairing-sid", issuer.id, auth.ScopeUser, time.Hour)
+
+	requestCode := func(withSession bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/device/pairing-code", nil)
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		if withSession {
+			req.AddCookie(&http.Cookie{Name: "ff_session", Value: session})
+		}
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := requestCode(false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 without a session, got %d", rec.Code)
+	}
+
+	rec := requestCode(true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var code PairingCodeResponse
+	json.NewDecoder(rec.Body).Decode(&code)
+	if len(code.Code) != auth.PairingCodeLength || code.ExpiresAt <= time.Now().UnixMilli() {
+		t.Fatalf("Unexpected pairing code: %+v", code)
+	}
+
+	newcomer := newTestDevice(t)
+	enroll := func(c string, jwk map[string]interface{}) *httptest.ResponseRecorder {
+		return postJSON(h, "/api/device/enroll", map[string]interface{}{
+			"code":      c,
+			"device_id": newcomer.id,
+			"pub_jwk":   jwk,
+			"label":     "phone",
+		}, false)
+	}
+
+	t.Run("WrongCode", func(t *testing.T) {
+		if rec := enroll("AAAAAAAA", newcomer.jwk); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", rec.Code)
+		}
+	})
+
+	t.Run("MismatchedKeyKeepsCode", func(t *testing.T) {
+		other := newTestDevice(t)
+		if rec := enroll(code.Code, other.jwk); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", rec.Code)
+		}
+	})
+
+	t.Run("Enroll", func(t *testing.T) {
+		rec := enroll(strings.ToLower(code.Code), newcomer.jwk)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		d, err := h.store.GetDevice(newcomer.id)
+		if err != nil {
+			t.Fatalf("Expected newcomer enrolled: %v", err)
+		}
+		if d.UserID != "u-carol" {
+			t.Errorf("Expected newcomer in the issuer's account, got user %q", d.UserID)
+		}
+	})
+
+	t.Run("CodeIsSingleUse", func(t *testing.T) {
+		if rec := enroll(code.Code, newcomer.jwk); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 reusing the code, got %d", rec.Code)
+		}
+	})
+}
+
+func TestEnrollmentLockout(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+	h.enrollMaxInvalid = 2
+
+	adminAdd := func(body string, admin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/devices", strings.NewReader(body))
+		if admin != "" {
+			req.Header.Set("Authorization", "Bearer "+admin)
+		} else {
+			req.Header.Set("X-Admin-Bootstrap", "test-bootstrap-token")
+		}
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Invalid payloads sent with an admin token do not count.
+	admin, _ := h.tokenManager.Sign(uuid.NewString(), auth.TokenVersionAdmin, auth.ScopeAdmin, time.Hour)
+	for i := 0; i < 3; i++ {
+		if rec := adminAdd("{", admin); rec.Code != http.StatusBadRequest {
+			t.Fatalf("admin garbage = %d", rec.Code)
+		}
+	}
+
+	device := newTestDevice(t)
+	valid, _ := json.Marshal(map[string]interface{}{"device_id": device.id, "pub_jwk": device.jwk})
+	for _, body := range []string{"{", `{"device_id":"x","pub_jwk":{}}`} {
+		if rec := adminAdd(body, ""); rec.Code != http.StatusBadRequest {
+			t.Fatalf("bootstrap garbage = %d", rec.Code)
+		}
+	}
+	rec := adminAdd(string(valid), "")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "BOOTSTRAP_LOCKED") {
+		t.Fatalf("locked bootstrap = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := adminAdd(string(valid), admin); rec.Code != http.StatusOK {
+		t.Fatalf("admin enroll after lock = %d: %s", rec.Code, rec.Body)
+	}
+
+	// A pairing code is revoked after the same number of bad payloads.
+	p, _ := h.pairingStore.Create(device.id)
+	newcomer := newTestDevice(t)
+	enroll := func(jwk map[string]interface{}) int {
+		return postJSON(h, "/api/device/enroll", map[string]interface{}{
+			"code": p.Code, "device_id": newcomer.id, "pub_jwk": jwk,
+		}, false).Code
+	}
+	other := newTestDevice(t)
+	if c1, c2 := enroll(other.jwk), enroll(other.jwk); c1 != http.StatusBadRequest || c2 != http.StatusBadRequest {
+		t.Fatalf("mismatched keys = %d, %d", c1, c2)
+	}
+	if c := enroll(newcomer.jwk); c != http.StatusUnauthorized {
+		t.Errorf("enroll with a locked code = %d, want 401", c)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/enroll-events?limit=10", nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	var resp EnrollEventsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("enroll-events = %d, %v", rec.Code, err)
+	}
+	var got []string
+	for _, e := range resp.Events {
+		got = append(got, e.Credential+"/"+e.Outcome+"/"+e.IssuedBy)
+	}
+	want := []string{
+		"pairing/locked/" + device.id,
+		"pairing/invalid_payload/" + device.id,
+		"bootstrap/locked/",
+		"bootstrap/invalid_payload/",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestSharedChallengeStore(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	// Two replicas behind a load balancer share only the database.
+	h.challengeStore = auth.NewDBChallengeStore(h.store, time.Minute)
+	replica := New(Config{
+		Store:          h.store,
+		TokenManager:   h.tokenManager,
+		LoginLimiter:   h.loginLimiter,
+		ConnLimiter:    h.connLimiter,
+		Hub:            h.hub,
+		ChallengeStore: auth.NewDBChallengeStore(h.store, time.Minute),
+	})
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+
+	rec := postJSON(h, "/api/device/challenge", map[string]interface{}{
+		"device_id": device.id,
+		"pub_jwk":   device.jwk,
+	}, false)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Challenge failed: status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var ch struct {
+		ChallengeID string `json:"challenge_id"`
+		Nonce       string `json:"nonce"`
+	}
+	json.NewDecoder(rec.Body).Decode(&ch)
+
+	attest := map[string]string{
+		"challenge_id": ch.ChallengeID,
+		"device_id":    device.id,
+		"signature":    device.sign(t, decodeB64URL(t, ch.Nonce)),
+	}
+	if rec := postJSON(replica, "/api/device/attest", attest, false); rec.Code != http.StatusOK {
+		t.Fatalf("Attest on replica failed: status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := postJSON(h, "/api/device/attest", attest, false); rec.Code == http.StatusOK {
+		t.Error("Expected the challenge to be redeemable only once across replicas")
+	}
+}
+
+func TestHostPrefixedCookies(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+	session, _ := h.tokenManager.SignSession("host-sid", device.id, auth.ScopeUser, time.Hour)
+
+	h.secureCookies, h.hostCookies, h.legacyCookies = true, true, true
+
+	t.Run("Issue", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.issueDeviceTicket(rec, httptest.NewRequest(http.MethodPost, "/api/device/attest", nil), device.id)
+
+		cookies := map[string]*http.Cookie{}
+		for _, c := range rec.Result().Cookies() {
+			cookies[c.Name] = c
+		}
+		c := cookies["__Host-device_ticket"]
+		if c == nil || !c.Secure || c.Path != "/" || c.Domain != "" || c.Value == "" {
+			t.Fatalf("Expected a __Host- ticket cookie, got %+v", c)
+		}
+		if legacy := cookies["device_ticket"]; legacy == nil || legacy.MaxAge >= 0 {
+			t.Errorf("Expected the legacy ticket cookie cleared, got %+v", legacy)
+		}
+	})
+
+	authed := func(cookies map[string]string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+		for name, value := range cookies {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		var resp AuthedResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp.Authed
+	}
+
+	tests := []struct {
+		name    string
+		legacy  bool
+		cookies map[string]string
+		want    bool
+	}{
+		{"Prefixed", false, map[string]string{"__Host-device_ticket": ticket, "__Host-ff_session": session}, true},
+		{"LegacyDuringMigration", true, map[string]string{"device_ticket": ticket, "ff_session": session}, true},
+		{"LegacyAfterMigration", false, map[string]string{"device_ticket": ticket, "ff_session": session}, false},
+		// A subdomain can plant an unprefixed cookie but not displace the
+		// prefixed one.
+		{"PrefixedWins", true, map[string]string{
+			"__Host-device_ticket": ticket, "__Host-ff_session": session,
+			"device_ticket": "injected", "ff_session": "injected",
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.legacyCookies = tt.legacy
+			if got := authed(tt.cookies); got != tt.want {
+				t.Errorf("Expected authed=%v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAdminDeviceList(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	kept, trashed := newTestDevice(t), newTestDevice(t)
+	enrollTestDevice(t, h, kept)
+	enrollTestDevice(t, h, trashed)
+	h.store.DeleteDevice(trashed.id, time.Now().UnixMilli())
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/devices", nil)
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without admin token, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/admin/devices", nil)
+	setAdmin(h, req)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp DeviceListResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Devices) != 1 || resp.Devices[0].DeviceID != kept.id || resp.Devices[0].LiveConnections != 0 || resp.Total != 1 {
+		t.Errorf("Unexpected device list: %+v", resp)
+	}
+
+	list := func(query string) (int, DeviceListResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/devices"+query, nil)
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		var resp DeviceListResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	second := newTestDevice(t)
+	enrollTestDevice(t, h, second)
+	if code, resp := list("?limit=1"); code != http.StatusOK || len(resp.Devices) != 1 || resp.Total != 2 || resp.NextOffset != 1 {
+		t.Errorf("First page: %d %+v", code, resp)
+	}
+	if code, resp := list("?limit=1&offset=1"); code != http.StatusOK || len(resp.Devices) != 1 || resp.Devices[0].DeviceID != second.id || resp.NextOffset != 0 {
+		t.Errorf("Last page: %d %+v", code, resp)
+	}
+	if code, resp := list("?label=no-such-label"); code != http.StatusOK || len(resp.Devices) != 0 || resp.Total != 0 {
+		t.Errorf("Label filter: %d %+v", code, resp)
+	}
+	for _, query := range []string{"?limit=0", "?limit=501", "?limit=x", "?offset=-1"} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
+
+func TestAdminUI(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "/admin/" {
+		t.Errorf("Expected redirect to /admin/, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	for _, path := range []string{"/admin/", "/admin/admin.js", "/admin/admin.css"} {
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", path, rec.Code)
+		}
+		if rec.Header().Get("Content-Security-Policy") == "" {
+			t.Errorf("%s: expected a Content-Security-Policy header", path)
+		}
+	}
+}
+
+func TestMultiUserLogin(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	rec := postJSON(h, "/api/admin/users", map[string]string{"name": "alice", "secret": "alice-secret"}, true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var alice UserInfo
+	json.NewDecoder(rec.Body).Decode(&alice)
+	if alice.UserID == "" || alice.Name != "alice" {
+		t.Fatalf("Unexpected user: %+v", alice)
+	}
+
+	if rec := postJSON(h, "/api/admin/users", map[string]string{"name": "alice", "secret": "other-secret"}, true); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for duplicate name, got %d", rec.Code)
+	}
+	if rec := postJSON(h, "/api/admin/users", map[string]string{"name": "bob", "secret": "short"}, true); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for short secret, got %d", rec.Code)
+	}
+	if rec := postJSON(h, "/api/admin/users", map[string]string{"name": "bob", "secret": "bob-secret"}, false); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without admin token, got %d", rec.Code)
+	}
+
+	aliceDevice := newTestDevice(t)
+	rec = postJSON(h, "/api/admin/devices", map[string]interface{}{
+		"device_id": aliceDevice.id, "pub_jwk": aliceDevice.jwk, "user_id": "no-such-user",
+	}, true)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown user, got %d", rec.Code)
+	}
+	rec = postJSON(h, "/api/admin/devices", map[string]interface{}{
+		"device_id": aliceDevice.id, "pub_jwk": aliceDevice.jwk, "user_id": alice.UserID,
+	}, true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 enrolling for alice, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	defaultDevice := newTestDevice(t)
+	enrollTestDevice(t, h, defaultDevice)
+
+	login := func(device testDevice, secret string) bool {
+		ticket := issueDeviceTicket(t, h, device)
+		body := `{"secret":"` + secret + `", "device_id":"` + device.id + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+
+		var resp AuthedResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp.Authed
+	}
+
+	if login(aliceDevice, "test-secret") {
+		t.Error("Alice's device should not accept the server-wide secret")
+	}
+	if !login(aliceDevice, "alice-secret") {
+		t.Error("Alice's device should accept alice's secret")
+	}
+	if login(defaultDevice, "alice-secret") {
+		t.Error("Default device should not accept alice's secret")
+	}
+	if !login(defaultDevice, "test-secret") {
+		t.Error("Default device should accept the server-wide secret")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+	setAdmin(h, req)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	var users UserListResponse
+	json.NewDecoder(rec.Body).Decode(&users)
+	if len(users.Users) != 1 || users.Users[0].UserID != alice.UserID {
+		t.Errorf("Unexpected user list: %+v", users)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+	session, _ := h.tokenManager.SignSession("tokens-sid", device.id, auth.ScopeUser, time.Hour)
+
+	withSession := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(b))
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: session})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	withBearer := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
 		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := withSession(http.MethodPost, "/api/tokens", map[string]string{"name": "backup script"})
+	var created APITokenCreatedResponse
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(created.Token, auth.APITokenPrefix) || created.Scope != auth.ScopeUser {
+		t.Fatalf("Create failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := withSession(http.MethodPost, "/api/tokens", map[string]string{"name": "backup script"}); rec.Code != http.StatusConflict {
+		t.Errorf("Duplicate name should conflict, got %d", rec.Code)
+	}
+	if rec := withSession(http.MethodPost, "/api/tokens", map[string]string{"name": "x", "scope": "admin"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("Admin scope should be rejected, got %d", rec.Code)
+	}
+
+	if rec := withBearer(http.MethodGet, "/api/presence", created.Token); rec.Code != http.StatusOK {
+		t.Errorf("Presence with API token failed: %d %s", rec.Code, rec.Body.String())
+	}
+	// A token cannot manage tokens, or a leaked one could mint more.
+	if rec := withBearer(http.MethodGet, "/api/tokens", created.Token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("API token should not list tokens, got %d", rec.Code)
+	}
+
+	rec = withSession(http.MethodGet, "/api/tokens", nil)
+	var list APITokenListResponse
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Tokens) != 1 || list.Tokens[0].ID != created.ID || list.Tokens[0].LastUsedAt == 0 {
+		t.Errorf("Unexpected token list: %+v", list)
+	}
+
+	server := httptest.NewServer(h.Routes())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+created.Token)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("WebSocket dial with API token failed: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	rec = withSession(http.MethodDelete, "/api/tokens/"+created.ID, nil)
+	var revoked APITokenRevokedResponse
+	json.Unmarshal(rec.Body.Bytes(), &revoked)
+	if rec.Code != http.StatusOK || revoked.ConnectionsClosed != 1 {
+		t.Fatalf("Revoke failed: %d %s", rec.Code, rec.Body.String())
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	if rec := withBearer(http.MethodGet, "/api/presence", created.Token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Revoked token should be rejected, got %d", rec.Code)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, header); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Revoked token should not open a WebSocket, got %v", err)
+	}
+	if rec := withSession(http.MethodDelete, "/api/tokens/"+created.ID, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking twice, got %d", rec.Code)
+	}
+}
+
+func TestCertReport(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
 
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+	session, _ := h.tokenManager.SignSession("test-sid", device.id, auth.ScopeUser, time.Hour)
+
+	report := func(fingerprint string, authed bool) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(CertReportRequest{Fingerprint: fingerprint})
+		req := httptest.NewRequest(http.MethodPost, "/api/cert-report", bytes.NewBuffer(b))
+		if authed {
+			req.AddCookie(&http.Cookie{Name: "ff_session", Value: session})
+			req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		}
+		rec := httptest.NewRecorder()
 		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
 
-		if rec.Code != http.StatusUnauthorized {
-			t.Errorf("Expected status 401, got %d", rec.Code)
+	good := certpin.Fingerprint([]byte("server certificate"))
+	proxy := certpin.Fingerprint([]byte("proxy certificate"))
+
+	if rec := report(good, true); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "CERT_PINNING_DISABLED") {
+		t.Errorf("Without pins: expected 404 CERT_PINNING_DISABLED, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	alerts := make(chan certpin.Mismatch, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m certpin.Mismatch
+		json.NewDecoder(r.Body).Decode(&m)
+		alerts <- m
+	}))
+	defer hook.Close()
+	h.certPins, _ = certpin.New([]string{good}, "")
+	h.certAlerter = certpin.NewAlerter(hook.URL, time.Hour)
+
+	if rec := report(good, false); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Unauthenticated: expected 401, got %d", rec.Code)
+	}
+	if rec := report("sha256:nope", true); rec.Code != http.StatusBadRequest {
+		t.Errorf("Bad fingerprint: expected 400, got %d", rec.Code)
+	}
+
+	// Colon-separated uppercase is how openssl prints it.
+	var colons []string
+	for i := 0; i < len(good); i += 2 {
+		colons = append(colons, strings.ToUpper(good[i:i+2]))
+	}
+	rec := report(strings.Join(colons, ":"), true)
+	var resp CertReportResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || !resp.Match {
+		t.Errorf("Pinned certificate: expected a match, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = report(proxy, true)
+	resp = CertReportResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Match {
+		t.Errorf("Proxy certificate: expected a mismatch, got %d %s", rec.Code, rec.Body.String())
+	}
+	select {
+	case m := <-alerts:
+		if m.DeviceID != device.id || m.Fingerprint != proxy || len(m.Expected) != 1 || m.Expected[0] != good {
+			t.Errorf("alert = %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no alert for the mismatch")
+	}
+	// The same device seeing the same proxy again is audited but alerts once.
+	report(proxy, true)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/cert-reports", nil)
+	setAdmin(h, req)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	var list CertReportsResponse
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if rec.Code != http.StatusOK || len(list.Reports) != 2 || list.Reports[0].DeviceID != device.id || list.Reports[0].Fingerprint != proxy {
+		t.Errorf("Expected two audited mismatches, got %d %s", rec.Code, rec.Body.String())
+	}
+	select {
+	case m := <-alerts:
+		t.Errorf("unexpected second alert %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	admin := func(method string, body interface{}) (*httptest.ResponseRecorder, LogLevelResponse) {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, "/api/admin/loglevel", bytes.NewBuffer(b))
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		var resp LogLevelResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	if rec, _ := admin(http.MethodGet, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("without levels: expected 404, got %d", rec.Code)
+	}
+
+	levels := logging.NewLevels(slog.LevelInfo)
+	h.logLevels = levels
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(&buf, "json", levels))
+
+	for _, bad := range []map[string]interface{}{
+		{"level": "loud"},
+		{"level": "info", "components": map[string]string{"relay": "debug"}},
+		{"level": "info", "components": map[string]string{"hub": "chatty"}},
+		{"level": "info", "revert_after": -1},
+		{"level": "info", "revert_after": 86401},
+	} {
+		if rec, _ := admin(http.MethodPut, bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %v: expected 400, got %d", bad, rec.Code)
 		}
+	}
+
+	rec, resp := admin(http.MethodPut, map[string]interface{}{
+		"level": "WARN", "components": map[string]string{"handler": "debug", "hub": "error"}, "revert_after": 60,
 	})
+	if rec.Code != http.StatusOK || resp.Level != "warn" || resp.Components["handler"] != "debug" || resp.Components["hub"] != "error" || resp.RevertAt == 0 {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, resp := admin(http.MethodGet, nil); resp.Level != "warn" || len(resp.Components) != 2 {
+		t.Errorf("GET: %+v", resp)
+	}
 
-	t.Run("AuthorizedWebSocket", func(t *testing.T) {
+	// This test runs in the handler package, so its records are the
+	// handler component's.
+	buf.Reset()
+	slog.Debug("relay detail")
+	if !bytes.Contains(buf.Bytes(), []byte("relay detail")) {
+		t.Errorf("handler=debug dropped a debug record: %q", buf.String())
+	}
+
+	if _, resp := admin(http.MethodPut, map[string]string{"level": "info"}); resp.Level != "info" || len(resp.Components) != 0 || resp.RevertAt != 0 {
+		t.Errorf("PUT without overrides: %+v", resp)
+	}
+	buf.Reset()
+	slog.Debug("relay detail")
+	if buf.Len() != 0 {
+		t.Errorf("debug record logged at info: %q", buf.String())
+	}
+}
+
+func TestAdminFeatures(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	admin := func(method string, body interface{}) (*httptest.ResponseRecorder, FeaturesResponse) {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, "/api/admin/features", bytes.NewBuffer(b))
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		var resp FeaturesResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+	serverInfo := func() map[string]bool {
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/server-info", nil))
+		var resp ServerInfoResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Features
+	}
+	joinRoom := func() *httptest.ResponseRecorder {
 		device := newTestDevice(t)
 		enrollTestDevice(t, h, device)
 		ticket := issueDeviceTicket(t, h, device)
+		sessionToken, _ := h.tokenManager.SignSession("test-sid", device.id, auth.ScopeUser, time.Minute)
+		req := httptest.NewRequest(http.MethodGet, "/ws?room=work", nil)
+		req.AddCookie(&http.Cookie{Name: "device_ticket", Value: ticket})
+		req.AddCookie(&http.Cookie{Name: "ff_session", Value: sessionToken})
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
 
-		sessionToken, _ := h.tokenManager.Sign("test-sid", auth.TokenVersionSession, time.Minute)
+	if rec, _ := admin(http.MethodGet, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("without flags: expected 404, got %d", rec.Code)
+	}
+	if f := serverInfo(); len(f) != len(feature.Known) || !f[feature.Rooms] {
+		t.Errorf("server-info features without flags = %v", f)
+	}
 
-		server := httptest.NewServer(h.Routes())
-		defer server.Close()
+	flags, err := feature.New(h.store, map[string]bool{feature.Rooms: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.flags = flags
 
-		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
-		header := http.Header{}
-		header.Set("Cookie", fmt.Sprintf("ff_session=%s; device_ticket=%s", sessionToken, ticket))
+	rec, resp := admin(http.MethodGet, nil)
+	if rec.Code != http.StatusOK || len(resp.Flags) != len(feature.Known) {
+		t.Fatalf("GET: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, f := range resp.Flags {
+		if f.Name == feature.Rooms && (!f.Enabled || f.Source != feature.SourceEnv) {
+			t.Errorf("rooms = %+v", f)
+		}
+	}
+	if rec, _ := admin(http.MethodPut, map[string]interface{}{"flags": map[string]bool{feature.Rooms: false}}); rec.Code != http.StatusConflict {
+		t.Errorf("env flag: expected 409, got %d", rec.Code)
+	}
 
-		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	flags, err = feature.New(h.store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.flags = flags
+
+	if rec, _ := admin(http.MethodPut, map[string]interface{}{"flags": map[string]bool{"teleport": true, feature.Rooms: false}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown flag: expected 400, got %d", rec.Code)
+	}
+	if f := serverInfo(); !f[feature.Rooms] {
+		t.Errorf("rejected PUT changed rooms: %v", f)
+	}
+
+	rec, resp = admin(http.MethodPut, map[string]interface{}{"flags": map[string]bool{feature.Rooms: false}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body.String())
+	}
+	if f := serverInfo(); f[feature.Rooms] {
+		t.Errorf("server-info features = %v", f)
+	}
+	if v, _ := h.store.GetConfig(store.ConfigKeyFeaturePrefix + feature.Rooms); v != "false" {
+		t.Errorf("stored rooms = %q", v)
+	}
+
+	rec = joinRoom()
+	var apiResp APIResponse
+	json.NewDecoder(rec.Body).Decode(&apiResp)
+	if rec.Code != http.StatusForbidden || apiResp.Error == nil || apiResp.Error.Code != "FEATURE_DISABLED" {
+		t.Errorf("room with rooms off: expected 403 FEATURE_DISABLED, got %d %#v", rec.Code, apiResp.Error)
+	}
+
+	if rec, _ := admin(http.MethodPut, map[string]interface{}{"flags": map[string]interface{}{feature.Rooms: nil}}); rec.Code != http.StatusOK {
+		t.Fatalf("reset rooms: %d", rec.Code)
+	}
+	if rec := joinRoom(); rec.Code == http.StatusForbidden {
+		t.Errorf("room with rooms reset to default: got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAdminDeviceWake(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+	h.waker = wake.New(h.store, time.Minute)
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+
+	woken := make(chan string, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		woken <- body["device_id"]
+	}))
+	defer hook.Close()
+
+	admin := func(method string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, "/api/admin/devices/"+device.id+"/wake", bytes.NewBuffer(b))
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, bad := range []map[string]string{
+		{},
+		{"mac": "not-a-mac"},
+		{"broadcast": "192.168.1.255:9", "webhook": hook.URL},
+		{"mac": "00:11:22:33:44:55", "broadcast": "nas.lan:9"},
+		{"webhook": "file:///etc/passwd"},
+	} {
+		if rec := admin(http.MethodPut, bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %v: expected 400, got %d", bad, rec.Code)
+		}
+	}
+
+	rec := admin(http.MethodPut, map[string]string{"mac": "00-11-22-AA-BB-CC", "broadcast": "127.0.0.1:9", "webhook": hook.URL})
+	var target WakeTargetResponse
+	json.Unmarshal(rec.Body.Bytes(), &target)
+	if rec.Code != http.StatusOK || target.MAC != "00:11:22:aa:bb:cc" {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = admin(http.MethodGet, nil)
+	json.Unmarshal(rec.Body.Bytes(), &target)
+	if target.Webhook != hook.URL || target.Broadcast != "127.0.0.1:9" {
+		t.Errorf("GET: %s", rec.Body.String())
+	}
+
+	// A push to the offline device wakes it and tells the caller when to
+	// retry.
+	rec = postJSON(h, "/api/admin/app-tokens", map[string]interface{}{"name": "wake", "device_ids": []string{device.id}}, true)
+	var created AppTokenCreatedResponse
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	req := httptest.NewRequest(http.MethodPost, "/api/push", strings.NewReader(`{"text":"hi"}`))
+	req.Header.Set("Authorization", "Bearer "+created.Token)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "DEVICE_WAKING") || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("push: %d %q %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+	select {
+	case id := <-woken:
+		if id != device.id {
+			t.Errorf("webhook woke %q", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("webhook was not called")
+	}
+
+	if rec := admin(http.MethodDelete, nil); rec.Code != http.StatusOK {
+		t.Errorf("DELETE: %d", rec.Code)
+	}
+	rec = admin(http.MethodGet, nil)
+	target = WakeTargetResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &target)
+	if target.MAC != "" || target.Webhook != "" {
+		t.Errorf("target should be gone: %s", rec.Body.String())
+	}
+}
+
+func TestAppTokenPush(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	other := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	enrollTestDevice(t, h, other)
+	ticket := issueDeviceTicket(t, h, device)
+	session, _ := h.tokenManager.SignSession("push-sid", device.id, auth.ScopeUser, time.Hour)
+
+	admin := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(b))
+		setAdmin(h, req)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	push := func(token string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/api/push", bytes.NewBuffer(b))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := admin(http.MethodPost, "/api/admin/app-tokens", map[string]interface{}{"name": "washer", "device_ids": []string{device.id}})
+	var created AppTokenCreatedResponse
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(created.Token, auth.AppTokenPrefix) {
+		t.Fatalf("Create failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := admin(http.MethodPost, "/api/admin/app-tokens", map[string]interface{}{"name": "washer", "device_ids": []string{device.id}}); rec.Code != http.StatusConflict {
+		t.Errorf("Duplicate name should conflict, got %d", rec.Code)
+	}
+	if rec := admin(http.MethodPost, "/api/admin/app-tokens", map[string]interface{}{"name": "x", "device_ids": []string{"unknown-device-id"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("Unknown device should be rejected, got %d", rec.Code)
+	}
+
+	if rec := push(created.Token, map[string]string{"text": "done"}); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while the device is offline, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := push(created.Token, map[string]string{"device_id": other.id, "text": "done"}); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a device outside the token, got %d", rec.Code)
+	}
+	if rec := push("ffapp_bogus", map[string]string{"text": "done"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown token, got %d", rec.Code)
+	}
+	// An app token is not an API token and cannot open a WebSocket.
+	req := httptest.NewRequest(http.MethodGet, "/api/presence", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Token)
+	rec = httptest.NewRecorder()
+	h.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("App token should not reach /api/presence, got %d", rec.Code)
+	}
+
+	server := httptest.NewServer(h.Routes())
+	defer server.Close()
+	header := http.Header{}
+	header.Add("Cookie", "device_ticket="+ticket+"; ff_session="+session)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+	if err != nil {
+		t.Fatalf("WebSocket dial failed: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	rec = push(created.Token, map[string]string{"text": "Washing machine finished"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Push failed: %d %s", rec.Code, rec.Body.String())
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			status := 0
-			if resp != nil {
-				status = resp.StatusCode
-			}
-			t.Fatalf("WebSocket dial failed: %v (status=%d)", err, status)
+			t.Fatalf("Did not receive the push: %v", err)
 		}
-		conn.Close()
+		var event struct {
+			T string             `json:"t"`
+			V realtime.PushValue `json:"v"`
+		}
+		json.Unmarshal(data, &event)
+		if event.T != realtime.EventPush {
+			continue
+		}
+		if event.V.From != "washer" || event.V.Text != "Washing machine finished" {
+			t.Errorf("Unexpected push: %+v", event.V)
+		}
+		break
+	}
+
+	if rec := admin(http.MethodDelete, "/api/admin/app-tokens/"+created.ID, nil); rec.Code != http.StatusOK {
+		t.Fatalf("Revoke failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := push(created.Token, map[string]string{"text": "done"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Revoked token should be rejected, got %d", rec.Code)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	h, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	device := newTestDevice(t)
+	enrollTestDevice(t, h, device)
+	ticket := issueDeviceTicket(t, h, device)
+
+	// A provider that signs an ES256 ID token with the current nonce for
+	// any code.
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var idp *httptest.Server
+	var nonce string
+	sub, email := "u1", "alice@example.com"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "EC", "crv": "P-256", "kid": "k1",
+			"x": base64.RawURLEncoding.EncodeToString(pad32(key.X.Bytes())),
+			"y": base64.RawURLEncoding.EncodeToString(pad32(key.Y.Bytes())),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k1"})
+		payload, _ := json.Marshal(map[string]interface{}{
+			"iss": idp.URL, "sub": sub, "aud": "fileflow", "nonce": nonce,
+			"exp": time.Now().Add(time.Hour).Unix(), "email": email, "email_verified": true,
+		})
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed + "." + signNonce(t, key, []byte(signed))})
 	})
+	idp = httptest.NewServer(mux)
+	defer idp.Close()
+
+	h.oidc = auth.NewOIDCProvider(auth.OIDCConfig{
+		Issuer:      idp.URL,
+		ClientID:    "fileflow",
+		RedirectURL: "https://app.example/auth/oidc/callback",
+	})
+
+	get := func(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		h.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	cookieNamed := func(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == name && c.Value != "" {
+				return c
+			}
+		}
+		return nil
+	}
+	deviceTicket := &http.Cookie{Name: "device_ticket", Value: ticket}
+
+	var session AuthedResponse
+	json.Unmarshal(get("/api/session").Body.Bytes(), &session)
+	if !session.OIDC {
+		t.Error("Signed-out session check should advertise OIDC")
+	}
+
+	if rec := get("/auth/oidc/login"); rec.Header().Get("Location") != "/?login_error=device_ticket" {
+		t.Errorf("Login without a device ticket should bounce back, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	startFor := func(ticket *http.Cookie) (*http.Cookie, string) {
+		t.Helper()
+		rec := get("/auth/oidc/login", ticket)
+		loc, _ := url.Parse(rec.Header().Get("Location"))
+		stateCookie := cookieNamed(rec, "ff_oidc")
+		if rec.Code != http.StatusFound || !strings.HasPrefix(loc.String(), idp.URL+"/authorize") || stateCookie == nil {
+			t.Fatalf("Login should redirect to the provider: %d %s", rec.Code, loc)
+		}
+		nonce = loc.Query().Get("nonce")
+		return stateCookie, loc.Query().Get("state")
+	}
+	start := func() (*http.Cookie, string) {
+		t.Helper()
+		return startFor(deviceTicket)
+	}
+
+	stateCookie, state := start()
+	if rec := get("/auth/oidc/callback?code=c&state=forged", stateCookie); rec.Header().Get("Location") != "/?login_error=oidc_state" {
+		t.Errorf("Mismatched state should be refused, got %s", rec.Header().Get("Location"))
+	}
+
+	// Without OIDC_ALLOWED nobody gets in.
+	stateCookie, state = start()
+	if rec := get("/auth/oidc/callback?code=c&state="+url.QueryEscape(state), stateCookie); rec.Header().Get("Location") != "/?login_error=oidc_not_allowed" {
+		t.Errorf("Empty OIDC_ALLOWED should refuse every account, got %s", rec.Header().Get("Location"))
+	}
+
+	h.oidcAllowed = []string{"alice@example.com"}
+	stateCookie, state = start()
+	rec := get("/auth/oidc/callback?code=c&state="+url.QueryEscape(state), stateCookie)
+	sessionCookie := cookieNamed(rec, "ff_session")
+	if rec.Header().Get("Location") != "/" || sessionCookie == nil {
+		t.Fatalf("Callback should start a session: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	json.Unmarshal(get("/api/session", deviceTicket, sessionCookie).Body.Bytes(), &session)
+	if !session.Authed {
+		t.Error("Session from OIDC login should be valid for the device")
+	}
+
+	h.oidcAllowed = []string{"@corp.example"}
+	stateCookie, state = start()
+	rec = get("/auth/oidc/callback?code=c&state="+url.QueryEscape(state), stateCookie)
+	if rec.Header().Get("Location") != "/?login_error=oidc_not_allowed" || cookieNamed(rec, "ff_session") != nil {
+		t.Errorf("Account outside OIDC_ALLOWED should be refused, got %s", rec.Header().Get("Location"))
+	}
+
+	// SSO does not stand in for a device's TOTP.
+	h.oidcAllowed = []string{"@example.com"}
+	if err := h.store.SetTOTPSeed(device.id, []byte("sealed"), time.Now().UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.store.UseTOTPStep(device.id, 1); err != nil {
+		t.Fatal(err)
+	}
+	stateCookie, state = start()
+	rec = get("/auth/oidc/callback?code=c&state="+url.QueryEscape(state), stateCookie)
+	if rec.Header().Get("Location") != "/?login_error=totp_required" || cookieNamed(rec, "ff_session") != nil {
+		t.Errorf("Device with TOTP should be refused OIDC login, got %s", rec.Header().Get("Location"))
+	}
+
+	// Each allowed account signs in as one user, and only on that user's
+	// devices.
+	userTicket := func(userID string) *http.Cookie {
+		t.Helper()
+		if err := h.store.CreateUser(&store.User{UserID: userID, Name: userID, SecretHash: "x", CreatedAt: 1}); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		d := newTestDevice(t)
+		jwk, _ := json.Marshal(d.jwk)
+		if err := h.store.AddDevice(&store.Device{DeviceID: d.id, PubJWKJSON: string(jwk), CreatedAt: 1, UserID: userID}); err != nil {
+			t.Fatalf("Failed to add device: %v", err)
+		}
+		return &http.Cookie{Name: "device_ticket", Value: issueDeviceTicket(t, h, d)}
+	}
+	aliceTicket := userTicket("u-alice")
+	bobTicket := userTicket("u-bob")
+	h.oidcAllowed = []string{"alice@example.com=u-alice", "sub:bob-sub=u-bob", "@example.com"}
+
+	stateCookie, state = startFor(aliceTicket)
+	rec = get("/auth/oidc/callback?code=c&state="+url.QueryEscape(state), stateCookie)
+	if rec.Header().Get("Location") != "/" || cookieNamed(rec, "ff_session") == nil {
+		t.Errorf("Alice should sign in to her own device: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	stateCookie, state = startFor(bobTicket)
+	rec = get("/auth/oidc/callback?code=c&state="+url.QueryEscape(state), stateCookie)
+	if rec.Code != http.StatusForbidden || cookieNamed(rec, "ff_session") != nil {
+		t.Errorf("Alice's account should be refused on Bob's device, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	sub, email = "bob-sub", "bob@elsewhere.example"
+	stateCookie, state = startFor(bobTicket)
+	rec = get("/auth/oidc/callback?code=c&state="+url.QueryEscape(state), stateCookie)
+	if rec.Header().Get("Location") != "/" || cookieNamed(rec, "ff_session") == nil {
+		t.Errorf("Bob's subject should sign in to his own device: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	stateCookie, state = startFor(aliceTicket)
+	rec = get("/auth/oidc/callback?code=c&state="+url.QueryEscape(state), stateCookie)
+	if rec.Code != http.StatusForbidden || cookieNamed(rec, "ff_session") != nil {
+		t.Errorf("Bob's subject should be refused on Alice's device, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// A domain entry without a user maps to the default account, not to
+	// whichever user owns the device.
+	sub, email = "carol-sub", "carol@example.com"
+	stateCookie, state = startFor(aliceTicket)
+	rec = get("/auth/oidc/callback?code=c&state="+url.QueryEscape(state), stateCookie)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Default-account login should be refused on Alice's device, got %d", rec.Code)
+	}
 }
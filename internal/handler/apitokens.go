@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/logging"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+const maxAPITokenNameLen = 64
+
+var errMissingAPIToken = errors.New("missing api token")
+
+// apiTokenSession is the hub session ID of connections authorised with API
+// token id, so revoking the token can drop them.
+func apiTokenSession(id string) string {
+	return "api:" + id
+}
+
+// verifyAPIToken checks an "Authorization: Bearer ffat_…" header. It
+// returns errMissingAPIToken when there is none, so callers can fall back
+// to cookies, and errDeviceRevoked or errDeviceDisabled with the token when
+// its device is gone or disabled.
+func (h *Handler) verifyAPIToken(r *http.Request) (*store.APIToken, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !auth.IsAPIToken(token) {
+		return nil, errMissingAPIToken
+	}
+
+	t, err := h.store.GetAPITokenByHash(auth.HashAPIToken(token))
+	if err != nil {
+		return nil, err
+	}
+	device, err := h.store.GetDevice(t.DeviceID)
+	if err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			return t, errDeviceRevoked
+		}
+		return nil, err
+	}
+	if device.Disabled {
+		return t, errDeviceDisabled
+	}
+
+	if err := h.store.TouchAPIToken(t.ID, time.Now().UnixMilli()); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record API token use", "err", err)
+	}
+	logging.SetDeviceID(r.Context(), t.DeviceID)
+	return t, nil
+}
+
+// handleAPITokenList lists the API tokens of the signed-in device. Only a
+// browser session can manage tokens; an API token cannot mint or list
+// others.
+func (h *Handler) handleAPITokenList(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := h.requireDeviceSession(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := h.store.ListAPITokens(deviceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list API tokens", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list tokens")
+		return
+	}
+
+	resp := APITokenListResponse{Tokens: make([]APITokenInfo, 0, len(tokens))}
+	for _, t := range tokens {
+		resp.Tokens = append(resp.Tokens, APITokenInfo{
+			ID:         t.ID,
+			Name:       t.Name,
+			Scope:      t.Scope,
+			CreatedAt:  t.CreatedAt,
+			LastUsedAt: t.LastUsedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleAPITokenCreate mints an API token for the signed-in device.
+func (h *Handler) handleAPITokenCreate(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := h.requireDeviceSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req APITokenCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxAPITokenNameLen {
+		writeError(w, http.StatusBadRequest, "INVALID_TOKEN_NAME", "name must be 1-64 characters")
+		return
+	}
+	scope := req.Scope
+	switch scope {
+	case "":
+		scope = auth.ScopeUser
+	case auth.ScopeUser, auth.ScopeReadOnly:
+	default:
+		writeError(w, http.StatusBadRequest, "INVALID_SCOPE", "scope must be user or readonly")
+		return
+	}
+
+	token, hash, err := auth.GenerateAPIToken()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate API token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create token")
+		return
+	}
+	t := &store.APIToken{
+		ID:        uuid.NewString(),
+		DeviceID:  deviceID,
+		Name:      name,
+		Scope:     scope,
+		Hash:      hash,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if err := h.store.CreateAPIToken(t); err != nil {
+		if errors.Is(err, store.ErrAPITokenExists) {
+			writeError(w, http.StatusConflict, "TOKEN_EXISTS", "This device already has a token with that name")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to store API token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create token")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "API token created", "name", name, "scope", scope)
+	writeJSON(w, http.StatusOK, APITokenCreatedResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scope:     t.Scope,
+		CreatedAt: t.CreatedAt,
+		Token:     token,
+	})
+}
+
+// handleAPIToken revokes the API token at /api/tokens/{id} and drops the
+// WebSocket connections it opened.
+func (h *Handler) handleAPIToken(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := h.requireDeviceSession(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := h.store.DeleteAPIToken(deviceID, id); err != nil {
+		if errors.Is(err, store.ErrAPITokenNotFound) {
+			writeError(w, http.StatusNotFound, "TOKEN_NOT_FOUND", "Token not found")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to revoke API token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to revoke token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, APITokenRevokedResponse{
+		ID:                id,
+		ConnectionsClosed: h.hub.CloseSession(apiTokenSession(id)),
+	})
+}
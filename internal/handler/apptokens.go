@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/realtime"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+const (
+	maxAppTokenDevices = 16
+	// maxPushText bounds the text of one /api/push call.
+	maxPushText = 64 * 1024
+)
+
+var errMissingAppToken = errors.New("missing app token")
+
+// verifyAppToken checks an "Authorization: Bearer ffapp_…" header. It
+// returns errMissingAppToken when there is none.
+func (h *Handler) verifyAppToken(r *http.Request) (*store.AppToken, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !auth.IsAppToken(token) {
+		return nil, errMissingAppToken
+	}
+
+	t, err := h.store.GetAppTokenByHash(auth.HashAPIToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if err := h.store.TouchAppToken(t.ID, time.Now().UnixMilli()); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record app token use", "err", err)
+	}
+	return t, nil
+}
+
+// handlePush delivers text from an app token to one of its devices as a
+// push event. The device must be online; nothing is queued.
+func (h *Handler) handlePush(w http.ResponseWriter, r *http.Request) {
+	t, err := h.verifyAppToken(r)
+	if err != nil {
+		if !errors.Is(err, errMissingAppToken) && !errors.Is(err, store.ErrAppTokenNotFound) {
+			slog.ErrorContext(r.Context(), "Failed to look up app token", "err", err)
+		}
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Invalid app token")
+		return
+	}
+	if h.pushLimiter != nil {
+		if ok, st := h.pushLimiter.Check(t.ID); !ok {
+			writeRateLimited(w, st, "Too many pushes for this token")
+			return
+		}
+	}
+
+	var req PushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+	if req.Text == "" || len(req.Text) > maxPushText {
+		writeError(w, http.StatusBadRequest, "INVALID_TEXT", "text must be 1 byte to 64 KiB")
+		return
+	}
+	deviceID := req.DeviceID
+	if deviceID == "" && len(t.DeviceIDs) == 1 {
+		deviceID = t.DeviceIDs[0]
+	}
+	allowed := false
+	for _, id := range t.DeviceIDs {
+		allowed = allowed || id == deviceID
+	}
+	if !allowed {
+		writeError(w, http.StatusForbidden, "DEVICE_NOT_ALLOWED", "This token cannot push to that device")
+		return
+	}
+
+	device, err := h.store.GetDevice(deviceID)
+	if err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			writeError(w, http.StatusNotFound, "DEVICE_NOT_FOUND", "Device not found")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to load device", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load device")
+		return
+	}
+	if device.Disabled {
+		writeError(w, http.StatusForbidden, "DEVICE_DISABLED", "Device is disabled")
+		return
+	}
+
+	pushID := uuid.NewString()
+	out, err := realtime.NewEvent(realtime.EventPush, realtime.PushValue{PushID: pushID, From: t.Name, Text: req.Text}).Marshal()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to encode push")
+		return
+	}
+	switch status := h.hub.Push(deviceID, out); status {
+	case realtime.DeliveryDelivered:
+		writeJSON(w, http.StatusOK, PushResponse{PushID: pushID, DeviceID: deviceID, Status: status})
+	case realtime.DeliveryOffline:
+		if h.waker != nil {
+			if wait := h.waker.WakeDevice(deviceID); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, http.StatusConflict, "DEVICE_WAKING", "Device is being woken; retry after Retry-After seconds")
+				return
+			}
+		}
+		writeError(w, http.StatusConflict, "DEVICE_OFFLINE", "Device is not connected")
+	default:
+		writeError(w, http.StatusServiceUnavailable, "DELIVERY_FAILED", "Device is not keeping up; try again")
+	}
+}
+
+// handleAdminAppTokenList lists app tokens.
+func (h *Handler) handleAdminAppTokenList(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	tokens, err := h.store.ListAppTokens()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list app tokens", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list tokens")
+		return
+	}
+
+	resp := AppTokenListResponse{Tokens: make([]AppTokenInfo, 0, len(tokens))}
+	for _, t := range tokens {
+		resp.Tokens = append(resp.Tokens, AppTokenInfo{
+			ID:         t.ID,
+			Name:       t.Name,
+			DeviceIDs:  t.DeviceIDs,
+			CreatedAt:  t.CreatedAt,
+			LastUsedAt: t.LastUsedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleAdminAppTokenCreate mints an app token.
+func (h *Handler) handleAdminAppTokenCreate(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	var req AppTokenCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxAPITokenNameLen {
+		writeError(w, http.StatusBadRequest, "INVALID_TOKEN_NAME", "name must be 1-64 characters")
+		return
+	}
+	if len(req.DeviceIDs) == 0 || len(req.DeviceIDs) > maxAppTokenDevices {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICES", "device_ids must list 1-16 devices")
+		return
+	}
+	for _, id := range req.DeviceIDs {
+		if _, err := h.store.GetDevice(id); err != nil {
+			if errors.Is(err, store.ErrDeviceNotFound) {
+				writeError(w, http.StatusBadRequest, "UNKNOWN_DEVICE", "Unknown device "+id)
+				return
+			}
+			slog.ErrorContext(r.Context(), "Failed to load device", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create token")
+			return
+		}
+	}
+
+	token, hash, err := auth.GenerateAppToken()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate app token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create token")
+		return
+	}
+	t := &store.AppToken{
+		ID:        uuid.NewString(),
+		Name:      name,
+		DeviceIDs: req.DeviceIDs,
+		Hash:      hash,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	if err := h.store.CreateAppToken(t); err != nil {
+		if errors.Is(err, store.ErrAppTokenExists) {
+			writeError(w, http.StatusConflict, "TOKEN_EXISTS", "An app token with that name already exists")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to store app token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create token")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "App token created", "name", name, "devices", len(t.DeviceIDs))
+	writeJSON(w, http.StatusOK, AppTokenCreatedResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		DeviceIDs: t.DeviceIDs,
+		CreatedAt: t.CreatedAt,
+		Token:     token,
+	})
+}
+
+// handleAdminAppToken revokes the app token at /api/admin/app-tokens/{id}.
+func (h *Handler) handleAdminAppToken(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := h.store.DeleteAppToken(id); err != nil {
+		if errors.Is(err, store.ErrAppTokenNotFound) {
+			writeError(w, http.StatusNotFound, "TOKEN_NOT_FOUND", "Token not found")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to revoke app token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to revoke token")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "App token revoked", "token_id", id)
+	writeJSON(w, http.StatusOK, AppTokenRevokedResponse{ID: id, Revoked: true})
+}
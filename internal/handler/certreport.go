@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/certpin"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// handleCertReport checks the TLS certificate fingerprint a client saw on
+// its connection against the pinned ones. Mismatches are audited, logged
+// and sent to the alert webhook. It takes a device ticket and session or
+// an API token.
+func (h *Handler) handleCertReport(w http.ResponseWriter, r *http.Request) {
+	if h.certPins == nil {
+		writeError(w, http.StatusNotFound, "CERT_PINNING_DISABLED", "Certificate pinning is not configured")
+		return
+	}
+
+	deviceID, ok := h.requireDeviceOrToken(w, r)
+	if !ok {
+		return
+	}
+
+	var req CertReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+	fp, err := certpin.Normalize(req.Fingerprint)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_FINGERPRINT", "fingerprint must be a hex SHA-256 digest")
+		return
+	}
+
+	match, err := h.certPins.Match(fp)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load pinned certificates", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return
+	}
+	if match {
+		writeJSON(w, http.StatusOK, CertReportResponse{Match: true})
+		return
+	}
+
+	report := &store.CertReport{
+		DeviceID:    deviceID,
+		Fingerprint: fp,
+		IP:          getClientIP(r),
+		UserAgent:   r.UserAgent(),
+		CreatedAt:   time.Now().UnixMilli(),
+	}
+	slog.WarnContext(r.Context(), "Certificate mismatch reported", "fingerprint", fp, "ip", report.IP)
+	if _, err := h.store.RecordCertReport(report); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record certificate report", "err", err)
+	}
+	if h.certAlerter != nil {
+		expected, _ := h.certPins.Expected()
+		h.certAlerter.Alert(certpin.Mismatch{
+			DeviceID:    deviceID,
+			Fingerprint: fp,
+			Expected:    expected,
+			IP:          report.IP,
+			ReportedAt:  report.CreatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, CertReportResponse{Match: false})
+}
+
+// handleAdminCertReports lists the most recent certificate mismatches.
+func (h *Handler) handleAdminCertReports(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+
+	reports, err := h.store.ListCertReports(limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list certificate reports", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list certificate reports")
+		return
+	}
+	writeJSON(w, http.StatusOK, CertReportsResponse{Reports: reports})
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/realtime"
+)
+
+// handleAdminDeviceCommands reads (GET) or replaces (PUT) the command
+// actions a device accepts from other devices over the realtime channel.
+func (h *Handler) handleAdminDeviceCommands(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdminMethod(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req AllowedCommandsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+			return
+		}
+		for _, action := range req.Commands {
+			if !realtime.IsKnownCmd(action) {
+				writeError(w, http.StatusBadRequest, "UNKNOWN_COMMAND", "Unknown command: "+action)
+				return
+			}
+		}
+		if err := h.store.SetAllowedCommands(deviceID, req.Commands); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to set allowed commands", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update commands")
+			return
+		}
+	}
+
+	commands, err := h.store.AllowedCommands(deviceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load allowed commands", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load commands")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, AllowedCommandsResponse{DeviceID: deviceID, Commands: commands})
+}
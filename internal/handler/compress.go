@@ -0,0 +1,310 @@
+package handler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encoder is a content coding CompressMiddleware can apply.
+type Encoder struct {
+	// Name is the Content-Encoding token, such as gzip.
+	Name string
+	// New wraps w. Closing the writer must flush everything to w.
+	New func(w io.Writer) io.WriteCloser
+}
+
+// GzipEncoder returns the gzip Encoder at level, which must be valid for
+// gzip.NewWriterLevel. Writers are pooled.
+func GzipEncoder(level int) (Encoder, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return Encoder{}, err
+	}
+	pool := &sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(io.Discard, level)
+		return w
+	}}
+	return Encoder{Name: "gzip", New: func(w io.Writer) io.WriteCloser {
+		gz := pool.Get().(*gzip.Writer)
+		gz.Reset(w)
+		return &pooledGzip{Writer: gz, pool: pool}
+	}}, nil
+}
+
+type pooledGzip struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (p *pooledGzip) Close() error {
+	err := p.Writer.Close()
+	p.pool.Put(p.Writer)
+	return err
+}
+
+// DefaultCompressTypes are the media types compressed unless configured
+// otherwise: text, JSON and the script and markup types of the web client.
+var DefaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/manifest+json",
+	"image/svg+xml",
+}
+
+// DefaultCompressMinSize is the smallest body worth compressing; below it
+// the gzip framing can outweigh the saving.
+const DefaultCompressMinSize = 1024
+
+// Compression configures CompressMiddleware.
+type Compression struct {
+	// Encoders in the server's order of preference. Empty disables
+	// compression.
+	Encoders []Encoder
+	// MinSize is the smallest body, in bytes, that is compressed.
+	MinSize int
+	// Types are media types to compress. "text/*" matches every subtype.
+	Types []string
+}
+
+// ParseCompression builds a Compression from a comma-separated list of
+// codings in order of preference. "off" or an empty list disables it.
+// Only gzip is built in.
+func ParseCompression(codings string, level, minSize int, types []string) (Compression, error) {
+	c := Compression{MinSize: minSize, Types: types}
+	for _, name := range strings.Split(codings, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "", "off":
+			continue
+		case "gzip":
+			enc, err := GzipEncoder(level)
+			if err != nil {
+				return Compression{}, fmt.Errorf("gzip: %w", err)
+			}
+			c.Encoders = append(c.Encoders, enc)
+		default:
+			return Compression{}, fmt.Errorf("content coding %q is not supported; use gzip or off", name)
+		}
+	}
+	if len(c.Types) == 0 {
+		c.Types = DefaultCompressTypes
+	}
+	return c, nil
+}
+
+// compressible reports whether a Content-Type value is on c.Types.
+func (c Compression) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.Types {
+		if t == mt || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate picks the first of c.Encoders that Accept-Encoding allows.
+func (c Compression) negotiate(accept string) *Encoder {
+	if accept == "" {
+		return nil
+	}
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[name] = weight
+	}
+	for i, enc := range c.Encoders {
+		weight, ok := q[enc.Name]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > 0 {
+			return &c.Encoders[i]
+		}
+	}
+	return nil
+}
+
+// CompressMiddleware compresses response bodies of the configured types
+// once they reach MinSize, with the client's most preferred coding that the
+// server offers. Responses of those types carry Vary: Accept-Encoding
+// whether or not they were compressed. WebSocket upgrades, HEAD and Range
+// requests, and responses that are already encoded or marked no-transform
+// pass through.
+func CompressMiddleware(c Compression) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(c.Encoders) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/ws" || r.Header.Get("Upgrade") != "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, c: c, enc: c.negotiate(r.Header.Get("Accept-Encoding")), status: http.StatusOK}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressWriter holds back the start of a body until it knows whether the
+// response will be compressed: when MinSize bytes have been written, the
+// handler flushes, or it returns.
+type compressWriter struct {
+	http.ResponseWriter
+	c   Compression
+	enc *Encoder
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	w           io.WriteCloser // the encoder, once compressing
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader || cw.decided {
+		return
+	}
+	if code < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	cw.wroteHeader = true
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	cw.wroteHeader = true
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.c.MinSize {
+			return len(p), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.w != nil {
+		return cw.w.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// decide writes the header, compressing if the response qualifies and big
+// is true, and then whatever body was held back.
+func (cw *compressWriter) decide(big bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	eligible := cw.status != http.StatusNoContent && cw.status != http.StatusNotModified && cw.status != http.StatusPartialContent &&
+		h.Get("Content-Encoding") == "" && !strings.Contains(h.Get("Cache-Control"), "no-transform") &&
+		cw.c.compressible(h.Get("Content-Type"))
+	if eligible && !headerHasToken(h, "Vary", "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	if eligible && big && cw.enc != nil {
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		h.Set("Content-Encoding", cw.enc.Name)
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.ResponseWriter.WriteHeader(cw.status)
+		cw.w = cw.enc.New(cw.ResponseWriter)
+		_, err := cw.w.Write(cw.buf)
+		cw.buf = nil
+		return err
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	var err error
+	if len(cw.buf) > 0 {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// Close sends anything held back and finishes the encoded stream.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			return nil
+		}
+		if err := cw.decide(len(cw.buf) >= cw.c.MinSize); err != nil {
+			return err
+		}
+	}
+	if cw.w != nil {
+		return cw.w.Close()
+	}
+	return nil
+}
+
+// Flush sends what has been written so far, deciding on compression with
+// the bytes at hand.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.wroteHeader = true
+		cw.decide(len(cw.buf) >= cw.c.MinSize)
+	}
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying response writer does not support Hijack")
+	}
+	return hijacker.Hijack()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// headerHasToken reports whether a comma-separated header lists token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
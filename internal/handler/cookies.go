@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+)
+
+// Logical names of the auth cookies. On the wire they carry hostPrefix when
+// host cookies are enabled.
+const (
+	cookieSession      = "ff_session"
+	cookieDeviceTicket = "device_ticket"
+	cookieOIDCState    = "ff_oidc"
+)
+
+// hostPrefix makes browsers refuse the cookie unless it is Secure, has
+// Path=/ and no Domain, so a sibling subdomain cannot plant or overwrite it.
+const hostPrefix = "__Host-"
+
+// cookieName returns the wire name for the logical cookie base.
+func (h *Handler) cookieName(base string) string {
+	if h.hostCookies {
+		return hostPrefix + base
+	}
+	return base
+}
+
+// readCookie returns the logical cookie base. The prefixed name wins; the
+// unprefixed one is only honoured while legacy cookies are accepted, so
+// browsers holding pre-migration cookies stay logged in.
+func (h *Handler) readCookie(r *http.Request, base string) (*http.Cookie, error) {
+	if c, err := r.Cookie(h.cookieName(base)); err == nil {
+		return c, nil
+	}
+	if h.hostCookies && h.legacyCookies {
+		return r.Cookie(base)
+	}
+	return nil, http.ErrNoCookie
+}
+
+// setCookie writes the logical cookie base and, once prefixed names are in
+// use, expires its legacy copy so the migration finishes on next issue.
+func (h *Handler) setCookie(w http.ResponseWriter, base, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.cookieName(base),
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: http.SameSiteStrictMode,
+	})
+	if h.hostCookies {
+		auth.ClearCookie(w, base, h.secureCookies)
+	}
+}
+
+// clearCookie expires both the prefixed and the legacy name.
+func (h *Handler) clearCookie(w http.ResponseWriter, base string) {
+	auth.ClearCookie(w, h.cookieName(base), h.secureCookies)
+	if h.hostCookies {
+		auth.ClearCookie(w, base, h.secureCookies)
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/limit"
+	"github.com/lixiansheng/fileflow/internal/realtime"
+)
+
+// Hub is the part of *realtime.Hub a Handler uses. Tests and embedders can
+// pass a fake, such as handlertest.Hub, to exercise handlers without a
+// running hub loop.
+type Hub interface {
+	// NewClient wraps an upgraded connection in a client of this hub.
+	NewClient(conn *websocket.Conn, deviceID, ip string, connLimiter *limit.ConnLimiter, rateLimit, maxMessageBytes int) *realtime.Client
+	// Attach registers client and starts serving its connection.
+	Attach(client *realtime.Client)
+	Push(deviceID string, message []byte) string
+	CloseSession(sessionID string) int
+	CloseDevice(deviceID string) int
+	DisableDevice(deviceID string) int
+	DeviceStats(deviceID string) realtime.DeviceStats
+	OnlineCountFor(userID string) int
+	LastHeartbeat() time.Time
+	OversizedFrames() uint64
+	Drops() realtime.DropStats
+	RoomCount() int
+}
+
+// TokenManager is the part of *auth.TokenManager a Handler uses. A fake,
+// such as handlertest.TokenManager, can stand in for it so tests need no
+// secret or real cryptography.
+type TokenManager interface {
+	Sign(sid string, version int, scope string, ttl time.Duration) (string, error)
+	SignSession(sid, deviceID, scope string, ttl time.Duration) (string, error)
+	SignTicket(deviceID, bind string, ttl time.Duration) (string, error)
+	SignOIDCState(state, deviceID string, ttl time.Duration) (string, error)
+	Renew(claims *auth.Claims, ttl, maxLifetime time.Duration) (string, *auth.Claims, error)
+	Verify(token string) (*auth.Claims, error)
+	VerifyWithVersion(token string, version int) (*auth.Claims, error)
+	VerifyScope(token string, version int, scopes ...string) (*auth.Claims, error)
+	BindingHash(v string) string
+	CheckBinding(claims *auth.Claims, v string) bool
+	RequestKey(sid string) []byte
+	OIDCVerifier(state string) string
+	OIDCNonce(state string) string
+	ReceiptSignature(payload []byte) string
+}
+
+var (
+	_ Hub          = (*realtime.Hub)(nil)
+	_ TokenManager = (*auth.TokenManager)(nil)
+)
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// handleAdminDeviceState disables or re-enables a device. A disabled device
+// keeps its enrollment but cannot attest, log in or connect, and its live
+// connections are dropped with realtime.CloseDeviceDisabled.
+func (h *Handler) handleAdminDeviceState(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	var req DeviceStateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Disabled == nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Body must be {\"disabled\": true|false}")
+		return
+	}
+
+	if err := h.store.SetDeviceDisabled(deviceID, *req.Disabled); err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			writeError(w, http.StatusNotFound, "DEVICE_NOT_FOUND", "Device not found")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to update device state", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update device")
+		return
+	}
+
+	resp := DeviceStateResponse{DeviceID: deviceID, Disabled: *req.Disabled}
+	if *req.Disabled {
+		resp.ConnectionsClosed = h.hub.DisableDevice(deviceID)
+		slog.InfoContext(r.Context(), "Device disabled", "device_id", deviceID, "connections_closed", resp.ConnectionsClosed)
+	} else {
+		slog.InfoContext(r.Context(), "Device enabled", "device_id", deviceID)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// maxLabelLen caps a device label in characters.
+const maxLabelLen = 64
+
+// handleAdminDeviceUpdate changes a device's metadata. Only fields present
+// in the body are updated; today that is just the label.
+func (h *Handler) handleAdminDeviceUpdate(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	var req DeviceUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Label == nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Body must be {\"label\": \"...\"}")
+		return
+	}
+	label := strings.TrimSpace(*req.Label)
+	if label == "" || utf8.RuneCountInString(label) > maxLabelLen || strings.IndexFunc(label, unicode.IsControl) >= 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_LABEL", "Label must be 1-64 characters without control characters")
+		return
+	}
+
+	if err := h.store.UpdateDevice(deviceID, store.DeviceUpdate{Label: &label}); err != nil {
+		switch {
+		case errors.Is(err, store.ErrDeviceNotFound):
+			writeError(w, http.StatusNotFound, "DEVICE_NOT_FOUND", "Device not found")
+		case errors.Is(err, store.ErrLabelExists):
+			writeError(w, http.StatusConflict, "LABEL_EXISTS", "Another device of this user already has that label")
+		default:
+			slog.ErrorContext(r.Context(), "Failed to update device", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update device")
+		}
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Device renamed", "device_id", deviceID)
+	writeJSON(w, http.StatusOK, DeviceUpdatedResponse{DeviceID: deviceID, Label: label})
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/lixiansheng/fileflow/internal/feature"
+)
+
+// handleAdminFeatures reads (GET) or changes (PUT) the feature flags.
+// Changes are stored, so they outlive a restart.
+func (h *Handler) handleAdminFeatures(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminMethod(w, r) {
+		return
+	}
+	if h.flags == nil {
+		writeError(w, http.StatusNotFound, "FEATURES_UNAVAILABLE", "Feature flags cannot be changed at runtime")
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req FeaturesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+			return
+		}
+		err := h.flags.Set(req.Flags)
+		switch {
+		case errors.Is(err, feature.ErrUnknownFlag):
+			writeError(w, http.StatusBadRequest, "UNKNOWN_FEATURE", err.Error())
+			return
+		case errors.Is(err, feature.ErrFlagLocked):
+			writeError(w, http.StatusConflict, "FEATURE_LOCKED", err.Error())
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Failed to store feature flags", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+			return
+		}
+		changed := make(map[string]string, len(req.Flags))
+		for name, v := range req.Flags {
+			changed[name] = "default"
+			if v != nil {
+				changed[name] = strconv.FormatBool(*v)
+			}
+		}
+		slog.WarnContext(r.Context(), "Feature flags changed", "flags", changed)
+	}
+
+	states := h.flags.States()
+	resp := FeaturesResponse{Flags: make([]FeatureFlag, len(states))}
+	for i, s := range states {
+		resp.Flags[i] = FeatureFlag{Name: s.Name, Description: s.Description, Enabled: s.Enabled, Default: s.Default, Source: s.Source}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
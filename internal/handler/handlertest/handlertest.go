@@ -0,0 +1,343 @@
+// Package handlertest provides test doubles for the dependencies of
+// handler.Handler that otherwise need goroutines or real cryptography: a
+// Hub that records what handlers ask of it, and a TokenManager that issues
+// opaque tokens from a map. Both are safe for concurrent use and start no
+// goroutines.
+package handlertest
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/limit"
+	"github.com/lixiansheng/fileflow/internal/realtime"
+)
+
+// Push is a message handed to Hub.Push.
+type Push struct {
+	DeviceID string
+	Message  []byte
+}
+
+// Hub is a handler.Hub that holds attached clients in a slice. It never
+// serves their connections, so a test drives the handler and then looks at
+// Clients, Pushes and the Closed fields.
+type Hub struct {
+	mu sync.Mutex
+
+	// Stats overrides DeviceStats for a device. Devices without an entry
+	// report one connection per attached client.
+	Stats map[string]realtime.DeviceStats
+	// Online is OnlineCountFor by user ID.
+	Online map[string]int
+	// Heartbeat is LastHeartbeat. Zero reports the current time, so the
+	// readiness check sees a live hub.
+	Heartbeat time.Time
+	// Oversized is OversizedFrames.
+	Oversized uint64
+	// Dropped is Drops.
+	Dropped realtime.DropStats
+	// Rooms is RoomCount.
+	Rooms int
+
+	Clients         []*realtime.Client
+	Pushes          []Push
+	ClosedSessions  []string
+	ClosedDevices   []string
+	DisabledDevices []string
+}
+
+// NewHub returns an empty Hub.
+func NewHub() *Hub {
+	return &Hub{
+		Stats:  make(map[string]realtime.DeviceStats),
+		Online: make(map[string]int),
+	}
+}
+
+// NewClient returns a client that belongs to no hub. Its pumps must not be
+// started; Attach does not start them.
+func (h *Hub) NewClient(conn *websocket.Conn, deviceID, ip string, connLimiter *limit.ConnLimiter, rateLimit, maxMessageBytes int) *realtime.Client {
+	return realtime.NewClient(nil, conn, deviceID, ip, connLimiter, rateLimit, maxMessageBytes)
+}
+
+// Attach records client.
+func (h *Hub) Attach(client *realtime.Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Clients = append(h.Clients, client)
+}
+
+// Push records the message and reports it delivered when deviceID has a
+// connection.
+func (h *Hub) Push(deviceID string, message []byte) string {
+	h.mu.Lock()
+	h.Pushes = append(h.Pushes, Push{DeviceID: deviceID, Message: message})
+	h.mu.Unlock()
+	if h.DeviceStats(deviceID).Connections == 0 {
+		return realtime.DeliveryOffline
+	}
+	return realtime.DeliveryDelivered
+}
+
+// CloseSession records sessionID and detaches its clients.
+func (h *Hub) CloseSession(sessionID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ClosedSessions = append(h.ClosedSessions, sessionID)
+	return h.detach(func(c *realtime.Client) bool { return c.SessionID == sessionID })
+}
+
+// CloseDevice records deviceID and detaches its clients.
+func (h *Hub) CloseDevice(deviceID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ClosedDevices = append(h.ClosedDevices, deviceID)
+	return h.detach(func(c *realtime.Client) bool { return c.DeviceID == deviceID })
+}
+
+// DisableDevice records deviceID and detaches its clients.
+func (h *Hub) DisableDevice(deviceID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.DisabledDevices = append(h.DisabledDevices, deviceID)
+	return h.detach(func(c *realtime.Client) bool { return c.DeviceID == deviceID })
+}
+
+// detach removes the clients match selects and returns how many there
+// were. h.mu must be held.
+func (h *Hub) detach(match func(*realtime.Client) bool) int {
+	kept := h.Clients[:0]
+	for _, c := range h.Clients {
+		if !match(c) {
+			kept = append(kept, c)
+		}
+	}
+	n := len(h.Clients) - len(kept)
+	h.Clients = kept
+	return n
+}
+
+// DeviceStats returns Stats[deviceID], or counts the device's clients.
+func (h *Hub) DeviceStats(deviceID string) realtime.DeviceStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if st, ok := h.Stats[deviceID]; ok {
+		return st
+	}
+	var st realtime.DeviceStats
+	sessions := make(map[string]bool)
+	for _, c := range h.Clients {
+		if c.DeviceID == deviceID {
+			st.Connections++
+			sessions[c.SessionID] = true
+		}
+	}
+	st.Sessions = len(sessions)
+	return st
+}
+
+// OnlineCountFor returns Online[userID].
+func (h *Hub) OnlineCountFor(userID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Online[userID]
+}
+
+// LastHeartbeat returns Heartbeat, or now when it is zero.
+func (h *Hub) LastHeartbeat() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.Heartbeat.IsZero() {
+		return time.Now()
+	}
+	return h.Heartbeat
+}
+
+// OversizedFrames returns Oversized.
+func (h *Hub) OversizedFrames() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Oversized
+}
+
+// Drops returns Dropped.
+func (h *Hub) Drops() realtime.DropStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Dropped
+}
+
+// RoomCount returns Rooms.
+func (h *Hub) RoomCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Rooms
+}
+
+// TokenManager is a handler.TokenManager whose tokens are opaque keys into
+// a map of claims. It checks expiry, revocation, version and scope like
+// auth.TokenManager, but signs and encrypts nothing.
+type TokenManager struct {
+	mu      sync.Mutex
+	next    int
+	claims  map[string]auth.Claims
+	revoked map[string]bool
+
+	// Now is the clock. Nil means time.Now.
+	Now func() time.Time
+}
+
+// NewTokenManager returns an empty TokenManager.
+func NewTokenManager() *TokenManager {
+	return &TokenManager{
+		claims:  make(map[string]auth.Claims),
+		revoked: make(map[string]bool),
+	}
+}
+
+func (tm *TokenManager) now() time.Time {
+	if tm.Now != nil {
+		return tm.Now()
+	}
+	return time.Now()
+}
+
+// Revoke makes every token with sid fail verification with
+// auth.ErrTokenRevoked.
+func (tm *TokenManager) Revoke(sid string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.revoked[sid] = true
+}
+
+// Issued returns the claims of every token issued so far, in no order.
+func (tm *TokenManager) Issued() []auth.Claims {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	out := make([]auth.Claims, 0, len(tm.claims))
+	for _, c := range tm.claims {
+		out = append(out, c)
+	}
+	return out
+}
+
+func (tm *TokenManager) issue(c auth.Claims) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.next++
+	token := "fake-token-" + strconv.Itoa(tm.next)
+	tm.claims[token] = c
+	return token
+}
+
+func (tm *TokenManager) Sign(sid string, version int, scope string, ttl time.Duration) (string, error) {
+	now := tm.now()
+	return tm.issue(auth.Claims{Ver: version, SID: sid, Iat: now.Unix(), Exp: now.Add(ttl).Unix(), Auth: now.Unix(), Scope: scope}), nil
+}
+
+func (tm *TokenManager) SignSession(sid, deviceID, scope string, ttl time.Duration) (string, error) {
+	now := tm.now()
+	return tm.issue(auth.Claims{Ver: auth.TokenVersionSession, SID: sid, Iat: now.Unix(), Exp: now.Add(ttl).Unix(), Auth: now.Unix(), DeviceID: deviceID, Scope: scope}), nil
+}
+
+func (tm *TokenManager) SignTicket(deviceID, bind string, ttl time.Duration) (string, error) {
+	now := tm.now()
+	return tm.issue(auth.Claims{Ver: auth.TokenVersionDeviceTicket, SID: deviceID, Iat: now.Unix(), Exp: now.Add(ttl).Unix(), Auth: now.Unix(), Bind: bind}), nil
+}
+
+func (tm *TokenManager) SignOIDCState(state, deviceID string, ttl time.Duration) (string, error) {
+	now := tm.now()
+	return tm.issue(auth.Claims{Ver: auth.TokenVersionOIDCState, SID: state, Iat: now.Unix(), Exp: now.Add(ttl).Unix(), DeviceID: deviceID}), nil
+}
+
+// Renew follows auth.TokenManager.Renew: the same SID, device and
+// authentication time, capped at maxLifetime after authentication.
+func (tm *TokenManager) Renew(claims *auth.Claims, ttl, maxLifetime time.Duration) (string, *auth.Claims, error) {
+	now := tm.now()
+	authAt := claims.Auth
+	if authAt == 0 {
+		authAt = claims.Iat
+	}
+	limit := time.Unix(authAt, 0).Add(maxLifetime)
+	if !now.Before(limit) {
+		return "", nil, auth.ErrMaxLifetime
+	}
+	exp := now.Add(ttl)
+	if exp.After(limit) {
+		exp = limit
+	}
+	renewed := *claims
+	renewed.Iat = now.Unix()
+	renewed.Exp = exp.Unix()
+	renewed.Auth = authAt
+	return tm.issue(renewed), &renewed, nil
+}
+
+func (tm *TokenManager) Verify(token string) (*auth.Claims, error) {
+	tm.mu.Lock()
+	c, ok := tm.claims[token]
+	revoked := tm.revoked[c.SID]
+	tm.mu.Unlock()
+	switch {
+	case !ok:
+		return nil, auth.ErrInvalidFormat
+	case tm.now().Unix() > c.Exp:
+		return nil, auth.ErrTokenExpired
+	case revoked:
+		return nil, auth.ErrTokenRevoked
+	}
+	return &c, nil
+}
+
+func (tm *TokenManager) VerifyWithVersion(token string, version int) (*auth.Claims, error) {
+	c, err := tm.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if c.Ver != version {
+		return nil, auth.ErrInvalidVersion
+	}
+	return c, nil
+}
+
+func (tm *TokenManager) VerifyScope(token string, version int, scopes ...string) (*auth.Claims, error) {
+	c, err := tm.VerifyWithVersion(token, version)
+	if err != nil {
+		return nil, err
+	}
+	if !c.HasScope(scopes...) {
+		return nil, auth.ErrInsufficientScope
+	}
+	return c, nil
+}
+
+// BindingHash returns v marked as bound, unhashed.
+func (tm *TokenManager) BindingHash(v string) string {
+	return "bind:" + v
+}
+
+func (tm *TokenManager) CheckBinding(claims *auth.Claims, v string) bool {
+	return claims.Bind == tm.BindingHash(v)
+}
+
+// RequestKey returns a key derived from sid by concatenation.
+func (tm *TokenManager) RequestKey(sid string) []byte {
+	return []byte("request-key:" + sid)
+}
+
+func (tm *TokenManager) OIDCVerifier(state string) string {
+	return "verifier-" + state
+}
+
+func (tm *TokenManager) OIDCNonce(state string) string {
+	return "nonce-" + state
+}
+
+// ReceiptSignature returns payload marked as signed, unhashed.
+func (tm *TokenManager) ReceiptSignature(payload []byte) string {
+	return "receipt:" + string(payload)
+}
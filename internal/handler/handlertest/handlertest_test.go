@@ -0,0 +1,119 @@
+package handlertest_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/handler"
+	"github.com/lixiansheng/fileflow/internal/handler/handlertest"
+	"github.com/lixiansheng/fileflow/internal/realtime"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+var (
+	_ handler.Hub          = (*handlertest.Hub)(nil)
+	_ handler.TokenManager = (*handlertest.TokenManager)(nil)
+)
+
+func TestHandlerWithFakes(t *testing.T) {
+	s, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	hub := handlertest.NewHub()
+	tokens := handlertest.NewTokenManager()
+	h := handler.New(handler.Config{Store: s, TokenManager: tokens, Hub: hub}).Routes()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("readyz = %d: %s", rec.Code, rec.Body)
+	}
+
+	deviceID := uuid.NewString()
+	if err := s.AddDevice(&store.Device{DeviceID: deviceID, PubJWKJSON: "{}", CreatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	admin, _ := tokens.Sign("admin-1", auth.TokenVersionAdmin, auth.ScopeAdmin, time.Hour)
+	del := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/api/admin/devices/"+deviceID, nil)
+		req.Header.Set("Authorization", "Bearer "+admin)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tokens.Revoke("admin-1")
+	if rec := del(); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked token: delete = %d, want 401", rec.Code)
+	}
+	admin, _ = tokens.Sign("admin-2", auth.TokenVersionAdmin, auth.ScopeAdmin, time.Hour)
+	if rec := del(); rec.Code != http.StatusOK {
+		t.Fatalf("delete = %d: %s", rec.Code, rec.Body)
+	}
+	if len(hub.ClosedDevices) != 1 || hub.ClosedDevices[0] != deviceID {
+		t.Errorf("closed devices = %v", hub.ClosedDevices)
+	}
+}
+
+func TestTokenManager(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	tm := handlertest.NewTokenManager()
+	tm.Now = func() time.Time { return now }
+
+	token, _ := tm.SignSession("sid", "dev", auth.ScopeReadOnly, time.Minute)
+	if _, err := tm.VerifyWithVersion(token, auth.TokenVersionAdmin); !errors.Is(err, auth.ErrInvalidVersion) {
+		t.Errorf("wrong version: %v", err)
+	}
+	if _, err := tm.VerifyScope(token, auth.TokenVersionSession, auth.ScopeUser); !errors.Is(err, auth.ErrInsufficientScope) {
+		t.Errorf("wrong scope: %v", err)
+	}
+	c, err := tm.VerifyScope(token, auth.TokenVersionSession, auth.ScopeReadOnly)
+	if err != nil || c.DeviceID != "dev" {
+		t.Fatalf("verify = %+v, %v", c, err)
+	}
+
+	now = now.Add(50 * time.Second)
+	renewedToken, renewed, err := tm.Renew(c, time.Minute, 90*time.Second)
+	if err != nil || renewed.SID != "sid" || renewed.Exp != time.Unix(1_000_000, 0).Add(90*time.Second).Unix() {
+		t.Fatalf("renew = %+v, %v", renewed, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := tm.Verify(renewedToken); !errors.Is(err, auth.ErrTokenExpired) {
+		t.Errorf("expired: %v", err)
+	}
+	if _, err := tm.Verify("nonsense"); !errors.Is(err, auth.ErrInvalidFormat) {
+		t.Errorf("unknown token: %v", err)
+	}
+
+	ticket, _ := tm.SignTicket("dev", tm.BindingHash("192.0.2.1"), time.Hour)
+	tc, _ := tm.Verify(ticket)
+	if tc == nil || !tm.CheckBinding(tc, "192.0.2.1") || tm.CheckBinding(tc, "192.0.2.2") {
+		t.Errorf("binding check failed for %+v", tc)
+	}
+}
+
+func TestHubPush(t *testing.T) {
+	hub := handlertest.NewHub()
+	if got := hub.Push("dev", []byte("x")); got != realtime.DeliveryOffline {
+		t.Errorf("offline push = %q", got)
+	}
+	hub.Stats["dev"] = realtime.DeviceStats{Connections: 2}
+	if got := hub.Push("dev", []byte("y")); got != realtime.DeliveryDelivered {
+		t.Errorf("online push = %q", got)
+	}
+	if len(hub.Pushes) != 2 || string(hub.Pushes[1].Message) != "y" {
+		t.Errorf("pushes = %+v", hub.Pushes)
+	}
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Hosts is an allowlist of Host header values. It defends against DNS
+// rebinding: a page on an attacker's domain that re-resolves to a LAN
+// address can reach the server, but its requests still carry the
+// attacker's hostname. Entries are hostnames, matched with any port, or
+// wildcards like *.example.com, which match any subdomain but not
+// example.com itself.
+type Hosts struct {
+	exact    map[string]bool
+	suffixes []string // wildcard entries, with the leading dot
+	// local also allows localhost, its subdomains, and loopback, private
+	// and link-local IP literals, for development on a LAN.
+	local bool
+}
+
+// ParseHosts parses a comma-separated allowlist. An empty list returns nil,
+// which allows every host whatever local is.
+func ParseHosts(list string, local bool) (*Hosts, error) {
+	h := &Hosts{exact: make(map[string]bool), local: local}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		host, wild := strings.CutPrefix(entry, "*.")
+		if name, _, err := net.SplitHostPort(host); err == nil && !strings.ContainsAny(host, "/@") {
+			host = name
+		}
+		if host == "" || strings.ContainsAny(host, "/:@*?# ") {
+			return nil, fmt.Errorf("host %q: want a hostname such as app.example.com or *.example.com", entry)
+		}
+		if wild {
+			h.suffixes = append(h.suffixes, "."+host)
+		} else {
+			h.exact[host] = true
+		}
+	}
+	if len(h.exact) == 0 && len(h.suffixes) == 0 {
+		return nil, nil
+	}
+	return h, nil
+}
+
+// Allow reports whether a Host header value is on the list. A nil list
+// allows everything.
+func (h *Hosts) Allow(hostport string) bool {
+	if h == nil {
+		return true
+	}
+	host := strings.ToLower(hostport)
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if host == "" {
+		return false
+	}
+	if h.exact[host] {
+		return true
+	}
+	for _, s := range h.suffixes {
+		if strings.HasSuffix(host, s) && len(host) > len(s) {
+			return true
+		}
+	}
+	return h.local && isLocalHost(host)
+}
+
+// isLocalHost reports whether host is localhost or a loopback, private or
+// link-local address.
+func isLocalHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// hostCheckExempt are paths served whatever the Host, so that probes
+// addressing the pod or container by IP keep working.
+var hostCheckExempt = []string{"/healthz", "/readyz"}
+
+// HostsMiddleware rejects requests whose Host is not on hosts with 421
+// Misdirected Request. A nil hosts disables the check.
+func HostsMiddleware(hosts *Hosts) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if hosts == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range hostCheckExempt {
+				if r.URL.Path == p {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if !hosts.Allow(r.Host) {
+				writeError(w, http.StatusMisdirectedRequest, "INVALID_HOST", "Unknown host")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
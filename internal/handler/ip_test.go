@@ -1,9 +1,14 @@
 package handler
 
 import (
+	"compress/gzip"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetClientIP(t *testing.T) {
@@ -71,3 +76,549 @@ func TestGetClientIP(t *testing.T) {
 		})
 	}
 }
+
+// TestGetClientIPHeaderSources runs the same proxy chains through each
+// forwarding header so the trust rules cannot drift between them.
+func TestGetClientIPHeaderSources(t *testing.T) {
+	SetTrustedProxies([]string{"10.0.0.0/8", "127.0.0.1", "::1"})
+
+	forwardedFor := func(chain []string) string {
+		var nodes []string
+		for _, ip := range chain {
+			if strings.Contains(ip, ":") {
+				ip = `"[` + ip + `]"`
+			}
+			nodes = append(nodes, "for="+ip)
+		}
+		return strings.Join(nodes, ", ")
+	}
+	sources := []struct {
+		header string
+		render func([]string) string
+	}{
+		{"X-Forwarded-For", func(c []string) string { return strings.Join(c, ", ") }},
+		{"Forwarded", forwardedFor},
+	}
+
+	tests := []struct {
+		name  string
+		chain []string
+		want  string
+	}{
+		{"SingleClient", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"SkipsTrustedHops", []string{"203.0.113.5", "10.0.0.1", "10.0.0.2"}, "203.0.113.5"},
+		{"IgnoresSpoofedPrefix", []string{"198.51.100.9", "203.0.113.5", "10.0.0.1"}, "203.0.113.5"},
+		{"IPv6Client", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"UnknownHopStopsWalk", []string{"203.0.113.5", "unknown", "10.0.0.1"}, "10.0.0.1"},
+		{"AllTrusted", []string{"10.0.0.1"}, "127.0.0.1"},
+	}
+
+	for _, src := range sources {
+		for _, tt := range tests {
+			t.Run(src.header+"/"+tt.name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "127.0.0.1:55555"
+				req.Header.Set(src.header, src.render(tt.chain))
+				if got := getClientIP(req); got != tt.want {
+					t.Errorf("getClientIP() = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+
+	t.Run("X-Real-IP", func(t *testing.T) {
+		for value, want := range map[string]string{
+			"203.0.113.5": "203.0.113.5",
+			"10.0.0.1":    "127.0.0.1",
+			"garbage":     "127.0.0.1",
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "127.0.0.1:55555"
+			req.Header.Set("X-Real-IP", value)
+			if got := getClientIP(req); got != want {
+				t.Errorf("X-Real-IP %q: getClientIP() = %q, want %q", value, got, want)
+			}
+		}
+	})
+
+	t.Run("UntrustedPeerIgnoresHeaders", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:44444"
+		req.Header.Set("Forwarded", "for=203.0.113.5")
+		req.Header.Set("X-Real-IP", "203.0.113.6")
+		if got := getClientIP(req); got != "192.0.2.1" {
+			t.Errorf("getClientIP() = %q, want 192.0.2.1", got)
+		}
+	})
+
+	t.Run("XFFTakesPrecedence", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "127.0.0.1:55555"
+		req.Header.Set("X-Forwarded-For", "203.0.113.5")
+		req.Header.Set("Forwarded", "for=198.51.100.9")
+		if got := getClientIP(req); got != "203.0.113.5" {
+			t.Errorf("getClientIP() = %q, want 203.0.113.5", got)
+		}
+	})
+}
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"Simple", []string{"for=192.0.2.60"}, []string{"192.0.2.60"}},
+		{"CaseAndParams", []string{`For="192.0.2.60:4711";proto=http;by=203.0.113.43`}, []string{"192.0.2.60"}},
+		{"IPv6Quoted", []string{`for="[2001:db8:cafe::17]:4711"`}, []string{"2001:db8:cafe::17"}},
+		{"MultipleElements", []string{"for=192.0.2.43, for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"MultipleHeaderLines", []string{"for=192.0.2.43", "for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"QuotedSeparators", []string{`for=192.0.2.43;host="a,b;c", for=198.51.100.17`}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"Obfuscated", []string{"for=_hidden, for=unknown"}, []string{"_hidden", "unknown"}},
+		{"NoFor", []string{"proto=https;by=10.0.0.1"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseForwarded(tt.values)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("parseForwarded() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedHeadersMiddleware(t *testing.T) {
+	SetTrustedProxies([]string{"10.0.0.0/8"})
+	defer SetTrustedProxies(nil)
+
+	var seen http.Header
+	h := ForwardedHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+	}))
+
+	spoofed := map[string]string{
+		"X-Forwarded-For":   "198.51.100.7",
+		"X-Forwarded-Host":  "evil.example",
+		"X-Forwarded-Proto": "https",
+		"Forwarded":         "for=198.51.100.7",
+		"X-Real-IP":         "198.51.100.7",
+	}
+	for _, tt := range []struct {
+		remoteAddr string
+		kept       bool
+	}{
+		{"203.0.113.1:1000", false},
+		{"10.1.2.3:1000", true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("User-Agent", "test")
+		for k, v := range spoofed {
+			req.Header.Set(k, v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		for k := range spoofed {
+			if got := seen.Get(k) != ""; got != tt.kept {
+				t.Errorf("%s: %s kept = %v, want %v", tt.remoteAddr, k, got, tt.kept)
+			}
+		}
+		if seen.Get("User-Agent") != "test" {
+			t.Errorf("%s: unrelated header removed", tt.remoteAddr)
+		}
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	for _, bad := range []string{"ftp://example.com", "https://example.com/path", "*.", "https://user@example.com"} {
+		if _, err := ParseOrigins(bad); err == nil {
+			t.Errorf("ParseOrigins(%q) should fail", bad)
+		}
+	}
+	if o, err := ParseOrigins(" , "); err != nil || o != nil {
+		t.Errorf("empty list = %v, %v; want nil", o, err)
+	}
+
+	origins, err := ParseOrigins("example.com, https://www.example.com, http://localhost:3000, *.staging.example.com")
+	if err != nil {
+		t.Fatalf("ParseOrigins: %v", err)
+	}
+	allowed := map[string]bool{
+		"https://example.com":                     true,
+		"https://EXAMPLE.com":                     true,
+		"http://example.com":                      false,
+		"https://www.example.com":                 true,
+		"https://app.example.com":                 false,
+		"http://localhost:3000":                   true,
+		"http://localhost:3001":                   false,
+		"https://a.staging.example.com":           true,
+		"https://b.a.staging.example.com":         true,
+		"https://staging.example.com":             false,
+		"https://evilstaging.example.com":         false,
+		"https://x.staging.example.com.evil.test": false,
+		"": false,
+	}
+	for origin, want := range allowed {
+		if got := origins.Allow(origin); got != want {
+			t.Errorf("Allow(%q) = %v, want %v", origin, got, want)
+		}
+	}
+
+	cors := CORSMiddleware(origins)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for origin, want := range allowed {
+		req := httptest.NewRequest(http.MethodOptions, "/api/login", nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		cors.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Access-Control-Allow-Origin") == origin && origin != ""; got != want {
+			t.Errorf("CORS for %q: allowed = %v, want %v", origin, got, want)
+		}
+	}
+
+	// The WebSocket handshake applies the same list.
+	h := New(Config{AllowedOrigins: origins})
+	for origin, want := range allowed {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.Header.Set("Origin", origin)
+		if got := h.upgrader.CheckOrigin(req); got != want {
+			t.Errorf("CheckOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestHostsMiddleware(t *testing.T) {
+	for _, bad := range []string{"*.", "https://app.example.com", "a/b", "*.*.example.com"} {
+		if _, err := ParseHosts(bad, false); err == nil {
+			t.Errorf("ParseHosts(%q) should fail", bad)
+		}
+	}
+	if h, err := ParseHosts(" , ", true); err != nil || h != nil {
+		t.Errorf("empty list = %v, %v; want nil", h, err)
+	}
+
+	hosts, err := ParseHosts("App.example.com, *.lan.example.com, box:8443", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, _ := ParseHosts("app.example.com", true)
+	tests := []struct {
+		host      string
+		want, dev bool
+	}{
+		{"app.example.com", true, true},
+		{"APP.example.com:8443", true, true},
+		{"app.example.com.", true, true},
+		{"box", true, false},
+		{"nas.lan.example.com", true, false},
+		{"lan.example.com", false, false},
+		{"evil.com", false, false},
+		{"app.example.com.evil.com", false, false},
+		{"", false, false},
+		{"localhost:8080", false, true},
+		{"dev.localhost", false, true},
+		{"127.0.0.1:8080", false, true},
+		{"[::1]:8080", false, true},
+		{"192.168.1.20", false, true},
+		{"fe80::1", false, true},
+		{"203.0.113.7", false, false},
+	}
+	for _, tt := range tests {
+		if got := hosts.Allow(tt.host); got != tt.want {
+			t.Errorf("Allow(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+		if tt.host == "box" || strings.HasSuffix(tt.host, "lan.example.com") {
+			continue
+		}
+		if got := local.Allow(tt.host); got != tt.dev {
+			t.Errorf("dev Allow(%q) = %v, want %v", tt.host, got, tt.dev)
+		}
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	if HostsMiddleware(nil)(next) == nil {
+		t.Fatal("nil hosts should pass through")
+	}
+	mw := HostsMiddleware(hosts)(next)
+	for _, tc := range []struct {
+		host, path string
+		want       int
+	}{
+		{"app.example.com", "/api/version", http.StatusOK},
+		{"rebind.attacker.test", "/api/version", http.StatusMisdirectedRequest},
+		{"10.0.0.5:8080", "/healthz", http.StatusOK},
+		{"10.0.0.5:8080", "/readyz", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Host = tc.host
+		rec := httptest.NewRecorder()
+		mw.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s%s = %d, want %d", tc.host, tc.path, rec.Code, tc.want)
+		}
+		if tc.want != http.StatusOK && !strings.Contains(rec.Body.String(), "INVALID_HOST") {
+			t.Errorf("%s%s body = %s", tc.host, tc.path, rec.Body)
+		}
+	}
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	c, err := ParseCompression("gzip", gzip.DefaultCompression, 64, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := `{"data":"` + strings.Repeat("a", 256) + `"}`
+	serve := func(path, body string, hdr map[string]string) *httptest.ResponseRecorder {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			io.WriteString(w, body)
+		})
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		CompressMiddleware(c)(next).ServeHTTP(rec, req)
+		return rec
+	}
+	gz := map[string]string{"Accept-Encoding": "br;q=1, gzip;q=0.8"}
+
+	rec := serve("/api/status", big, gz)
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" || rec.Header().Get("Content-Length") != "" {
+		t.Fatalf("big response headers = %v", rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != big {
+		t.Errorf("decompressed body = %q", got)
+	}
+
+	rec = serve("/api/status", `{}`, gz)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "Accept-Encoding" || rec.Body.String() != `{}` {
+		t.Errorf("small response: headers %v, body %q", rec.Header(), rec.Body)
+	}
+
+	for name, tc := range map[string]struct {
+		path string
+		hdr  map[string]string
+	}{
+		"no Accept-Encoding": {"/api/status", nil},
+		"gzip refused":       {"/api/status", map[string]string{"Accept-Encoding": "gzip;q=0, identity"}},
+		"range":              {"/app.js", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-10"}},
+		"websocket":          {"/ws", map[string]string{"Accept-Encoding": "gzip"}},
+	} {
+		rec := serve(tc.path, big, tc.hdr)
+		if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != big {
+			t.Errorf("%s: compressed: headers %v", name, rec.Header())
+		}
+	}
+
+	if _, err := ParseCompression("br,gzip", gzip.DefaultCompression, 0, nil); err == nil {
+		t.Error("ParseCompression accepted br")
+	}
+	if c, err := ParseCompression("off", gzip.DefaultCompression, 0, nil); err != nil || len(c.Encoders) != 0 {
+		t.Errorf("ParseCompression(off) = %v, %v", c, err)
+	}
+}
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	serve := func(s SecurityHeaders, next http.HandlerFunc) http.Header {
+		rec := httptest.NewRecorder()
+		SecurityHeadersMiddleware(s)(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Header()
+	}
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+
+	h := serve(DefaultSecurityHeaders(), noop)
+	if h.Get("Content-Security-Policy") != DefaultCSP || h.Get("Permissions-Policy") != DefaultPermissionsPolicy ||
+		h.Get("Strict-Transport-Security") != "" || h.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("default headers = %v", h)
+	}
+
+	h = serve(SecurityHeaders{HSTSMaxAge: 365 * 24 * time.Hour, HSTSIncludeSubdomains: true, HSTSPreload: true}, noop)
+	if got := h.Get("Strict-Transport-Security"); got != "max-age=31536000; includeSubDomains; preload" {
+		t.Errorf("Strict-Transport-Security = %q", got)
+	}
+	if h.Get("Content-Security-Policy") != "" || h.Get("Permissions-Policy") != "" {
+		t.Errorf("disabled headers sent: %v", h)
+	}
+
+	// A handler with its own policy, like the admin page, overrides it.
+	h = serve(DefaultSecurityHeaders(), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	})
+	if got := h.Get("Content-Security-Policy"); got != "default-src 'none'" {
+		t.Errorf("handler CSP = %q", got)
+	}
+}
+
+func TestRateLimiterIPv6Prefix(t *testing.T) {
+	SetTrustedProxies(nil)
+	rl := NewRateLimiter(0.001, 1)
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		remoteAddr string
+		wantStatus int
+	}{
+		{"[2001:db8::1]:1000", http.StatusOK},
+		{"[2001:db8::2]:1000", http.StatusTooManyRequests},
+		{"[2001:db8:0:1::1]:1000", http.StatusOK},
+		{"203.0.113.1:1000", http.StatusOK},
+		{"203.0.113.2:1000", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.remoteAddr, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestRateLimiterExemptions(t *testing.T) {
+	SetTrustedProxies(nil)
+	rl := NewRateLimiter(0.001, 1)
+	if err := rl.SetExemptions([]string{"/healthz", "/probe/"}, []string{"10.0.0.0/8", "192.0.2.7"}); err != nil {
+		t.Fatalf("SetExemptions: %v", err)
+	}
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		path       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{"/", "203.0.113.1:1000", http.StatusOK},
+		{"/", "203.0.113.1:1000", http.StatusTooManyRequests},
+		{"/healthz", "203.0.113.1:1000", http.StatusOK},
+		{"/probe/deep", "203.0.113.1:1000", http.StatusOK},
+		{"/healthz/x", "203.0.113.1:1000", http.StatusTooManyRequests},
+		{"/", "10.1.2.3:1000", http.StatusOK},
+		{"/", "10.1.2.3:1000", http.StatusOK},
+		{"/", "192.0.2.7:1000", http.StatusOK},
+		{"/", "192.0.2.7:1000", http.StatusOK},
+		{"/", "192.0.2.8:1000", http.StatusOK},
+		{"/", "192.0.2.8:1000", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s from %s: status = %d, want %d", tt.path, tt.remoteAddr, rec.Code, tt.wantStatus)
+		}
+	}
+
+	for _, bad := range [][2][]string{
+		{nil, {"10.0.0.0/33"}},
+		{nil, {"not-an-ip"}},
+		{{"healthz"}, nil},
+	} {
+		if err := rl.SetExemptions(bad[0], bad[1]); err == nil {
+			t.Errorf("SetExemptions(%v, %v) accepted bad input", bad[0], bad[1])
+		}
+	}
+}
+
+func TestRateLimiterRoutes(t *testing.T) {
+	SetTrustedProxies(nil)
+	rl := NewRateLimiter(0.001, 2)
+	limits, err := ParseRouteLimits("/api/login=0.001:1, /api/admin/=0.001:3")
+	if err != nil {
+		t.Fatalf("ParseRouteLimits: %v", err)
+	}
+	if err := rl.SetRouteLimits(append(limits, RouteLimit{Pattern: "/api/admin/login", RPS: 0.001, Burst: 1})); err != nil {
+		t.Fatalf("SetRouteLimits: %v", err)
+	}
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		// The login bucket is separate from the default one...
+		{"/api/login", http.StatusOK},
+		{"/api/v1/login", http.StatusTooManyRequests},
+		{"/", http.StatusOK},
+		{"/ws", http.StatusOK},
+		{"/app.js", http.StatusTooManyRequests},
+		// ...and the longest pattern wins.
+		{"/api/admin/login", http.StatusOK},
+		{"/api/admin/login", http.StatusTooManyRequests},
+		{"/api/admin/devices", http.StatusOK},
+		{"/api/v1/admin/devices", http.StatusOK},
+		{"/api/admin/stats", http.StatusOK},
+		{"/api/admin/stats", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.RemoteAddr = "203.0.113.9:1000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.path, rec.Code, tt.wantStatus)
+		}
+	}
+
+	for _, bad := range []string{"/api/login", "/api/login=1", "/api/login=x:1", "/api/login=1:y"} {
+		if _, err := ParseRouteLimits(bad); err == nil {
+			t.Errorf("ParseRouteLimits(%q) accepted", bad)
+		}
+	}
+	for _, bad := range []RouteLimit{{"api/login", 1, 1}, {"/api/login", 0, 1}, {"/api/login", 1, 0}} {
+		if err := rl.SetRouteLimits([]RouteLimit{bad}); err == nil {
+			t.Errorf("SetRouteLimits(%+v) accepted", bad)
+		}
+	}
+	if err := rl.SetRouteLimits(DefaultRouteLimits); err != nil {
+		t.Errorf("DefaultRouteLimits: %v", err)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	SetTrustedProxies(nil)
+	rl := NewRateLimiter(0.5, 2)
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.10:1000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do()
+	if rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "2" || rec.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Errorf("first: %d %v", rec.Code, rec.Header())
+	}
+	if rec.Header().Get("Retry-After") != "" {
+		t.Error("Retry-After set on an allowed request")
+	}
+	do()
+	rec = do()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("third: status = %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	if rec.Header().Get("X-RateLimit-Remaining") != "0" || rec.Header().Get("X-RateLimit-Reset") != "4" {
+		t.Errorf("headers = %v", rec.Header())
+	}
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/logging"
+)
+
+// maxLogLevelRevert bounds LogLevelRequest.RevertAfter.
+const maxLogLevelRevert = 24 * time.Hour
+
+// handleAdminLogLevel reads (GET) or replaces (PUT) the log levels, so
+// debug logging of one component can be turned on during an incident
+// without a restart.
+func (h *Handler) handleAdminLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminMethod(w, r) {
+		return
+	}
+	if h.logLevels == nil {
+		writeError(w, http.StatusNotFound, "LOG_LEVELS_UNAVAILABLE", "Log levels cannot be changed at runtime")
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req LogLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+			return
+		}
+		level, overrides, msg := logLevels(req)
+		if msg != "" {
+			writeError(w, http.StatusBadRequest, "INVALID_LOG_LEVEL", msg)
+			return
+		}
+		if err := h.logLevels.Set(level, overrides, time.Duration(req.RevertAfter)*time.Second); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_LOG_LEVEL", err.Error())
+			return
+		}
+		// Warn so the change shows up whatever the new levels are.
+		slog.WarnContext(r.Context(), "Log levels changed", "level", level, "components", req.Components, "revert_after", req.RevertAfter)
+	}
+
+	level, overrides, revertAt := h.logLevels.Get()
+	resp := LogLevelResponse{Level: levelName(level), Components: map[string]string{}}
+	for c, l := range overrides {
+		resp.Components[c] = levelName(l)
+	}
+	if !revertAt.IsZero() {
+		resp.RevertAt = revertAt.UnixMilli()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// logLevels validates req and returns the levels it sets, or a message
+// explaining what is wrong with it.
+func logLevels(req LogLevelRequest) (slog.Level, map[string]slog.Level, string) {
+	level, err := logging.ParseLevel(req.Level)
+	if err != nil {
+		return 0, nil, "level must be debug, info, warn or error"
+	}
+	if req.RevertAfter < 0 || time.Duration(req.RevertAfter)*time.Second > maxLogLevelRevert {
+		return 0, nil, "revert_after must be between 0 and 86400 seconds"
+	}
+	overrides := make(map[string]slog.Level, len(req.Components))
+	for c, name := range req.Components {
+		if !logging.ValidComponent(c) {
+			return 0, nil, "components must be " + strings.Join(logging.Components, ", ")
+		}
+		l, err := logging.ParseLevel(name)
+		if err != nil {
+			return 0, nil, "level of " + c + " must be debug, info, warn or error"
+		}
+		overrides[c] = l
+	}
+	return level, overrides, ""
+}
+
+func levelName(l slog.Level) string {
+	return strings.ToLower(l.String())
+}
@@ -3,14 +3,20 @@ package handler
 import (
 	"bufio"
 	"errors"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"golang.org/x/time/rate"
+
+	"github.com/lixiansheng/fileflow/internal/limit"
+	"github.com/lixiansheng/fileflow/internal/logging"
 )
 
 var (
@@ -19,9 +25,20 @@ var (
 )
 
 func SetTrustedProxies(cidrs []string) error {
+	parsed, err := parseCIDRs(cidrs)
+	if err != nil {
+		return errors.New("invalid trusted proxy: " + err.Error())
+	}
+
 	muTrusted.Lock()
 	defer muTrusted.Unlock()
+	trustedCIDRs = parsed
+	return nil
+}
 
+// parseCIDRs parses CIDRs and bare IPs, which stand for a single address.
+// Blank entries are skipped; the error names the first bad one.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
 	var parsed []*net.IPNet
 	for _, cidr := range cidrs {
 		cidr = strings.TrimSpace(cidr)
@@ -31,7 +48,7 @@ func SetTrustedProxies(cidrs []string) error {
 		if strings.Contains(cidr, "/") {
 			_, network, err := net.ParseCIDR(cidr)
 			if err != nil {
-				return errors.New("invalid trusted proxy: " + cidr)
+				return nil, errors.New(cidr)
 			}
 			parsed = append(parsed, network)
 			continue
@@ -39,7 +56,7 @@ func SetTrustedProxies(cidrs []string) error {
 
 		ip := net.ParseIP(cidr)
 		if ip == nil {
-			return errors.New("invalid trusted proxy: " + cidr)
+			return nil, errors.New(cidr)
 		}
 		bits := 32
 		if ip.To4() == nil {
@@ -47,32 +64,93 @@ func SetTrustedProxies(cidrs []string) error {
 		}
 		parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
 	}
-	trustedCIDRs = parsed
-	return nil
+	return parsed, nil
 }
 
-func isTrusted(ipStr string) bool {
+func containsIP(nets []*net.IPNet, ipStr string) bool {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return false
 	}
-
-	muTrusted.RLock()
-	defer muTrusted.RUnlock()
-
-	for _, cidr := range trustedCIDRs {
-		if cidr.Contains(ip) {
+	for _, n := range nets {
+		if n.Contains(ip) {
 			return true
 		}
 	}
 	return false
 }
 
+func isTrusted(ipStr string) bool {
+	muTrusted.RLock()
+	defer muTrusted.RUnlock()
+	return containsIP(trustedCIDRs, ipStr)
+}
+
 type RateLimiter struct {
 	mu       sync.RWMutex
 	visitors map[string]*visitorLimiter
 	rate     rate.Limit
 	burst    int
+	v6Prefix int
+
+	// Requests to exemptPaths or from exemptNets skip the limit.
+	exemptPaths []string
+	exemptNets  []*net.IPNet
+
+	// routes override rate and burst for matching paths, longest
+	// pattern first.
+	routes []RouteLimit
+
+	// key names the client a request counts against; nil uses its
+	// address.
+	key func(*http.Request) string
+}
+
+// RouteLimit is the request rate one client may send to the paths matching
+// Pattern, in place of the limiter's default. A pattern ending in "/"
+// covers everything below it; /api/v1/... paths match their /api/...
+// pattern. Each route has its own bucket per client.
+type RouteLimit struct {
+	Pattern string
+	RPS     float64
+	Burst   int
+}
+
+// DefaultRouteLimits keep credential and enrollment endpoints well below
+// the default, so guessing is slow without throttling /ws or static assets.
+var DefaultRouteLimits = []RouteLimit{
+	{Pattern: "/api/login", RPS: 1, Burst: 5},
+	{Pattern: "/api/admin/login", RPS: 0.5, Burst: 3},
+	{Pattern: "/api/device/", RPS: 2, Burst: 5},
+	{Pattern: "/api/webauthn/", RPS: 2, Burst: 5},
+	{Pattern: "/auth/oidc/", RPS: 1, Burst: 5},
+}
+
+// ParseRouteLimits parses comma-separated pattern=rps:burst entries, e.g.
+// "/api/login=1:5,/api/push=10:20".
+func ParseRouteLimits(s string) ([]RouteLimit, error) {
+	var limits []RouteLimit
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, spec, ok := strings.Cut(entry, "=")
+		rps, burst, ok2 := strings.Cut(spec, ":")
+		if !ok || !ok2 {
+			return nil, errors.New("invalid route limit " + entry + ": want pattern=rps:burst")
+		}
+		r, err := strconv.ParseFloat(rps, 64)
+		if err != nil {
+			return nil, errors.New("invalid route limit " + entry + ": bad rps")
+		}
+		b, err := strconv.Atoi(burst)
+		if err != nil {
+			return nil, errors.New("invalid route limit " + entry + ": bad burst")
+		}
+		limits = append(limits, RouteLimit{Pattern: strings.TrimSpace(pattern), RPS: r, Burst: b})
+	}
+	return limits, nil
 }
 
 type visitorLimiter struct {
@@ -85,11 +163,109 @@ func NewRateLimiter(rps float64, burst int) *RateLimiter {
 		visitors: make(map[string]*visitorLimiter),
 		rate:     rate.Limit(rps),
 		burst:    burst,
+		v6Prefix: limit.DefaultIPv6PrefixLen,
 	}
 	go rl.cleanupLoop()
 	return rl
 }
 
+// SetIPv6PrefixLen sets the prefix length used to group IPv6 clients into
+// a single bucket.
+func (rl *RateLimiter) SetIPv6PrefixLen(bits int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.v6Prefix = bits
+}
+
+// SetExemptions exempts requests for paths, and requests from clients in
+// cidrs, from the limit; health checks and internal probes then don't use
+// up the budget of real clients behind the same address. A path ending in
+// "/" covers everything below it, like a ServeMux pattern. Clients are
+// matched on the address getClientIP reports, so a probe that goes
+// through a trusted proxy is matched on its own address, not the proxy's.
+func (rl *RateLimiter) SetExemptions(paths, cidrs []string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return errors.New("invalid rate limit exemption: " + err.Error())
+	}
+	var clean []string
+	for _, p := range paths {
+		if p = strings.TrimSpace(p); p != "" {
+			if !strings.HasPrefix(p, "/") {
+				return errors.New("invalid rate limit exemption: " + p + " is not an absolute path")
+			}
+			clean = append(clean, p)
+		}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.exemptPaths, rl.exemptNets = clean, nets
+	return nil
+}
+
+// SetKeyFunc makes the limiter count requests against key(r) instead of
+// the client address, such as Handler.LimitKey in onion mode. Exempt
+// networks are still matched on the address.
+func (rl *RateLimiter) SetKeyFunc(key func(*http.Request) string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.key = key
+}
+
+// SetRouteLimits replaces the per-route limits. A later entry for the same
+// pattern replaces an earlier one, so overrides can be appended to
+// DefaultRouteLimits.
+func (rl *RateLimiter) SetRouteLimits(limits []RouteLimit) error {
+	byPattern := make(map[string]RouteLimit, len(limits))
+	for _, l := range limits {
+		if !strings.HasPrefix(l.Pattern, "/") {
+			return errors.New("invalid route limit: " + l.Pattern + " is not an absolute path")
+		}
+		if l.RPS <= 0 || l.Burst < 1 {
+			return errors.New("invalid route limit for " + l.Pattern + ": rps and burst must be positive")
+		}
+		byPattern[l.Pattern] = l
+	}
+	routes := make([]RouteLimit, 0, len(byPattern))
+	for _, l := range byPattern {
+		routes = append(routes, l)
+	}
+	sort.Slice(routes, func(i, j int) bool { return len(routes[i].Pattern) > len(routes[j].Pattern) })
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.routes = routes
+	// Buckets of the old configuration would keep their old rates.
+	rl.visitors = make(map[string]*visitorLimiter)
+	return nil
+}
+
+// matchPath reports whether path falls under pattern.
+func matchPath(pattern, path string) bool {
+	return path == pattern || strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern)
+}
+
+// unversionedPath maps /api/v1/... to the /api/... path it is served as,
+// so one pattern limits both.
+func unversionedPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/api/v"+strconv.Itoa(APIVersion)+"/"); ok {
+		return "/api/" + rest
+	}
+	return path
+}
+
+func (rl *RateLimiter) exempt(path, ip string) bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	for _, p := range rl.exemptPaths {
+		if matchPath(p, path) {
+			return true
+		}
+	}
+	return containsIP(rl.exemptNets, ip)
+}
+
 func (rl *RateLimiter) cleanupLoop() {
 	ticker := time.NewTicker(time.Minute)
 	for range ticker.C {
@@ -103,14 +279,27 @@ func (rl *RateLimiter) cleanupLoop() {
 	}
 }
 
-func (rl *RateLimiter) getVisitor(ip string) *rate.Limiter {
+// getVisitor returns the bucket of ip for the route path falls under.
+func (rl *RateLimiter) getVisitor(ip, path string) *rate.Limiter {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	v, exists := rl.visitors[ip]
+	r, burst, route := rl.rate, rl.burst, ""
+	for _, l := range rl.routes {
+		if matchPath(l.Pattern, path) {
+			r, burst, route = rate.Limit(l.RPS), l.Burst, l.Pattern
+			break
+		}
+	}
+
+	key := limit.Key(ip, rl.v6Prefix)
+	if route != "" {
+		key = route + " " + key
+	}
+	v, exists := rl.visitors[key]
 	if !exists {
-		limiter := rate.NewLimiter(rl.rate, rl.burst)
-		rl.visitors[ip] = &visitorLimiter{limiter: limiter, lastSeen: time.Now()}
+		limiter := rate.NewLimiter(r, burst)
+		rl.visitors[key] = &visitorLimiter{limiter: limiter, lastSeen: time.Now()}
 		return limiter
 	}
 
@@ -121,10 +310,23 @@ func (rl *RateLimiter) getVisitor(ip string) *rate.Limiter {
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := getClientIP(r)
-		limiter := rl.getVisitor(ip)
+		path := unversionedPath(r.URL.Path)
+		if rl.exempt(path, ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rl.mu.RLock()
+		key := rl.key
+		rl.mu.RUnlock()
+		if key != nil {
+			ip = key(r)
+		}
+		limiter := rl.getVisitor(ip, path)
 
-		if !limiter.Allow() {
-			writeError(w, http.StatusTooManyRequests, "RATE_LIMITED", "Too many requests")
+		ok, st := limit.Take(limiter, time.Now())
+		setRateLimitHeaders(w, st)
+		if !ok {
+			writeRateLimited(w, st, "Too many requests")
 			return
 		}
 
@@ -132,48 +334,288 @@ func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// setRateLimitHeaders describes st in X-RateLimit-Limit, -Remaining and
+// -Reset (seconds until the bucket is full). A limiter consulted later in
+// the request overwrites the values of an earlier one.
+func setRateLimitHeaders(w http.ResponseWriter, st limit.Status) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(st.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(st.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(st.Reset)))
+}
+
+// writeRateLimited answers 429 with the rate-limit headers for st and a
+// Retry-After of at least one second.
+func writeRateLimited(w http.ResponseWriter, st limit.Status, msg string) {
+	setRateLimitHeaders(w, st)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(st.RetryAfter))))
+	writeError(w, http.StatusTooManyRequests, "RATE_LIMITED", msg)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// getClientIP returns the address rate limits and audits key on. Forwarding
+// headers are only honoured when the direct peer is a trusted proxy, and are
+// consulted in order X-Forwarded-For, Forwarded (RFC 7239), X-Real-IP, so
+// deployments whose proxy only sets X-Forwarded-For keep their behaviour.
 func getClientIP(r *http.Request) string {
+	host := peerHost(r)
+	if !isTrusted(host) {
+		return host
+	}
+
+	chains := [][]string{
+		splitForwardedFor(r.Header.Values("X-Forwarded-For")),
+		parseForwarded(r.Header.Values("Forwarded")),
+		{strings.TrimSpace(r.Header.Get("X-Real-IP"))},
+	}
+	for _, chain := range chains {
+		if ip, ok := clientFromChain(host, chain); ok {
+			return ip
+		}
+	}
+
+	return host
+}
+
+// peerHost returns the address of the direct peer, without the port.
+func peerHost(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		host = r.RemoteAddr
+		return r.RemoteAddr
 	}
+	return host
+}
 
-	if !isTrusted(host) {
+// isForwardingHeader reports whether the canonical header name key is set
+// by reverse proxies to describe the original request.
+func isForwardingHeader(key string) bool {
+	return key == "Forwarded" || key == "X-Real-Ip" || strings.HasPrefix(key, "X-Forwarded-")
+}
+
+// ForwardedHeadersMiddleware removes Forwarded, X-Forwarded-* and X-Real-IP
+// from requests whose peer is not a trusted proxy. getClientIP already
+// ignores them there, but stripping them up front means nothing further
+// down (logs, handlers added later) can be fooled by a client setting them
+// itself. It must run before anything that reads those headers.
+func ForwardedHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isTrusted(peerHost(r)) {
+			for key := range r.Header {
+				if isForwardingHeader(key) {
+					r.Header.Del(key)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientFromChain walks a proxy chain (client first) from the nearest hop
+// back, skipping trusted proxies, and returns the first untrusted address.
+// A hop that is not an IP ("unknown", an obfuscated node) cannot be checked,
+// so the walk stops and the last verified hop is used instead. ok is false
+// when the chain is empty or made up entirely of trusted proxies.
+func clientFromChain(peer string, chain []string) (ip string, ok bool) {
+	last := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := chain[i]
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			return last, true
+		}
+		if !isTrusted(hop) {
+			return hop, true
+		}
+		last = hop
+	}
+	return "", false
+}
+
+func splitForwardedFor(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			chain = append(chain, strings.TrimSpace(part))
+		}
+	}
+	return chain
+}
+
+// parseForwarded extracts the for= node of every Forwarded element, in
+// order, normalising quoted, bracketed and port-suffixed forms to a bare IP.
+// Nodes that are not IPs are kept verbatim so clientFromChain can stop there.
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			for _, pair := range splitQuoted(element, ';') {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if !found || !strings.EqualFold(strings.TrimSpace(key), "for") {
+					continue
+				}
+				chain = append(chain, forwardedNode(strings.TrimSpace(val)))
+			}
+		}
+	}
+	return chain
+}
+
+// forwardedNode converts an RFC 7239 node such as 192.0.2.1:80,
+// "[2001:db8::1]:443" (quoted) or unknown to an IP string where possible.
+func forwardedNode(node string) string {
+	if len(node) >= 2 && node[0] == '"' && node[len(node)-1] == '"' {
+		node = strings.ReplaceAll(node[1:len(node)-1], `\"`, `"`)
+	}
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
 		return host
 	}
+	return node
+}
 
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		for i := len(parts) - 1; i >= 0; i-- {
-			ip := strings.TrimSpace(parts[i])
-			if ip == "" {
-				continue
+// splitQuoted splits s on sep outside double-quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if inQuote {
+				i++
 			}
-			if !isTrusted(ip) {
-				return ip
+		case '"':
+			inQuote = !inQuote
+		case sep:
+			if !inQuote {
+				parts = append(parts, s[start:i])
+				start = i + 1
 			}
 		}
 	}
+	return append(parts, s[start:])
+}
 
-	// Fallback to X-Real-IP only if XFF didn't yield a client and we trust remote
-	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
-		if net.ParseIP(xri) != nil {
-			return xri
-		}
+// DefaultCSP fits the bundled web UI: its own script and stylesheet, the
+// inline style attributes it toggles, Google Fonts, and WebSocket and
+// fetch calls back to the same origin. The admin page and /api/docs set
+// their own policies.
+const DefaultCSP = "default-src 'self'; script-src 'self'; " +
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com; font-src https://fonts.gstatic.com; " +
+	"img-src 'self' data:; connect-src 'self'; object-src 'none'; base-uri 'none'; " +
+	"form-action 'self'; frame-ancestors 'none'"
+
+// DefaultPermissionsPolicy turns off browser features FileFlow never uses.
+// WebAuthn and the clipboard keep their same-origin defaults.
+const DefaultPermissionsPolicy = "camera=(), microphone=(), geolocation=(), payment=(), usb=()"
+
+// SecurityHeaders configures SecurityHeadersMiddleware. Empty strings and
+// a zero HSTSMaxAge leave the header out.
+type SecurityHeaders struct {
+	// CSP is the Content-Security-Policy of responses whose handler does
+	// not set its own.
+	CSP string
+	// PermissionsPolicy is sent as Permissions-Policy.
+	PermissionsPolicy string
+	// HSTSMaxAge enables Strict-Transport-Security. Browsers ignore it on
+	// plain HTTP, so only turn it on once the site is served over HTTPS
+	// for good: they will refuse HTTP for this long.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+}
+
+// DefaultSecurityHeaders returns the policy used when none is configured:
+// DefaultCSP and DefaultPermissionsPolicy, no HSTS.
+func DefaultSecurityHeaders() SecurityHeaders {
+	return SecurityHeaders{CSP: DefaultCSP, PermissionsPolicy: DefaultPermissionsPolicy}
+}
+
+// hsts returns the Strict-Transport-Security value, or "" when disabled.
+func (s SecurityHeaders) hsts() string {
+	if s.HSTSMaxAge <= 0 {
+		return ""
+	}
+	v := "max-age=" + strconv.FormatInt(int64(s.HSTSMaxAge/time.Second), 10)
+	if s.HSTSIncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if s.HSTSPreload {
+		v += "; preload"
 	}
+	return v
+}
 
-	return host
+// SecurityHeadersMiddleware sets the fixed hardening headers and the
+// configurable ones in s. Handlers may override Content-Security-Policy.
+func SecurityHeadersMiddleware(s SecurityHeaders) func(http.Handler) http.Handler {
+	hsts := s.hsts()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+			if s.CSP != "" {
+				h.Set("Content-Security-Policy", s.CSP)
+			}
+			if s.PermissionsPolicy != "" {
+				h.Set("Permissions-Policy", s.PermissionsPolicy)
+			}
+			if hsts != "" {
+				h.Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-func SecurityHeadersMiddleware(next http.Handler) http.Handler {
+// maxRequestIDLen bounds a client-supplied X-Request-ID.
+const maxRequestIDLen = 128
+
+// RequestIDMiddleware gives every request an ID, taken from X-Request-ID
+// when a client or proxy set a sane one and generated otherwise, echoes it
+// in the response and stores it in the context for logging.
+func RequestIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "DENY")
-		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
-		next.ServeHTTP(w, r)
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
 	})
 }
 
+// validRequestID accepts IDs that are safe to log verbatim: bounded and
+// limited to the characters request ID generators use.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:+/=", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// LoggingMiddleware writes an access log record per request. It runs
+// inside RequestIDMiddleware, so the record carries the request ID and, once
+// authentication has identified it, the device.
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -181,7 +623,12 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 		next.ServeHTTP(wrapped, r)
 
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapped.statusCode, time.Since(start))
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"route", r.URL.Path,
+			"ip", getClientIP(r),
+			"status", wrapped.statusCode,
+			"duration", time.Since(start))
 	})
 }
 
@@ -204,16 +651,20 @@ func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return hijacker.Hijack()
 }
 
-func CORSMiddleware(allowedOrigin string) func(http.Handler) http.Handler {
+// CORSMiddleware answers preflights and allows credentialed cross-origin
+// requests from origins on the list. A nil list allows none.
+func CORSMiddleware(origins *Origins) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			origin := r.Header.Get("Origin")
 
-			if allowedOrigin != "" && (origin == allowedOrigin || origin == "https://"+allowedOrigin) {
+			w.Header().Add("Vary", "Origin")
+			if origins.Allow(origin) {
 				w.Header().Set("Access-Control-Allow-Origin", origin)
 				w.Header().Set("Access-Control-Allow-Credentials", "true")
 				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Bootstrap")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Admin-Bootstrap, X-Request-ID")
+				w.Header().Set("Access-Control-Expose-Headers", "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-Request-ID")
 			}
 
 			if r.Method == http.MethodOptions {
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// oidcStateTTL is how long a user has at the provider before the callback
+// is refused.
+const oidcStateTTL = 10 * time.Minute
+
+// oidcFail sends the browser back to the app with a reason it can show,
+// since the login endpoints are navigated to rather than fetched.
+func oidcFail(w http.ResponseWriter, r *http.Request, reason string) {
+	http.Redirect(w, r, "/?login_error="+url.QueryEscape(reason), http.StatusFound)
+}
+
+// handleOIDCLogin starts an OIDC login for the device holding the request's
+// device ticket. The state travels in a Lax cookie because the callback
+// arrives from the provider's site, where the Strict device_ticket and
+// ff_session cookies are not sent.
+func (h *Handler) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		writeError(w, http.StatusNotFound, "OIDC_DISABLED", "OIDC login is not configured")
+		return
+	}
+	if !h.loginLimiter.Allow(h.LimitKey(r)) {
+		oidcFail(w, r, "rate_limited")
+		return
+	}
+
+	deviceID, err := h.verifyDeviceTicket(r)
+	if err != nil {
+		if errors.Is(err, errDeviceRevoked) {
+			oidcFail(w, r, "device_not_enrolled")
+			return
+		}
+		if errors.Is(err, errDeviceDisabled) {
+			oidcFail(w, r, "device_disabled")
+			return
+		}
+		oidcFail(w, r, "device_ticket")
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate OIDC state", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+
+	target, err := h.oidc.AuthCodeURL(r.Context(), state, h.tokenManager.OIDCNonce(state), h.tokenManager.OIDCVerifier(state))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC provider unavailable", "err", err)
+		oidcFail(w, r, "oidc_unavailable")
+		return
+	}
+	token, err := h.tokenManager.SignOIDCState(state, deviceID, oidcStateTTL)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to sign OIDC state", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.cookieName(cookieOIDCState),
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(oidcStateTTL),
+		HttpOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleOIDCCallback finishes an OIDC login: it checks the state against
+// the cookie from handleOIDCLogin, exchanges the code, verifies the ID
+// token and starts a session for the device that began the login.
+//
+// The provider stands in for the shared secret only, never for the
+// device's TOTP: the redirect has no step to ask for a code, so a device
+// with TOTP turned on is refused here and must log in with the secret and
+// a code. Otherwise SSO would be a way around the second factor.
+func (h *Handler) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		writeError(w, http.StatusNotFound, "OIDC_DISABLED", "OIDC login is not configured")
+		return
+	}
+	cookie, err := h.readCookie(r, cookieOIDCState)
+	if err != nil {
+		oidcFail(w, r, "oidc_state")
+		return
+	}
+	// Single use: whatever happens next, this state is spent.
+	h.clearCookie(w, cookieOIDCState)
+
+	claims, err := h.tokenManager.VerifyWithVersion(cookie.Value, auth.TokenVersionOIDCState)
+	q := r.URL.Query()
+	if err != nil || subtle.ConstantTimeCompare([]byte(claims.SID), []byte(q.Get("state"))) != 1 {
+		oidcFail(w, r, "oidc_state")
+		return
+	}
+	if q.Get("error") != "" {
+		oidcFail(w, r, "oidc_denied")
+		return
+	}
+
+	state := claims.SID
+	deviceID := claims.DeviceID
+	id, err := h.oidc.Exchange(r.Context(), q.Get("code"), h.tokenManager.OIDCVerifier(state), h.tokenManager.OIDCNonce(state))
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC login failed", "device_id", deviceID, "err", err)
+		h.recordAuthFailure(deviceID)
+		oidcFail(w, r, "oidc_failed")
+		return
+	}
+	userID, ok := h.oidcUser(id)
+	if !ok {
+		slog.WarnContext(r.Context(), "OIDC login refused: not an allowed account", "email", id.Email, "subject", id.Subject, "device_id", deviceID)
+		h.recordAuthFailure(deviceID)
+		oidcFail(w, r, "oidc_not_allowed")
+		return
+	}
+
+	// The device may have been deleted or disabled while its user was at
+	// the provider.
+	device, err := h.store.GetDevice(deviceID)
+	if err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			oidcFail(w, r, "device_not_enrolled")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Store error during OIDC login", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return
+	}
+	if device.Disabled {
+		oidcFail(w, r, "device_disabled")
+		return
+	}
+	// The account stands in for the secret of one user only; it must not
+	// open a session on a device that belongs to someone else.
+	if userID != device.UserID {
+		slog.WarnContext(r.Context(), "OIDC login refused: account belongs to another user", "email", id.Email, "subject", id.Subject, "user_id", userID, "device_id", deviceID, "device_user_id", device.UserID)
+		h.recordAuthFailure(deviceID)
+		writeError(w, http.StatusForbidden, "OIDC_USER_MISMATCH", "This account may not sign in to this device")
+		return
+	}
+	needOTP, err := h.totpRequired(deviceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Store error during OIDC login", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return
+	}
+	if needOTP {
+		slog.WarnContext(r.Context(), "OIDC login refused: device requires TOTP", "email", id.Email, "device_id", deviceID)
+		oidcFail(w, r, "totp_required")
+		return
+	}
+
+	h.recordAuthSuccess(deviceID)
+	if err := h.startSession(w, deviceID, auth.ScopeUser); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate token", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate token")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "OIDC login", "email", id.Email, "subject", id.Subject, "device_id", deviceID)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// oidcUser resolves id against OIDCAllowed and returns the user it may
+// sign in as. Entries are an email, an "@domain" suffix or "sub:" and the
+// provider's subject, optionally followed by "=" and a user ID; without
+// one the entry maps to the default account. Email entries only match
+// verified emails, so an account cannot claim an address it does not own.
+// Exact email and subject entries win over domain entries. An empty list
+// allows no one rather than every account at the issuer; main refuses to
+// enable OIDC without one.
+func (h *Handler) oidcUser(id *auth.OIDCIdentity) (string, bool) {
+	email := ""
+	if id.EmailVerified {
+		email = strings.ToLower(id.Email)
+	}
+	domainUser, domainOK := "", false
+	for _, entry := range h.oidcAllowed {
+		match, userID, _ := strings.Cut(entry, "=")
+		match = strings.TrimSpace(match)
+		userID = strings.TrimSpace(userID)
+		switch {
+		case strings.HasPrefix(match, "sub:"):
+			if id.Subject != "" && match[len("sub:"):] == id.Subject {
+				return userID, true
+			}
+		case email == "":
+		case strings.HasPrefix(match, "@"):
+			if !domainOK && strings.HasSuffix(email, strings.ToLower(match)) {
+				domainUser, domainOK = userID, true
+			}
+		case email == strings.ToLower(match):
+			return userID, true
+		}
+	}
+	return domainUser, domainOK
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+)
+
+// Onion mode is for running FileFlow as a Tor onion service. The Tor
+// daemon connects to the server locally, so every request arrives from
+// 127.0.0.1 and address-based limits would put all clients in one bucket.
+// In onion mode the limits key on the device a request's ticket names
+// instead, and device tickets are not bound to an address. Requests
+// without a valid ticket (the device challenge, admin login) share one
+// anonymous bucket.
+
+// Server modes and limit keys reported by /api/server-info.
+const (
+	ServerModeStandard = "standard"
+	ServerModeOnion    = "onion"
+	LimitKeyIP         = "ip"
+	LimitKeyDevice     = "device"
+)
+
+// onionAnonymousKey is the limiter key of every request without a valid
+// device ticket in onion mode.
+const onionAnonymousKey = "onion"
+
+// LimitKey returns the key per-client limits count r under: the client
+// address, or in onion mode the device named by its ticket. The ticket's
+// signature is checked but not the store, so revoked devices still get a
+// bucket of their own until their tickets expire.
+func (h *Handler) LimitKey(r *http.Request) string {
+	if !h.onion {
+		return getClientIP(r)
+	}
+	cookie, err := h.readCookie(r, cookieDeviceTicket)
+	if err != nil {
+		return onionAnonymousKey
+	}
+	claims, err := h.tokenManager.VerifyWithVersion(cookie.Value, auth.TokenVersionDeviceTicket)
+	if err != nil || !auth.ValidateDeviceIDFormat(claims.SID) {
+		return onionAnonymousKey
+	}
+	return "device:" + claims.SID
+}
+
+// handleServerInfo tells clients and operators how this deployment
+// identifies clients, so a client can tell whether it reached an onion
+// service and what its limits key on.
+func (h *Handler) handleServerInfo(w http.ResponseWriter, r *http.Request) {
+	resp := ServerInfoResponse{
+		Mode:          ServerModeStandard,
+		LimitKey:      LimitKeyIP,
+		SecureCookies: h.secureCookies,
+		HostCookies:   h.hostCookies,
+		TicketBinding: h.ticketBinding,
+		Features:      h.flags.Snapshot(),
+	}
+	if h.onion {
+		resp.Mode = ServerModeOnion
+		resp.LimitKey = LimitKeyDevice
+	}
+	if resp.TicketBinding == "" {
+		resp.TicketBinding = "off"
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,391 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/realtime"
+)
+
+// apiOperation documents one route of the HTTP API for the OpenAPI
+// document. Request and Response are zero values of the body types, whose
+// schemas are derived from their json tags like cmd/tsgen does for the SPA.
+type apiOperation struct {
+	Method  string
+	Path    string
+	Tag     string
+	Summary string
+	// Security lists the accepted credentials; each entry is a set of
+	// schemes that must all be present. Empty means public.
+	Security [][]string
+	Query    []apiParam
+	Request  any
+	Response any
+	// Wrapped marks responses sent inside the APIResponse envelope.
+	Wrapped bool
+	// Status is the success status when it is not 200 OK, for routes that
+	// upgrade or redirect instead of answering with JSON.
+	Status      int
+	Description string
+}
+
+// apiParam is an optional query parameter.
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+var (
+	secDevice  = [][]string{{"deviceTicket"}}
+	secSession = [][]string{{"deviceTicket", "session"}}
+	secAdmin   = [][]string{{"adminToken"}}
+	secEnroll  = [][]string{{"adminToken"}, {"adminBootstrap"}}
+)
+
+// apiOperations is every route Routes serves under /api, /auth and /ws,
+// apart from the dev-only docs page. TestOpenAPI fails when a route is
+// added without an entry here.
+var apiOperations = []apiOperation{
+	{Method: http.MethodGet, Path: "/healthz", Tag: "meta", Summary: "Liveness probe", Response: HealthResponse{}},
+	{Method: http.MethodGet, Path: "/readyz", Tag: "meta", Summary: "Readiness probe; 503 when the store or hub is degraded", Response: ReadyResponse{}},
+	{Method: http.MethodGet, Path: "/.well-known/fileflow.json", Tag: "meta", Summary: "Client auto-configuration: API base, WebSocket path, protocol, limits and enabled features", Response: WellKnownResponse{}},
+	{Method: http.MethodGet, Path: "/api/version", Tag: "meta", Summary: "Server version and realtime protocol; build details for admins", Response: VersionResponse{}},
+	{Method: http.MethodGet, Path: "/api/server-info", Tag: "meta", Summary: "Deployment mode (standard or onion) and what per-client limits key on", Response: ServerInfoResponse{}},
+	{Method: http.MethodGet, Path: "/api/openapi.json", Tag: "meta", Summary: "This document"},
+
+	{Method: http.MethodPost, Path: "/api/device/challenge", Tag: "device", Summary: "Request a nonce for the device key to sign", Request: ChallengeRequest{}, Response: ChallengeResponse{}},
+	{Method: http.MethodPost, Path: "/api/device/attest", Tag: "device", Summary: "Prove possession of the device key; sets the device_ticket cookie", Request: AttestRequest{}, Response: DeviceOKResponse{}},
+	{Method: http.MethodPost, Path: "/api/device/pairing-code", Tag: "device", Summary: "Issue a one-time code to enroll another device", Security: secSession, Response: PairingCodeResponse{}},
+	{Method: http.MethodPost, Path: "/api/device/enroll", Tag: "device", Summary: "Enroll a device with a pairing code", Request: EnrollRequest{}, Response: AddedResponse{}},
+	{Method: http.MethodPost, Path: "/api/webauthn/register/options", Tag: "device", Summary: "Start registering a passkey as a device", Security: secEnroll, Response: WebAuthnRegisterOptionsResponse{}},
+	{Method: http.MethodPost, Path: "/api/webauthn/register", Tag: "device", Summary: "Finish registering a passkey", Security: secEnroll, Request: WebAuthnRegisterRequest{}, Response: WebAuthnRegisteredResponse{}},
+	{Method: http.MethodPost, Path: "/api/webauthn/assert/options", Tag: "device", Summary: "Start a passkey assertion", Request: WebAuthnAssertOptionsRequest{}, Response: WebAuthnAssertOptionsResponse{}},
+	{Method: http.MethodPost, Path: "/api/webauthn/assert", Tag: "device", Summary: "Finish a passkey assertion; sets the device_ticket cookie", Request: WebAuthnAssertRequest{}, Response: DeviceOKResponse{}},
+
+	{Method: http.MethodPost, Path: "/api/login", Tag: "session", Summary: "Log in with the user secret and, when enabled, a TOTP code", Security: secDevice, Request: LoginRequest{}, Response: AuthedResponse{},
+		Description: "The user's main secret or one of its named secrets (see /api/admin/secrets) is accepted; a named secret caps the session scope."},
+	{Method: http.MethodGet, Path: "/api/session", Tag: "session", Summary: "Report whether the cookies hold a valid session", Response: AuthedResponse{}},
+	{Method: http.MethodPost, Path: "/api/session/refresh", Tag: "session", Summary: "Extend the session within its maximum lifetime", Security: secSession, Response: SessionRefreshResponse{}},
+	{Method: http.MethodPost, Path: "/api/logout", Tag: "session", Summary: "Revoke the session and clear cookies", Response: LoggedOutResponse{}},
+	{Method: http.MethodPost, Path: "/api/totp/setup", Tag: "session", Summary: "Generate a TOTP seed for this device", Security: secSession, Response: TOTPSetupResponse{}},
+	{Method: http.MethodPost, Path: "/api/totp/confirm", Tag: "session", Summary: "Enable TOTP with a first code", Security: secSession, Request: TOTPConfirmRequest{}, Response: TOTPEnabledResponse{}},
+	{Method: http.MethodGet, Path: "/api/presence", Tag: "session", Summary: "Count the user's online devices", Security: [][]string{{"deviceTicket", "session"}, {"apiToken"}}, Response: PresenceResponse{}, Wrapped: true},
+	{Method: http.MethodGet, Path: "/auth/oidc/login", Tag: "session", Summary: "Redirect to the OIDC provider", Security: secDevice, Status: http.StatusFound},
+	{Method: http.MethodGet, Path: "/auth/oidc/callback", Tag: "session", Summary: "OIDC redirect target; sets the session cookie", Status: http.StatusFound},
+	{Method: http.MethodGet, Path: "/ws", Tag: "session", Summary: "Open the realtime WebSocket", Security: [][]string{{"deviceTicket", "session"}, {"apiToken"}},
+		Query: []apiParam{
+			{"client_version", "string", "Client version, checked against the minimum supported one"},
+			{"max_chunk", "integer", "Largest para_chunk in bytes the client can send and receive; msg_params grants the smallest among the peers"},
+			{"locale", "string", "BCP 47 language tag relayed to peers in peer_info; defaults to the first Accept-Language tag"},
+			{"tz", "string", "IANA time zone name relayed to peers in peer_info"},
+			{"room", "string", "Room to join among the user's devices (1-64 letters, digits, - or _); omitted joins the default room"},
+			{"resume", "string", "resumeToken from the connected event of a connection that dropped; replays what it missed"},
+			{"last_seq", "integer", "seq of the last event received on the dropped connection; required with resume"},
+			{"reconnect", "string", "Token from the reason of a 1001 or 4004 close frame; authorises this one connection within 30 seconds without a device ticket or session"},
+		},
+		Status: http.StatusSwitchingProtocols, Description: "Subprotocols " + realtime.SubprotocolJSON + " and " + realtime.SubprotocolCBOR + "; see /api/version for the protocol version."},
+
+	{Method: http.MethodGet, Path: "/api/tokens", Tag: "tokens", Summary: "List this device's API tokens", Security: secSession, Response: APITokenListResponse{}},
+	{Method: http.MethodPost, Path: "/api/tokens", Tag: "tokens", Summary: "Create an API token for this device", Security: secSession, Request: APITokenCreateRequest{}, Response: APITokenCreatedResponse{}},
+	{Method: http.MethodDelete, Path: "/api/tokens/{id}", Tag: "tokens", Summary: "Revoke an API token", Security: secSession, Response: APITokenRevokedResponse{}},
+	{Method: http.MethodPost, Path: "/api/cert-report", Tag: "session", Summary: "Report the TLS certificate fingerprint the client saw", Security: [][]string{{"deviceTicket", "session"}, {"apiToken"}}, Request: CertReportRequest{}, Response: CertReportResponse{},
+		Description: "Mismatches with the pinned certificates are audited and sent to CERT_ALERT_WEBHOOK. 404 CERT_PINNING_DISABLED when no pins are configured."},
+	{Method: http.MethodGet, Path: "/api/transfers/{id}/receipt", Tag: "session", Summary: "Signed receipt of a committed transfer", Security: [][]string{{"deviceTicket", "session"}, {"apiToken"}}, Response: TransferReceiptResponse{},
+		Description: "{id} is the receipt ID msg_commit carried. Any device of the user that made the transfer may fetch it. 404 RECEIPTS_DISABLED unless TRANSFER_RECEIPTS is on."},
+	{Method: http.MethodPost, Path: "/api/push", Tag: "tokens", Summary: "Send text to an online device", Security: [][]string{{"appToken"}}, Request: PushRequest{}, Response: PushResponse{}},
+
+	{Method: http.MethodPost, Path: "/api/admin/login", Tag: "admin", Summary: "Exchange the admin secret for an admin token", Request: AdminLoginRequest{}, Response: AdminTokenResponse{}},
+	{Method: http.MethodPost, Path: "/api/admin/logout", Tag: "admin", Summary: "Revoke the admin token", Security: secAdmin, Response: LoggedOutResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/devices", Tag: "admin", Summary: "List enrolled devices", Security: secAdmin, Response: DeviceListResponse{},
+		Query: []apiParam{{"label", "string", "Substring the label must contain"}, {"limit", "integer", "Page size, 1-500 (default 100)"}, {"offset", "integer", "Devices to skip"}}},
+	{Method: http.MethodPost, Path: "/api/admin/devices", Tag: "admin", Summary: "Enroll a device from its public key", Security: secEnroll, Request: DeviceAddRequest{}, Response: AddedResponse{}},
+	{Method: http.MethodPatch, Path: "/api/admin/devices/{id}", Tag: "admin", Summary: "Rename a device", Security: secAdmin, Request: DeviceUpdateRequest{}, Response: DeviceUpdatedResponse{}},
+	{Method: http.MethodDelete, Path: "/api/admin/devices/{id}", Tag: "admin", Summary: "Move a device to the trash and disconnect it", Security: secAdmin, Response: DeviceDeletedResponse{}},
+	{Method: http.MethodPost, Path: "/api/admin/devices/{id}/restore", Tag: "admin", Summary: "Restore a device from the trash", Security: secAdmin, Response: DeviceRestoredResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/devices/{id}/impact", Tag: "admin", Summary: "Preview what revoking a device would disrupt", Security: secAdmin, Response: DeviceImpactResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/devices/{id}/connections", Tag: "admin", Summary: "Recent connection attempts", Security: secAdmin, Response: ConnectionsResponse{},
+		Query: []apiParam{{"limit", "integer", "Maximum attempts, 1-500"}}},
+	{Method: http.MethodGet, Path: "/api/admin/devices/{id}/timeline", Tag: "admin", Summary: "Online intervals of a device", Security: secAdmin, Response: TimelineResponse{},
+		Query: []apiParam{{"limit", "integer", "Page size, 1-500 (default 50)"}, {"before", "integer", "Cursor from the previous page"}}},
+	{Method: http.MethodPut, Path: "/api/admin/devices/{id}/state", Tag: "admin", Summary: "Disable or enable a device", Security: secAdmin, Request: DeviceStateRequest{}, Response: DeviceStateResponse{}},
+	{Method: http.MethodDelete, Path: "/api/admin/devices/{id}/totp", Tag: "admin", Summary: "Reset a device's TOTP", Security: secAdmin, Response: TOTPEnabledResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/devices/{id}/commands", Tag: "admin", Summary: "Commands the device may receive", Security: secAdmin, Response: AllowedCommandsResponse{}},
+	{Method: http.MethodPut, Path: "/api/admin/devices/{id}/commands", Tag: "admin", Summary: "Replace the command allowlist", Security: secAdmin, Request: AllowedCommandsRequest{}, Response: AllowedCommandsResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/devices/{id}/peers", Tag: "admin", Summary: "Devices this one may exchange messages with", Security: secAdmin, Response: DevicePeersResponse{}},
+	{Method: http.MethodPut, Path: "/api/admin/devices/{id}/peers", Tag: "admin", Summary: "Replace the peer allowlist; empty means unrestricted", Security: secAdmin, Request: DevicePeersRequest{}, Response: DevicePeersResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/devices/{id}/wake", Tag: "admin", Summary: "How the server wakes the device when it is offline", Security: secAdmin, Response: WakeTargetResponse{}},
+	{Method: http.MethodPut, Path: "/api/admin/devices/{id}/wake", Tag: "admin", Summary: "Set a Wake-on-LAN MAC and/or webhook", Security: secAdmin, Request: WakeTargetRequest{}, Response: WakeTargetResponse{}},
+	{Method: http.MethodDelete, Path: "/api/admin/devices/{id}/wake", Tag: "admin", Summary: "Remove the wake target", Security: secAdmin, Response: WakeTargetResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/trash", Tag: "admin", Summary: "List trashed devices", Security: secAdmin, Response: TrashResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/users", Tag: "admin", Summary: "List users", Security: secAdmin, Response: UserListResponse{}},
+	{Method: http.MethodPost, Path: "/api/admin/users", Tag: "admin", Summary: "Create a user", Security: secAdmin, Request: UserCreateRequest{}, Response: UserInfo{}},
+	{Method: http.MethodGet, Path: "/api/admin/secrets", Tag: "admin", Summary: "List a user's named login secrets", Security: secAdmin, Response: LoginSecretListResponse{},
+		Query: []apiParam{{"user_id", "string", "User whose secrets to list; omitted lists the default account's"}}},
+	{Method: http.MethodPost, Path: "/api/admin/secrets", Tag: "admin", Summary: "Add a named login secret that caps session scope", Security: secAdmin, Request: LoginSecretCreateRequest{}, Response: LoginSecretInfo{},
+		Description: "At most 8 per user. Logging in with a readonly secret always starts a readonly session."},
+	{Method: http.MethodDelete, Path: "/api/admin/secrets/{name}", Tag: "admin", Summary: "Remove a named login secret", Security: secAdmin, Response: LoginSecretDeletedResponse{},
+		Query: []apiParam{{"user_id", "string", "User the secret belongs to; omitted means the default account"}}},
+	{Method: http.MethodGet, Path: "/api/admin/loglevel", Tag: "admin", Summary: "Log levels by component", Security: secAdmin, Response: LogLevelResponse{}},
+	{Method: http.MethodPut, Path: "/api/admin/loglevel", Tag: "admin", Summary: "Change log levels without a restart", Description: "Components are handler, hub, store and auth. revert_after (seconds) undoes the change later.", Security: secAdmin, Request: LogLevelRequest{}, Response: LogLevelResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/features", Tag: "admin", Summary: "Feature flags", Security: secAdmin, Response: FeaturesResponse{}},
+	{Method: http.MethodPut, Path: "/api/admin/features", Tag: "admin", Summary: "Turn feature flags on or off", Description: "null returns a flag to its default. Flags set by the FEATURES environment variable cannot be changed.", Security: secAdmin, Request: FeaturesRequest{}, Response: FeaturesResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/stats", Tag: "admin", Summary: "Server statistics", Security: secAdmin, Response: AdminStatsResponse{}},
+	{Method: http.MethodGet, Path: "/api/admin/cert-reports", Tag: "admin", Summary: "Recent certificate mismatch reports", Security: secAdmin, Response: CertReportsResponse{},
+		Query: []apiParam{{"limit", "integer", "Maximum reports, 1-500 (default 50)"}}},
+	{Method: http.MethodGet, Path: "/api/admin/enroll-events", Tag: "admin", Summary: "Recent enrollments rejected for an invalid device payload", Security: secAdmin, Response: EnrollEventsResponse{},
+		Description: "Each names the pairing code issuer or the bootstrap token that authorised it; outcome locked marks the attempt that revoked the credential.",
+		Query:       []apiParam{{"limit", "integer", "Maximum events, 1-500 (default 50)"}}},
+	{Method: http.MethodGet, Path: "/api/admin/app-tokens", Tag: "admin", Summary: "List app tokens", Security: secAdmin, Response: AppTokenListResponse{}},
+	{Method: http.MethodPost, Path: "/api/admin/app-tokens", Tag: "admin", Summary: "Create a push-only app token", Security: secAdmin, Request: AppTokenCreateRequest{}, Response: AppTokenCreatedResponse{}},
+	{Method: http.MethodDelete, Path: "/api/admin/app-tokens/{id}", Tag: "admin", Summary: "Revoke an app token", Security: secAdmin, Response: AppTokenRevokedResponse{}},
+}
+
+var pathParamRE = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPISpec builds the OpenAPI 3 document for apiOperations.
+func openAPISpec(version string) map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+
+	for _, op := range apiOperations {
+		o := map[string]any{
+			"tags":        []string{op.Tag},
+			"summary":     op.Summary,
+			"operationId": operationID(op),
+		}
+		if op.Description != "" {
+			o["description"] = op.Description
+		}
+
+		var params []any
+		for _, m := range pathParamRE.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]any{
+				"name": q.Name, "in": "query", "description": q.Description,
+				"schema": map[string]any{"type": q.Type},
+			})
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+
+		if op.Request != nil {
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(schemaRef(schemas, reflect.TypeOf(op.Request))),
+			}
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		ok := map[string]any{"description": http.StatusText(status)}
+		if op.Response != nil {
+			schema := schemaRef(schemas, reflect.TypeOf(op.Response))
+			if op.Wrapped {
+				schema = map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"success": map[string]any{"type": "boolean"},
+						"data":    schema,
+					},
+				}
+			}
+			ok["content"] = jsonContent(schema)
+		}
+		o["responses"] = map[string]any{
+			strconv.Itoa(status): ok,
+			"default":            map[string]any{"$ref": "#/components/responses/Error"},
+		}
+
+		if len(op.Security) > 0 {
+			var sec []any
+			for _, set := range op.Security {
+				req := map[string][]string{}
+				for _, name := range set {
+					req[name] = []string{}
+				}
+				sec = append(sec, req)
+			}
+			o["security"] = sec
+		}
+
+		item, _ := paths[op.Path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = o
+	}
+
+	errSchema := schemaRef(schemas, reflect.TypeOf(APIResponse{}))
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "FileFlow API",
+			"version":     version,
+			"description": "Every path is also served under /api/v" + strconv.Itoa(APIVersion) + ", e.g. /api/v1/login. Pin the versioned prefix to keep working across future breaking changes.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"responses": map[string]any{
+				"Error": map[string]any{
+					"description": "Error, with a machine-readable code",
+					"content":     jsonContent(errSchema),
+				},
+			},
+			"securitySchemes": map[string]any{
+				"deviceTicket": map[string]any{
+					"type": "apiKey", "in": "cookie", "name": cookieDeviceTicket,
+					"description": "Set by /api/device/attest; named " + hostPrefix + cookieDeviceTicket + " behind HTTPS.",
+				},
+				"session": map[string]any{
+					"type": "apiKey", "in": "cookie", "name": cookieSession,
+					"description": "Set by /api/login; named " + hostPrefix + cookieSession + " behind HTTPS.",
+				},
+				"adminToken": map[string]any{
+					"type": "http", "scheme": "bearer",
+					"description": "Token from /api/admin/login. Read-only tokens may only GET.",
+				},
+				"adminBootstrap": map[string]any{
+					"type": "apiKey", "in": "header", "name": "X-Admin-Bootstrap",
+					"description": "Bootstrap token; only accepted until the first device is enrolled.",
+				},
+				"apiToken": map[string]any{
+					"type": "http", "scheme": "bearer",
+					"description": "Device API token (" + auth.APITokenPrefix + "…) from /api/tokens.",
+				},
+				"appToken": map[string]any{
+					"type": "http", "scheme": "bearer",
+					"description": "Push-only app token (" + auth.AppTokenPrefix + "…) from /api/admin/app-tokens.",
+				},
+			},
+		},
+	}
+}
+
+// operationID derives a stable camelCase ID such as "getAdminDevicesIdPeers".
+func operationID(op apiOperation) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(op.Method))
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool {
+		return r == '/' || r == '-' || r == '.' || r == '{' || r == '}'
+	}) {
+		if part == "api" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+func jsonContent(schema any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// schemaRef returns the schema for t, registering named structs under
+// components/schemas and referring to them by name.
+func schemaRef(schemas map[string]any, t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaRef(schemas, t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaRef(schemas, t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(schemas, t)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Placeholder first so self-referencing types terminate.
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = structSchema(schemas, t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	// interface{} and anything else accepts any JSON value.
+	return map[string]any{}
+}
+
+func structSchema(schemas map[string]any, t reflect.Type) map[string]any {
+	props := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaRef(schemas, f.Type)
+	}
+	return map[string]any{"type": "object", "properties": props}
+}
+
+// handleOpenAPI serves the OpenAPI document. It is public: it describes
+// routes, not data.
+func (h *Handler) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	version := h.build.Version
+	if version == "" {
+		version = "dev"
+	}
+	writeJSON(w, http.StatusOK, openAPISpec(version))
+}
+
+// swaggerUIVersion pins the swagger-ui-dist release /api/docs loads.
+const swaggerUIVersion = "5.17.14"
+
+const apiDocsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>FileFlow API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@` + swaggerUIVersion + `/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@` + swaggerUIVersion + `/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/api/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// handleAPIDocs serves Swagger UI. It is only routed with Config.APIDocs,
+// since it needs a looser CSP than the rest of the site.
+func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy",
+		"default-src 'none'; script-src https://unpkg.com 'unsafe-inline'; style-src https://unpkg.com; "+
+			"img-src 'self' data:; connect-src 'self'; base-uri 'none'; frame-ancestors 'none'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(apiDocsPage))
+}
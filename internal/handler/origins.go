@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Origins is an allowlist of browser origins, shared by CORSMiddleware and
+// the WebSocket origin check. Entries are full origins
+// (https://app.example.com, http://localhost:3000), bare hosts, which mean
+// https, or wildcard hosts like *.example.com, which match any subdomain
+// at any depth but not example.com itself.
+type Origins struct {
+	exact    map[string]bool
+	suffixes []originSuffix // wildcard entries
+
+}
+
+type originSuffix struct {
+	scheme string
+	domain string
+}
+
+// ParseOrigins parses a comma-separated allowlist. An empty list returns
+// nil, which Allow treats as allowing nothing.
+func ParseOrigins(list string) (*Origins, error) {
+	o := &Origins{exact: make(map[string]bool)}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		scheme := "https"
+		host := entry
+		if s, rest, ok := strings.Cut(entry, "://"); ok {
+			scheme, host = strings.ToLower(s), rest
+		}
+		if scheme != "https" && scheme != "http" {
+			return nil, fmt.Errorf("origin %q: scheme must be http or https", entry)
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "/"))
+		if wild, ok := strings.CutPrefix(host, "*."); ok {
+			if !validOriginHost(wild) {
+				return nil, fmt.Errorf("origin %q: invalid host", entry)
+			}
+			o.suffixes = append(o.suffixes, originSuffix{scheme: scheme + "://", domain: "." + wild})
+			continue
+		}
+		if !validOriginHost(host) {
+			return nil, fmt.Errorf("origin %q: invalid host", entry)
+		}
+		o.exact[scheme+"://"+host] = true
+	}
+	if len(o.exact) == 0 && len(o.suffixes) == 0 {
+		return nil, nil
+	}
+	return o, nil
+}
+
+// validOriginHost accepts host[:port] with no path, userinfo or wildcard.
+func validOriginHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/@*?#") {
+		return false
+	}
+	u, err := url.Parse("https://" + host)
+	return err == nil && u.Host == host
+}
+
+// Allow reports whether an Origin header value is on the list.
+func (o *Origins) Allow(origin string) bool {
+	if o == nil || origin == "" {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	if o.exact[origin] {
+		return true
+	}
+	for _, s := range o.suffixes {
+		if host, ok := strings.CutPrefix(origin, s.scheme); ok && strings.HasSuffix(host, s.domain) && len(host) > len(s.domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// handlePairingCode issues a short-lived, single-use code that lets a new
+// device enroll itself through /api/device/enroll. Only a logged-in device
+// can vouch for another one.
+func (h *Handler) handlePairingCode(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := h.requireDeviceSession(w, r)
+	if !ok {
+		return
+	}
+
+	p, err := h.pairingStore.Create(deviceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create pairing code", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create pairing code")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PairingCodeResponse{
+		Code:      p.Code,
+		ExpiresAt: p.ExpiresAt.UnixMilli(),
+	})
+}
+
+// handleDeviceEnroll adds a device that presents a valid pairing code. It is
+// the self-service counterpart of POST /api/admin/devices.
+func (h *Handler) handleDeviceEnroll(w http.ResponseWriter, r *http.Request) {
+	// Codes are short enough to guess given unlimited tries.
+	if ok, st := h.loginLimiter.Check(h.LimitKey(r)); !ok {
+		writeRateLimited(w, st, "Too many requests")
+		return
+	}
+
+	var req EnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+
+	// Validate before consuming so a malformed request does not burn the
+	// code; rejectEnrollment revokes it after enrollMaxInvalid of them.
+	if err := auth.ValidateDeviceID(req.DeviceID, req.PubJWK); err != nil {
+		h.rejectEnrollment(w, r, req.Code, "INVALID_DEVICE_ID", err.Error())
+		return
+	}
+	// Unlike the admin endpoint, anyone with a code can call this, so the
+	// device ID must be the one derived from the key being enrolled.
+	_, jwk, _ := auth.ParsePublicJWKMap(req.PubJWK)
+	if derived, err := auth.DeviceIDFromJWK(jwk); err != nil || derived != req.DeviceID {
+		h.rejectEnrollment(w, r, req.Code, "INVALID_DEVICE_ID", "device_id does not match public key")
+		return
+	}
+	jwkJSON, err := json.Marshal(req.PubJWK)
+	if err != nil {
+		h.rejectEnrollment(w, r, req.Code, "INVALID_PUBLIC_KEY", "Failed to serialize public key")
+		return
+	}
+
+	p, err := h.pairingStore.Consume(req.Code)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_PAIRING_CODE", "Invalid or expired pairing code")
+		return
+	}
+
+	// The new device joins the account of the device that issued the code.
+	userID, err := h.deviceUser(p.IssuedBy)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_PAIRING_CODE", "Invalid or expired pairing code")
+		return
+	}
+
+	device := &store.Device{
+		DeviceID:   req.DeviceID,
+		PubJWKJSON: string(jwkJSON),
+		Label:      req.Label,
+		CreatedAt:  time.Now().UnixMilli(),
+		UserID:     userID,
+	}
+	if err := h.store.AddDevice(device); err != nil {
+		if errors.Is(err, store.ErrDeviceExists) {
+			writeError(w, http.StatusConflict, "DEVICE_EXISTS", "Device already enrolled")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to add device", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to add device")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Device enrolled with a pairing code", "device_id", req.DeviceID, "issued_by", p.IssuedBy)
+	writeJSON(w, http.StatusOK, AddedResponse{Added: true})
+}
+
+// handleAdminEnrollEvents lists the most recent rejected enrollments.
+func (h *Handler) handleAdminEnrollEvents(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+
+	events, err := h.store.ListEnrollEvents(limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list enrollment events", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list enrollment events")
+		return
+	}
+	writeJSON(w, http.StatusOK, EnrollEventsResponse{Events: events})
+}
+
+// rejectEnrollment answers an enrollment whose device payload is invalid
+// with a 400 and counts it against the credential that authorised it: the
+// pairing code when code is set, otherwise the bootstrap token if the
+// request used it. A credential stops working after enrollMaxInvalid such
+// payloads, and each one is recorded as an enrollment event.
+func (h *Handler) rejectEnrollment(w http.ResponseWriter, r *http.Request, code, errCode, msg string) {
+	writeError(w, http.StatusBadRequest, errCode, msg)
+
+	event := &store.EnrollEvent{
+		Outcome:   store.EnrollOutcomeInvalidPayload,
+		Reason:    errCode,
+		IP:        getClientIP(r),
+		UserAgent: r.UserAgent(),
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	locked := false
+	switch {
+	case code != "":
+		p, l := h.pairingStore.Strike(code, h.enrollMaxInvalid)
+		if p == nil {
+			return
+		}
+		event.Credential, event.IssuedBy, locked = store.EnrollCredentialPairing, p.IssuedBy, l
+	case h.viaBootstrap(r):
+		h.bootstrapMu.Lock()
+		h.bootstrapStrikes++
+		locked = h.bootstrapStrikes == h.enrollMaxInvalid
+		h.bootstrapMu.Unlock()
+		event.Credential = store.EnrollCredentialBootstrap
+	default:
+		return
+	}
+	if locked {
+		event.Outcome = store.EnrollOutcomeLocked
+		slog.WarnContext(r.Context(), "Enrollment credential locked after repeated invalid payloads",
+			"credential", event.Credential, "issued_by", event.IssuedBy, "ip", event.IP)
+	}
+	if _, err := h.store.RecordEnrollEvent(event); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record enrollment event", "err", err)
+	}
+}
+
+// viaBootstrap reports whether r, which passed requireEnrollAdmin, was let
+// through by the bootstrap token rather than an admin token.
+func (h *Handler) viaBootstrap(r *http.Request) bool {
+	if r.Header.Get("X-Admin-Bootstrap") == "" {
+		return false
+	}
+	_, err := h.adminClaims(r, auth.ScopeAdmin)
+	return err != nil
+}
+
+// bootstrapLocked reports whether the bootstrap token has taken too many
+// invalid payloads. The lock lasts until the server restarts.
+func (h *Handler) bootstrapLocked() bool {
+	h.bootstrapMu.Lock()
+	defer h.bootstrapMu.Unlock()
+	return h.bootstrapStrikes >= h.enrollMaxInvalid
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// handleAdminDevicePeers reads (GET) or replaces (PUT) the devices a device
+// may exchange realtime events with. An empty list lets it talk to every
+// unrestricted device of its user.
+func (h *Handler) handleAdminDevicePeers(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdminMethod(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req DevicePeersRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+			return
+		}
+
+		device, err := h.store.GetDevice(deviceID)
+		if err != nil {
+			if errors.Is(err, store.ErrDeviceNotFound) {
+				writeError(w, http.StatusNotFound, "DEVICE_NOT_FOUND", "Device not found")
+				return
+			}
+			slog.ErrorContext(r.Context(), "Failed to look up device", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+			return
+		}
+		// The hub never routes between users, so a cross-user link could
+		// only restrict and would never let the devices talk.
+		for _, peerID := range req.Peers {
+			if peerID == deviceID || !auth.ValidateDeviceIDFormat(peerID) {
+				writeError(w, http.StatusBadRequest, "INVALID_PEER", "Invalid peer: "+peerID)
+				return
+			}
+			peer, err := h.store.GetDevice(peerID)
+			if errors.Is(err, store.ErrDeviceNotFound) || (err == nil && peer.UserID != device.UserID) {
+				writeError(w, http.StatusBadRequest, "INVALID_PEER", "Not a device of the same user: "+peerID)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to look up device", "err", err)
+				writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+				return
+			}
+		}
+
+		if err := h.store.SetPeers(deviceID, req.Peers); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to set peers", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update peers")
+			return
+		}
+	}
+
+	peers, err := h.store.Peers(deviceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load peers", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load peers")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, DevicePeersResponse{DeviceID: deviceID, Peers: peers})
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/lixiansheng/fileflow/internal/realtime"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// Transfer receipts. With TRANSFER_RECEIPTS on, the hub reports every
+// atomic message or file transfer both ends confirmed, the Handler signs
+// and stores a receipt for it, and msg_commit tells both ends the receipt
+// ID. A receipt holds the two device IDs, chunk and byte counts, the
+// SHA-256 both ends agreed on and when the transfer started and
+// committed, never content. The signature is keyed by the session key, so
+// only this server can check it, and does so on every fetch.
+
+// RecordReceipt signs and stores r. It implements realtime.ReceiptRecorder.
+func (h *Handler) RecordReceipt(r realtime.Receipt) (string, error) {
+	receipt := &store.TransferReceipt{
+		ID:          uuid.NewString(),
+		UserID:      r.UserID,
+		MsgID:       r.MsgID,
+		Sender:      r.From,
+		Receiver:    r.To,
+		File:        r.File,
+		Chunks:      r.Chunks,
+		Bytes:       r.Bytes,
+		SHA256:      r.SHA256,
+		StartedAt:   r.StartedAt.UnixMilli(),
+		CommittedAt: r.CommittedAt.UnixMilli(),
+	}
+	sig, err := h.signReceipt(receipt)
+	if err != nil {
+		return "", err
+	}
+	receipt.Signature = sig
+	if err := h.store.PutTransferReceipt(receipt); err != nil {
+		return "", err
+	}
+	return receipt.ID, nil
+}
+
+// signReceipt signs the JSON encoding of r without its signature.
+func (h *Handler) signReceipt(r *store.TransferReceipt) (string, error) {
+	unsigned := *r
+	unsigned.Signature = ""
+	payload, err := json.Marshal(unsigned)
+	if err != nil {
+		return "", err
+	}
+	return h.tokenManager.ReceiptSignature(payload), nil
+}
+
+// handleTransferReceipt returns a receipt to a device of the user that
+// made the transfer, with whether its signature is still valid. Receipts
+// of other users are reported as not found. It takes a device ticket and
+// session or an API token.
+func (h *Handler) handleTransferReceipt(w http.ResponseWriter, r *http.Request) {
+	if !h.receipts {
+		writeError(w, http.StatusNotFound, "RECEIPTS_DISABLED", "Transfer receipts are not enabled")
+		return
+	}
+
+	deviceID, ok := h.requireDeviceOrToken(w, r)
+	if !ok {
+		return
+	}
+	userID, err := h.deviceUser(deviceID)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_DEVICE_TICKET", "Invalid device ticket")
+		return
+	}
+
+	receipt, err := h.store.GetTransferReceipt(r.PathValue("id"))
+	if errors.Is(err, store.ErrReceiptNotFound) || (err == nil && receipt.UserID != userID) {
+		writeError(w, http.StatusNotFound, "RECEIPT_NOT_FOUND", "Receipt not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load transfer receipt", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return
+	}
+
+	sig, err := h.signReceipt(receipt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return
+	}
+	writeJSON(w, http.StatusOK, TransferReceiptResponse{
+		Receipt: *receipt,
+		Valid:   hmac.Equal([]byte(sig), []byte(receipt.Signature)),
+	})
+}
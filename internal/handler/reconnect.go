@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/logging"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// reconnectTTL is how long a reconnect token from a close frame stays
+// valid.
+const reconnectTTL = 30 * time.Second
+
+var errInvalidReconnect = errors.New("invalid reconnect token")
+
+// ReconnectToken implements realtime.Reconnector: it grants the device
+// connected with sessionID one WebSocket connection without a device
+// ticket or session cookie within reconnectTTL, so it can roam to another
+// network without a new challenge. Connections made with an API token get
+// none; they can present the token again.
+func (h *Handler) ReconnectToken(deviceID, sessionID string, readOnly bool) string {
+	if sessionID == "" || strings.HasPrefix(sessionID, apiTokenSession("")) {
+		return ""
+	}
+	token, hash, err := auth.GenerateReconnectToken()
+	if err != nil {
+		slog.Error("Failed to generate reconnect token", "err", err)
+		return ""
+	}
+	err = h.store.PutReconnectGrant(&store.ReconnectGrant{
+		Hash:      hash,
+		DeviceID:  deviceID,
+		SessionID: sessionID,
+		ReadOnly:  readOnly,
+		ExpiresAt: time.Now().Add(reconnectTTL).UnixMilli(),
+	})
+	if err != nil {
+		slog.Error("Failed to store reconnect grant", "err", err, "device_id", deviceID)
+		return ""
+	}
+	return token
+}
+
+// verifyReconnect redeems a /ws?reconnect= token. Like a device ticket,
+// it fails with errDeviceRevoked or errDeviceDisabled, with the device,
+// once an admin deleted or disabled the device, and a revoked session
+// does not carry over.
+func (h *Handler) verifyReconnect(r *http.Request, token string) (wsAuth, error) {
+	if !strings.HasPrefix(token, auth.ReconnectTokenPrefix) {
+		return wsAuth{}, errInvalidReconnect
+	}
+	g, err := h.store.TakeReconnectGrant(auth.HashAPIToken(token), time.Now().UnixMilli())
+	if errors.Is(err, store.ErrReconnectGrantNotFound) {
+		return wsAuth{}, errInvalidReconnect
+	}
+	if err != nil {
+		return wsAuth{}, err
+	}
+
+	a := wsAuth{deviceID: g.DeviceID, sessionID: g.SessionID, readOnly: g.ReadOnly}
+	device, err := h.store.GetDevice(g.DeviceID)
+	if err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			return a, errDeviceRevoked
+		}
+		return wsAuth{}, err
+	}
+	if device.Disabled {
+		return a, errDeviceDisabled
+	}
+	revoked, err := h.store.IsSessionRevoked(g.SessionID)
+	if err != nil {
+		return wsAuth{}, err
+	}
+	if revoked {
+		return a, errInvalidReconnect
+	}
+
+	logging.SetDeviceID(r.Context(), g.DeviceID)
+	return a, nil
+}
@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// Named login secrets. Besides its main secret, a user can have up to
+// maxLoginSecrets named ones, each with the widest scope a session it
+// starts may have. Login tries the main secret first, then the named ones
+// oldest first, so every extra secret adds an Argon2 check to a failed
+// login; hence the small cap.
+
+const maxLoginSecrets = 8
+
+var loginSecretNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+var errWrongSecret = errors.New("wrong secret")
+
+// matchLoginSecret checks secret against userID's main secret, whose hash
+// is mainHash, and then its named secrets. It returns the scope the
+// matching secret allows, upgrading its hash if it is due. Errors from
+// the verifier pool are returned as they are; no match is errWrongSecret.
+func (h *Handler) matchLoginSecret(r *http.Request, userID, secret, mainHash string) (string, error) {
+	err := h.verifySecret(r, secret, mainHash)
+	if err == nil {
+		h.maybeRehashUserSecret(userID, secret, mainHash)
+		return auth.ScopeUser, nil
+	}
+	if verifierError(err) {
+		return "", err
+	}
+
+	named, err := h.store.ListLoginSecrets(userID)
+	if err != nil {
+		return "", err
+	}
+	for _, ls := range named {
+		err := h.verifySecret(r, secret, ls.SecretHash)
+		if err == nil {
+			h.maybeRehashLoginSecret(ls, secret)
+			return ls.Scope, nil
+		}
+		if verifierError(err) {
+			return "", err
+		}
+	}
+	return "", errWrongSecret
+}
+
+// verifierError reports whether err came from the verifier pool rather
+// than from a wrong secret.
+func verifierError(err error) bool {
+	return errors.Is(err, auth.ErrVerifierBusy) || errors.Is(err, auth.ErrVerifierTimeout)
+}
+
+// maybeRehashLoginSecret is maybeRehashUserSecret for a named secret.
+func (h *Handler) maybeRehashLoginSecret(ls store.LoginSecret, secret string) {
+	if !auth.NeedsRehash(ls.SecretHash, h.argonParams) {
+		return
+	}
+	newHash, err := auth.HashSecretParams(secret, h.argonParams)
+	if err != nil {
+		slog.Error("Failed to re-hash secret", "err", err)
+		return
+	}
+	if err := h.store.SetLoginSecretHash(ls.UserID, ls.Name, newHash); err != nil {
+		slog.Error("Failed to store re-hashed secret", "user_id", ls.UserID, "name", ls.Name, "err", err)
+	}
+}
+
+// narrowScope returns the narrower of two session scopes.
+func narrowScope(a, b string) string {
+	if a == auth.ScopeReadOnly || b == auth.ScopeReadOnly {
+		return auth.ScopeReadOnly
+	}
+	return auth.ScopeUser
+}
+
+// handleAdminLoginSecretList lists the named secrets of the user in
+// ?user_id=, the default account when it is empty.
+func (h *Handler) handleAdminLoginSecretList(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if !h.requireUser(w, userID) {
+		return
+	}
+	secrets, err := h.store.ListLoginSecrets(userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list login secrets", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list secrets")
+		return
+	}
+
+	resp := LoginSecretListResponse{Secrets: make([]LoginSecretInfo, 0, len(secrets))}
+	for _, ls := range secrets {
+		resp.Secrets = append(resp.Secrets, loginSecretInfo(ls))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleAdminLoginSecretCreate adds a named secret to a user.
+func (h *Handler) handleAdminLoginSecretCreate(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	var req LoginSecretCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+	if !loginSecretNamePattern.MatchString(req.Name) {
+		writeError(w, http.StatusBadRequest, "INVALID_SECRET_NAME", "name must be 1-32 lowercase letters, digits, - or _")
+		return
+	}
+	if req.Scope != auth.ScopeUser && req.Scope != auth.ScopeReadOnly {
+		writeError(w, http.StatusBadRequest, "INVALID_SCOPE", "scope must be user or readonly")
+		return
+	}
+	if len(req.Secret) < minUserSecretLen {
+		writeError(w, http.StatusBadRequest, "WEAK_SECRET", "secret must be at least 8 characters")
+		return
+	}
+	if !h.requireUser(w, req.UserID) {
+		return
+	}
+
+	existing, err := h.store.ListLoginSecrets(req.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list login secrets", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create secret")
+		return
+	}
+	if len(existing) >= maxLoginSecrets {
+		writeError(w, http.StatusConflict, "TOO_MANY_SECRETS", "A user can have at most 8 named secrets")
+		return
+	}
+
+	hash, err := auth.HashSecretParams(req.Secret, h.argonParams)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to hash login secret", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create secret")
+		return
+	}
+	ls := store.LoginSecret{
+		UserID:     req.UserID,
+		Name:       req.Name,
+		SecretHash: hash,
+		Scope:      req.Scope,
+		CreatedAt:  time.Now().UnixMilli(),
+	}
+	if err := h.store.CreateLoginSecret(&ls); err != nil {
+		if errors.Is(err, store.ErrLoginSecretExists) {
+			writeError(w, http.StatusConflict, "SECRET_EXISTS", "The user already has a secret with that name")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to store login secret", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create secret")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Login secret created", "user_id", ls.UserID, "name", ls.Name, "scope", ls.Scope)
+	writeJSON(w, http.StatusOK, loginSecretInfo(ls))
+}
+
+// handleAdminLoginSecretDelete removes the named secret at
+// /api/admin/secrets/{name} from the user in ?user_id=. Sessions it
+// started live on until they expire.
+func (h *Handler) handleAdminLoginSecretDelete(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	userID, name := r.URL.Query().Get("user_id"), r.PathValue("name")
+	if err := h.store.DeleteLoginSecret(userID, name); err != nil {
+		if errors.Is(err, store.ErrLoginSecretNotFound) {
+			writeError(w, http.StatusNotFound, "SECRET_NOT_FOUND", "Secret not found")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to delete login secret", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete secret")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Login secret deleted", "user_id", userID, "name", name)
+	writeJSON(w, http.StatusOK, LoginSecretDeletedResponse{Name: name, Deleted: true})
+}
+
+func loginSecretInfo(ls store.LoginSecret) LoginSecretInfo {
+	return LoginSecretInfo{UserID: ls.UserID, Name: ls.Name, Scope: ls.Scope, CreatedAt: ls.CreatedAt}
+}
@@ -0,0 +1,29 @@
+package handler
+
+import "net/http"
+
+// handleAdminStats reports server internals worth watching under load.
+func (h *Handler) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	var resp AdminStatsResponse
+	if h.verifier != nil {
+		st := h.verifier.Stats()
+		resp.SecretVerifier = SecretVerifierStats{
+			Workers:   st.Workers,
+			QueueCap:  st.QueueCap,
+			Queued:    st.Queued,
+			Running:   st.Running,
+			Completed: st.Completed,
+			Rejected:  st.Rejected,
+			TimedOut:  st.TimedOut,
+			Abandoned: st.Abandoned,
+		}
+	}
+	resp.Realtime.OversizedFrames = h.hub.OversizedFrames()
+	resp.Realtime.Dropped = DroppedStats(h.hub.Drops())
+	resp.Realtime.Rooms = h.hub.RoomCount()
+	writeJSON(w, http.StatusOK, resp)
+}
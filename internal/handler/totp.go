@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+const totpIssuer = "FileFlow"
+
+// requireDeviceSession checks that the caller holds a device ticket and a
+// live ff_session issued to that device, writing a 401 otherwise. Read-only
+// sessions get a 403: they may not change the device's settings.
+func (h *Handler) requireDeviceSession(w http.ResponseWriter, r *http.Request) (string, bool) {
+	deviceID, err := h.verifyDeviceTicket(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_DEVICE_TICKET", "Invalid device ticket")
+		return "", false
+	}
+
+	claims, err := h.verifySession(r, deviceID)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Session required")
+		return "", false
+	}
+	if !claims.HasScope(auth.ScopeUser) {
+		writeError(w, http.StatusForbidden, "INSUFFICIENT_SCOPE", "This session is read-only")
+		return "", false
+	}
+	return deviceID, true
+}
+
+// handleTOTPSetup issues a new TOTP seed for the caller's device. The seed
+// is stored unconfirmed and is not enforced on login until a code from it
+// has been accepted by POST /api/totp/confirm.
+func (h *Handler) handleTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	if h.totpCipher == nil {
+		writeError(w, http.StatusNotFound, "TOTP_DISABLED", "TOTP is not configured")
+		return
+	}
+
+	deviceID, ok := h.requireDeviceSession(w, r)
+	if !ok {
+		return
+	}
+
+	existing, err := h.store.GetTOTP(deviceID)
+	if err != nil && !errors.Is(err, store.ErrTOTPNotFound) {
+		slog.ErrorContext(r.Context(), "Failed to load TOTP", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load TOTP")
+		return
+	}
+	if existing != nil && existing.Confirmed {
+		writeError(w, http.StatusConflict, "TOTP_ENABLED", "TOTP is already enabled for this device")
+		return
+	}
+
+	seed, err := auth.GenerateTOTPSeed()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate TOTP seed", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate seed")
+		return
+	}
+	sealed, err := h.totpCipher.Seal(deviceID, seed)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to seal TOTP seed", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate seed")
+		return
+	}
+	if err := h.store.SetTOTPSeed(deviceID, sealed, time.Now().UnixMilli()); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to store TOTP seed", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to store seed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TOTPSetupResponse{
+		Secret: auth.TOTPEncoding.EncodeToString(seed),
+		URI:    auth.TOTPURI(seed, totpIssuer, deviceID),
+	})
+}
+
+// handleTOTPConfirm enables TOTP for the caller's device once it proves it
+// can produce a valid code.
+func (h *Handler) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	if h.totpCipher == nil {
+		writeError(w, http.StatusNotFound, "TOTP_DISABLED", "TOTP is not configured")
+		return
+	}
+
+	deviceID, ok := h.requireDeviceSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req TOTPConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+
+	ok, err := h.verifyOTP(deviceID, req.OTP)
+	if err != nil {
+		if errors.Is(err, store.ErrTOTPNotFound) {
+			writeError(w, http.StatusBadRequest, "TOTP_NOT_SETUP", "Call /api/totp/setup first")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to verify TOTP", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to verify code")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "INVALID_OTP", "Invalid code")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TOTPEnabledResponse{TOTPEnabled: true})
+}
+
+// totpRequired reports whether login for deviceID needs a one-time code.
+func (h *Handler) totpRequired(deviceID string) (bool, error) {
+	t, err := h.store.GetTOTP(deviceID)
+	if errors.Is(err, store.ErrTOTPNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return t.Confirmed, nil
+}
+
+// verifyOTP checks code against deviceID's seed and consumes its time step,
+// confirming the seed on first use.
+func (h *Handler) verifyOTP(deviceID, code string) (bool, error) {
+	t, err := h.store.GetTOTP(deviceID)
+	if err != nil {
+		return false, err
+	}
+	if h.totpCipher == nil {
+		return false, errors.New("totp cipher not configured")
+	}
+	seed, err := h.totpCipher.Open(deviceID, t.SealedSeed)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := auth.VerifyTOTP(seed, code, time.Now(), t.LastStep)
+	if !ok {
+		return false, nil
+	}
+	return h.store.UseTOTPStep(deviceID, step)
+}
+
+// handleAdminDeviceTOTP removes a device's TOTP seed so a user who lost
+// their authenticator can log in with the shared secret and set it up again.
+func (h *Handler) handleAdminDeviceTOTP(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	if err := h.store.DeleteTOTP(deviceID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete TOTP", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to reset TOTP")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TOTPEnabledResponse{TOTPEnabled: false})
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// handleAdminDeviceDelete moves a device to the trash and drops its live
+// connections. The device can no longer log in or connect, but keeps its key
+// so POST /api/admin/devices/{id}/restore brings it back without
+// re-enrollment until the janitor purges it.
+func (h *Handler) handleAdminDeviceDelete(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	deletedAt := time.Now().UnixMilli()
+	if err := h.store.DeleteDevice(deviceID, deletedAt); err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			writeError(w, http.StatusNotFound, "DEVICE_NOT_FOUND", "Device not found")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to delete device", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete device")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, DeviceDeletedResponse{
+		DeviceID:          deviceID,
+		DeletedAt:         deletedAt,
+		ConnectionsClosed: h.hub.CloseDevice(deviceID),
+	})
+}
+
+// handleAdminDeviceRestore takes a device out of the trash.
+func (h *Handler) handleAdminDeviceRestore(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	if err := h.store.RestoreDevice(deviceID); err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			writeError(w, http.StatusNotFound, "DEVICE_NOT_IN_TRASH", "Device is not in the trash")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to restore device", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to restore device")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, DeviceRestoredResponse{DeviceID: deviceID, Restored: true})
+}
+
+// handleAdminTrash lists soft-deleted devices awaiting purge.
+func (h *Handler) handleAdminTrash(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	devices, err := h.store.ListDeletedDevices()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list trash", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list trash")
+		return
+	}
+
+	resp := TrashResponse{Devices: make([]TrashedDevice, 0, len(devices))}
+	for _, d := range devices {
+		resp.Devices = append(resp.Devices, TrashedDevice{
+			DeviceID:  d.DeviceID,
+			Label:     d.Label,
+			CreatedAt: d.CreatedAt,
+			DeletedAt: d.DeletedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
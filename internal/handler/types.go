@@ -0,0 +1,673 @@
+package handler
+
+import "github.com/lixiansheng/fileflow/internal/store"
+
+//go:generate go run ../../cmd/tsgen -out ../../web/types/fileflow.d.ts api.go types.go ../realtime/events.go ../realtime/hub.go ../store/audit.go ../store/enrollevents.go ../store/receipts.go
+
+// HealthResponse is returned by GET /healthz.
+type HealthResponse struct {
+	OK bool `json:"ok"`
+}
+
+// ReadyResponse is returned by GET /readyz, with status 503 unless every
+// component is OK.
+type ReadyResponse struct {
+	OK    bool            `json:"ok"`
+	Store ComponentStatus `json:"store"`
+	Hub   ComponentStatus `json:"hub"`
+}
+
+// ComponentStatus is one probe in ReadyResponse. Detail names the problem
+// when OK is false. LatencyMS is set for the store probe, LastHeartbeat
+// (Unix ms) for the hub.
+type ComponentStatus struct {
+	OK            bool   `json:"ok"`
+	Detail        string `json:"detail,omitempty"`
+	LatencyMS     int64  `json:"latency_ms,omitempty"`
+	LastHeartbeat int64  `json:"last_heartbeat,omitempty"`
+}
+
+// VersionResponse is returned by GET /api/version. Protocol is the realtime
+// protocol version, bumped on incompatible event changes. Build is only
+// included for admin tokens.
+type VersionResponse struct {
+	Version           string        `json:"version"`
+	Protocol          int           `json:"protocol"`
+	Subprotocols      []string      `json:"subprotocols"`
+	MinClient         string        `json:"min_client_version,omitempty"`
+	RecommendedClient string        `json:"recommended_client_version,omitempty"`
+	Build             *BuildDetails `json:"build,omitempty"`
+}
+
+// WellKnownResponse is served at /.well-known/fileflow.json so clients can
+// configure themselves from a hostname. Paths are relative to the origin.
+// Features lists optional capabilities that are enabled: webauthn, totp,
+// oidc, wake and cert_pinning depend on the server's configuration.
+type WellKnownResponse struct {
+	Version           string          `json:"version"`
+	APIBase           string          `json:"api_base"`
+	APIVersions       []int           `json:"api_versions"`
+	OpenAPI           string          `json:"openapi"`
+	WebSocket         string          `json:"websocket"`
+	Protocol          int             `json:"protocol"`
+	Subprotocols      []string        `json:"subprotocols"`
+	MinClient         string          `json:"min_client_version,omitempty"`
+	RecommendedClient string          `json:"recommended_client_version,omitempty"`
+	Limits            WellKnownLimits `json:"limits"`
+	Features          []string        `json:"features"`
+}
+
+// WellKnownLimits are the realtime size limits in bytes. ChunkBytes is the
+// para_chunk size every client may use; msg_params can grant up to
+// MaxChunkBytes.
+type WellKnownLimits struct {
+	MaxMessageBytes int `json:"max_message_bytes"`
+	ChunkBytes      int `json:"chunk_bytes"`
+	MaxChunkBytes   int `json:"max_chunk_bytes"`
+	MaxParagraphs   int `json:"max_paragraphs"`
+	MaxRecipients   int `json:"max_recipients"`
+	MaxPendingCmds  int `json:"max_pending_cmds"`
+	MaxSettingBytes int `json:"max_setting_bytes"`
+	MaxSettings     int `json:"max_settings"`
+}
+
+// ServerInfoResponse is returned by GET /api/server-info. Mode is standard
+// or onion; LimitKey is ip, or device when per-client limits key on device
+// tickets. TicketBinding is ip, subnet or off. Features holds every
+// feature flag by name.
+type ServerInfoResponse struct {
+	Mode          string          `json:"mode"`
+	LimitKey      string          `json:"limit_key"`
+	SecureCookies bool            `json:"secure_cookies"`
+	HostCookies   bool            `json:"host_cookies"`
+	TicketBinding string          `json:"ticket_binding"`
+	Features      map[string]bool `json:"features"`
+}
+
+// BuildDetails describes how the server binary was built.
+type BuildDetails struct {
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// ChallengeResponse is returned by POST /api/device/challenge.
+type ChallengeResponse struct {
+	ChallengeID string `json:"challenge_id"`
+	Nonce       string `json:"nonce"`
+}
+
+// DeviceOKResponse is returned by POST /api/device/attest and
+// POST /api/webauthn/assert.
+type DeviceOKResponse struct {
+	DeviceOK bool `json:"device_ok"`
+}
+
+// WebAuthnRegisterOptionsResponse is returned by POST
+// /api/webauthn/register/options. Binary fields are base64url.
+type WebAuthnRegisterOptionsResponse struct {
+	ChallengeID string `json:"challenge_id"`
+	Challenge   string `json:"challenge"`
+	RPID        string `json:"rp_id"`
+	UserID      string `json:"user_id"`
+	Algorithms  []int  `json:"algorithms"`
+}
+
+// WebAuthnRegisteredResponse is returned by POST /api/webauthn/register.
+type WebAuthnRegisteredResponse struct {
+	DeviceID     string `json:"device_id"`
+	CredentialID string `json:"credential_id"`
+}
+
+// WebAuthnAssertOptionsResponse is returned by POST
+// /api/webauthn/assert/options.
+type WebAuthnAssertOptionsResponse struct {
+	ChallengeID  string `json:"challenge_id"`
+	Challenge    string `json:"challenge"`
+	RPID         string `json:"rp_id"`
+	CredentialID string `json:"credential_id"`
+}
+
+// AuthedResponse is returned by POST /api/login and GET /api/session.
+// OTPRequired is set when the secret was accepted but the device has TOTP
+// enabled and the request's otp was missing or wrong. OIDC tells a signed
+// out client that /auth/oidc/login is available.
+type AuthedResponse struct {
+	Authed      bool `json:"authed"`
+	OTPRequired bool `json:"otp_required,omitempty"`
+	OIDC        bool `json:"oidc,omitempty"`
+	// Scope is the session's scope. A named login secret may have
+	// narrowed it below what POST /api/login asked for.
+	Scope string `json:"scope,omitempty"`
+}
+
+// SessionRefreshResponse is returned by POST /api/session/refresh.
+// ExpiresAt is the new cookie expiry in Unix milliseconds.
+type SessionRefreshResponse struct {
+	Authed    bool  `json:"authed"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// TOTPSetupResponse is returned by POST /api/totp/setup.
+type TOTPSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPEnabledResponse is returned by POST /api/totp/confirm.
+type TOTPEnabledResponse struct {
+	TOTPEnabled bool `json:"totp_enabled"`
+}
+
+// DeviceDeletedResponse is returned by DELETE /api/admin/devices/{id}.
+type DeviceDeletedResponse struct {
+	DeviceID          string `json:"device_id"`
+	DeletedAt         int64  `json:"deleted_at"`
+	ConnectionsClosed int    `json:"connections_closed"`
+}
+
+// DeviceRestoredResponse is returned by POST
+// /api/admin/devices/{id}/restore.
+type DeviceRestoredResponse struct {
+	DeviceID string `json:"device_id"`
+	Restored bool   `json:"restored"`
+}
+
+// EnrolledDevice is one entry of DeviceListResponse. UserID is empty for
+// devices of the default account. LastSeen is the latest successful login
+// or accepted WebSocket connection (Unix ms), zero if never seen.
+type EnrolledDevice struct {
+	DeviceID        string `json:"device_id"`
+	Label           string `json:"label"`
+	UserID          string `json:"user_id"`
+	CreatedAt       int64  `json:"created_at"`
+	LiveConnections int    `json:"live_connections"`
+	LastSeen        int64  `json:"last_seen"`
+	Disabled        bool   `json:"disabled"`
+}
+
+// DeviceListResponse is returned by GET /api/admin/devices. Total counts
+// every device matching the filter; NextOffset is the offset of the next
+// page, or zero on the last one.
+type DeviceListResponse struct {
+	Devices    []EnrolledDevice `json:"devices"`
+	Total      int              `json:"total"`
+	NextOffset int              `json:"next_offset,omitempty"`
+}
+
+// UserInfo describes a user. POST /api/admin/users returns the one it
+// created.
+type UserInfo struct {
+	UserID    string `json:"user_id"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// LoginSecretInfo describes a named login secret. The secret itself is
+// never returned.
+type LoginSecretInfo struct {
+	UserID    string `json:"user_id"`
+	Name      string `json:"name"`
+	Scope     string `json:"scope"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// LoginSecretListResponse is returned by GET /api/admin/secrets.
+type LoginSecretListResponse struct {
+	Secrets []LoginSecretInfo `json:"secrets"`
+}
+
+// LoginSecretDeletedResponse is returned by DELETE
+// /api/admin/secrets/{name}.
+type LoginSecretDeletedResponse struct {
+	Name    string `json:"name"`
+	Deleted bool   `json:"deleted"`
+}
+
+// UserListResponse is returned by GET /api/admin/users.
+type UserListResponse struct {
+	Users []UserInfo `json:"users"`
+}
+
+// TrashedDevice is one entry of TrashResponse.
+type TrashedDevice struct {
+	DeviceID  string `json:"device_id"`
+	Label     string `json:"label"`
+	CreatedAt int64  `json:"created_at"`
+	DeletedAt int64  `json:"deleted_at"`
+}
+
+// TrashResponse is returned by GET /api/admin/trash.
+type TrashResponse struct {
+	Devices []TrashedDevice `json:"devices"`
+}
+
+// AllowedCommandsResponse is returned by GET and PUT
+// /api/admin/devices/{id}/commands.
+type AllowedCommandsResponse struct {
+	DeviceID string   `json:"device_id"`
+	Commands []string `json:"commands"`
+}
+
+// DevicePeersResponse is returned by GET and PUT
+// /api/admin/devices/{id}/peers. An empty Peers means unrestricted.
+type DevicePeersResponse struct {
+	DeviceID string   `json:"device_id"`
+	Peers    []string `json:"peers"`
+}
+
+// AdminTokenResponse is returned by POST /api/admin/login.
+type AdminTokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+	Scope     string `json:"scope"`
+	// SigningKey is the base64url HMAC key admin calls that change state
+	// must be signed with, when the server requires signed calls.
+	SigningKey string `json:"signing_key,omitempty"`
+}
+
+// LogLevelRequest is the body of PUT /api/admin/loglevel. It replaces the
+// default level and every override: components left out of Components
+// follow Level. RevertAfter (seconds, up to a day) restores the previous
+// levels after that long; 0 keeps the change.
+type LogLevelRequest struct {
+	Level       string            `json:"level"`
+	Components  map[string]string `json:"components,omitempty"`
+	RevertAfter int               `json:"revert_after,omitempty"`
+}
+
+// LogLevelResponse is returned by GET and PUT /api/admin/loglevel.
+// Components holds the overrides only. RevertAt (Unix ms) is set while a
+// change is due to be undone.
+type LogLevelResponse struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components"`
+	RevertAt   int64             `json:"revert_at,omitempty"`
+}
+
+// FeaturesRequest is the body of PUT /api/admin/features. Flags maps flag
+// names to their new value; null returns a flag to its default. Flags
+// left out are unchanged.
+type FeaturesRequest struct {
+	Flags map[string]*bool `json:"flags"`
+}
+
+// FeaturesResponse is returned by GET and PUT /api/admin/features.
+type FeaturesResponse struct {
+	Flags []FeatureFlag `json:"flags"`
+}
+
+// FeatureFlag is one feature flag. Source is default, config, or env for
+// flags set by FEATURES, which cannot be changed at runtime.
+type FeatureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Default     bool   `json:"default"`
+	Source      string `json:"source"`
+}
+
+// AdminStatsResponse is returned by GET /api/admin/stats.
+type AdminStatsResponse struct {
+	SecretVerifier SecretVerifierStats `json:"secret_verifier"`
+	Realtime       RealtimeStats       `json:"realtime"`
+}
+
+// RealtimeStats reports the WebSocket hub. OversizedFrames counts incoming
+// frames dropped for exceeding MAX_WS_MSG_BYTES since the server started;
+// Dropped counts outgoing events that never reached a connection; Rooms is
+// how many rooms have a connected device.
+type RealtimeStats struct {
+	OversizedFrames uint64       `json:"oversized_frames"`
+	Dropped         DroppedStats `json:"dropped"`
+	Rooms           int          `json:"rooms"`
+}
+
+// DroppedStats counts dropped outgoing events by reason: FullQueue when the
+// recipient's queue was full, NoPeer when nobody could be sent the event,
+// Unregistered when the recipient was disconnected for falling behind.
+type DroppedStats struct {
+	FullQueue    uint64 `json:"full_queue"`
+	NoPeer       uint64 `json:"no_peer"`
+	Unregistered uint64 `json:"unregistered"`
+}
+
+// SecretVerifierStats reports the pool that checks login secrets. Rejected
+// logins found the queue full; timed_out ones waited too long; abandoned
+// jobs were dropped from the queue after their caller gave up.
+type SecretVerifierStats struct {
+	Workers   int    `json:"workers"`
+	QueueCap  int    `json:"queue_capacity"`
+	Queued    int    `json:"queued"`
+	Running   int    `json:"running"`
+	Completed uint64 `json:"completed"`
+	Rejected  uint64 `json:"rejected"`
+	TimedOut  uint64 `json:"timed_out"`
+	Abandoned uint64 `json:"abandoned"`
+}
+
+// LoggedOutResponse is returned by POST /api/logout and
+// POST /api/admin/logout.
+type LoggedOutResponse struct {
+	LoggedOut bool `json:"logged_out"`
+}
+
+// PresenceResponse is the data payload of GET /api/presence.
+type PresenceResponse struct {
+	Online   int `json:"online"`
+	Required int `json:"required"`
+}
+
+// PairingCodeResponse is returned by POST /api/device/pairing-code.
+type PairingCodeResponse struct {
+	Code      string `json:"code"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// AddedResponse is returned by POST /api/admin/devices and
+// POST /api/device/enroll.
+type AddedResponse struct {
+	Added bool `json:"added"`
+}
+
+// DeviceImpactResponse is returned by GET /api/admin/devices/{id}/impact.
+type DeviceImpactResponse struct {
+	DeviceID              string `json:"device_id"`
+	Label                 string `json:"label"`
+	LiveConnections       int    `json:"live_connections"`
+	ActiveSessions        int    `json:"active_sessions"`
+	InFlightMessages      int    `json:"in_flight_messages"`
+	OutstandingChallenges int    `json:"outstanding_challenges"`
+}
+
+// ConnectionsResponse is returned by GET /api/admin/devices/{id}/connections.
+type ConnectionsResponse struct {
+	Attempts []store.ConnAttempt `json:"attempts"`
+}
+
+// DeviceStateResponse is returned by PUT /api/admin/devices/{id}/state.
+// ConnectionsClosed counts the live connections dropped by disabling.
+type DeviceStateResponse struct {
+	DeviceID          string `json:"device_id"`
+	Disabled          bool   `json:"disabled"`
+	ConnectionsClosed int    `json:"connections_closed"`
+}
+
+// DeviceUpdatedResponse is returned by PATCH /api/admin/devices/{id}.
+type DeviceUpdatedResponse struct {
+	DeviceID string `json:"device_id"`
+	Label    string `json:"label"`
+}
+
+// TimelineEntry is one connection in TimelineResponse. EndedAt and
+// DurationMS are zero when no end was recorded: the connection is still
+// open, or the server stopped before it could note the close.
+type TimelineEntry struct {
+	ID         int64  `json:"id"`
+	StartedAt  int64  `json:"started_at"`
+	EndedAt    int64  `json:"ended_at"`
+	DurationMS int64  `json:"duration_ms"`
+	IP         string `json:"ip"`
+	CloseCode  int    `json:"close_code,omitempty"`
+}
+
+// TimelineResponse is returned by GET /api/admin/devices/{id}/timeline.
+// NextBefore is the ?before= value for the next (older) page, or zero on
+// the last one.
+type TimelineResponse struct {
+	DeviceID   string          `json:"device_id"`
+	Intervals  []TimelineEntry `json:"intervals"`
+	NextBefore int64           `json:"next_before,omitempty"`
+}
+
+// APITokenInfo describes an API token. The token itself is only returned
+// once, when it is created.
+type APITokenInfo struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Scope      string `json:"scope"`
+	CreatedAt  int64  `json:"created_at"`
+	LastUsedAt int64  `json:"last_used_at"`
+}
+
+// APITokenListResponse is returned by GET /api/tokens.
+type APITokenListResponse struct {
+	Tokens []APITokenInfo `json:"tokens"`
+}
+
+// APITokenCreatedResponse is returned by POST /api/tokens. Token is sent
+// as "Authorization: Bearer <token>" and cannot be retrieved again.
+type APITokenCreatedResponse struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Scope     string `json:"scope"`
+	CreatedAt int64  `json:"created_at"`
+	Token     string `json:"token"`
+}
+
+// AppTokenInfo describes an app token. The token itself is only returned
+// once, when it is created.
+type AppTokenInfo struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	DeviceIDs  []string `json:"device_ids"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt int64    `json:"last_used_at"`
+}
+
+// AppTokenListResponse is returned by GET /api/admin/app-tokens.
+type AppTokenListResponse struct {
+	Tokens []AppTokenInfo `json:"tokens"`
+}
+
+// AppTokenCreatedResponse is returned by POST /api/admin/app-tokens. Token
+// is sent as "Authorization: Bearer <token>" to /api/push and cannot be
+// retrieved again.
+type AppTokenCreatedResponse struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	DeviceIDs []string `json:"device_ids"`
+	CreatedAt int64    `json:"created_at"`
+	Token     string   `json:"token"`
+}
+
+// AppTokenRevokedResponse is returned by DELETE /api/admin/app-tokens/{id}.
+type AppTokenRevokedResponse struct {
+	ID      string `json:"id"`
+	Revoked bool   `json:"revoked"`
+}
+
+// PushResponse is returned by POST /api/push once the device received the
+// text.
+type PushResponse struct {
+	PushID   string `json:"push_id"`
+	DeviceID string `json:"device_id"`
+	Status   string `json:"status"`
+}
+
+// APITokenRevokedResponse is returned by DELETE /api/tokens/{id}.
+type APITokenRevokedResponse struct {
+	ID                string `json:"id"`
+	ConnectionsClosed int    `json:"connections_closed"`
+}
+
+// LoginRequest is the body of POST /api/login. OTP is only needed once the
+// server has answered otp_required.
+type LoginRequest struct {
+	Secret   string `json:"secret"`
+	DeviceID string `json:"device_id"`
+	OTP      string `json:"otp"`
+	Scope    string `json:"scope"`
+}
+
+// ChallengeRequest is the body of POST /api/device/challenge.
+type ChallengeRequest struct {
+	DeviceID string                 `json:"device_id"`
+	PubJWK   map[string]interface{} `json:"pub_jwk"`
+}
+
+// AttestRequest is the body of POST /api/device/attest. Signature is the
+// base64url ECDSA signature over the challenge nonce.
+type AttestRequest struct {
+	ChallengeID string `json:"challenge_id"`
+	DeviceID    string `json:"device_id"`
+	Signature   string `json:"signature"`
+}
+
+// EnrollRequest is the body of POST /api/device/enroll.
+type EnrollRequest struct {
+	Code     string                 `json:"code"`
+	DeviceID string                 `json:"device_id"`
+	PubJWK   map[string]interface{} `json:"pub_jwk"`
+	Label    string                 `json:"label"`
+}
+
+// TOTPConfirmRequest is the body of POST /api/totp/confirm.
+type TOTPConfirmRequest struct {
+	OTP string `json:"otp"`
+}
+
+// APITokenCreateRequest is the body of POST /api/tokens.
+type APITokenCreateRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// PushRequest is the body of POST /api/push. DeviceID may be omitted when
+// the app token is bound to a single device.
+type PushRequest struct {
+	DeviceID string `json:"device_id"`
+	Text     string `json:"text"`
+}
+
+// WebAuthnRegisterRequest is the body of POST /api/webauthn/register.
+type WebAuthnRegisterRequest struct {
+	ChallengeID       string `json:"challenge_id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AttestationObject string `json:"attestation_object"`
+	Label             string `json:"label"`
+	UserID            string `json:"user_id"`
+}
+
+// WebAuthnAssertOptionsRequest is the body of POST
+// /api/webauthn/assert/options.
+type WebAuthnAssertOptionsRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+// WebAuthnAssertRequest is the body of POST /api/webauthn/assert.
+type WebAuthnAssertRequest struct {
+	ChallengeID       string `json:"challenge_id"`
+	DeviceID          string `json:"device_id"`
+	CredentialID      string `json:"credential_id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AuthenticatorData string `json:"authenticator_data"`
+	Signature         string `json:"signature"`
+}
+
+// AdminLoginRequest is the body of POST /api/admin/login.
+type AdminLoginRequest struct {
+	Secret string `json:"secret"`
+	Scope  string `json:"scope"`
+}
+
+// DeviceAddRequest is the body of POST /api/admin/devices.
+type DeviceAddRequest struct {
+	DeviceID string                 `json:"device_id"`
+	PubJWK   map[string]interface{} `json:"pub_jwk"`
+	Label    string                 `json:"label"`
+	UserID   string                 `json:"user_id"`
+}
+
+// DeviceUpdateRequest is the body of PATCH /api/admin/devices/{id}.
+type DeviceUpdateRequest struct {
+	Label *string `json:"label"`
+}
+
+// DeviceStateRequest is the body of PUT /api/admin/devices/{id}/state.
+type DeviceStateRequest struct {
+	Disabled *bool `json:"disabled"`
+}
+
+// AllowedCommandsRequest is the body of PUT
+// /api/admin/devices/{id}/commands.
+type AllowedCommandsRequest struct {
+	Commands []string `json:"commands"`
+}
+
+// DevicePeersRequest is the body of PUT /api/admin/devices/{id}/peers.
+type DevicePeersRequest struct {
+	Peers []string `json:"peers"`
+}
+
+// UserCreateRequest is the body of POST /api/admin/users.
+type UserCreateRequest struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+}
+
+// LoginSecretCreateRequest is the body of POST /api/admin/secrets. An
+// empty UserID means the default account.
+type LoginSecretCreateRequest struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+	Scope  string `json:"scope"`
+}
+
+// AppTokenCreateRequest is the body of POST /api/admin/app-tokens.
+type AppTokenCreateRequest struct {
+	Name      string   `json:"name"`
+	DeviceIDs []string `json:"device_ids"`
+}
+
+// CertReportRequest is the body of POST /api/cert-report: the SHA-256
+// fingerprint of the leaf certificate the client's TLS connection
+// presented, in hex with or without colons.
+type CertReportRequest struct {
+	Fingerprint string `json:"fingerprint"`
+}
+
+// CertReportResponse is returned by POST /api/cert-report. Match is false
+// when the certificate is not one the server is reached through.
+type CertReportResponse struct {
+	Match bool `json:"match"`
+}
+
+// TransferReceiptResponse is returned by GET /api/transfers/{id}/receipt.
+// Valid reports whether the receipt's signature checks out, that is
+// whether this server issued it unchanged.
+type TransferReceiptResponse struct {
+	Receipt store.TransferReceipt `json:"receipt"`
+	Valid   bool                  `json:"valid"`
+}
+
+// CertReportsResponse is returned by GET /api/admin/cert-reports.
+type CertReportsResponse struct {
+	Reports []store.CertReport `json:"reports"`
+}
+
+// EnrollEventsResponse is returned by GET /api/admin/enroll-events.
+type EnrollEventsResponse struct {
+	Events []store.EnrollEvent `json:"events"`
+}
+
+// WakeTargetRequest is the body of PUT /api/admin/devices/{id}/wake. At
+// least one of MAC and Webhook is required; Broadcast defaults to
+// 255.255.255.255:9.
+type WakeTargetRequest struct {
+	MAC       string `json:"mac"`
+	Broadcast string `json:"broadcast"`
+	Webhook   string `json:"webhook"`
+}
+
+// WakeTargetResponse is returned by GET, PUT and DELETE
+// /api/admin/devices/{id}/wake. Every field but DeviceID is empty when the
+// device has no wake target.
+type WakeTargetResponse struct {
+	DeviceID  string `json:"device_id"`
+	MAC       string `json:"mac,omitempty"`
+	Broadcast string `json:"broadcast,omitempty"`
+	Webhook   string `json:"webhook,omitempty"`
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+const (
+	maxUserNameLen   = 64
+	minUserSecretLen = 8
+)
+
+// deviceUser returns the user deviceID belongs to; empty for the default
+// account.
+func (h *Handler) deviceUser(deviceID string) (string, error) {
+	device, err := h.store.GetDevice(deviceID)
+	if err != nil {
+		return "", err
+	}
+	return device.UserID, nil
+}
+
+// secretHashFor returns the secret hash userID logs in with. The default
+// account uses the server-wide hash.
+func (h *Handler) secretHashFor(userID string) (string, error) {
+	if userID == "" {
+		return h.currentSecretHash(), nil
+	}
+	user, err := h.store.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	return user.SecretHash, nil
+}
+
+// maybeRehashUserSecret is maybeRehashSecret for named users, whose hashes
+// always live in the store.
+func (h *Handler) maybeRehashUserSecret(userID, secret, oldHash string) {
+	if userID == "" {
+		h.maybeRehashSecret(secret, oldHash)
+		return
+	}
+	if !auth.NeedsRehash(oldHash, h.argonParams) {
+		return
+	}
+	newHash, err := auth.HashSecretParams(secret, h.argonParams)
+	if err != nil {
+		slog.Error("Failed to re-hash secret", "err", err)
+		return
+	}
+	if err := h.store.SetUserSecretHash(userID, newHash); err != nil {
+		slog.Error("Failed to store re-hashed secret", "user_id", userID, "err", err)
+	}
+}
+
+// requireUser checks that userID names an existing user (or is empty, for
+// the default account) and writes a 400 when it does not.
+func (h *Handler) requireUser(w http.ResponseWriter, userID string) bool {
+	if userID == "" {
+		return true
+	}
+	if _, err := h.store.GetUser(userID); err != nil {
+		if errors.Is(err, store.ErrUserNotFound) {
+			writeError(w, http.StatusBadRequest, "UNKNOWN_USER", "User does not exist")
+			return false
+		}
+		slog.Error("Failed to look up user", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+		return false
+	}
+	return true
+}
+
+// handleAdminUserList lists users.
+func (h *Handler) handleAdminUserList(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdminRead(w, r) {
+		return
+	}
+
+	users, err := h.store.ListUsers()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list users", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list users")
+		return
+	}
+
+	resp := UserListResponse{Users: make([]UserInfo, 0, len(users))}
+	for _, u := range users {
+		resp.Users = append(resp.Users, UserInfo{UserID: u.UserID, Name: u.Name, CreatedAt: u.CreatedAt})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleAdminUserCreate creates a user with its own shared secret.
+func (h *Handler) handleAdminUserCreate(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	var req UserCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxUserNameLen {
+		writeError(w, http.StatusBadRequest, "INVALID_USER_NAME", "name must be 1-64 characters")
+		return
+	}
+	if len(req.Secret) < minUserSecretLen {
+		writeError(w, http.StatusBadRequest, "WEAK_SECRET", "secret must be at least 8 characters")
+		return
+	}
+
+	hash, err := auth.HashSecretParams(req.Secret, h.argonParams)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to hash user secret", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create user")
+		return
+	}
+
+	user := &store.User{
+		UserID:     uuid.NewString(),
+		Name:       name,
+		SecretHash: hash,
+		CreatedAt:  time.Now().UnixMilli(),
+	}
+	if err := h.store.CreateUser(user); err != nil {
+		if errors.Is(err, store.ErrUserExists) {
+			writeError(w, http.StatusConflict, "USER_EXISTS", "A user with that name already exists")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to create user", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create user")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, UserInfo{UserID: user.UserID, Name: user.Name, CreatedAt: user.CreatedAt})
+}
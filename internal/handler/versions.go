@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// APIVersion is the API version served at the unversioned /api paths. A
+// breaking change gets a new router mounted at /api/v2 and a bump here once
+// clients have moved; /api/v1 keeps answering as before.
+const APIVersion = 1
+
+// apiVersionHeader names the API version that answered a request.
+const apiVersionHeader = "FileFlow-API-Version"
+
+type ctxKey int
+
+// requestURIKey holds the request URI as the client sent it, before a
+// versioned mount rewrote the path.
+const requestURIKey ctxKey = iota
+
+// withAPIVersion tags the responses of api with version.
+func withAPIVersion(version int, api http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(apiVersionHeader, strconv.Itoa(version))
+		api.ServeHTTP(w, r)
+	})
+}
+
+// mountAPIVersion serves prefix/... (e.g. /api/v1/login) from api, which
+// routes the same endpoints at /api/... (e.g. /api/login), so a version's
+// handlers do not need to know where they are mounted.
+func mountAPIVersion(prefix string, version int, api http.Handler) http.Handler {
+	return withAPIVersion(version, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(context.WithValue(r.Context(), requestURIKey, r.URL.RequestURI()))
+		r2.URL.Path = "/api" + strings.TrimPrefix(r.URL.Path, prefix)
+		if r.URL.RawPath != "" {
+			r2.URL.RawPath = "/api" + strings.TrimPrefix(r.URL.RawPath, prefix)
+		}
+		api.ServeHTTP(w, r2)
+	}))
+}
+
+// clientRequestURI returns the request URI the client sent, which is what
+// it signed, even when the request was routed through a versioned mount.
+func clientRequestURI(r *http.Request) string {
+	if uri, ok := r.Context().Value(requestURIKey).(string); ok {
+		return uri
+	}
+	return r.URL.RequestURI()
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+	"github.com/lixiansheng/fileflow/internal/wake"
+)
+
+// handleAdminDeviceWake reads (GET), replaces (PUT) or removes (DELETE) how
+// the server wakes a sleeping device when a message or push finds it
+// offline. A device without a target reads back with every field empty.
+func (h *Handler) handleAdminDeviceWake(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	if !h.requireAdminMethod(w, r) {
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(deviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req WakeTargetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+			return
+		}
+		target, msg := wakeTarget(deviceID, req)
+		if msg != "" {
+			writeError(w, http.StatusBadRequest, "INVALID_WAKE_TARGET", msg)
+			return
+		}
+		if err := h.store.SetWakeTarget(target); err != nil {
+			if errors.Is(err, store.ErrDeviceNotFound) {
+				writeError(w, http.StatusNotFound, "DEVICE_NOT_FOUND", "Device not found")
+				return
+			}
+			slog.ErrorContext(r.Context(), "Failed to set wake target", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update wake target")
+			return
+		}
+		writeJSON(w, http.StatusOK, WakeTargetResponse(target))
+
+	case http.MethodDelete:
+		if err := h.store.DeleteWakeTarget(deviceID); err != nil && !errors.Is(err, store.ErrWakeTargetNotFound) {
+			slog.ErrorContext(r.Context(), "Failed to delete wake target", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete wake target")
+			return
+		}
+		writeJSON(w, http.StatusOK, WakeTargetResponse{DeviceID: deviceID})
+
+	default:
+		target, err := h.store.GetWakeTarget(deviceID)
+		if errors.Is(err, store.ErrWakeTargetNotFound) {
+			writeJSON(w, http.StatusOK, WakeTargetResponse{DeviceID: deviceID})
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to load wake target", "err", err)
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load wake target")
+			return
+		}
+		writeJSON(w, http.StatusOK, WakeTargetResponse(*target))
+	}
+}
+
+// wakeTarget validates req and returns the normalized target, or a message
+// explaining what is wrong with it.
+func wakeTarget(deviceID string, req WakeTargetRequest) (store.WakeTarget, string) {
+	t := store.WakeTarget{DeviceID: deviceID, Broadcast: req.Broadcast, Webhook: req.Webhook}
+	if req.MAC == "" && req.Webhook == "" {
+		return t, "Set a mac, a webhook or both"
+	}
+	if req.MAC != "" {
+		mac, err := wake.ParseMAC(req.MAC)
+		if err != nil {
+			return t, "Invalid MAC address"
+		}
+		t.MAC = mac.String()
+	}
+	if req.Broadcast != "" {
+		if req.MAC == "" {
+			return t, "broadcast needs a mac"
+		}
+		if err := wake.ValidateBroadcast(req.Broadcast); err != nil {
+			return t, "broadcast must be an IPv4 host:port"
+		}
+	}
+	if req.Webhook != "" {
+		u, err := url.Parse(req.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return t, "webhook must be an http or https URL"
+		}
+	}
+	return t, ""
+}
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// webauthnEnabled writes a 404 when no relying party is configured.
+func (h *Handler) webauthnEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if h.relyingParty.ID == "" {
+		writeError(w, http.StatusNotFound, "WEBAUTHN_DISABLED", "WebAuthn is not configured")
+		return false
+	}
+	return true
+}
+
+// consumeChallenge redeems a challenge and writes a 400 when it is unknown
+// or expired.
+func (h *Handler) consumeChallenge(w http.ResponseWriter, id string) (*auth.Challenge, bool) {
+	challenge, err := h.challengeStore.Consume(id)
+	if err != nil {
+		if errors.Is(err, auth.ErrChallengeExpired) || errors.Is(err, auth.ErrChallengeNotFound) {
+			writeError(w, http.StatusBadRequest, "CHALLENGE_EXPIRED", "Challenge expired")
+			return nil, false
+		}
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to read challenge")
+		return nil, false
+	}
+	return challenge, true
+}
+
+// handleWebAuthnRegisterOptions issues a creation challenge. Enrollment is
+// admin-gated exactly like POST /api/admin/devices.
+func (h *Handler) handleWebAuthnRegisterOptions(w http.ResponseWriter, r *http.Request) {
+	if !h.webauthnEnabled(w, r) || !h.requireEnrollAdmin(w, r) {
+		return
+	}
+
+	challenge, err := h.challengeStore.Create("")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create challenge", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create challenge")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, WebAuthnRegisterOptionsResponse{
+		ChallengeID: challenge.ID,
+		Challenge:   base64.RawURLEncoding.EncodeToString(challenge.Nonce),
+		RPID:        h.relyingParty.ID,
+		UserID:      base64.RawURLEncoding.EncodeToString([]byte(challenge.ID)),
+		Algorithms:  auth.WebAuthnAlgorithms,
+	})
+}
+
+// handleWebAuthnRegister verifies a navigator.credentials.create() response
+// and enrolls the credential's public key as a device.
+func (h *Handler) handleWebAuthnRegister(w http.ResponseWriter, r *http.Request) {
+	if !h.webauthnEnabled(w, r) || !h.requireEnrollAdmin(w, r) {
+		return
+	}
+
+	var req WebAuthnRegisterRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.rejectEnrollment(w, r, "", "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+	if !h.requireUser(w, req.UserID) {
+		return
+	}
+
+	clientData, err1 := base64.RawURLEncoding.DecodeString(req.ClientDataJSON)
+	attObj, err2 := base64.RawURLEncoding.DecodeString(req.AttestationObject)
+	if err1 != nil || err2 != nil {
+		h.rejectEnrollment(w, r, "", "INVALID_REQUEST", "Invalid base64url field")
+		return
+	}
+
+	challenge, ok := h.consumeChallenge(w, req.ChallengeID)
+	if !ok {
+		return
+	}
+	if challenge.DeviceID != "" {
+		writeError(w, http.StatusBadRequest, "CHALLENGE_EXPIRED", "Challenge expired")
+		return
+	}
+
+	cred, err := h.relyingParty.VerifyRegistration(clientData, attObj, challenge.Nonce)
+	if err != nil {
+		h.rejectEnrollment(w, r, "", "INVALID_CREDENTIAL", err.Error())
+		return
+	}
+
+	deviceID, err := auth.DeviceIDFromJWK(cred.JWK)
+	if err != nil {
+		h.rejectEnrollment(w, r, "", "INVALID_PUBLIC_KEY", "Invalid public key")
+		return
+	}
+
+	jwkJSON, err := json.Marshal(cred.JWK)
+	if err != nil {
+		h.rejectEnrollment(w, r, "", "INVALID_PUBLIC_KEY", "Failed to serialize public key")
+		return
+	}
+
+	device := &store.Device{
+		DeviceID:     deviceID,
+		PubJWKJSON:   string(jwkJSON),
+		Label:        req.Label,
+		CreatedAt:    time.Now().UnixMilli(),
+		CredentialID: base64.RawURLEncoding.EncodeToString(cred.ID),
+		SignCount:    cred.SignCount,
+		UserID:       req.UserID,
+	}
+
+	if err := h.store.AddDevice(device); err != nil {
+		if err == store.ErrDeviceExists {
+			writeError(w, http.StatusConflict, "DEVICE_EXISTS", "Device already enrolled")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to add device", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to add device")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, WebAuthnRegisteredResponse{
+		DeviceID:     device.DeviceID,
+		CredentialID: device.CredentialID,
+	})
+}
+
+// handleWebAuthnAssertOptions issues a get() challenge bound to one enrolled
+// passkey device.
+func (h *Handler) handleWebAuthnAssertOptions(w http.ResponseWriter, r *http.Request) {
+	if !h.webauthnEnabled(w, r) {
+		return
+	}
+
+	var req WebAuthnAssertOptionsRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+
+	if !auth.ValidateDeviceIDFormat(req.DeviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid device ID format")
+		return
+	}
+
+	device, ok := h.loadPasskeyDevice(w, req.DeviceID)
+	if !ok {
+		return
+	}
+	if !h.allowChallenge(w, req.DeviceID) {
+		return
+	}
+
+	challenge, err := h.challengeStore.Create(req.DeviceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create challenge", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create challenge")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, WebAuthnAssertOptionsResponse{
+		ChallengeID:  challenge.ID,
+		Challenge:    base64.RawURLEncoding.EncodeToString(challenge.Nonce),
+		RPID:         h.relyingParty.ID,
+		CredentialID: device.CredentialID,
+	})
+}
+
+// handleWebAuthnAssert verifies a navigator.credentials.get() response and
+// issues a device_ticket, the same as POST /api/device/attest.
+func (h *Handler) handleWebAuthnAssert(w http.ResponseWriter, r *http.Request) {
+	if !h.webauthnEnabled(w, r) {
+		return
+	}
+
+	var req WebAuthnAssertRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		return
+	}
+
+	if req.ChallengeID == "" || !auth.ValidateDeviceIDFormat(req.DeviceID) {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Invalid request")
+		return
+	}
+
+	clientData, err1 := base64.RawURLEncoding.DecodeString(req.ClientDataJSON)
+	authData, err2 := base64.RawURLEncoding.DecodeString(req.AuthenticatorData)
+	sig, err3 := base64.RawURLEncoding.DecodeString(req.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid base64url field")
+		return
+	}
+
+	challenge, ok := h.consumeChallenge(w, req.ChallengeID)
+	if !ok {
+		return
+	}
+	if challenge.DeviceID != req.DeviceID {
+		writeError(w, http.StatusBadRequest, "INVALID_DEVICE_ID", "Device mismatch")
+		return
+	}
+
+	device, ok := h.loadPasskeyDevice(w, req.DeviceID)
+	if !ok {
+		return
+	}
+	if req.CredentialID != device.CredentialID {
+		writeError(w, http.StatusBadRequest, "INVALID_CREDENTIAL", "Credential mismatch")
+		return
+	}
+
+	pubKey, _, err := auth.ParsePublicJWKBytes([]byte(device.PubJWKJSON))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_PUBLIC_KEY", "Invalid enrolled public key")
+		return
+	}
+
+	// As in handleDeviceAttest, a failed assertion is charged to the
+	// caller rather than to the device anyone can request a challenge for.
+	count, err := h.relyingParty.VerifyAssertion(pubKey, device.SignCount, clientData, authData, sig, challenge.Nonce)
+	if err != nil {
+		h.loginLimiter.Allow(h.LimitKey(r))
+		slog.WarnContext(r.Context(), "Passkey assertion failed", "device_id", req.DeviceID, "ip", getClientIP(r), "err", err)
+		writeError(w, http.StatusUnauthorized, "INVALID_SIGNATURE", err.Error())
+		return
+	}
+
+	if err := h.store.UpdateSignCount(req.DeviceID, count); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update sign count", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update device")
+		return
+	}
+
+	h.recordAuthSuccess(req.DeviceID)
+	h.issueDeviceTicket(w, r, req.DeviceID)
+}
+
+// loadPasskeyDevice fetches an enrolled device that has a WebAuthn
+// credential, writing the error response when it does not.
+func (h *Handler) loadPasskeyDevice(w http.ResponseWriter, deviceID string) (*store.Device, bool) {
+	device, err := h.store.GetDevice(deviceID)
+	if err != nil {
+		if errors.Is(err, store.ErrDeviceNotFound) {
+			writeError(w, http.StatusForbidden, "DEVICE_NOT_ENROLLED", "Device not enrolled")
+			return nil, false
+		}
+		slog.Error("Failed to load device", "err", err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load device")
+		return nil, false
+	}
+	if device.Disabled {
+		writeError(w, http.StatusForbidden, "DEVICE_DISABLED", "Device is disabled")
+		return nil, false
+	}
+	if device.CredentialID == "" {
+		writeError(w, http.StatusBadRequest, "NO_CREDENTIAL", "Device has no WebAuthn credential")
+		return nil, false
+	}
+	return device, true
+}
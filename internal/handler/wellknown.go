@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/lixiansheng/fileflow/internal/realtime"
+)
+
+// handleWellKnown describes this server to a client that only knows its
+// hostname: where the API and WebSocket live, which protocol versions and
+// limits apply, and which optional features are switched on. Paths are
+// relative to the origin the document was fetched from, so it stays
+// correct behind any proxy that preserves the path.
+func (h *Handler) handleWellKnown(w http.ResponseWriter, r *http.Request) {
+	version := h.build.Version
+	if version == "" {
+		version = "dev"
+	}
+	apiBase := "/api/v" + strconv.Itoa(APIVersion)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, WellKnownResponse{
+		Version:           version,
+		APIBase:           apiBase,
+		APIVersions:       []int{APIVersion},
+		OpenAPI:           apiBase + "/openapi.json",
+		WebSocket:         "/ws",
+		Protocol:          realtime.ProtocolVersion,
+		Subprotocols:      []string{realtime.SubprotocolJSON, realtime.SubprotocolCBOR},
+		MinClient:         h.minClient,
+		RecommendedClient: h.recommendClient,
+		Limits: WellKnownLimits{
+			MaxMessageBytes: h.maxWSMsgBytes,
+			ChunkBytes:      realtime.MaxChunkSize,
+			MaxChunkBytes:   realtime.MaxNegotiatedChunkSize,
+			MaxParagraphs:   realtime.MaxParagraphs,
+			MaxRecipients:   realtime.MaxRecipients,
+			MaxPendingCmds:  realtime.MaxPendingCmds,
+			MaxSettingBytes: realtime.MaxSettingValueLen,
+			MaxSettings:     realtime.MaxSettings,
+		},
+		Features: h.features(),
+	})
+}
+
+// features lists the optional capabilities this server has enabled.
+func (h *Handler) features() []string {
+	features := []string{"atomic", "chunk_negotiation", "commands", "flow_control", "group_msg", "push", "settings_sync"}
+	if h.relyingParty.ID != "" {
+		features = append(features, "webauthn")
+	}
+	if h.totpCipher != nil {
+		features = append(features, "totp")
+	}
+	if h.oidc != nil {
+		features = append(features, "oidc")
+	}
+	if h.waker != nil {
+		features = append(features, "wake")
+	}
+	if h.certPins != nil {
+		features = append(features, "cert_pinning")
+	}
+	return features
+}
@@ -0,0 +1,115 @@
+// Package lifecycle starts and stops the server's long-running subsystems in
+// a defined order, so adding one (janitor, webhooks, GC) is a single
+// Register call rather than another defer in run().
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultStopTimeout bounds a hook's Stop when Hook.Timeout is zero.
+const DefaultStopTimeout = 10 * time.Second
+
+var ErrStopTimeout = errors.New("stop timed out")
+
+// Hook describes one subsystem. Start and Stop are both optional.
+type Hook struct {
+	Name string
+	// Start must not block; long-running work belongs in a goroutine.
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+	// Timeout bounds Stop. Defaults to DefaultStopTimeout.
+	Timeout time.Duration
+}
+
+// Manager runs hooks in registration order and stops them in reverse, so a
+// subsystem is always stopped before the ones it was registered after.
+type Manager struct {
+	mu      sync.Mutex
+	hooks   []Hook
+	started int
+}
+
+func New() *Manager {
+	return &Manager{}
+}
+
+// Register appends a hook. Hooks must be registered before Start.
+func (m *Manager) Register(h Hook) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, h)
+}
+
+// Start runs every Start hook in order. If one fails, the hooks already
+// started are stopped in reverse and the error is returned.
+func (m *Manager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := m.started; i < len(m.hooks); i++ {
+		h := m.hooks[i]
+		if h.Start != nil {
+			if err := h.Start(ctx); err != nil {
+				startErr := fmt.Errorf("start %s: %w", h.Name, err)
+				if stopErr := m.stopLocked(ctx); stopErr != nil {
+					return errors.Join(startErr, stopErr)
+				}
+				return startErr
+			}
+		}
+		m.started = i + 1
+	}
+	return nil
+}
+
+// Stop runs the Stop hooks of every started subsystem in reverse order.
+// Each hook gets its own timeout; a hook that fails or times out is logged
+// and the remaining hooks still run. All errors are returned joined.
+func (m *Manager) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopLocked(ctx)
+}
+
+func (m *Manager) stopLocked(ctx context.Context) error {
+	var errs []error
+	for i := m.started - 1; i >= 0; i-- {
+		h := m.hooks[i]
+		if h.Stop == nil {
+			continue
+		}
+		if err := stopHook(ctx, h); err != nil {
+			log.Printf("Shutdown of %s failed: %v", h.Name, err)
+			errs = append(errs, fmt.Errorf("stop %s: %w", h.Name, err))
+		}
+	}
+	m.started = 0
+	return errors.Join(errs...)
+}
+
+func stopHook(ctx context.Context, h Hook) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Stop(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ErrStopTimeout
+	}
+}
@@ -0,0 +1,91 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func recorder(calls *[]string, name string, startErr error) Hook {
+	return Hook{
+		Name: name,
+		Start: func(context.Context) error {
+			*calls = append(*calls, "start "+name)
+			return startErr
+		},
+		Stop: func(context.Context) error {
+			*calls = append(*calls, "stop "+name)
+			return nil
+		},
+	}
+}
+
+func TestManagerOrder(t *testing.T) {
+	var calls []string
+	m := New()
+	m.Register(recorder(&calls, "store", nil))
+	m.Register(recorder(&calls, "hub", nil))
+	m.Register(recorder(&calls, "http", nil))
+
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := m.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	want := []string{"start store", "start hub", "start http", "stop http", "stop hub", "stop store"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestManagerStartFailureRollsBack(t *testing.T) {
+	var calls []string
+	boom := errors.New("boom")
+	m := New()
+	m.Register(recorder(&calls, "store", nil))
+	m.Register(recorder(&calls, "hub", boom))
+	m.Register(recorder(&calls, "http", nil))
+
+	err := m.Start(context.Background())
+	if !errors.Is(err, boom) {
+		t.Fatalf("Expected boom, got %v", err)
+	}
+
+	want := []string{"start store", "start hub", "stop store"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestManagerStopTimeout(t *testing.T) {
+	stopped := false
+	m := New()
+	m.Register(Hook{
+		Name: "first",
+		Stop: func(context.Context) error {
+			stopped = true
+			return nil
+		},
+	})
+	m.Register(Hook{
+		Name:    "stuck",
+		Timeout: 20 * time.Millisecond,
+		Stop: func(context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		},
+	})
+
+	m.Start(context.Background())
+	err := m.Stop(context.Background())
+	if !errors.Is(err, ErrStopTimeout) {
+		t.Errorf("Expected ErrStopTimeout, got %v", err)
+	}
+	if !stopped {
+		t.Error("Expected hooks after a timed-out one to still stop")
+	}
+}
@@ -0,0 +1,26 @@
+package limit
+
+import "net"
+
+// DefaultIPv6PrefixLen is the prefix length used to group IPv6 clients.
+// A single subscriber is typically delegated a whole /64, so keying on the
+// full address lets a client rotate freely around per-IP limits.
+const DefaultIPv6PrefixLen = 64
+
+// Key returns the limiter bucket key for ip. IPv4 (and IPv4-mapped IPv6)
+// addresses key on the full address; IPv6 addresses key on their network
+// prefix of prefixLen bits. Unparseable input is returned unchanged.
+func Key(ip string, prefixLen int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.String()
+	}
+	if prefixLen <= 0 || prefixLen > 128 {
+		prefixLen = DefaultIPv6PrefixLen
+	}
+	network := parsed.Mask(net.CIDRMask(prefixLen, 128))
+	return (&net.IPNet{IP: network, Mask: net.CIDRMask(prefixLen, 128)}).String()
+}
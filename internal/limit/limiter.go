@@ -1,40 +1,130 @@
 package limit
 
 import (
+	"math"
 	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
+// Status is a token bucket's state right after a request was counted
+// against it, for the rate-limit headers of the response.
+type Status struct {
+	// Limit is the bucket size (burst).
+	Limit int
+	// Remaining is how many requests could be made right now.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed; zero
+	// unless the request was refused.
+	RetryAfter time.Duration
+}
+
+// Take counts one request against l at now and reports whether it was
+// allowed, together with the bucket's state afterwards.
+func Take(l *rate.Limiter, now time.Time) (bool, Status) {
+	ok := l.AllowN(now, 1)
+	tokens := l.TokensAt(now)
+	st := Status{Limit: l.Burst(), Remaining: max(0, int(math.Floor(tokens)))}
+	if r := float64(l.Limit()); r > 0 && l.Limit() != rate.Inf {
+		st.Reset = seconds((float64(st.Limit) - tokens) / r)
+		if !ok {
+			st.RetryAfter = seconds((1 - tokens) / r)
+		}
+	}
+	return ok, st
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(max(0, s) * float64(time.Second))
+}
+
 // IPLimiter controls the rate of requests per IP address.
 type IPLimiter struct {
-	mu  sync.Mutex
-	ips map[string]*rate.Limiter
-	r   rate.Limit
-	b   int
+	mu       sync.Mutex
+	ips      map[string]*rate.Limiter
+	r        rate.Limit
+	b        int
+	v6Prefix int
 }
 
 // NewIPLimiter returns a new IPLimiter with the given rate and burst.
 func NewIPLimiter(r rate.Limit, b int) *IPLimiter {
 	return &IPLimiter{
-		ips: make(map[string]*rate.Limiter),
-		r:   r,
-		b:   b,
+		ips:      make(map[string]*rate.Limiter),
+		r:        r,
+		b:        b,
+		v6Prefix: DefaultIPv6PrefixLen,
 	}
 }
 
+// SetIPv6PrefixLen sets the prefix length used to group IPv6 addresses.
+func (l *IPLimiter) SetIPv6PrefixLen(bits int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.v6Prefix = bits
+}
+
 // Allow checks if the request from the given IP is allowed.
 func (l *IPLimiter) Allow(ip string) bool {
+	ok, _ := l.Check(ip)
+	return ok
+}
+
+// Check is Allow that also reports the state of ip's bucket.
+func (l *IPLimiter) Check(ip string) (bool, Status) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := Key(ip, l.v6Prefix)
+	limiter, exists := l.ips[key]
+	if !exists {
+		limiter = rate.NewLimiter(l.r, l.b)
+		l.ips[key] = limiter
+	}
+
+	return Take(limiter, time.Now())
+}
+
+// DeviceLimiter controls the rate of requests per device ID, for endpoints
+// where one device can be targeted from many addresses. Callers should only
+// consult it for enrolled devices so the map stays bounded.
+type DeviceLimiter struct {
+	mu      sync.Mutex
+	devices map[string]*rate.Limiter
+	r       rate.Limit
+	b       int
+}
+
+// NewDeviceLimiter returns a new DeviceLimiter with the given rate and burst.
+func NewDeviceLimiter(r rate.Limit, b int) *DeviceLimiter {
+	return &DeviceLimiter{
+		devices: make(map[string]*rate.Limiter),
+		r:       r,
+		b:       b,
+	}
+}
+
+// Allow checks if a request for the given device is allowed.
+func (l *DeviceLimiter) Allow(deviceID string) bool {
+	ok, _ := l.Check(deviceID)
+	return ok
+}
+
+// Check is Allow that also reports the state of deviceID's bucket.
+func (l *DeviceLimiter) Check(deviceID string) (bool, Status) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	limiter, exists := l.ips[ip]
+	limiter, exists := l.devices[deviceID]
 	if !exists {
 		limiter = rate.NewLimiter(l.r, l.b)
-		l.ips[ip] = limiter
+		l.devices[deviceID] = limiter
 	}
 
-	return limiter.Allow()
+	return Take(limiter, time.Now())
 }
 
 // ConnLimiter tracks and limits the number of active connections.
@@ -44,6 +134,7 @@ type ConnLimiter struct {
 	totalCount int
 	maxPerIP   int
 	maxGlobal  int
+	v6Prefix   int
 }
 
 // NewConnLimiter returns a new ConnLimiter with per-IP and global limits.
@@ -52,9 +143,17 @@ func NewConnLimiter(maxPerIP, maxGlobal int) *ConnLimiter {
 		ipCounts:  make(map[string]int),
 		maxPerIP:  maxPerIP,
 		maxGlobal: maxGlobal,
+		v6Prefix:  DefaultIPv6PrefixLen,
 	}
 }
 
+// SetIPv6PrefixLen sets the prefix length used to group IPv6 addresses.
+func (l *ConnLimiter) SetIPv6PrefixLen(bits int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.v6Prefix = bits
+}
+
 // Increment increments the connection count for the given IP.
 // Returns true if the connection is allowed, false otherwise.
 func (l *ConnLimiter) Increment(ip string) bool {
@@ -65,11 +164,12 @@ func (l *ConnLimiter) Increment(ip string) bool {
 		return false
 	}
 
-	if l.ipCounts[ip] >= l.maxPerIP {
+	key := Key(ip, l.v6Prefix)
+	if l.ipCounts[key] >= l.maxPerIP {
 		return false
 	}
 
-	l.ipCounts[ip]++
+	l.ipCounts[key]++
 	l.totalCount++
 	return true
 }
@@ -79,10 +179,11 @@ func (l *ConnLimiter) Decrement(ip string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.ipCounts[ip] > 0 {
-		l.ipCounts[ip]--
-		if l.ipCounts[ip] == 0 {
-			delete(l.ipCounts, ip)
+	key := Key(ip, l.v6Prefix)
+	if l.ipCounts[key] > 0 {
+		l.ipCounts[key]--
+		if l.ipCounts[key] == 0 {
+			delete(l.ipCounts, key)
 		}
 		l.totalCount--
 	}
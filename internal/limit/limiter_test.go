@@ -35,6 +35,48 @@ func TestIPLimiter(t *testing.T) {
 	}
 }
 
+func TestDeviceLimiter(t *testing.T) {
+	limiter := NewDeviceLimiter(rate.Limit(1), 2)
+
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow("device-a") {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+	}
+	if limiter.Allow("device-a") {
+		t.Error("Request 3 should be blocked")
+	}
+
+	// Devices have separate buckets.
+	if !limiter.Allow("device-b") {
+		t.Error("Another device should not share the bucket")
+	}
+}
+
+func TestTake(t *testing.T) {
+	now := time.Now()
+	l := rate.NewLimiter(rate.Limit(0.5), 3)
+
+	ok, st := Take(l, now)
+	if !ok || st.Limit != 3 || st.Remaining != 2 || st.Reset != 2*time.Second || st.RetryAfter != 0 {
+		t.Errorf("first request: ok=%v %+v", ok, st)
+	}
+	Take(l, now)
+	Take(l, now)
+	ok, st = Take(l, now)
+	if ok || st.Remaining != 0 || st.Reset != 6*time.Second || st.RetryAfter != 2*time.Second {
+		t.Errorf("refused request: ok=%v %+v", ok, st)
+	}
+	// Half a token later the wait has halved.
+	if ok, st = Take(l, now.Add(time.Second)); ok || st.RetryAfter != time.Second {
+		t.Errorf("after 1s: ok=%v %+v", ok, st)
+	}
+
+	if ok, st := Take(rate.NewLimiter(rate.Inf, 1), now); !ok || st.Reset != 0 || st.RetryAfter != 0 {
+		t.Errorf("unlimited: ok=%v %+v", ok, st)
+	}
+}
+
 func TestConnLimiter_PerIP(t *testing.T) {
 	// Max 2 connections per IP, 10 global
 	limiter := NewConnLimiter(2, 10)
@@ -77,3 +119,60 @@ func TestConnLimiter_Global(t *testing.T) {
 		t.Error("Connection should be allowed after global decrement")
 	}
 }
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		ip        string
+		prefixLen int
+		want      string
+	}{
+		{"IPv4", "192.168.1.1", 64, "192.168.1.1"},
+		{"IPv4Mapped", "::ffff:192.168.1.1", 64, "192.168.1.1"},
+		{"IPv6Default", "2001:db8:1:2:3:4:5:6", 64, "2001:db8:1:2::/64"},
+		{"IPv6Wide", "2001:db8:1:2:3:4:5:6", 48, "2001:db8:1::/48"},
+		{"IPv6InvalidPrefix", "2001:db8:1:2:3:4:5:6", 0, "2001:db8:1:2::/64"},
+		{"Unparseable", "not-an-ip", 64, "not-an-ip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Key(tt.ip, tt.prefixLen); got != tt.want {
+				t.Errorf("Key(%q, %d) = %q, want %q", tt.ip, tt.prefixLen, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPLimiter_IPv6Prefix(t *testing.T) {
+	limiter := NewIPLimiter(rate.Limit(1), 2)
+
+	if !limiter.Allow("2001:db8::1") {
+		t.Error("Request 1 should be allowed")
+	}
+	if !limiter.Allow("2001:db8::2") {
+		t.Error("Request 2 should be allowed")
+	}
+	if limiter.Allow("2001:db8::ffff") {
+		t.Error("Request from same /64 should share the bucket")
+	}
+	if !limiter.Allow("2001:db8:0:1::1") {
+		t.Error("Request from a different /64 should be allowed")
+	}
+}
+
+func TestConnLimiter_IPv6Prefix(t *testing.T) {
+	limiter := NewConnLimiter(1, 10)
+
+	if !limiter.Increment("2001:db8::1") {
+		t.Error("First connection should be allowed")
+	}
+	if limiter.Increment("2001:db8::2") {
+		t.Error("Connection from same /64 should be rejected")
+	}
+
+	limiter.Decrement("2001:db8::1")
+	if !limiter.Increment("2001:db8::2") {
+		t.Error("Connection should be allowed after decrement")
+	}
+}
@@ -0,0 +1,216 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Components are the parts of the server whose log level can be set on
+// their own. A record belongs to the component of the package that logged
+// it; records from anywhere else use the default level.
+var Components = []string{"handler", "hub", "store", "auth"}
+
+// packageComponents maps the last element of a package path to its
+// component.
+var packageComponents = map[string]string{
+	"handler":  "handler",
+	"realtime": "hub",
+	"store":    "store",
+	"auth":     "auth",
+}
+
+// Levels holds the default log level and per-component overrides. They
+// can be changed while the server runs; a change made with a revert time
+// is undone then unless another change came first.
+type Levels struct {
+	mu         sync.RWMutex
+	level      slog.Level
+	components map[string]slog.Level
+	min        slog.Level
+	revertAt   time.Time
+	gen        uint64
+
+	pcs sync.Map // uintptr -> component, "" for none
+}
+
+// NewLevels returns levels logging at level with no overrides.
+func NewLevels(level slog.Level) *Levels {
+	return &Levels{level: level, min: level}
+}
+
+// ParseLevel parses a level name such as "debug" or "WARN".
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: want debug, info, warn or error", s)
+	}
+	return l, nil
+}
+
+// ParseLevels parses a default level and overrides written as
+// "hub=debug,store=warn", as LOG_LEVEL and LOG_LEVELS hold them.
+func ParseLevels(level, components string) (*Levels, error) {
+	def, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	overrides := map[string]slog.Level{}
+	for _, kv := range strings.Split(components, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid log level override %q: want component=level", kv)
+		}
+		l, err := ParseLevel(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		overrides[strings.TrimSpace(name)] = l
+	}
+	l := NewLevels(def)
+	if err := l.Set(def, overrides, 0); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ValidComponent reports whether name is one of Components.
+func ValidComponent(name string) bool {
+	for _, c := range Components {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the default level, a copy of the overrides and when the
+// current setting reverts (zero if it does not).
+func (l *Levels) Get() (slog.Level, map[string]slog.Level, time.Time) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	overrides := make(map[string]slog.Level, len(l.components))
+	for c, level := range l.components {
+		overrides[c] = level
+	}
+	return l.level, overrides, l.revertAt
+}
+
+// Set replaces the default level and the overrides; components without an
+// override follow the default. With revertAfter > 0 the previous setting
+// comes back after that long.
+func (l *Levels) Set(level slog.Level, overrides map[string]slog.Level, revertAfter time.Duration) error {
+	for c := range overrides {
+		if !ValidComponent(c) {
+			return fmt.Errorf("unknown log component %q", c)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prevLevel, prevComponents := l.level, l.components
+	l.set(level, overrides)
+	l.gen++
+	l.revertAt = time.Time{}
+	if revertAfter > 0 {
+		gen := l.gen
+		l.revertAt = time.Now().Add(revertAfter)
+		time.AfterFunc(revertAfter, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.gen == gen {
+				l.set(prevLevel, prevComponents)
+				l.revertAt = time.Time{}
+			}
+		})
+	}
+	return nil
+}
+
+// set installs a copy of overrides. l.mu must be held.
+func (l *Levels) set(level slog.Level, overrides map[string]slog.Level) {
+	l.level = level
+	l.components = make(map[string]slog.Level, len(overrides))
+	l.min = level
+	for c, cl := range overrides {
+		l.components[c] = cl
+		l.min = min(l.min, cl)
+	}
+}
+
+// enabled reports whether some component logs at level, so the record is
+// worth building.
+func (l *Levels) enabled(level slog.Level) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return level >= l.min
+}
+
+// allows reports whether the component that logged at pc logs at level.
+func (l *Levels) allows(pc uintptr, level slog.Level) bool {
+	c := l.component(pc)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if cl, ok := l.components[c]; ok {
+		return level >= cl
+	}
+	return level >= l.level
+}
+
+// component returns the component of the function at pc, or "".
+func (l *Levels) component(pc uintptr) string {
+	if pc == 0 {
+		return ""
+	}
+	if c, ok := l.pcs.Load(pc); ok {
+		return c.(string)
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	c := componentOf(frame.Function)
+	l.pcs.Store(pc, c)
+	return c
+}
+
+// componentOf returns the component of a function named like
+// "path/to/pkg.Func" or "path/to/pkg.(*T).Method", or "".
+func componentOf(function string) string {
+	if i := strings.LastIndexByte(function, '/'); i >= 0 {
+		function = function[i+1:]
+	}
+	pkg, _, _ := strings.Cut(function, ".")
+	return packageComponents[pkg]
+}
+
+// levelHandler drops records below the level of the component that logged
+// them.
+type levelHandler struct {
+	slog.Handler
+	levels *Levels
+}
+
+func (h levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.levels.enabled(level)
+}
+
+func (h levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !h.levels.allows(r.PC, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs), h.levels}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name), h.levels}
+}
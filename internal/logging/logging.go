@@ -0,0 +1,107 @@
+// Package logging threads per-request fields (request ID, device) through
+// log/slog. Middleware stores them in the request context; a Handler
+// wrapped by NewHandler adds them to every record logged with that
+// context, so call sites only pass what is specific to them.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+type ctxKey struct{}
+
+// fields is shared by a request and everything derived from its context.
+// The device is learned part-way through (once a ticket or token checks
+// out), hence the pointer and lock.
+type fields struct {
+	mu        sync.Mutex
+	requestID string
+	deviceID  string
+}
+
+// WithRequestID returns a context carrying requestID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, &fields{requestID: requestID})
+}
+
+// RequestID returns the request ID carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	f, _ := ctx.Value(ctxKey{}).(*fields)
+	if f == nil {
+		return ""
+	}
+	return f.requestID
+}
+
+// SetDeviceID records the device a request authenticated as, so records
+// logged for the rest of the request, including the access log, name it.
+// It does nothing if ctx carries no request ID.
+func SetDeviceID(ctx context.Context, deviceID string) {
+	if f, _ := ctx.Value(ctxKey{}).(*fields); f != nil {
+		f.mu.Lock()
+		f.deviceID = deviceID
+		f.mu.Unlock()
+	}
+}
+
+func (f *fields) attrs() []slog.Attr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attrs := []slog.Attr{slog.String("request_id", f.requestID)}
+	if f.deviceID != "" {
+		attrs = append(attrs, slog.String("device_id", f.deviceID))
+	}
+	return attrs
+}
+
+// Logger returns the default logger with ctx's fields bound, for work that
+// outlives the request, such as a WebSocket connection.
+func Logger(ctx context.Context) *slog.Logger {
+	l := slog.Default()
+	if f, _ := ctx.Value(ctxKey{}).(*fields); f != nil {
+		for _, a := range f.attrs() {
+			l = l.With(a)
+		}
+	}
+	return l
+}
+
+// NewHandler wraps h so records logged with a request context carry its
+// fields.
+func NewHandler(h slog.Handler) slog.Handler {
+	return contextHandler{h}
+}
+
+type contextHandler struct{ slog.Handler }
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if f, _ := ctx.Value(ctxKey{}).(*fields); f != nil {
+		r.AddAttrs(f.attrs()...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// New returns a logger writing text, or JSON if format is "json", to w,
+// at levels.
+func New(w io.Writer, format string, levels *Levels) *slog.Logger {
+	// levels decides; the inner handler takes everything it is given.
+	opts := &slog.HandlerOptions{Level: slog.Level(-1 << 10)}
+	var h slog.Handler
+	if format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(levelHandler{NewHandler(h), levels})
+}
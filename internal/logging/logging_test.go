@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(slog.NewJSONHandler(&buf, nil)))
+	record := func() map[string]any {
+		t.Helper()
+		var m map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+			t.Fatalf("decode %q: %v", buf.String(), err)
+		}
+		buf.Reset()
+		return m
+	}
+
+	logger.InfoContext(context.Background(), "plain")
+	if m := record(); m["request_id"] != nil || m["device_id"] != nil {
+		t.Errorf("record without request context = %v", m)
+	}
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	if got := RequestID(ctx); got != "req-1" {
+		t.Errorf("RequestID = %q", got)
+	}
+	logger.InfoContext(ctx, "before auth")
+	if m := record(); m["request_id"] != "req-1" || m["device_id"] != nil {
+		t.Errorf("record = %v", m)
+	}
+
+	// The device is set on a context derived from the one the record is
+	// later logged with, as middleware and handlers do.
+	SetDeviceID(context.WithValue(ctx, struct{}{}, 1), "laptop")
+	logger.With("route", "/api/x").InfoContext(ctx, "after auth")
+	if m := record(); m["request_id"] != "req-1" || m["device_id"] != "laptop" || m["route"] != "/api/x" {
+		t.Errorf("record = %v", m)
+	}
+
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+	Logger(ctx).Info("connection")
+	if m := record(); m["request_id"] != "req-1" || m["device_id"] != "laptop" {
+		t.Errorf("Logger record = %v", m)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	for function, want := range map[string]string{
+		"github.com/lixiansheng/fileflow/internal/realtime.(*Hub).Run":        "hub",
+		"github.com/lixiansheng/fileflow/internal/handler.(*Handler).x.func1": "handler",
+		"github.com/lixiansheng/fileflow/internal/store.(*Store).Prune":       "store",
+		"github.com/lixiansheng/fileflow/internal/auth.HashSecret":            "auth",
+		"github.com/lixiansheng/fileflow/internal/handler/handlertest.New":    "",
+		"main.run": "",
+	} {
+		if got := componentOf(function); got != want {
+			t.Errorf("componentOf(%q) = %q, want %q", function, got, want)
+		}
+	}
+
+	for _, bad := range [][2]string{{"loud", ""}, {"info", "hub"}, {"info", "hub=loud"}, {"info", "relay=debug"}} {
+		if _, err := ParseLevels(bad[0], bad[1]); err == nil {
+			t.Errorf("ParseLevels(%q, %q) should fail", bad[0], bad[1])
+		}
+	}
+	levels, err := ParseLevels("WARN", " hub=debug, store=error ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	level, overrides, revertAt := levels.Get()
+	if level != slog.LevelWarn || len(overrides) != 2 || overrides["hub"] != slog.LevelDebug || !revertAt.IsZero() {
+		t.Errorf("Get = %v, %v, %v", level, overrides, revertAt)
+	}
+	if !levels.enabled(slog.LevelDebug) || levels.allows(0, slog.LevelInfo) || !levels.allows(0, slog.LevelWarn) {
+		t.Error("hub=debug should enable debug records, and the default stays at warn")
+	}
+
+	// Records logged from this package follow the default level.
+	var buf bytes.Buffer
+	logger := New(&buf, "json", levels)
+	logger.Info("quiet")
+	logger.Warn("loud")
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 1 {
+		t.Errorf("logged %d records, want 1: %s", n, buf.String())
+	}
+
+	if err := levels.Set(slog.LevelInfo, map[string]slog.Level{"relay": slog.LevelDebug}, 0); err == nil {
+		t.Error("Set should refuse an unknown component")
+	}
+	if err := levels.Set(slog.LevelDebug, nil, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if level, overrides, revertAt := levels.Get(); level != slog.LevelDebug || len(overrides) != 0 || revertAt.IsZero() {
+		t.Errorf("after Set: %v, %v, %v", level, overrides, revertAt)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if level, overrides, revertAt := levels.Get(); level != slog.LevelWarn || overrides["store"] != slog.LevelError || !revertAt.IsZero() {
+		t.Errorf("after revert: %v, %v, %v", level, overrides, revertAt)
+	}
+}
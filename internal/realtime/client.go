@@ -1,8 +1,15 @@
 package realtime
 
 import (
-	"log"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,22 +23,97 @@ const (
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 256 * 1024
 	maxActiveMsgs  = 100
+	// hardLimitFactor sets the read limit the connection enforces, as a
+	// multiple of the client's message size limit; see nextMessage.
+	hardLimitFactor = 4
 )
 
+// errFrameTooLarge is returned by nextMessage for a message it discarded.
+var errFrameTooLarge = errors.New("frame exceeds message size limit")
+
+// CloseDeviceRevoked is the close code sent when an admin deletes the
+// connection's device. Clients should not reconnect on it.
+const CloseDeviceRevoked = 4001
+
+// CloseClientOutdated is the close code that follows update_required when a
+// client is older than the server's minimum version. Clients should not
+// reconnect on it until they have been updated.
+const CloseClientOutdated = 4002
+
+// CloseDeviceDisabled is the close code sent when an admin disables the
+// connection's device. Clients should not reconnect on it; the device can
+// connect again once it is enabled.
+const CloseDeviceDisabled = 4003
+
 type Client struct {
-	hub      *Hub
-	conn     *websocket.Conn
-	send     chan []byte
-	DeviceID string
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+	// sendMu guards sendClosed. The hub closes send with closeSend, so a
+	// Send that races a disconnect drops its message instead of writing
+	// to a closed channel.
+	sendMu     sync.Mutex
+	sendClosed bool
+	DeviceID   string
+	// SessionID is the ff_session the connection was authorised with.
+	SessionID string
+	// UserID is the account DeviceID belongs to. The hub only routes
+	// between clients of the same user; empty is the default account.
+	UserID string
+	// Room is the room of UserID the client joined, "" for the default
+	// one. The hub only routes within a room; see room.go.
+	Room string
+	// ReadOnly marks a connection from a read-only session: it receives
+	// and acknowledges but may not send messages or commands.
+	ReadOnly bool
+	// MaxChunk is the largest para_chunk text the client declared it can
+	// send and receive, normalised with ClampChunkSize. msg_start grants
+	// the sender the smallest MaxChunk among it and its peers.
+	MaxChunk int
+	// Locale and TimeZone are what the client declared at connect time,
+	// normalised with NormalizeLocale and NormalizeTimeZone. When either is
+	// set, peers get them in a peer_info event before each msg_start.
+	Locale   string
+	TimeZone string
+	// CompressMin is the smallest event frame, in bytes, written with
+	// permessage-deflate when the connection negotiated it. Smaller frames
+	// and file chunks go out uncompressed; 0 compresses every event.
+	CompressMin int
+	// ResumeToken and ResumeSeq are the /ws?resume= and last_seq of a
+	// client reconnecting after a drop; see replay.go.
+	ResumeToken string
+	ResumeSeq   uint64
+	// OnClose, if set, is called once ReadPump exits with the close code
+	// sent by the peer (or CloseAbnormalClosure if none was received).
+	OnClose func(code int)
+	// Log is the connection's logger. NewClient binds the device ID; the
+	// handler replaces it with one that also carries the upgrade request's
+	// ID, so a connection's records can be traced back to its handshake.
+	Log *slog.Logger
 
 	// Rate limiting
 	limiter        *rate.Limiter
 	connLimiter    *limit.ConnLimiter
 	ip             string
 	maxMessageSize int
+	cbor           bool
 
 	mu             sync.Mutex
 	activeMessages map[string]*MessageState
+	pendingCmds    map[string]pendingCmd
+
+	// replay numbers outgoing events; parked is closed once WritePump has
+	// handed it to the hub, unless kicked says the server closed the
+	// connection on purpose.
+	replay replayLog
+	parked chan struct{}
+	kicked atomic.Bool
+	// closed is closed once ReadPump has returned and run OnClose.
+	closed chan struct{}
+
+	// draining is set by the hub before it closes send on Stop, so
+	// WritePump closes with CloseGoingAway and a reconnect token.
+	draining bool
 }
 
 type MessageState struct {
@@ -39,6 +121,41 @@ type MessageState struct {
 	ParaCount   int
 	TotalBytes  int
 	CurrentPara int
+
+	// Atomic messages are checksummed as they are relayed and confirmed
+	// with msg_commit; Dropped records that a relay to the peer failed.
+	Atomic  bool
+	Dropped bool
+	sum     hash.Hash
+
+	// ChunkSize is the para_chunk limit granted with msg_params.
+	ChunkSize int
+
+	// To is the device the message is addressed to, or empty for any peer.
+	To string
+
+	// Chunks counts the chunks relayed since StartedAt, for receipts.
+	Chunks    int
+	StartedAt time.Time
+
+	// Paused zeroes the flow-control window: the receiver asked the sender
+	// to stop, and only PauseGrace more chunks are relayed.
+	Paused       bool
+	pausedChunks int
+
+	// File marks a transfer opened with file_start. It is always Atomic;
+	// FileReceived counts the bytes relayed so far out of FileSize.
+	File         bool
+	FileSize     int64
+	FileReceived int64
+
+	// A file transfer is suspended while suspendedAt is set; resumeAsked
+	// means resume_request was forwarded and resume_ok must name
+	// resumeOffset. See resume.go.
+	suspendedAt  time.Time
+	resumeAsked  bool
+	resumeOffset int64
+	resumePoints []resumePoint
 }
 
 func NewClient(hub *Hub, conn *websocket.Conn, deviceID, ip string, connLimiter *limit.ConnLimiter, rateLimit int, maxMessageBytes int) *Client {
@@ -48,26 +165,40 @@ func NewClient(hub *Hub, conn *websocket.Conn, deviceID, ip string, connLimiter
 	return &Client{
 		hub:            hub,
 		conn:           conn,
-		send:           make(chan []byte, 256),
+		send:           make(chan []byte, hub.sendQueueLen()),
 		DeviceID:       deviceID,
+		MaxChunk:       MaxChunkSize,
 		activeMessages: make(map[string]*MessageState),
+		pendingCmds:    make(map[string]pendingCmd),
 		limiter:        rate.NewLimiter(rate.Limit(rateLimit), rateLimit), // Burst = rate
 		connLimiter:    connLimiter,
 		ip:             ip,
 		maxMessageSize: maxMessageBytes,
+		cbor:           conn.Subprotocol() == SubprotocolCBOR,
+		Log:            slog.Default().With("device_id", deviceID),
+		replay:         replayLog{token: newResumeToken(), next: 1},
+		parked:         make(chan struct{}),
+		closed:         make(chan struct{}),
 	}
 }
 
 func (c *Client) ReadPump() {
+	closeCode := websocket.CloseAbnormalClosure
 	defer func() {
 		if c.connLimiter != nil {
 			c.connLimiter.Decrement(c.ip)
 		}
+		c.parkTransfers()
+		c.abortAtomic("sender_disconnected")
 		c.hub.Unregister(c)
 		c.conn.Close()
+		if c.OnClose != nil {
+			c.OnClose(closeCode)
+		}
+		close(c.closed)
 	}()
 
-	c.conn.SetReadLimit(int64(c.maxMessageSize))
+	c.conn.SetReadLimit(int64(c.maxMessageSize) * hardLimitFactor)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -75,27 +206,105 @@ func (c *Client) ReadPump() {
 	})
 
 	for {
-		_, message, err := c.conn.ReadMessage()
-		if err != nil {
+		messageType, message, err := c.nextMessage()
+		oversized := errors.Is(err, errFrameTooLarge)
+		if err != nil && !oversized {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				closeCode = closeErr.Code
+			}
+			if errors.Is(err, websocket.ErrReadLimit) {
+				c.hub.oversized.Add(1)
+				c.Log.Warn("Frame over read limit, closing", "limit", c.maxMessageSize*hardLimitFactor)
+				closeCode = websocket.CloseMessageTooBig
+				break
+			}
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				c.Log.Error("WebSocket error", "err", err)
 			}
 			break
 		}
 
 		if !c.limiter.Allow() {
-			log.Printf("Rate limit exceeded for client %s (%s)", c.DeviceID, c.ip)
+			c.Log.Warn("Rate limit exceeded", "ip", c.ip)
+			closeCode = websocket.ClosePolicyViolation
 			break
 		}
 
+		if oversized {
+			c.rejectOversized()
+			continue
+		}
+
+		if messageType == websocket.BinaryMessage && IsFileChunk(message) {
+			c.handleFileChunk(message)
+			continue
+		}
+		if c.cbor && messageType == websocket.BinaryMessage {
+			message, err = DecodeCBOR(message)
+			if err != nil {
+				c.Log.Error("Failed to decode CBOR event", "err", err)
+				continue
+			}
+		}
+
 		c.handleMessage(message)
 	}
 }
 
+// nextMessage reads the next data message without ever holding more than
+// the client's message size limit. The websocket library checks each frame
+// header against the connection's read limit, hardLimitFactor times larger,
+// and fails with websocket.ErrReadLimit before reading that frame's
+// payload. A message between the two limits is read up to the limit, the
+// rest is discarded as it streams in, and errFrameTooLarge is returned so
+// the connection can stay open.
+func (c *Client) nextMessage() (int, []byte, error) {
+	messageType, r, err := c.conn.NextReader()
+	if err != nil {
+		return 0, nil, err
+	}
+	message, err := io.ReadAll(io.LimitReader(r, int64(c.maxMessageSize)+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(message) <= c.maxMessageSize {
+		return messageType, message, nil
+	}
+	// The read limit counts bytes on the wire, which permessage-deflate
+	// lets expand far beyond it, so the discarded rest is bounded too.
+	rest := int64(c.maxMessageSize) * (hardLimitFactor - 1)
+	n, err := io.Copy(io.Discard, io.LimitReader(r, rest+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > rest {
+		msg := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		return 0, nil, websocket.ErrReadLimit
+	}
+	return messageType, nil, errFrameTooLarge
+}
+
+// rejectOversized counts a message nextMessage discarded and tells the
+// client with an error event. Whatever the message was part of is lost; an
+// atomic message will fail its checksum at msg_end.
+func (c *Client) rejectOversized() {
+	c.hub.oversized.Add(1)
+	c.Log.Warn("Dropped oversized frame", "limit", c.maxMessageSize)
+	if data, err := NewEvent(EventError, ErrorValue{Code: "frame_too_large", Limit: c.maxMessageSize}).Marshal(); err == nil {
+		c.Send(data)
+	}
+}
+
 func (c *Client) handleMessage(data []byte) {
 	event, err := ParseEvent(data)
 	if err != nil {
-		log.Printf("Failed to parse event: %v", err)
+		c.Log.Error("Failed to parse event", "err", err)
+		return
+	}
+	data, err = stampServerTS(event, data, time.Now().UnixMilli())
+	if err != nil {
 		return
 	}
 
@@ -110,21 +319,88 @@ func (c *Client) handleMessage(data []byte) {
 		c.handleParaEnd(event, data)
 	case EventMsgEnd:
 		c.handleMsgEnd(event, data)
+	case EventFileStart:
+		c.handleFileStart(event, data)
+	case EventFileEnd:
+		c.handleFileEnd(event, data)
+	case EventResumeRequest:
+		c.handleResumeRequest(data)
+	case EventResumeOK:
+		c.handleResumeOK(data)
 	case EventAck:
-		c.hub.SendToPeer(c, data)
+		c.hub.route(c, event.To, data)
+	case EventGroupMsg:
+		c.handleGroupMsg(data)
+	case EventKeyShare:
+		c.handleKeyShare(data)
+	case EventPause, EventResume:
+		c.hub.SetPaused(c, event.GetMsgID(), event.Type == EventPause)
+	case EventCmd:
+		c.handleCmd(data)
+	case EventCmdResult:
+		c.handleCmdResult(data)
+	case EventSettingsSet:
+		c.handleSettingsSet(data)
+	case EventSettingsGet:
+		c.handleSettingsGet()
 	}
 }
 
 func (c *Client) handleMsgStart(event *Event, data []byte) {
 	msgID := event.GetMsgID()
-	if msgID == "" {
+	if msgID == "" || !c.canSend(msgID, event.To) {
 		return
 	}
 
-	if !c.hub.HasPeer(c) {
+	state := &MessageState{
+		MsgID:       msgID,
+		ParaCount:   0,
+		TotalBytes:  0,
+		CurrentPara: -1,
+		Atomic:      event.GetAtomic(),
+		ChunkSize:   c.negotiateChunkSize(event.To),
+		To:          event.To,
+	}
+	if state.Atomic {
+		state.sum = sha256.New()
+	}
+	c.start(state, data)
+}
+
+// canSend reports whether this client may start msgID for device to, or
+// any peer if to is empty, answering send_fail when it may not: a
+// read-only session, an invalid target, or no peer to relay to.
+func (c *Client) canSend(msgID, to string) bool {
+	if c.ReadOnly {
+		c.sendFail(msgID, DeliveryReadOnly)
+		return false
+	}
+	if to == c.DeviceID || len(to) > 255 {
+		c.sendFail(msgID, "invalid_recipient")
+		return false
+	}
+
+	if ok, blocked := c.hub.peerState(c, to); !ok {
+		if blocked {
+			c.sendFail(msgID, DeliveryNotPermitted)
+			return false
+		}
+		if w := c.hub.currentWaker(); w != nil {
+			if wait := w.WakePeers(c.DeviceID); wait > 0 {
+				c.sendFailRetry(msgID, "peer_waking", wait)
+				return false
+			}
+		}
 		c.sendFail(msgID, "peer_offline")
-		return
+		return false
 	}
+	return true
+}
+
+// start registers state, relays the opening event data behind peer_info,
+// and grants the sender its chunk size with msg_params.
+func (c *Client) start(state *MessageState, data []byte) {
+	msgID := state.MsgID
 
 	c.mu.Lock()
 	if len(c.activeMessages) >= maxActiveMsgs {
@@ -132,15 +408,39 @@ func (c *Client) handleMsgStart(event *Event, data []byte) {
 		c.sendFail(msgID, "too_many_active_messages")
 		return
 	}
-	c.activeMessages[msgID] = &MessageState{
-		MsgID:       msgID,
-		ParaCount:   0,
-		TotalBytes:  0,
-		CurrentPara: -1,
-	}
+	state.StartedAt = time.Now()
+	c.activeMessages[msgID] = state
 	c.mu.Unlock()
 
-	c.hub.SendToPeer(c, data)
+	if c.Locale != "" || c.TimeZone != "" {
+		info := PeerInfoValue{MsgID: msgID, DeviceID: c.DeviceID, Locale: c.Locale, TimeZone: c.TimeZone}
+		if data, err := NewEvent(EventPeerInfo, info).Marshal(); err == nil {
+			c.hub.route(c, state.To, data)
+		}
+	}
+	c.relay(msgID, data)
+	if params, err := NewEvent(EventMsgParams, MsgParamsValue{MsgID: msgID, ChunkSize: state.ChunkSize}).Marshal(); err == nil {
+		c.Send(params)
+	}
+}
+
+// ClampChunkSize turns a client's declared chunk limit into a MaxChunk:
+// never below MaxChunkSize, which every client must handle, nor above
+// MaxNegotiatedChunkSize.
+func ClampChunkSize(n int) int {
+	return min(max(n, MaxChunkSize), MaxNegotiatedChunkSize)
+}
+
+// negotiateChunkSize picks the chunk size for a new message to device to:
+// the smallest MaxChunk of the sender and the peers it may reach, kept well
+// inside the read limit. It falls back to MaxChunkSize while a peer is falling behind,
+// since bigger frames would only deepen its queue.
+func (c *Client) negotiateChunkSize(to string) int {
+	size := min(c.MaxChunk, c.maxMessageSize/8)
+	if peer := c.hub.peerChunkSize(c, to); peer < size {
+		size = peer
+	}
+	return max(size, MaxChunkSize)
 }
 
 func (c *Client) handleParaStart(event *Event, data []byte) {
@@ -149,7 +449,7 @@ func (c *Client) handleParaStart(event *Event, data []byte) {
 
 	c.mu.Lock()
 	state, ok := c.activeMessages[msgID]
-	if !ok {
+	if !ok || state.File {
 		c.mu.Unlock()
 		return
 	}
@@ -164,22 +464,43 @@ func (c *Client) handleParaStart(event *Event, data []byte) {
 	state.ParaCount++
 	c.mu.Unlock()
 
-	c.hub.SendToPeer(c, data)
+	c.relay(msgID, data)
 }
 
 func (c *Client) handleParaChunk(event *Event, data []byte) {
 	msgID := event.GetMsgID()
 	chunkText := event.GetChunkText()
 
+	policy := c.hub.currentTextPolicy()
+	problem := ""
+	if policy != TextPolicyOff {
+		problem = chunkTextProblem(data, chunkText)
+	}
+
 	c.mu.Lock()
 	state, ok := c.activeMessages[msgID]
-	if !ok {
+	if !ok || state.File {
 		c.mu.Unlock()
 		return
 	}
 
+	if problem != "" {
+		if state.Atomic {
+			delete(c.activeMessages, msgID)
+			c.mu.Unlock()
+			c.failAtomic(state, problem)
+			return
+		}
+		if policy == TextPolicyReject {
+			c.mu.Unlock()
+			c.sendFail(msgID, problem)
+			return
+		}
+		chunkText = SanitizeText(chunkText)
+	}
+
 	chunkLen := len(chunkText)
-	if chunkLen > MaxChunkSize {
+	if chunkLen > state.ChunkSize {
 		c.mu.Unlock()
 		c.sendFail(msgID, "chunk_too_large")
 		return
@@ -191,9 +512,32 @@ func (c *Client) handleParaChunk(event *Event, data []byte) {
 		c.sendFail(msgID, "message_too_large")
 		return
 	}
+	if state.Paused {
+		state.pausedChunks++
+		if state.pausedChunks > PauseGrace {
+			c.mu.Unlock()
+			c.sendFail(msgID, "flow_control_violation")
+			return
+		}
+	}
+	if state.sum != nil {
+		state.sum.Write([]byte(chunkText))
+	}
+	state.Chunks++
 	c.mu.Unlock()
 
-	c.hub.SendToPeer(c, data)
+	if problem != "" {
+		clean := NewEvent(EventParaChunk, ParaChunkValue{MsgID: msgID, Index: event.GetParaIndex(), Text: chunkText})
+		clean.Timestamp = event.Timestamp
+		clean.ServerTS = event.ServerTS
+		out, err := clean.Marshal()
+		if err != nil {
+			return
+		}
+		data = out
+	}
+
+	c.relay(msgID, data)
 }
 
 func (c *Client) handleParaEnd(event *Event, data []byte) {
@@ -201,45 +545,218 @@ func (c *Client) handleParaEnd(event *Event, data []byte) {
 
 	c.mu.Lock()
 	state, ok := c.activeMessages[msgID]
-	if !ok {
+	if !ok || state.File {
 		c.mu.Unlock()
 		return
 	}
 	state.CurrentPara = -1
 	c.mu.Unlock()
 
-	c.hub.SendToPeer(c, data)
+	c.relay(msgID, data)
 }
 
 func (c *Client) handleMsgEnd(event *Event, data []byte) {
 	msgID := event.GetMsgID()
 
 	c.mu.Lock()
+	state, ok := c.activeMessages[msgID]
+	if ok && state.File {
+		c.mu.Unlock()
+		return
+	}
 	delete(c.activeMessages, msgID)
 	c.mu.Unlock()
 
-	c.hub.SendToPeer(c, data)
+	if !ok {
+		c.hub.SendToPeer(c, data)
+		return
+	}
+	if !state.Atomic {
+		c.hub.route(c, state.To, data)
+		return
+	}
+
+	if state.Dropped {
+		c.failAtomic(state, "relay_failed")
+		return
+	}
+	sum := hex.EncodeToString(state.sum.Sum(nil))
+	if event.GetSHA256() != sum {
+		c.failAtomic(state, "checksum_mismatch")
+		return
+	}
+
+	c.commitAtomic(state, sum, data)
+}
+
+// commitAtomic relays end, the event that closed the atomic message state
+// with checksum sum, then confirms the message to both ends with
+// msg_commit.
+func (c *Client) commitAtomic(state *MessageState, sum string, end []byte) {
+	to := c.hub.deliver(c, state.To, end)
+	if to == "" {
+		c.failAtomic(state, "relay_failed")
+		return
+	}
+	commit, err := NewEvent(EventMsgCommit, MsgCommitValue{
+		MsgID:   state.MsgID,
+		SHA256:  sum,
+		Receipt: c.recordReceipt(state, to, sum),
+	}).Marshal()
+	if err != nil {
+		return
+	}
+	c.hub.route(c, state.To, commit)
+	c.Send(commit)
+}
+
+// handleGroupMsg fans a group_msg out so each recipient gets only its own
+// envelope, then reports per-recipient delivery status to the sender. A
+// delivered envelope may make its pair's key due, see KeyRotation.
+func (c *Client) handleGroupMsg(data []byte) {
+	var msg struct {
+		V GroupMsgValue `json:"v"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil || msg.V.MsgID == "" {
+		return
+	}
+	if c.ReadOnly {
+		c.sendFail(msg.V.MsgID, DeliveryReadOnly)
+		return
+	}
+	if len(msg.V.Envelopes) == 0 || len(msg.V.Envelopes) > MaxRecipients {
+		c.sendFail(msg.V.MsgID, "invalid_recipients")
+		return
+	}
+
+	seen := make(map[string]bool, len(msg.V.Envelopes))
+	results := make([]GroupResult, 0, len(msg.V.Envelopes))
+	for _, env := range msg.V.Envelopes {
+		if env.To == "" || env.To == c.DeviceID || seen[env.To] || len(env.KeyID) > MaxKeyIDLen {
+			results = append(results, GroupResult{To: env.To, Status: DeliveryInvalid})
+			continue
+		}
+		seen[env.To] = true
+
+		out, err := NewEvent(EventGroupMsg, GroupDeliveryValue{
+			MsgID:      msg.V.MsgID,
+			From:       c.DeviceID,
+			Ciphertext: env.Ciphertext,
+			KeyID:      env.KeyID,
+		}).Marshal()
+		if err != nil {
+			results = append(results, GroupResult{To: env.To, Status: DeliveryDropped})
+			continue
+		}
+		delivery := c.hub.SendToDevice(c, env.To, out)
+		results = append(results, GroupResult{To: env.To, Status: delivery})
+		if delivery == DeliveryDelivered {
+			if keyID, reason := c.hub.countEnvelope(c.DeviceID, env.To, len(env.Ciphertext), time.Now()); keyID != "" {
+				c.rotateKey(env.To, keyID, reason)
+			}
+		}
+	}
+
+	status, err := NewEvent(EventGroupStatus, GroupStatusValue{MsgID: msg.V.MsgID, Results: results}).Marshal()
+	if err != nil {
+		return
+	}
+	c.Send(status)
+}
+
+// relay forwards data to the peer msgID is addressed to, flagging atomic
+// messages whose events could not be delivered so msg_end aborts instead of
+// committing. A file transfer is suspended instead, and the sender paused
+// until the receiver asks to resume.
+func (c *Client) relay(msgID string, data []byte) {
+	c.mu.Lock()
+	state, ok := c.activeMessages[msgID]
+	to := ""
+	if ok {
+		to = state.To
+	}
+	c.mu.Unlock()
+
+	if c.hub.route(c, to, data) {
+		return
+	}
+
+	c.mu.Lock()
+	suspended := false
+	if ok {
+		state.Dropped = true
+		suspended = state.File && state.suspend(time.Now())
+	}
+	c.mu.Unlock()
+
+	if suspended {
+		if pause, err := NewEvent(EventPause, FlowValue{MsgID: msgID}).Marshal(); err == nil {
+			c.Send(pause)
+		}
+	}
+}
+
+// failAtomic reports reason to the sender and tells the peer to discard
+// whatever it has buffered for state.
+func (c *Client) failAtomic(state *MessageState, reason string) {
+	c.abortPeer(state, reason)
+	c.sendFail(state.MsgID, reason)
+}
+
+func (c *Client) abortPeer(state *MessageState, reason string) {
+	data, err := NewEvent(EventMsgAbort, MsgAbortValue{MsgID: state.MsgID, Reason: reason}).Marshal()
+	if err != nil {
+		return
+	}
+	c.hub.route(c, state.To, data)
+}
+
+// abortAtomic tells the peer to discard every atomic message this client
+// left unfinished.
+func (c *Client) abortAtomic(reason string) {
+	c.mu.Lock()
+	var pending []*MessageState
+	for _, state := range c.activeMessages {
+		if state.Atomic {
+			pending = append(pending, state)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, state := range pending {
+		c.abortPeer(state, reason)
+	}
 }
 
 func (c *Client) sendFail(msgID, reason string) {
-	event := NewEvent(EventSendFail, SendFailValue{
-		MsgID:  msgID,
-		Reason: reason,
-	})
+	c.sendFailValue(SendFailValue{MsgID: msgID, Reason: reason})
+}
+
+// sendFailRetry is sendFail for failures the sender should retry after
+// wait, such as a peer that is being woken.
+func (c *Client) sendFailRetry(msgID, reason string, wait time.Duration) {
+	c.sendFailValue(SendFailValue{MsgID: msgID, Reason: reason, RetryAfter: wait.Milliseconds()})
+}
+
+func (c *Client) sendFailValue(v SendFailValue) {
+	msgID, reason := v.MsgID, v.Reason
+	event := NewEvent(EventSendFail, v)
 
 	data, err := event.Marshal()
 	if err != nil {
 		return
 	}
 
-	select {
-	case c.send <- data:
-	default:
-	}
+	c.Send(data)
 
 	c.mu.Lock()
+	state, ok := c.activeMessages[msgID]
 	delete(c.activeMessages, msgID)
 	c.mu.Unlock()
+
+	if ok && state.Atomic {
+		c.abortPeer(state, reason)
+	}
 }
 
 func (c *Client) WritePump() {
@@ -247,30 +764,39 @@ func (c *Client) WritePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.parkReplay()
 	}()
 
+	for _, e := range c.replay.takePending() {
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.writeEvent(e.frame); err != nil {
+			return
+		}
+	}
+
 	for {
 		select {
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				msg := []byte{}
+				if c.draining {
+					msg = c.closeMessage(websocket.CloseGoingAway)
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, msg)
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+			var err error
+			switch {
+			case IsFileChunk(message):
+				err = c.writeChunk(message)
+			case c.cbor:
+				err = c.writeCBOR(message)
+			default:
+				err = c.writeText(message)
 			}
-			w.Write(message)
-
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			if err != nil {
 				return
 			}
 
@@ -283,9 +809,188 @@ func (c *Client) WritePump() {
 	}
 }
 
+// writeEvent writes one event frame that is already stamped.
+func (c *Client) writeEvent(frame []byte) error {
+	if !c.cbor {
+		c.compress(len(frame))
+		return c.conn.WriteMessage(websocket.TextMessage, frame)
+	}
+	data, err := EncodeCBOR(frame)
+	if err != nil {
+		c.Log.Error("Failed to encode CBOR event", "err", err)
+		return nil
+	}
+	c.compress(len(data))
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// compress decides whether the next frame, of size bytes, is compressed.
+// It has no effect unless the connection negotiated permessage-deflate.
+func (c *Client) compress(size int) {
+	c.conn.EnableWriteCompression(size >= c.CompressMin)
+}
+
+// writeChunk writes a file chunk frame uncompressed: file data is mostly
+// compressed already, and deflating it again only costs CPU.
+func (c *Client) writeChunk(chunk []byte) error {
+	c.conn.EnableWriteCompression(false)
+	return c.conn.WriteMessage(websocket.BinaryMessage, chunk)
+}
+
+// writeText writes message and any queued events as one newline-batched
+// text frame. A queued file chunk ends the batch and is written after it,
+// so frames leave in the order they were queued.
+func (c *Client) writeText(message []byte) error {
+	batch := [][]byte{c.replay.stamp(message)}
+	size := len(batch[0])
+
+	var chunk []byte
+	n := len(c.send)
+	for i := 0; i < n; i++ {
+		next := <-c.send
+		if IsFileChunk(next) {
+			chunk = next
+			break
+		}
+		next = c.replay.stamp(next)
+		batch = append(batch, next)
+		size += 1 + len(next)
+	}
+
+	c.compress(size)
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for i, m := range batch {
+		if i > 0 {
+			w.Write([]byte{'\n'})
+		}
+		w.Write(m)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if chunk == nil {
+		return nil
+	}
+	return c.writeChunk(chunk)
+}
+
+// writeCBOR transcodes message and any queued events into individual binary
+// frames; unlike JSON text frames, CBOR items are never newline-batched.
+// File chunks are already binary and go out as they are.
+func (c *Client) writeCBOR(message []byte) error {
+	n := len(c.send)
+	for i := 0; ; i++ {
+		if IsFileChunk(message) {
+			if err := c.writeChunk(message); err != nil {
+				return err
+			}
+		} else if frame, err := EncodeCBOR(c.replay.stamp(message)); err != nil {
+			c.Log.Error("Failed to encode CBOR event", "err", err)
+		} else {
+			c.compress(len(frame))
+			if err := c.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				return err
+			}
+		}
+		if i >= n {
+			return nil
+		}
+		message = <-c.send
+	}
+}
+
+// setPaused updates the flow-control state of one of this client's
+// outgoing messages and forwards the pause/resume event to it. It reports
+// false if the client is not sending msgID.
+func (c *Client) setPaused(msgID string, paused bool) bool {
+	c.mu.Lock()
+	state, ok := c.activeMessages[msgID]
+	if ok {
+		state.Paused = paused
+		state.pausedChunks = 0
+	}
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	eventType := EventResume
+	if paused {
+		eventType = EventPause
+	}
+	data, err := NewEvent(eventType, FlowValue{MsgID: msgID}).Marshal()
+	if err == nil {
+		c.Send(data)
+	}
+	return true
+}
+
+// InFlightMessages returns the number of messages this client has started
+// but not yet finished sending.
+func (c *Client) InFlightMessages() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.activeMessages)
+}
+
+// Reject sends event to a client that was never registered with the hub,
+// then closes the connection with code. It refuses a connection after the
+// upgrade so the client can still read why, which a failed handshake does
+// not allow in browsers.
+func (c *Client) Reject(event *Event, code int, reason string) {
+	data, err := event.Marshal()
+	if err == nil && c.cbor {
+		data, err = EncodeCBOR(data)
+	}
+	if err != nil {
+		c.Log.Error("Failed to encode event", "type", event.Type, "err", err)
+	} else {
+		messageType := websocket.TextMessage
+		if c.cbor {
+			messageType = websocket.BinaryMessage
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		c.conn.WriteMessage(messageType, data)
+	}
+	c.kick(code, reason)
+}
+
+// kick sends a close frame with code and reason, then drops the connection.
+// WriteControl is safe to call alongside WritePump.
+func (c *Client) kick(code int, reason string) {
+	c.kicked.Store(true)
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
+// Send queues data for the client, dropping it if the queue is full or
+// the hub has already closed it.
 func (c *Client) Send(data []byte) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendClosed {
+		c.hub.drop(DropUnregistered, c, data)
+		return
+	}
 	select {
 	case c.send <- data:
 	default:
+		c.hub.drop(DropFullQueue, c, data)
+	}
+}
+
+// closeSend closes the send queue, which stops WritePump. Only the hub
+// calls it, holding h.mu, so the hub's own sends under h.mu never see a
+// closed queue either.
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.send)
 	}
 }
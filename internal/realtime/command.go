@@ -0,0 +1,179 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// Commands a device can be asked to run. Each target device opts in to
+// individual actions through its allowlist.
+const (
+	CmdOpenURL           = "open_url"
+	CmdRing              = "ring"
+	CmdScreenshotRequest = "request_screenshot"
+)
+
+// CmdTimeout is how long a command waits for its cmd_result before the
+// sender's pending slot is reclaimed.
+const CmdTimeout = time.Minute
+
+const maxCmdURLLen = 2048
+
+var (
+	ErrUnknownCmd = errors.New("unknown command")
+	ErrInvalidCmd = errors.New("invalid command arguments")
+)
+
+// CommandAuthorizer decides whether deviceID accepts action. store.Store
+// implements it from the per-device allowlist.
+type CommandAuthorizer interface {
+	CommandAllowed(deviceID, action string) (bool, error)
+}
+
+// IsKnownCmd reports whether action is a command FileFlow relays.
+func IsKnownCmd(action string) bool {
+	switch action {
+	case CmdOpenURL, CmdRing, CmdScreenshotRequest:
+		return true
+	}
+	return false
+}
+
+// ValidateCmd checks action and its arguments before relaying, so a target
+// only ever receives well-formed commands.
+func ValidateCmd(action string, args map[string]string) error {
+	if !IsKnownCmd(action) {
+		return ErrUnknownCmd
+	}
+	switch action {
+	case CmdOpenURL:
+		raw := args["url"]
+		if len(args) != 1 || raw == "" || len(raw) > maxCmdURLLen {
+			return ErrInvalidCmd
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return ErrInvalidCmd
+		}
+	default:
+		if len(args) != 0 {
+			return ErrInvalidCmd
+		}
+	}
+	return nil
+}
+
+// handleCmd relays a command to its target device after checking the
+// target's allowlist, and reports the outcome with cmd_status.
+func (c *Client) handleCmd(data []byte) {
+	var msg struct {
+		V CmdValue `json:"v"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil || msg.V.CmdID == "" {
+		return
+	}
+	cmd := msg.V
+
+	status := c.relayCmd(cmd)
+	if status != DeliveryDelivered {
+		c.forgetCmd(cmd.CmdID)
+	}
+
+	out, err := NewEvent(EventCmdStatus, CmdStatusValue{CmdID: cmd.CmdID, Status: status}).Marshal()
+	if err != nil {
+		return
+	}
+	c.Send(out)
+}
+
+func (c *Client) relayCmd(cmd CmdValue) string {
+	if c.ReadOnly {
+		return DeliveryReadOnly
+	}
+	if cmd.To == "" || cmd.To == c.DeviceID || ValidateCmd(cmd.Action, cmd.Args) != nil {
+		return DeliveryInvalid
+	}
+	if !c.hub.commandAllowed(cmd.To, cmd.Action) {
+		return DeliveryDenied
+	}
+	if !c.trackCmd(cmd.CmdID, cmd.To) {
+		return DeliveryDropped
+	}
+
+	out, err := NewEvent(EventCmd, CmdDeliveryValue{
+		CmdID:  cmd.CmdID,
+		From:   c.DeviceID,
+		Action: cmd.Action,
+		Args:   cmd.Args,
+	}).Marshal()
+	if err != nil {
+		return DeliveryDropped
+	}
+	return c.hub.SendToDevice(c, cmd.To, out)
+}
+
+// handleCmdResult forwards a target's answer to the device that sent the
+// command. Results for commands nobody is waiting on are dropped.
+func (c *Client) handleCmdResult(data []byte) {
+	var msg struct {
+		V CmdResultValue `json:"v"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil || msg.V.CmdID == "" || msg.V.To == "" {
+		return
+	}
+	result := msg.V
+	to := result.To
+	result.To, result.From = "", c.DeviceID
+
+	out, err := NewEvent(EventCmdResult, result).Marshal()
+	if err != nil {
+		return
+	}
+	c.hub.sendCmdResult(c, to, result.CmdID, out)
+}
+
+type pendingCmd struct {
+	target string
+	sentAt time.Time
+}
+
+// trackCmd records an outstanding command so only its target can answer
+// it. It reports false when too many commands are already pending.
+func (c *Client) trackCmd(cmdID, target string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for id, p := range c.pendingCmds {
+		if now.Sub(p.sentAt) > CmdTimeout {
+			delete(c.pendingCmds, id)
+		}
+	}
+	if _, dup := c.pendingCmds[cmdID]; dup || len(c.pendingCmds) >= MaxPendingCmds {
+		return false
+	}
+	c.pendingCmds[cmdID] = pendingCmd{target: target, sentAt: now}
+	return true
+}
+
+func (c *Client) forgetCmd(cmdID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pendingCmds, cmdID)
+}
+
+// takeCmd removes cmdID if it is pending for target and reports whether it
+// was.
+func (c *Client) takeCmd(cmdID, target string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pendingCmds[cmdID]
+	if !ok || p.target != target {
+		return false
+	}
+	delete(c.pendingCmds, cmdID)
+	return true
+}
@@ -0,0 +1,97 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync/atomic"
+)
+
+// Reasons an outgoing event was dropped, as counted by Hub.Drops.
+const (
+	// DropFullQueue: the recipient's send queue was full.
+	DropFullQueue = "full_queue"
+	// DropNoPeer: no connection could be sent the event at all.
+	DropNoPeer = "no_peer"
+	// DropUnregistered: the recipient's queue was full on a broadcast, and
+	// the hub disconnected it for falling behind.
+	DropUnregistered = "unregistered"
+)
+
+// DefaultDropLogSampling is how many drops go by per debug record unless
+// SetDropLogSampling says otherwise.
+const DefaultDropLogSampling = 100
+
+// DropStats counts outgoing events dropped since the hub started, by
+// reason.
+type DropStats struct {
+	FullQueue    uint64
+	NoPeer       uint64
+	Unregistered uint64
+}
+
+type dropCounters struct {
+	fullQueue    atomic.Uint64
+	noPeer       atomic.Uint64
+	unregistered atomic.Uint64
+	total        atomic.Uint64
+	sampling     atomic.Int64
+}
+
+// Drops returns how many outgoing events were dropped, by reason.
+func (h *Hub) Drops() DropStats {
+	return DropStats{
+		FullQueue:    h.drops.fullQueue.Load(),
+		NoPeer:       h.drops.noPeer.Load(),
+		Unregistered: h.drops.unregistered.Load(),
+	}
+}
+
+// SetDropLogSampling logs one in every n drops at debug level, with the
+// event type and size but never its content. Values below 1 log none.
+func (h *Hub) SetDropLogSampling(n int) {
+	h.drops.sampling.Store(int64(n))
+}
+
+// drop counts message as dropped for reason on its way to c, which is nil
+// when there was no recipient.
+func (h *Hub) drop(reason string, c *Client, message []byte) {
+	switch reason {
+	case DropFullQueue:
+		h.drops.fullQueue.Add(1)
+	case DropNoPeer:
+		h.drops.noPeer.Add(1)
+	case DropUnregistered:
+		h.drops.unregistered.Add(1)
+	}
+
+	n := h.drops.total.Add(1)
+	sampling := h.drops.sampling.Load()
+	if sampling < 1 || (n-1)%uint64(sampling) != 0 {
+		return
+	}
+	log := slog.Default()
+	if c != nil {
+		log = c.Log
+	}
+	if !log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	attrs := []any{"reason", reason, "type", eventType(message), "bytes", len(message), "drops", n}
+	if c != nil {
+		attrs = append(attrs, "queue", cap(c.send))
+	}
+	log.Debug("Dropped outgoing event", attrs...)
+}
+
+// eventType returns the type of an outgoing frame for logging.
+func eventType(message []byte) string {
+	if IsFileChunk(message) {
+		return "file_chunk"
+	}
+	var e struct {
+		Type string `json:"t"`
+	}
+	json.Unmarshal(message, &e)
+	return e.Type
+}
@@ -1,31 +1,123 @@
 package realtime
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"strconv"
 	"time"
+
+	"github.com/lixiansheng/fileflow/internal/cbor"
+)
+
+// ProtocolVersion is the version of the event protocol. Bump it on any change
+// an older client cannot handle, together with MIN_CLIENT_VERSION.
+const ProtocolVersion = 1
+
+// WebSocket subprotocols. Clients that offer SubprotocolCBOR exchange events
+// as CBOR-encoded binary frames; everyone else uses JSON text frames.
+const (
+	SubprotocolJSON = "fileflow.json"
+	SubprotocolCBOR = "fileflow.cbor"
+)
+
+var ErrInvalidEvent = errors.New("invalid event")
+
+const (
+	EventPresence    = "presence"
+	EventMsgStart    = "msg_start"
+	EventParaStart   = "para_start"
+	EventParaChunk   = "para_chunk"
+	EventParaEnd     = "para_end"
+	EventMsgEnd      = "msg_end"
+	EventAck         = "ack"
+	EventSendFail    = "send_fail"
+	EventMsgCommit   = "msg_commit"
+	EventMsgAbort    = "msg_abort"
+	EventMsgParams   = "msg_params"
+	EventPeerInfo    = "peer_info"
+	EventGroupMsg    = "group_msg"
+	EventGroupStatus = "group_status"
+	EventPause       = "pause"
+	EventResume      = "resume"
+	EventCmd         = "cmd"
+	EventCmdStatus   = "cmd_status"
+	EventCmdResult   = "cmd_result"
+	// Settings sync between a user's devices.
+	EventSettingsSet    = "settings_set"
+	EventSettingsGet    = "settings_get"
+	EventSettingsValues = "settings_values"
+	EventSettingsStatus = "settings_status"
+	// File transfers. file_start and file_end are events; the bytes travel
+	// in between as file_chunk binary frames, see FileChunkMagic.
+	EventFileStart = "file_start"
+	EventFileChunk = "file_chunk"
+	EventFileEnd   = "file_end"
+	// Key rotation for group_msg envelopes; see KeyRotation.
+	EventKeyRotate = "key_rotate"
+	EventKeyShare  = "key_share"
+	// Resuming an interrupted file transfer; see ResumeTTL.
+	EventResumeRequest = "resume_request"
+	EventResumeOK      = "resume_ok"
+	// Sent by the server for text an app token pushed through /api/push.
+	EventPush = "push"
+	// Sent by the server when a connection opens with an old client version.
+	EventUpdateRequired    = "update_required"
+	EventUpdateRecommended = "update_recommended"
+	// Sent by the server for an incoming frame it dropped unread.
+	EventError = "error"
+	// Sent by the server when a connection opens, after any replayed
+	// events.
+	EventConnected = "connected"
 )
 
 const (
-	EventPresence  = "presence"
-	EventMsgStart  = "msg_start"
-	EventParaStart = "para_start"
-	EventParaChunk = "para_chunk"
-	EventParaEnd   = "para_end"
-	EventMsgEnd    = "msg_end"
-	EventAck       = "ack"
-	EventSendFail  = "send_fail"
+	// MaxChunkSize is the para_chunk size every client must accept, and the
+	// limit for messages whose sender ignores msg_params.
+	MaxChunkSize = 4 * 1024
+	// MaxNegotiatedChunkSize caps the chunk size msg_params may grant.
+	MaxNegotiatedChunkSize = 64 * 1024
+	MaxMessageSize         = 256 * 1024
+	MaxParagraphs          = 512
+	MaxRecipients          = 32
+	// MaxPendingCmds bounds the unanswered commands one client may have
+	// outstanding.
+	MaxPendingCmds = 32
+	// PauseGrace is how many chunks a sender may still relay after a pause
+	// (those already in flight) before the message is failed.
+	PauseGrace = 16
 )
 
+// Per-recipient outcomes reported in group_status and cmd_status.
 const (
-	MaxChunkSize   = 4 * 1024
-	MaxMessageSize = 256 * 1024
-	MaxParagraphs  = 512
+	DeliveryDelivered = "delivered"
+	DeliveryOffline   = "offline"
+	DeliveryDropped   = "dropped"
+	DeliveryInvalid   = "invalid"
+	DeliveryDenied    = "denied"
+	// DeliveryNotPermitted means the peer policy does not let the two
+	// devices talk. It is also the send_fail reason for msg_start.
+	DeliveryNotPermitted = "not_permitted"
+	// DeliveryReadOnly means the sender's session may only receive. It is
+	// also the send_fail reason for msg_start and group_msg.
+	DeliveryReadOnly = "read_only"
 )
 
 type Event struct {
 	Type      string      `json:"t"`
 	Value     interface{} `json:"v"`
 	Timestamp int64       `json:"ts"`
+	// ServerTS is when the server received (or created) the event, in Unix
+	// ms. Unlike ts, which the sending client sets from its own clock, it
+	// is authoritative for ordering.
+	ServerTS int64 `json:"server_ts,omitempty"`
+	// To addresses the event to one device of the user. On msg_start and
+	// file_start it routes the whole message; without it the server picks
+	// any peer.
+	To string `json:"to,omitempty"`
+	// Seq numbers the events the server sends one connection, from 1; see
+	// replay.go. Clients do not set it.
+	Seq uint64 `json:"seq,omitempty"`
 }
 
 type PresenceValue struct {
@@ -35,6 +127,50 @@ type PresenceValue struct {
 
 type MsgStartValue struct {
 	MsgID string `json:"msgId"`
+	// Atomic asks the server to validate the message checksum at msg_end and
+	// confirm it with msg_commit (or msg_abort) so the receiver can buffer
+	// chunks and never display a partial message.
+	Atomic bool `json:"atomic,omitempty"`
+}
+
+// MsgParamsValue answers an accepted msg_start with the largest para_chunk
+// the sender may use for that message; see Client.MaxChunk.
+type MsgParamsValue struct {
+	MsgID     string `json:"msgId"`
+	ChunkSize int    `json:"chunk"`
+}
+
+// PeerInfoValue precedes a relayed msg_start from a sender that declared
+// its locale or time zone, so the receiver can show the message's
+// timestamps and sizes the way the sender sees them.
+type PeerInfoValue struct {
+	MsgID    string `json:"msgId"`
+	DeviceID string `json:"device_id"`
+	// Locale is a BCP 47 language tag, such as de-DE.
+	Locale string `json:"locale,omitempty"`
+	// TimeZone is an IANA time zone name, such as Europe/Berlin.
+	TimeZone string `json:"tz,omitempty"`
+}
+
+// FileStartValue opens a file transfer. The server relays it like an
+// atomic msg_start: the receiver buffers the chunks and keeps the file only
+// after msg_commit.
+type FileStartValue struct {
+	MsgID string `json:"msgId"`
+	// Name is the file's base name, without any directory.
+	Name string `json:"name"`
+	// Size is the exact number of bytes the chunks will carry.
+	Size int64 `json:"size"`
+	// Type is the file's media type, such as image/png.
+	Type string `json:"type,omitempty"`
+}
+
+// FileEndValue closes a file transfer once Size bytes have been sent.
+type FileEndValue struct {
+	MsgID string `json:"msgId"`
+	// SHA256 is the hex SHA-256 of the file. When set, the server checks it
+	// before committing.
+	SHA256 string `json:"sha256,omitempty"`
 }
 
 type ParaStartValue struct {
@@ -55,6 +191,9 @@ type ParaEndValue struct {
 
 type MsgEndValue struct {
 	MsgID string `json:"msgId"`
+	// SHA256 is the hex SHA-256 of every para_chunk text in send order.
+	// Required for atomic messages.
+	SHA256 string `json:"sha256,omitempty"`
 }
 
 type AckValue struct {
@@ -64,13 +203,33 @@ type AckValue struct {
 type SendFailValue struct {
 	MsgID  string `json:"msgId"`
 	Reason string `json:"reason"`
+	// RetryAfter is how many milliseconds to wait before sending again,
+	// set with reason peer_waking.
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+// MsgCommitValue tells both ends that an atomic message arrived complete.
+type MsgCommitValue struct {
+	MsgID  string `json:"msgId"`
+	SHA256 string `json:"sha256"`
+	// Receipt is the ID of the transfer receipt recorded for the message,
+	// when the server keeps receipts.
+	Receipt string `json:"receipt,omitempty"`
+}
+
+// MsgAbortValue tells the receiver to discard a buffered atomic message.
+type MsgAbortValue struct {
+	MsgID  string `json:"msgId"`
+	Reason string `json:"reason"`
 }
 
 func NewEvent(eventType string, value interface{}) *Event {
+	now := time.Now().UnixMilli()
 	return &Event{
 		Type:      eventType,
 		Value:     value,
-		Timestamp: time.Now().UnixMilli(),
+		Timestamp: now,
+		ServerTS:  now,
 	}
 }
 
@@ -86,6 +245,25 @@ func ParseEvent(data []byte) (*Event, error) {
 	return &e, nil
 }
 
+// stampServerTS sets server_ts on e, parsed from the JSON event data, and
+// returns data carrying it. The common case appends the field without
+// re-encoding; an event whose sender already set server_ts is re-encoded
+// so the client's value cannot survive.
+func stampServerTS(e *Event, data []byte, ms int64) ([]byte, error) {
+	claimed := e.ServerTS != 0
+	e.ServerTS = ms
+
+	trimmed := bytes.TrimRight(data, " \t\r\n")
+	if claimed || len(trimmed) < 2 || trimmed[len(trimmed)-1] != '}' {
+		return e.Marshal()
+	}
+	out := make([]byte, 0, len(trimmed)+32)
+	out = append(out, trimmed[:len(trimmed)-1]...)
+	out = append(out, `,"server_ts":`...)
+	out = strconv.AppendInt(out, ms, 10)
+	return append(out, '}'), nil
+}
+
 func (e *Event) GetMsgID() string {
 	if e.Value == nil {
 		return ""
@@ -130,3 +308,425 @@ func (e *Event) GetChunkText() string {
 	text, _ := valueMap["s"].(string)
 	return text
 }
+
+func (e *Event) GetAtomic() bool {
+	if e.Value == nil {
+		return false
+	}
+
+	valueMap, ok := e.Value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	atomic, _ := valueMap["atomic"].(bool)
+	return atomic
+}
+
+func (e *Event) GetSHA256() string {
+	if e.Value == nil {
+		return ""
+	}
+
+	valueMap, ok := e.Value.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	sum, _ := valueMap["sha256"].(string)
+	return sum
+}
+
+// FlowValue is carried by pause and resume. A receiver sends it to stop or
+// restart a message; the hub forwards it to the sending client.
+type FlowValue struct {
+	MsgID string `json:"msgId"`
+}
+
+// GroupMsgValue is sent by a client: one end-to-end encrypted envelope per
+// recipient. The server never sees plaintext and never keeps the envelopes.
+type GroupMsgValue struct {
+	MsgID     string          `json:"msgId"`
+	Envelopes []GroupEnvelope `json:"envelopes"`
+}
+
+type GroupEnvelope struct {
+	// To is the recipient device ID.
+	To string `json:"to"`
+	// Ciphertext is opaque to the server.
+	Ciphertext string `json:"ct"`
+	// KeyID names the pair key Ciphertext was sealed with, as announced in
+	// key_rotate. Empty is the key the devices agreed before any rotation.
+	KeyID string `json:"kid,omitempty"`
+}
+
+// GroupDeliveryValue is what each recipient receives: only its own envelope.
+type GroupDeliveryValue struct {
+	MsgID      string `json:"msgId"`
+	From       string `json:"from"`
+	Ciphertext string `json:"ct"`
+	KeyID      string `json:"kid,omitempty"`
+}
+
+// KeyRotateValue asks a device to agree a new key with Peer under KeyID.
+// Both devices of the pair receive it and answer with key_share.
+type KeyRotateValue struct {
+	Peer  string `json:"peer"`
+	KeyID string `json:"kid"`
+	// Reason is KeyRotateSchedule or KeyRotateBytes.
+	Reason string `json:"reason"`
+}
+
+// KeyShareValue is sent by a client: its ephemeral public key for KeyID,
+// for device To. The server relays it and never learns the derived key.
+type KeyShareValue struct {
+	To     string `json:"to"`
+	KeyID  string `json:"kid"`
+	Public string `json:"pub"`
+}
+
+// KeyShareDeliveryValue is the key_share the peer receives.
+type KeyShareDeliveryValue struct {
+	From   string `json:"from"`
+	KeyID  string `json:"kid"`
+	Public string `json:"pub"`
+}
+
+// GroupStatusValue reports the fan-out outcome back to the sender.
+type GroupStatusValue struct {
+	MsgID   string        `json:"msgId"`
+	Results []GroupResult `json:"results"`
+}
+
+type GroupResult struct {
+	To     string `json:"to"`
+	Status string `json:"status"`
+}
+
+// CmdValue is sent by a client to run Action on device To. The target must
+// have Action in its allowlist.
+type CmdValue struct {
+	CmdID  string            `json:"cmdId"`
+	To     string            `json:"to"`
+	Action string            `json:"action"`
+	Args   map[string]string `json:"args,omitempty"`
+}
+
+// CmdDeliveryValue is what the target device receives.
+type CmdDeliveryValue struct {
+	CmdID  string            `json:"cmdId"`
+	From   string            `json:"from"`
+	Action string            `json:"action"`
+	Args   map[string]string `json:"args,omitempty"`
+}
+
+// CmdStatusValue tells the sender whether its command reached the target.
+type CmdStatusValue struct {
+	CmdID  string `json:"cmdId"`
+	Status string `json:"status"`
+}
+
+// CmdResultValue is the target's answer. The target sets To; the hub
+// replaces it with From before delivering to the sender.
+type CmdResultValue struct {
+	CmdID string `json:"cmdId"`
+	To    string `json:"to,omitempty"`
+	From  string `json:"from,omitempty"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ConnectedValue opens every connection. ResumeToken is what to pass as
+// /ws?resume= after a drop. Resumed says the events the dropped
+// connection missed, Replayed of them, came just before; without it the
+// client must reset its state.
+type ConnectedValue struct {
+	ResumeToken string `json:"resumeToken"`
+	Resumed     bool   `json:"resumed"`
+	Replayed    int    `json:"replayed,omitempty"`
+}
+
+// PushValue is text an app pushed to a device. From is the app token's
+// name.
+type PushValue struct {
+	PushID string `json:"pushId"`
+	From   string `json:"from"`
+	Text   string `json:"text"`
+}
+
+// SettingsSetValue stores one setting. Ciphertext is encrypted by the
+// client and empty to delete the key. The hub sets From when pushing the
+// change to the user's other devices.
+type SettingsSetValue struct {
+	Key        string `json:"key"`
+	Ciphertext string `json:"ct"`
+	From       string `json:"from,omitempty"`
+}
+
+// SettingsValuesValue answers settings_get with every stored setting.
+type SettingsValuesValue struct {
+	Settings map[string]string `json:"settings"`
+}
+
+// SettingsStatusValue tells the sender whether its settings_set was saved.
+type SettingsStatusValue struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+}
+
+// UpdateValue is carried by update_required and update_recommended. Current
+// is the version the client reported (empty if it sent none) and Version the
+// one it should update to.
+// ErrorValue reports a problem that is not tied to one message, such as a
+// frame over the size limit or a key_share the server could not relay.
+type ErrorValue struct {
+	Code string `json:"code"`
+	// Limit is the limit that was exceeded, in bytes.
+	Limit int `json:"limit,omitempty"`
+	// KeyID is the key_share's kid.
+	KeyID string `json:"kid,omitempty"`
+	// MsgID is the resume_request's msgId.
+	MsgID string `json:"msgId,omitempty"`
+}
+
+// ResumeValue is carried by resume_request, from the receiver of a file
+// transfer, and resume_ok, the sender's answer. Offset is the number of
+// bytes the receiver holds, where the sender continues.
+type ResumeValue struct {
+	MsgID  string `json:"msgId"`
+	Offset int64  `json:"offset"`
+}
+
+type UpdateValue struct {
+	Current string `json:"current"`
+	Version string `json:"version"`
+	URL     string `json:"url,omitempty"`
+}
+
+//go:generate go run ../../cmd/cborgen -out events_cbor.go events.go
+
+// cborValue is an event value with generated CBOR methods, see
+// events_cbor.go.
+type cborValue interface {
+	AppendCBOR(b []byte) []byte
+	UnmarshalCBOR(d *cbor.Decoder) error
+}
+
+// sentValues and receivedValues give the value type of each event the
+// server sends and receives, so CBOR frames are encoded and decoded
+// straight from the structs. Events missing here are transcoded through
+// interface{}, as is a value that does not fit its type (a received one
+// with an unknown key, or a fractional number for an int).
+var sentValues = map[string]func() cborValue{
+	EventPresence:          func() cborValue { return new(PresenceValue) },
+	EventMsgStart:          func() cborValue { return new(MsgStartValue) },
+	EventParaStart:         func() cborValue { return new(ParaStartValue) },
+	EventParaChunk:         func() cborValue { return new(ParaChunkValue) },
+	EventParaEnd:           func() cborValue { return new(ParaEndValue) },
+	EventMsgEnd:            func() cborValue { return new(MsgEndValue) },
+	EventAck:               func() cborValue { return new(AckValue) },
+	EventSendFail:          func() cborValue { return new(SendFailValue) },
+	EventMsgCommit:         func() cborValue { return new(MsgCommitValue) },
+	EventMsgAbort:          func() cborValue { return new(MsgAbortValue) },
+	EventMsgParams:         func() cborValue { return new(MsgParamsValue) },
+	EventPeerInfo:          func() cborValue { return new(PeerInfoValue) },
+	EventGroupMsg:          func() cborValue { return new(GroupDeliveryValue) },
+	EventGroupStatus:       func() cborValue { return new(GroupStatusValue) },
+	EventPause:             func() cborValue { return new(FlowValue) },
+	EventResume:            func() cborValue { return new(FlowValue) },
+	EventCmd:               func() cborValue { return new(CmdDeliveryValue) },
+	EventCmdStatus:         func() cborValue { return new(CmdStatusValue) },
+	EventCmdResult:         func() cborValue { return new(CmdResultValue) },
+	EventSettingsSet:       func() cborValue { return new(SettingsSetValue) },
+	EventSettingsValues:    func() cborValue { return new(SettingsValuesValue) },
+	EventSettingsStatus:    func() cborValue { return new(SettingsStatusValue) },
+	EventFileStart:         func() cborValue { return new(FileStartValue) },
+	EventFileEnd:           func() cborValue { return new(FileEndValue) },
+	EventKeyRotate:         func() cborValue { return new(KeyRotateValue) },
+	EventKeyShare:          func() cborValue { return new(KeyShareDeliveryValue) },
+	EventResumeRequest:     func() cborValue { return new(ResumeValue) },
+	EventResumeOK:          func() cborValue { return new(ResumeValue) },
+	EventPush:              func() cborValue { return new(PushValue) },
+	EventUpdateRequired:    func() cborValue { return new(UpdateValue) },
+	EventUpdateRecommended: func() cborValue { return new(UpdateValue) },
+	EventError:             func() cborValue { return new(ErrorValue) },
+	EventConnected:         func() cborValue { return new(ConnectedValue) },
+}
+
+var receivedValues = map[string]func() cborValue{
+	EventMsgStart:      func() cborValue { return new(MsgStartValue) },
+	EventParaStart:     func() cborValue { return new(ParaStartValue) },
+	EventParaChunk:     func() cborValue { return new(ParaChunkValue) },
+	EventParaEnd:       func() cborValue { return new(ParaEndValue) },
+	EventMsgEnd:        func() cborValue { return new(MsgEndValue) },
+	EventAck:           func() cborValue { return new(AckValue) },
+	EventFileStart:     func() cborValue { return new(FileStartValue) },
+	EventFileEnd:       func() cborValue { return new(FileEndValue) },
+	EventGroupMsg:      func() cborValue { return new(GroupMsgValue) },
+	EventKeyShare:      func() cborValue { return new(KeyShareValue) },
+	EventPause:         func() cborValue { return new(FlowValue) },
+	EventResume:        func() cborValue { return new(FlowValue) },
+	EventCmd:           func() cborValue { return new(CmdValue) },
+	EventCmdResult:     func() cborValue { return new(CmdResultValue) },
+	EventSettingsSet:   func() cborValue { return new(SettingsSetValue) },
+	EventResumeRequest: func() cborValue { return new(ResumeValue) },
+	EventResumeOK:      func() cborValue { return new(ResumeValue) },
+}
+
+// sentValue returns a new value of the type sentValues gives the JSON
+// event data, if data starts with its type as Event.Marshal writes it.
+func sentValue(data []byte) cborValue {
+	rest, ok := bytes.CutPrefix(data, []byte(`{"t":"`))
+	if !ok {
+		return nil
+	}
+	end := bytes.IndexByte(rest, '"')
+	if end < 0 {
+		return nil
+	}
+	if newValue, ok := sentValues[string(rest[:end])]; ok {
+		return newValue()
+	}
+	return nil
+}
+
+// EncodeCBOR converts a JSON-encoded event into its CBOR wire form, with
+// the same envelope keys. The value is decoded once, straight into its
+// struct (see sentValue), and encoded by the struct's AppendCBOR, so keys
+// neither Event nor the value's struct defines are not sent; DecodeCBOR,
+// facing clients, keeps them.
+func EncodeCBOR(data []byte) ([]byte, error) {
+	var e Event
+	if v := sentValue(data); v != nil {
+		// The decoder fills the pointer e.Value holds.
+		e.Value = v
+	}
+	if err := json.Unmarshal(data, &e); err != nil || e.Type == "" {
+		return encodeCBORGeneric(data)
+	}
+
+	n := 3
+	if e.ServerTS != 0 {
+		n++
+	}
+	if e.To != "" {
+		n++
+	}
+	if e.Seq != 0 {
+		n++
+	}
+	b := make([]byte, 0, len(data))
+	b = cbor.AppendMapHeader(b, n)
+	b = cbor.AppendString(cbor.AppendString(b, "t"), e.Type)
+	b = cbor.AppendString(b, "v")
+	if v, ok := e.Value.(cborValue); ok {
+		b = v.AppendCBOR(b)
+	} else {
+		item, err := cbor.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, item...)
+	}
+	b = cbor.AppendInt(cbor.AppendString(b, "ts"), e.Timestamp)
+	if e.ServerTS != 0 {
+		b = cbor.AppendInt(cbor.AppendString(b, "server_ts"), e.ServerTS)
+	}
+	if e.To != "" {
+		b = cbor.AppendString(cbor.AppendString(b, "to"), e.To)
+	}
+	if e.Seq != 0 {
+		b = cbor.AppendUint(cbor.AppendString(b, "seq"), e.Seq)
+	}
+	return b, nil
+}
+
+// encodeCBORGeneric is EncodeCBOR through interface{}, for events whose
+// envelope does not fit Event.
+func encodeCBORGeneric(data []byte) ([]byte, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if _, ok := m["t"].(string); !ok {
+		return nil, ErrInvalidEvent
+	}
+	return cbor.Marshal(m)
+}
+
+// DecodeCBOR converts a CBOR-encoded event into the JSON form relayed
+// through the hub.
+func DecodeCBOR(data []byte) ([]byte, error) {
+	var e Event
+	var value []byte
+	d := cbor.NewDecoder(data)
+	n, err := d.MapLen()
+	if err != nil {
+		return decodeCBORGeneric(data)
+	}
+	for i := 0; i < n; i++ {
+		key, err := d.String()
+		if err != nil {
+			return decodeCBORGeneric(data)
+		}
+		switch key {
+		case "t":
+			e.Type, err = d.String()
+		case "v":
+			value, err = d.Raw()
+		case "ts":
+			e.Timestamp, err = d.Int()
+		case "server_ts":
+			e.ServerTS, err = d.Int()
+		case "to":
+			e.To, err = d.String()
+		case "seq":
+			e.Seq, err = d.Uint()
+		default:
+			err = cbor.ErrUnknownField
+		}
+		if err != nil {
+			return decodeCBORGeneric(data)
+		}
+	}
+	if !d.Done() {
+		return nil, cbor.ErrTrailingData
+	}
+	if e.Type == "" {
+		return nil, ErrInvalidEvent
+	}
+	if value != nil {
+		if e.Value, err = decodeValueCBOR(e.Type, value); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(&e)
+}
+
+func decodeValueCBOR(eventType string, data []byte) (interface{}, error) {
+	if newValue, ok := receivedValues[eventType]; ok {
+		v := newValue()
+		d := cbor.NewDecoder(data)
+		if v.UnmarshalCBOR(d) == nil && d.Done() {
+			return v, nil
+		}
+	}
+	return cbor.Unmarshal(data)
+}
+
+// decodeCBORGeneric is DecodeCBOR through interface{}, for events
+// carrying keys or types Event does not fit.
+func decodeCBORGeneric(data []byte) ([]byte, error) {
+	v, err := cbor.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidEvent
+	}
+	if _, ok := m["t"].(string); !ok {
+		return nil, ErrInvalidEvent
+	}
+	return json.Marshal(m)
+}
@@ -0,0 +1,193 @@
+package realtime
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FileChunkMagic is the first byte of a file_chunk binary frame. JSON
+// events start with '{' and CBOR events with a map header (0xa0-0xbf), so
+// one byte tells a chunk apart from an event on either subprotocol.
+//
+// A frame is the magic byte, the msgId length as one byte, the msgId, the
+// chunk's byte offset in the file as a big-endian uint64, and the payload.
+const FileChunkMagic byte = 0x01
+
+const (
+	// MaxFileSize is the largest size file_start may declare.
+	MaxFileSize = 64 * 1024 * 1024
+	// MaxFileNameLength bounds a file_start name, in bytes.
+	MaxFileNameLength = 255
+)
+
+var ErrInvalidFileChunk = errors.New("invalid file chunk")
+
+// mimeTypePattern matches a type/subtype media type without parameters.
+var mimeTypePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}$`)
+
+// IsFileChunk reports whether frame is a file_chunk frame rather than an
+// event.
+func IsFileChunk(frame []byte) bool {
+	return len(frame) > 0 && frame[0] == FileChunkMagic
+}
+
+// EncodeFileChunk builds the file_chunk frame for payload at offset.
+func EncodeFileChunk(msgID string, offset int64, payload []byte) ([]byte, error) {
+	if msgID == "" || len(msgID) > 255 || offset < 0 {
+		return nil, ErrInvalidFileChunk
+	}
+	frame := make([]byte, 0, 2+len(msgID)+8+len(payload))
+	frame = append(frame, FileChunkMagic, byte(len(msgID)))
+	frame = append(frame, msgID...)
+	frame = binary.BigEndian.AppendUint64(frame, uint64(offset))
+	return append(frame, payload...), nil
+}
+
+// ParseFileChunk splits a file_chunk frame. The payload aliases frame.
+func ParseFileChunk(frame []byte) (msgID string, offset int64, payload []byte, err error) {
+	if !IsFileChunk(frame) || len(frame) < 2 {
+		return "", 0, nil, ErrInvalidFileChunk
+	}
+	n := int(frame[1])
+	if n == 0 || len(frame) < 2+n+8 {
+		return "", 0, nil, ErrInvalidFileChunk
+	}
+	off := binary.BigEndian.Uint64(frame[2+n:])
+	if off > MaxFileSize {
+		return "", 0, nil, ErrInvalidFileChunk
+	}
+	return string(frame[2 : 2+n]), int64(off), frame[2+n+8:], nil
+}
+
+// validFileStart reports whether v describes a file the server will relay:
+// a size within MaxFileSize, a plain file name with no path or control
+// characters, and an optional media type.
+func validFileStart(v FileStartValue) bool {
+	if len(v.MsgID) > 255 || v.Size < 0 || v.Size > MaxFileSize {
+		return false
+	}
+	if v.Type != "" && !mimeTypePattern.MatchString(v.Type) {
+		return false
+	}
+	name := v.Name
+	if name == "" || len(name) > MaxFileNameLength || !utf8.ValidString(name) ||
+		name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return false
+	}
+	return strings.IndexFunc(name, unicode.IsControl) < 0
+}
+
+// handleFileStart opens a file transfer. It is atomic: the server checksums
+// the chunks and confirms the file with msg_commit, or has the receiver
+// discard it with msg_abort.
+func (c *Client) handleFileStart(event *Event, data []byte) {
+	var msg struct {
+		V FileStartValue `json:"v"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil || msg.V.MsgID == "" {
+		return
+	}
+	msgID := msg.V.MsgID
+	if !validFileStart(msg.V) {
+		c.sendFail(msgID, "invalid_file")
+		return
+	}
+	if !c.canSend(msgID, event.To) {
+		return
+	}
+
+	state := &MessageState{
+		MsgID:       msgID,
+		CurrentPara: -1,
+		Atomic:      true,
+		sum:         sha256.New(),
+		ChunkSize:   c.negotiateChunkSize(event.To),
+		To:          event.To,
+		File:        true,
+		FileSize:    msg.V.Size,
+	}
+	state.markResumePoint()
+	c.start(state, data)
+}
+
+// handleFileChunk relays a file_chunk frame unchanged once its offset
+// follows the bytes already relayed and it stays within the chunk size
+// granted by msg_params and the size declared in file_start. Chunks of a
+// suspended transfer are dropped.
+func (c *Client) handleFileChunk(frame []byte) {
+	msgID, offset, payload, err := ParseFileChunk(frame)
+	if err != nil {
+		c.Log.Error("Failed to parse file chunk", "err", err)
+		return
+	}
+
+	c.mu.Lock()
+	state, ok := c.activeMessages[msgID]
+	if !ok || !state.File || !state.suspendedAt.IsZero() {
+		c.mu.Unlock()
+		return
+	}
+	reason := ""
+	switch {
+	case offset != state.FileReceived:
+		reason = "bad_offset"
+	case len(payload) > state.ChunkSize:
+		reason = "chunk_too_large"
+	case state.FileReceived+int64(len(payload)) > state.FileSize:
+		reason = "file_too_large"
+	case state.Paused:
+		state.pausedChunks++
+		if state.pausedChunks > PauseGrace {
+			reason = "flow_control_violation"
+		}
+	}
+	if reason != "" {
+		c.mu.Unlock()
+		c.sendFail(msgID, reason)
+		return
+	}
+	state.FileReceived += int64(len(payload))
+	state.sum.Write(payload)
+	state.Chunks++
+	state.markResumePoint()
+	c.mu.Unlock()
+
+	c.relay(msgID, frame)
+}
+
+// handleFileEnd commits a file transfer that carried exactly the declared
+// size and, when the sender gave one, the declared checksum.
+func (c *Client) handleFileEnd(event *Event, data []byte) {
+	msgID := event.GetMsgID()
+
+	c.mu.Lock()
+	state, ok := c.activeMessages[msgID]
+	if !ok || !state.File || !state.suspendedAt.IsZero() {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.activeMessages, msgID)
+	c.mu.Unlock()
+
+	if state.Dropped {
+		c.failAtomic(state, "relay_failed")
+		return
+	}
+	if state.FileReceived != state.FileSize {
+		c.failAtomic(state, "size_mismatch")
+		return
+	}
+	sum := hex.EncodeToString(state.sum.Sum(nil))
+	if want := event.GetSHA256(); want != "" && want != sum {
+		c.failAtomic(state, "checksum_mismatch")
+		return
+	}
+	c.commitAtomic(state, sum, data)
+}
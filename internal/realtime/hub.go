@@ -1,53 +1,129 @@
 package realtime
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lixiansheng/fileflow/internal/limit"
 )
 
 type Hub struct {
-	mu         sync.RWMutex
-	clients    map[*Client]bool
-	register   chan *Client
-	unregister chan *Client
-	stopCh     chan struct{}
+	mu          sync.RWMutex
+	clients     map[*Client]bool
+	devices     map[string]map[*Client]bool // clients by DeviceID
+	rooms       map[string]*room            // by roomKey
+	register    chan *Client
+	unregister  chan *Client
+	stopCh      chan struct{}
+	stopOnce    sync.Once
+	doneCh      chan struct{} // closed when Run returns
+	drained     []*Client     // clients Run closed on stop
+	commands    CommandAuthorizer
+	peers       PeerPolicy
+	sendQueue   int
+	textPolicy  string
+	settings    SettingsStore
+	receipts    ReceiptRecorder
+	reconnector Reconnector
+	waker       Waker
+	heartbeat   atomic.Int64
+	oversized   atomic.Uint64
+	drops       dropCounters
+	keys        pairKeys
+	transfers   parkedTransfers
+	replays     map[string]*parkedReplay // by resume token
+}
+
+// HeartbeatInterval is how often a running hub loop records that it is
+// alive; see Hub.LastHeartbeat.
+const HeartbeatInterval = 5 * time.Second
+
+// DefaultSendQueue is how many outgoing events a client may have queued
+// before it is treated as too slow and dropped.
+const DefaultSendQueue = 256
+
+// PeerPolicy decides whether two devices may exchange events. store.Store
+// implements it from the peer links set by an admin. The hub calls it with
+// h.mu held, once per candidate receiver, so it must answer from memory
+// rather than block on I/O.
+type PeerPolicy interface {
+	PeerAllowed(a, b string) (bool, error)
 }
 
 func NewHub() *Hub {
-	return &Hub{
+	h := &Hub{
 		clients:    make(map[*Client]bool),
+		devices:    make(map[string]map[*Client]bool),
+		rooms:      make(map[string]*room),
+		replays:    make(map[string]*parkedReplay),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		stopCh:     make(chan struct{}),
+		doneCh:     make(chan struct{}),
+		sendQueue:  DefaultSendQueue,
+		textPolicy: defaultTextPolicy,
+		keys:       pairKeys{rotation: DefaultKeyRotation},
 	}
+	h.drops.sampling.Store(DefaultDropLogSampling)
+	return h
 }
 
 func (h *Hub) Run() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	defer close(h.doneCh)
+	h.heartbeat.Store(time.Now().UnixMilli())
+
 	for {
 		select {
+		case now := <-ticker.C:
+			h.heartbeat.Store(now.UnixMilli())
+			h.pruneKeys(now)
+			h.expireTransfers(now)
+			h.expireReplays(now)
+
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client] = true
+			if h.devices[client.DeviceID] == nil {
+				h.devices[client.DeviceID] = make(map[*Client]bool)
+			}
+			h.devices[client.DeviceID][client] = true
+			h.join(client)
 			h.mu.Unlock()
 			h.broadcastPresence()
-			log.Printf("Client connected: %s (total: %d)", client.DeviceID, h.OnlineCount())
+			client.Log.Info("Client connected", "total", h.OnlineCount())
 
 		case client := <-h.unregister:
 			h.mu.Lock()
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				close(client.send)
+				delete(h.devices[client.DeviceID], client)
+				if len(h.devices[client.DeviceID]) == 0 {
+					delete(h.devices, client.DeviceID)
+				}
+				h.leave(client)
+				client.closeSend()
 			}
 			h.mu.Unlock()
 			h.broadcastPresence()
-			log.Printf("Client disconnected: %s (total: %d)", client.DeviceID, h.OnlineCount())
+			client.Log.Info("Client disconnected", "total", h.OnlineCount())
 
 		case <-h.stopCh:
+			h.heartbeat.Store(0)
 			h.mu.Lock()
 			for client := range h.clients {
-				close(client.send)
+				client.draining = true
+				client.closeSend()
 				delete(h.clients, client)
+				h.drained = append(h.drained, client)
 			}
+			clear(h.devices)
+			clear(h.rooms)
 			h.mu.Unlock()
 			return
 		}
@@ -55,15 +131,205 @@ func (h *Hub) Run() {
 }
 
 func (h *Hub) Stop() {
-	close(h.stopCh)
+	h.stopOnce.Do(func() { close(h.stopCh) })
+}
+
+// Shutdown stops the hub and waits, until ctx is done, for every client it
+// drained to finish: the write pump has sent its close frame, with the
+// reconnect token minted through the Reconnector, and the read pump has
+// run OnClose. Both can write to the store, so the store must outlive it.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.Stop()
+	select {
+	case <-h.doneCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	h.mu.RLock()
+	drained := h.drained
+	h.mu.RUnlock()
+	for _, client := range drained {
+		for _, done := range []chan struct{}{client.parked, client.closed} {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// LastHeartbeat returns when the hub loop last proved it was running, or
+// the zero time if it is not running. A blocked loop stops advancing it.
+func (h *Hub) LastHeartbeat() time.Time {
+	ms := h.heartbeat.Load()
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// OversizedFrames returns how many incoming frames, over all clients, were
+// dropped for exceeding the message size limit.
+func (h *Hub) OversizedFrames() uint64 {
+	return h.oversized.Load()
+}
+
+// SetSendQueue sets the outgoing queue depth of clients created after the
+// call. Values below 1 restore DefaultSendQueue.
+func (h *Hub) SetSendQueue(n int) {
+	if n < 1 {
+		n = DefaultSendQueue
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sendQueue = n
+}
+
+// sendQueueLen is DefaultSendQueue for a nil hub, so a client built
+// without one, as by a test double, still gets a queue.
+func (h *Hub) sendQueueLen() int {
+	if h == nil {
+		return DefaultSendQueue
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sendQueue
+}
+
+// SetTextPolicy sets how para_chunk text that is not valid UTF-8 or
+// carries control characters is handled. See TextPolicyOff,
+// TextPolicyReject and TextPolicySanitize; unknown values are ignored.
+func (h *Hub) SetTextPolicy(p string) {
+	if _, err := ParseTextPolicy(p); err != nil {
+		return
+	}
+	if p == "" {
+		p = defaultTextPolicy
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.textPolicy = p
+}
+
+func (h *Hub) currentTextPolicy() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.textPolicy
+}
+
+// SetCommandAuthorizer sets the allowlist consulted before relaying cmd
+// events. Without one every command is denied.
+func (h *Hub) SetCommandAuthorizer(a CommandAuthorizer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commands = a
+}
+
+// commandAllowed fails closed on a missing authorizer or lookup error.
+func (h *Hub) commandAllowed(deviceID, action string) bool {
+	h.mu.RLock()
+	a := h.commands
+	h.mu.RUnlock()
+
+	if a == nil {
+		return false
+	}
+	ok, err := a.CommandAllowed(deviceID, action)
+	if err != nil {
+		slog.Error("Command allowlist lookup failed", "err", err)
+		return false
+	}
+	return ok
+}
+
+// SetSettingsStore sets where synced settings are kept. Without one,
+// settings_set answers unavailable and settings_get returns nothing.
+func (h *Hub) SetSettingsStore(s SettingsStore) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.settings = s
+}
+
+func (h *Hub) settingsStore() SettingsStore {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.settings
+}
+
+// Waker wakes a user's sleeping devices when a message finds none of them
+// online. wake.Waker implements it.
+type Waker interface {
+	// WakePeers returns how long the sender should wait before retrying,
+	// or zero if nothing could be woken.
+	WakePeers(deviceID string) time.Duration
+}
+
+// SetWaker sets what msg_start uses to wake offline peers. Without one the
+// sender just gets peer_offline.
+func (h *Hub) SetWaker(w Waker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.waker = w
+}
+
+func (h *Hub) currentWaker() Waker {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.waker
+}
+
+// SetPeerPolicy sets the policy consulted before relaying between two
+// devices. Without one every pair of devices of the same user may talk.
+func (h *Hub) SetPeerPolicy(p PeerPolicy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.peers = p
+}
+
+// peerAllowed fails closed on a lookup error. Callers must hold h.mu.
+func (h *Hub) peerAllowed(a, b string) bool {
+	if h.peers == nil || a == b {
+		return true
+	}
+	ok, err := h.peers.PeerAllowed(a, b)
+	if err != nil {
+		slog.Error("Peer policy lookup failed", "err", err)
+		return false
+	}
+	return ok
+}
+
+// NewClient is the package-level NewClient for a client of h.
+func (h *Hub) NewClient(conn *websocket.Conn, deviceID, ip string, connLimiter *limit.ConnLimiter, rateLimit, maxMessageBytes int) *Client {
+	return NewClient(h, conn, deviceID, ip, connLimiter, rateLimit, maxMessageBytes)
+}
+
+// Attach registers client and starts its read and write pumps.
+func (h *Hub) Attach(client *Client) {
+	resumed, replayed := h.resume(client)
+	connected := ConnectedValue{ResumeToken: client.replay.token, Resumed: resumed, Replayed: replayed}
+	if data, err := NewEvent(EventConnected, connected).Marshal(); err == nil {
+		client.Send(data)
+	}
+	h.Register(client)
+	go client.WritePump()
+	go client.ReadPump()
 }
 
 func (h *Hub) Register(client *Client) {
 	h.register <- client
 }
 
+// Unregister removes client from the hub. Once Run has returned there is
+// nothing left to remove it from, so it does not block.
 func (h *Hub) Unregister(client *Client) {
-	h.unregister <- client
+	select {
+	case h.unregister <- client:
+	case <-h.doneCh:
+	}
 }
 
 func (h *Hub) OnlineCount() int {
@@ -72,19 +338,116 @@ func (h *Hub) OnlineCount() int {
 	return len(h.clients)
 }
 
+// OnlineCountFor returns how many clients of userID are connected.
+func (h *Hub) OnlineCountFor(userID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	n := 0
+	for client := range h.clients {
+		if client.UserID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+// DeviceStats describes the live hub state attributable to one device.
+type DeviceStats struct {
+	Connections int `json:"live_connections"`
+	Sessions    int `json:"active_sessions"`
+	InFlight    int `json:"in_flight_messages"`
+}
+
+// DeviceStats reports the connections, distinct sessions and in-flight
+// messages currently held by clients of deviceID.
+func (h *Hub) DeviceStats(deviceID string) DeviceStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var stats DeviceStats
+	sessions := make(map[string]struct{})
+	for client := range h.clients {
+		if client.DeviceID != deviceID {
+			continue
+		}
+		stats.Connections++
+		stats.InFlight += client.InFlightMessages()
+		if client.SessionID != "" {
+			sessions[client.SessionID] = struct{}{}
+		}
+	}
+	stats.Sessions = len(sessions)
+	return stats
+}
+
+// CloseSession drops every connection authorised with sessionID and returns
+// how many were closed. ReadPump unregisters them as the reads fail.
+func (h *Hub) CloseSession(sessionID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	n := 0
+	for client := range h.clients {
+		if client.SessionID == sessionID {
+			client.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// CloseDevice sends CloseDeviceRevoked to every connection of deviceID,
+// drops them and returns how many were closed.
+func (h *Hub) CloseDevice(deviceID string) int {
+	return h.closeDevice(deviceID, CloseDeviceRevoked, "device revoked")
+}
+
+// DisableDevice is CloseDevice with CloseDeviceDisabled.
+func (h *Hub) DisableDevice(deviceID string) int {
+	return h.closeDevice(deviceID, CloseDeviceDisabled, "device disabled")
+}
+
+func (h *Hub) closeDevice(deviceID string, code int, reason string) int {
+	h.mu.RLock()
+	var clients []*Client
+	for client := range h.devices[deviceID] {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	// Close frames can block for up to writeWait, so send them outside the lock.
+	for _, client := range clients {
+		client.kick(code, reason)
+	}
+	return len(clients)
+}
+
+// broadcastPresence sends every client the online count of its room.
 func (h *Hub) broadcastPresence() {
-	event := NewEvent(EventPresence, PresenceValue{
-		Online:   h.OnlineCount(),
-		Required: 2,
-	})
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-	data, err := event.Marshal()
-	if err != nil {
-		log.Printf("Failed to marshal presence event: %v", err)
-		return
+	events := make(map[string][]byte, len(h.rooms))
+	for key, r := range h.rooms {
+		data, err := NewEvent(EventPresence, PresenceValue{Online: len(r.members), Required: 2}).Marshal()
+		if err != nil {
+			slog.Error("Failed to marshal presence event", "err", err)
+			return
+		}
+		events[key] = data
 	}
 
-	h.Broadcast(data, nil)
+	for client := range h.clients {
+		select {
+		case client.send <- events[client.roomKey()]:
+		default:
+			h.drop(DropUnregistered, client, events[client.roomKey()])
+			go func(c *Client) {
+				h.unregister <- c
+			}(client)
+		}
+	}
 }
 
 func (h *Hub) Broadcast(message []byte, exclude *Client) {
@@ -98,6 +461,7 @@ func (h *Hub) Broadcast(message []byte, exclude *Client) {
 		select {
 		case client.send <- message:
 		default:
+			h.drop(DropUnregistered, client, message)
 			go func(c *Client) {
 				h.unregister <- c
 			}(client)
@@ -105,31 +469,236 @@ func (h *Hub) Broadcast(message []byte, exclude *Client) {
 	}
 }
 
+// sendToClient queues message for c under the hub lock, so c cannot be
+// unregistered mid-send. It reports false if c is no longer registered; a
+// full queue drops message but still reports true.
+func (h *Hub) sendToClient(c *Client, message []byte) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.clients[c] {
+		h.drop(DropNoPeer, c, message)
+		return false
+	}
+	select {
+	case c.send <- message:
+	default:
+		h.drop(DropFullQueue, c, message)
+	}
+	return true
+}
+
+// SendToPeer delivers message to one other connection in sender's room
+// that the peer policy lets sender reach.
 func (h *Hub) SendToPeer(sender *Client, message []byte) bool {
+	return h.sendToPeer(sender, message) != nil
+}
+
+// sendToPeer is SendToPeer returning the client that got message, or nil.
+func (h *Hub) sendToPeer(sender *Client, message []byte) *Client {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
+	var full *Client
 	for client := range h.clients {
-		if client != sender {
+		if client != sender && client.inRoom(sender) && h.peerAllowed(sender.DeviceID, client.DeviceID) {
 			select {
 			case client.send <- message:
-				return true
+				return client
 			default:
-				continue
+				full = client
 			}
 		}
 	}
+	if full != nil {
+		h.drop(DropFullQueue, full, message)
+	} else {
+		h.drop(DropNoPeer, nil, message)
+	}
+	return nil
+}
+
+// route delivers message to the device to, or with to empty to any peer as
+// SendToPeer does. It reports whether a connection got it.
+func (h *Hub) route(sender *Client, to string, message []byte) bool {
+	return h.deliver(sender, to, message) != ""
+}
+
+// deliver is route returning the device that got message, or "".
+func (h *Hub) deliver(sender *Client, to string, message []byte) string {
+	if to == "" {
+		if client := h.sendToPeer(sender, message); client != nil {
+			return client.DeviceID
+		}
+		return ""
+	}
+	if h.SendToDevice(sender, to, message) != DeliveryDelivered {
+		return ""
+	}
+	return to
+}
+
+// candidates returns the clients to route among: the connections of device
+// to or, with to empty, every client. h.mu must be held.
+func (h *Hub) candidates(to string) map[*Client]bool {
+	if to == "" {
+		return h.clients
+	}
+	return h.devices[to]
+}
+
+// peerChunkSize returns the smallest MaxChunk among the clients sender may
+// relay to, limited to device to if it is set, or MaxChunkSize if any of
+// them has a send queue more than a quarter full.
+func (h *Hub) peerChunkSize(sender *Client, to string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	size := MaxNegotiatedChunkSize
+	for client := range h.candidates(to) {
+		if client == sender || !client.inRoom(sender) || !h.peerAllowed(sender.DeviceID, client.DeviceID) {
+			continue
+		}
+		if len(client.send) > cap(client.send)/4 {
+			return MaxChunkSize
+		}
+		size = min(size, client.MaxChunk)
+	}
+	return size
+}
+
+// SendToUser delivers message to every other connection of sender's user,
+// in any room, that the peer policy lets sender reach, and returns how many
+// got it.
+func (h *Hub) SendToUser(sender *Client, message []byte) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	n := 0
+	for client := range h.clients {
+		if client == sender || client.UserID != sender.UserID || !h.peerAllowed(sender.DeviceID, client.DeviceID) {
+			continue
+		}
+		select {
+		case client.send <- message:
+			n++
+		default:
+			h.drop(DropFullQueue, client, message)
+		}
+	}
+	return n
+}
+
+// Push delivers a server-originated message to every connection of
+// deviceID and returns the resulting Delivery* status.
+func (h *Hub) Push(deviceID string, message []byte) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	status := DeliveryOffline
+	for client := range h.devices[deviceID] {
+		select {
+		case client.send <- message:
+			status = DeliveryDelivered
+		default:
+			h.drop(DropFullQueue, client, message)
+			if status == DeliveryOffline {
+				status = DeliveryDropped
+			}
+		}
+	}
+	return status
+}
+
+// SendToDevice delivers message to every connection of deviceID in
+// sender's room other than sender and returns the resulting Delivery*
+// status.
+func (h *Hub) SendToDevice(sender *Client, deviceID string, message []byte) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if !h.peerAllowed(sender.DeviceID, deviceID) {
+		return DeliveryNotPermitted
+	}
+
+	status := DeliveryOffline
+	for client := range h.devices[deviceID] {
+		if client == sender || !client.inRoom(sender) {
+			continue
+		}
+		select {
+		case client.send <- message:
+			status = DeliveryDelivered
+		default:
+			h.drop(DropFullQueue, client, message)
+			if status == DeliveryOffline {
+				status = DeliveryDropped
+			}
+		}
+	}
+	return status
+}
+
+// sendCmdResult delivers a cmd_result from sender to the connection of
+// deviceID that is waiting on cmdID from sender's device.
+func (h *Hub) sendCmdResult(sender *Client, deviceID, cmdID string, message []byte) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients {
+		if client.DeviceID != deviceID || !client.inRoom(sender) || !client.takeCmd(cmdID, sender.DeviceID) {
+			continue
+		}
+		select {
+		case client.send <- message:
+			return true
+		default:
+			h.drop(DropFullQueue, client, message)
+			return false
+		}
+	}
 	return false
 }
 
-func (h *Hub) HasPeer(sender *Client) bool {
+// SetPaused pauses or resumes msgID on whichever other client is sending
+// it. It reports whether a sender was found.
+func (h *Hub) SetPaused(requester *Client, msgID string, paused bool) bool {
+	if msgID == "" {
+		return false
+	}
+
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
 	for client := range h.clients {
-		if client != sender {
+		if client != requester && client.inRoom(requester) &&
+			h.peerAllowed(requester.DeviceID, client.DeviceID) && client.setPaused(msgID, paused) {
 			return true
 		}
 	}
 	return false
 }
+
+// HasPeer reports whether sender has another connection it may relay to.
+func (h *Hub) HasPeer(sender *Client) bool {
+	ok, _ := h.peerState(sender, "")
+	return ok
+}
+
+// peerState reports whether sender has a peer it may relay to, limited to
+// device to if it is set, and if not, whether one is online but blocked by
+// the peer policy.
+func (h *Hub) peerState(sender *Client, to string) (reachable, blocked bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.candidates(to) {
+		if client == sender || !client.inRoom(sender) {
+			continue
+		}
+		if h.peerAllowed(sender.DeviceID, client.DeviceID) {
+			return true, false
+		}
+		blocked = true
+	}
+	return false, blocked
+}
@@ -0,0 +1,188 @@
+package realtime
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Key rotation for end-to-end encrypted group_msg envelopes. The server
+// never holds a key: it counts what each pair of devices exchanges and,
+// once the pair's key has been in use for long enough, sends both devices
+// key_rotate with a fresh key ID. Each answers with key_share carrying an
+// ephemeral public key for that ID, which the hub relays to the other.
+// Both derive the new key from their own ephemeral private key and the
+// peer's public key and then discard the private key, so a device that is
+// later compromised cannot recompute earlier keys. Envelopes name their key
+// in kid, so a receiver can still open those sealed just before a rotation.
+
+// KeyRotation is when the hub asks a pair of devices for a new key. A zero
+// field disables that trigger.
+type KeyRotation struct {
+	// Interval is the longest a pair key is used.
+	Interval time.Duration
+	// Bytes is the most envelope ciphertext a pair key seals.
+	Bytes int64
+}
+
+// DefaultKeyRotation rotates pair keys daily or every 64 MiB.
+var DefaultKeyRotation = KeyRotation{Interval: 24 * time.Hour, Bytes: 64 << 20}
+
+// Reasons carried by key_rotate.
+const (
+	KeyRotateSchedule = "schedule"
+	KeyRotateBytes    = "bytes"
+)
+
+const (
+	// MaxKeyIDLen bounds the kid of an envelope.
+	MaxKeyIDLen = 64
+	// MaxKeyShareLen bounds the public key in key_share.
+	MaxKeyShareLen = 512
+	// keyPairIdle is how long a pair may exchange nothing before the hub
+	// forgets it; its next envelope starts a new schedule.
+	keyPairIdle = 7 * 24 * time.Hour
+)
+
+// pairKeys is the rotation state of every pair that has exchanged an
+// envelope, keyed by pairID.
+type pairKeys struct {
+	mu       sync.Mutex
+	rotation KeyRotation
+	pairs    map[string]*pairKey
+}
+
+type pairKey struct {
+	keyID    string
+	since    time.Time
+	bytes    int64
+	lastUsed time.Time
+}
+
+// pairID is the same for both directions of a pair.
+func pairID(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "\x00" + b
+}
+
+// SetKeyRotation sets when device pairs are asked to rotate their key.
+func (h *Hub) SetKeyRotation(r KeyRotation) {
+	h.keys.mu.Lock()
+	defer h.keys.mu.Unlock()
+	h.keys.rotation = r
+}
+
+// countEnvelope records n bytes of ciphertext sealed for the pair a, b and,
+// when that makes the pair's key due, starts a rotation and returns the new
+// key ID and the reason. It returns an empty ID otherwise.
+func (h *Hub) countEnvelope(a, b string, n int, now time.Time) (keyID, reason string) {
+	h.keys.mu.Lock()
+	defer h.keys.mu.Unlock()
+
+	if h.keys.pairs == nil {
+		h.keys.pairs = make(map[string]*pairKey)
+	}
+	id := pairID(a, b)
+	p, ok := h.keys.pairs[id]
+	if !ok {
+		p = &pairKey{since: now}
+		h.keys.pairs[id] = p
+	}
+	p.bytes += int64(n)
+	p.lastUsed = now
+
+	r := h.keys.rotation
+	switch {
+	case r.Bytes > 0 && p.bytes >= r.Bytes:
+		reason = KeyRotateBytes
+	case r.Interval > 0 && now.Sub(p.since) >= r.Interval:
+		reason = KeyRotateSchedule
+	default:
+		return "", ""
+	}
+	p.keyID = newKeyID()
+	p.since = now
+	p.bytes = 0
+	return p.keyID, reason
+}
+
+// currentKeyID returns the key ID last announced to the pair a, b, or ""
+// if there has been no rotation.
+func (h *Hub) currentKeyID(a, b string) string {
+	h.keys.mu.Lock()
+	defer h.keys.mu.Unlock()
+	if p, ok := h.keys.pairs[pairID(a, b)]; ok {
+		return p.keyID
+	}
+	return ""
+}
+
+// pruneKeys forgets pairs idle for keyPairIdle.
+func (h *Hub) pruneKeys(now time.Time) {
+	h.keys.mu.Lock()
+	defer h.keys.mu.Unlock()
+	for id, p := range h.keys.pairs {
+		if now.Sub(p.lastUsed) >= keyPairIdle {
+			delete(h.keys.pairs, id)
+		}
+	}
+}
+
+func newKeyID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// rotateKey announces keyID to this client and to its peer device.
+func (c *Client) rotateKey(peer, keyID, reason string) {
+	mine, err := NewEvent(EventKeyRotate, KeyRotateValue{Peer: peer, KeyID: keyID, Reason: reason}).Marshal()
+	if err != nil {
+		return
+	}
+	theirs, err := NewEvent(EventKeyRotate, KeyRotateValue{Peer: c.DeviceID, KeyID: keyID, Reason: reason}).Marshal()
+	if err != nil {
+		return
+	}
+	c.Send(mine)
+	c.hub.SendToDevice(c, peer, theirs)
+}
+
+// handleKeyShare relays a key_share for the pair's current key ID. Shares
+// for an older rotation, or ones that cannot be delivered, are answered
+// with an error event so the client can wait for the next key_rotate.
+func (c *Client) handleKeyShare(data []byte) {
+	var msg struct {
+		V KeyShareValue `json:"v"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	share := msg.V
+
+	code := ""
+	switch {
+	case share.To == "" || share.To == c.DeviceID || share.Public == "" || len(share.Public) > MaxKeyShareLen:
+		code = "invalid_key_share"
+	case share.KeyID == "" || share.KeyID != c.hub.currentKeyID(c.DeviceID, share.To):
+		code = "stale_key_id"
+	default:
+		out, err := NewEvent(EventKeyShare, KeyShareDeliveryValue{From: c.DeviceID, KeyID: share.KeyID, Public: share.Public}).Marshal()
+		if err != nil {
+			return
+		}
+		if c.hub.SendToDevice(c, share.To, out) != DeliveryDelivered {
+			code = "key_share_undelivered"
+		}
+	}
+	if code == "" {
+		return
+	}
+	if out, err := NewEvent(EventError, ErrorValue{Code: code, KeyID: share.KeyID}).Marshal(); err == nil {
+		c.Send(out)
+	}
+}
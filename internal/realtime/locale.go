@@ -0,0 +1,36 @@
+package realtime
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// localeRe accepts BCP 47 tags such as en, pt-BR or zh-Hant-TW.
+	localeRe = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+	// timeZoneRe accepts IANA zone names such as UTC, Europe/Berlin or
+	// America/Argentina/Buenos_Aires, and Etc/GMT+5.
+	timeZoneRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+-]*(/[A-Za-z0-9_+-]+)*$`)
+)
+
+// NormalizeLocale returns the BCP 47 language tag s, or "" if it is not
+// one. An Accept-Language header may be passed; its first tag is used.
+func NormalizeLocale(s string) string {
+	s, _, _ = strings.Cut(s, ",")
+	s, _, _ = strings.Cut(s, ";")
+	s = strings.TrimSpace(s)
+	if len(s) > 35 || !localeRe.MatchString(s) {
+		return ""
+	}
+	return s
+}
+
+// NormalizeTimeZone returns the IANA time zone name s, or "" if it does
+// not look like one. Names are not resolved, so the server needs no zone
+// database.
+func NormalizeTimeZone(s string) string {
+	if len(s) > 64 || !timeZoneRe.MatchString(s) {
+		return ""
+	}
+	return s
+}
@@ -1,15 +1,28 @@
 package realtime
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/lixiansheng/fileflow/internal/cbor"
 )
 
 func TestHub(t *testing.T) {
@@ -152,12 +165,15 @@ func TestMessageForwarding(t *testing.T) {
 	// conn2 receives: p2 (self)
 	conn2.ReadMessage()
 
+	// A sender with a skewed clock: ts is relayed as sent, server_ts is the
+	// hub's own.
 	msgStart := Event{
 		Type:      EventMsgStart,
 		Value:     map[string]interface{}{"msgId": "test-msg-1"},
-		Timestamp: time.Now().UnixMilli(),
+		Timestamp: 1000,
 	}
 	data, _ := json.Marshal(msgStart)
+	before := time.Now().UnixMilli()
 	conn1.WriteMessage(websocket.TextMessage, data)
 
 	time.Sleep(50 * time.Millisecond)
@@ -174,6 +190,29 @@ func TestMessageForwarding(t *testing.T) {
 	if receivedEvent.Type != EventMsgStart {
 		t.Errorf("Expected msg_start, got %s", receivedEvent.Type)
 	}
+	if receivedEvent.Timestamp != 1000 || receivedEvent.ServerTS < before {
+		t.Errorf("Expected ts 1000 and a server_ts stamped by the hub, got %d / %d", receivedEvent.Timestamp, receivedEvent.ServerTS)
+	}
+}
+
+func TestStampServerTS(t *testing.T) {
+	for _, in := range []string{
+		`{"t":"ack","v":{"msgId":"m"},"ts":5}`,
+		`{"t":"ack","v":{"msgId":"m"},"ts":5,"server_ts":1}` + "\n",
+	} {
+		e, _ := ParseEvent([]byte(in))
+		out, err := stampServerTS(e, []byte(in), 42)
+		if err != nil {
+			t.Fatalf("stampServerTS(%s) failed: %v", in, err)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(out, &got); err != nil {
+			t.Fatalf("stampServerTS(%s) produced invalid JSON %s", in, out)
+		}
+		if got["server_ts"] != float64(42) || got["ts"] != float64(5) || bytes.Count(out, []byte("server_ts")) != 1 {
+			t.Errorf("stampServerTS(%s) = %s", in, out)
+		}
+	}
 }
 
 func TestSendFailWhenPeerOffline(t *testing.T) {
@@ -229,8 +268,31 @@ func TestSendFailWhenPeerOffline(t *testing.T) {
 	if valueMap["reason"] != "peer_offline" {
 		t.Errorf("Expected reason peer_offline, got %v", valueMap["reason"])
 	}
+
+	// With a waker that woke something, the sender is told when to retry.
+	var wokeFor string
+	hub.SetWaker(wakerFunc(func(deviceID string) time.Duration {
+		wokeFor = deviceID
+		return 30 * time.Second
+	}))
+	conn.WriteMessage(websocket.TextMessage, data)
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, received, err = conn.ReadMessage(); err != nil {
+		t.Fatalf("Failed to receive send_fail: %v", err)
+	}
+	var fail struct {
+		V SendFailValue `json:"v"`
+	}
+	json.Unmarshal(received, &fail)
+	if fail.V.Reason != "peer_waking" || fail.V.RetryAfter != 30000 || wokeFor != "device-solo" {
+		t.Errorf("Expected peer_waking with retry_after 30000 for device-solo, got %+v (woke %q)", fail.V, wokeFor)
+	}
 }
 
+type wakerFunc func(deviceID string) time.Duration
+
+func (f wakerFunc) WakePeers(deviceID string) time.Duration { return f(deviceID) }
+
 func TestAckForwarding(t *testing.T) {
 	hub := NewHub()
 	go hub.Run()
@@ -341,3 +403,2402 @@ func TestConcurrentClients(t *testing.T) {
 		}
 	}
 }
+
+func TestCBORSubprotocol(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: []string{SubprotocolCBOR, SubprotocolJSON}}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	cborDialer := websocket.Dialer{Subprotocols: []string{SubprotocolCBOR}}
+	sender, resp, err := cborDialer.Dial(wsURL+"?id=cbor", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect CBOR client: %v", err)
+	}
+	defer sender.Close()
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != SubprotocolCBOR {
+		t.Fatalf("Expected negotiated %q, got %q", SubprotocolCBOR, got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	receiver, _, err := websocket.DefaultDialer.Dial(wsURL+"?id=json", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect JSON client: %v", err)
+	}
+	defer receiver.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// sender: p1, p2 as binary CBOR frames
+	for i := 0; i < 2; i++ {
+		mt, msg, err := sender.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read presence: %v", err)
+		}
+		if mt != websocket.BinaryMessage {
+			t.Fatalf("Expected binary frame, got %d", mt)
+		}
+		v, err := cbor.Unmarshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to decode CBOR presence: %v", err)
+		}
+		if v.(map[string]interface{})["t"] != EventPresence {
+			t.Errorf("Expected presence event, got %#v", v)
+		}
+	}
+	receiver.ReadMessage()
+
+	frame, _ := cbor.Marshal(map[string]interface{}{
+		"t":  EventMsgStart,
+		"v":  map[string]interface{}{"msgId": "cbor-msg"},
+		"ts": time.Now().UnixMilli(),
+	})
+	sender.WriteMessage(websocket.BinaryMessage, frame)
+
+	receiver.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	mt, received, err := receiver.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to receive forwarded message: %v", err)
+	}
+	if mt != websocket.TextMessage {
+		t.Fatalf("Expected text frame for JSON client, got %d", mt)
+	}
+
+	var event Event
+	json.Unmarshal(received, &event)
+	if event.Type != EventMsgStart || event.GetMsgID() != "cbor-msg" {
+		t.Errorf("Unexpected forwarded event: %s", received)
+	}
+}
+
+// fillValue sets every field of the struct v points to, so a round trip
+// that drops or mangles any of them shows.
+func fillValue(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString("x" + strconv.Itoa(i))
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			f.SetInt(int64(1000 + i))
+		case reflect.Uint64:
+			f.SetUint(uint64(2000 + i))
+		case reflect.Map:
+			f.Set(reflect.ValueOf(map[string]string{"k": "v", "k2": ""}))
+		case reflect.Slice:
+			s := reflect.MakeSlice(f.Type(), 2, 2)
+			for j := 0; j < 2; j++ {
+				fillValue(s.Index(j))
+			}
+			f.Set(s)
+		}
+	}
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	// sameJSON compares two JSON documents by content.
+	sameJSON := func(a, b []byte) bool {
+		var x, y interface{}
+		return json.Unmarshal(a, &x) == nil && json.Unmarshal(b, &y) == nil && reflect.DeepEqual(x, y)
+	}
+
+	for _, registry := range []map[string]func() cborValue{sentValues, receivedValues} {
+		for eventType, newValue := range registry {
+			value := newValue()
+			fillValue(reflect.ValueOf(value).Elem())
+
+			// The generated codec on its own.
+			back := newValue()
+			d := cbor.NewDecoder(value.AppendCBOR(nil))
+			if err := back.UnmarshalCBOR(d); err != nil || !d.Done() || !reflect.DeepEqual(back, value) {
+				t.Errorf("%s: %T round trip = %+v, %v", eventType, value, back, err)
+			}
+		}
+	}
+
+	// What the server sends, every envelope field set.
+	for eventType, newValue := range sentValues {
+		value := newValue()
+		fillValue(reflect.ValueOf(value).Elem())
+		in, _ := json.Marshal(&Event{Type: eventType, Value: value, Timestamp: 1700000000001, ServerTS: 1700000000002, To: "device-b", Seq: 42})
+		frame, err := EncodeCBOR(in)
+		if err != nil {
+			t.Fatalf("%s: EncodeCBOR: %v", eventType, err)
+		}
+		wire, _ := cbor.Unmarshal(frame)
+		m, _ := wire.(map[string]interface{})
+		for _, key := range []string{"t", "v", "ts", "server_ts", "to", "seq"} {
+			if _, ok := m[key]; !ok {
+				t.Errorf("%s: CBOR frame lacks %q: %v", eventType, key, m)
+			}
+		}
+		if !bytes.Equal(cborItem(t, frame, "v"), value.AppendCBOR(nil)) {
+			t.Errorf("%s: value was not encoded by %T.AppendCBOR", eventType, value)
+		}
+		out, err := DecodeCBOR(frame)
+		if err != nil || !sameJSON(in, out) {
+			t.Errorf("%s: round trip\n got %s, %v\nwant %s", eventType, out, err, in)
+		}
+	}
+
+	// What clients send.
+	for eventType, newValue := range receivedValues {
+		value := newValue()
+		fillValue(reflect.ValueOf(value).Elem())
+		frame := cbor.AppendMapHeader(nil, 6)
+		frame = cbor.AppendString(cbor.AppendString(frame, "t"), eventType)
+		frame = value.AppendCBOR(cbor.AppendString(frame, "v"))
+		frame = cbor.AppendInt(cbor.AppendString(frame, "ts"), 1700000000001)
+		frame = cbor.AppendInt(cbor.AppendString(frame, "server_ts"), 1700000000002)
+		frame = cbor.AppendString(cbor.AppendString(frame, "to"), "device-b")
+		frame = cbor.AppendUint(cbor.AppendString(frame, "seq"), 42)
+		want, _ := json.Marshal(&Event{Type: eventType, Value: value, Timestamp: 1700000000001, ServerTS: 1700000000002, To: "device-b", Seq: 42})
+		out, err := DecodeCBOR(frame)
+		if err != nil || !sameJSON(want, out) {
+			t.Errorf("%s: DecodeCBOR\n got %s, %v\nwant %s", eventType, out, err, want)
+		}
+	}
+
+	// Frames off the schema take the generic path and arrive whole.
+	for _, in := range []string{
+		`{"t":"msg_start","v":{"msgId":"m1","future":[1,"two"]},"ts":5,"to":"device-b"}`,
+		`{"t":"para_chunk","v":{"msgId":"m1","i":1.5,"s":"x"},"ts":5}`,
+		`{"t":"msg_start","v":{"msgId":"m1"},"ts":5,"trace":"abc"}`,
+		`{"t":"settings_get","v":null,"ts":5}`,
+		`{"t":"new_event","v":{"a":[true,null]},"ts":5,"seq":3}`,
+	} {
+		var v interface{}
+		json.Unmarshal([]byte(in), &v)
+		out, err := DecodeCBOR(mustCBOR(t, v))
+		if err != nil || !sameJSON([]byte(in), out) {
+			t.Errorf("DecodeCBOR of %s = %s, %v", in, out, err)
+		}
+	}
+
+	// Sent frames carry what the structs define; an event they cannot
+	// hold at all is encoded whole.
+	for in, want := range map[string]string{
+		`{"t":"msg_start","v":{"msgId":"m1","future":[1,"two"]},"ts":5,"trace":"abc"}`: `{"t":"msg_start","v":{"msgId":"m1"},"ts":5}`,
+		`{"t":"para_chunk","v":{"msgId":"m1","i":1.5,"s":"x"},"ts":5}`:                 `{"t":"para_chunk","v":{"msgId":"m1","i":1.5,"s":"x"},"ts":5}`,
+		`{"t":"new_event","v":{"a":[true,null]},"ts":5,"seq":3}`:                       `{"t":"new_event","v":{"a":[true,null]},"ts":5,"seq":3}`,
+	} {
+		frame, err := EncodeCBOR([]byte(in))
+		if err != nil {
+			t.Fatalf("EncodeCBOR(%s): %v", in, err)
+		}
+		out, err := DecodeCBOR(frame)
+		if err != nil || !sameJSON([]byte(want), out) {
+			t.Errorf("EncodeCBOR of %s = %s, %v; want %s", in, out, err, want)
+		}
+	}
+
+	for _, bad := range []interface{}{
+		[]interface{}{"t"},
+		map[string]interface{}{"v": 1},
+		map[string]interface{}{"t": 7},
+	} {
+		frame, _ := cbor.Marshal(bad)
+		if _, err := DecodeCBOR(frame); err == nil {
+			t.Errorf("DecodeCBOR(%v) succeeded", bad)
+		}
+	}
+	if _, err := DecodeCBOR(append(mustCBOR(t, map[string]interface{}{"t": "ack"}), 0x01)); !errors.Is(err, cbor.ErrTrailingData) {
+		t.Errorf("trailing data: err = %v", err)
+	}
+}
+
+// cborItem returns the encoded value of key in the CBOR map frame.
+func cborItem(t *testing.T, frame []byte, key string) []byte {
+	t.Helper()
+	d := cbor.NewDecoder(frame)
+	n, err := d.MapLen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		k, err := d.String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := d.Raw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k == key {
+			return v
+		}
+	}
+	return nil
+}
+
+func mustCBOR(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := cbor.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestOversizedFrames(t *testing.T) {
+	const limit = 1024
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, limit)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	sender, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=1", nil)
+	defer sender.Close()
+	time.Sleep(50 * time.Millisecond)
+	receiver, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=2", nil)
+	defer receiver.Close()
+	time.Sleep(100 * time.Millisecond)
+	readEvents(t, sender, 2)
+	readEvents(t, receiver, 1)
+
+	// Over the limit but under the read limit: dropped, connection kept.
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"t":"ack","v":{"msgId":"`+strings.Repeat("x", 2*limit)+`"}}`))
+	events := readUntil(t, sender, EventError)
+	if v, _ := events[len(events)-1].Value.(map[string]interface{}); v["code"] != "frame_too_large" || v["limit"] != float64(limit) {
+		t.Errorf("error event = %v", events[len(events)-1].Value)
+	}
+	if got := hub.OversizedFrames(); got != 1 {
+		t.Errorf("OversizedFrames = %d after a dropped frame, want 1", got)
+	}
+	data, _ := NewEvent(EventAck, AckValue{MsgID: "after"}).Marshal()
+	sender.WriteMessage(websocket.TextMessage, data)
+	if events := readUntil(t, receiver, EventAck); events[len(events)-1].GetMsgID() != "after" {
+		t.Errorf("ack after oversized frame = %v", events[len(events)-1].Value)
+	}
+
+	// Over the read limit: closed from the frame header.
+	sender.WriteMessage(websocket.BinaryMessage, make([]byte, hardLimitFactor*limit+1))
+	sender.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := sender.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("read after huge frame: %v, want close 1009", err)
+			}
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := hub.OversizedFrames(); got != 2 {
+		t.Errorf("OversizedFrames = %d, want 2", got)
+	}
+}
+
+func TestAtomicCommit(t *testing.T) {
+	chunks := []string{"hello ", "world"}
+	good := sha256.Sum256([]byte(strings.Join(chunks, "")))
+
+	tests := []struct {
+		name         string
+		sum          string
+		wantReceiver string
+		wantSender   string
+	}{
+		{"ValidChecksumCommits", hex.EncodeToString(good[:]), EventMsgCommit, EventMsgCommit},
+		{"BadChecksumAborts", strings.Repeat("0", 64), EventMsgAbort, EventSendFail},
+		{"MissingChecksumAborts", "", EventMsgAbort, EventSendFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			go hub.Run()
+			defer hub.Stop()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upgrader := websocket.Upgrader{}
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+
+				client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+				hub.Register(client)
+				go client.WritePump()
+				client.ReadPump()
+			}))
+			defer server.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+			sender, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=1", nil)
+			defer sender.Close()
+			time.Sleep(50 * time.Millisecond)
+			receiver, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=2", nil)
+			defer receiver.Close()
+			time.Sleep(100 * time.Millisecond)
+
+			readEvents(t, sender, 2)
+			readEvents(t, receiver, 1)
+
+			send := func(typ string, v map[string]interface{}) {
+				data, _ := NewEvent(typ, v).Marshal()
+				sender.WriteMessage(websocket.TextMessage, data)
+			}
+			send(EventMsgStart, map[string]interface{}{"msgId": "atomic-1", "atomic": true})
+			send(EventParaStart, map[string]interface{}{"msgId": "atomic-1", "i": 0})
+			for _, c := range chunks {
+				send(EventParaChunk, map[string]interface{}{"msgId": "atomic-1", "i": 0, "s": c})
+			}
+			send(EventParaEnd, map[string]interface{}{"msgId": "atomic-1", "i": 0})
+			send(EventMsgEnd, map[string]interface{}{"msgId": "atomic-1", "sha256": tt.sum})
+
+			got := readUntil(t, receiver, EventMsgCommit, EventMsgAbort)
+			last := got[len(got)-1]
+			if last.Type != tt.wantReceiver || last.GetMsgID() != "atomic-1" {
+				t.Errorf("Receiver: expected %s, got %s", tt.wantReceiver, last.Type)
+			}
+			if last.Type == EventMsgCommit && got[len(got)-2].Type != EventMsgEnd {
+				t.Errorf("Expected msg_end before msg_commit, got %s", got[len(got)-2].Type)
+			}
+
+			got = readUntil(t, sender, EventMsgCommit, EventSendFail)
+			if outcome := got[len(got)-1]; outcome.Type != tt.wantSender {
+				t.Errorf("Sender: expected %s, got %s", tt.wantSender, outcome.Type)
+			}
+		})
+	}
+}
+
+// readEvents reads at least n events from conn, splitting newline-batched
+// frames.
+func readEvents(t *testing.T, conn *websocket.Conn, n int) []*Event {
+	t.Helper()
+	var events []*Event
+	for len(events) < n {
+		events = append(events, readFrame(t, conn)...)
+	}
+	return events
+}
+
+// readUntil reads events from conn until one of the given types arrives.
+func readUntil(t *testing.T, conn *websocket.Conn, types ...string) []*Event {
+	t.Helper()
+	var events []*Event
+	for {
+		for _, e := range readFrame(t, conn) {
+			events = append(events, e)
+			for _, typ := range types {
+				if e.Type == typ {
+					return events
+				}
+			}
+		}
+	}
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) []*Event {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	var events []*Event
+	for _, line := range strings.Split(string(data), "\n") {
+		e, err := ParseEvent([]byte(line))
+		if err != nil {
+			t.Fatalf("Failed to parse event: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestFileTransfer(t *testing.T) {
+	frame, _ := EncodeFileChunk("f1", 4096, []byte("data"))
+	if msgID, off, payload, err := ParseFileChunk(frame); err != nil || msgID != "f1" || off != 4096 || string(payload) != "data" {
+		t.Fatalf("ParseFileChunk = %q, %d, %q, %v", msgID, off, payload, err)
+	}
+	for _, bad := range [][]byte{nil, {FileChunkMagic}, {FileChunkMagic, 0, 0, 0, 0, 0, 0, 0, 0, 0}, frame[:6], []byte(`{"t":"ack"}`)} {
+		if _, _, _, err := ParseFileChunk(bad); err == nil {
+			t.Errorf("ParseFileChunk(%x) accepted", bad)
+		}
+	}
+
+	for _, tt := range []struct {
+		v    FileStartValue
+		want bool
+	}{
+		{FileStartValue{MsgID: "f", Name: "photo.png", Size: 10, Type: "image/png"}, true},
+		{FileStartValue{MsgID: "f", Name: "empty.txt"}, true},
+		{FileStartValue{MsgID: "f", Name: "../passwd", Size: 1}, false},
+		{FileStartValue{MsgID: "f", Name: "a\x00b", Size: 1}, false},
+		{FileStartValue{MsgID: "f", Name: "big.iso", Size: MaxFileSize + 1}, false},
+		{FileStartValue{MsgID: "f", Name: "x", Size: 1, Type: "text/html; charset=utf-8"}, false},
+	} {
+		if got := validFileStart(tt.v); got != tt.want {
+			t.Errorf("validFileStart(%+v) = %v", tt.v, got)
+		}
+	}
+
+	content := []byte("hello, binary world")
+	sum := sha256.Sum256(content)
+
+	// Each chunk is an offset and the content bytes it carries.
+	type chunk struct {
+		off    int64
+		lo, hi int
+	}
+	whole := []chunk{{0, 0, 8}, {8, 8, len(content)}}
+	tests := []struct {
+		name         string
+		chunks       []chunk
+		sum          string
+		wantReceiver string
+		wantSender   string
+	}{
+		{"Commits", whole, hex.EncodeToString(sum[:]), EventMsgCommit, EventMsgCommit},
+		{"CommitsWithoutChecksum", whole, "", EventMsgCommit, EventMsgCommit},
+		{"BadChecksumAborts", whole, strings.Repeat("0", 64), EventMsgAbort, EventSendFail},
+		{"GapAborts", []chunk{{0, 0, 8}, {9, 9, len(content)}}, "", EventMsgAbort, EventSendFail},
+		{"ShortFileAborts", whole[:1], "", EventMsgAbort, EventSendFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			go hub.Run()
+			defer hub.Stop()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+				hub.Register(client)
+				go client.WritePump()
+				client.ReadPump()
+			}))
+			defer server.Close()
+
+			wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+			sender, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=1", nil)
+			defer sender.Close()
+			time.Sleep(50 * time.Millisecond)
+			receiver, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=2", nil)
+			defer receiver.Close()
+			time.Sleep(100 * time.Millisecond)
+			readEvents(t, sender, 2)
+			readEvents(t, receiver, 1)
+
+			data, _ := NewEvent(EventFileStart, FileStartValue{MsgID: "f1", Name: "hello.txt", Size: int64(len(content)), Type: "text/plain"}).Marshal()
+			sender.WriteMessage(websocket.TextMessage, data)
+			if got := readUntil(t, sender, EventMsgParams); got[len(got)-1].GetMsgID() != "f1" {
+				t.Fatalf("msg_params for %q", got[len(got)-1].GetMsgID())
+			}
+			for _, c := range tt.chunks {
+				frame, _ := EncodeFileChunk("f1", c.off, content[c.lo:c.hi])
+				sender.WriteMessage(websocket.BinaryMessage, frame)
+			}
+			data, _ = NewEvent(EventFileEnd, FileEndValue{MsgID: "f1", SHA256: tt.sum}).Marshal()
+			sender.WriteMessage(websocket.TextMessage, data)
+
+			// The receiver sees file_start, the chunks as binary frames,
+			// then the outcome.
+			var got []byte
+			var types []string
+			for last := ""; last != EventMsgCommit && last != EventMsgAbort; {
+				receiver.SetReadDeadline(time.Now().Add(time.Second))
+				mt, msg, err := receiver.ReadMessage()
+				if err != nil {
+					t.Fatalf("receiver: %v (saw %v)", err, types)
+				}
+				if mt == websocket.BinaryMessage {
+					_, _, payload, err := ParseFileChunk(msg)
+					if err != nil {
+						t.Fatalf("receiver got a bad chunk: %v", err)
+					}
+					got = append(got, payload...)
+					continue
+				}
+				for _, line := range strings.Split(string(msg), "\n") {
+					e, _ := ParseEvent([]byte(line))
+					types = append(types, e.Type)
+					last = e.Type
+				}
+			}
+			if types[0] != EventFileStart || types[len(types)-1] != tt.wantReceiver {
+				t.Errorf("receiver events = %v, want file_start ... %s", types, tt.wantReceiver)
+			}
+			if tt.wantReceiver == EventMsgCommit && string(got) != string(content) {
+				t.Errorf("receiver file = %q", got)
+			}
+
+			out := readUntil(t, sender, EventMsgCommit, EventSendFail)
+			if last := out[len(out)-1]; last.Type != tt.wantSender {
+				t.Errorf("sender outcome = %s, want %s", last.Type, tt.wantSender)
+			}
+		})
+	}
+}
+
+// readTransfer reads from conn until an event of one of types arrives,
+// returning it and the file chunk payloads received on the way.
+func readTransfer(t *testing.T, conn *websocket.Conn, types ...string) (*Event, []byte) {
+	t.Helper()
+	var payload []byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Waiting for %v: %v", types, err)
+		}
+		if mt == websocket.BinaryMessage {
+			_, _, p, err := ParseFileChunk(msg)
+			if err != nil {
+				t.Fatalf("Bad chunk: %v", err)
+			}
+			payload = append(payload, p...)
+			continue
+		}
+		for _, line := range strings.Split(string(msg), "\n") {
+			e, _ := ParseEvent([]byte(line))
+			if slices.Contains(types, e.Type) {
+				return e, payload
+			}
+		}
+	}
+}
+
+func TestResumeTransfer(t *testing.T) {
+	t.Run("SenderGone", func(t *testing.T) {
+		// The forwarded resume_request must not reach a sender the hub
+		// unregistered (and closed) after claimTransfer found it.
+		hub := NewHub()
+		sender := &Client{hub: hub, send: make(chan []byte, 1), DeviceID: "device-a", Log: slog.New(slog.NewJSONHandler(io.Discard, nil))}
+		hub.mu.Lock()
+		hub.clients[sender] = true
+		hub.mu.Unlock()
+		msg := []byte(`{"t":"resume_request"}`)
+		if !hub.sendToClient(sender, msg) || !hub.sendToClient(sender, msg) {
+			t.Fatal("registered sender reported gone")
+		}
+
+		hub.mu.Lock()
+		delete(hub.clients, sender)
+		sender.closeSend()
+		hub.mu.Unlock()
+		if hub.sendToClient(sender, msg) {
+			t.Error("unregistered sender reported present")
+		}
+		if got := hub.Drops(); got != (DropStats{FullQueue: 1, NoPeer: 1}) {
+			t.Errorf("drops = %+v", got)
+		}
+	})
+
+	t.Run("Rewind", func(t *testing.T) {
+		s := &MessageState{sum: sha256.New(), File: true, FileSize: 1 << 20}
+		s.markResumePoint()
+		for i := 0; i < 2*maxResumePoints; i++ {
+			s.sum.Write([]byte("0123456789"))
+			s.FileReceived += 10
+			s.markResumePoint()
+		}
+		if len(s.resumePoints) != maxResumePoints || s.resumePoints[0].offset != 0 {
+			t.Fatalf("kept %d points starting at %d", len(s.resumePoints), s.resumePoints[0].offset)
+		}
+		if s.rewind(15) || s.rewind(10) {
+			t.Error("rewound to an offset that is not a kept boundary")
+		}
+		if !s.rewind(s.FileReceived-20) || s.FileReceived != 2*maxResumePoints*10-20 {
+			t.Fatalf("rewind to a recent boundary: at %d", s.FileReceived)
+		}
+		s.sum.Write([]byte("0123456789"))
+		want := sha256.Sum256([]byte(strings.Repeat("0123456789", 2*maxResumePoints-1)))
+		if got := s.sum.Sum(nil); string(got) != string(want[:]) {
+			t.Error("checksum not restored by rewind")
+		}
+		if !s.rewind(0) || s.FileReceived != 0 {
+			t.Error("cannot start over")
+		}
+	})
+
+	content := []byte("0123456789abcdefghij")
+	sum := sha256.Sum256(content)
+
+	setup := func(t *testing.T) (*Hub, func(string) *websocket.Conn) {
+		hub := NewHub()
+		go hub.Run()
+		t.Cleanup(hub.Stop)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+			hub.Register(client)
+			go client.WritePump()
+			client.ReadPump()
+		}))
+		t.Cleanup(server.Close)
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+		return hub, func(id string) *websocket.Conn {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?id="+id, nil)
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			time.Sleep(50 * time.Millisecond)
+			return conn
+		}
+	}
+	write := func(conn *websocket.Conn, typ string, v interface{}) {
+		data, _ := NewEvent(typ, v).Marshal()
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+	chunk := func(conn *websocket.Conn, lo, hi int) {
+		frame, _ := EncodeFileChunk("f1", int64(lo), content[lo:hi])
+		conn.WriteMessage(websocket.BinaryMessage, frame)
+	}
+	start := func(sender, receiver *websocket.Conn) {
+		write(sender, EventFileStart, FileStartValue{MsgID: "f1", Name: "f.txt", Size: int64(len(content))})
+		readTransfer(t, sender, EventMsgParams)
+		chunk(sender, 0, 8)
+		if _, got := readTransfer(t, receiver, EventFileStart); len(got) != 0 {
+			t.Fatalf("chunk before file_start")
+		}
+	}
+	// finish resumes at offset 8 and checks the receiver ends up with the
+	// whole file.
+	finish := func(sender, receiver *websocket.Conn) {
+		write(receiver, EventResumeRequest, ResumeValue{MsgID: "f1", Offset: 8})
+		req, _ := readTransfer(t, sender, EventResumeRequest)
+		raw, _ := json.Marshal(req.Value)
+		var v ResumeValue
+		json.Unmarshal(raw, &v)
+		if v != (ResumeValue{MsgID: "f1", Offset: 8}) {
+			t.Fatalf("forwarded resume_request = %+v", v)
+		}
+		write(sender, EventResumeOK, v)
+		readTransfer(t, receiver, EventResumeOK)
+		chunk(sender, 8, 14)
+		chunk(sender, 14, len(content))
+		write(sender, EventFileEnd, FileEndValue{MsgID: "f1", SHA256: hex.EncodeToString(sum[:])})
+		if _, got := readTransfer(t, receiver, EventMsgCommit); string(got) != string(content[8:]) {
+			t.Errorf("received after resume = %q", got)
+		}
+		readTransfer(t, sender, EventMsgCommit)
+	}
+
+	t.Run("ReceiverReconnects", func(t *testing.T) {
+		_, dial := setup(t)
+		sender := dial("a")
+		receiver := dial("b")
+		start(sender, receiver)
+		time.Sleep(50 * time.Millisecond)
+		receiver.Close()
+		time.Sleep(100 * time.Millisecond)
+
+		chunk(sender, 8, 14)
+		if e, _ := readTransfer(t, sender, EventPause, EventSendFail); e.Type != EventPause {
+			t.Fatalf("sender got %s, want pause", e.Type)
+		}
+		chunk(sender, 14, 20) // discarded while suspended
+
+		receiver = dial("b")
+		finish(sender, receiver)
+	})
+
+	t.Run("SenderReconnects", func(t *testing.T) {
+		_, dial := setup(t)
+		sender := dial("a")
+		receiver := dial("b")
+		start(sender, receiver)
+		sender.Close()
+		time.Sleep(100 * time.Millisecond)
+
+		write(receiver, EventResumeRequest, ResumeValue{MsgID: "f1", Offset: 8})
+		if e, _ := readTransfer(t, receiver, EventError); e.Value.(map[string]interface{})["code"] != "sender_offline" {
+			t.Errorf("resume while sender offline: %v", e.Value)
+		}
+		sender = dial("a")
+		write(receiver, EventResumeRequest, ResumeValue{MsgID: "f1", Offset: 5})
+		if e, _ := readTransfer(t, receiver, EventError); e.Value.(map[string]interface{})["code"] != "bad_offset" {
+			t.Errorf("resume at a non-boundary: %v", e.Value)
+		}
+		finish(sender, receiver)
+	})
+
+	t.Run("Expires", func(t *testing.T) {
+		hub, dial := setup(t)
+		sender := dial("a")
+		receiver := dial("b")
+		start(sender, receiver)
+		sender.Close()
+		time.Sleep(100 * time.Millisecond)
+
+		hub.expireTransfers(time.Now().Add(ResumeTTL))
+		if e, _ := readTransfer(t, receiver, EventMsgAbort); e.Value.(map[string]interface{})["reason"] != "resume_expired" {
+			t.Errorf("abort = %v", e.Value)
+		}
+		write(receiver, EventResumeRequest, ResumeValue{MsgID: "f1", Offset: 8})
+		if e, _ := readTransfer(t, receiver, EventError); e.Value.(map[string]interface{})["code"] != "unknown_transfer" {
+			t.Errorf("resume after expiry: %v", e.Value)
+		}
+	})
+}
+
+func TestGroupMessageFanOut(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conns := make(map[string]*websocket.Conn)
+	for _, id := range []string{"a", "b", "c"} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?id="+id, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect %s: %v", id, err)
+		}
+		defer conn.Close()
+		conns[id] = conn
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	readEvents(t, conns["a"], 3)
+	readEvents(t, conns["b"], 2)
+	readEvents(t, conns["c"], 1)
+
+	data, _ := NewEvent(EventGroupMsg, GroupMsgValue{
+		MsgID: "group-1",
+		Envelopes: []GroupEnvelope{
+			{To: "device-b", Ciphertext: "ct-for-b"},
+			{To: "device-c", Ciphertext: "ct-for-c"},
+			{To: "device-missing", Ciphertext: "ct-for-missing"},
+			{To: "device-a", Ciphertext: "ct-for-self"},
+		},
+	}).Marshal()
+	conns["a"].WriteMessage(websocket.TextMessage, data)
+
+	for _, id := range []string{"b", "c"} {
+		got := readUntil(t, conns[id], EventGroupMsg)
+		v := got[len(got)-1].Value.(map[string]interface{})
+		if v["ct"] != "ct-for-"+id || v["from"] != "device-a" || v["msgId"] != "group-1" {
+			t.Errorf("Recipient %s got unexpected envelope: %#v", id, v)
+		}
+	}
+
+	got := readUntil(t, conns["a"], EventGroupStatus)
+	raw, _ := json.Marshal(got[len(got)-1].Value)
+	var status GroupStatusValue
+	json.Unmarshal(raw, &status)
+
+	want := map[string]string{
+		"device-b":       DeliveryDelivered,
+		"device-c":       DeliveryDelivered,
+		"device-missing": DeliveryOffline,
+		"device-a":       DeliveryInvalid,
+	}
+	if len(status.Results) != len(want) {
+		t.Fatalf("Expected %d results, got %+v", len(want), status.Results)
+	}
+	for _, r := range status.Results {
+		if want[r.To] != r.Status {
+			t.Errorf("Recipient %s: expected %s, got %s", r.To, want[r.To], r.Status)
+		}
+	}
+}
+
+func TestTargetedRouting(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conns := make(map[string]*websocket.Conn)
+	for _, id := range []string{"a", "b", "c"} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?id="+id, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect %s: %v", id, err)
+		}
+		defer conn.Close()
+		conns[id] = conn
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	readEvents(t, conns["a"], 3)
+	readEvents(t, conns["b"], 2)
+	readEvents(t, conns["c"], 1)
+
+	send := func(typ, to string, v interface{}) {
+		data, _ := json.Marshal(Event{Type: typ, Value: v, Timestamp: time.Now().UnixMilli(), To: to})
+		conns["a"].WriteMessage(websocket.TextMessage, data)
+	}
+
+	// Every event of a message addressed to device-c reaches device-c, even
+	// with device-b connected first.
+	send(EventMsgStart, "device-c", MsgStartValue{MsgID: "to-c", Atomic: true})
+	send(EventParaStart, "", map[string]interface{}{"msgId": "to-c", "i": 0})
+	send(EventParaChunk, "", ParaChunkValue{MsgID: "to-c", Index: 0, Text: "hi"})
+	send(EventParaEnd, "", map[string]interface{}{"msgId": "to-c", "i": 0})
+	sum := sha256.Sum256([]byte("hi"))
+	send(EventMsgEnd, "", map[string]interface{}{"msgId": "to-c", "sha256": hex.EncodeToString(sum[:])})
+
+	var types []string
+	for _, e := range readUntil(t, conns["c"], EventMsgCommit) {
+		types = append(types, e.Type)
+	}
+	want := []string{EventMsgStart, EventParaStart, EventParaChunk, EventParaEnd, EventMsgEnd, EventMsgCommit}
+	if !slices.Equal(types, want) {
+		t.Errorf("device-c got %v, want %v", types, want)
+	}
+	readUntil(t, conns["a"], EventMsgCommit)
+
+	conns["b"].SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, data, err := conns["b"].ReadMessage(); err == nil {
+		t.Errorf("device-b received %s", data)
+	}
+
+	// A message to no one online, or to the sender itself, fails at once.
+	for to, reason := range map[string]string{"device-missing": "peer_offline", "device-a": "invalid_recipient"} {
+		send(EventMsgStart, to, MsgStartValue{MsgID: "to-" + to})
+		got := readUntil(t, conns["a"], EventSendFail)
+		v := got[len(got)-1].Value.(map[string]interface{})
+		if v["msgId"] != "to-"+to || v["reason"] != reason {
+			t.Errorf("msg_start to %s: got %v, want %s", to, v, reason)
+		}
+	}
+}
+
+// memReceipts records receipts in order, naming each by its position.
+type memReceipts struct {
+	mu       sync.Mutex
+	receipts []Receipt
+}
+
+func (m *memReceipts) RecordReceipt(r Receipt) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.receipts = append(m.receipts, r)
+	return "r" + strconv.Itoa(len(m.receipts)), nil
+}
+
+func TestReceipts(t *testing.T) {
+	hub := NewHub()
+	receipts := &memReceipts{}
+	hub.SetReceiptRecorder(receipts)
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		client.UserID = "user-1"
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	a, _, err := websocket.DefaultDialer.Dial(wsURL+"?id=a", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect a: %v", err)
+	}
+	defer a.Close()
+	time.Sleep(50 * time.Millisecond)
+	b, _, err := websocket.DefaultDialer.Dial(wsURL+"?id=b", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect b: %v", err)
+	}
+	defer b.Close()
+	time.Sleep(50 * time.Millisecond)
+	readEvents(t, a, 2)
+	readEvents(t, b, 1)
+
+	send := func(typ string, v interface{}) {
+		data, _ := json.Marshal(Event{Type: typ, Value: v, Timestamp: time.Now().UnixMilli()})
+		a.WriteMessage(websocket.TextMessage, data)
+	}
+	send(EventMsgStart, MsgStartValue{MsgID: "m1", Atomic: true})
+	send(EventParaStart, map[string]interface{}{"msgId": "m1", "i": 0})
+	send(EventParaChunk, ParaChunkValue{MsgID: "m1", Index: 0, Text: "hello "})
+	send(EventParaChunk, ParaChunkValue{MsgID: "m1", Index: 0, Text: "world"})
+	send(EventParaEnd, map[string]interface{}{"msgId": "m1", "i": 0})
+	sum := sha256.Sum256([]byte("hello world"))
+	send(EventMsgEnd, map[string]interface{}{"msgId": "m1", "sha256": hex.EncodeToString(sum[:])})
+
+	got := readUntil(t, b, EventMsgCommit)
+	v := got[len(got)-1].Value.(map[string]interface{})
+	if v["receipt"] != "r1" {
+		t.Errorf("msg_commit = %v, want receipt r1", v)
+	}
+	readUntil(t, a, EventMsgCommit)
+
+	receipts.mu.Lock()
+	defer receipts.mu.Unlock()
+	if len(receipts.receipts) != 1 {
+		t.Fatalf("recorded %d receipts, want 1", len(receipts.receipts))
+	}
+	r := receipts.receipts[0]
+	if r.UserID != "user-1" || r.MsgID != "m1" || r.From != "device-a" || r.To != "device-b" ||
+		r.Chunks != 2 || r.Bytes != 11 || r.SHA256 != hex.EncodeToString(sum[:]) || r.File {
+		t.Errorf("receipt = %+v", r)
+	}
+	if r.StartedAt.IsZero() || r.CommittedAt.Before(r.StartedAt) {
+		t.Errorf("receipt times %v to %v", r.StartedAt, r.CommittedAt)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	t.Run("Stamp", func(t *testing.T) {
+		for in, want := range map[string]string{
+			`{"t":"ack","v":{}}`:           `{"t":"ack","v":{},"seq":7}`,
+			" {\"t\":\"ack\",\"seq\":1}\n": `{"t":"ack","seq":1,"seq":7}`,
+			`{}`:                           `{"seq":7}`,
+			`not json`:                     ``,
+		} {
+			if got := string(stampSeq([]byte(in), 7)); got != want {
+				t.Errorf("stampSeq(%q) = %q, want %q", in, got, want)
+			}
+		}
+		if e, err := ParseEvent([]byte(`{"t":"ack","seq":1,"seq":7}`)); err != nil || e.Seq != 7 {
+			t.Errorf("stamped seq should win, got %+v, %v", e, err)
+		}
+
+		var l replayLog
+		for i := 0; i < maxReplayEvents+10; i++ {
+			l.stamp([]byte(`{"t":"ack"}`))
+		}
+		if len(l.events) != maxReplayEvents || l.events[0].seq != 10 || l.next != maxReplayEvents+10 {
+			t.Errorf("kept %d events from %d, next %d", len(l.events), l.events[0].seq, l.next)
+		}
+	})
+
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		q := r.URL.Query()
+		client := NewClient(hub, conn, "device-"+q.Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		client.ResumeToken = q.Get("resume")
+		client.ResumeSeq, _ = strconv.ParseUint(q.Get("last_seq"), 10, 64)
+		hub.Attach(client)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(query string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?"+query, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect %s: %v", query, err)
+		}
+		return conn
+	}
+	// connected reads conn up to its connected event, returning the events
+	// before it too.
+	connected := func(conn *websocket.Conn) ([]*Event, ConnectedValue, uint64) {
+		t.Helper()
+		events := readUntil(t, conn, EventConnected)
+		last := events[len(events)-1]
+		var v ConnectedValue
+		b, _ := json.Marshal(last.Value)
+		json.Unmarshal(b, &v)
+		return events[:len(events)-1], v, last.Seq
+	}
+
+	b := dial("id=b")
+	_, first, seq := connected(b)
+	if first.ResumeToken == "" || first.Resumed || seq != 1 {
+		t.Fatalf("first connected = %+v, seq %d", first, seq)
+	}
+	a := dial("id=a")
+	defer a.Close()
+	connected(a)
+
+	send := func(typ string, v interface{}) {
+		data, _ := json.Marshal(Event{Type: typ, Value: v, Timestamp: time.Now().UnixMilli()})
+		a.WriteMessage(websocket.TextMessage, data)
+	}
+	send(EventMsgStart, MsgStartValue{MsgID: "m1"})
+	got := readUntil(t, b, EventMsgStart)
+	last := got[len(got)-1].Seq
+	send(EventParaStart, map[string]interface{}{"msgId": "m1", "i": 0})
+	time.Sleep(50 * time.Millisecond)
+
+	// b drops without a close frame, and whatever it had not read is lost.
+	b.UnderlyingConn().Close()
+	time.Sleep(100 * time.Millisecond)
+
+	b2 := dial("id=b&resume=" + first.ResumeToken + "&last_seq=" + strconv.FormatUint(last, 10))
+	defer b2.Close()
+	replayed, second, seq := connected(b2)
+	if !second.Resumed || second.Replayed != 1 || second.ResumeToken == first.ResumeToken {
+		t.Fatalf("resumed connected = %+v", second)
+	}
+	if len(replayed) != 1 || replayed[0].Type != EventParaStart || replayed[0].Seq != last+1 || seq != last+2 {
+		t.Errorf("replayed %+v then connected seq %d, want para_start %d", replayed, seq, last+1)
+	}
+
+	// A token works once, and only for the device it was issued to.
+	for _, query := range []string{
+		"id=b&resume=" + first.ResumeToken + "&last_seq=1",
+		"id=a&resume=" + second.ResumeToken + "&last_seq=" + strconv.FormatUint(seq, 10),
+	} {
+		conn := dial(query)
+		if _, v, seq := connected(conn); v.Resumed || seq != 1 {
+			t.Errorf("%s: connected = %+v, seq %d", query, v, seq)
+		}
+		conn.Close()
+	}
+
+	// Reconnecting before the server noticed the drop closes the old
+	// connection and resumes from it.
+	b3 := dial("id=b&resume=" + second.ResumeToken + "&last_seq=" + strconv.FormatUint(seq, 10))
+	defer b3.Close()
+	_, third, _ := connected(b3)
+	if !third.Resumed {
+		t.Errorf("resume over a live connection: %+v", third)
+	}
+	b2.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := b2.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	// A last_seq the connection never reached is refused.
+	b3.UnderlyingConn().Close()
+	time.Sleep(100 * time.Millisecond)
+	hub.mu.RLock()
+	parked := len(hub.replays)
+	hub.mu.RUnlock()
+	if parked == 0 {
+		t.Fatal("dropped connection was not parked")
+	}
+	b4 := dial("id=b&resume=" + third.ResumeToken + "&last_seq=1000000")
+	defer b4.Close()
+	if _, v, _ := connected(b4); v.Resumed {
+		t.Errorf("resumed past the last event: %+v", v)
+	}
+}
+
+type fakeReconnector struct{ issued chan string }
+
+func (f fakeReconnector) ReconnectToken(deviceID, sessionID string, readOnly bool) string {
+	f.issued <- deviceID + "/" + sessionID
+	return "ffrc_" + deviceID
+}
+
+func TestReconnectClose(t *testing.T) {
+	hub := NewHub()
+	rec := fakeReconnector{issued: make(chan string, 4)}
+	hub.SetReconnector(rec)
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		q := r.URL.Query()
+		client := NewClient(hub, conn, "device-"+q.Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		client.SessionID = "sess-" + q.Get("id")
+		client.ResumeToken = q.Get("resume")
+		client.ResumeSeq, _ = strconv.ParseUint(q.Get("last_seq"), 10, 64)
+		hub.Attach(client)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(query string) (*websocket.Conn, ConnectedValue, uint64) {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?"+query, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect %s: %v", query, err)
+		}
+		events := readUntil(t, conn, EventConnected)
+		var v ConnectedValue
+		b, _ := json.Marshal(events[len(events)-1].Value)
+		json.Unmarshal(b, &v)
+		return conn, v, events[len(events)-1].Seq
+	}
+	// closeOf reads conn until it closes and returns the close frame.
+	closeOf := func(conn *websocket.Conn) *websocket.CloseError {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, _, err := conn.ReadMessage()
+			if err == nil {
+				continue
+			}
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) {
+				t.Fatalf("expected a close frame, got %v", err)
+			}
+			return ce
+		}
+	}
+
+	// A connection taken over by a resume of the same device is told so,
+	// with a token in case it is the one still in use.
+	a, first, seq := dial("id=a")
+	defer a.Close()
+	a2, second, _ := dial("id=a&resume=" + first.ResumeToken + "&last_seq=" + strconv.FormatUint(seq, 10))
+	defer a2.Close()
+	if !second.Resumed {
+		t.Fatalf("resume = %+v", second)
+	}
+	if ce := closeOf(a); ce.Code != CloseSuperseded || ce.Text != "ffrc_device-a" {
+		t.Errorf("superseded close = %d %q", ce.Code, ce.Text)
+	}
+	if got := <-rec.issued; got != "device-a/sess-a" {
+		t.Errorf("token issued for %q", got)
+	}
+
+	// Draining closes every connection with going away and a token.
+	hub.Stop()
+	if ce := closeOf(a2); ce.Code != websocket.CloseGoingAway || ce.Text != "ffrc_device-a" {
+		t.Errorf("drain close = %d %q", ce.Code, ce.Text)
+	}
+}
+
+// countingConn counts the bytes read from the wire.
+type countingConn struct {
+	net.Conn
+	n atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestCompression(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{EnableCompression: true}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		client.CompressMin = 1024
+		hub.Attach(client)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	var wire *countingConn
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			wire = &countingConn{Conn: conn}
+			return wire, nil
+		},
+	}
+	receiver, resp, err := dialer.Dial(wsURL+"?id=b", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer receiver.Close()
+	received := wire
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Fatalf("compression not negotiated: %v", resp.Header)
+	}
+	readUntil(t, receiver, EventConnected)
+	sender, _, err := dialer.Dial(wsURL+"?id=a", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer sender.Close()
+	readUntil(t, sender, EventConnected)
+	readUntil(t, receiver, EventPresence)
+
+	relay := func(typ string, v interface{}) int64 {
+		t.Helper()
+		data, _ := json.Marshal(Event{Type: typ, Value: v, Timestamp: time.Now().UnixMilli()})
+		sender.WriteMessage(websocket.TextMessage, data)
+		before := received.n.Load()
+		readUntil(t, receiver, typ)
+		return received.n.Load() - before
+	}
+	relay(EventMsgStart, MsgStartValue{MsgID: "m1"})
+	relay(EventParaStart, map[string]interface{}{"msgId": "m1", "i": 0})
+	text := strings.Repeat("all work and no play ", 180)
+	if n := relay(EventParaChunk, map[string]interface{}{"msgId": "m1", "i": 0, "text": text}); n >= int64(len(text))/4 {
+		t.Errorf("a %d byte chunk took %d bytes on the wire", len(text), n)
+	}
+	// Below CompressMin events are sent as they are.
+	if n := relay(EventParaEnd, map[string]interface{}{"msgId": "m1", "i": 0, "padding": strings.Repeat("x", 200)}); n < 200 {
+		t.Errorf("a small event took %d bytes on the wire; it should not be compressed", n)
+	}
+
+	// A message that inflates past the read limit closes the connection
+	// instead of being inflated to the end.
+	bomb := make([]byte, 2*MaxMessageSize*hardLimitFactor)
+	bomb[0] = '{'
+	if err := sender.WriteMessage(websocket.TextMessage, bomb); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := sender.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("expected close 1009, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestDrops(t *testing.T) {
+	hub := NewHub()
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client := func(id string) *Client {
+		c := &Client{hub: hub, send: make(chan []byte, 1), DeviceID: id, Log: logger}
+		hub.mu.Lock()
+		hub.clients[c] = true
+		hub.mu.Unlock()
+		return c
+	}
+	a, b := client("device-a"), client("device-b")
+	hub.SetDropLogSampling(2)
+
+	msg := []byte(`{"t":"para_chunk","v":{"text":"secret"}}`)
+	if !hub.SendToPeer(a, msg) || hub.SendToPeer(a, msg) {
+		t.Fatal("the second event should find b's queue full")
+	}
+	b.Send(msg)
+	if got := hub.Drops(); got != (DropStats{FullQueue: 2}) {
+		t.Errorf("after full queues: %+v", got)
+	}
+
+	unregistered := make(chan *Client, 1)
+	go func() { unregistered <- <-hub.unregister }()
+	hub.Broadcast(msg, a)
+	if c := <-unregistered; c != b {
+		t.Errorf("unregistered %v, want b", c)
+	}
+
+	hub.mu.Lock()
+	delete(hub.clients, b)
+	hub.mu.Unlock()
+	if hub.SendToPeer(a, msg) {
+		t.Fatal("nobody should get the event")
+	}
+	if got := hub.Drops(); got != (DropStats{FullQueue: 2, NoPeer: 1, Unregistered: 1}) {
+		t.Errorf("Drops = %+v", got)
+	}
+
+	// One record in two, with the type but not the content.
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 2 {
+		t.Errorf("logged %d records for 4 drops: %s", n, buf.String())
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"type":"para_chunk"`)) || bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Errorf("drop records = %s", buf.String())
+	}
+
+	hub.SetDropLogSampling(0)
+	buf.Reset()
+	a.Send(msg)
+	a.Send(msg)
+	if buf.Len() != 0 {
+		t.Errorf("logged with sampling off: %s", buf.String())
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	hub := NewHub()
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	for range 100 {
+		c := &Client{hub: hub, send: make(chan []byte, 4), DeviceID: "device-a", Log: logger}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 8 {
+				c.Send([]byte(`{"t":"presence"}`))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			c.closeSend()
+			c.closeSend()
+		}()
+		wg.Wait()
+		before := hub.Drops().Unregistered
+		c.Send([]byte(`{"t":"presence"}`))
+		if hub.Drops().Unregistered != before+1 {
+			t.Fatal("Send after close was not dropped as unregistered")
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	t.Run("Triggers", func(t *testing.T) {
+		hub := NewHub()
+		hub.SetKeyRotation(KeyRotation{Interval: time.Hour, Bytes: 100})
+		now := time.Unix(1_000_000, 0)
+
+		if id, _ := hub.countEnvelope("a", "b", 60, now); id != "" {
+			t.Fatalf("rotated after 60 bytes: %q", id)
+		}
+		id, reason := hub.countEnvelope("b", "a", 40, now)
+		if id == "" || reason != KeyRotateBytes || hub.currentKeyID("a", "b") != id {
+			t.Fatalf("after 100 bytes: %q, %q", id, reason)
+		}
+		if id, _ := hub.countEnvelope("a", "b", 1, now.Add(59*time.Minute)); id != "" {
+			t.Fatalf("rotated again after 1 byte: %q", id)
+		}
+		next, reason := hub.countEnvelope("a", "b", 1, now.Add(time.Hour))
+		if next == "" || next == id || reason != KeyRotateSchedule {
+			t.Fatalf("after an hour: %q, %q", next, reason)
+		}
+
+		hub.pruneKeys(now.Add(time.Hour + keyPairIdle))
+		if got := hub.currentKeyID("a", "b"); got != "" {
+			t.Errorf("idle pair kept key ID %q", got)
+		}
+	})
+
+	hub := NewHub()
+	hub.SetKeyRotation(KeyRotation{Bytes: 10})
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	a, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=a", nil)
+	defer a.Close()
+	time.Sleep(50 * time.Millisecond)
+	b, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=b", nil)
+	defer b.Close()
+	time.Sleep(100 * time.Millisecond)
+	readEvents(t, a, 2)
+	readEvents(t, b, 1)
+
+	send := func(typ string, v interface{}) {
+		data, _ := NewEvent(typ, v).Marshal()
+		a.WriteMessage(websocket.TextMessage, data)
+	}
+	last := func(conn *websocket.Conn, types ...string) map[string]interface{} {
+		got := readUntil(t, conn, types...)
+		v, _ := got[len(got)-1].Value.(map[string]interface{})
+		return v
+	}
+
+	send(EventGroupMsg, GroupMsgValue{MsgID: "g1", Envelopes: []GroupEnvelope{{To: "device-b", Ciphertext: "0123456789"}}})
+	mine := last(a, EventKeyRotate)
+	theirs := last(b, EventKeyRotate)
+	keyID, _ := mine["kid"].(string)
+	if keyID == "" || theirs["kid"] != keyID || mine["peer"] != "device-b" || theirs["peer"] != "device-a" || mine["reason"] != KeyRotateBytes {
+		t.Fatalf("key_rotate: sender %v, peer %v", mine, theirs)
+	}
+
+	send(EventKeyShare, KeyShareValue{To: "device-b", KeyID: "old", Public: "pub-a"})
+	if v := last(a, EventError); v["code"] != "stale_key_id" || v["kid"] != "old" {
+		t.Errorf("stale key_share: %v", v)
+	}
+	send(EventKeyShare, KeyShareValue{To: "device-b", KeyID: keyID, Public: "pub-a"})
+	if v := last(b, EventKeyShare); v["from"] != "device-a" || v["kid"] != keyID || v["pub"] != "pub-a" {
+		t.Errorf("relayed key_share: %v", v)
+	}
+
+	send(EventGroupMsg, GroupMsgValue{MsgID: "g2", Envelopes: []GroupEnvelope{{To: "device-b", Ciphertext: "new", KeyID: keyID}}})
+	if v := last(b, EventGroupMsg); v["kid"] != keyID || v["ct"] != "new" {
+		t.Errorf("envelope under the new key: %v", v)
+	}
+}
+
+func TestPeerInfo(t *testing.T) {
+	for in, want := range map[string]string{
+		"de-DE":                     "de-DE",
+		"fr-CH, fr;q=0.9, en;q=0.8": "fr-CH",
+		"zh-Hant-TW":                "zh-Hant-TW",
+		"en_US":                     "",
+		"<script>":                  "",
+		"":                          "",
+	} {
+		if got := NormalizeLocale(in); got != want {
+			t.Errorf("NormalizeLocale(%q) = %q, want %q", in, got, want)
+		}
+	}
+	for in, want := range map[string]string{
+		"Europe/Berlin":                  "Europe/Berlin",
+		"America/Argentina/Buenos_Aires": "America/Argentina/Buenos_Aires",
+		"Etc/GMT+5":                      "Etc/GMT+5",
+		"../etc/passwd":                  "",
+		"Europe/":                        "",
+		"":                               "",
+	} {
+		if got := NormalizeTimeZone(in); got != want {
+			t.Errorf("NormalizeTimeZone(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		client.Locale = NormalizeLocale(r.URL.Query().Get("locale"))
+		client.TimeZone = NormalizeTimeZone(r.URL.Query().Get("tz"))
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?"+query, nil)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return conn
+	}
+	berlin := dial("id=berlin&locale=de-DE&tz=Europe/Berlin")
+	defer berlin.Close()
+	plain := dial("id=plain")
+	defer plain.Close()
+
+	data, _ := NewEvent(EventMsgStart, MsgStartValue{MsgID: "m1"}).Marshal()
+	berlin.WriteMessage(websocket.TextMessage, data)
+	events := readUntil(t, plain, EventMsgStart)
+	if len(events) < 2 || events[len(events)-2].Type != EventPeerInfo {
+		t.Fatalf("expected peer_info before msg_start, got %+v", events)
+	}
+	v := events[len(events)-2].Value.(map[string]interface{})
+	if v["msgId"] != "m1" || v["device_id"] != "device-berlin" || v["locale"] != "de-DE" || v["tz"] != "Europe/Berlin" {
+		t.Errorf("peer_info = %v", v)
+	}
+
+	// A sender that declared nothing sends no peer_info.
+	data, _ = NewEvent(EventMsgStart, MsgStartValue{MsgID: "m2"}).Marshal()
+	plain.WriteMessage(websocket.TextMessage, data)
+	for _, e := range readUntil(t, berlin, EventMsgStart) {
+		if e.Type == EventPeerInfo {
+			t.Errorf("unexpected peer_info %v", e.Value)
+		}
+	}
+}
+
+func TestChunkNegotiation(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		if n, err := strconv.Atoi(r.URL.Query().Get("max_chunk")); err == nil {
+			client.MaxChunk = ClampChunkSize(n)
+		}
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?"+query, nil)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return conn
+	}
+	send := func(conn *websocket.Conn, typ string, v interface{}) {
+		data, _ := NewEvent(typ, v).Marshal()
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+	granted := func(conn *websocket.Conn, msgID string) float64 {
+		t.Helper()
+		send(conn, EventMsgStart, MsgStartValue{MsgID: msgID})
+		events := readUntil(t, conn, EventMsgParams)
+		v := events[len(events)-1].Value.(map[string]interface{})
+		if v["msgId"] != msgID {
+			t.Fatalf("msg_params for %v, want %s", v["msgId"], msgID)
+		}
+		return v["chunk"].(float64)
+	}
+
+	desktop := dial("id=desktop&max_chunk=65536")
+	defer desktop.Close()
+	laptop := dial("id=laptop&max_chunk=32768")
+	defer laptop.Close()
+
+	if got := granted(desktop, "m1"); got != 32768 {
+		t.Errorf("desktop to laptop: chunk = %v, want 32768", got)
+	}
+	big := strings.Repeat("x", 20*1024)
+	send(desktop, EventParaStart, ParaStartValue{MsgID: "m1", Index: 0})
+	send(desktop, EventParaChunk, ParaChunkValue{MsgID: "m1", Index: 0, Text: big})
+	events := readUntil(t, laptop, EventParaChunk)
+	if v := events[len(events)-1].Value.(map[string]interface{}); v["s"] != big {
+		t.Error("negotiated chunk was not relayed intact")
+	}
+
+	// A phone that declared nothing keeps every new message on 4 KiB.
+	phone := dial("id=phone")
+	defer phone.Close()
+	if got := granted(desktop, "m2"); got != MaxChunkSize {
+		t.Errorf("with phone online: chunk = %v, want %d", got, MaxChunkSize)
+	}
+	send(desktop, EventParaStart, ParaStartValue{MsgID: "m2", Index: 0})
+	send(desktop, EventParaChunk, ParaChunkValue{MsgID: "m2", Index: 0, Text: big})
+	events = readUntil(t, desktop, EventSendFail)
+	if v := events[len(events)-1].Value.(map[string]interface{}); v["reason"] != "chunk_too_large" {
+		t.Errorf("Expected chunk_too_large, got %v", v["reason"])
+	}
+
+	for in, want := range map[int]int{0: MaxChunkSize, 1024: MaxChunkSize, 16384: 16384, 1 << 20: MaxNegotiatedChunkSize} {
+		if got := ClampChunkSize(in); got != want {
+			t.Errorf("ClampChunkSize(%d) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	sender, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=1", nil)
+	defer sender.Close()
+	time.Sleep(50 * time.Millisecond)
+	receiver, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=2", nil)
+	defer receiver.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	readEvents(t, sender, 2)
+	readEvents(t, receiver, 1)
+
+	write := func(conn *websocket.Conn, typ string, v map[string]interface{}) {
+		data, _ := NewEvent(typ, v).Marshal()
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	write(sender, EventMsgStart, map[string]interface{}{"msgId": "big-paste"})
+	write(sender, EventParaStart, map[string]interface{}{"msgId": "big-paste", "i": 0})
+	readUntil(t, receiver, EventParaStart)
+
+	write(receiver, EventPause, map[string]interface{}{"msgId": "big-paste"})
+	got := readUntil(t, sender, EventPause, EventResume)
+	if got[len(got)-1].Type != EventPause {
+		t.Fatalf("Expected sender to receive pause, got %s", got[len(got)-1].Type)
+	}
+
+	write(receiver, EventResume, map[string]interface{}{"msgId": "big-paste"})
+	got = readUntil(t, sender, EventPause, EventResume)
+	if got[len(got)-1].Type != EventResume {
+		t.Fatalf("Expected sender to receive resume, got %s", got[len(got)-1].Type)
+	}
+
+	write(receiver, EventPause, map[string]interface{}{"msgId": "big-paste"})
+	readUntil(t, sender, EventPause)
+
+	// A sender that ignores the zero window is cut off after the grace.
+	for i := 0; i <= PauseGrace; i++ {
+		write(sender, EventParaChunk, map[string]interface{}{"msgId": "big-paste", "i": 0, "s": "x"})
+	}
+	got = readUntil(t, sender, EventSendFail)
+	v := got[len(got)-1].Value.(map[string]interface{})
+	if v["reason"] != "flow_control_violation" {
+		t.Errorf("Expected flow_control_violation, got %v", v["reason"])
+	}
+}
+
+type allowlist map[string][]string
+
+func (a allowlist) CommandAllowed(deviceID, action string) (bool, error) {
+	for _, allowed := range a[deviceID] {
+		if allowed == action {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestCommandChannel(t *testing.T) {
+	hub := NewHub()
+	hub.SetCommandAuthorizer(allowlist{"device-b": {CmdOpenURL}})
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conns := make(map[string]*websocket.Conn)
+	for _, id := range []string{"a", "b", "c"} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?id="+id, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect %s: %v", id, err)
+		}
+		defer conn.Close()
+		conns[id] = conn
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	readEvents(t, conns["a"], 3)
+	readEvents(t, conns["b"], 2)
+	readEvents(t, conns["c"], 1)
+
+	write := func(conn *websocket.Conn, typ string, v interface{}) {
+		data, _ := NewEvent(typ, v).Marshal()
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+	status := func() CmdStatusValue {
+		got := readUntil(t, conns["a"], EventCmdStatus)
+		raw, _ := json.Marshal(got[len(got)-1].Value)
+		var s CmdStatusValue
+		json.Unmarshal(raw, &s)
+		return s
+	}
+
+	tests := []struct {
+		name string
+		cmd  CmdValue
+		want string
+	}{
+		{"not allowlisted", CmdValue{CmdID: "c1", To: "device-b", Action: CmdRing}, DeliveryDenied},
+		{"unknown action", CmdValue{CmdID: "c2", To: "device-b", Action: "exec"}, DeliveryInvalid},
+		{"bad url", CmdValue{CmdID: "c3", To: "device-b", Action: CmdOpenURL, Args: map[string]string{"url": "javascript:alert(1)"}}, DeliveryInvalid},
+		{"self", CmdValue{CmdID: "c4", To: "device-a", Action: CmdRing}, DeliveryInvalid},
+		{"other device's list", CmdValue{CmdID: "c5", To: "device-c", Action: CmdOpenURL, Args: map[string]string{"url": "https://example.com"}}, DeliveryDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write(conns["a"], EventCmd, tt.cmd)
+			if s := status(); s.CmdID != tt.cmd.CmdID || s.Status != tt.want {
+				t.Errorf("Expected %s for %s, got %+v", tt.want, tt.cmd.CmdID, s)
+			}
+		})
+	}
+
+	write(conns["a"], EventCmd, CmdValue{CmdID: "ok-1", To: "device-b", Action: CmdOpenURL, Args: map[string]string{"url": "https://example.com/x"}})
+	if s := status(); s.Status != DeliveryDelivered {
+		t.Fatalf("Expected delivered, got %+v", s)
+	}
+	got := readUntil(t, conns["b"], EventCmd)
+	v := got[len(got)-1].Value.(map[string]interface{})
+	if v["cmdId"] != "ok-1" || v["from"] != "device-a" || v["action"] != CmdOpenURL {
+		t.Fatalf("Target got unexpected command: %#v", v)
+	}
+
+	// A device that was never sent the command cannot forge its result.
+	write(conns["c"], EventCmdResult, CmdResultValue{CmdID: "ok-1", To: "device-a", OK: true})
+	write(conns["b"], EventCmdResult, CmdResultValue{CmdID: "ok-1", To: "device-a", OK: false, Error: "declined"})
+
+	got = readUntil(t, conns["a"], EventCmdResult)
+	raw, _ := json.Marshal(got[len(got)-1].Value)
+	var result CmdResultValue
+	json.Unmarshal(raw, &result)
+	if result.From != "device-b" || result.OK || result.Error != "declined" || result.To != "" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	// The pending slot is consumed, so a second answer is dropped.
+	write(conns["b"], EventCmdResult, CmdResultValue{CmdID: "ok-1", To: "device-a", OK: true})
+	conns["a"].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := conns["a"].ReadMessage(); err == nil {
+		t.Error("Expected duplicate result to be dropped")
+	}
+}
+
+func TestValidateCmd(t *testing.T) {
+	tests := []struct {
+		action string
+		args   map[string]string
+		want   error
+	}{
+		{CmdRing, nil, nil},
+		{CmdScreenshotRequest, nil, nil},
+		{CmdOpenURL, map[string]string{"url": "https://example.com"}, nil},
+		{CmdOpenURL, map[string]string{"url": "file:///etc/passwd"}, ErrInvalidCmd},
+		{CmdOpenURL, map[string]string{"url": "https://" + strings.Repeat("a", 2048)}, ErrInvalidCmd},
+		{CmdOpenURL, map[string]string{"url": "https://example.com", "x": "y"}, ErrInvalidCmd},
+		{CmdRing, map[string]string{"volume": "11"}, ErrInvalidCmd},
+		{"shell", nil, ErrUnknownCmd},
+	}
+	for _, tt := range tests {
+		if err := ValidateCmd(tt.action, tt.args); err != tt.want {
+			t.Errorf("ValidateCmd(%s, %v) = %v, want %v", tt.action, tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestVersionBelow(t *testing.T) {
+	tests := []struct {
+		client, min string
+		want        bool
+	}{
+		{"1.2.0", "1.2", false},
+		{"1.2", "1.2.1", true},
+		{"1.10", "1.9", false},
+		{"v2.0.0-beta.1", "2.0", false},
+		{"0.9.9", "1", true},
+		{"", "1.0", true},
+		{"1.x", "1.0", true},
+		{"01.0", "1.0", true},
+		{"0.1", "", false},
+	}
+	for _, tt := range tests {
+		if got := VersionBelow(tt.client, tt.min); got != tt.want {
+			t.Errorf("VersionBelow(%q, %q) = %v, want %v", tt.client, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestChunkTextProblem(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{`{"s":"hello\nworld\t"}`, ""},
+		{"{\"s\":\"café \uFFFD\"}", ""},
+		{`{"s":"escaped \ufffd"}`, ""},
+		{"{\"s\":\"caf\xc3\"}", ReasonInvalidUTF8},
+		{`{"s":"half \ud83d pair"}`, ReasonInvalidUTF8},
+		{`{"s":"bell \u0007"}`, ReasonControlChars},
+		{`{"s":"c1 \u0085"}`, ReasonControlChars},
+	}
+	for _, tt := range tests {
+		var v struct {
+			S string `json:"s"`
+		}
+		json.Unmarshal([]byte(tt.raw), &v)
+		if got := chunkTextProblem([]byte(tt.raw), v.S); got != tt.want {
+			t.Errorf("chunkTextProblem(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	if got := SanitizeText("a\x00b\x7fc\xffd\r\n"); got != "abc\uFFFDd\r\n" {
+		t.Errorf("SanitizeText() = %q", got)
+	}
+	if _, err := ParseTextPolicy("strict"); err == nil {
+		t.Error("ParseTextPolicy accepted an unknown policy")
+	}
+}
+
+func TestTextPolicy(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	sender, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=1", nil)
+	defer sender.Close()
+	time.Sleep(50 * time.Millisecond)
+	receiver, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=2", nil)
+	defer receiver.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	readEvents(t, sender, 2)
+	readEvents(t, receiver, 1)
+
+	start, _ := NewEvent(EventMsgStart, map[string]interface{}{"msgId": "m1"}).Marshal()
+	sender.WriteMessage(websocket.TextMessage, start)
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"t":"para_chunk","v":{"msgId":"m1","i":0,"s":"ok\u0007\ud83d!"},"ts":1}`))
+
+	got := readUntil(t, receiver, EventParaChunk)
+	v := got[len(got)-1].Value.(map[string]interface{})
+	if v["s"] != "ok\uFFFD!" {
+		t.Errorf("Expected sanitized chunk, got %q", v["s"])
+	}
+
+	hub.SetTextPolicy(TextPolicyReject)
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"t":"para_chunk","v":{"msgId":"m1","i":0,"s":"bell\u0007"},"ts":2}`))
+	got = readUntil(t, sender, EventSendFail)
+	v = got[len(got)-1].Value.(map[string]interface{})
+	if v["reason"] != ReasonControlChars {
+		t.Errorf("Expected %s, got %v", ReasonControlChars, v["reason"])
+	}
+}
+
+type memSettings map[string]map[string]string
+
+func (m memSettings) PutSetting(userID, key, value string) error {
+	if m[userID] == nil {
+		m[userID] = map[string]string{}
+	}
+	if value == "" {
+		delete(m[userID], key)
+	} else {
+		m[userID][key] = value
+	}
+	return nil
+}
+
+func (m memSettings) Settings(userID string) (map[string]string, error) {
+	out := map[string]string{}
+	for k, v := range m[userID] {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func TestSettingsSync(t *testing.T) {
+	hub := NewHub()
+	hub.SetSettingsStore(memSettings{})
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	a, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=a", nil)
+	defer a.Close()
+	time.Sleep(50 * time.Millisecond)
+	b, _, _ := websocket.DefaultDialer.Dial(wsURL+"?id=b", nil)
+	defer b.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	readEvents(t, a, 2)
+	readEvents(t, b, 1)
+
+	write := func(typ string, v interface{}) {
+		data, _ := NewEvent(typ, v).Marshal()
+		a.WriteMessage(websocket.TextMessage, data)
+	}
+	status := func() string {
+		got := readUntil(t, a, EventSettingsStatus)
+		return got[len(got)-1].Value.(map[string]interface{})["status"].(string)
+	}
+
+	write(EventSettingsSet, SettingsSetValue{Key: "theme", Ciphertext: "ct-dark"})
+	if s := status(); s != SettingsSaved {
+		t.Fatalf("Expected saved, got %s", s)
+	}
+	got := readUntil(t, b, EventSettingsSet)
+	v := got[len(got)-1].Value.(map[string]interface{})
+	if v["key"] != "theme" || v["ct"] != "ct-dark" || v["from"] != "device-a" {
+		t.Errorf("Unexpected pushed setting: %#v", v)
+	}
+
+	write(EventSettingsSet, SettingsSetValue{Key: "Theme!", Ciphertext: "x"})
+	if s := status(); s != DeliveryInvalid {
+		t.Errorf("Expected invalid for a bad key, got %s", s)
+	}
+
+	data, _ := NewEvent(EventSettingsGet, map[string]interface{}{}).Marshal()
+	b.WriteMessage(websocket.TextMessage, data)
+	got = readUntil(t, b, EventSettingsValues)
+	settings := got[len(got)-1].Value.(map[string]interface{})["settings"].(map[string]interface{})
+	if len(settings) != 1 || settings["theme"] != "ct-dark" {
+		t.Errorf("Unexpected settings: %#v", settings)
+	}
+}
+
+func TestUserIsolation(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		client.UserID = r.URL.Query().Get("user")
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(id, user string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?id="+id+"&user="+user, nil)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return conn
+	}
+	// drain returns the events received until the connection goes quiet.
+	drain := func(conn *websocket.Conn) []Event {
+		var events []Event
+		for {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return events
+			}
+			var e Event
+			json.Unmarshal(data, &e)
+			events = append(events, e)
+		}
+	}
+	lastOnline := func(events []Event) int {
+		online := -1
+		for _, e := range events {
+			if e.Type == EventPresence {
+				v, _ := e.Value.(map[string]interface{})
+				online = int(v["online"].(float64))
+			}
+		}
+		return online
+	}
+
+	a1 := dial("a1", "alice")
+	defer a1.Close()
+	b1 := dial("b1", "bob")
+	defer b1.Close()
+	a2 := dial("a2", "alice")
+	defer a2.Close()
+
+	if n := lastOnline(drain(a1)); n != 2 {
+		t.Errorf("Expected alice to see 2 online, got %d", n)
+	}
+	if n := lastOnline(drain(b1)); n != 1 {
+		t.Errorf("Expected bob to see 1 online, got %d", n)
+	}
+	drain(a2)
+	if n := hub.OnlineCountFor("alice"); n != 2 {
+		t.Errorf("OnlineCountFor(alice) = %d, want 2", n)
+	}
+
+	data, _ := json.Marshal(Event{
+		Type:      EventMsgStart,
+		Value:     map[string]interface{}{"msgId": "iso-1"},
+		Timestamp: time.Now().UnixMilli(),
+	})
+	b1.WriteMessage(websocket.TextMessage, data)
+	time.Sleep(50 * time.Millisecond)
+
+	for _, e := range append(drain(a1), drain(a2)...) {
+		if e.Type == EventMsgStart {
+			t.Error("Message from bob reached one of alice's devices")
+		}
+	}
+	for _, e := range drain(b1) {
+		if e.Type == EventMsgStart {
+			t.Error("Bob's message should not echo back")
+		}
+	}
+}
+
+func TestRooms(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		client.Room = r.URL.Query().Get("room")
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(id, room string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?id="+id+"&room="+room, nil)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return conn
+	}
+	// drain returns the events received until the connection goes quiet.
+	// The connection cannot be read after that.
+	drain := func(conn *websocket.Conn) []*Event {
+		var events []*Event
+		for {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return events
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if e, err := ParseEvent([]byte(line)); err == nil {
+					events = append(events, e)
+				}
+			}
+		}
+	}
+	lastOnline := func(events []*Event) int {
+		online := -1
+		for _, e := range events {
+			if e.Type == EventPresence {
+				online = int(e.Value.(map[string]interface{})["online"].(float64))
+			}
+		}
+		return online
+	}
+
+	desk1 := dial("desk1", "desk")
+	defer desk1.Close()
+	desk2 := dial("desk2", "desk")
+	defer desk2.Close()
+	home1 := dial("home1", "")
+	home2 := dial("home2", "")
+	defer home2.Close()
+
+	if n := lastOnline(drain(desk1)); n != 2 {
+		t.Errorf("desk room presence = %d, want 2", n)
+	}
+	if n := lastOnline(drain(home1)); n != 2 {
+		t.Errorf("default room presence = %d, want 2", n)
+	}
+	if n := hub.RoomCount(); n != 2 {
+		t.Errorf("RoomCount = %d, want 2", n)
+	}
+
+	data, _ := NewEvent(EventMsgStart, MsgStartValue{MsgID: "room-1"}).Marshal()
+	desk1.WriteMessage(websocket.TextMessage, data)
+	if got := readUntil(t, desk2, EventMsgStart); got[len(got)-1].GetMsgID() != "room-1" {
+		t.Errorf("desk2 got %+v", got[len(got)-1])
+	}
+	for _, e := range append(drain(home1), drain(home2)...) {
+		if e.Type == EventMsgStart {
+			t.Error("Message from the desk room reached the default room")
+		}
+	}
+
+	// A room closes with its last member.
+	home1.Close()
+	home2.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := hub.RoomCount(); n != 1 {
+		t.Errorf("RoomCount after the default room emptied = %d, want 1", n)
+	}
+
+	for _, id := range []string{"", "desk", "pair_2-b"} {
+		if !ValidRoomID(id) {
+			t.Errorf("ValidRoomID(%q) = false", id)
+		}
+	}
+	for _, id := range []string{"a b", "x/y", strings.Repeat("r", MaxRoomIDLen+1)} {
+		if ValidRoomID(id) {
+			t.Errorf("ValidRoomID(%q) = true", id)
+		}
+	}
+}
+
+// deniedPairs is a PeerPolicy that blocks the listed device pairs.
+type deniedPairs map[[2]string]bool
+
+func (d deniedPairs) PeerAllowed(a, b string) (bool, error) {
+	return !d[[2]string{a, b}] && !d[[2]string{b, a}], nil
+}
+
+func TestPeerPolicy(t *testing.T) {
+	hub := NewHub()
+	hub.SetPeerPolicy(deniedPairs{{"device-k1", "device-k2"}: true})
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		client := NewClient(hub, conn, "device-"+r.URL.Query().Get("id"), "127.0.0.1", nil, 100, MaxMessageSize)
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(id string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?id="+id, nil)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return conn
+	}
+	send := func(conn *websocket.Conn, typ string, v interface{}) {
+		data, _ := NewEvent(typ, v).Marshal()
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	k1 := dial("k1")
+	defer k1.Close()
+	k2 := dial("k2")
+	defer k2.Close()
+
+	// The only other device online is one k1 may not talk to.
+	send(k1, EventMsgStart, MsgStartValue{MsgID: "blocked"})
+	events := readUntil(t, k1, EventSendFail)
+	v, _ := events[len(events)-1].Value.(map[string]interface{})
+	if v["reason"] != DeliveryNotPermitted {
+		t.Errorf("Expected not_permitted, got %v", v["reason"])
+	}
+
+	p := dial("p")
+	defer p.Close()
+
+	send(k1, EventMsgStart, MsgStartValue{MsgID: "to-parent"})
+	readUntil(t, p, EventMsgStart)
+
+	send(k1, EventGroupMsg, GroupMsgValue{MsgID: "g1", Envelopes: []GroupEnvelope{
+		{To: "device-k2", Ciphertext: "x"},
+		{To: "device-p", Ciphertext: "y"},
+	}})
+	events = readUntil(t, k1, EventGroupStatus)
+	b, _ := json.Marshal(events[len(events)-1].Value)
+	var status GroupStatusValue
+	json.Unmarshal(b, &status)
+	want := map[string]string{"device-k2": DeliveryNotPermitted, "device-p": DeliveryDelivered}
+	for _, r := range status.Results {
+		if want[r.To] != r.Status {
+			t.Errorf("%s: status %s, want %s", r.To, r.Status, want[r.To])
+		}
+	}
+
+	k2.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		_, data, err := k2.ReadMessage()
+		if err != nil {
+			break
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if e, err := ParseEvent([]byte(line)); err == nil && e.Type != EventPresence {
+				t.Errorf("k2 received %s from a device it may not talk to", e.Type)
+			}
+		}
+	}
+}
+
+func TestReadOnlyClient(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		id := r.URL.Query().Get("id")
+		client := NewClient(hub, conn, "device-"+id, "127.0.0.1", nil, 100, MaxMessageSize)
+		client.ReadOnly = id == "viewer"
+		hub.Register(client)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(id string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?id="+id, nil)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return conn
+	}
+	send := func(conn *websocket.Conn, typ string, v interface{}) {
+		data, _ := NewEvent(typ, v).Marshal()
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	viewer := dial("viewer")
+	defer viewer.Close()
+	writer := dial("writer")
+	defer writer.Close()
+
+	// The viewer still receives.
+	send(writer, EventMsgStart, MsgStartValue{MsgID: "to-viewer"})
+	readUntil(t, viewer, EventMsgStart)
+
+	send(viewer, EventMsgStart, MsgStartValue{MsgID: "from-viewer"})
+	events := readUntil(t, viewer, EventSendFail)
+	v, _ := events[len(events)-1].Value.(map[string]interface{})
+	if v["reason"] != DeliveryReadOnly {
+		t.Errorf("msg_start: expected read_only, got %v", v["reason"])
+	}
+
+	send(viewer, EventGroupMsg, GroupMsgValue{MsgID: "g1", Envelopes: []GroupEnvelope{
+		{To: "device-writer", Ciphertext: "x"},
+	}})
+	events = readUntil(t, viewer, EventSendFail)
+	v, _ = events[len(events)-1].Value.(map[string]interface{})
+	if v["reason"] != DeliveryReadOnly {
+		t.Errorf("group_msg: expected read_only, got %v", v["reason"])
+	}
+
+	send(viewer, EventCmd, CmdValue{CmdID: "c1", To: "device-writer", Action: CmdRing})
+	events = readUntil(t, viewer, EventCmdStatus)
+	v, _ = events[len(events)-1].Value.(map[string]interface{})
+	if v["status"] != DeliveryReadOnly {
+		t.Errorf("cmd: expected read_only, got %v", v["status"])
+	}
+}
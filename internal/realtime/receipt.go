@@ -0,0 +1,74 @@
+package realtime
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Receipt describes an atomic message or file transfer that both ends
+// confirmed with msg_commit. It holds the checksum the ends agreed on and
+// no content.
+type Receipt struct {
+	UserID      string
+	MsgID       string
+	From        string // sending device
+	To          string // receiving device
+	File        bool
+	Chunks      int
+	Bytes       int64
+	SHA256      string
+	StartedAt   time.Time
+	CommittedAt time.Time
+}
+
+// ReceiptRecorder keeps receipts and returns the ID to look each up by.
+// The handler implements it, signing receipts before storing them.
+type ReceiptRecorder interface {
+	RecordReceipt(r Receipt) (string, error)
+}
+
+// SetReceiptRecorder sets where receipts of committed transfers go.
+// Without one no receipts are kept and msg_commit names none.
+func (h *Hub) SetReceiptRecorder(r ReceiptRecorder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.receipts = r
+}
+
+func (h *Hub) receiptRecorder() ReceiptRecorder {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.receipts
+}
+
+// recordReceipt records that state was delivered to device to with
+// checksum sum and returns the receipt ID, or "" when none was kept.
+func (c *Client) recordReceipt(state *MessageState, to, sum string) string {
+	rec := c.hub.receiptRecorder()
+	if rec == nil {
+		return ""
+	}
+	c.mu.Lock()
+	r := Receipt{
+		UserID:      c.UserID,
+		MsgID:       state.MsgID,
+		From:        c.DeviceID,
+		To:          to,
+		File:        state.File,
+		Chunks:      state.Chunks,
+		Bytes:       int64(state.TotalBytes),
+		SHA256:      sum,
+		StartedAt:   state.StartedAt,
+		CommittedAt: time.Now(),
+	}
+	c.mu.Unlock()
+	if state.File {
+		r.Bytes = state.FileSize
+	}
+	id, err := rec.RecordReceipt(r)
+	if err != nil {
+		slog.Error("Failed to record transfer receipt", "err", err, "msg_id", state.MsgID)
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,53 @@
+package realtime
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseSuperseded is the close code sent to a connection that another
+// connection of the same device replaced by resuming it (see replay.go).
+const CloseSuperseded = 4004
+
+// Reconnector issues fast-reconnect tokens for connections the server
+// closes on its own: when the hub drains (CloseGoingAway) and when a
+// connection is superseded. The token is the close frame's reason, so it
+// must fit in 123 bytes; "" sends none. The handler implements it.
+//
+// Idle connections are deliberately left out: the hub has no idle
+// timeout, and a peer that stops answering pings (pongWait) is dropped
+// without a close frame, since nothing would reach it. Such a device
+// reconnects the usual way and can still pass its resume token.
+type Reconnector interface {
+	ReconnectToken(deviceID, sessionID string, readOnly bool) string
+}
+
+// SetReconnector sets who issues reconnect tokens. Without one the close
+// frames carry no reason.
+func (h *Hub) SetReconnector(r Reconnector) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reconnector = r
+}
+
+// closeMessage returns the close frame telling c's device to reconnect,
+// with a reconnect token when the hub has a Reconnector.
+func (c *Client) closeMessage(code int) []byte {
+	c.hub.mu.RLock()
+	r := c.hub.reconnector
+	c.hub.mu.RUnlock()
+
+	reason := ""
+	if r != nil {
+		reason = r.ReconnectToken(c.DeviceID, c.SessionID, c.ReadOnly)
+	}
+	return websocket.FormatCloseMessage(code, reason)
+}
+
+// supersede closes c because a new connection took it over. Unlike kick
+// it leaves c's events to be parked for the new connection to resume.
+func (c *Client) supersede() {
+	c.conn.WriteControl(websocket.CloseMessage, c.closeMessage(CloseSuperseded), time.Now().Add(writeWait))
+	c.conn.Close()
+}
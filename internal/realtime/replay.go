@@ -0,0 +1,228 @@
+package realtime
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Replaying events after a reconnect. WritePump stamps every JSON event a
+// connection is sent with the next sequence number, starting at 1, and
+// keeps the most recent ones. When the connection drops, the hub holds on
+// to them, along with any events still queued for it, for ReplayTTL. A
+// client that reconnects with /ws?resume=<token>&last_seq=N gets the
+// events after N again before anything else, and then a connected event
+// saying whether the resume worked; if it did not, the client must reset
+// as after a fresh connect. Only events already handed to the old
+// connection are replayed: nothing is queued for a device that is
+// offline. File chunk frames are not stamped or replayed; file transfers
+// recover with resume_request instead.
+
+// ReplayTTL is how long a dropped connection's events wait for it to
+// reconnect.
+const ReplayTTL = 30 * time.Second
+
+const (
+	// maxReplayEvents and maxReplayBytes bound the events kept per
+	// connection; the oldest go first.
+	maxReplayEvents = 128
+	maxReplayBytes  = 256 * 1024
+	// maxParkedReplays bounds the dropped connections held at once.
+	maxParkedReplays = 256
+	// MaxResumeTokenLen bounds the resume token /ws accepts.
+	MaxResumeTokenLen = 64
+	// resumeWait is how long a resuming connection waits for the one it
+	// replaces to be parked.
+	resumeWait = 2 * time.Second
+)
+
+// seqEvent is an event frame stamped with its sequence number.
+type seqEvent struct {
+	seq   uint64
+	frame []byte
+}
+
+// replayLog numbers a connection's outgoing events and keeps the latest.
+type replayLog struct {
+	mu      sync.Mutex
+	token   string
+	next    uint64
+	events  []seqEvent
+	size    int
+	pending []seqEvent // replayed events WritePump sends first
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// stamp numbers frame and records it. Frames that are not JSON objects
+// are returned unchanged.
+func (l *replayLog) stamp(frame []byte) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := stampSeq(frame, l.next)
+	if out == nil {
+		return frame
+	}
+	l.add(seqEvent{seq: l.next, frame: out})
+	l.next++
+	return out
+}
+
+// add records e, dropping the oldest events over the limits. l.mu must be
+// held.
+func (l *replayLog) add(e seqEvent) {
+	l.events = append(l.events, e)
+	l.size += len(e.frame)
+	for len(l.events) > maxReplayEvents || l.size > maxReplayBytes {
+		l.size -= len(l.events[0].frame)
+		l.events = l.events[1:]
+	}
+}
+
+func (l *replayLog) takePending() []seqEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p := l.pending
+	l.pending = nil
+	return p
+}
+
+// stampSeq returns the JSON object frame with "seq" added last, so it
+// wins over any seq a sending client put in a relayed event, or nil if
+// frame is not a JSON object.
+func stampSeq(frame []byte, seq uint64) []byte {
+	frame = bytes.TrimSpace(frame)
+	if len(frame) < 2 || frame[0] != '{' || frame[len(frame)-1] != '}' {
+		return nil
+	}
+	body := bytes.TrimSpace(frame[:len(frame)-1])
+	out := make([]byte, 0, len(frame)+24)
+	out = append(out, body...)
+	if len(body) > 1 {
+		out = append(out, ',')
+	}
+	out = append(out, `"seq":`...)
+	out = strconv.AppendUint(out, seq, 10)
+	return append(out, '}')
+}
+
+// parkedReplay is what a dropped connection left for a resume.
+type parkedReplay struct {
+	deviceID string
+	userID   string
+	room     string
+	next     uint64
+	events   []seqEvent
+	expires  time.Time
+}
+
+// parkReplay runs when WritePump stops: it numbers the events still
+// queued for c, which never left, and hands c's log to the hub. Clients
+// the server closed on purpose are not parked.
+func (c *Client) parkReplay() {
+	defer close(c.parked)
+	for message := range c.send {
+		if !IsFileChunk(message) {
+			c.replay.stamp(message)
+		}
+	}
+	if c.kicked.Load() {
+		return
+	}
+
+	c.replay.mu.Lock()
+	p := &parkedReplay{
+		deviceID: c.DeviceID,
+		userID:   c.UserID,
+		room:     c.Room,
+		next:     c.replay.next,
+		events:   c.replay.events,
+		expires:  time.Now().Add(ReplayTTL),
+	}
+	token := c.replay.token
+	c.replay.mu.Unlock()
+
+	h := c.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.replays) < maxParkedReplays {
+		h.replays[token] = p
+	}
+}
+
+// resume gives client the events its previous connection was sent after
+// client.ResumeSeq, if client.ResumeToken names one that can be resumed,
+// and reports whether it did and how many events it replays. A previous
+// connection that is still open is closed first. client must not be
+// running yet.
+func (h *Hub) resume(client *Client) (bool, int) {
+	token := client.ResumeToken
+	if token == "" {
+		return false, 0
+	}
+
+	h.mu.RLock()
+	var old *Client
+	for c := range h.devices[client.DeviceID] {
+		if c.replay.token == token {
+			old = c
+		}
+	}
+	h.mu.RUnlock()
+	if old != nil {
+		old.supersede()
+		select {
+		case <-old.parked:
+		case <-time.After(resumeWait):
+		}
+	}
+
+	h.mu.Lock()
+	p, ok := h.replays[token]
+	delete(h.replays, token)
+	h.mu.Unlock()
+	if !ok || time.Now().After(p.expires) ||
+		p.deviceID != client.DeviceID || p.userID != client.UserID || p.room != client.Room {
+		return false, 0
+	}
+
+	last := client.ResumeSeq
+	first := p.next
+	if len(p.events) > 0 {
+		first = p.events[0].seq
+	}
+	if last >= p.next || last+1 < first {
+		return false, 0
+	}
+
+	l := &client.replay
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next = p.next
+	for _, e := range p.events {
+		if e.seq > last {
+			l.add(e)
+			l.pending = append(l.pending, e)
+		}
+	}
+	return true, len(l.pending)
+}
+
+// expireReplays drops parked logs nobody resumed in time.
+func (h *Hub) expireReplays(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for token, p := range h.replays {
+		if now.After(p.expires) {
+			delete(h.replays, token)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package realtime
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Resuming file transfers. When a file_chunk cannot be relayed because the
+// receiver went away, the transfer is suspended and the sender gets pause.
+// When the sender goes away, its unfinished transfers are parked in the
+// hub. Either way the receiver, once both ends are back, sends
+// resume_request with the number of bytes it holds; the server rewinds the
+// transfer to that offset and forwards the request to the sender, which
+// answers resume_ok and sends the rest. Chunks and file_end that arrive
+// while a transfer is suspended are discarded; the sender repeats them
+// after resume_ok. A transfer still suspended after ResumeTTL is aborted.
+
+// ResumeTTL is how long a suspended or parked transfer waits for
+// resume_request and resume_ok.
+const ResumeTTL = 5 * time.Minute
+
+// maxResumePoints bounds the chunk boundaries a transfer can be rewound
+// to: the start of the file and the most recent ones.
+const maxResumePoints = 64
+
+// resumePoint is the checksum state after the first offset bytes.
+type resumePoint struct {
+	offset int64
+	chunks int
+	sum    []byte
+}
+
+// markResumePoint records the current offset as one the transfer can be
+// rewound to. s must be locked by its client.
+func (s *MessageState) markResumePoint() {
+	m, ok := s.sum.(encoding.BinaryMarshaler)
+	if !ok {
+		return
+	}
+	sum, err := m.MarshalBinary()
+	if err != nil {
+		return
+	}
+	if len(s.resumePoints) >= maxResumePoints {
+		// Keep the start so a receiver can always start over.
+		s.resumePoints = append(s.resumePoints[:1], s.resumePoints[2:]...)
+	}
+	s.resumePoints = append(s.resumePoints, resumePoint{offset: s.FileReceived, chunks: s.Chunks, sum: sum})
+}
+
+// rewind resets the transfer to offset, which must be a recorded chunk
+// boundary, and forgets the boundaries after it.
+func (s *MessageState) rewind(offset int64) bool {
+	for i := len(s.resumePoints) - 1; i >= 0; i-- {
+		p := s.resumePoints[i]
+		if p.offset != offset {
+			continue
+		}
+		sum := sha256.New()
+		if err := sum.(encoding.BinaryUnmarshaler).UnmarshalBinary(p.sum); err != nil {
+			return false
+		}
+		s.sum = sum
+		s.FileReceived = offset
+		s.Chunks = p.chunks
+		s.resumePoints = s.resumePoints[:i+1]
+		return true
+	}
+	return false
+}
+
+// suspend stops relaying the transfer until it is resumed. s must be
+// locked by its client. It reports false if s was already suspended.
+func (s *MessageState) suspend(now time.Time) bool {
+	if !s.suspendedAt.IsZero() {
+		return false
+	}
+	s.suspendedAt = now
+	s.resumeAsked = false
+	return true
+}
+
+// parkedTransfers holds the file transfers of senders that disconnected,
+// keyed by room and msgId.
+type parkedTransfers struct {
+	mu   sync.Mutex
+	byID map[string]*parkedTransfer
+}
+
+type parkedTransfer struct {
+	state    *MessageState
+	userID   string
+	room     string
+	deviceID string
+}
+
+func transferKey(roomKey, msgID string) string {
+	return roomKey + "\x00" + msgID
+}
+
+// parkTransfers moves this client's unfinished file transfers into the hub
+// so a reconnected connection of the same device can resume them.
+func (c *Client) parkTransfers() {
+	now := time.Now()
+	c.mu.Lock()
+	var parked []*MessageState
+	for msgID, state := range c.activeMessages {
+		if state.File {
+			state.suspend(now)
+			parked = append(parked, state)
+			delete(c.activeMessages, msgID)
+		}
+	}
+	c.mu.Unlock()
+	if len(parked) == 0 {
+		return
+	}
+
+	h := c.hub
+	h.transfers.mu.Lock()
+	defer h.transfers.mu.Unlock()
+	if h.transfers.byID == nil {
+		h.transfers.byID = make(map[string]*parkedTransfer)
+	}
+	for _, state := range parked {
+		h.transfers.byID[transferKey(c.roomKey(), state.MsgID)] = &parkedTransfer{state: state, userID: c.UserID, room: c.Room, deviceID: c.DeviceID}
+	}
+}
+
+// claimTransfer finds the sender of the file transfer msgID that requester
+// is receiving, moving a parked transfer to a connection of its sending
+// device. The code is non-empty when there is none: unknown_transfer if
+// the transfer is finished, expired or not requester's, sender_offline if
+// its device has not reconnected yet.
+func (h *Hub) claimTransfer(requester *Client, msgID string) (*Client, *MessageState, string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients {
+		if client == requester || !client.inRoom(requester) {
+			continue
+		}
+		client.mu.Lock()
+		state, ok := client.activeMessages[msgID]
+		client.mu.Unlock()
+		if ok && state.File {
+			if client.DeviceID == requester.DeviceID || !h.peerAllowed(client.DeviceID, requester.DeviceID) ||
+				state.To != "" && state.To != requester.DeviceID {
+				return nil, nil, "unknown_transfer"
+			}
+			return client, state, ""
+		}
+	}
+
+	h.transfers.mu.Lock()
+	defer h.transfers.mu.Unlock()
+	key := transferKey(requester.roomKey(), msgID)
+	p, ok := h.transfers.byID[key]
+	if !ok || p.deviceID == requester.DeviceID || !h.peerAllowed(p.deviceID, requester.DeviceID) ||
+		p.state.To != "" && p.state.To != requester.DeviceID {
+		return nil, nil, "unknown_transfer"
+	}
+	for client := range h.clients {
+		if client.DeviceID != p.deviceID || client.UserID != p.userID || client.Room != p.room || client.ReadOnly {
+			continue
+		}
+		client.mu.Lock()
+		if len(client.activeMessages) >= maxActiveMsgs {
+			client.mu.Unlock()
+			continue
+		}
+		client.activeMessages[msgID] = p.state
+		client.mu.Unlock()
+		delete(h.transfers.byID, key)
+		return client, p.state, ""
+	}
+	return nil, nil, "sender_offline"
+}
+
+// handleResumeRequest is sent by the receiver of a file transfer with the
+// bytes it holds. The transfer is rewound to that offset and the request
+// forwarded to the sender.
+func (c *Client) handleResumeRequest(data []byte) {
+	var msg struct {
+		V ResumeValue `json:"v"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil || msg.V.MsgID == "" {
+		return
+	}
+	req := msg.V
+
+	sender, state, code := c.hub.claimTransfer(c, req.MsgID)
+	if code == "" {
+		sender.mu.Lock()
+		if state.rewind(req.Offset) {
+			state.suspend(time.Now())
+			state.resumeAsked = true
+			state.resumeOffset = req.Offset
+		} else {
+			code = "bad_offset"
+		}
+		sender.mu.Unlock()
+	}
+	if code != "" {
+		if out, err := NewEvent(EventError, ErrorValue{Code: code, MsgID: req.MsgID}).Marshal(); err == nil {
+			c.Send(out)
+		}
+		return
+	}
+
+	// The sender may disconnect once claimTransfer lets go of the hub
+	// lock; sendToClient checks it is still registered.
+	if out, err := NewEvent(EventResumeRequest, req).Marshal(); err == nil && !c.hub.sendToClient(sender, out) {
+		if out, err := NewEvent(EventError, ErrorValue{Code: "sender_offline", MsgID: req.MsgID}).Marshal(); err == nil {
+			c.Send(out)
+		}
+	}
+}
+
+// handleResumeOK is the sender's answer to a forwarded resume_request. It
+// lifts the suspension and is relayed to the receiver, after which the
+// sender continues from the offset.
+func (c *Client) handleResumeOK(data []byte) {
+	var msg struct {
+		V ResumeValue `json:"v"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	state, ok := c.activeMessages[msg.V.MsgID]
+	if !ok || !state.File || !state.resumeAsked || state.resumeOffset != msg.V.Offset {
+		c.mu.Unlock()
+		return
+	}
+	state.suspendedAt = time.Time{}
+	state.resumeAsked = false
+	state.Dropped = false
+	state.Paused = false
+	state.pausedChunks = 0
+	c.mu.Unlock()
+
+	c.relay(msg.V.MsgID, data)
+}
+
+// expireTransfers aborts parked and suspended transfers older than
+// ResumeTTL.
+func (h *Hub) expireTransfers(now time.Time) {
+	h.transfers.mu.Lock()
+	var expired []*parkedTransfer
+	for key, p := range h.transfers.byID {
+		if now.Sub(p.state.suspendedAt) >= ResumeTTL {
+			expired = append(expired, p)
+			delete(h.transfers.byID, key)
+		}
+	}
+	h.transfers.mu.Unlock()
+
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	// The sender is gone, so tell every connection that could have been
+	// receiving; the others have no such msgId and ignore the abort.
+	for _, p := range expired {
+		abort, err := NewEvent(EventMsgAbort, MsgAbortValue{MsgID: p.state.MsgID, Reason: "resume_expired"}).Marshal()
+		if err != nil {
+			continue
+		}
+		for _, client := range clients {
+			if client.UserID == p.userID && client.Room == p.room && client.DeviceID != p.deviceID && h.peerAllowed(p.deviceID, client.DeviceID) &&
+				(p.state.To == "" || p.state.To == client.DeviceID) {
+				client.Send(abort)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.expireSuspended(now)
+	}
+}
+
+// expireSuspended fails this client's transfers suspended for ResumeTTL.
+func (c *Client) expireSuspended(now time.Time) {
+	c.mu.Lock()
+	var expired []string
+	for msgID, state := range c.activeMessages {
+		if state.File && !state.suspendedAt.IsZero() && now.Sub(state.suspendedAt) >= ResumeTTL {
+			expired = append(expired, msgID)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, msgID := range expired {
+		c.sendFail(msgID, "resume_expired")
+	}
+}
@@ -0,0 +1,76 @@
+package realtime
+
+import "regexp"
+
+// Rooms partition the devices of one user. A client joins the room it
+// names when connecting, or the user's default room "" otherwise, and the
+// hub relays, reports presence and resumes transfers only between clients
+// of the same user in the same room. Pairing enrolls a device into the
+// issuing device's user, so paired devices meet in its default room unless
+// they pick another. A room exists while it has a member.
+
+// MaxRoomIDLen bounds a room ID, in bytes.
+const MaxRoomIDLen = 64
+
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidRoomID reports whether id may name a room: 1 to MaxRoomIDLen
+// letters, digits, '-' or '_'. The default room "" is always valid.
+func ValidRoomID(id string) bool {
+	return id == "" || roomIDPattern.MatchString(id)
+}
+
+// room is the hub's record of an open room.
+type room struct {
+	members map[*Client]bool
+}
+
+// roomKey identifies a room across users.
+func roomKey(userID, room string) string {
+	return userID + "\x00" + room
+}
+
+// roomKey returns the key of the room c joined.
+func (c *Client) roomKey() string {
+	return roomKey(c.UserID, c.Room)
+}
+
+// inRoom reports whether o is in the same room as c.
+func (c *Client) inRoom(o *Client) bool {
+	return c.UserID == o.UserID && c.Room == o.Room
+}
+
+// join adds client to its room, opening the room if it is the first
+// member. h.mu must be held for writing.
+func (h *Hub) join(client *Client) {
+	key := client.roomKey()
+	r, ok := h.rooms[key]
+	if !ok {
+		r = &room{members: make(map[*Client]bool)}
+		h.rooms[key] = r
+		client.Log.Debug("Room opened", "user_id", client.UserID, "room", client.Room)
+	}
+	r.members[client] = true
+}
+
+// leave removes client from its room and closes the room when it was the
+// last member. h.mu must be held for writing.
+func (h *Hub) leave(client *Client) {
+	key := client.roomKey()
+	r, ok := h.rooms[key]
+	if !ok {
+		return
+	}
+	delete(r.members, client)
+	if len(r.members) == 0 {
+		delete(h.rooms, key)
+		client.Log.Debug("Room closed", "user_id", client.UserID, "room", client.Room)
+	}
+}
+
+// RoomCount returns how many rooms have a member.
+func (h *Hub) RoomCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rooms)
+}
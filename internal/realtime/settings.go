@@ -0,0 +1,122 @@
+package realtime
+
+import (
+	"encoding/json"
+)
+
+// Limits on the settings a user can sync. Values are client-side
+// ciphertext, so the server only bounds their size.
+const (
+	MaxSettings        = 64
+	MaxSettingKeyLen   = 64
+	MaxSettingValueLen = 8 * 1024
+)
+
+// Outcomes reported in settings_status besides DeliveryInvalid and
+// DeliveryReadOnly.
+const (
+	SettingsSaved       = "saved"
+	SettingsFull        = "full"
+	SettingsUnavailable = "unavailable"
+)
+
+// SettingsStore persists each user's synced settings. store.Store
+// implements it; an empty value deletes the key.
+type SettingsStore interface {
+	PutSetting(userID, key, value string) error
+	Settings(userID string) (map[string]string, error)
+}
+
+// validSettingKey allows short lowercase keys like "theme" or
+// "paste.format".
+func validSettingKey(key string) bool {
+	if key == "" || len(key) > MaxSettingKeyLen {
+		return false
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// handleSettingsSet stores a setting for the sender's user, pushes it to
+// the user's other connections and answers with settings_status.
+func (c *Client) handleSettingsSet(data []byte) {
+	var msg struct {
+		V SettingsSetValue `json:"v"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil || msg.V.Key == "" {
+		return
+	}
+	set := msg.V
+
+	status := c.saveSetting(set)
+	if status == SettingsSaved {
+		out, err := NewEvent(EventSettingsSet, SettingsSetValue{
+			Key:        set.Key,
+			Ciphertext: set.Ciphertext,
+			From:       c.DeviceID,
+		}).Marshal()
+		if err == nil {
+			c.hub.SendToUser(c, out)
+		}
+	}
+
+	out, err := NewEvent(EventSettingsStatus, SettingsStatusValue{Key: set.Key, Status: status}).Marshal()
+	if err != nil {
+		return
+	}
+	c.Send(out)
+}
+
+func (c *Client) saveSetting(set SettingsSetValue) string {
+	if c.ReadOnly {
+		return DeliveryReadOnly
+	}
+	if !validSettingKey(set.Key) || len(set.Ciphertext) > MaxSettingValueLen {
+		return DeliveryInvalid
+	}
+	s := c.hub.settingsStore()
+	if s == nil {
+		return SettingsUnavailable
+	}
+
+	if set.Ciphertext != "" {
+		current, err := s.Settings(c.UserID)
+		if err != nil {
+			c.Log.Error("Settings lookup failed", "err", err)
+			return SettingsUnavailable
+		}
+		if _, ok := current[set.Key]; !ok && len(current) >= MaxSettings {
+			return SettingsFull
+		}
+	}
+	if err := s.PutSetting(c.UserID, set.Key, set.Ciphertext); err != nil {
+		c.Log.Error("Failed to save setting", "err", err)
+		return SettingsUnavailable
+	}
+	return SettingsSaved
+}
+
+// handleSettingsGet answers with every stored setting of the sender's user.
+func (c *Client) handleSettingsGet() {
+	settings := map[string]string{}
+	if s := c.hub.settingsStore(); s != nil {
+		stored, err := s.Settings(c.UserID)
+		if err != nil {
+			c.Log.Error("Settings lookup failed", "err", err)
+		} else {
+			settings = stored
+		}
+	}
+
+	out, err := NewEvent(EventSettingsValues, SettingsValuesValue{Settings: settings}).Marshal()
+	if err != nil {
+		return
+	}
+	c.Send(out)
+}
@@ -0,0 +1,82 @@
+package realtime
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Text policies for para_chunk text that is not valid UTF-8 or carries
+// control characters a receiver may choke on.
+const (
+	// TextPolicyOff relays chunk text exactly as sent.
+	TextPolicyOff = "off"
+	// TextPolicyReject fails the message with send_fail.
+	TextPolicyReject = "reject"
+	// TextPolicySanitize relays a cleaned copy: invalid sequences become
+	// U+FFFD and control characters are dropped. Atomic messages are
+	// rejected instead, since changing their text breaks the checksum.
+	TextPolicySanitize = "sanitize"
+)
+
+// send_fail reasons for chunk text refused by the text policy.
+const (
+	ReasonInvalidUTF8  = "invalid_utf8"
+	ReasonControlChars = "control_characters"
+)
+
+const defaultTextPolicy = TextPolicySanitize
+
+// ParseTextPolicy checks a TEXT_POLICY value. Empty means the default,
+// TextPolicySanitize.
+func ParseTextPolicy(s string) (string, error) {
+	switch s {
+	case "":
+		return defaultTextPolicy, nil
+	case TextPolicyOff, TextPolicyReject, TextPolicySanitize:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown text policy %q: want off, reject or sanitize", s)
+}
+
+// chunkTextProblem returns the send_fail reason for chunk text the policy
+// should act on, or "" if it is clean. raw is the event as received: JSON
+// decoding already replaced invalid bytes and lone surrogate escapes with
+// U+FFFD in text, so those are found by comparing the two.
+func chunkTextProblem(raw []byte, text string) string {
+	if !utf8.Valid(raw) {
+		return ReasonInvalidUTF8
+	}
+	if strings.Contains(text, "\uFFFD") &&
+		!bytes.Contains(raw, []byte("\uFFFD")) &&
+		!bytes.Contains(bytes.ToLower(raw), []byte(`\ufffd`)) {
+		return ReasonInvalidUTF8
+	}
+	if strings.IndexFunc(text, isUnsafeControl) >= 0 {
+		return ReasonControlChars
+	}
+	return ""
+}
+
+// isUnsafeControl reports C0 controls other than tab, newline and
+// carriage return, DEL and the C1 controls.
+func isUnsafeControl(r rune) bool {
+	switch r {
+	case '\t', '\n', '\r':
+		return false
+	}
+	return r < 0x20 || (r >= 0x7f && r <= 0x9f)
+}
+
+// SanitizeText replaces invalid UTF-8 with U+FFFD and drops the control
+// characters isUnsafeControl rejects.
+func SanitizeText(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	return strings.Map(func(r rune) rune {
+		if isUnsafeControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,64 @@
+package realtime
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidVersion = errors.New("invalid client version")
+
+// ParseVersion parses a dotted numeric client version such as "1.4" or
+// "2.0.3". A leading "v" and any "-prerelease" or "+build" suffix are
+// ignored.
+func ParseVersion(s string) ([]int, error) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	if s == "" {
+		return nil, ErrInvalidVersion
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 4 {
+		return nil, ErrInvalidVersion
+	}
+	v := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || p != strconv.Itoa(n) {
+			return nil, ErrInvalidVersion
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// VersionBelow reports whether client is older than min. Missing
+// components count as zero, so "1.2" equals "1.2.0". A client version that
+// does not parse, including an empty one, is below every minimum.
+func VersionBelow(client, min string) bool {
+	want, err := ParseVersion(min)
+	if err != nil {
+		return false
+	}
+	have, err := ParseVersion(client)
+	if err != nil {
+		return true
+	}
+
+	for i := 0; i < len(have) || i < len(want); i++ {
+		var h, w int
+		if i < len(have) {
+			h = have[i]
+		}
+		if i < len(want) {
+			w = want[i]
+		}
+		if h != w {
+			return h < w
+		}
+	}
+	return false
+}
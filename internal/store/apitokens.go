@@ -0,0 +1,124 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+
+	sqlite "modernc.org/sqlite"
+	lib "modernc.org/sqlite/lib"
+)
+
+var (
+	ErrAPITokenExists   = errors.New("api token name already used")
+	ErrAPITokenNotFound = errors.New("api token not found")
+)
+
+// APIToken is a named bearer token a device minted for a headless client.
+// Only the SHA-256 of the token itself is stored.
+type APIToken struct {
+	ID         string `json:"id"`
+	DeviceID   string `json:"device_id"`
+	Name       string `json:"name"`
+	Scope      string `json:"scope"`
+	Hash       string `json:"-"`
+	CreatedAt  int64  `json:"created_at"`
+	LastUsedAt int64  `json:"last_used_at"`
+}
+
+const apiTokenColumns = "id, device_id, name, scope, token_hash, created_at, last_used_at"
+
+func scanAPIToken(row interface{ Scan(...any) error }) (*APIToken, error) {
+	var t APIToken
+	if err := row.Scan(&t.ID, &t.DeviceID, &t.Name, &t.Scope, &t.Hash, &t.CreatedAt, &t.LastUsedAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CreateAPIToken stores t. It returns ErrAPITokenExists when the device
+// already has a token with the same name.
+func (s *Store) CreateAPIToken(t *APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT INTO api_tokens ("+apiTokenColumns+") VALUES (?, ?, ?, ?, ?, ?, 0)",
+		t.ID, t.DeviceID, t.Name, t.Scope, t.Hash, t.CreatedAt,
+	)
+	if err != nil {
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) &&
+			(sqliteErr.Code() == lib.SQLITE_CONSTRAINT_PRIMARYKEY ||
+				sqliteErr.Code() == lib.SQLITE_CONSTRAINT_UNIQUE) {
+			return ErrAPITokenExists
+		}
+		return err
+	}
+	return nil
+}
+
+// GetAPITokenByHash returns the token whose hash is hash, or
+// ErrAPITokenNotFound.
+func (s *Store) GetAPITokenByHash(hash string) (*APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, err := scanAPIToken(s.db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_hash = ?", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPITokenNotFound
+	}
+	return t, err
+}
+
+// ListAPITokens returns the tokens of deviceID, oldest first.
+func (s *Store) ListAPITokens(deviceID string) ([]APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(
+		"SELECT "+apiTokenColumns+" FROM api_tokens WHERE device_id = ? ORDER BY created_at, id", deviceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// TouchAPIToken records that token id was used at usedAt (Unix ms).
+func (s *Store) TouchAPIToken(id string, usedAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", usedAt, id)
+	return err
+}
+
+// DeleteAPIToken revokes token id of deviceID. It returns
+// ErrAPITokenNotFound when the device has no such token.
+func (s *Store) DeleteAPIToken(deviceID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM api_tokens WHERE id = ? AND device_id = ?", id, deviceID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	sqlite "modernc.org/sqlite"
+	lib "modernc.org/sqlite/lib"
+)
+
+var (
+	ErrAppTokenExists   = errors.New("app token name already used")
+	ErrAppTokenNotFound = errors.New("app token not found")
+)
+
+// AppToken is a send-only bearer token an admin created for a script or
+// home-automation system. It may only push to the devices in DeviceIDs.
+// Only the SHA-256 of the token itself is stored.
+type AppToken struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	DeviceIDs  []string `json:"device_ids"`
+	Hash       string   `json:"-"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt int64    `json:"last_used_at"`
+}
+
+const appTokenColumns = "id, name, device_ids, token_hash, created_at, last_used_at"
+
+func scanAppToken(row interface{ Scan(...any) error }) (*AppToken, error) {
+	var t AppToken
+	var devices string
+	if err := row.Scan(&t.ID, &t.Name, &devices, &t.Hash, &t.CreatedAt, &t.LastUsedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(devices), &t.DeviceIDs); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CreateAppToken stores t. It returns ErrAppTokenExists when another app
+// token has the same name.
+func (s *Store) CreateAppToken(t *AppToken) error {
+	devices, err := json.Marshal(t.DeviceIDs)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.db.Exec(
+		"INSERT INTO app_tokens ("+appTokenColumns+") VALUES (?, ?, ?, ?, ?, 0)",
+		t.ID, t.Name, string(devices), t.Hash, t.CreatedAt,
+	)
+	if err != nil {
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) &&
+			(sqliteErr.Code() == lib.SQLITE_CONSTRAINT_PRIMARYKEY ||
+				sqliteErr.Code() == lib.SQLITE_CONSTRAINT_UNIQUE) {
+			return ErrAppTokenExists
+		}
+		return err
+	}
+	return nil
+}
+
+// GetAppTokenByHash returns the app token whose hash is hash, or
+// ErrAppTokenNotFound.
+func (s *Store) GetAppTokenByHash(hash string) (*AppToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, err := scanAppToken(s.db.QueryRow("SELECT "+appTokenColumns+" FROM app_tokens WHERE token_hash = ?", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAppTokenNotFound
+	}
+	return t, err
+}
+
+// ListAppTokens returns every app token, oldest first.
+func (s *Store) ListAppTokens() ([]AppToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query("SELECT " + appTokenColumns + " FROM app_tokens ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []AppToken{}
+	for rows.Next() {
+		t, err := scanAppToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// TouchAppToken records that app token id was used at usedAt (Unix ms).
+func (s *Store) TouchAppToken(id string, usedAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec("UPDATE app_tokens SET last_used_at = ? WHERE id = ?", usedAt, id)
+	return err
+}
+
+// DeleteAppToken revokes app token id. It returns ErrAppTokenNotFound when
+// there is no such token.
+func (s *Store) DeleteAppToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM app_tokens WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAppTokenNotFound
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"errors"
+	"math"
+)
+
+// Connection attempt outcomes recorded by the WebSocket handler.
+const (
+	ConnOutcomeAccepted       = "accepted"
+	ConnOutcomeAuthFailed     = "auth_failed"
+	ConnOutcomeLimitRejected  = "limit_rejected"
+	ConnOutcomeUpgradeFailed  = "upgrade_failed"
+	ConnOutcomeClientOutdated = "client_outdated"
+)
+
+var ErrConnAttemptNotFound = errors.New("connection attempt not found")
+
+// ConnAttempt is one WebSocket upgrade attempt and, for accepted
+// connections, how it ended.
+type ConnAttempt struct {
+	ID          int64  `json:"id"`
+	DeviceID    string `json:"device_id"`
+	Outcome     string `json:"outcome"`
+	Reason      string `json:"reason,omitempty"`
+	IP          string `json:"ip"`
+	UserAgent   string `json:"user_agent"`
+	Origin      string `json:"origin"`
+	Extensions  string `json:"extensions,omitempty"`
+	Subprotocol string `json:"subprotocol,omitempty"`
+	TLSVersion  string `json:"tls_version,omitempty"`
+	TLSCipher   string `json:"tls_cipher,omitempty"`
+	// Locale and TimeZone are what the client declared at connect time.
+	Locale    string `json:"locale,omitempty"`
+	TimeZone  string `json:"tz,omitempty"`
+	CloseCode int    `json:"close_code,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	ClosedAt  int64  `json:"closed_at,omitempty"`
+}
+
+// RecordConnAttempt stores a connection attempt and returns its ID.
+func (s *Store) RecordConnAttempt(a *ConnAttempt) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec(`
+		INSERT INTO connection_attempts
+			(device_id, outcome, reason, ip, user_agent, origin, extensions, subprotocol, tls_version, tls_cipher, locale, timezone, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.DeviceID, a.Outcome, a.Reason, a.IP, a.UserAgent, a.Origin, a.Extensions, a.Subprotocol, a.TLSVersion, a.TLSCipher, a.Locale, a.TimeZone, a.CreatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// CloseConnAttempt records how an accepted connection ended.
+func (s *Store) CloseConnAttempt(id int64, closeCode int, closedAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec(
+		"UPDATE connection_attempts SET close_code = ?, closed_at = ? WHERE id = ?",
+		closeCode, closedAt, id,
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrConnAttemptNotFound
+	}
+	return nil
+}
+
+// ListConnAttempts returns the most recent attempts for a device, newest first.
+func (s *Store) ListConnAttempts(deviceID string, limit int) ([]ConnAttempt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, device_id, outcome, reason, ip, user_agent, origin, extensions, subprotocol, tls_version, tls_cipher, locale, timezone, close_code, created_at, closed_at
+		FROM connection_attempts WHERE device_id = ? ORDER BY id DESC LIMIT ?`,
+		deviceID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []ConnAttempt{}
+	for rows.Next() {
+		var a ConnAttempt
+		if err := rows.Scan(&a.ID, &a.DeviceID, &a.Outcome, &a.Reason, &a.IP, &a.UserAgent, &a.Origin,
+			&a.Extensions, &a.Subprotocol, &a.TLSVersion, &a.TLSCipher, &a.Locale, &a.TimeZone, &a.CloseCode, &a.CreatedAt, &a.ClosedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// ListConnIntervals returns up to limit accepted connections of a device
+// with IDs below before (zero for no bound), newest first. Each is a span
+// the device was online, from CreatedAt to ClosedAt.
+func (s *Store) ListConnIntervals(deviceID string, before int64, limit int) ([]ConnAttempt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	rows, err := s.db.Query(`
+		SELECT id, device_id, outcome, reason, ip, user_agent, origin, extensions, subprotocol, tls_version, tls_cipher, close_code, created_at, closed_at
+		FROM connection_attempts WHERE device_id = ? AND outcome = ? AND id < ? ORDER BY id DESC LIMIT ?`,
+		deviceID, ConnOutcomeAccepted, before, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []ConnAttempt{}
+	for rows.Next() {
+		var a ConnAttempt
+		if err := rows.Scan(&a.ID, &a.DeviceID, &a.Outcome, &a.Reason, &a.IP, &a.UserAgent, &a.Origin,
+			&a.Extensions, &a.Subprotocol, &a.TLSVersion, &a.TLSCipher, &a.CloseCode, &a.CreatedAt, &a.ClosedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// PruneConnAttempts deletes attempts created before the given time and
+// returns the number removed.
+func (s *Store) PruneConnAttempts(before int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM connection_attempts WHERE created_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,65 @@
+package store
+
+// CertReport is a client's report of a TLS certificate that did not match
+// the server's pinned fingerprints.
+type CertReport struct {
+	ID          int64  `json:"id"`
+	DeviceID    string `json:"device_id"`
+	Fingerprint string `json:"fingerprint"`
+	IP          string `json:"ip"`
+	UserAgent   string `json:"user_agent"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+// RecordCertReport stores r and returns its ID.
+func (s *Store) RecordCertReport(r *CertReport) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec(`
+		INSERT INTO cert_reports (device_id, fingerprint, ip, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		r.DeviceID, r.Fingerprint, r.IP, r.UserAgent, r.CreatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListCertReports returns the most recent reports, newest first.
+func (s *Store) ListCertReports(limit int) ([]CertReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, device_id, fingerprint, ip, user_agent, created_at
+		FROM cert_reports ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []CertReport{}
+	for rows.Next() {
+		var r CertReport
+		if err := rows.Scan(&r.ID, &r.DeviceID, &r.Fingerprint, &r.IP, &r.UserAgent, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// PruneCertReports deletes reports created before the given time and
+// returns the number removed.
+func (s *Store) PruneCertReports(before int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM cert_reports WHERE created_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
+)
+
+// InsertChallenge stores c for auth.DBChallengeStore.
+func (s *Store) InsertChallenge(c *auth.Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT INTO challenges (id, device_id, nonce, expires_at) VALUES (?, ?, ?, ?)",
+		c.ID, c.DeviceID, c.Nonce, c.ExpiresAt.UnixMilli(),
+	)
+	return err
+}
+
+// TakeChallenge deletes the challenge with id and returns it. The delete and
+// read are one statement, so two instances racing on the same ID cannot
+// both redeem it.
+func (s *Store) TakeChallenge(id string) (*auth.Challenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &auth.Challenge{ID: id}
+	var expiresAt int64
+	err := s.db.QueryRow(
+		"DELETE FROM challenges WHERE id = ? RETURNING device_id, nonce, expires_at",
+		id,
+	).Scan(&c.DeviceID, &c.Nonce, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, auth.ErrChallengeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.ExpiresAt = time.UnixMilli(expiresAt)
+	return c, nil
+}
+
+// CountChallenges returns the number of unexpired challenges for deviceID.
+func (s *Store) CountChallenges(deviceID string, now time.Time) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n int
+	err := s.db.QueryRow(
+		"SELECT COUNT(*) FROM challenges WHERE device_id = ? AND expires_at > ?",
+		deviceID, now.UnixMilli(),
+	).Scan(&n)
+	return n, err
+}
+
+// PruneChallenges deletes challenges that expired before cutoff (Unix ms)
+// and returns the number removed.
+func (s *Store) PruneChallenges(cutoff int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM challenges WHERE expires_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
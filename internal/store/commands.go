@@ -0,0 +1,66 @@
+package store
+
+// SetAllowedCommands replaces the set of command actions deviceID accepts
+// from other devices. An empty list disables the command channel for it.
+func (s *Store) SetAllowedCommands(deviceID string, actions []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM device_commands WHERE device_id = ?", deviceID); err != nil {
+		return err
+	}
+	for _, action := range actions {
+		if _, err := tx.Exec(
+			"INSERT OR IGNORE INTO device_commands (device_id, action) VALUES (?, ?)",
+			deviceID, action,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AllowedCommands returns the actions deviceID accepts, sorted by name.
+func (s *Store) AllowedCommands(deviceID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(
+		"SELECT action FROM device_commands WHERE device_id = ? ORDER BY action",
+		deviceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []string{}
+	for rows.Next() {
+		var action string
+		if err := rows.Scan(&action); err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+// CommandAllowed reports whether deviceID accepts action. It satisfies
+// realtime.CommandAuthorizer.
+func (s *Store) CommandAllowed(deviceID, action string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n int
+	err := s.db.QueryRow(
+		"SELECT COUNT(*) FROM device_commands WHERE device_id = ? AND action = ?",
+		deviceID, action,
+	).Scan(&n)
+	return n > 0, err
+}
@@ -54,8 +54,41 @@ func (s *Store) DeleteConfig(key string) error {
 	return nil
 }
 
+// SetConfigs sets the keys in set and removes the keys in del in one
+// transaction, so either all of them change or none does. Removing a key
+// that does not exist is not an error.
+func (s *Store) SetConfigs(set map[string]string, del []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for key, value := range set {
+		if _, err := tx.Exec(
+			"INSERT INTO config (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value",
+			key, value,
+		); err != nil {
+			return err
+		}
+	}
+	for _, key := range del {
+		if _, err := tx.Exec("DELETE FROM config WHERE key = ?", key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 // Config keys used by the application.
 const (
-	ConfigKeySecretHash = "secret_hash"
-	ConfigKeyAppDomain  = "app_domain"
+	ConfigKeySecretHash      = "secret_hash"
+	ConfigKeyAdminSecretHash = "admin_secret_hash"
+	ConfigKeyAppDomain       = "app_domain"
+	// ConfigKeyFeaturePrefix followed by a flag name holds that feature
+	// flag, see package feature.
+	ConfigKeyFeaturePrefix = "feature."
 )
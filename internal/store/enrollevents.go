@@ -0,0 +1,83 @@
+package store
+
+// Credentials an enrollment request can be authorised by.
+const (
+	EnrollCredentialBootstrap = "bootstrap"
+	EnrollCredentialPairing   = "pairing"
+)
+
+// Enrollment event outcomes. A credential that reaches its limit of
+// invalid payloads records EnrollOutcomeLocked instead of
+// EnrollOutcomeInvalidPayload for the payload that locked it.
+const (
+	EnrollOutcomeInvalidPayload = "invalid_payload"
+	EnrollOutcomeLocked         = "locked"
+)
+
+// EnrollEvent is an enrollment attempt that presented a valid bootstrap
+// token or pairing code with an invalid device payload.
+type EnrollEvent struct {
+	ID         int64  `json:"id"`
+	Credential string `json:"credential"`
+	// IssuedBy is the device that issued the pairing code; empty for the
+	// bootstrap token. The code itself is never stored.
+	IssuedBy  string `json:"issued_by,omitempty"`
+	Outcome   string `json:"outcome"`
+	Reason    string `json:"reason"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// RecordEnrollEvent stores e and returns its ID.
+func (s *Store) RecordEnrollEvent(e *EnrollEvent) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec(`
+		INSERT INTO enroll_events (credential, issued_by, outcome, reason, ip, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		e.Credential, e.IssuedBy, e.Outcome, e.Reason, e.IP, e.UserAgent, e.CreatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListEnrollEvents returns the most recent events, newest first.
+func (s *Store) ListEnrollEvents(limit int) ([]EnrollEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT id, credential, issued_by, outcome, reason, ip, user_agent, created_at
+		FROM enroll_events ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []EnrollEvent{}
+	for rows.Next() {
+		var e EnrollEvent
+		if err := rows.Scan(&e.ID, &e.Credential, &e.IssuedBy, &e.Outcome, &e.Reason, &e.IP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// PruneEnrollEvents deletes events created before the given time and
+// returns the number removed.
+func (s *Store) PruneEnrollEvents(before int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM enroll_events WHERE created_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,134 @@
+package store
+
+import "time"
+
+// Peer links restrict which devices may exchange realtime events. A device
+// with no links talks to every device of its user that also has none; once
+// linked, it only talks to the devices it is linked with. Links are stored
+// in both directions.
+
+// peerCacheTTL bounds how long PeerAllowed answers from a snapshot of the
+// links. Changes made through this Store drop the snapshot at once; the
+// TTL only matters for changes made by another replica sharing the file.
+const peerCacheTTL = 10 * time.Second
+
+// peerLinks is an immutable snapshot of device_peers: links[a][b] is set
+// when a is linked with b.
+type peerLinks struct {
+	links    map[string]map[string]bool
+	loadedAt time.Time
+}
+
+// SetPeers replaces the devices deviceID is linked with. An empty list
+// lifts its restriction.
+func (s *Store) SetPeers(deviceID string, peers []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"DELETE FROM device_peers WHERE device_id = ? OR peer_id = ?",
+		deviceID, deviceID,
+	); err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if peer == deviceID {
+			continue
+		}
+		if _, err := tx.Exec(
+			"INSERT OR IGNORE INTO device_peers (device_id, peer_id) VALUES (?, ?), (?, ?)",
+			deviceID, peer, peer, deviceID,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.peers.Store(nil)
+	return nil
+}
+
+// Peers returns the devices deviceID is linked with, sorted by ID. An
+// empty list means it is unrestricted.
+func (s *Store) Peers(deviceID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(
+		"SELECT peer_id FROM device_peers WHERE device_id = ? ORDER BY peer_id",
+		deviceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	peers := []string{}
+	for rows.Next() {
+		var peer string
+		if err := rows.Scan(&peer); err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+	return peers, rows.Err()
+}
+
+// PeerAllowed reports whether a and b may exchange events: they are linked,
+// or neither has any links. It satisfies realtime.PeerPolicy.
+//
+// The hub asks once per candidate receiver of every relayed event while
+// holding its lock, so the answer comes from an in-memory snapshot rather
+// than a query; only a missing or stale snapshot touches the database.
+func (s *Store) PeerAllowed(a, b string) (bool, error) {
+	if a == b {
+		return true, nil
+	}
+
+	p := s.peers.Load()
+	if p == nil || time.Since(p.loadedAt) > peerCacheTTL {
+		var err error
+		if p, err = s.loadPeerLinks(); err != nil {
+			return false, err
+		}
+	}
+	linked := p.links[a][b]
+	restricted := len(p.links[a]) > 0 || len(p.links[b]) > 0
+	return linked || !restricted, nil
+}
+
+// loadPeerLinks reads every link into a fresh snapshot and caches it.
+func (s *Store) loadPeerLinks() (*peerLinks, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query("SELECT device_id, peer_id FROM device_peers")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	p := &peerLinks{links: make(map[string]map[string]bool), loadedAt: time.Now()}
+	for rows.Next() {
+		var device, peer string
+		if err := rows.Scan(&device, &peer); err != nil {
+			return nil, err
+		}
+		if p.links[device] == nil {
+			p.links[device] = make(map[string]bool)
+		}
+		p.links[device][peer] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.peers.Store(p)
+	return p, nil
+}
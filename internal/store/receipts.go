@@ -0,0 +1,72 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// TransferReceipt is the signed record of an atomic message or file
+// transfer that both ends confirmed. It names the devices and the
+// checksum they agreed on, never content. Times are Unix milliseconds.
+type TransferReceipt struct {
+	ID          string `json:"id"`
+	UserID      string `json:"user_id"`
+	MsgID       string `json:"msg_id"`
+	Sender      string `json:"sender"`
+	Receiver    string `json:"receiver"`
+	File        bool   `json:"file"`
+	Chunks      int    `json:"chunks"`
+	Bytes       int64  `json:"bytes"`
+	SHA256      string `json:"sha256"`
+	StartedAt   int64  `json:"started_at"`
+	CommittedAt int64  `json:"committed_at"`
+	Signature   string `json:"signature"`
+}
+
+// ErrReceiptNotFound is returned for an unknown receipt ID.
+var ErrReceiptNotFound = errors.New("transfer receipt not found")
+
+// PutTransferReceipt stores r.
+func (s *Store) PutTransferReceipt(r *TransferReceipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT INTO transfer_receipts (id, user_id, msg_id, sender, receiver, file, chunks, bytes, sha256, started_at, committed_at, signature)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, r.UserID, r.MsgID, r.Sender, r.Receiver, r.File, r.Chunks, r.Bytes, r.SHA256, r.StartedAt, r.CommittedAt, r.Signature,
+	)
+	return err
+}
+
+// GetTransferReceipt returns the receipt with the given ID.
+func (s *Store) GetTransferReceipt(id string) (*TransferReceipt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var r TransferReceipt
+	err := s.db.QueryRow(`
+		SELECT id, user_id, msg_id, sender, receiver, file, chunks, bytes, sha256, started_at, committed_at, signature
+		FROM transfer_receipts WHERE id = ?`, id,
+	).Scan(&r.ID, &r.UserID, &r.MsgID, &r.Sender, &r.Receiver, &r.File, &r.Chunks, &r.Bytes, &r.SHA256, &r.StartedAt, &r.CommittedAt, &r.Signature)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrReceiptNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// PruneTransferReceipts deletes receipts committed before the given time
+// and returns the number removed.
+func (s *Store) PruneTransferReceipts(before int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM transfer_receipts WHERE committed_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
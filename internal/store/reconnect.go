@@ -0,0 +1,68 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ReconnectGrant lets a device open a WebSocket again for a short while
+// without a device ticket or session cookie, after the server closed its
+// connection. Only the SHA-256 of the token is stored. ExpiresAt is Unix
+// milliseconds.
+type ReconnectGrant struct {
+	Hash      string
+	DeviceID  string
+	SessionID string
+	ReadOnly  bool
+	ExpiresAt int64
+}
+
+// ErrReconnectGrantNotFound is returned for an unknown, used or expired
+// reconnect token.
+var ErrReconnectGrantNotFound = errors.New("reconnect grant not found")
+
+// PutReconnectGrant stores g.
+func (s *Store) PutReconnectGrant(g *ReconnectGrant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT INTO reconnect_grants (token_hash, device_id, session_id, read_only, expires_at) VALUES (?, ?, ?, ?, ?)",
+		g.Hash, g.DeviceID, g.SessionID, g.ReadOnly, g.ExpiresAt,
+	)
+	return err
+}
+
+// TakeReconnectGrant deletes the grant whose hash is hash and returns it
+// if it has not expired by now (Unix ms). Like TakeChallenge, a grant can
+// be redeemed once.
+func (s *Store) TakeReconnectGrant(hash string, now int64) (*ReconnectGrant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := &ReconnectGrant{Hash: hash}
+	err := s.db.QueryRow(
+		"DELETE FROM reconnect_grants WHERE token_hash = ? RETURNING device_id, session_id, read_only, expires_at",
+		hash,
+	).Scan(&g.DeviceID, &g.SessionID, &g.ReadOnly, &g.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && g.ExpiresAt < now) {
+		return nil, ErrReconnectGrantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// PruneReconnectGrants deletes grants that expired before cutoff (Unix ms)
+// and returns the number removed.
+func (s *Store) PruneReconnectGrants(cutoff int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM reconnect_grants WHERE expires_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
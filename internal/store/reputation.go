@@ -0,0 +1,58 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// AuthStats summarises a device's authentication history.
+type AuthStats struct {
+	DeviceID      string `json:"device_id"`
+	Successes     int    `json:"successes"`
+	Failures      int    `json:"failures"`
+	LastSuccessAt int64  `json:"last_success_at"`
+	LastFailureAt int64  `json:"last_failure_at"`
+}
+
+// RecordAuthSuccess increments the success counter for a device.
+func (s *Store) RecordAuthSuccess(deviceID string, at int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT INTO device_auth_stats (device_id, successes, last_success_at) VALUES (?, 1, ?)
+		ON CONFLICT(device_id) DO UPDATE SET successes = successes + 1, last_success_at = excluded.last_success_at`,
+		deviceID, at,
+	)
+	return err
+}
+
+// RecordAuthFailure increments the failure counter for a device.
+func (s *Store) RecordAuthFailure(deviceID string, at int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT INTO device_auth_stats (device_id, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT(device_id) DO UPDATE SET failures = failures + 1, last_failure_at = excluded.last_failure_at`,
+		deviceID, at,
+	)
+	return err
+}
+
+// GetAuthStats returns the authentication history for a device.
+// Devices without any recorded history yield zeroed stats.
+func (s *Store) GetAuthStats(deviceID string) (*AuthStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st := AuthStats{DeviceID: deviceID}
+	err := s.db.QueryRow(
+		"SELECT successes, failures, last_success_at, last_failure_at FROM device_auth_stats WHERE device_id = ?",
+		deviceID,
+	).Scan(&st.Successes, &st.Failures, &st.LastSuccessAt, &st.LastFailureAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return &st, nil
+}
@@ -0,0 +1,40 @@
+package store
+
+// RevokeSession records sid as revoked until expiresAt (Unix ms), after which
+// the token would have expired anyway and the row can be pruned.
+func (s *Store) RevokeSession(sid string, revokedAt, expiresAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT OR IGNORE INTO revoked_sessions (sid, revoked_at, expires_at) VALUES (?, ?, ?)",
+		sid, revokedAt, expiresAt,
+	)
+	return err
+}
+
+// IsSessionRevoked reports whether sid has been revoked.
+func (s *Store) IsSessionRevoked(sid string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM revoked_sessions WHERE sid = ?", sid).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// PruneRevokedSessions deletes revocations whose tokens expired before
+// cutoff (Unix ms) and returns the number removed.
+func (s *Store) PruneRevokedSessions(cutoff int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM revoked_sessions WHERE expires_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
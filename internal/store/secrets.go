@@ -0,0 +1,109 @@
+package store
+
+import (
+	"errors"
+
+	sqlite "modernc.org/sqlite"
+	lib "modernc.org/sqlite/lib"
+)
+
+var (
+	ErrLoginSecretExists   = errors.New("login secret name already used")
+	ErrLoginSecretNotFound = errors.New("login secret not found")
+)
+
+// LoginSecret is an extra secret a user can log in with besides their
+// main one. Sessions it starts get at most Scope, so a kiosk can be given
+// a secret that only receives. Only the Argon2id hash is stored.
+type LoginSecret struct {
+	UserID     string `json:"user_id"`
+	Name       string `json:"name"`
+	SecretHash string `json:"-"`
+	Scope      string `json:"scope"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// CreateLoginSecret stores ls. It returns ErrLoginSecretExists when the
+// user already has a secret with that name.
+func (s *Store) CreateLoginSecret(ls *LoginSecret) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT INTO login_secrets (user_id, name, secret_hash, scope, created_at) VALUES (?, ?, ?, ?, ?)",
+		ls.UserID, ls.Name, ls.SecretHash, ls.Scope, ls.CreatedAt,
+	)
+	if err != nil {
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code() == lib.SQLITE_CONSTRAINT_PRIMARYKEY {
+			return ErrLoginSecretExists
+		}
+		return err
+	}
+	return nil
+}
+
+// ListLoginSecrets returns userID's named secrets, oldest first.
+func (s *Store) ListLoginSecrets(userID string) ([]LoginSecret, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(
+		"SELECT user_id, name, secret_hash, scope, created_at FROM login_secrets WHERE user_id = ? ORDER BY created_at, name",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := []LoginSecret{}
+	for rows.Next() {
+		var ls LoginSecret
+		if err := rows.Scan(&ls.UserID, &ls.Name, &ls.SecretHash, &ls.Scope, &ls.CreatedAt); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, ls)
+	}
+	return secrets, rows.Err()
+}
+
+// SetLoginSecretHash replaces the hash of userID's secret name, after a
+// re-hash with stronger parameters.
+func (s *Store) SetLoginSecretHash(userID, name, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("UPDATE login_secrets SET secret_hash = ? WHERE user_id = ? AND name = ?", hash, userID, name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLoginSecretNotFound
+	}
+	return nil
+}
+
+// DeleteLoginSecret removes userID's secret name. It returns
+// ErrLoginSecretNotFound when there is none.
+func (s *Store) DeleteLoginSecret(userID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM login_secrets WHERE user_id = ? AND name = ?", userID, name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLoginSecretNotFound
+	}
+	return nil
+}
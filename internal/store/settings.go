@@ -0,0 +1,48 @@
+package store
+
+import "time"
+
+// Settings are per-user key-value pairs clients sync through the realtime
+// settings_set/settings_get events. Values are encrypted by the clients;
+// the server only stores the ciphertext.
+
+// PutSetting stores value under key for userID, replacing any previous
+// value. An empty value deletes the key. It satisfies
+// realtime.SettingsStore.
+func (s *Store) PutSetting(userID, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value == "" {
+		_, err := s.db.Exec("DELETE FROM user_settings WHERE user_id = ? AND key = ?", userID, key)
+		return err
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO user_settings (user_id, key, value, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		userID, key, value, time.Now().UnixMilli(),
+	)
+	return err
+}
+
+// Settings returns every stored setting of userID by key.
+func (s *Store) Settings(userID string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query("SELECT key, value FROM user_settings WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		settings[key] = value
+	}
+	return settings, rows.Err()
+}
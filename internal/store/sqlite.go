@@ -2,10 +2,13 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	sqlite "modernc.org/sqlite"
 	lib "modernc.org/sqlite/lib"
@@ -15,11 +18,35 @@ import (
 type Store struct {
 	db *sql.DB
 	mu sync.RWMutex
+	// peers caches the peer links for PeerAllowed; nil until loaded or
+	// after a change.
+	peers atomic.Pointer[peerLinks]
+}
+
+// Options tune the SQLite connection. The zero value keeps SQLite's
+// defaults.
+type Options struct {
+	// CacheKiB caps the page cache of each connection, in KiB.
+	CacheKiB int
 }
 
 // New creates a new Store and initializes the database schema.
 func New(dbPath string) (*Store, error) {
-	db, err := sql.Open("sqlite", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	return Open(dbPath, Options{})
+}
+
+// Open is New with connection options.
+func Open(dbPath string, opts Options) (*Store, error) {
+	// The driver runs each _pragma on every connection the pool opens.
+	// Without busy_timeout a write that finds the file locked by another
+	// process (a second replica, the doctor) fails at once instead of
+	// waiting its turn.
+	dsn := dbPath + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	if opts.CacheKiB > 0 {
+		// A negative cache_size is in KiB rather than pages.
+		dsn += fmt.Sprintf("&_pragma=cache_size(-%d)", opts.CacheKiB)
+	}
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
@@ -42,6 +69,23 @@ func (s *Store) Close() error {
 	return s.db.Close()
 }
 
+// Ping checks that the database answers and that a write lock can be
+// taken, which fails while another connection or process holds it. It does
+// not take s.mu, so a stuck store call cannot hang it past ctx.
+func (s *Store) Ping(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "ROLLBACK")
+	return err
+}
+
 // DB returns the underlying database connection for advanced queries.
 func (s *Store) DB() *sql.DB {
 	return s.db
@@ -50,6 +94,9 @@ func (s *Store) DB() *sql.DB {
 var (
 	ErrDeviceExists   = fmt.Errorf("device already exists")
 	ErrDeviceNotFound = errors.New("device not found")
+	// ErrLabelExists is returned by UpdateDevice when another device of the
+	// same user already has the requested label.
+	ErrLabelExists = errors.New("device label already used")
 )
 
 type Device struct {
@@ -57,14 +104,39 @@ type Device struct {
 	PubJWKJSON string `json:"pub_jwk_json"`
 	Label      string `json:"label"`
 	CreatedAt  int64  `json:"created_at"`
+	// CredentialID is the base64url WebAuthn credential ID for devices
+	// enrolled with a platform authenticator; empty for WebCrypto keys.
+	CredentialID string `json:"credential_id,omitempty"`
+	// SignCount is the last authenticator signature counter seen.
+	SignCount uint32 `json:"sign_count,omitempty"`
+	// DeletedAt is when an admin moved the device to the trash (Unix ms);
+	// zero for live devices.
+	DeletedAt int64 `json:"deleted_at,omitempty"`
+	// UserID is the account the device belongs to. Empty means the
+	// default account, which logs in with the server-wide secret.
+	UserID string `json:"user_id,omitempty"`
+	// Disabled blocks the device from attesting, logging in and
+	// connecting until an admin enables it again.
+	Disabled bool `json:"disabled,omitempty"`
+	// LastSeen is the latest successful login or accepted WebSocket
+	// connection (Unix ms); zero if never seen. Only QueryDevices fills it.
+	LastSeen int64 `json:"last_seen,omitempty"`
+}
+
+// DeviceQuery selects a page of live devices for QueryDevices.
+type DeviceQuery struct {
+	// Label keeps devices whose label contains it, ignoring ASCII case.
+	Label  string
+	Limit  int
+	Offset int
 }
 
 func (s *Store) AddDevice(d *Device) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	stmt := `INSERT INTO devices (device_id, pub_jwk_json, label, created_at) VALUES (?, ?, ?, ?)`
-	_, err := s.db.Exec(stmt, d.DeviceID, d.PubJWKJSON, d.Label, d.CreatedAt)
+	stmt := `INSERT INTO devices (device_id, pub_jwk_json, label, created_at, credential_id, sign_count, user_id) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(stmt, d.DeviceID, d.PubJWKJSON, d.Label, d.CreatedAt, d.CredentialID, d.SignCount, d.UserID)
 	if err != nil {
 		var sqliteErr *sqlite.Error
 		if errors.As(err, &sqliteErr) {
@@ -83,8 +155,8 @@ func (s *Store) GetDevice(deviceID string) (*Device, error) {
 	defer s.mu.RUnlock()
 
 	var d Device
-	err := s.db.QueryRow("SELECT device_id, pub_jwk_json, label, created_at FROM devices WHERE device_id = ?", deviceID).
-		Scan(&d.DeviceID, &d.PubJWKJSON, &d.Label, &d.CreatedAt)
+	err := s.db.QueryRow("SELECT device_id, pub_jwk_json, label, created_at, credential_id, sign_count, user_id, disabled FROM devices WHERE device_id = ? AND deleted_at = 0", deviceID).
+		Scan(&d.DeviceID, &d.PubJWKJSON, &d.Label, &d.CreatedAt, &d.CredentialID, &d.SignCount, &d.UserID, &d.Disabled)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrDeviceNotFound
@@ -94,6 +166,158 @@ func (s *Store) GetDevice(deviceID string) (*Device, error) {
 	return &d, nil
 }
 
+// ListDevices returns the enrolled devices that are not in the trash, oldest
+// first.
+func (s *Store) ListDevices() ([]Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT device_id, pub_jwk_json, label, created_at, credential_id, sign_count, user_id, disabled
+		FROM devices WHERE deleted_at = 0 ORDER BY created_at, device_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.DeviceID, &d.PubJWKJSON, &d.Label, &d.CreatedAt, &d.CredentialID, &d.SignCount, &d.UserID, &d.Disabled); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// QueryDevices returns one page of the devices ListDevices would, in the
+// same order, with LastSeen filled in, and how many devices match q in
+// total.
+func (s *Store) QueryDevices(q DeviceQuery) ([]Device, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	label := "%" + likeEscaper.Replace(q.Label) + "%"
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM devices WHERE deleted_at = 0 AND label LIKE ? ESCAPE '\'`, label).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT d.device_id, d.pub_jwk_json, d.label, d.created_at, d.credential_id, d.sign_count, d.user_id, d.disabled,
+			MAX(
+				COALESCE((SELECT last_success_at FROM device_auth_stats WHERE device_id = d.device_id), 0),
+				COALESCE((SELECT MAX(MAX(created_at, closed_at)) FROM connection_attempts
+					WHERE device_id = d.device_id AND outcome = ?), 0)
+			)
+		FROM devices d WHERE d.deleted_at = 0 AND d.label LIKE ? ESCAPE '\'
+		ORDER BY d.created_at, d.device_id LIMIT ? OFFSET ?`,
+		ConnOutcomeAccepted, label, q.Limit, q.Offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.DeviceID, &d.PubJWKJSON, &d.Label, &d.CreatedAt, &d.CredentialID, &d.SignCount, &d.UserID, &d.Disabled, &d.LastSeen); err != nil {
+			return nil, 0, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, total, rows.Err()
+}
+
+// likeEscaper escapes the LIKE wildcards in a substring so it matches
+// literally under ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// CountDevices returns how many devices are enrolled and not in the trash.
+func (s *Store) CountDevices() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM devices WHERE deleted_at = 0").Scan(&n)
+	return n, err
+}
+
+// DeviceUpdate lists the device fields to change; nil fields are left as
+// they are.
+type DeviceUpdate struct {
+	Label *string
+}
+
+// UpdateDevice applies u to a device. It returns ErrDeviceNotFound for
+// unknown and trashed devices and ErrLabelExists if the new label is taken
+// by another of the user's devices.
+func (s *Store) UpdateDevice(deviceID string, u DeviceUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var userID string
+	err := s.db.QueryRow("SELECT user_id FROM devices WHERE device_id = ? AND deleted_at = 0", deviceID).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDeviceNotFound
+		}
+		return err
+	}
+	if u.Label == nil {
+		return nil
+	}
+
+	var taken int
+	err = s.db.QueryRow(
+		"SELECT COUNT(*) FROM devices WHERE user_id = ? AND label = ? AND device_id != ? AND deleted_at = 0",
+		userID, *u.Label, deviceID,
+	).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrLabelExists
+	}
+
+	_, err = s.db.Exec("UPDATE devices SET label = ? WHERE device_id = ?", *u.Label, deviceID)
+	return err
+}
+
+// SetDeviceDisabled disables or re-enables a device. It returns
+// ErrDeviceNotFound for unknown and trashed devices.
+func (s *Store) SetDeviceDisabled(deviceID string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("UPDATE devices SET disabled = ? WHERE device_id = ? AND deleted_at = 0", disabled, deviceID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// UpdateSignCount records the authenticator counter from a successful
+// WebAuthn assertion.
+func (s *Store) UpdateSignCount(deviceID string, count uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("UPDATE devices SET sign_count = ? WHERE device_id = ? AND deleted_at = 0", count, deviceID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
 // migrate creates the database schema if it doesn't exist.
 func (s *Store) migrate() error {
 	schema := `
@@ -107,8 +331,219 @@ func (s *Store) migrate() error {
 		label TEXT,
 		created_at INTEGER NOT NULL
 	);
+	CREATE TABLE IF NOT EXISTS device_auth_stats (
+		device_id TEXT PRIMARY KEY,
+		successes INTEGER NOT NULL DEFAULT 0,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_success_at INTEGER NOT NULL DEFAULT 0,
+		last_failure_at INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS connection_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_id TEXT NOT NULL DEFAULT '',
+		outcome TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		origin TEXT NOT NULL DEFAULT '',
+		extensions TEXT NOT NULL DEFAULT '',
+		subprotocol TEXT NOT NULL DEFAULT '',
+		tls_version TEXT NOT NULL DEFAULT '',
+		tls_cipher TEXT NOT NULL DEFAULT '',
+		close_code INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		closed_at INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS idx_connection_attempts_device ON connection_attempts (device_id, id);
+	CREATE TABLE IF NOT EXISTS revoked_sessions (
+		sid TEXT PRIMARY KEY,
+		revoked_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS device_totp (
+		device_id TEXT PRIMARY KEY,
+		seed BLOB NOT NULL,
+		confirmed INTEGER NOT NULL DEFAULT 0,
+		last_step INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS challenges (
+		id TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL DEFAULT '',
+		nonce BLOB NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS device_commands (
+		device_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		PRIMARY KEY (device_id, action)
+	);
+	CREATE TABLE IF NOT EXISTS device_peers (
+		device_id TEXT NOT NULL,
+		peer_id TEXT NOT NULL,
+		PRIMARY KEY (device_id, peer_id)
+	);
+	CREATE TABLE IF NOT EXISTS users (
+		user_id TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		secret_hash TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS login_secrets (
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		secret_hash TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, name)
+	);
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL DEFAULT 0,
+		UNIQUE (device_id, name)
+	);
+	CREATE TABLE IF NOT EXISTS app_tokens (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		device_ids TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS device_wake (
+		device_id TEXT PRIMARY KEY,
+		mac TEXT NOT NULL DEFAULT '',
+		broadcast TEXT NOT NULL DEFAULT '',
+		webhook TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS cert_reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_id TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS transfer_receipts (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL DEFAULT '',
+		msg_id TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		receiver TEXT NOT NULL,
+		file INTEGER NOT NULL DEFAULT 0,
+		chunks INTEGER NOT NULL,
+		bytes INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		started_at INTEGER NOT NULL,
+		committed_at INTEGER NOT NULL,
+		signature TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS reconnect_grants (
+		token_hash TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		session_id TEXT NOT NULL,
+		read_only INTEGER NOT NULL DEFAULT 0,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS enroll_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		credential TEXT NOT NULL,
+		issued_by TEXT NOT NULL DEFAULT '',
+		outcome TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS user_settings (
+		user_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, key)
+	);
 	`
 
-	_, err := s.db.Exec(schema)
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+
+	// Columns added after the initial devices schema.
+	if err := s.ensureColumn("devices", "credential_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("devices", "sign_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("devices", "deleted_at", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("devices", "user_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("devices", "disabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// Columns added after the initial connection_attempts schema.
+	if err := s.ensureColumn("connection_attempts", "locale", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("connection_attempts", "timezone", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// Indices are created last since some cover the columns added above.
+	// store_test.go asserts the queries they serve actually use them.
+	_, err := s.db.Exec(indexes)
+	return err
+}
+
+// indexes backs the lookups, listings and prunes that would otherwise scan
+// a whole table.
+const indexes = `
+	DROP INDEX IF EXISTS idx_challenges_device;
+	CREATE INDEX IF NOT EXISTS idx_challenges_device_expires ON challenges (device_id, expires_at);
+	CREATE INDEX IF NOT EXISTS idx_challenges_expires ON challenges (expires_at);
+	CREATE INDEX IF NOT EXISTS idx_connection_attempts_outcome ON connection_attempts (device_id, outcome, id);
+	CREATE INDEX IF NOT EXISTS idx_connection_attempts_created ON connection_attempts (created_at);
+	CREATE INDEX IF NOT EXISTS idx_revoked_sessions_expires ON revoked_sessions (expires_at);
+	CREATE INDEX IF NOT EXISTS idx_device_peers_peer ON device_peers (peer_id);
+	CREATE INDEX IF NOT EXISTS idx_devices_deleted ON devices (deleted_at, created_at, device_id);
+	CREATE INDEX IF NOT EXISTS idx_devices_user_label ON devices (user_id, label);
+	CREATE INDEX IF NOT EXISTS idx_cert_reports_created ON cert_reports (created_at);
+	CREATE INDEX IF NOT EXISTS idx_enroll_events_created ON enroll_events (created_at);
+	CREATE INDEX IF NOT EXISTS idx_transfer_receipts_committed ON transfer_receipts (committed_at);
+	CREATE INDEX IF NOT EXISTS idx_reconnect_grants_expires ON reconnect_grants (expires_at);
+`
+
+// ensureColumn adds column to table when an older database lacks it.
+func (s *Store) ensureColumn(table, column, def string) error {
+	rows, err := s.db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
 	return err
 }
@@ -3,7 +3,13 @@ package store
 import (
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/auth"
 )
 
 func TestStore(t *testing.T) {
@@ -38,6 +44,463 @@ func TestStore(t *testing.T) {
 			t.Errorf("GetConfig = %q, want %q", val, "updated_value")
 		}
 	})
+
+	t.Run("SetConfigs", func(t *testing.T) {
+		if err := s.SetConfigs(map[string]string{"a": "1", "test_key": "2"}, []string{"missing"}); err != nil {
+			t.Fatalf("SetConfigs failed: %v", err)
+		}
+		if a, _ := s.GetConfig("a"); a != "1" {
+			t.Errorf("a = %q, want 1", a)
+		}
+		if err := s.SetConfigs(nil, []string{"a", "test_key"}); err != nil {
+			t.Fatalf("SetConfigs delete failed: %v", err)
+		}
+		for _, key := range []string{"a", "test_key"} {
+			if _, err := s.GetConfig(key); err != ErrConfigNotFound {
+				t.Errorf("GetConfig(%q) after delete: err = %v", key, err)
+			}
+		}
+	})
+}
+
+func TestAuthStats(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	st, err := s.GetAuthStats("device-1234567890")
+	if err != nil {
+		t.Fatalf("GetAuthStats failed: %v", err)
+	}
+	if st.Successes != 0 || st.Failures != 0 {
+		t.Errorf("Expected zeroed stats, got %+v", st)
+	}
+
+	s.RecordAuthSuccess("device-1234567890", 100)
+	s.RecordAuthSuccess("device-1234567890", 200)
+	s.RecordAuthFailure("device-1234567890", 300)
+
+	st, err = s.GetAuthStats("device-1234567890")
+	if err != nil {
+		t.Fatalf("GetAuthStats failed: %v", err)
+	}
+	if st.Successes != 2 || st.Failures != 1 {
+		t.Errorf("Expected 2 successes and 1 failure, got %+v", st)
+	}
+	if st.LastSuccessAt != 200 || st.LastFailureAt != 300 {
+		t.Errorf("Unexpected timestamps: %+v", st)
+	}
+}
+
+func TestConnAttempts(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	id, err := s.RecordConnAttempt(&ConnAttempt{
+		DeviceID:  "device-1234567890",
+		Outcome:   ConnOutcomeAccepted,
+		IP:        "203.0.113.1",
+		UserAgent: "test-agent",
+		Locale:    "de-DE",
+		TimeZone:  "Europe/Berlin",
+		CreatedAt: 100,
+	})
+	if err != nil {
+		t.Fatalf("RecordConnAttempt failed: %v", err)
+	}
+	s.RecordConnAttempt(&ConnAttempt{DeviceID: "device-1234567890", Outcome: ConnOutcomeLimitRejected, CreatedAt: 200})
+	s.RecordConnAttempt(&ConnAttempt{DeviceID: "other-device-123", Outcome: ConnOutcomeAccepted, CreatedAt: 300})
+
+	if err := s.CloseConnAttempt(id, 1001, 150); err != nil {
+		t.Fatalf("CloseConnAttempt failed: %v", err)
+	}
+	if err := s.CloseConnAttempt(9999, 1001, 150); err != ErrConnAttemptNotFound {
+		t.Errorf("Expected ErrConnAttemptNotFound, got %v", err)
+	}
+
+	attempts, err := s.ListConnAttempts("device-1234567890", 10)
+	if err != nil {
+		t.Fatalf("ListConnAttempts failed: %v", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(attempts))
+	}
+	if attempts[0].Outcome != ConnOutcomeLimitRejected {
+		t.Errorf("Expected newest first, got %+v", attempts[0])
+	}
+	if attempts[1].CloseCode != 1001 || attempts[1].ClosedAt != 150 || attempts[1].UserAgent != "test-agent" ||
+		attempts[1].Locale != "de-DE" || attempts[1].TimeZone != "Europe/Berlin" {
+		t.Errorf("Unexpected closed attempt: %+v", attempts[1])
+	}
+
+	n, err := s.PruneConnAttempts(250)
+	if err != nil {
+		t.Fatalf("PruneConnAttempts failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 pruned, got %d", n)
+	}
+}
+
+func TestRevokedSessions(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	if revoked, _ := s.IsSessionRevoked("sid-1"); revoked {
+		t.Fatal("Expected sid-1 not revoked")
+	}
+
+	if err := s.RevokeSession("sid-1", 100, 1000); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+	if err := s.RevokeSession("sid-1", 200, 2000); err != nil {
+		t.Fatalf("Repeated RevokeSession failed: %v", err)
+	}
+	if err := s.RevokeSession("sid-2", 100, 5000); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+
+	if revoked, err := s.IsSessionRevoked("sid-1"); err != nil || !revoked {
+		t.Fatalf("Expected sid-1 revoked, got %v, %v", revoked, err)
+	}
+
+	n, err := s.PruneRevokedSessions(1500)
+	if err != nil {
+		t.Fatalf("PruneRevokedSessions failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 pruned, got %d", n)
+	}
+	if revoked, _ := s.IsSessionRevoked("sid-2"); !revoked {
+		t.Error("Expected sid-2 still revoked")
+	}
+}
+
+func TestDeviceTOTP(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.GetTOTP("dev-1"); err != ErrTOTPNotFound {
+		t.Fatalf("Expected ErrTOTPNotFound, got %v", err)
+	}
+
+	if err := s.SetTOTPSeed("dev-1", []byte("seed-a"), 100); err != nil {
+		t.Fatalf("SetTOTPSeed failed: %v", err)
+	}
+	if err := s.SetTOTPSeed("dev-1", []byte("seed-b"), 200); err != nil {
+		t.Fatalf("SetTOTPSeed failed: %v", err)
+	}
+	totp, err := s.GetTOTP("dev-1")
+	if err != nil || string(totp.SealedSeed) != "seed-b" || totp.Confirmed {
+		t.Fatalf("Expected unconfirmed seed-b, got %+v, %v", totp, err)
+	}
+
+	if ok, err := s.UseTOTPStep("dev-1", 10); err != nil || !ok {
+		t.Fatalf("UseTOTPStep(10) = %v, %v", ok, err)
+	}
+	if ok, _ := s.UseTOTPStep("dev-1", 10); ok {
+		t.Error("Expected replayed step rejected")
+	}
+
+	// Once confirmed, setup must not silently replace the seed.
+	if err := s.SetTOTPSeed("dev-1", []byte("seed-c"), 300); err != nil {
+		t.Fatalf("SetTOTPSeed failed: %v", err)
+	}
+	totp, _ = s.GetTOTP("dev-1")
+	if string(totp.SealedSeed) != "seed-b" || !totp.Confirmed || totp.LastStep != 10 {
+		t.Errorf("Expected confirmed seed-b at step 10, got %+v", totp)
+	}
+
+	if err := s.DeleteTOTP("dev-1"); err != nil {
+		t.Fatalf("DeleteTOTP failed: %v", err)
+	}
+	if _, err := s.GetTOTP("dev-1"); err != ErrTOTPNotFound {
+		t.Errorf("Expected ErrTOTPNotFound after delete, got %v", err)
+	}
+}
+
+func TestAllowedCommands(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	if ok, err := s.CommandAllowed("dev-1", "ring"); err != nil || ok {
+		t.Fatalf("CommandAllowed on empty allowlist = %v, %v", ok, err)
+	}
+
+	if err := s.SetAllowedCommands("dev-1", []string{"ring", "open_url", "ring"}); err != nil {
+		t.Fatalf("SetAllowedCommands failed: %v", err)
+	}
+	got, err := s.AllowedCommands("dev-1")
+	if err != nil || len(got) != 2 || got[0] != "open_url" || got[1] != "ring" {
+		t.Fatalf("AllowedCommands = %v, %v", got, err)
+	}
+	if ok, _ := s.CommandAllowed("dev-2", "ring"); ok {
+		t.Error("Expected allowlist scoped to dev-1")
+	}
+
+	// Setting a new list replaces the old one.
+	if err := s.SetAllowedCommands("dev-1", []string{"open_url"}); err != nil {
+		t.Fatalf("SetAllowedCommands failed: %v", err)
+	}
+	if ok, _ := s.CommandAllowed("dev-1", "ring"); ok {
+		t.Error("Expected ring removed from allowlist")
+	}
+	if ok, _ := s.CommandAllowed("dev-1", "open_url"); !ok {
+		t.Error("Expected open_url allowed")
+	}
+}
+
+func TestPeers(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	if ok, err := s.PeerAllowed("parent", "kid-1"); err != nil || !ok {
+		t.Fatalf("PeerAllowed without links = %v, %v", ok, err)
+	}
+
+	if err := s.SetPeers("parent", []string{"kid-2", "kid-1", "parent"}); err != nil {
+		t.Fatalf("SetPeers failed: %v", err)
+	}
+	got, err := s.Peers("parent")
+	if err != nil || len(got) != 2 || got[0] != "kid-1" || got[1] != "kid-2" {
+		t.Fatalf("Peers = %v, %v", got, err)
+	}
+	if got, _ := s.Peers("kid-1"); len(got) != 1 || got[0] != "parent" {
+		t.Errorf("Expected links stored both ways, got %v", got)
+	}
+
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{"parent", "kid-1", true},
+		{"kid-2", "parent", true},
+		{"kid-1", "kid-2", false},
+		{"kid-1", "laptop", false},
+		{"laptop", "phone", true},
+		{"kid-1", "kid-1", true},
+	} {
+		if ok, _ := s.PeerAllowed(tt.a, tt.b); ok != tt.want {
+			t.Errorf("PeerAllowed(%s, %s) = %v, want %v", tt.a, tt.b, ok, tt.want)
+		}
+	}
+
+	// Replacing the list drops links on both sides.
+	if err := s.SetPeers("parent", []string{"kid-1"}); err != nil {
+		t.Fatalf("SetPeers failed: %v", err)
+	}
+	if got, _ := s.Peers("kid-2"); len(got) != 0 {
+		t.Errorf("Expected kid-2 unlinked, got %v", got)
+	}
+	if ok, _ := s.PeerAllowed("kid-2", "laptop"); !ok {
+		t.Error("Expected kid-2 unrestricted again")
+	}
+
+	// Purging a device drops its own links from the cached snapshot too,
+	// while its former peers stay restricted.
+	if err := s.AddDevice(&Device{DeviceID: "parent", PubJWKJSON: "{}", CreatedAt: 1}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	if ok, _ := s.PeerAllowed("parent", "laptop"); ok {
+		t.Fatal("Expected linked parent to be restricted")
+	}
+	if err := s.DeleteDevice("parent", 1000); err != nil {
+		t.Fatalf("DeleteDevice failed: %v", err)
+	}
+	if _, err := s.PurgeDeletedDevices(2000); err != nil {
+		t.Fatalf("PurgeDeletedDevices failed: %v", err)
+	}
+	if ok, _ := s.PeerAllowed("parent", "laptop"); !ok {
+		t.Error("Expected purged device's links dropped from the cache")
+	}
+	if ok, _ := s.PeerAllowed("kid-1", "laptop"); ok {
+		t.Error("Expected former peer to stay restricted")
+	}
+}
+
+func TestDeviceTrash(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	for _, id := range []string{"dev-1", "dev-2"} {
+		if err := s.AddDevice(&Device{DeviceID: id, PubJWKJSON: "{}", Label: id, CreatedAt: 1}); err != nil {
+			t.Fatalf("AddDevice failed: %v", err)
+		}
+	}
+	s.SetAllowedCommands("dev-1", []string{"ring"})
+
+	if err := s.DeleteDevice("dev-1", 1000); err != nil {
+		t.Fatalf("DeleteDevice failed: %v", err)
+	}
+	if err := s.DeleteDevice("dev-1", 1001); err != ErrDeviceNotFound {
+		t.Errorf("Expected ErrDeviceNotFound deleting twice, got %v", err)
+	}
+	if _, err := s.GetDevice("dev-1"); err != ErrDeviceNotFound {
+		t.Errorf("Expected trashed device hidden from GetDevice, got %v", err)
+	}
+	if err := s.AddDevice(&Device{DeviceID: "dev-1", PubJWKJSON: "{}", CreatedAt: 2}); err != ErrDeviceExists {
+		t.Errorf("Expected ErrDeviceExists re-enrolling a trashed device, got %v", err)
+	}
+
+	trash, err := s.ListDeletedDevices()
+	if err != nil || len(trash) != 1 || trash[0].DeviceID != "dev-1" || trash[0].DeletedAt != 1000 {
+		t.Fatalf("ListDeletedDevices = %+v, %v", trash, err)
+	}
+	live, err := s.ListDevices()
+	if err != nil || len(live) != 1 || live[0].DeviceID != "dev-2" {
+		t.Fatalf("ListDevices = %+v, %v", live, err)
+	}
+
+	if err := s.RestoreDevice("dev-1"); err != nil {
+		t.Fatalf("RestoreDevice failed: %v", err)
+	}
+	if d, err := s.GetDevice("dev-1"); err != nil || d.Label != "dev-1" {
+		t.Errorf("Expected restored device, got %+v, %v", d, err)
+	}
+	if err := s.RestoreDevice("dev-2"); err != ErrDeviceNotFound {
+		t.Errorf("Expected ErrDeviceNotFound restoring a live device, got %v", err)
+	}
+
+	s.DeleteDevice("dev-1", 1000)
+	s.DeleteDevice("dev-2", 5000)
+	n, err := s.PurgeDeletedDevices(2000)
+	if err != nil || n != 1 {
+		t.Fatalf("PurgeDeletedDevices = %d, %v", n, err)
+	}
+	if err := s.RestoreDevice("dev-1"); err != ErrDeviceNotFound {
+		t.Errorf("Expected purged device gone, got %v", err)
+	}
+	if ok, _ := s.CommandAllowed("dev-1", "ring"); ok {
+		t.Error("Expected purge to remove the command allowlist")
+	}
+	if err := s.RestoreDevice("dev-2"); err != nil {
+		t.Errorf("Expected dev-2 still in trash, got %v", err)
+	}
+}
+
+func TestDBChallengeStore(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	cs := auth.NewDBChallengeStore(s, time.Minute)
+	c, err := cs.Create("dev-1")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if n := cs.CountForDevice("dev-1"); n != 1 {
+		t.Errorf("Expected 1 outstanding challenge, got %d", n)
+	}
+
+	got, err := cs.Consume(c.ID)
+	if err != nil || got.DeviceID != "dev-1" || string(got.Nonce) != string(c.Nonce) {
+		t.Fatalf("Consume = %+v, %v", got, err)
+	}
+	if _, err := cs.Consume(c.ID); err != auth.ErrChallengeNotFound {
+		t.Errorf("Expected single use, got %v", err)
+	}
+
+	expired := auth.NewDBChallengeStore(s, -time.Second)
+	old, _ := expired.Create("dev-2")
+	if n := cs.CountForDevice("dev-2"); n != 0 {
+		t.Errorf("Expected expired challenge not counted, got %d", n)
+	}
+	if n, err := s.PruneChallenges(time.Now().UnixMilli()); err != nil || n != 1 {
+		t.Errorf("PruneChallenges = %d, %v", n, err)
+	}
+	if _, err := cs.Consume(old.ID); err != auth.ErrChallengeNotFound {
+		t.Errorf("Expected pruned challenge gone, got %v", err)
+	}
+
+	stale, _ := expired.Create("dev-3")
+	if _, err := cs.Consume(stale.ID); err != auth.ErrChallengeExpired {
+		t.Errorf("Expected ErrChallengeExpired, got %v", err)
+	}
+}
+
+// TestDBChallengeStoreReplicas runs two stores on one database file, as two
+// replicas behind a load balancer would, racing to redeem the same
+// challenges. Each must be redeemed exactly once and no write may fail
+// because the other replica held the lock.
+func TestDBChallengeStoreReplicas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	var replicas []*auth.DBChallengeStore
+	for i := 0; i < 2; i++ {
+		s, err := New(path)
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+		defer s.Close()
+		replicas = append(replicas, auth.NewDBChallengeStore(s, time.Minute))
+	}
+
+	const n = 50
+	ids := make([]string, n)
+	for i := range ids {
+		c, err := replicas[i%2].Create("dev-1")
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		ids[i] = c.ID
+	}
+
+	var wg sync.WaitGroup
+	var redeemed atomic.Int32
+	errs := make(chan error, 4*n)
+	for _, id := range ids {
+		for _, cs := range replicas {
+			wg.Add(1)
+			go func(cs *auth.DBChallengeStore, id string) {
+				defer wg.Done()
+				_, err := cs.Consume(id)
+				switch {
+				case err == nil:
+					redeemed.Add(1)
+				case err != auth.ErrChallengeNotFound:
+					errs <- err
+				}
+			}(cs, id)
+		}
+		// New challenges keep being written while the others are redeemed.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := replicas[0].Create("dev-2"); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("replica error: %v", err)
+	}
+	if got := redeemed.Load(); got != n {
+		t.Errorf("redeemed %d challenges, want each of %d exactly once", got, n)
+	}
 }
 
 func TestNewStoreCreatesFile(t *testing.T) {
@@ -56,3 +519,591 @@ func TestNewStoreCreatesFile(t *testing.T) {
 		t.Error("Expected database file to be created")
 	}
 }
+
+func TestUsers(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.CreateUser(&User{UserID: "u1", Name: "alice", SecretHash: "h1", CreatedAt: 1}); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := s.CreateUser(&User{UserID: "u2", Name: "alice", SecretHash: "h2", CreatedAt: 2}); err != ErrUserExists {
+		t.Errorf("Expected ErrUserExists for a duplicate name, got %v", err)
+	}
+	if _, err := s.GetUser("u2"); err != ErrUserNotFound {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+
+	if err := s.SetUserSecretHash("u1", "h1b"); err != nil {
+		t.Fatalf("SetUserSecretHash failed: %v", err)
+	}
+	if u, err := s.GetUser("u1"); err != nil || u.SecretHash != "h1b" || u.Name != "alice" {
+		t.Errorf("GetUser = %+v, %v", u, err)
+	}
+	if err := s.SetUserSecretHash("u2", "x"); err != ErrUserNotFound {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+	if users, err := s.ListUsers(); err != nil || len(users) != 1 {
+		t.Errorf("ListUsers = %+v, %v", users, err)
+	}
+
+	if err := s.AddDevice(&Device{DeviceID: "dev-1", PubJWKJSON: "{}", CreatedAt: 1, UserID: "u1"}); err != nil {
+		t.Fatalf("AddDevice failed: %v", err)
+	}
+	if d, err := s.GetDevice("dev-1"); err != nil || d.UserID != "u1" {
+		t.Errorf("Expected device of u1, got %+v, %v", d, err)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	tok := &APIToken{ID: "t1", DeviceID: "dev-1", Name: "backup", Scope: "user", Hash: "h1", CreatedAt: 1}
+	if err := s.CreateAPIToken(tok); err != nil {
+		t.Fatalf("CreateAPIToken failed: %v", err)
+	}
+	dup := &APIToken{ID: "t2", DeviceID: "dev-1", Name: "backup", Scope: "user", Hash: "h2", CreatedAt: 2}
+	if err := s.CreateAPIToken(dup); err != ErrAPITokenExists {
+		t.Errorf("Expected ErrAPITokenExists for a duplicate name, got %v", err)
+	}
+	other := &APIToken{ID: "t3", DeviceID: "dev-2", Name: "backup", Scope: "readonly", Hash: "h3", CreatedAt: 3}
+	if err := s.CreateAPIToken(other); err != nil {
+		t.Fatalf("The same name on another device should be allowed: %v", err)
+	}
+
+	if err := s.TouchAPIToken("t1", 42); err != nil {
+		t.Fatalf("TouchAPIToken failed: %v", err)
+	}
+	if got, err := s.GetAPITokenByHash("h1"); err != nil || got.ID != "t1" || got.LastUsedAt != 42 {
+		t.Errorf("GetAPITokenByHash = %+v, %v", got, err)
+	}
+	if _, err := s.GetAPITokenByHash("nope"); err != ErrAPITokenNotFound {
+		t.Errorf("Expected ErrAPITokenNotFound, got %v", err)
+	}
+	if tokens, err := s.ListAPITokens("dev-1"); err != nil || len(tokens) != 1 || tokens[0].Name != "backup" {
+		t.Errorf("ListAPITokens = %+v, %v", tokens, err)
+	}
+
+	if err := s.DeleteAPIToken("dev-1", "t3"); err != ErrAPITokenNotFound {
+		t.Errorf("A device should not revoke another device's token, got %v", err)
+	}
+	if err := s.DeleteAPIToken("dev-1", "t1"); err != nil {
+		t.Fatalf("DeleteAPIToken failed: %v", err)
+	}
+	if _, err := s.GetAPITokenByHash("h1"); err != ErrAPITokenNotFound {
+		t.Errorf("Revoked token should be gone, got %v", err)
+	}
+}
+
+func TestLoginSecrets(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	for i, ls := range []LoginSecret{
+		{UserID: "u", Name: "drop-only", SecretHash: "h1", Scope: "readonly"},
+		{UserID: "u", Name: "full-access", SecretHash: "h2", Scope: "user"},
+		{UserID: "", Name: "drop-only", SecretHash: "h3", Scope: "readonly"},
+	} {
+		ls.CreatedAt = int64(i + 1)
+		if err := s.CreateLoginSecret(&ls); err != nil {
+			t.Fatalf("CreateLoginSecret %+v: %v", ls, err)
+		}
+	}
+	if err := s.CreateLoginSecret(&LoginSecret{UserID: "u", Name: "drop-only", SecretHash: "h4", Scope: "user"}); err != ErrLoginSecretExists {
+		t.Errorf("Expected ErrLoginSecretExists, got %v", err)
+	}
+
+	if err := s.SetLoginSecretHash("u", "drop-only", "h1b"); err != nil {
+		t.Fatalf("SetLoginSecretHash: %v", err)
+	}
+	secrets, err := s.ListLoginSecrets("u")
+	if err != nil {
+		t.Fatalf("ListLoginSecrets: %v", err)
+	}
+	if len(secrets) != 2 || secrets[0].Name != "drop-only" || secrets[0].SecretHash != "h1b" || secrets[1].Scope != "user" {
+		t.Errorf("Expected both of u's secrets, got %+v", secrets)
+	}
+
+	if err := s.DeleteLoginSecret("u", "drop-only"); err != nil {
+		t.Fatalf("DeleteLoginSecret: %v", err)
+	}
+	if err := s.DeleteLoginSecret("u", "drop-only"); err != ErrLoginSecretNotFound {
+		t.Errorf("Expected ErrLoginSecretNotFound, got %v", err)
+	}
+	if secrets, _ := s.ListLoginSecrets(""); len(secrets) != 1 || secrets[0].SecretHash != "h3" {
+		t.Errorf("Expected the default account's secret to survive, got %+v", secrets)
+	}
+}
+
+func TestAppTokens(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	tok := &AppToken{ID: "a1", Name: "washer", DeviceIDs: []string{"dev-1", "dev-2"}, Hash: "h1", CreatedAt: 1}
+	if err := s.CreateAppToken(tok); err != nil {
+		t.Fatalf("CreateAppToken failed: %v", err)
+	}
+	if err := s.CreateAppToken(&AppToken{ID: "a2", Name: "washer", DeviceIDs: []string{"dev-1"}, Hash: "h2"}); err != ErrAppTokenExists {
+		t.Errorf("Expected ErrAppTokenExists for a duplicate name, got %v", err)
+	}
+
+	s.TouchAppToken("a1", 42)
+	got, err := s.GetAppTokenByHash("h1")
+	if err != nil || got.LastUsedAt != 42 || len(got.DeviceIDs) != 2 || got.DeviceIDs[1] != "dev-2" {
+		t.Errorf("GetAppTokenByHash = %+v, %v", got, err)
+	}
+	if tokens, err := s.ListAppTokens(); err != nil || len(tokens) != 1 {
+		t.Errorf("ListAppTokens = %+v, %v", tokens, err)
+	}
+
+	if err := s.DeleteAppToken("a1"); err != nil {
+		t.Fatalf("DeleteAppToken failed: %v", err)
+	}
+	if _, err := s.GetAppTokenByHash("h1"); err != ErrAppTokenNotFound {
+		t.Errorf("Revoked token should be gone, got %v", err)
+	}
+	if err := s.DeleteAppToken("a1"); err != ErrAppTokenNotFound {
+		t.Errorf("Expected ErrAppTokenNotFound, got %v", err)
+	}
+}
+
+func TestQueryDevices(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	for i, label := range []string{"Kitchen iPad", "Office PC", "kid_phone", "kidsphone"} {
+		d := &Device{DeviceID: "dev-" + string(rune('0'+i)), PubJWKJSON: "{}", Label: label, CreatedAt: int64(i + 1)}
+		if err := s.AddDevice(d); err != nil {
+			t.Fatalf("AddDevice failed: %v", err)
+		}
+	}
+	s.RecordAuthSuccess("dev-0", 500)
+	id, _ := s.RecordConnAttempt(&ConnAttempt{DeviceID: "dev-0", Outcome: ConnOutcomeAccepted, CreatedAt: 600})
+	s.CloseConnAttempt(id, 1000, 700)
+	s.RecordConnAttempt(&ConnAttempt{DeviceID: "dev-1", Outcome: ConnOutcomeAuthFailed, CreatedAt: 900})
+
+	page, total, err := s.QueryDevices(DeviceQuery{Limit: 2, Offset: 1})
+	if err != nil || total != 4 || len(page) != 2 || page[0].DeviceID != "dev-1" || page[1].DeviceID != "dev-2" {
+		t.Fatalf("QueryDevices page = %+v, %d, %v", page, total, err)
+	}
+	if page[0].LastSeen != 0 {
+		t.Errorf("A failed connection should not count as seen, got %d", page[0].LastSeen)
+	}
+
+	all, _, _ := s.QueryDevices(DeviceQuery{Limit: 10})
+	if all[0].LastSeen != 700 {
+		t.Errorf("Expected last seen at the connection close, got %d", all[0].LastSeen)
+	}
+
+	// The filter ignores case and matches wildcards literally.
+	for label, want := range map[string]int{"KITCHEN": 1, "kid_": 1, "%": 0, "o": 3} {
+		if _, total, err := s.QueryDevices(DeviceQuery{Label: label, Limit: 10}); err != nil || total != want {
+			t.Errorf("Label %q matched %d devices (%v), want %d", label, total, err, want)
+		}
+	}
+}
+
+func TestOpenCacheSize(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{CacheKiB: 512})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+
+	var size int
+	if err := s.DB().QueryRow("PRAGMA cache_size").Scan(&size); err != nil || size != -512 {
+		t.Errorf("cache_size = %d, %v; want -512", size, err)
+	}
+}
+
+func TestUpdateDevice(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	s.AddDevice(&Device{DeviceID: "dev-1", PubJWKJSON: "{}", Label: "old", CreatedAt: 1, UserID: "u1"})
+	s.AddDevice(&Device{DeviceID: "dev-2", PubJWKJSON: "{}", Label: "taken", CreatedAt: 2, UserID: "u1"})
+	s.AddDevice(&Device{DeviceID: "dev-3", PubJWKJSON: "{}", Label: "other", CreatedAt: 3, UserID: "u2"})
+
+	label := "new"
+	if err := s.UpdateDevice("dev-1", DeviceUpdate{Label: &label}); err != nil {
+		t.Fatalf("UpdateDevice failed: %v", err)
+	}
+	if d, _ := s.GetDevice("dev-1"); d.Label != "new" {
+		t.Errorf("Expected label new, got %q", d.Label)
+	}
+
+	label = "taken"
+	if err := s.UpdateDevice("dev-1", DeviceUpdate{Label: &label}); err != ErrLabelExists {
+		t.Errorf("Expected ErrLabelExists, got %v", err)
+	}
+	label = "other"
+	if err := s.UpdateDevice("dev-1", DeviceUpdate{Label: &label}); err != nil {
+		t.Errorf("Labels of another user should not conflict: %v", err)
+	}
+	if err := s.UpdateDevice("dev-1", DeviceUpdate{}); err != nil {
+		t.Errorf("Empty update failed: %v", err)
+	}
+
+	s.DeleteDevice("dev-2", 1000)
+	label = "taken"
+	if err := s.UpdateDevice("dev-1", DeviceUpdate{Label: &label}); err != nil {
+		t.Errorf("Trashed devices should not hold their label: %v", err)
+	}
+	if err := s.UpdateDevice("dev-2", DeviceUpdate{Label: &label}); err != ErrDeviceNotFound {
+		t.Errorf("Expected ErrDeviceNotFound for a trashed device, got %v", err)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	s.PutSetting("u1", "theme", "ct-1")
+	s.PutSetting("u1", "theme", "ct-2")
+	s.PutSetting("u1", "paste.format", "ct-3")
+	s.PutSetting("u2", "theme", "ct-4")
+
+	got, err := s.Settings("u1")
+	if err != nil {
+		t.Fatalf("Settings failed: %v", err)
+	}
+	if len(got) != 2 || got["theme"] != "ct-2" || got["paste.format"] != "ct-3" {
+		t.Errorf("Unexpected settings for u1: %v", got)
+	}
+
+	s.PutSetting("u1", "theme", "")
+	if got, _ := s.Settings("u1"); len(got) != 1 {
+		t.Errorf("Expected theme to be deleted, got %v", got)
+	}
+	if got, _ := s.Settings("u2"); got["theme"] != "ct-4" {
+		t.Errorf("Other users' settings changed: %v", got)
+	}
+}
+
+func TestCertReports(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	for i, fp := range []string{"aa", "bb", "cc"} {
+		if _, err := s.RecordCertReport(&CertReport{DeviceID: "laptop", Fingerprint: fp, IP: "10.0.0.1", CreatedAt: int64(100 * (i + 1))}); err != nil {
+			t.Fatalf("RecordCertReport: %v", err)
+		}
+	}
+
+	reports, err := s.ListCertReports(2)
+	if err != nil {
+		t.Fatalf("ListCertReports: %v", err)
+	}
+	if len(reports) != 2 || reports[0].Fingerprint != "cc" || reports[1].Fingerprint != "bb" {
+		t.Errorf("Expected the two newest reports, got %+v", reports)
+	}
+
+	if n, err := s.PruneCertReports(250); err != nil || n != 2 {
+		t.Errorf("PruneCertReports = %d, %v; want 2", n, err)
+	}
+	if reports, _ := s.ListCertReports(10); len(reports) != 1 || reports[0].Fingerprint != "cc" {
+		t.Errorf("Expected only the newest report to survive, got %+v", reports)
+	}
+}
+
+func TestReconnectGrants(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	for _, g := range []ReconnectGrant{
+		{Hash: "h1", DeviceID: "d1", SessionID: "s1", ReadOnly: true, ExpiresAt: 200},
+		{Hash: "h2", DeviceID: "d2", SessionID: "s2", ExpiresAt: 100},
+		{Hash: "h3", DeviceID: "d3", SessionID: "s3", ExpiresAt: 50},
+	} {
+		if err := s.PutReconnectGrant(&g); err != nil {
+			t.Fatalf("PutReconnectGrant: %v", err)
+		}
+	}
+
+	g, err := s.TakeReconnectGrant("h1", 150)
+	if err != nil || g.DeviceID != "d1" || g.SessionID != "s1" || !g.ReadOnly {
+		t.Fatalf("TakeReconnectGrant = %+v, %v", g, err)
+	}
+	if _, err := s.TakeReconnectGrant("h1", 150); err != ErrReconnectGrantNotFound {
+		t.Errorf("Expected a grant to be redeemable once, got %v", err)
+	}
+	if _, err := s.TakeReconnectGrant("h2", 150); err != ErrReconnectGrantNotFound {
+		t.Errorf("Expected an expired grant to be refused, got %v", err)
+	}
+
+	if n, err := s.PruneReconnectGrants(150); err != nil || n != 1 {
+		t.Errorf("PruneReconnectGrants = %d, %v; want 1", n, err)
+	}
+}
+
+func TestTransferReceipts(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	for i, id := range []string{"r1", "r2"} {
+		r := &TransferReceipt{ID: id, UserID: "u", MsgID: "m" + id, Sender: "laptop", Receiver: "phone", File: i == 1, Chunks: 3, Bytes: 1 << 20, SHA256: "ab", StartedAt: int64(100*(i+1) - 50), CommittedAt: int64(100 * (i + 1)), Signature: "sig"}
+		if err := s.PutTransferReceipt(r); err != nil {
+			t.Fatalf("PutTransferReceipt: %v", err)
+		}
+	}
+	if err := s.PutTransferReceipt(&TransferReceipt{ID: "r1"}); err == nil {
+		t.Error("Expected a duplicate receipt ID to be rejected")
+	}
+
+	r, err := s.GetTransferReceipt("r2")
+	if err != nil {
+		t.Fatalf("GetTransferReceipt: %v", err)
+	}
+	want := TransferReceipt{ID: "r2", UserID: "u", MsgID: "mr2", Sender: "laptop", Receiver: "phone", File: true, Chunks: 3, Bytes: 1 << 20, SHA256: "ab", StartedAt: 150, CommittedAt: 200, Signature: "sig"}
+	if *r != want {
+		t.Errorf("GetTransferReceipt = %+v, want %+v", *r, want)
+	}
+
+	if n, err := s.PruneTransferReceipts(150); err != nil || n != 1 {
+		t.Errorf("PruneTransferReceipts = %d, %v; want 1", n, err)
+	}
+	if _, err := s.GetTransferReceipt("r1"); err != ErrReceiptNotFound {
+		t.Errorf("Expected the pruned receipt to be gone, got %v", err)
+	}
+}
+
+func TestEnrollEvents(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	for i, outcome := range []string{EnrollOutcomeInvalidPayload, EnrollOutcomeInvalidPayload, EnrollOutcomeLocked} {
+		e := &EnrollEvent{Credential: EnrollCredentialPairing, IssuedBy: "laptop", Outcome: outcome, Reason: "INVALID_DEVICE_ID", IP: "10.0.0.1", CreatedAt: int64(100 * (i + 1))}
+		if _, err := s.RecordEnrollEvent(e); err != nil {
+			t.Fatalf("RecordEnrollEvent: %v", err)
+		}
+	}
+
+	events, err := s.ListEnrollEvents(2)
+	if err != nil {
+		t.Fatalf("ListEnrollEvents: %v", err)
+	}
+	if len(events) != 2 || events[0].Outcome != EnrollOutcomeLocked || events[0].IssuedBy != "laptop" || events[1].CreatedAt != 200 {
+		t.Errorf("Expected the two newest events, got %+v", events)
+	}
+
+	if n, err := s.PruneEnrollEvents(250); err != nil || n != 2 {
+		t.Errorf("PruneEnrollEvents = %d, %v; want 2", n, err)
+	}
+	if events, _ := s.ListEnrollEvents(10); len(events) != 1 || events[0].Outcome != EnrollOutcomeLocked {
+		t.Errorf("Expected only the newest event to survive, got %+v", events)
+	}
+}
+
+func TestWakeTargets(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	for i, id := range []string{"phone", "desktop", "laptop", "nas", "other"} {
+		user := "u1"
+		if id == "other" {
+			user = "u2"
+		}
+		s.AddDevice(&Device{DeviceID: id, PubJWKJSON: "{}", Label: id, CreatedAt: int64(i), UserID: user})
+	}
+
+	if err := s.SetWakeTarget(WakeTarget{DeviceID: "ghost", MAC: "00:11:22:33:44:55"}); err != ErrDeviceNotFound {
+		t.Errorf("Expected ErrDeviceNotFound, got %v", err)
+	}
+	for _, id := range []string{"desktop", "laptop", "nas", "other"} {
+		if err := s.SetWakeTarget(WakeTarget{DeviceID: id, MAC: "00:11:22:33:44:55"}); err != nil {
+			t.Fatalf("SetWakeTarget(%s): %v", id, err)
+		}
+	}
+	if err := s.SetWakeTarget(WakeTarget{DeviceID: "desktop", Webhook: "http://hass.lan/wake"}); err != nil {
+		t.Fatalf("SetWakeTarget replace: %v", err)
+	}
+	if w, err := s.GetWakeTarget("desktop"); err != nil || w.MAC != "" || w.Webhook != "http://hass.lan/wake" {
+		t.Errorf("Expected replaced target, got %+v, %v", w, err)
+	}
+
+	s.SetDeviceDisabled("laptop", true)
+	s.DeleteDevice("nas", 100)
+
+	targets, err := s.PeerWakeTargets("phone")
+	if err != nil {
+		t.Fatalf("PeerWakeTargets: %v", err)
+	}
+	if len(targets) != 1 || targets[0].DeviceID != "desktop" {
+		t.Errorf("Expected only desktop, got %+v", targets)
+	}
+	if targets, _ := s.PeerWakeTargets("desktop"); len(targets) != 0 {
+		t.Errorf("A device should not wake itself, got %+v", targets)
+	}
+
+	if err := s.DeleteWakeTarget("desktop"); err != nil {
+		t.Fatalf("DeleteWakeTarget: %v", err)
+	}
+	if err := s.DeleteWakeTarget("desktop"); err != ErrWakeTargetNotFound {
+		t.Errorf("Expected ErrWakeTargetNotFound, got %v", err)
+	}
+
+	if _, err := s.PurgeDeletedDevices(200); err != nil {
+		t.Fatalf("PurgeDeletedDevices: %v", err)
+	}
+	if _, err := s.GetWakeTarget("nas"); err != ErrWakeTargetNotFound {
+		t.Errorf("Purge should drop the wake target, got %v", err)
+	}
+}
+
+// queryPlan returns the detail column of EXPLAIN QUERY PLAN for query.
+func queryPlan(t *testing.T, s *Store, query string, args ...any) []string {
+	t.Helper()
+	rows, err := s.DB().Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		t.Fatalf("explain %q: %v", query, err)
+	}
+	defer rows.Close()
+
+	var details []string
+	for rows.Next() {
+		var id, parent, notused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+			t.Fatalf("scan plan: %v", err)
+		}
+		details = append(details, detail)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("plan rows: %v", err)
+	}
+	return details
+}
+
+// TestQueryPlans pins the admin and housekeeping queries to their indices
+// so a schema or query change can't quietly turn them into table scans.
+func TestQueryPlans(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name  string
+		query string
+		args  []any
+		index string
+	}{
+		{"conn attempts by device", `SELECT id FROM connection_attempts WHERE device_id = ? ORDER BY id DESC LIMIT ?`,
+			[]any{"d", 10}, "idx_connection_attempts_device"},
+		{"conn intervals", `SELECT id FROM connection_attempts WHERE device_id = ? AND outcome = ? AND id < ? ORDER BY id DESC LIMIT ?`,
+			[]any{"d", ConnOutcomeAccepted, 100, 10}, "idx_connection_attempts_outcome"},
+		{"conn attempts prune", `DELETE FROM connection_attempts WHERE created_at < ?`,
+			[]any{0}, "idx_connection_attempts_created"},
+		{"challenge count", `SELECT COUNT(*) FROM challenges WHERE device_id = ? AND expires_at > ?`,
+			[]any{"d", 0}, "idx_challenges_device_expires"},
+		{"challenge prune", `DELETE FROM challenges WHERE expires_at < ?`,
+			[]any{0}, "idx_challenges_expires"},
+		{"revocation prune", `DELETE FROM revoked_sessions WHERE expires_at < ?`,
+			[]any{0}, "idx_revoked_sessions_expires"},
+		{"reconnect grant prune", `DELETE FROM reconnect_grants WHERE expires_at < ?`,
+			[]any{0}, "idx_reconnect_grants_expires"},
+		{"peer unlink", `SELECT device_id FROM device_peers WHERE peer_id = ?`,
+			[]any{"d"}, "idx_device_peers_peer"},
+		{"device list", `SELECT device_id FROM devices WHERE deleted_at = 0 ORDER BY created_at, device_id`,
+			nil, "idx_devices_deleted"},
+		{"device trash", `SELECT device_id FROM devices WHERE deleted_at > 0 ORDER BY deleted_at DESC`,
+			nil, "idx_devices_deleted"},
+		{"device purge", `DELETE FROM devices WHERE deleted_at > 0 AND deleted_at < ?`,
+			[]any{0}, "idx_devices_deleted"},
+		{"peer wake targets", `SELECT w.device_id FROM devices d JOIN device_wake w ON w.device_id = d.device_id
+			WHERE d.user_id = (SELECT user_id FROM devices WHERE device_id = ? AND deleted_at = 0)
+				AND d.deleted_at = 0 AND d.disabled = 0 AND d.device_id != ?`,
+			[]any{"d", "d"}, "idx_devices_user_label"},
+		{"label uniqueness", `SELECT COUNT(*) FROM devices WHERE user_id = ? AND label = ? AND device_id != ? AND deleted_at = 0`,
+			[]any{"u", "l", "d"}, "idx_devices_user_label"},
+		{"cert report prune", `DELETE FROM cert_reports WHERE created_at < ?`,
+			[]any{0}, "idx_cert_reports_created"},
+		{"enroll event prune", `DELETE FROM enroll_events WHERE created_at < ?`,
+			[]any{0}, "idx_enroll_events_created"},
+		{"transfer receipt prune", `DELETE FROM transfer_receipts WHERE committed_at < ?`,
+			[]any{0}, "idx_transfer_receipts_committed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := queryPlan(t, s, tt.query, tt.args...)
+			used := false
+			for _, step := range plan {
+				if strings.HasPrefix(step, "SCAN ") && !strings.Contains(step, " INDEX ") {
+					t.Errorf("full table scan %q in plan %q", step, plan)
+				}
+				if strings.Contains(step, "INDEX "+tt.index+" ") || strings.HasSuffix(step, "INDEX "+tt.index) {
+					used = true
+				}
+			}
+			if !used {
+				t.Errorf("plan %q does not use %s", plan, tt.index)
+			}
+		})
+	}
+}
+
+func TestSetDeviceDisabled(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer s.Close()
+
+	s.AddDevice(&Device{DeviceID: "dev-1", PubJWKJSON: "{}", CreatedAt: 1})
+	if err := s.SetDeviceDisabled("dev-1", true); err != nil {
+		t.Fatalf("SetDeviceDisabled failed: %v", err)
+	}
+	if d, err := s.GetDevice("dev-1"); err != nil || !d.Disabled {
+		t.Errorf("Expected a disabled device, got %+v, %v", d, err)
+	}
+	if list, _ := s.ListDevices(); len(list) != 1 || !list[0].Disabled {
+		t.Errorf("Disabled devices should stay listed: %+v", list)
+	}
+	s.SetDeviceDisabled("dev-1", false)
+	if d, _ := s.GetDevice("dev-1"); d.Disabled {
+		t.Error("Expected the device to be enabled again")
+	}
+
+	s.DeleteDevice("dev-1", 1000)
+	if err := s.SetDeviceDisabled("dev-1", true); err != ErrDeviceNotFound {
+		t.Errorf("Expected ErrDeviceNotFound for a trashed device, got %v", err)
+	}
+}
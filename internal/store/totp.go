@@ -0,0 +1,86 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var ErrTOTPNotFound = errors.New("totp not configured")
+
+// DeviceTOTP is a device's encrypted TOTP seed. Login only requires a code
+// once the seed is Confirmed.
+type DeviceTOTP struct {
+	DeviceID   string
+	SealedSeed []byte
+	Confirmed  bool
+	LastStep   int64
+	CreatedAt  int64
+}
+
+// SetTOTPSeed stores an unconfirmed seed for deviceID, replacing any earlier
+// unconfirmed one. A confirmed seed is left untouched.
+func (s *Store) SetTOTPSeed(deviceID string, sealed []byte, createdAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT INTO device_totp (device_id, seed, confirmed, last_step, created_at)
+		VALUES (?, ?, 0, 0, ?)
+		ON CONFLICT(device_id) DO UPDATE SET
+			seed = excluded.seed,
+			last_step = 0,
+			created_at = excluded.created_at
+		WHERE device_totp.confirmed = 0`,
+		deviceID, sealed, createdAt,
+	)
+	return err
+}
+
+// GetTOTP returns the TOTP record for deviceID or ErrTOTPNotFound.
+func (s *Store) GetTOTP(deviceID string) (*DeviceTOTP, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t := &DeviceTOTP{DeviceID: deviceID}
+	err := s.db.QueryRow(
+		"SELECT seed, confirmed, last_step, created_at FROM device_totp WHERE device_id = ?",
+		deviceID,
+	).Scan(&t.SealedSeed, &t.Confirmed, &t.LastStep, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// UseTOTPStep records step as consumed and marks the seed confirmed. It
+// reports false when step is not newer than the last one used, which
+// rejects a concurrent replay of the same code.
+func (s *Store) UseTOTPStep(deviceID string, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec(
+		"UPDATE device_totp SET last_step = ?, confirmed = 1 WHERE device_id = ? AND last_step < ?",
+		step, deviceID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DeleteTOTP removes the TOTP seed for deviceID.
+func (s *Store) DeleteTOTP(deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec("DELETE FROM device_totp WHERE device_id = ?", deviceID)
+	return err
+}
@@ -0,0 +1,105 @@
+package store
+
+// Soft-deleted devices stay in the devices table with deleted_at set. GetDevice
+// ignores them, so they can neither log in nor connect, but an admin can
+// restore them with the same key until the janitor purges the row.
+
+// DeleteDevice moves deviceID to the trash at deletedAt (Unix ms). It returns
+// ErrDeviceNotFound if the device does not exist or is already in the trash.
+func (s *Store) DeleteDevice(deviceID string, deletedAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec(
+		"UPDATE devices SET deleted_at = ? WHERE device_id = ? AND deleted_at = 0",
+		deletedAt, deviceID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// RestoreDevice takes deviceID out of the trash. It returns
+// ErrDeviceNotFound if the device is not in the trash.
+func (s *Store) RestoreDevice(deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec(
+		"UPDATE devices SET deleted_at = 0 WHERE device_id = ? AND deleted_at != 0",
+		deviceID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// ListDeletedDevices returns the devices in the trash, most recently deleted
+// first.
+func (s *Store) ListDeletedDevices() ([]Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT device_id, pub_jwk_json, label, created_at, credential_id, sign_count, deleted_at, user_id
+		FROM devices WHERE deleted_at > 0 ORDER BY deleted_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.DeviceID, &d.PubJWKJSON, &d.Label, &d.CreatedAt, &d.CredentialID, &d.SignCount, &d.DeletedAt, &d.UserID); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// PurgeDeletedDevices permanently removes devices trashed before cutoff
+// (Unix ms), together with their TOTP seeds, command allowlists, peer links,
+// auth stats, API tokens and wake targets, and returns the number of devices
+// removed.
+func (s *Store) PurgeDeletedDevices(cutoff int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Links pointing at a purged device are kept so its former peers stay
+	// restricted instead of silently opening up to everyone.
+	const purged = "SELECT device_id FROM devices WHERE deleted_at > 0 AND deleted_at < ?"
+	for _, table := range []string{"device_totp", "device_commands", "device_peers", "device_auth_stats", "api_tokens", "device_wake"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE device_id IN ("+purged+")", cutoff); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.Exec("DELETE FROM devices WHERE deleted_at > 0 AND deleted_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.peers.Store(nil)
+	return n, nil
+}
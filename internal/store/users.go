@@ -0,0 +1,104 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+
+	sqlite "modernc.org/sqlite"
+	lib "modernc.org/sqlite/lib"
+)
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// User is an account with its own shared secret and set of devices.
+// Devices without a user belong to the default account, whose secret is
+// ConfigKeySecretHash.
+type User struct {
+	UserID     string `json:"user_id"`
+	Name       string `json:"name"`
+	SecretHash string `json:"-"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// CreateUser adds u. It returns ErrUserExists when the ID or name is taken.
+func (s *Store) CreateUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(
+		"INSERT INTO users (user_id, name, secret_hash, created_at) VALUES (?, ?, ?, ?)",
+		u.UserID, u.Name, u.SecretHash, u.CreatedAt,
+	)
+	if err != nil {
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) &&
+			(sqliteErr.Code() == lib.SQLITE_CONSTRAINT_PRIMARYKEY ||
+				sqliteErr.Code() == lib.SQLITE_CONSTRAINT_UNIQUE) {
+			return ErrUserExists
+		}
+		return err
+	}
+	return nil
+}
+
+// GetUser returns the user with userID.
+func (s *Store) GetUser(userID string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var u User
+	err := s.db.QueryRow(
+		"SELECT user_id, name, secret_hash, created_at FROM users WHERE user_id = ?", userID,
+	).Scan(&u.UserID, &u.Name, &u.SecretHash, &u.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListUsers returns every user, oldest first.
+func (s *Store) ListUsers() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query("SELECT user_id, name, secret_hash, created_at FROM users ORDER BY created_at, user_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.UserID, &u.Name, &u.SecretHash, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// SetUserSecretHash replaces the secret hash of userID.
+func (s *Store) SetUserSecretHash(userID, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("UPDATE users SET secret_hash = ? WHERE user_id = ?", hash, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var ErrWakeTargetNotFound = errors.New("wake target not found")
+
+// WakeTarget is how to wake a sleeping device: a Wake-on-LAN magic packet
+// for MAC sent to Broadcast, a POST to Webhook, or both.
+type WakeTarget struct {
+	DeviceID  string `json:"device_id"`
+	MAC       string `json:"mac,omitempty"`
+	Broadcast string `json:"broadcast,omitempty"`
+	Webhook   string `json:"webhook,omitempty"`
+}
+
+// SetWakeTarget stores t, replacing the device's previous target. It
+// returns ErrDeviceNotFound for unknown and trashed devices.
+func (s *Store) SetWakeTarget(t WakeTarget) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM devices WHERE device_id = ? AND deleted_at = 0", t.DeviceID).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDeviceNotFound
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO device_wake (device_id, mac, broadcast, webhook) VALUES (?, ?, ?, ?)
+		ON CONFLICT (device_id) DO UPDATE SET mac = excluded.mac, broadcast = excluded.broadcast, webhook = excluded.webhook`,
+		t.DeviceID, t.MAC, t.Broadcast, t.Webhook,
+	)
+	return err
+}
+
+// GetWakeTarget returns the wake target of deviceID, or
+// ErrWakeTargetNotFound.
+func (s *Store) GetWakeTarget(deviceID string) (*WakeTarget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t := WakeTarget{DeviceID: deviceID}
+	err := s.db.QueryRow("SELECT mac, broadcast, webhook FROM device_wake WHERE device_id = ?", deviceID).
+		Scan(&t.MAC, &t.Broadcast, &t.Webhook)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWakeTargetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// DeleteWakeTarget removes the wake target of deviceID. It returns
+// ErrWakeTargetNotFound when there is none.
+func (s *Store) DeleteWakeTarget(deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec("DELETE FROM device_wake WHERE device_id = ?", deviceID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWakeTargetNotFound
+	}
+	return nil
+}
+
+// PeerWakeTargets returns the wake targets of deviceID's user's other
+// devices that are neither trashed nor disabled.
+func (s *Store) PeerWakeTargets(deviceID string) ([]WakeTarget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT w.device_id, w.mac, w.broadcast, w.webhook
+		FROM devices d JOIN device_wake w ON w.device_id = d.device_id
+		WHERE d.user_id = (SELECT user_id FROM devices WHERE device_id = ? AND deleted_at = 0)
+			AND d.deleted_at = 0 AND d.disabled = 0 AND d.device_id != ?
+		ORDER BY w.device_id`,
+		deviceID, deviceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := []WakeTarget{}
+	for rows.Next() {
+		var t WakeTarget
+		if err := rows.Scan(&t.DeviceID, &t.MAC, &t.Broadcast, &t.Webhook); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
@@ -0,0 +1,218 @@
+// Package wake wakes sleeping devices when someone tries to reach them:
+// a Wake-on-LAN magic packet broadcast from the server, a webhook for a
+// home-automation system that can power the machine on, or both.
+//
+// Nothing is queued. The sender is told how long to wait and retries the
+// delivery itself once the device had time to boot and reconnect.
+package wake
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+// DefaultGrace is how long a sender is told to wait for a woken device.
+const DefaultGrace = 45 * time.Second
+
+// DefaultBroadcast is where magic packets go when a target names none.
+const DefaultBroadcast = "255.255.255.255:9"
+
+// webhookTimeout bounds a wake webhook call.
+const webhookTimeout = 5 * time.Second
+
+// Store looks up wake targets. store.Store implements it.
+type Store interface {
+	GetWakeTarget(deviceID string) (*store.WakeTarget, error)
+	PeerWakeTargets(deviceID string) ([]store.WakeTarget, error)
+	PeerAllowed(a, b string) (bool, error)
+}
+
+// Waker fires wake targets, at most once per grace period per device so a
+// sender retrying in a loop cannot flood the LAN or the webhook.
+type Waker struct {
+	store  Store
+	grace  time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	fired map[string]time.Time
+
+	// send delivers a target; tests replace it.
+	send func(store.WakeTarget) error
+}
+
+// New returns a Waker that tells senders to retry after grace, or
+// DefaultGrace if grace is not positive.
+func New(s Store, grace time.Duration) *Waker {
+	if grace <= 0 {
+		grace = DefaultGrace
+	}
+	w := &Waker{
+		store:  s,
+		grace:  grace,
+		client: &http.Client{Timeout: webhookTimeout},
+		fired:  make(map[string]time.Time),
+	}
+	w.send = w.deliver
+	return w
+}
+
+// WakePeers wakes the other devices of deviceID's user that it may reach
+// and returns how long the sender should wait before retrying, or zero if
+// none has a wake target. It satisfies realtime.Waker.
+func (w *Waker) WakePeers(deviceID string) time.Duration {
+	targets, err := w.store.PeerWakeTargets(deviceID)
+	if err != nil {
+		slog.Error("Failed to look up wake targets", "device_id", deviceID, "err", err)
+		return 0
+	}
+	var wait time.Duration
+	for _, t := range targets {
+		if ok, err := w.store.PeerAllowed(deviceID, t.DeviceID); err != nil || !ok {
+			continue
+		}
+		if d := w.fire(t); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// WakeDevice wakes deviceID and returns how long to wait before retrying,
+// or zero if it has no wake target.
+func (w *Waker) WakeDevice(deviceID string) time.Duration {
+	t, err := w.store.GetWakeTarget(deviceID)
+	if err != nil {
+		return 0
+	}
+	return w.fire(*t)
+}
+
+// fire sends t in the background unless it was sent within the grace
+// period, and returns the time left until that period ends.
+func (w *Waker) fire(t store.WakeTarget) time.Duration {
+	now := time.Now()
+	w.mu.Lock()
+	if last, ok := w.fired[t.DeviceID]; ok && now.Sub(last) < w.grace {
+		w.mu.Unlock()
+		return w.grace - now.Sub(last)
+	}
+	w.fired[t.DeviceID] = now
+	for id, last := range w.fired {
+		if now.Sub(last) >= w.grace {
+			delete(w.fired, id)
+		}
+	}
+	w.mu.Unlock()
+
+	go func() {
+		if err := w.send(t); err != nil {
+			slog.Error("Failed to wake device", "device_id", t.DeviceID, "err", err)
+		} else {
+			slog.Info("Woke device", "device_id", t.DeviceID)
+		}
+	}()
+	return w.grace
+}
+
+func (w *Waker) deliver(t store.WakeTarget) error {
+	if t.MAC != "" {
+		if err := SendMagicPacket(t.MAC, t.Broadcast); err != nil {
+			return err
+		}
+	}
+	if t.Webhook != "" {
+		return w.callWebhook(t)
+	}
+	return nil
+}
+
+func (w *Waker) callWebhook(t store.WakeTarget) error {
+	body, err := json.Marshal(map[string]string{"device_id": t.DeviceID, "mac": t.MAC})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// MagicPacket returns the Wake-on-LAN payload for mac: six 0xFF bytes
+// followed by the address repeated sixteen times.
+func MagicPacket(mac net.HardwareAddr) []byte {
+	p := make([]byte, 0, 6+16*len(mac))
+	p = append(p, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	for i := 0; i < 16; i++ {
+		p = append(p, mac...)
+	}
+	return p
+}
+
+// ParseMAC parses a 48-bit MAC address in any notation net.ParseMAC takes.
+func ParseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("wake: %q is not a 48-bit MAC address", s)
+	}
+	return mac, nil
+}
+
+// ValidateBroadcast checks a host:port magic packets can be sent to. The
+// host must be an IPv4 address, since Wake-on-LAN relies on broadcast.
+func ValidateBroadcast(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("wake: %q is not an IPv4 address", host)
+	}
+	if _, err := net.LookupPort("udp", port); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SendMagicPacket broadcasts the magic packet for mac to broadcast, or to
+// DefaultBroadcast when it is empty.
+func SendMagicPacket(mac, broadcast string) error {
+	hw, err := ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if broadcast == "" {
+		broadcast = DefaultBroadcast
+	}
+	conn, err := net.Dial("udp4", broadcast)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(MagicPacket(hw))
+	return err
+}
@@ -0,0 +1,173 @@
+package wake
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lixiansheng/fileflow/internal/store"
+)
+
+type memStore struct {
+	targets map[string]store.WakeTarget
+	blocked map[string]bool
+}
+
+func (m *memStore) GetWakeTarget(deviceID string) (*store.WakeTarget, error) {
+	t, ok := m.targets[deviceID]
+	if !ok {
+		return nil, store.ErrWakeTargetNotFound
+	}
+	return &t, nil
+}
+
+func (m *memStore) PeerWakeTargets(deviceID string) ([]store.WakeTarget, error) {
+	var out []store.WakeTarget
+	for id, t := range m.targets {
+		if id != deviceID {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+func (m *memStore) PeerAllowed(a, b string) (bool, error) {
+	return !m.blocked[b], nil
+}
+
+func TestMagicPacket(t *testing.T) {
+	mac, err := ParseMAC("00-11-22-aa-bb-cc")
+	if err != nil {
+		t.Fatalf("ParseMAC: %v", err)
+	}
+	p := MagicPacket(mac)
+	if len(p) != 102 {
+		t.Fatalf("len = %d, want 102", len(p))
+	}
+	if !bytes.Equal(p[:6], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}) {
+		t.Errorf("header = %x", p[:6])
+	}
+	for i := 0; i < 16; i++ {
+		if !bytes.Equal(p[6+6*i:12+6*i], mac) {
+			t.Fatalf("repetition %d = %x", i, p[6+6*i:12+6*i])
+		}
+	}
+
+	if _, err := ParseMAC("00:11:22:33:44:55:66:77"); err == nil {
+		t.Error("EUI-64 should be rejected")
+	}
+	for addr, ok := range map[string]bool{
+		"192.168.1.255:9": true,
+		"10.0.0.255:7":    true,
+		"[ff02::1]:9":     false,
+		"192.168.1.255":   false,
+		"nas.lan:9":       false,
+	} {
+		if err := ValidateBroadcast(addr); (err == nil) != ok {
+			t.Errorf("ValidateBroadcast(%q) = %v", addr, err)
+		}
+	}
+}
+
+func TestSendMagicPacket(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := SendMagicPacket("00:11:22:33:44:55", conn.LocalAddr().String()); err != nil {
+		t.Fatalf("SendMagicPacket: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 200)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	mac, _ := ParseMAC("00:11:22:33:44:55")
+	if !bytes.Equal(buf[:n], MagicPacket(mac)) {
+		t.Errorf("received %x", buf[:n])
+	}
+}
+
+func TestWaker(t *testing.T) {
+	s := &memStore{
+		targets: map[string]store.WakeTarget{
+			"desktop": {DeviceID: "desktop", MAC: "00:11:22:33:44:55"},
+			"nas":     {DeviceID: "nas", MAC: "00:11:22:33:44:66"},
+			"phone":   {DeviceID: "phone", MAC: "00:11:22:33:44:77"},
+		},
+		blocked: map[string]bool{"nas": true},
+	}
+	w := New(s, time.Minute)
+
+	var mu sync.Mutex
+	sent := map[string]int{}
+	done := make(chan struct{}, 10)
+	w.send = func(t store.WakeTarget) error {
+		mu.Lock()
+		sent[t.DeviceID]++
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	}
+
+	if wait := w.WakePeers("phone"); wait != time.Minute {
+		t.Errorf("wait = %v, want 1m", wait)
+	}
+	<-done
+	// A retry within the grace period reports the time left and sends
+	// nothing new.
+	if wait := w.WakePeers("phone"); wait <= 0 || wait > time.Minute {
+		t.Errorf("second wait = %v", wait)
+	}
+	if wait := w.WakeDevice("desktop"); wait <= 0 {
+		t.Errorf("WakeDevice wait = %v", wait)
+	}
+	if wait := w.WakeDevice("laptop"); wait != 0 {
+		t.Errorf("device without target: wait = %v, want 0", wait)
+	}
+
+	select {
+	case <-done:
+		t.Error("unexpected second send")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sent["desktop"] != 1 || sent["nas"] != 0 || sent["phone"] != 0 {
+		t.Errorf("sent = %v, want only desktop once", sent)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	got := make(chan map[string]string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		got <- body
+	}))
+	defer srv.Close()
+
+	w := New(&memStore{}, 0)
+	if err := w.deliver(store.WakeTarget{DeviceID: "desktop", Webhook: srv.URL}); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if body := <-got; body["device_id"] != "desktop" {
+		t.Errorf("body = %v", body)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	if err := w.deliver(store.WakeTarget{DeviceID: "desktop", Webhook: failing.URL}); err == nil {
+		t.Error("expected an error for a failing webhook")
+	}
+}
@@ -0,0 +1,465 @@
+/**
+ * FileFlow admin page. Signs in with the admin secret and talks to
+ * /api/admin/* with the short-lived token it gets back, which is kept in
+ * sessionStorage so it does not outlive the tab. Calls that change state
+ * are signed with the key that comes with the token.
+ */
+const FileFlowAdmin = (function () {
+    'use strict';
+
+    const TOKEN_KEY = 'ff_admin_token';
+    const SIGNING_KEY = 'ff_admin_signing_key';
+    const COMMANDS = ['open_url', 'ring', 'request_screenshot'];
+
+    const $viewSignin = document.getElementById('view-signin');
+    const $viewMain = document.getElementById('view-main');
+    const $signinForm = document.getElementById('signin-form');
+    const $tokenInput = document.getElementById('token-input');
+    const $signoutButton = document.getElementById('signout-button');
+    const $refreshButton = document.getElementById('refresh-button');
+    const $deviceRows = document.getElementById('device-rows');
+    const $deviceEmpty = document.getElementById('device-empty');
+    const $trashRows = document.getElementById('trash-rows');
+    const $trashEmpty = document.getElementById('trash-empty');
+    const $serverStats = document.getElementById('server-stats');
+    const $detailCard = document.getElementById('detail-card');
+    const $detailTitle = document.getElementById('detail-title');
+    const $detailBody = document.getElementById('detail-body');
+    const $detailClose = document.getElementById('detail-close');
+    const $enrollForm = document.getElementById('enroll-form');
+    const $enrollId = document.getElementById('enroll-id');
+    const $enrollLabel = document.getElementById('enroll-label');
+    const $enrollJwk = document.getElementById('enroll-jwk');
+    const $enrollUser = document.getElementById('enroll-user');
+    const $userRows = document.getElementById('user-rows');
+    const $userForm = document.getElementById('user-form');
+    const $userName = document.getElementById('user-name');
+    const $userSecret = document.getElementById('user-secret');
+    const $toast = document.getElementById('toast');
+
+    let toastTimer = null;
+    let userNames = new Map();
+
+    // ===== API =====
+    // canonicalJSON matches the server's canonical form: object keys
+    // sorted, no whitespace.
+    function canonicalJSON(value) {
+        return JSON.stringify(value, (key, v) => {
+            if (v === null || typeof v !== 'object' || Array.isArray(v)) return v;
+            return Object.fromEntries(Object.keys(v).sort().map((k) => [k, v[k]]));
+        });
+    }
+
+    function b64url(bytes) {
+        return btoa(String.fromCharCode(...new Uint8Array(bytes)))
+            .replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    }
+
+    function b64urlDecode(s) {
+        const bin = atob(s.replace(/-/g, '+').replace(/_/g, '/'));
+        return Uint8Array.from(bin, (c) => c.charCodeAt(0));
+    }
+
+    async function signRequest(headers, method, path, body) {
+        const key = sessionStorage.getItem(SIGNING_KEY);
+        if (!key) return;
+        const timestamp = String(Math.floor(Date.now() / 1000));
+        const nonce = b64url(crypto.getRandomValues(new Uint8Array(16)));
+        const hmacKey = await crypto.subtle.importKey(
+            'raw', b64urlDecode(key), { name: 'HMAC', hash: 'SHA-256' }, false, ['sign']);
+        const message = [method, path, timestamp, nonce, body || ''].join('\n');
+        const sig = await crypto.subtle.sign('HMAC', hmacKey, new TextEncoder().encode(message));
+        headers['X-Admin-Timestamp'] = timestamp;
+        headers['X-Admin-Nonce'] = nonce;
+        headers['X-Admin-Signature'] = b64url(sig);
+    }
+
+    async function api(method, path, body) {
+        const headers = { 'Authorization': `Bearer ${sessionStorage.getItem(TOKEN_KEY) || ''}` };
+        const init = { method, headers };
+        if (body !== undefined) {
+            headers['Content-Type'] = 'application/json';
+            init.body = canonicalJSON(body);
+        }
+        if (method !== 'GET') {
+            await signRequest(headers, method, path, init.body);
+        }
+
+        const res = await fetch(path, init);
+        const data = await res.json().catch(() => ({}));
+        if (res.status === 401) {
+            signOut();
+            throw new Error('Admin session expired; sign in again');
+        }
+        if (!res.ok) {
+            throw new Error((data.error && data.error.message) || `Request failed (${res.status})`);
+        }
+        return data;
+    }
+
+    function devicePath(deviceId, sub) {
+        const base = `/api/admin/devices/${encodeURIComponent(deviceId)}`;
+        return sub ? `${base}/${sub}` : base;
+    }
+
+    // ===== Rendering =====
+    function el(tag, text, className) {
+        const node = document.createElement(tag);
+        if (text !== undefined) node.textContent = text;
+        if (className) node.className = className;
+        return node;
+    }
+
+    function button(label, onClick, className) {
+        const b = el('button', label, className);
+        b.type = 'button';
+        b.addEventListener('click', onClick);
+        return b;
+    }
+
+    function formatTime(ms) {
+        return ms ? new Date(ms).toLocaleString() : '-';
+    }
+
+    function shortId(id) {
+        return id.length > 16 ? `${id.slice(0, 16)}…` : id;
+    }
+
+    function showToast(message, isError) {
+        $toast.textContent = message;
+        $toast.classList.toggle('error', !!isError);
+        $toast.hidden = false;
+        clearTimeout(toastTimer);
+        toastTimer = setTimeout(() => { $toast.hidden = true; }, 4000);
+    }
+
+    async function run(action) {
+        try {
+            await action();
+        } catch (err) {
+            showToast(err.message, true);
+        }
+    }
+
+    function renderDevices(devices) {
+        $deviceRows.replaceChildren();
+        $deviceEmpty.hidden = devices.length > 0;
+        for (const d of devices) {
+            const row = el('tr');
+            row.append(
+                el('td', d.label || '(no label)'),
+                el('td', shortId(d.device_id), 'mono'),
+                el('td', userName(d.user_id)),
+                el('td', formatTime(d.created_at)),
+                el('td', formatTime(d.last_seen)),
+                el('td', d.disabled ? 'disabled' : String(d.live_connections),
+                    d.disabled ? 'disabled' : d.live_connections > 0 ? 'online' : ''),
+            );
+            const actions = el('td', undefined, 'actions');
+            actions.append(
+                button('Details', () => run(() => showDetails(d))),
+                button('Rename', () => run(() => renameDevice(d)), 'secondary'),
+                button(d.disabled ? 'Enable' : 'Disable', () => run(() => setDisabled(d, !d.disabled)), 'secondary'),
+                button('Delete', () => run(() => deleteDevice(d)), 'danger'),
+            );
+            row.append(actions);
+            $deviceRows.append(row);
+        }
+    }
+
+    function userName(userId) {
+        if (!userId) return 'default';
+        return userNames.get(userId) || shortId(userId);
+    }
+
+    function renderUsers(users) {
+        userNames = new Map(users.map((u) => [u.user_id, u.name]));
+
+        $userRows.replaceChildren();
+        for (const u of users) {
+            const row = el('tr');
+            row.append(
+                el('td', u.name),
+                el('td', u.user_id, 'mono'),
+                el('td', formatTime(u.created_at)),
+            );
+            $userRows.append(row);
+        }
+
+        const selected = $enrollUser.value;
+        $enrollUser.replaceChildren(new Option('Default account', ''));
+        for (const u of users) {
+            $enrollUser.append(new Option(u.name, u.user_id));
+        }
+        $enrollUser.value = userNames.has(selected) ? selected : '';
+    }
+
+    function renderTrash(devices) {
+        $trashRows.replaceChildren();
+        $trashEmpty.hidden = devices.length > 0;
+        for (const d of devices) {
+            const row = el('tr');
+            row.append(
+                el('td', d.label || '(no label)'),
+                el('td', shortId(d.device_id), 'mono'),
+                el('td', formatTime(d.deleted_at)),
+            );
+            const actions = el('td', undefined, 'actions');
+            actions.append(button('Restore', () => run(() => restoreDevice(d))));
+            row.append(actions);
+            $trashRows.append(row);
+        }
+    }
+
+    function renderStats(stats) {
+        const { secret_verifier: verifier, realtime } = stats;
+        $serverStats.replaceChildren();
+        for (const [name, value] of [
+            ['Open rooms', realtime.rooms],
+            ['Oversized frames', realtime.oversized_frames],
+            ['Dropped (queue full)', realtime.dropped.full_queue],
+            ['Dropped (no peer)', realtime.dropped.no_peer],
+            ['Dropped (disconnected)', realtime.dropped.unregistered],
+            ['Logins queued', `${verifier.queued} / ${verifier.queue_capacity}`],
+            ['Logins running', `${verifier.running} / ${verifier.workers}`],
+            ['Logins rejected', verifier.rejected],
+            ['Logins timed out', verifier.timed_out],
+        ]) {
+            $serverStats.append(el('dt', name), el('dd', String(value)));
+        }
+    }
+
+    // ===== Actions =====
+    // The device list is paged; the admin page shows every device.
+    async function listDevices() {
+        const devices = [];
+        let offset = 0;
+        do {
+            const page = await api('GET', `/api/admin/devices?limit=500&offset=${offset}`);
+            devices.push(...page.devices);
+            offset = page.next_offset || 0;
+        } while (offset);
+        return devices;
+    }
+
+    async function refresh() {
+        const [users, devices, trash, stats] = await Promise.all([
+            api('GET', '/api/admin/users'),
+            listDevices(),
+            api('GET', '/api/admin/trash'),
+            api('GET', '/api/admin/stats'),
+        ]);
+        renderUsers(users.users);
+        renderDevices(devices);
+        renderTrash(trash.devices);
+        renderStats(stats);
+    }
+
+    async function showDetails(device) {
+        const [impact, commands, connections] = await Promise.all([
+            api('GET', devicePath(device.device_id, 'impact')),
+            api('GET', devicePath(device.device_id, 'commands')),
+            api('GET', devicePath(device.device_id, 'connections') + '?limit=20'),
+        ]);
+
+        $detailTitle.textContent = device.label || shortId(device.device_id);
+        $detailBody.replaceChildren();
+
+        $detailBody.append(el('p', device.device_id, 'mono'));
+
+        const stats = el('dl', undefined, 'stats');
+        for (const [name, value] of [
+            ['Live connections', impact.live_connections],
+            ['Active sessions', impact.active_sessions],
+            ['In-flight messages', impact.in_flight_messages],
+            ['Outstanding challenges', impact.outstanding_challenges],
+        ]) {
+            stats.append(el('dt', name), el('dd', String(value)));
+        }
+        $detailBody.append(stats);
+
+        $detailBody.append(el('h3', 'Allowed commands'));
+        const allowed = new Set(commands.commands);
+        const commandForm = el('form', undefined, 'commands');
+        for (const cmd of COMMANDS) {
+            const label = el('label');
+            const box = el('input');
+            box.type = 'checkbox';
+            box.value = cmd;
+            box.checked = allowed.has(cmd);
+            label.append(box, ` ${cmd}`);
+            commandForm.append(label);
+        }
+        commandForm.append(button('Save commands', () => run(async () => {
+            const selected = [...commandForm.querySelectorAll('input:checked')].map((b) => b.value);
+            await api('PUT', devicePath(device.device_id, 'commands'), { commands: selected });
+            showToast('Commands saved');
+        })));
+        $detailBody.append(commandForm);
+
+        $detailBody.append(el('h3', 'Two-factor'));
+        $detailBody.append(button('Reset TOTP', () => run(async () => {
+            if (!confirm('Remove this device\'s TOTP seed? It can log in with the shared secret alone until it sets TOTP up again.')) return;
+            await api('DELETE', devicePath(device.device_id, 'totp'));
+            showToast('TOTP reset');
+        }), 'secondary'));
+
+        $detailBody.append(el('h3', 'Recent connection attempts'));
+        if (connections.attempts.length === 0) {
+            $detailBody.append(el('p', 'No attempts recorded.', 'hint'));
+        } else {
+            const list = el('ul', undefined, 'attempts');
+            for (const a of connections.attempts) {
+                const reason = a.reason ? ` (${a.reason})` : '';
+                list.append(el('li', `${formatTime(a.created_at)} — ${a.outcome}${reason} from ${a.ip}`));
+            }
+            $detailBody.append(list);
+        }
+
+        $detailCard.hidden = false;
+        $detailCard.scrollIntoView({ behavior: 'smooth' });
+    }
+
+    async function deleteDevice(device) {
+        const impact = await api('GET', devicePath(device.device_id, 'impact'));
+        const name = device.label || shortId(device.device_id);
+        const msg = `Move ${name} to the trash?\n\n` +
+            `This closes ${impact.live_connections} connection(s) and ${impact.active_sessions} session(s). ` +
+            'It can be restored until the trash is purged.';
+        if (!confirm(msg)) return;
+
+        const res = await api('DELETE', devicePath(device.device_id));
+        showToast(`Deleted ${name}; closed ${res.connections_closed} connection(s)`);
+        $detailCard.hidden = true;
+        await refresh();
+    }
+
+    async function renameDevice(device) {
+        const label = prompt('New label', device.label || '');
+        if (label === null || label.trim() === (device.label || '')) return;
+
+        const res = await api('PATCH', devicePath(device.device_id), { label });
+        showToast(`Renamed to ${res.label}`);
+        await refresh();
+    }
+
+    async function setDisabled(device, disabled) {
+        const name = device.label || shortId(device.device_id);
+        if (disabled && !confirm(`Disable ${name}? It is disconnected and cannot sign in until enabled again.`)) return;
+
+        const res = await api('PUT', devicePath(device.device_id, 'state'), { disabled });
+        showToast(disabled
+            ? `Disabled ${name}; closed ${res.connections_closed} connection(s)`
+            : `Enabled ${name}`);
+        await refresh();
+    }
+
+    async function restoreDevice(device) {
+        await api('POST', devicePath(device.device_id, 'restore'));
+        showToast(`Restored ${device.label || shortId(device.device_id)}`);
+        await refresh();
+    }
+
+    async function enrollDevice() {
+        let jwk;
+        try {
+            jwk = JSON.parse($enrollJwk.value);
+        } catch {
+            throw new Error('Public key must be valid JSON');
+        }
+        await api('POST', '/api/admin/devices', {
+            device_id: $enrollId.value.trim(),
+            label: $enrollLabel.value.trim(),
+            pub_jwk: jwk,
+            user_id: $enrollUser.value,
+        });
+        $enrollForm.reset();
+        showToast('Device enrolled');
+        await refresh();
+    }
+
+    async function createUser() {
+        const user = await api('POST', '/api/admin/users', {
+            name: $userName.value.trim(),
+            secret: $userSecret.value,
+        });
+        $userForm.reset();
+        showToast(`Created user ${user.name}`);
+        await refresh();
+    }
+
+    // ===== Session =====
+    function showSignedIn(signedIn) {
+        $viewSignin.hidden = signedIn;
+        $viewMain.hidden = !signedIn;
+        $signoutButton.hidden = !signedIn;
+    }
+
+    function signOut() {
+        const token = sessionStorage.getItem(TOKEN_KEY);
+        if (token) {
+            fetch('/api/admin/logout', {
+                method: 'POST',
+                headers: { 'Authorization': `Bearer ${token}` },
+            }).catch(() => {});
+        }
+        sessionStorage.removeItem(TOKEN_KEY);
+        sessionStorage.removeItem(SIGNING_KEY);
+        $detailCard.hidden = true;
+        showSignedIn(false);
+    }
+
+    async function signIn(secret) {
+        const res = await fetch('/api/admin/login', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ secret }),
+        });
+        const data = await res.json().catch(() => ({}));
+        if (!res.ok) {
+            throw new Error((data.error && data.error.message) || `Sign-in failed (${res.status})`);
+        }
+        sessionStorage.setItem(TOKEN_KEY, data.token);
+        if (data.signing_key) {
+            sessionStorage.setItem(SIGNING_KEY, data.signing_key);
+        } else {
+            sessionStorage.removeItem(SIGNING_KEY);
+        }
+        await refresh();
+        showSignedIn(true);
+    }
+
+    function init() {
+        $signinForm.addEventListener('submit', (e) => {
+            e.preventDefault();
+            run(async () => {
+                await signIn($tokenInput.value);
+                $tokenInput.value = '';
+            });
+        });
+        $signoutButton.addEventListener('click', signOut);
+        $refreshButton.addEventListener('click', () => run(refresh));
+        $detailClose.addEventListener('click', () => { $detailCard.hidden = true; });
+        $enrollForm.addEventListener('submit', (e) => {
+            e.preventDefault();
+            run(enrollDevice);
+        });
+        $userForm.addEventListener('submit', (e) => {
+            e.preventDefault();
+            run(createUser);
+        });
+
+        if (sessionStorage.getItem(TOKEN_KEY)) {
+            run(async () => {
+                await refresh();
+                showSignedIn(true);
+            });
+        } else {
+            showSignedIn(false);
+        }
+    }
+
+    return { init };
+})();
+
+document.addEventListener('DOMContentLoaded', FileFlowAdmin.init);
@@ -0,0 +1,11 @@
+// Package web holds frontend assets that are compiled into the server
+// binary.
+package web
+
+import "embed"
+
+// Admin is the admin page served under /admin/. Unlike web/static it is
+// embedded, so small installs get it without shipping extra files.
+//
+//go:embed admin
+var Admin embed.FS
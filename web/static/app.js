@@ -2,11 +2,27 @@ const FileFlow = (function () {
     'use strict';
 
     const CHUNK_SIZE = 4096;
+    // Largest chunk declared on connect. Phones stay on small frames; the
+    // server grants each message the smallest limit among the peers.
+    const MAX_CHUNK = matchMedia('(pointer: coarse)').matches ? CHUNK_SIZE : 65536;
+    // How long transmit waits for msg_params before using CHUNK_SIZE.
+    const MSG_PARAMS_WAIT_MS = 2000;
+    // Reported to the server on connect; bump it with protocol changes so
+    // MIN_CLIENT_VERSION can turn away clients that no longer fit.
+    const CLIENT_VERSION = '1.2.0';
+    // Sent on connect and relayed to peers in peer_info.
+    const CLIENT_LOCALE = navigator.language || '';
+    const CLIENT_TZ = Intl.DateTimeFormat().resolvedOptions().timeZone || '';
 
     let ws = null;
     let reconnectAttempts = 0;
+    let sessionRefreshTimer = null;
+    let sessionExpiresAt = 0;
     let isOnline = false;
     let activeMessages = new Map();
+    let pausedMessages = new Map();
+    let chunkWaiters = new Map();
+    let peerInfo = new Map();
 
     const $app = document.getElementById('app');
     const $viewSecret = document.getElementById('view-secret');
@@ -16,9 +32,13 @@ const FileFlow = (function () {
     const $secretForm = document.getElementById('secret-form');
     const $secretInput = document.getElementById('secret-input');
     const $secretError = document.getElementById('secret-error');
+    const $otpInput = document.getElementById('otp-input');
+    const $oidcLogin = document.getElementById('oidc-login');
     const $messageStream = document.getElementById('message-stream');
     const $composerInput = document.getElementById('composer-input');
     const $sendButton = document.getElementById('send-button');
+    const $pairButton = document.getElementById('pair-button');
+    const $logoutButton = document.getElementById('logout-button');
 
     async function init() {
         try {
@@ -34,9 +54,11 @@ const FileFlow = (function () {
                     setupComposer();
                     return;
                 }
+                if (data.oidc) $oidcLogin.style.display = '';
             }
             showView('secret');
             setupSecretForm();
+            showLoginError();
         } catch (err) {
             console.error('Initialization failed:', err);
             showView('secret');
@@ -47,8 +69,14 @@ const FileFlow = (function () {
     function showView(view) {
         $viewSecret.style.display = 'none';
         $viewMain.style.display = 'none';
+        $pairButton.style.display = 'none';
+        $logoutButton.style.display = 'none';
         const $viewUnauthorized = document.getElementById('view-unauthorized');
         if ($viewUnauthorized) $viewUnauthorized.style.display = 'none';
+        const $viewUpdate = document.getElementById('view-update');
+        if ($viewUpdate) $viewUpdate.style.display = 'none';
+        const $viewDisabled = document.getElementById('view-disabled');
+        if ($viewDisabled) $viewDisabled.style.display = 'none';
 
         switch (view) {
             case 'secret':
@@ -56,6 +84,10 @@ const FileFlow = (function () {
                 break;
             case 'main':
                 $viewMain.style.display = 'flex';
+                $pairButton.style.display = '';
+                $logoutButton.style.display = '';
+                setupPairButton();
+                setupLogoutButton();
                 break;
             case 'unauthorized':
                 if ($viewUnauthorized) {
@@ -63,58 +95,133 @@ const FileFlow = (function () {
                     setupEnrollForm();
                 }
                 break;
+            case 'update':
+                if ($viewUpdate) $viewUpdate.style.display = 'flex';
+                break;
+            case 'disabled':
+                if ($viewDisabled) $viewDisabled.style.display = 'flex';
+                break;
+        }
+    }
+
+    // showForbidden handles a 403 from the device or login endpoints: a
+    // disabled device waits for an admin, anything else needs enrolling.
+    function showForbidden(data, identity) {
+        if (data.error?.code === 'DEVICE_DISABLED') {
+            showView('disabled');
+            return;
         }
+        showView('unauthorized');
+        const display = document.getElementById('device-id-display');
+        if (display) display.textContent = identity.deviceId;
     }
 
     function setupEnrollForm() {
         const $enrollForm = document.getElementById('enroll-form');
         const $enrollTokenInput = document.getElementById('enroll-token-input');
+        const $pairForm = document.getElementById('pair-form');
+        const $pairCodeInput = document.getElementById('pair-code-input');
+
+        if ($enrollForm && !$enrollForm.dataset.setup) {
+            $enrollForm.dataset.setup = 'true';
+            $enrollForm.addEventListener('submit', (e) => {
+                e.preventDefault();
+                const token = $enrollTokenInput.value.trim();
+                if (!token) return;
+                enrollDevice('/api/admin/devices', { 'X-Admin-Bootstrap': token }, {},
+                    'Enrollment failed. Check your token.');
+            });
+        }
+
+        if ($pairForm && !$pairForm.dataset.setup) {
+            $pairForm.dataset.setup = 'true';
+            $pairForm.addEventListener('submit', (e) => {
+                e.preventDefault();
+                const code = $pairCodeInput.value.trim();
+                if (!code) return;
+                enrollDevice('/api/device/enroll', {}, { code },
+                    'Pairing failed. Check the code or request a new one.');
+            });
+        }
+    }
+
+    async function enrollDevice(url, headers, extra, failMessage) {
         const $enrollError = document.getElementById('enroll-error');
+        $enrollError.textContent = '';
 
-        if (!$enrollForm || $enrollForm.dataset.setup) return;
-        $enrollForm.dataset.setup = 'true';
+        try {
+            const identity = await getOrCreateIdentity();
+            const res = await fetch(url, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json', ...headers },
+                body: JSON.stringify({
+                    ...extra,
+                    device_id: identity.deviceId,
+                    pub_jwk: identity.publicJwk,
+                    label: navigator.userAgent.slice(0, 50)
+                })
+            });
 
-        $enrollForm.addEventListener('submit', async (e) => {
-            e.preventDefault();
-            $enrollError.textContent = '';
+            const data = await res.json();
 
-            const token = $enrollTokenInput.value.trim();
-            if (!token) return;
+            if (res.ok && data.added) {
+                // Re-try the device ticket flow
+                const ticketOk = await ensureDeviceTicket();
+                if (ticketOk) {
+                    showView('secret');
+                    setupSecretForm();
+                }
+            } else {
+                $enrollError.textContent = data.error?.message || failMessage;
+            }
+        } catch (err) {
+            console.error('Enrollment failed:', err);
+            $enrollError.textContent = 'Network error. Please try again.';
+        }
+    }
 
-            try {
-                const identity = await getOrCreateIdentity();
-                const res = await fetch('/api/admin/devices', {
-                    method: 'POST',
-                    headers: {
-                        'Content-Type': 'application/json',
-                        'X-Admin-Bootstrap': token
-                    },
-                    body: JSON.stringify({
-                        device_id: identity.deviceId,
-                        pub_jwk: identity.publicJwk,
-                        label: navigator.userAgent.slice(0, 50)
-                    })
-                });
+    // Shows a one-time code another device can use to enroll itself.
+    function setupPairButton() {
+        if ($pairButton.dataset.setup) return;
+        $pairButton.dataset.setup = 'true';
 
+        let resetTimer = null;
+        $pairButton.addEventListener('click', async () => {
+            try {
+                const res = await fetch('/api/device/pairing-code', { method: 'POST' });
                 const data = await res.json();
-
-                if (res.ok && data.added) {
-                    // Re-try the device ticket flow
-                    const ticketOk = await ensureDeviceTicket();
-                    if (ticketOk) {
-                        showView('secret');
-                        setupSecretForm();
-                    }
-                } else {
-                    $enrollError.textContent = data.error?.message || 'Enrollment failed. Check your token.';
+                if (!res.ok) {
+                    $pairButton.textContent = 'Pairing unavailable';
+                    return;
                 }
+                $pairButton.textContent = `Code: ${data.code.slice(0, 4)}-${data.code.slice(4)}`;
+                clearTimeout(resetTimer);
+                resetTimer = setTimeout(() => {
+                    $pairButton.textContent = 'Pair device';
+                }, Math.max(0, data.expires_at - Date.now()));
             } catch (err) {
-                console.error('Enrollment failed:', err);
-                $enrollError.textContent = 'Network error. Please try again.';
+                console.error('Pairing code request failed:', err);
             }
         });
     }
 
+    // Signs out for shared computers: the server revokes the session and
+    // expires both cookies, and the reload drops the messages on screen.
+    function setupLogoutButton() {
+        if ($logoutButton.dataset.setup) return;
+        $logoutButton.dataset.setup = 'true';
+
+        $logoutButton.addEventListener('click', async () => {
+            $logoutButton.disabled = true;
+            try {
+                await fetch('/api/logout', { method: 'POST', credentials: 'include' });
+            } catch (err) {
+                console.error('Logout failed:', err);
+            }
+            location.reload();
+        });
+    }
+
     let identityPromise = null;
     let ticketPromise = null;
 
@@ -201,12 +308,32 @@ const FileFlow = (function () {
         }
     }
 
+    // Longest Retry-After a background request waits out before giving up.
+    const MAX_AUTO_RETRY_S = 10;
+
+    // Seconds a 429 or 503 response asks us to wait, or 0.
+    function retryAfter(res) {
+        if (res.status !== 429 && res.status !== 503) return 0;
+        const s = parseInt(res.headers.get('Retry-After'), 10);
+        return s > 0 ? s : 1;
+    }
+
+    // fetch that waits out one short Retry-After, for requests the user
+    // did not start and should not have to repeat.
+    async function fetchRetrying(url, init) {
+        const res = await fetch(url, init);
+        const wait = retryAfter(res);
+        if (wait === 0 || wait > MAX_AUTO_RETRY_S) return res;
+        await new Promise(resolve => setTimeout(resolve, wait * 1000));
+        return fetch(url, init);
+    }
+
     async function ensureDeviceTicket() {
         if (ticketPromise) return ticketPromise;
         ticketPromise = (async () => {
             const identity = await getOrCreateIdentity();
 
-            const challengeRes = await fetch('/api/device/challenge', {
+            const challengeRes = await fetchRetrying('/api/device/challenge', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 credentials: 'include',
@@ -217,9 +344,7 @@ const FileFlow = (function () {
             });
 
             if (challengeRes.status === 403) {
-                showView('unauthorized');
-                const display = document.getElementById('device-id-display');
-                if (display) display.textContent = identity.deviceId;
+                showForbidden(await challengeRes.json().catch(() => ({})), identity);
                 return false;
             }
 
@@ -235,7 +360,7 @@ const FileFlow = (function () {
                 nonceBytes
             );
 
-            const attestRes = await fetch('/api/device/attest', {
+            const attestRes = await fetchRetrying('/api/device/attest', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 credentials: 'include',
@@ -247,9 +372,7 @@ const FileFlow = (function () {
             });
 
             if (attestRes.status === 403) {
-                showView('unauthorized');
-                const display = document.getElementById('device-id-display');
-                if (display) display.textContent = identity.deviceId;
+                showForbidden(await attestRes.json().catch(() => ({})), identity);
                 return false;
             }
 
@@ -267,6 +390,27 @@ const FileFlow = (function () {
         }
     }
 
+    // The OIDC endpoints send the browser back with ?login_error=<reason>
+    // when a sign-in at the identity provider did not work out.
+    const LOGIN_ERRORS = {
+        oidc_denied: 'Sign-in was cancelled at your identity provider.',
+        oidc_not_allowed: 'Your account is not allowed to sign in here.',
+        oidc_unavailable: 'The identity provider is unavailable. Please try again later.',
+        totp_required: 'This device uses a one-time code. Sign in with the secret and your code instead.',
+        device_not_enrolled: 'This device is not enrolled.',
+        device_disabled: 'This device has been disabled by an administrator.',
+    };
+
+    function showLoginError() {
+        const params = new URLSearchParams(location.search);
+        const reason = params.get('login_error');
+        if (!reason) return;
+        $secretError.textContent = LOGIN_ERRORS[reason] || 'Sign-in failed. Please try again.';
+        params.delete('login_error');
+        const query = params.toString();
+        history.replaceState(null, '', location.pathname + (query ? `?${query}` : '') + location.hash);
+    }
+
     function setupSecretForm() {
         $secretForm.addEventListener('submit', async (e) => {
             e.preventDefault();
@@ -286,23 +430,38 @@ const FileFlow = (function () {
                     credentials: 'include',
                     body: JSON.stringify({
                         secret,
-                        device_id: identity.deviceId
+                        device_id: identity.deviceId,
+                        otp: $otpInput.value.trim()
                     })
                 });
 
                 const data = await res.json();
 
-                if (res.status === 403 && data.error?.code === 'DEVICE_NOT_ENROLLED') {
-                    showView('unauthorized');
-                    const display = document.getElementById('device-id-display');
-                    if (display) display.textContent = identity.deviceId;
+                if (res.status === 403 && data.error) {
+                    showForbidden(data, identity);
+                    return;
+                }
+
+                const wait = retryAfter(res);
+                if (wait > 0) {
+                    const reason = res.status === 429 ? 'Too many attempts.' : 'The server is busy.';
+                    $secretError.textContent = `${reason} Please wait ${wait} seconds and try again.`;
                     return;
                 }
 
                 if (data.authed) {
+                    $otpInput.value = '';
+                    $otpInput.style.display = 'none';
                     showView('main');
                     connectWebSocket();
                     setupComposer();
+                } else if (data.otp_required) {
+                    $secretError.textContent = $otpInput.value
+                        ? 'Invalid code. Please try again.'
+                        : 'Enter the code from your authenticator app.';
+                    $otpInput.value = '';
+                    $otpInput.style.display = '';
+                    $otpInput.focus();
                 } else {
                     $secretError.textContent = 'Invalid secret. Please try again.';
                     $secretInput.value = '';
@@ -317,11 +476,15 @@ const FileFlow = (function () {
 
     function connectWebSocket() {
         const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
-        ws = new WebSocket(`${protocol}//${location.host}/ws`);
+        const version = encodeURIComponent(CLIENT_VERSION);
+        const locale = encodeURIComponent(CLIENT_LOCALE);
+        const tz = encodeURIComponent(CLIENT_TZ);
+        ws = new WebSocket(`${protocol}//${location.host}/ws?client_version=${version}&max_chunk=${MAX_CHUNK}&locale=${locale}&tz=${tz}`);
 
         ws.onopen = () => {
             reconnectAttempts = 0;
             updatePresence(1, 2);
+            if (!sessionRefreshTimer) refreshSession();
         };
 
         ws.onmessage = (event) => {
@@ -333,8 +496,23 @@ const FileFlow = (function () {
             }
         };
 
-        ws.onclose = () => {
+        ws.onclose = (event) => {
             updatePresence(0, 2);
+            // 4001: an admin deleted this device; reconnecting cannot succeed.
+            if (event.code === 4001) {
+                showView('unauthorized');
+                return;
+            }
+            // 4003: an admin disabled this device until they enable it.
+            if (event.code === 4003) {
+                showView('disabled');
+                return;
+            }
+            // 4002: this client is older than the server accepts.
+            if (event.code === 4002) {
+                showView('update');
+                return;
+            }
             checkSessionAndReconnect();
         };
 
@@ -343,6 +521,28 @@ const FileFlow = (function () {
         };
     }
 
+    // Keep the session alive while the page is open. The server caps the
+    // total lifetime, so stop once a refresh no longer moves the expiry.
+    async function refreshSession() {
+        sessionRefreshTimer = null;
+        try {
+            // The session is bound to this device, so refresh needs a live ticket.
+            if (!(await ensureDeviceTicket())) return;
+            const res = await fetch('/api/session/refresh', {
+                method: 'POST',
+                credentials: 'include'
+            });
+            if (!res.ok) return;
+            const data = await res.json();
+            if (data.expires_at <= sessionExpiresAt) return;
+            sessionExpiresAt = data.expires_at;
+            const delay = Math.max((data.expires_at - Date.now()) / 2, 60000);
+            sessionRefreshTimer = setTimeout(refreshSession, delay);
+        } catch (err) {
+            sessionRefreshTimer = setTimeout(refreshSession, 60000);
+        }
+    }
+
     async function checkSessionAndReconnect() {
         try {
             const ticketOk = await ensureDeviceTicket();
@@ -398,7 +598,59 @@ const FileFlow = (function () {
             case 'send_fail':
                 handleSendFail(event);
                 break;
+            case 'msg_params':
+                resolveChunkSize(event.v.msgId, event.v.chunk);
+                break;
+            case 'peer_info':
+                peerInfo.set(event.v.msgId, event.v);
+                break;
+            case 'msg_commit':
+                handleMsgCommit(event);
+                break;
+            case 'msg_abort':
+                handleMsgAbort(event);
+                break;
+            case 'pause':
+                handlePause(event);
+                break;
+            case 'resume':
+                handleResume(event);
+                break;
+            case 'cmd':
+                handleCmd(event);
+                break;
+            case 'push':
+                handlePush(event);
+                break;
+            case 'cmd_status':
+            case 'cmd_result':
+                console.log(event.t, event.v);
+                break;
+            case 'update_required':
+            case 'update_recommended':
+                handleUpdate(event);
+                break;
+        }
+    }
+
+    function handleUpdate(event) {
+        const { version, url } = event.v;
+        if (event.t === 'update_required') {
+            document.getElementById('update-text').textContent =
+                `This version of FileFlow (${CLIENT_VERSION}) is no longer supported. Version ${version} or newer is required.`;
+            const $link = document.getElementById('update-link');
+            $link.href = url || '/';
+            return;
         }
+
+        const $banner = document.getElementById('update-banner');
+        $banner.replaceChildren(`FileFlow ${version} is available. `);
+        const $link = document.createElement('a');
+        $link.className = 'update-link';
+        $link.href = url || '/';
+        $link.textContent = 'Update';
+        $banner.append($link);
+        $banner.hidden = false;
     }
 
     function updatePresence(online, required) {
@@ -420,16 +672,54 @@ const FileFlow = (function () {
 
     function handleMsgStart(event) {
         const msgId = event.v.msgId;
+        if (event.v.atomic) {
+            // Atomic content stays off-screen until the server commits it;
+            // meanwhile show a placeholder the user can pause.
+            const bubble = createMessageBubble(msgId, 'received');
+            stampBubble(bubble, event);
+            bubble.classList.add('pending');
+            bubble.querySelector('.message-content').textContent = 'Receiving…';
+            bubble.appendChild(createFlowButton(msgId));
+            $messageStream.appendChild(bubble);
+            activeMessages.set(msgId, { atomic: true, bubble, paragraphs: [] });
+            scrollToBottom();
+            return;
+        }
         const bubble = createMessageBubble(msgId, 'received');
+        stampBubble(bubble, event);
         $messageStream.appendChild(bubble);
         activeMessages.set(msgId, { bubble, paragraphs: [] });
         scrollToBottom();
     }
 
+    // Received messages are dated by the server's server_ts; the sender's
+    // ts comes from its own clock and may be skewed. When the sender sent
+    // peer_info, the tooltip also gives the time as the sender saw it.
+    function stampBubble(bubble, event) {
+        const at = event.server_ts || event.ts;
+        bubble.dataset.serverTs = at;
+        bubble.title = new Date(at).toLocaleString();
+
+        const info = peerInfo.get(event.v.msgId);
+        peerInfo.delete(event.v.msgId);
+        if (!info) return;
+        try {
+            const theirs = new Date(at).toLocaleString(info.locale || undefined, { timeZone: info.tz || undefined, timeZoneName: 'short' });
+            bubble.title += `\nSender's time: ${theirs}`;
+        } catch (err) {
+            // An unknown locale or time zone leaves the local time alone.
+        }
+    }
+
     function handleParaStart(event) {
         const state = activeMessages.get(event.v.msgId);
         if (!state) return;
 
+        if (state.atomic) {
+            state.paragraphs[event.v.i] = '';
+            return;
+        }
+
         const para = document.createElement('div');
         para.className = 'paragraph';
         para.dataset.index = event.v.i;
@@ -441,6 +731,13 @@ const FileFlow = (function () {
         const state = activeMessages.get(event.v.msgId);
         if (!state) return;
 
+        if (state.atomic) {
+            if (state.paragraphs[event.v.i] !== undefined) {
+                state.paragraphs[event.v.i] += event.v.s;
+            }
+            return;
+        }
+
         const para = state.paragraphs[event.v.i];
         if (para) {
             para.textContent += event.v.s;
@@ -453,12 +750,119 @@ const FileFlow = (function () {
 
     function handleMsgEnd(event) {
         const state = activeMessages.get(event.v.msgId);
-        if (!state) return;
+        if (!state || state.atomic) return;
 
         sendEvent('ack', { msgId: event.v.msgId });
         activeMessages.delete(event.v.msgId);
     }
 
+    // Text an app token sent through /api/push arrives whole, with the
+    // token's name in from.
+    function handlePush(event) {
+        const { pushId, from, text } = event.v;
+        const bubble = createMessageBubble(pushId, 'received');
+        stampBubble(bubble, event);
+        const content = bubble.querySelector('.message-content');
+        for (const part of text.split('\n\n')) {
+            const para = document.createElement('div');
+            para.className = 'paragraph';
+            para.textContent = part;
+            content.appendChild(para);
+        }
+        const label = document.createElement('div');
+        label.className = 'message-status';
+        label.textContent = `From ${from}`;
+        bubble.appendChild(label);
+        $messageStream.appendChild(bubble);
+        scrollToBottom();
+    }
+
+    function handleMsgCommit(event) {
+        const msgId = event.v.msgId;
+        const state = activeMessages.get(msgId);
+        if (!state) {
+            // Our own message: the server accepted it.
+            const bubble = document.querySelector(`[data-msg-id="${msgId}"]`);
+            const status = bubble && bubble.querySelector('.message-status');
+            if (status && status.textContent === 'Sending...') {
+                status.textContent = 'Sent';
+            }
+            return;
+        }
+        if (!state.atomic) return;
+
+        const bubble = state.bubble;
+        bubble.classList.remove('pending');
+        const flowBtn = bubble.querySelector('.flow-button');
+        if (flowBtn) flowBtn.remove();
+        const content = bubble.querySelector('.message-content');
+        content.textContent = '';
+        for (const text of state.paragraphs) {
+            if (text === undefined) continue;
+            const p = document.createElement('div');
+            p.className = 'paragraph';
+            p.textContent = text;
+            content.appendChild(p);
+        }
+        scrollToBottom();
+
+        sendEvent('ack', { msgId });
+        activeMessages.delete(msgId);
+    }
+
+    function handleMsgAbort(event) {
+        const state = activeMessages.get(event.v.msgId);
+        if (state && state.bubble) {
+            state.bubble.remove();
+        }
+        activeMessages.delete(event.v.msgId);
+    }
+
+    function createFlowButton(msgId) {
+        const btn = document.createElement('button');
+        btn.className = 'flow-button';
+        btn.textContent = 'Pause';
+        btn.onclick = () => {
+            const pausing = btn.textContent === 'Pause';
+            sendEvent(pausing ? 'pause' : 'resume', { msgId });
+            btn.textContent = pausing ? 'Resume' : 'Pause';
+        };
+        return btn;
+    }
+
+    // The receiver asked us to stop streaming msgId; sendMessage awaits
+    // waitIfPaused before every chunk.
+    function handlePause(event) {
+        const msgId = event.v.msgId;
+        if (!pausedMessages.has(msgId)) {
+            pausedMessages.set(msgId, []);
+        }
+        setSentStatus(msgId, 'Paused by receiver');
+    }
+
+    function handleResume(event) {
+        releasePaused(event.v.msgId);
+        setSentStatus(event.v.msgId, 'Sending...');
+    }
+
+    function releasePaused(msgId) {
+        const waiters = pausedMessages.get(msgId);
+        pausedMessages.delete(msgId);
+        if (waiters) waiters.forEach(resolve => resolve());
+    }
+
+    function waitIfPaused(msgId) {
+        const waiters = pausedMessages.get(msgId);
+        if (!waiters) return Promise.resolve();
+        return new Promise(resolve => waiters.push(resolve));
+    }
+
+    function setSentStatus(msgId, text) {
+        const bubble = document.querySelector(`[data-msg-id="${msgId}"]`);
+        const status = bubble && bubble.querySelector('.message-status');
+        if (status) status.textContent = text;
+    }
+
     function handleAck(event) {
         const bubble = document.querySelector(`[data-msg-id="${event.v.msgId}"]`);
         if (bubble) {
@@ -469,12 +873,31 @@ const FileFlow = (function () {
         }
     }
 
+    // Messages already retried once after the server woke a sleeping peer.
+    const wakeRetried = new Set();
+
     function handleSendFail(event) {
+        releasePaused(event.v.msgId);
+        resolveChunkSize(event.v.msgId, CHUNK_SIZE);
         const bubble = document.querySelector(`[data-msg-id="${event.v.msgId}"]`);
+        if (bubble && event.v.reason === 'peer_waking' && !wakeRetried.has(event.v.msgId)) {
+            // The server only wakes the peer; the text stays here and is
+            // sent again once it had time to boot and reconnect.
+            wakeRetried.add(event.v.msgId);
+            setSentStatus(event.v.msgId, 'Waking device...');
+            setTimeout(() => {
+                const paragraphs = Array.from(bubble.querySelector('.message-content').children)
+                    .map(p => p.textContent);
+                setSentStatus(event.v.msgId, 'Sending...');
+                transmit(event.v.msgId, paragraphs);
+            }, event.v.retry_after || 0);
+            return;
+        }
         if (bubble) {
             const status = bubble.querySelector('.message-status');
             if (status) {
-                status.textContent = event.v.reason === 'peer_offline' ? 'Peer offline' : 'Failed';
+                const offline = event.v.reason === 'peer_offline' || event.v.reason === 'peer_waking';
+                status.textContent = offline ? 'Peer offline' : 'Failed';
                 status.classList.add('error');
             }
         }
@@ -578,30 +1001,118 @@ const FileFlow = (function () {
         $messageStream.appendChild(bubble);
         scrollToBottom();
 
-        sendEvent('msg_start', { msgId });
+        await transmit(msgId, paragraphs);
+    }
+
+    async function transmit(msgId, paragraphs) {
+        const sha256 = await checksum(paragraphs.join(''));
+
+        const granted = waitChunkSize(msgId);
+        sendEvent('msg_start', { msgId, atomic: true });
+        const size = await granted;
 
         for (let i = 0; i < paragraphs.length; i++) {
             sendEvent('para_start', { msgId, i });
 
-            const chunks = chunkText(paragraphs[i]);
+            const chunks = chunkText(paragraphs[i], size);
             for (const chunk of chunks) {
+                await waitIfPaused(msgId);
                 sendEvent('para_chunk', { msgId, i, s: chunk });
             }
 
             sendEvent('para_end', { msgId, i });
         }
 
-        sendEvent('msg_end', { msgId });
+        sendEvent('msg_end', { msgId, sha256 });
+    }
+
+    // Resolves with the chunk size msg_params grants msgId, or CHUNK_SIZE
+    // if the server does not answer in time.
+    function waitChunkSize(msgId) {
+        return new Promise(resolve => {
+            chunkWaiters.set(msgId, resolve);
+            setTimeout(() => resolveChunkSize(msgId, CHUNK_SIZE), MSG_PARAMS_WAIT_MS);
+        });
+    }
+
+    function resolveChunkSize(msgId, size) {
+        const resolve = chunkWaiters.get(msgId);
+        if (!resolve) return;
+        chunkWaiters.delete(msgId);
+        resolve(size >= CHUNK_SIZE ? size : CHUNK_SIZE);
+    }
+
+    // Hex SHA-256 of the UTF-8 text of every chunk in send order; the server
+    // recomputes it before committing an atomic message.
+    async function checksum(text) {
+        const digest = await crypto.subtle.digest('SHA-256', new TextEncoder().encode(text));
+        return Array.from(new Uint8Array(digest))
+            .map(b => b.toString(16).padStart(2, '0'))
+            .join('');
     }
 
     function parseParagraphs(text) {
         return text.split(/\n\n+/).filter(p => p.length > 0);
     }
 
-    function* chunkText(text) {
-        for (let i = 0; i < text.length; i += CHUNK_SIZE) {
-            yield text.slice(i, i + CHUNK_SIZE);
+    function* chunkText(text, size) {
+        for (let i = 0; i < text.length;) {
+            let end = Math.min(i + size, text.length);
+            // Never split a surrogate pair: a lone half does not survive JSON
+            // round-tripping and would break the atomic checksum.
+            const code = text.charCodeAt(end - 1);
+            if (end < text.length && code >= 0xd800 && code <= 0xdbff) {
+                end--;
+            }
+            yield text.slice(i, end);
+            i = end;
+        }
+    }
+
+    // A paired device asked us to run an action this device allowlisted.
+    // Anything that leaves the page needs the user's explicit consent.
+    function handleCmd(event) {
+        const { cmdId, from, action, args } = event.v;
+        const reply = (ok, error) => sendEvent('cmd_result', { cmdId, to: from, ok, error });
+
+        switch (action) {
+            case 'open_url': {
+                if (!confirm(`${from} wants to open:\n${args.url}`)) {
+                    reply(false, 'declined');
+                    return;
+                }
+                window.open(args.url, '_blank', 'noopener');
+                reply(true);
+                return;
+            }
+            case 'ring':
+                ring();
+                reply(true);
+                return;
+            case 'request_screenshot': {
+                // Capture itself stays a manual step; this only relays consent.
+                const allowed = confirm(`${from} is asking you to share a screenshot. Allow?`);
+                reply(allowed, allowed ? undefined : 'declined');
+                return;
+            }
+            default:
+                reply(false, 'unsupported');
+        }
+    }
+
+    function ring() {
+        if (navigator.vibrate) {
+            navigator.vibrate([200, 100, 200]);
         }
+        const Ctx = window.AudioContext || window.webkitAudioContext;
+        if (!Ctx) return;
+        const ctx = new Ctx();
+        const osc = ctx.createOscillator();
+        osc.frequency.value = 880;
+        osc.connect(ctx.destination);
+        osc.start();
+        osc.stop(ctx.currentTime + 0.6);
+        osc.onended = () => ctx.close();
     }
 
     function sendEvent(type, value) {